@@ -0,0 +1,170 @@
+package netem
+
+//
+// Throughput and latency assertions for tests
+//
+
+import (
+	"context"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// TestingT is the subset of [testing.TB] used by the helpers in this file,
+// which allows using them without importing the testing package.
+type TestingT interface {
+	Fatalf(format string, args ...any)
+	Helper()
+	Logf(format string, args ...any)
+}
+
+// MustRunNDT0 runs an NDT0 server using serverStack and the given IP address and
+// port along with an NDT0 client using clientStack and returns the performance
+// samples collected by the client. The options may be nil, in which case we use
+// the defaults. This function fails the test if the client or the server fail or
+// if we did not collect the final sample. The ctx bounds the measurement runtime,
+// therefore, you typically want to use a context with a timeout.
+func MustRunNDT0(
+	t TestingT,
+	ctx context.Context,
+	clientStack UnderlyingNetwork,
+	serverStack UnderlyingNetwork,
+	serverIPAddr string,
+	serverPort int,
+	TLS bool,
+	options *NDT0Options,
+) []*NDT0PerformanceSample {
+	t.Helper()
+	if options == nil {
+		options = &NDT0Options{}
+	}
+
+	// start the server in the background
+	ready, serverErrorCh := make(chan net.Listener, 1), make(chan error, 1)
+	go RunNDT0ServerWithOptions(
+		ctx,
+		serverStack,
+		net.ParseIP(serverIPAddr),
+		serverPort,
+		&NullLogger{},
+		ready,
+		serverErrorCh,
+		TLS,
+		options,
+	)
+	select {
+	case listener := <-ready:
+		defer listener.Close()
+	case err := <-serverErrorCh:
+		t.Fatalf("netem: MustRunNDT0: server: %s", err.Error())
+	}
+
+	// run the client and collect the samples
+	clientErrorCh := make(chan error, 1)
+	perfch := make(chan *NDT0PerformanceSample)
+	go RunNDT0ClientWithOptions(
+		ctx,
+		clientStack,
+		net.JoinHostPort(serverIPAddr, strconv.Itoa(serverPort)),
+		&NullLogger{},
+		TLS,
+		options,
+		clientErrorCh,
+		perfch,
+	)
+	var samples []*NDT0PerformanceSample
+	for sample := range perfch {
+		samples = append(samples, sample)
+	}
+
+	// make sure that neither the client nor the server failed
+	if err := <-clientErrorCh; err != nil {
+		t.Fatalf("netem: MustRunNDT0: client: %s", err.Error())
+	}
+	if err := <-serverErrorCh; err != nil {
+		t.Fatalf("netem: MustRunNDT0: server: %s", err.Error())
+	}
+	if len(samples) <= 0 || !samples[len(samples)-1].Final {
+		t.Fatalf("netem: MustRunNDT0: did not collect the final sample")
+	}
+	return samples
+}
+
+// MedianSpeedMbps returns the median of the average download speed of the
+// given samples in Mbit/s, which is less sensitive than the final average
+// speed to the initial TCP slow start, or zero if there are no samples.
+func MedianSpeedMbps(samples []*NDT0PerformanceSample) float64 {
+	var values []float64
+	for _, sample := range samples {
+		values = append(values, sample.AvgSpeedMbps())
+	}
+	if len(values) <= 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	return values[len(values)/2]
+}
+
+// MedianRTT returns the median of the given round-trip times or zero.
+func MedianRTT(rtts []time.Duration) time.Duration {
+	return responsivenessMedian(rtts)
+}
+
+// AssertMedianSpeedBelow fails the test unless the [MedianSpeedMbps] of the
+// given samples is below the expectation expressed in Mbit/s.
+func AssertMedianSpeedBelow(t TestingT, samples []*NDT0PerformanceSample, expectation float64) {
+	t.Helper()
+	speed := MedianSpeedMbps(samples)
+	t.Logf("netem: median speed %f Mbit/s; expected below %f Mbit/s", speed, expectation)
+	if speed >= expectation {
+		t.Fatalf("netem: median speed %f Mbit/s is not below %f Mbit/s", speed, expectation)
+	}
+}
+
+// AssertMedianSpeedAbove fails the test unless the [MedianSpeedMbps] of the
+// given samples is above the expectation expressed in Mbit/s.
+func AssertMedianSpeedAbove(t TestingT, samples []*NDT0PerformanceSample, expectation float64) {
+	t.Helper()
+	speed := MedianSpeedMbps(samples)
+	t.Logf("netem: median speed %f Mbit/s; expected above %f Mbit/s", speed, expectation)
+	if speed <= expectation {
+		t.Fatalf("netem: median speed %f Mbit/s is not above %f Mbit/s", speed, expectation)
+	}
+}
+
+// AssertMedianSpeedWithin fails the test unless the [MedianSpeedMbps] of the given
+// samples is within the given relative tolerance (e.g., 0.1 for 10%) of the
+// expectation expressed in Mbit/s.
+func AssertMedianSpeedWithin(t TestingT, samples []*NDT0PerformanceSample, expectation, tolerance float64) {
+	t.Helper()
+	speed := MedianSpeedMbps(samples)
+	t.Logf("netem: median speed %f Mbit/s; expected %f Mbit/s ± %.0f%%", speed, expectation, tolerance*100)
+	if math.Abs(speed-expectation) > expectation*tolerance {
+		t.Fatalf("netem: median speed %f Mbit/s is not within %.0f%% of %f Mbit/s", speed, tolerance*100, expectation)
+	}
+}
+
+// AssertMedianRTTAbove fails the test unless the [MedianRTT] of
+// the given round-trip times is above the expectation.
+func AssertMedianRTTAbove(t TestingT, rtts []time.Duration, expectation time.Duration) {
+	t.Helper()
+	rtt := MedianRTT(rtts)
+	t.Logf("netem: median RTT %s; expected above %s", rtt, expectation)
+	if rtt <= expectation {
+		t.Fatalf("netem: median RTT %s is not above %s", rtt, expectation)
+	}
+}
+
+// AssertMedianRTTBelow fails the test unless the [MedianRTT] of
+// the given round-trip times is below the expectation.
+func AssertMedianRTTBelow(t TestingT, rtts []time.Duration, expectation time.Duration) {
+	t.Helper()
+	rtt := MedianRTT(rtts)
+	t.Logf("netem: median RTT %s; expected below %s", rtt, expectation)
+	if rtt >= expectation {
+		t.Fatalf("netem: median RTT %s is not below %s", rtt, expectation)
+	}
+}
@@ -0,0 +1,112 @@
+package netem
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeTestingT is a [TestingT] recording whether the test failed.
+type fakeTestingT struct {
+	failed bool
+}
+
+func (ft *fakeTestingT) Fatalf(format string, args ...any) {
+	ft.failed = true
+}
+
+func (ft *fakeTestingT) Helper() {}
+
+func (ft *fakeTestingT) Logf(format string, args ...any) {
+	_ = fmt.Sprintf(format, args...)
+}
+
+func TestAssertions(t *testing.T) {
+	// the average speed of these samples is 8, 16, and 24 Mbit/s
+	samples := []*NDT0PerformanceSample{}
+	for idx := 1; idx <= 3; idx++ {
+		samples = append(samples, &NDT0PerformanceSample{
+			ReceivedTotal: int64(idx) * 1000 * 1000,
+			TimeNow:       time.Unix(1, 0),
+			TimeZero:      time.Unix(0, 0),
+		})
+	}
+	rtts := []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond}
+
+	if MedianSpeedMbps(samples) != 16 || MedianSpeedMbps(nil) != 0 {
+		t.Fatal("unexpected median speed")
+	}
+	if MedianRTT(rtts) != 20*time.Millisecond {
+		t.Fatal("unexpected median RTT")
+	}
+
+	type testcase struct {
+		name   string
+		assert func(t TestingT)
+		failed bool
+	}
+	testcases := []testcase{{
+		name:   "speed below",
+		assert: func(t TestingT) { AssertMedianSpeedBelow(t, samples, 17) },
+		failed: false,
+	}, {
+		name:   "speed not below",
+		assert: func(t TestingT) { AssertMedianSpeedBelow(t, samples, 16) },
+		failed: true,
+	}, {
+		name:   "speed above",
+		assert: func(t TestingT) { AssertMedianSpeedAbove(t, samples, 15) },
+		failed: false,
+	}, {
+		name:   "speed not above",
+		assert: func(t TestingT) { AssertMedianSpeedAbove(t, samples, 16) },
+		failed: true,
+	}, {
+		name:   "speed within",
+		assert: func(t TestingT) { AssertMedianSpeedWithin(t, samples, 15, 0.1) },
+		failed: false,
+	}, {
+		name:   "speed not within",
+		assert: func(t TestingT) { AssertMedianSpeedWithin(t, samples, 20, 0.1) },
+		failed: true,
+	}, {
+		name:   "RTT above",
+		assert: func(t TestingT) { AssertMedianRTTAbove(t, rtts, 15*time.Millisecond) },
+		failed: false,
+	}, {
+		name:   "RTT not above",
+		assert: func(t TestingT) { AssertMedianRTTAbove(t, rtts, 25*time.Millisecond) },
+		failed: true,
+	}, {
+		name:   "RTT below",
+		assert: func(t TestingT) { AssertMedianRTTBelow(t, rtts, 25*time.Millisecond) },
+		failed: false,
+	}, {
+		name:   "RTT not below",
+		assert: func(t TestingT) { AssertMedianRTTBelow(t, rtts, 15*time.Millisecond) },
+		failed: true,
+	}}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ft := &fakeTestingT{}
+			tc.assert(ft)
+			if ft.failed != tc.failed {
+				t.Fatal("expected failed to be", tc.failed)
+			}
+		})
+	}
+}
+
+func TestMustRunNDT0(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{
+		LeftToRightDelay: 5 * time.Millisecond,
+		RightToLeftDelay: 5 * time.Millisecond,
+	})
+	defer topology.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	samples := MustRunNDT0(t, ctx, topology.Client, topology.Server, "10.0.0.1", 443, true, nil)
+	AssertMedianSpeedAbove(t, samples, 0)
+}
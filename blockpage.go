@@ -0,0 +1,214 @@
+package netem
+
+//
+// Blockpage server
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// BlockpageTemplate describes a blockpage served by a [BlockpageServer].
+type BlockpageTemplate struct {
+	// Body is the HTML body of the blockpage.
+	Body string
+
+	// Fingerprint is a substring of either the body or of a header
+	// that allows to classify the blockpage, which is useful to write
+	// tests checking whether blockpage detection works.
+	Fingerprint string
+
+	// Headers contains the headers of the blockpage.
+	Headers map[string]string
+
+	// Name is the name of the blockpage.
+	Name string
+
+	// StatusCode is the HTTP status code of the blockpage.
+	StatusCode int
+}
+
+// BlockpageTemplateGeneric is a generic blockpage with a distinctive title.
+var BlockpageTemplateGeneric = &BlockpageTemplate{
+	Body: `<!DOCTYPE html>
+<html>
+<head><title>Access to this website has been blocked</title></head>
+<body>
+<h1>Access to this website has been blocked</h1>
+<p>This website has been blocked in accordance with the applicable regulations.</p>
+</body>
+</html>
+`,
+	Fingerprint: "<title>Access to this website has been blocked</title>",
+	Headers: map[string]string{
+		"Content-Type": "text/html; charset=utf-8",
+	},
+	Name:       "generic",
+	StatusCode: http.StatusForbidden,
+}
+
+// BlockpageTemplateIframe is modeled after blockpages that embed an iframe
+// pointing to a private address, which is the case, e.g., in Iran.
+var BlockpageTemplateIframe = &BlockpageTemplate{
+	Body: `<html><head><meta http-equiv="Content-Type" content="text/html; charset=windows-1256">` +
+		`<title>M1-6</title></head><body><iframe src="http://10.10.34.34?type=Invalid Site&policy=MainPolicy" ` +
+		`style="width: 100%; height: 100%" scrolling="no" marginwidth="0" marginheight="0" frameborder="0" ` +
+		`vspace="0" hspace="0"></iframe></body></html>`,
+	Fingerprint: `iframe src="http://10.10.34.34`,
+	Headers: map[string]string{
+		"Content-Type": "text/html; charset=windows-1256",
+	},
+	Name:       "iframe",
+	StatusCode: http.StatusForbidden,
+}
+
+// BlockpageTemplateSquid is modeled after the error page of a filtering
+// Squid proxy, which we can classify using its headers.
+var BlockpageTemplateSquid = &BlockpageTemplate{
+	Body: `<!DOCTYPE html>
+<html><head><title>ERROR: The requested URL could not be retrieved</title></head>
+<body><h1>ERROR</h1><h2>The requested URL could not be retrieved</h2>
+<p>Access control configuration prevents your request from being allowed at this time.</p>
+</body></html>
+`,
+	Fingerprint: "ERR_ACCESS_DENIED",
+	Headers: map[string]string{
+		"Content-Type":  "text/html; charset=utf-8",
+		"Server":        "squid",
+		"X-Squid-Error": "ERR_ACCESS_DENIED 0",
+	},
+	Name:       "squid",
+	StatusCode: http.StatusForbidden,
+}
+
+// HTTPResponse formats the blockpage as a raw HTTP response, which you can
+// use with [DPISpoofBlockpageForString] to emulate HTTP injection. Because the
+// rule requires a small response, the [BlockpageTemplateIframe] blockpage is
+// the most suitable for this use case.
+func (bt *BlockpageTemplate) HTTPResponse() (output []byte) {
+	output = fmt.Appendf(output, "HTTP/1.1 %d %s\r\n", bt.StatusCode, http.StatusText(bt.StatusCode))
+	var keys []string
+	for key := range bt.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		output = fmt.Appendf(output, "%s: %s\r\n", key, bt.Headers[key])
+	}
+	output = fmt.Appendf(output, "Content-Length: %d\r\n", len(bt.Body))
+	output = append(output, []byte("Connection: close\r\n\r\n")...)
+	output = append(output, []byte(bt.Body)...)
+	return
+}
+
+// NewBlockpageHandler returns an [http.Handler] that serves the given
+// blockpage regardless of the request method, host, and path.
+func NewBlockpageHandler(template *BlockpageTemplate) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, value := range template.Headers {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(template.StatusCode)
+		_, _ = w.Write([]byte(template.Body))
+	})
+}
+
+// BlockpageServerConfig contains the [BlockpageServer] configuration.
+type BlockpageServerConfig struct {
+	// H2C OPTIONALLY allows serving HTTP/2 cleartext on the HTTPPort.
+	H2C bool
+
+	// HTTPPort is the OPTIONAL TCP port for HTTP (default: 80).
+	HTTPPort int
+
+	// HTTPSPort is the OPTIONAL TCP port for HTTPS (default: 443).
+	HTTPSPort int
+
+	// ServerNames contains the OPTIONAL names for which the server presents
+	// a certificate in addition to its IP address, which typically are the
+	// domains that a DNS-hijacking censor resolves to the server. Remember
+	// that you can use [CA.AddInvalidCertificate] to emulate blockpage servers
+	// that present an invalid certificate.
+	ServerNames []string
+
+	// Template is the OPTIONAL blockpage (default: [BlockpageTemplateGeneric]).
+	Template *BlockpageTemplate
+}
+
+// BlockpageServer serves a blockpage over HTTP and HTTPS, which is useful
+// to emulate DNS-hijacking and HTTP-injection scenarios. The zero value is
+// invalid, please construct using [NewBlockpageServer].
+type BlockpageServer struct {
+	once    sync.Once
+	servers []*http.Server
+}
+
+// NewBlockpageServer creates a new [BlockpageServer] listening on the given
+// IP address. Remember to call [BlockpageServer.Close] when done.
+func NewBlockpageServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *BlockpageServerConfig,
+) (*BlockpageServer, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	httpPort := config.HTTPPort
+	if httpPort <= 0 {
+		httpPort = 80
+	}
+	httpsPort := config.HTTPSPort
+	if httpsPort <= 0 {
+		httpsPort = 443
+	}
+	template := config.Template
+	if template == nil {
+		template = BlockpageTemplateGeneric
+	}
+
+	ns := &Net{Stack: stack}
+	httpListener, err := ns.ListenTCP("tcp", &net.TCPAddr{IP: parsedIP, Port: httpPort})
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := stack.MustNewServerTLSConfig(ipAddress, config.ServerNames...)
+	httpsListener, err := ns.ListenTLS("tcp", &net.TCPAddr{IP: parsedIP, Port: httpsPort}, tlsConfig)
+	if err != nil {
+		httpListener.Close()
+		return nil, err
+	}
+
+	bs := &BlockpageServer{}
+	handler := NewBlockpageHandler(template)
+	for idx, listener := range []net.Listener{httpListener, httpsListener} {
+		server := &http.Server{Handler: handler}
+		if idx == 0 && config.H2C {
+			server.Handler = NewH2CHandler(handler)
+		}
+		bs.servers = append(bs.servers, server)
+		go func(listener net.Listener) {
+			err := server.Serve(listener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				logger.Warnf("netem: BlockpageServer: %s", err.Error())
+			}
+		}(listener)
+	}
+	return bs, nil
+}
+
+// Close closes the server.
+func (bs *BlockpageServer) Close() error {
+	bs.once.Do(func() {
+		for _, server := range bs.servers {
+			server.Close()
+		}
+	})
+	return nil
+}
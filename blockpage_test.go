@@ -0,0 +1,85 @@
+package netem
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBlockpageServer(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	// emulate a censor that resolves www.example.com to the blockpage server
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.1"))
+	dnsServer := Must1(NewDNSServer(&NullLogger{}, topology.Server, "10.0.0.1", dnsConfig))
+	defer dnsServer.Close()
+
+	server := Must1(NewBlockpageServer(&NullLogger{}, topology.Server, "10.0.0.1", &BlockpageServerConfig{
+		ServerNames: []string{"www.example.com"},
+		Template:    BlockpageTemplateSquid,
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewHTTPTransport(topology.Client)}
+	for _, URL := range []string{"http://www.example.com/", "https://www.example.com/robots.txt"} {
+		t.Run(URL, func(t *testing.T) {
+			resp, err := client.Get(URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body := Must1(io.ReadAll(resp.Body))
+			if resp.StatusCode != http.StatusForbidden {
+				t.Fatal("unexpected status code", resp.StatusCode)
+			}
+			if resp.Header.Get("X-Squid-Error") != "ERR_ACCESS_DENIED 0" {
+				t.Fatal("unexpected headers", resp.Header)
+			}
+			if string(body) != BlockpageTemplateSquid.Body {
+				t.Fatal("unexpected body", string(body))
+			}
+		})
+	}
+}
+
+func TestBlockpageTemplates(t *testing.T) {
+	templates := []*BlockpageTemplate{
+		BlockpageTemplateGeneric,
+		BlockpageTemplateIframe,
+		BlockpageTemplateSquid,
+	}
+	for _, template := range templates {
+		t.Run(template.Name, func(t *testing.T) {
+			var headers []string
+			for key, value := range template.Headers {
+				headers = append(headers, fmt.Sprintf("%s: %s", key, value))
+			}
+			serialized := strings.Join(headers, "\n") + "\n" + template.Body
+			if !strings.Contains(serialized, template.Fingerprint) {
+				t.Fatal("the fingerprint does not match the blockpage")
+			}
+		})
+	}
+}
+
+func TestBlockpageTemplateHTTPResponse(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewReader(BlockpageTemplateIframe.HTTPResponse()))
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := Must1(io.ReadAll(resp.Body))
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Content-Type") != "text/html; charset=windows-1256" {
+		t.Fatal("unexpected response", resp.StatusCode, resp.Header)
+	}
+	if string(body) != BlockpageTemplateIframe.Body {
+		t.Fatal("unexpected body", string(body))
+	}
+}
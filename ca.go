@@ -22,8 +22,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
 	"math/big"
 	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -39,6 +43,14 @@ var caMaxSerialNumber = big.NewInt(0).SetBytes(bytes.Repeat([]byte{255}, 20))
 // SPDX-License-Identifier: Apache-2.0.
 func caMustNewAuthority(name, organization string, validity time.Duration,
 	timeNow func() time.Time) (*x509.Certificate, *rsa.PrivateKey) {
+	return caMustNewAuthorityWithParent(name, organization, validity, timeNow, nil, nil)
+}
+
+// caMustNewAuthorityWithParent is like [caMustNewAuthority] but the certificate is
+// signed by the given parent certificate and key, which yields an intermediate CA. When
+// the parent is nil, the certificate is self signed, which yields a root CA.
+func caMustNewAuthorityWithParent(name, organization string, validity time.Duration,
+	timeNow func() time.Time, parent *x509.Certificate, parentKey any) (*x509.Certificate, *rsa.PrivateKey) {
 	priv := Must1(rsa.GenerateKey(rand.Reader, 2048))
 	pub := priv.Public()
 
@@ -69,7 +81,11 @@ func caMustNewAuthority(name, organization string, validity time.Duration,
 		IsCA:                  true,
 	}
 
-	raw := Must1(x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv))
+	if parent == nil {
+		parent, parentKey = tmpl, priv
+	}
+
+	raw := Must1(x509.CreateCertificate(rand.Reader, tmpl, parent, pub, parentKey))
 
 	// Parse certificate bytes so that we have a leaf certificate.
 	x509c := Must1(x509.ParseCertificate(raw))
@@ -85,12 +101,44 @@ func caMustNewAuthority(name, organization string, validity time.Duration,
 //
 // SPDX-License-Identifier: Apache-2.0.
 type CA struct {
-	caCert   *x509.Certificate
-	capriv   any
-	keyID    []byte
-	org      string
-	priv     *rsa.PrivateKey
-	validity time.Duration
+	caCert    *x509.Certificate
+	capriv    any
+	chain     []*x509.Certificate
+	issuerKey any
+	keyID     []byte
+	mu        sync.Mutex
+	org       string
+	priv      *rsa.PrivateKey
+	static    map[string]*tls.Certificate
+	validity  time.Duration
+}
+
+// CAConfig contains config for creating a [*CA] using [MustNewCAWithConfig].
+//
+// The zero value is ready to use and produces the same [*CA] returned by [MustNewCA].
+type CAConfig struct {
+	// Intermediates is the OPTIONAL number of intermediate CAs between the root CA
+	// and the server certificates. When zero, the root CA directly signs the server
+	// certificates. Otherwise, the root CA signs the first intermediate, each
+	// intermediate signs the next one, and the last one signs the server certificates,
+	// which also include the intermediates in their chain.
+	Intermediates int
+
+	// IntermediateValidity is the OPTIONAL validity of the intermediate CAs around
+	// the time of their creation. When zero, we use the RootValidity.
+	IntermediateValidity time.Duration
+
+	// LeafValidity is the OPTIONAL validity of the server certificates around
+	// the time of their creation. When zero, we use one hour.
+	LeafValidity time.Duration
+
+	// RootValidity is the OPTIONAL validity of the root CA around the
+	// time of its creation. When zero, we use 24 hours.
+	RootValidity time.Duration
+
+	// TimeNow is the OPTIONAL [time.Now] like func to use when
+	// creating the CAs. When nil, we use [time.Now].
+	TimeNow func() time.Time
 }
 
 // NewCA creates a new certification authority.
@@ -101,15 +149,48 @@ func MustNewCA() *CA {
 var _ CertificationAuthority = &CA{}
 
 // MustNewCA is like [NewCA] but uses a custom [time.Now] func.
+func MustNewCAWithTimeNow(timeNow func() time.Time) *CA {
+	return MustNewCAWithConfig(&CAConfig{TimeNow: timeNow})
+}
+
+// MustNewCAWithConfig is like [MustNewCA] but uses the given config, which allows
+// to create a realistic certificate chain (i.e., leaf, intermediates, and root), since
+// some client validation logic and TLS fingerprinting depend on the chain structure.
 //
 // This code is derived from github.com/google/martian/v3.
 //
 // SPDX-License-Identifier: Apache-2.0.
-func MustNewCAWithTimeNow(timeNow func() time.Time) *CA {
-	ca, privateKey := caMustNewAuthority("jafar", "OONI", 24*time.Hour, timeNow)
+func MustNewCAWithConfig(config *CAConfig) *CA {
+	timeNow := config.TimeNow
+	if timeNow == nil {
+		timeNow = time.Now
+	}
+	rootValidity := config.RootValidity
+	if rootValidity <= 0 {
+		rootValidity = 24 * time.Hour
+	}
+	intermediateValidity := config.IntermediateValidity
+	if intermediateValidity <= 0 {
+		intermediateValidity = rootValidity
+	}
+	leafValidity := config.LeafValidity
+	if leafValidity <= 0 {
+		leafValidity = time.Hour
+	}
 
-	roots := x509.NewCertPool()
-	roots.AddCert(ca)
+	ca, privateKey := caMustNewAuthority("jafar", "OONI", rootValidity, timeNow)
+
+	// Create the intermediates such that the chain is ordered from
+	// the certificate signing the leaves up to the root CA.
+	chain := []*x509.Certificate{ca}
+	issuer, issuerKey := ca, any(privateKey)
+	for idx := 0; idx < config.Intermediates; idx++ {
+		name := fmt.Sprintf("jafar intermediate %d", idx+1)
+		cert, key := caMustNewAuthorityWithParent(
+			name, "OONI", intermediateValidity, timeNow, issuer, issuerKey)
+		chain = append([]*x509.Certificate{cert}, chain...)
+		issuer, issuerKey = cert, key
+	}
 
 	priv := Must1(rsa.GenerateKey(rand.Reader, 2048))
 	pub := priv.Public()
@@ -122,12 +203,14 @@ func MustNewCAWithTimeNow(timeNow func() time.Time) *CA {
 	keyID := h.Sum(nil)
 
 	return &CA{
-		caCert:   ca,
-		capriv:   privateKey,
-		priv:     priv,
-		keyID:    keyID,
-		validity: time.Hour,
-		org:      "OONI Netem CA",
+		caCert:    ca,
+		capriv:    privateKey,
+		chain:     chain,
+		issuerKey: issuerKey,
+		priv:      priv,
+		keyID:     keyID,
+		validity:  leafValidity,
+		org:       "OONI Netem CA",
 	}
 }
 
@@ -136,6 +219,13 @@ func (ca *CA) CACert() *x509.Certificate {
 	return ca.caCert
 }
 
+// IntermediateCerts returns the intermediate CA certificates configured using
+// [CAConfig], ordered from the one signing server certificates up to the one
+// signed by the root CA. The returned slice is empty when there are none.
+func (ca *CA) IntermediateCerts() []*x509.Certificate {
+	return append([]*x509.Certificate{}, ca.chain[:len(ca.chain)-1]...)
+}
+
 // DefaultCertPool implements [CertificationAuthority].
 func (ca *CA) DefaultCertPool() *x509.CertPool {
 	p := x509.NewCertPool()
@@ -143,13 +233,74 @@ func (ca *CA) DefaultCertPool() *x509.CertPool {
 	return p
 }
 
+// CACertPEM returns the CA certificate encoded as PEM. You can use this method to
+// make clients that do not use [CA.DefaultCertPool], such as external programs
+// bridged into the topology or custom TLS stacks, trust the emulated servers.
+func (ca *CA) CACertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})
+}
+
+// CAKeyPEM returns the CA private key encoded as a PKCS#8 PEM block. Use this method
+// when external code needs to issue its own certificates signed by this CA. Keep
+// in mind that whoever holds this key can impersonate any emulated server.
+func (ca *CA) CAKeyPEM() ([]byte, error) {
+	raw, err := x509.MarshalPKCS8PrivateKey(ca.capriv)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: raw}), nil
+}
+
+// AddStaticCertificate registers a static certificate for the given server name. From
+// now on, [CA.MustNewTLSCertificate] returns this certificate when the common name is
+// serverName, and the configs returned by [CA.MustNewServerTLSConfig] return it when
+// the client sends serverName as the SNI, instead of minting a MITM certificate on
+// the fly. This allows tests to exercise certificate pinning and to reproduce
+// byte-identical TLS handshakes across runs. Registering a certificate for a name
+// that already has one replaces the previous certificate.
+func (ca *CA) AddStaticCertificate(serverName string, cert *tls.Certificate) {
+	if cert.Leaf == nil && len(cert.Certificate) > 0 {
+		// Note: we ignore the error because the TLS stack will fail anyway
+		// when using a certificate that we cannot parse
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	defer ca.mu.Unlock()
+	ca.mu.Lock()
+	if ca.static == nil {
+		ca.static = map[string]*tls.Certificate{}
+	}
+	ca.static[strings.ToLower(serverName)] = cert
+}
+
+// AddStaticCertificatePEM is like [CA.AddStaticCertificate] but takes in input
+// the PEM encoded certificate chain and private key.
+func (ca *CA) AddStaticCertificatePEM(serverName string, certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	ca.AddStaticCertificate(serverName, &cert)
+	return nil
+}
+
+// staticCertificate returns the static certificate for the given server name or nil.
+func (ca *CA) staticCertificate(serverName string) *tls.Certificate {
+	defer ca.mu.Unlock()
+	ca.mu.Lock()
+	return ca.static[strings.ToLower(serverName)]
+}
+
 // MustNewServerTLSConfig implements [CertificationAuthority].
 func (ca *CA) MustNewServerTLSConfig(commonName string, extraNames ...string) *tls.Config {
 	// Implementation note: we want to force http/1.1 because we have several tests
 	// where the connection is hijackable and we cannot hijack http2 connections.
 	return &tls.Config{
 		Certificates: []tls.Certificate{*ca.MustNewTLSCertificate(commonName, extraNames...)},
-		NextProtos:   []string{"http/1.1"},
+		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// returning nil causes the TLS stack to use Certificates
+			return ca.staticCertificate(chi.ServerName), nil
+		},
+		NextProtos: []string{"http/1.1"},
 	}
 }
 
@@ -165,6 +316,16 @@ func (ca *CA) MustNewTLSCertificate(commonName string, extraNames ...string) *tl
 // SPDX-License-Identifier: Apache-2.0.
 func (ca *CA) MustNewTLSCertificateWithTimeNow(timeNow func() time.Time,
 	commonName string, extraNames ...string) *tls.Certificate {
+	if cert := ca.staticCertificate(commonName); cert != nil {
+		return cert
+	}
+
+	tmpl := ca.newLeafTemplate(timeNow, commonName, extraNames...)
+	return ca.mustIssueLeaf(tmpl)
+}
+
+// newLeafTemplate returns the template for a server certificate valid for the given names.
+func (ca *CA) newLeafTemplate(timeNow func() time.Time, commonName string, extraNames ...string) *x509.Certificate {
 	serial := Must1(rand.Int(rand.Reader, caMaxSerialNumber))
 
 	tmpl := &x509.Certificate{
@@ -191,13 +352,36 @@ func (ca *CA) MustNewTLSCertificateWithTimeNow(timeNow func() time.Time,
 		}
 	}
 
-	raw := Must1(x509.CreateCertificate(rand.Reader, tmpl, ca.caCert, ca.priv.Public(), ca.capriv))
+	return tmpl
+}
+
+// mustIssueLeaf signs the given template using the CA that issues server certificates
+// and returns the corresponding [*tls.Certificate] or PANICS.
+func (ca *CA) mustIssueLeaf(tmpl *x509.Certificate) *tls.Certificate {
+	return ca.mustSignLeaf(tmpl, ca.issuerKey, ca.chain...)
+}
+
+// mustSignLeaf signs the given template using the given parent key and returns the
+// corresponding [*tls.Certificate] or PANICS. The parents are the certificates to
+// include in the chain, starting from the one corresponding to the parent key. When
+// there are no parents, the certificate is self signed and the chain only contains it.
+func (ca *CA) mustSignLeaf(tmpl *x509.Certificate, parentKey any, parents ...*x509.Certificate) *tls.Certificate {
+	parent := tmpl
+	if len(parents) > 0 {
+		parent = parents[0]
+	}
+	raw := Must1(x509.CreateCertificate(rand.Reader, tmpl, parent, ca.priv.Public(), parentKey))
 
 	// Parse certificate bytes so that we have a leaf certificate.
 	x509c := Must1(x509.ParseCertificate(raw))
 
+	chain := [][]byte{raw}
+	for _, cert := range parents {
+		chain = append(chain, cert.Raw)
+	}
+
 	tlsc := &tls.Certificate{
-		Certificate: [][]byte{raw, ca.caCert.Raw},
+		Certificate: chain,
 		PrivateKey:  ca.priv,
 		Leaf:        x509c,
 	}
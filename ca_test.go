@@ -18,6 +18,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"net"
 	"net/http"
 	"reflect"
@@ -140,3 +141,181 @@ func TestCAWeCanGenerateAnExpiredCertificate(t *testing.T) {
 		t.Fatal("unexpected error", err)
 	}
 }
+
+func TestCAExportPEM(t *testing.T) {
+	ca := MustNewCA()
+
+	t.Run("the certificate PEM allows to verify server certificates", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca.CACertPEM()) {
+			t.Fatal("cannot parse the CA certificate PEM")
+		}
+		tlsc := ca.MustNewTLSCertificate("example.com")
+		opts := x509.VerifyOptions{DNSName: "example.com", Roots: pool}
+		if _, err := tlsc.Leaf.Verify(opts); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("the key PEM matches the certificate PEM", func(t *testing.T) {
+		keyPEM, err := ca.CAKeyPEM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tls.X509KeyPair(ca.CACertPEM(), keyPEM); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("the PPP topology exposes the CA shared by its stacks", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		if topology.CA() != topology.Server.CA() {
+			t.Fatal("the client and the server use different CAs")
+		}
+		if diff := cmp.Diff(topology.CA().CACertPEM(), topology.Client.CACertPEM()); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+}
+
+func TestCAStaticCertificates(t *testing.T) {
+	// create the static certificate using another CA such that we can
+	// distinguish it from the certificates minted by the main CA
+	other := MustNewCA()
+	static := other.MustNewTLSCertificate("pinned.example.com")
+
+	t.Run("MustNewTLSCertificate returns the static certificate", func(t *testing.T) {
+		ca := MustNewCA()
+		ca.AddStaticCertificate("Pinned.Example.COM", static)
+		if ca.MustNewTLSCertificate("pinned.example.com") != static {
+			t.Fatal("did not get the static certificate")
+		}
+		if ca.MustNewTLSCertificate("www.example.com") == static {
+			t.Fatal("got the static certificate for another name")
+		}
+	})
+
+	t.Run("the server TLS config selects the static certificate using the SNI", func(t *testing.T) {
+		ca := MustNewCA()
+		ca.AddStaticCertificate("pinned.example.com", static)
+		serverConfig := ca.MustNewServerTLSConfig("10.0.0.1", "pinned.example.com", "www.example.com")
+
+		handshake := func(sni string, roots *x509.CertPool) ([]byte, error) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			go func() {
+				_ = tls.Server(serverConn, serverConfig).Handshake()
+			}()
+			client := tls.Client(clientConn, &tls.Config{RootCAs: roots, ServerName: sni})
+			if err := client.Handshake(); err != nil {
+				return nil, err
+			}
+			return client.ConnectionState().PeerCertificates[0].Raw, nil
+		}
+
+		for idx := 0; idx < 2; idx++ {
+			raw, err := handshake("pinned.example.com", other.DefaultCertPool())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(static.Certificate[0], raw); diff != "" {
+				t.Fatal(diff)
+			}
+		}
+		if _, err := handshake("www.example.com", ca.DefaultCertPool()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("AddStaticCertificatePEM parses the certificate and the key", func(t *testing.T) {
+		ca := MustNewCA()
+		if err := ca.AddStaticCertificatePEM("pinned.example.com", other.CACertPEM(), Must1(other.CAKeyPEM())); err != nil {
+			t.Fatal(err)
+		}
+		cert := ca.MustNewTLSCertificate("pinned.example.com")
+		if diff := cmp.Diff(other.CACert().Raw, cert.Leaf.Raw); diff != "" {
+			t.Fatal(diff)
+		}
+		if err := ca.AddStaticCertificatePEM("broken.example.com", []byte("x"), []byte("y")); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestCAIntermediates(t *testing.T) {
+	t.Run("by default the root directly signs the leaf", func(t *testing.T) {
+		ca := MustNewCA()
+		if n := len(ca.IntermediateCerts()); n != 0 {
+			t.Fatal("expected no intermediates, got", n)
+		}
+		cert := ca.MustNewTLSCertificate("www.example.com")
+		if n := len(cert.Certificate); n != 2 {
+			t.Fatal("expected leaf and root, got", n)
+		}
+	})
+
+	t.Run("we can configure the chain depth and the lifetimes", func(t *testing.T) {
+		ca := MustNewCAWithConfig(&CAConfig{
+			Intermediates:        2,
+			IntermediateValidity: 2 * time.Hour,
+			LeafValidity:         10 * time.Minute,
+		})
+		intermediates := ca.IntermediateCerts()
+		if len(intermediates) != 2 {
+			t.Fatal("expected two intermediates, got", len(intermediates))
+		}
+
+		cert := ca.MustNewTLSCertificate("www.example.com")
+		if len(cert.Certificate) != 4 {
+			t.Fatal("expected leaf, two intermediates, and root, got", len(cert.Certificate))
+		}
+		if diff := cmp.Diff(intermediates[0].Raw, cert.Certificate[1]); diff != "" {
+			t.Fatal(diff)
+		}
+		if diff := cmp.Diff(ca.CACert().Raw, cert.Certificate[3]); diff != "" {
+			t.Fatal(diff)
+		}
+
+		if got := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore); got != 20*time.Minute {
+			t.Fatal("unexpected leaf lifetime", got)
+		}
+		for _, ic := range intermediates {
+			if got := ic.NotAfter.Sub(ic.NotBefore); got != 4*time.Hour {
+				t.Fatal("unexpected intermediate lifetime", got)
+			}
+		}
+
+		pool := x509.NewCertPool()
+		for _, raw := range cert.Certificate[1:] {
+			pool.AddCert(Must1(x509.ParseCertificate(raw)))
+		}
+		chains, err := cert.Leaf.Verify(x509.VerifyOptions{
+			DNSName:       "www.example.com",
+			Intermediates: pool,
+			Roots:         ca.DefaultCertPool(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chains) != 1 || len(chains[0]) != 4 {
+			t.Fatal("unexpected chains", chains)
+		}
+
+		// without the intermediates the leaf does not verify
+		var authErr x509.UnknownAuthorityError
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: ca.DefaultCertPool()})
+		if !errors.As(err, &authErr) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("invalid certificates use the same chain", func(t *testing.T) {
+		ca := MustNewCAWithConfig(&CAConfig{Intermediates: 1})
+		cert := ca.MustNewInvalidTLSCertificate(InvalidCertificateExpired, "www.example.com")
+		if len(cert.Certificate) != 3 {
+			t.Fatal("expected leaf, intermediate, and root, got", len(cert.Certificate))
+		}
+	})
+}
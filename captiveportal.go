@@ -0,0 +1,217 @@
+package netem
+
+//
+// Captive portal emulation
+//
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// CaptivePortalConfig contains the [CaptivePortal] configuration. With the
+// zero value, the portal uses "captive.portal" as the login domain and the
+// portal DNS resolves all the names to 10.99.99.99 until clients log in.
+type CaptivePortalConfig struct {
+	// Domain is the OPTIONAL domain of the login page (default: "captive.portal").
+	Domain string
+
+	// IPAddress is the OPTIONAL address to which the portal DNS resolves all
+	// the names for clients that did not authenticate (default: "10.99.99.99").
+	IPAddress string
+
+	// MTU is the OPTIONAL MTU of the [CaptivePortal] NICs (default: 1500).
+	MTU uint32
+}
+
+// domain returns the configured domain or the default.
+func (c *CaptivePortalConfig) domain() string {
+	if c.Domain != "" {
+		return c.Domain
+	}
+	return "captive.portal"
+}
+
+// ipAddress returns the configured IP address or the default.
+func (c *CaptivePortalConfig) ipAddress() string {
+	if c.IPAddress != "" {
+		return c.IPAddress
+	}
+	return "10.99.99.99"
+}
+
+// CaptivePortal is a [Middlebox] emulating a captive portal. Until a client
+// authenticates by visiting the /login page of the portal domain, the portal
+// redirects all its HTTP requests to the portal domain, where it serves a
+// login page, and closes its HTTPS connections. Once the client has been
+// authenticated, the portal transparently proxies its traffic. Use the
+// [CaptivePortal.ConfigureDNS] method to also emulate the DNS behavior
+// typical of captive portals. The zero value is invalid; please, construct
+// using [NewCaptivePortal].
+//
+// Like for [Middlebox], use [CaptivePortal.ClientSideNIC] and
+// [CaptivePortal.ServerSideNIC] to connect the [CaptivePortal].
+type CaptivePortal struct {
+	authenticated map[string]bool
+	dnsConfig     *DNSConfig
+	domain        string
+	ipAddress     string
+	mb            *Middlebox
+	mu            sync.Mutex
+}
+
+// NewCaptivePortal creates a new [CaptivePortal]. The [CA] argument has the
+// same meaning it has for [NewMiddlebox], even though the portal does not
+// perform TLS MITM. Remember to call [CaptivePortal.Close] when done.
+func NewCaptivePortal(logger Logger, ca *CA, config *CaptivePortalConfig) (*CaptivePortal, error) {
+	cp := &CaptivePortal{
+		authenticated: map[string]bool{},
+		dnsConfig:     nil,
+		domain:        config.domain(),
+		ipAddress:     config.ipAddress(),
+		mb:            nil, // set below
+		mu:            sync.Mutex{},
+	}
+	mb, err := NewMiddlebox(logger, ca, &MiddleboxConfig{
+		HTTPResponder:     cp.respond,
+		InterceptTCPPorts: []uint16{80, 443},
+		MTU:               config.MTU,
+		Policy:            cp.allow,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cp.mb = mb
+	return cp, nil
+}
+
+// ClientSideNIC returns the [NIC] to connect to the client's side of the path.
+func (cp *CaptivePortal) ClientSideNIC() NIC {
+	return cp.mb.ClientSideNIC()
+}
+
+// ServerSideNIC returns the [NIC] to connect to the server's side of the path.
+func (cp *CaptivePortal) ServerSideNIC() NIC {
+	return cp.mb.ServerSideNIC()
+}
+
+// Close stops the [CaptivePortal] and closes its [NIC]s.
+func (cp *CaptivePortal) Close() error {
+	return cp.mb.Close()
+}
+
+// ConfigureDNS modifies the given [DNSConfig], which should be the one used
+// by the DNS server the clients use, such that the portal domain resolves to
+// the portal address and such that all the names in the [DNSConfig] resolve
+// to the portal address for the clients that did not authenticate. Because we
+// take a snapshot of the names, call this method after adding the records.
+func (cp *CaptivePortal) ConfigureDNS(config *DNSConfig) error {
+	if err := config.AddRecord(cp.domain, "", cp.ipAddress); err != nil {
+		return err
+	}
+
+	// create a view resolving all the names to the portal address
+	hijacked := NewDNSConfig()
+	config.mu.Lock()
+	var names []string
+	for name := range config.r {
+		names = append(names, name)
+	}
+	config.mu.Unlock()
+	for _, name := range names {
+		if err := hijacked.AddRecord(name, "", cp.ipAddress); err != nil {
+			return err
+		}
+	}
+	if err := config.AddView("0.0.0.0/0", hijacked); err != nil {
+		return err
+	}
+
+	// make sure the already authenticated clients see the real records
+	defer cp.mu.Unlock()
+	cp.mu.Lock()
+	cp.dnsConfig = config
+	for ipAddress := range cp.authenticated {
+		if err := cp.dnsConfig.AddView(ipAddress+"/32", config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Authenticate marks the client with the given IPv4 address as authenticated,
+// which is equivalent to the client visiting the login page.
+func (cp *CaptivePortal) Authenticate(ipAddress string) error {
+	if net.ParseIP(ipAddress).To4() == nil {
+		return ErrNotIPAddress
+	}
+	defer cp.mu.Unlock()
+	cp.mu.Lock()
+	cp.authenticated[ipAddress] = true
+	if cp.dnsConfig != nil {
+		return cp.dnsConfig.AddView(ipAddress+"/32", cp.dnsConfig)
+	}
+	return nil
+}
+
+// IsAuthenticated returns whether the client with the given IP address is authenticated.
+func (cp *CaptivePortal) IsAuthenticated(ipAddress string) bool {
+	defer cp.mu.Unlock()
+	cp.mu.Lock()
+	return cp.authenticated[ipAddress]
+}
+
+// clientIPAddress returns the IP address of the client of a connection.
+func (cp *CaptivePortal) clientIPAddress(info *MiddleboxConnInfo) string {
+	ipAddress, _, _ := net.SplitHostPort(info.ClientAddress)
+	return ipAddress
+}
+
+// allow is the [Middlebox] policy, which only allows authenticated clients.
+func (cp *CaptivePortal) allow(info *MiddleboxConnInfo) bool {
+	return cp.IsAuthenticated(cp.clientIPAddress(info))
+}
+
+// respond is the [Middlebox] HTTP responder, which serves the portal to
+// the clients that did not authenticate using port 80.
+func (cp *CaptivePortal) respond(info *MiddleboxConnInfo) http.Handler {
+	clientIP := cp.clientIPAddress(info)
+	_, port, _ := net.SplitHostPort(info.ServerAddress)
+	if port != "80" || cp.IsAuthenticated(clientIP) {
+		return nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		switch {
+		case dns.CanonicalName(host) != dns.CanonicalName(cp.domain):
+			location := &url.URL{
+				Scheme:   "http",
+				Host:     cp.domain,
+				Path:     "/",
+				RawQuery: url.Values{"url": {"http://" + r.Host + r.URL.RequestURI()}}.Encode(),
+			}
+			http.Redirect(w, r, location.String(), http.StatusFound)
+
+		case r.URL.Path == "/login":
+			_ = cp.Authenticate(clientIP)
+			// close the connection such that we proxy the next connections
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, "<html><head><title>Connected</title></head>"+
+				"<body><h1>You are now connected to the Internet</h1></body></html>\n")
+
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, "<html><head><title>Login</title></head><body><h1>Welcome</h1>"+
+				"<p><a href=\"/login\">Accept the terms of service to connect</a></p></body></html>\n")
+		}
+	})
+}
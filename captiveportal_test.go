@@ -0,0 +1,123 @@
+package netem
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCaptivePortal(t *testing.T) {
+	// create the following topology
+	//
+	//	10.0.0.2 <-> portal <-> router <-> 10.0.0.1
+	//
+	// where 10.0.0.1 runs the DNS server and a web server.
+	ca := MustNewCA()
+	router := NewRouter(&NullLogger{})
+
+	portal := Must1(NewCaptivePortal(&NullLogger{}, ca, &CaptivePortalConfig{}))
+	defer portal.Close()
+
+	client := Must1(NewUNetStack(&NullLogger{}, 1500, "10.0.0.2", ca, "10.0.0.1"))
+	clientLink := NewLink(&NullLogger{}, client, portal.ClientSideNIC(), &LinkConfig{})
+	defer clientLink.Close()
+	clientPort := NewRouterPort(router)
+	router.AddRoute("10.0.0.2", clientPort)
+	portalLink := NewLink(&NullLogger{}, portal.ServerSideNIC(), clientPort, &LinkConfig{})
+	defer portalLink.Close()
+
+	server := Must1(NewUNetStack(&NullLogger{}, 1500, "10.0.0.1", ca, "0.0.0.0"))
+	serverPort := NewRouterPort(router)
+	router.AddRoute("10.0.0.1", serverPort)
+	serverLink := NewLink(&NullLogger{}, server, serverPort, &LinkConfig{})
+	defer serverLink.Close()
+
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("connectivitycheck.example.com", "", "10.0.0.1"))
+	Must0(portal.ConfigureDNS(dnsConfig))
+	dnsServer := Must1(NewDNSServer(&NullLogger{}, server, "10.0.0.1", dnsConfig))
+	defer dnsServer.Close()
+
+	// the web server implements a connectivity check returning 204
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ns := &Net{Stack: server}
+	httpListener := Must1(ns.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}))
+	tlsConfig := server.MustNewServerTLSConfig("connectivitycheck.example.com")
+	httpsListener := Must1(ns.ListenTLS("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, tlsConfig))
+	for _, listener := range []net.Listener{httpListener, httpsListener} {
+		server := &http.Server{Handler: handler}
+		defer server.Close()
+		go server.Serve(listener)
+	}
+
+	// lookup resolves the connectivity check domain.
+	lookup := func(t *testing.T) string {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		addrs, _, err := client.GetaddrinfoLookupANY(ctx, "connectivitycheck.example.com")
+		if err != nil || len(addrs) != 1 {
+			t.Fatal("unexpected lookup result", addrs, err)
+		}
+		return addrs[0]
+	}
+
+	// get fetches the given URL without following redirects.
+	get := func(URL string) (*http.Response, error) {
+		httpClient := NewHTTPClientWithOptions(client, &HTTPClientOptions{
+			DisableRedirects: true,
+			Timeout:          time.Second,
+		})
+		resp, err := httpClient.Get(URL)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp, nil
+	}
+
+	t.Run("before authenticating", func(t *testing.T) {
+		if addr := lookup(t); addr != "10.99.99.99" {
+			t.Fatal("expected the portal address, got", addr)
+		}
+		resp, err := get("http://10.0.0.1/generate_204")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := "http://captive.portal/?url=http%3A%2F%2F10.0.0.1%2Fgenerate_204"
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != expect {
+			t.Fatal("unexpected response", resp.StatusCode, resp.Header)
+		}
+		if _, err := get("https://10.0.0.1/generate_204"); err == nil {
+			t.Fatal("expected HTTPS to fail")
+		}
+		if resp, err := get("http://captive.portal/"); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("expected to see the login page", err)
+		}
+	})
+
+	t.Run("after authenticating", func(t *testing.T) {
+		if resp, err := get("http://captive.portal/login"); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("expected to login", err)
+		}
+		if !portal.IsAuthenticated("10.0.0.2") {
+			t.Fatal("expected the client to be authenticated")
+		}
+		if addr := lookup(t); addr != "10.0.0.1" {
+			t.Fatal("expected the real address, got", addr)
+		}
+		for _, URL := range []string{"http://connectivitycheck.example.com/generate_204",
+			"https://connectivitycheck.example.com/generate_204"} {
+			resp, err := get(URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusNoContent {
+				t.Fatal("unexpected status code", resp.StatusCode)
+			}
+		}
+	})
+}
@@ -0,0 +1,254 @@
+package netem
+
+//
+// Country censorship scenario presets
+//
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// CensorshipScenario describes which censorship techniques to apply to a set
+// of [CensorshipTarget]s. Because this is a plain struct, you can compose the
+// presets (e.g., [CensorshipPresetCN]) by modifying the returned value. Use
+// [NewCensorship] to instantiate a scenario inside a [StarTopology].
+type CensorshipScenario struct {
+	// Blockpage is the OPTIONAL blockpage. When set, we run a [BlockpageServer]
+	// at BlockpageAddress and, unless DNSInjectionAddresses is set, we inject
+	// DNS responses pointing to the blockpage server.
+	Blockpage *BlockpageTemplate
+
+	// BlockpageAddress is the OPTIONAL address of the blockpage server
+	// (default: "10.10.34.35").
+	BlockpageAddress string
+
+	// DNSInjection OPTIONALLY injects DNS responses for the target domains.
+	DNSInjection bool
+
+	// DNSInjectionAddresses contains the OPTIONAL addresses to inject. When
+	// empty and there is no blockpage, we inject NXDOMAIN responses.
+	DNSInjectionAddresses []string
+
+	// HTTPInjection OPTIONALLY injects the blockpage in response to cleartext
+	// HTTP requests for the target domains sent to the target addresses.
+	HTTPInjection bool
+
+	// Name is the OPTIONAL scenario name.
+	Name string
+
+	// QUICDrop OPTIONALLY drops the UDP traffic towards port 443 of the
+	// target addresses, which prevents using QUIC.
+	QUICDrop bool
+
+	// SNIDrop OPTIONALLY drops the TLS flows using the target domains as SNI.
+	SNIDrop bool
+
+	// SNIReset OPTIONALLY injects RST segments into the TLS flows using the
+	// target domains as SNI.
+	SNIReset bool
+
+	// ThrottleDelay is the OPTIONAL extra delay for the TLS flows using the
+	// target domains as SNI. See also ThrottlePLR.
+	ThrottleDelay time.Duration
+
+	// ThrottlePLR is the OPTIONAL extra packet loss rate for the TLS flows
+	// using the target domains as SNI. See also ThrottleDelay.
+	ThrottlePLR float64
+}
+
+// blockpageAddress returns the configured blockpage address or the default.
+func (cs *CensorshipScenario) blockpageAddress() string {
+	if cs.BlockpageAddress != "" {
+		return cs.BlockpageAddress
+	}
+	return "10.10.34.35"
+}
+
+// CensorshipPresetCN returns a [CensorshipScenario] modeled on the documented
+// behavior of the Great Firewall of China, which injects DNS responses containing
+// bogus addresses, injects RST segments after seeing the SNI, and blocks QUIC.
+func CensorshipPresetCN() *CensorshipScenario {
+	return &CensorshipScenario{
+		DNSInjection:          true,
+		DNSInjectionAddresses: []string{"243.185.187.39"},
+		Name:                  "CN",
+		QUICDrop:              true,
+		SNIReset:              true,
+	}
+}
+
+// CensorshipPresetIR returns a [CensorshipScenario] modeled on the documented
+// behavior of Iran, which injects DNS responses pointing to a private address
+// serving an iframe blockpage, injects the same blockpage into cleartext HTTP,
+// drops the TLS flows after seeing the SNI, and blocks QUIC.
+func CensorshipPresetIR() *CensorshipScenario {
+	return &CensorshipScenario{
+		Blockpage:        BlockpageTemplateIframe,
+		BlockpageAddress: "10.10.34.34",
+		DNSInjection:     true,
+		HTTPInjection:    true,
+		Name:             "IR",
+		QUICDrop:         true,
+		SNIDrop:          true,
+	}
+}
+
+// CensorshipPresetRU returns a [CensorshipScenario] modeled on the documented
+// throttling of specific services in Russia, which slows down the TLS flows
+// using the target domains as SNI without blocking them.
+func CensorshipPresetRU() *CensorshipScenario {
+	return &CensorshipScenario{
+		Name:          "RU",
+		ThrottleDelay: 100 * time.Millisecond,
+		ThrottlePLR:   0.05,
+	}
+}
+
+// CensorshipPresetIN returns a [CensorshipScenario] modeled on the documented
+// behavior of some Indian ISPs, which inject a blockpage into cleartext HTTP
+// and reset the TLS flows after seeing the SNI.
+func CensorshipPresetIN() *CensorshipScenario {
+	return &CensorshipScenario{
+		Blockpage:     BlockpageTemplateGeneric,
+		HTTPInjection: true,
+		Name:          "IN",
+		SNIReset:      true,
+	}
+}
+
+// CensorshipTarget is a website targeted by a [CensorshipScenario].
+type CensorshipTarget struct {
+	// Addresses contains the OPTIONAL website addresses, which are required
+	// by the techniques that target endpoints (e.g., QUICDrop).
+	Addresses []string
+
+	// Domain is the MANDATORY website domain.
+	Domain string
+}
+
+// ErrCensorshipScenario indicates that a [CensorshipScenario] is invalid.
+var ErrCensorshipScenario = errors.New("netem: invalid censorship scenario")
+
+// Censorship is an instantiated [CensorshipScenario]. The zero value is
+// invalid, please construct using [NewCensorship].
+type Censorship struct {
+	// DPIEngine is the [DPIEngine] implementing the scenario, which you should
+	// use in the [LinkConfig] of the censored clients.
+	DPIEngine *DPIEngine
+
+	// Blockpage is the blockpage server or nil.
+	Blockpage *BlockpageServer
+}
+
+// NewCensorship instantiates the given [CensorshipScenario] for the given targets
+// inside the given [StarTopology]. When the scenario uses a blockpage, we add a
+// host running a [BlockpageServer] to the topology, which owns the server.
+//
+// Because the DNS injection, the HTTP injection, and the RST injection rely on
+// the router spoofing packets, the censored clients MUST be attached to the
+// topology's router and, for consistent results, the links of the servers should
+// have some delay (see, e.g., [DPISpoofDNSResponse]).
+func NewCensorship(
+	logger Logger,
+	topology *StarTopology,
+	scenario *CensorshipScenario,
+	targets ...*CensorshipTarget,
+) (*Censorship, error) {
+	if scenario.HTTPInjection && scenario.Blockpage == nil {
+		return nil, fmt.Errorf("%w: HTTP injection requires a blockpage", ErrCensorshipScenario)
+	}
+	censorship := &Censorship{
+		DPIEngine: NewDPIEngine(logger),
+		Blockpage: nil,
+	}
+
+	injectAddresses := scenario.DNSInjectionAddresses
+	if scenario.Blockpage != nil {
+		var serverNames []string
+		for _, target := range targets {
+			serverNames = append(serverNames, target.Domain)
+		}
+		address := scenario.blockpageAddress()
+		host, err := topology.AddHost(address, "0.0.0.0", &LinkConfig{})
+		if err != nil {
+			return nil, err
+		}
+		server, err := NewBlockpageServer(logger, host, address, &BlockpageServerConfig{
+			ServerNames: serverNames,
+			Template:    scenario.Blockpage,
+		})
+		if err != nil {
+			return nil, err
+		}
+		topology.TrackServer(server)
+		censorship.Blockpage = server
+		if len(injectAddresses) <= 0 {
+			injectAddresses = []string{address}
+		}
+	}
+
+	for _, target := range targets {
+		if target.Domain == "" {
+			return nil, fmt.Errorf("%w: empty target domain", ErrCensorshipScenario)
+		}
+		for _, rule := range scenario.newRules(logger, target, injectAddresses) {
+			censorship.DPIEngine.AddRule(rule)
+		}
+	}
+	return censorship, nil
+}
+
+// newRules returns the [DPIRule]s to apply for the given target.
+func (cs *CensorshipScenario) newRules(logger Logger, target *CensorshipTarget, injectAddresses []string) (rules []DPIRule) {
+	if cs.DNSInjection {
+		rules = append(rules, &DPISpoofDNSResponse{
+			Addresses: injectAddresses,
+			Logger:    logger,
+			Domain:    target.Domain,
+		})
+	}
+	if cs.SNIReset {
+		rules = append(rules, &DPIResetTrafficForTLSSNI{
+			Logger: logger,
+			SNI:    target.Domain,
+		})
+	}
+	if cs.SNIDrop {
+		rules = append(rules, &DPIDropTrafficForTLSSNI{
+			Logger: logger,
+			SNI:    target.Domain,
+		})
+	}
+	if cs.ThrottleDelay > 0 || cs.ThrottlePLR > 0 {
+		rules = append(rules, &DPIThrottleTrafficForTLSSNI{
+			Delay:  cs.ThrottleDelay,
+			Logger: logger,
+			PLR:    cs.ThrottlePLR,
+			SNI:    target.Domain,
+		})
+	}
+	for _, address := range target.Addresses {
+		if cs.QUICDrop {
+			rules = append(rules, &DPIDropTrafficForServerEndpoint{
+				Logger:          logger,
+				ServerIPAddress: address,
+				ServerPort:      443,
+				ServerProtocol:  layers.IPProtocolUDP,
+			})
+		}
+		if cs.HTTPInjection {
+			rules = append(rules, &DPISpoofBlockpageForString{
+				HTTPResponse:    cs.Blockpage.HTTPResponse(),
+				Logger:          logger,
+				ServerIPAddress: address,
+				ServerPort:      80,
+				String:          target.Domain,
+			})
+		}
+	}
+	return
+}
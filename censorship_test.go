@@ -0,0 +1,121 @@
+package netem
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCensorship(t *testing.T) {
+	t.Run("the IR preset", func(t *testing.T) {
+		// create a star topology where 10.0.0.1 is the resolver
+		// and 10.0.0.3 is the website, with the censored client
+		// being 10.0.0.2
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		serverLink := &LinkConfig{LeftToRightDelay: 10 * time.Millisecond, RightToLeftDelay: 10 * time.Millisecond}
+		resolver := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", serverLink))
+		website := Must1(topology.AddHost("10.0.0.3", "10.0.0.1", serverLink))
+
+		dnsConfig := NewDNSConfig()
+		Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.3"))
+		topology.TrackServer(Must1(NewDNSServer(&NullLogger{}, resolver, "10.0.0.1", dnsConfig)))
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Bonsoir, Elliot!"))
+		})
+		ns := &Net{Stack: website}
+		httpListener := Must1(ns.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 80}))
+		tlsConfig := website.MustNewServerTLSConfig("www.example.com")
+		httpsListener := Must1(ns.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 443}))
+		httpServer := &http.Server{Handler: handler}
+		topology.TrackServer(httpServer)
+		go httpServer.Serve(httpListener)
+
+		// note: we use ServeTLS because ListenTLS performs the handshake inside Accept,
+		// which would block the server until the handshake of the dropped flow times out
+		httpsServer := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+		topology.TrackServer(httpsServer)
+		go httpsServer.ServeTLS(httpsListener, "", "")
+		topology.TrackServer(Must1(NewHTTP3Server(&NullLogger{}, website, "10.0.0.3", 443, handler, "www.example.com")))
+
+		censorship := Must1(NewCensorship(&NullLogger{}, topology, CensorshipPresetIR(), &CensorshipTarget{
+			Addresses: []string{"10.0.0.3"},
+			Domain:    "www.example.com",
+		}))
+		client := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{DPIEngine: censorship.DPIEngine}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		addrs, _, err := client.GetaddrinfoLookupANY(ctx, "www.example.com")
+		if err != nil || len(addrs) != 1 || addrs[0] != "10.10.34.34" {
+			t.Fatal("expected the DNS injection", addrs, err)
+		}
+
+		// fetch fetches the URL using the website address
+		fetch := func(URL string, transport http.RoundTripper) (string, error) {
+			client := &http.Client{Transport: transport, Timeout: time.Second}
+			req := Must1(http.NewRequest("GET", URL, nil))
+			req.Host = "www.example.com"
+			resp, err := client.Do(req)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			return string(body), err
+		}
+
+		body, err := fetch("http://10.0.0.3/", NewHTTPTransport(client))
+		if err != nil || !strings.Contains(body, BlockpageTemplateIframe.Fingerprint) {
+			t.Fatal("expected the HTTP injection", body, err)
+		}
+
+		txp := NewHTTPTransport(client)
+		txp.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			ns := &Net{Stack: client}
+			conn, err := ns.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			tc := tls.Client(conn, &tls.Config{RootCAs: client.DefaultCertPool(), ServerName: "www.example.com"})
+			if err := tc.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tc, nil
+		}
+		if _, err := fetch("https://10.0.0.3/", txp); err == nil {
+			t.Fatal("expected the SNI-based blocking")
+		}
+
+		h3txp := NewHTTP3Transport(client)
+		h3txp.TLSClientConfig.ServerName = "www.example.com"
+		defer h3txp.Close()
+		if _, err := fetch("https://10.0.0.3/", h3txp); err == nil {
+			t.Fatal("expected QUIC to be blocked")
+		}
+
+		body, err = fetch("http://10.10.34.34/", NewHTTPTransport(client))
+		if err != nil || !strings.Contains(body, BlockpageTemplateIframe.Fingerprint) {
+			t.Fatal("expected the blockpage server", body, err)
+		}
+	})
+
+	t.Run("we reject HTTP injection without a blockpage", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		scenario := CensorshipPresetIN()
+		scenario.Blockpage = nil
+		_, err := NewCensorship(&NullLogger{}, topology, scenario, &CensorshipTarget{Domain: "www.example.com"})
+		if !errors.Is(err, ErrCensorshipScenario) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
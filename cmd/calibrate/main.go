@@ -27,6 +27,9 @@ var (
 	rtt            = flag.Duration("rtt", 0, "RTT delay")
 	tlsFlag        = flag.Bool("tls", false, "run NDT0 over TLS")
 	duration       = flag.Duration("duration", 10*time.Second, "duration of the calibration")
+	direction      = flag.String("direction", "download", "NDT0 direction: download, upload, or bidirectional")
+	messageSize    = flag.Int("message-size", 65535, "size of each NDT0 write")
+	sampleInterval = flag.Duration("sample-interval", 500*time.Millisecond, "interval between NDT0 samples")
 )
 
 func main() {
@@ -73,7 +76,12 @@ func main() {
 
 	// start server in background
 	ready, serverErrch := make(chan net.Listener, 1), make(chan error, 1)
-	go netem.RunNDT0Server(
+	ndt0Options := &netem.NDT0Options{
+		Direction:      netem.NDT0Direction(*direction),
+		MessageSize:    *messageSize,
+		SampleInterval: *sampleInterval,
+	}
+	go netem.RunNDT0ServerWithOptions(
 		ctx,
 		serverStack,
 		net.ParseIP(serverAddress),
@@ -82,6 +90,7 @@ func main() {
 		ready,
 		serverErrch,
 		*tlsFlag,
+		ndt0Options,
 	)
 
 	// wait for server to be listening
@@ -90,12 +99,13 @@ func main() {
 	// run client in the background and measure speed
 	clientErrch := make(chan error, 1)
 	perfch := make(chan *netem.NDT0PerformanceSample)
-	go netem.RunNDT0Client(
+	go netem.RunNDT0ClientWithOptions(
 		ctx,
 		clientStack,
 		"ndt0.local:54321",
 		log.Log,
 		*tlsFlag,
+		ndt0Options,
 		clientErrch,
 		perfch,
 	)
@@ -121,8 +131,12 @@ func main() {
 		log.Warnf("RunNDT0Server: %s", errClient.Error())
 	}
 
-	// explicitly close the topology to await for PCAPDumper to finish
-	topology.Close()
+	// explicitly shutdown the topology to await for PCAPDumper to finish
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := topology.Shutdown(shutdownCtx); err != nil {
+		log.Warnf("topology.Shutdown: %s", err.Error())
+	}
 
 	// panic if either of them failed
 	netem.Must0(errClient)
@@ -5,6 +5,8 @@ package main
 //
 
 import (
+	"context"
+	"io"
 	"time"
 
 	"github.com/apex/log"
@@ -12,9 +14,11 @@ import (
 )
 
 // topologyCloser allows to close an open topology and release all
-// the associated hosts and links.
+// the associated servers, hosts and links.
 type topologyCloser interface {
 	Close() error
+	Shutdown(ctx context.Context) error
+	TrackServer(server io.Closer)
 }
 
 // newTopology creates a new topology. This function panics on failure.
@@ -79,7 +83,7 @@ func newTopologyStar(
 	serverStack := netem.Must1(topology.AddHost(serverAddress, serverAddress, serverLink))
 
 	// create DNS server using the server stack
-	_ = netem.Must1(netem.NewDNSServer(log.Log, serverStack, serverAddress, dnsConfig))
+	topology.TrackServer(netem.Must1(netem.NewDNSServer(log.Log, serverStack, serverAddress, dnsConfig)))
 
 	return topology, clientStack, serverStack
 }
@@ -110,7 +114,7 @@ func newTopologyPPP(
 	)
 
 	// create DNS server using the server stack
-	_ = netem.Must1(netem.NewDNSServer(log.Log, topology.Server, serverAddress, dnsConfig))
+	topology.TrackServer(netem.Must1(netem.NewDNSServer(log.Log, topology.Server, serverAddress, dnsConfig)))
 
 	return topology, topology.Client, topology.Server
 }
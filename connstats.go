@@ -0,0 +1,161 @@
+package netem
+
+//
+// Per-connection statistics
+//
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// ConnStats contains per-connection statistics.
+type ConnStats struct {
+	// BytesRead is the number of bytes read by the application.
+	BytesRead int64
+
+	// BytesWritten is the number of bytes written by the application.
+	BytesWritten int64
+
+	// Duration is the time elapsed since we created the connection or,
+	// if the connection is closed, the lifetime of the connection.
+	Duration time.Duration
+
+	// SegmentsReceived is the number of TCP segments received (zero for UDP).
+	SegmentsReceived uint64
+
+	// SegmentsSent is the number of TCP segments sent (zero for UDP).
+	SegmentsSent uint64
+
+	// Retransmissions is the number of TCP segments retransmitted (zero for UDP).
+	Retransmissions uint64
+
+	// RTT is the smoothed TCP RTT estimate (zero for UDP).
+	RTT time.Duration
+
+	// RTTVar is the TCP RTT variation (zero for UDP).
+	RTTVar time.Duration
+
+	// RTO is the TCP retransmission timeout (zero for UDP).
+	RTO time.Duration
+
+	// CongestionWindow is the TCP congestion window in segments (zero for UDP).
+	CongestionWindow uint32
+
+	// SlowStartThreshold is the TCP slow start threshold in segments (zero for UDP).
+	SlowStartThreshold uint32
+
+	// BytesInFlight is the number of bytes sent and not yet acknowledged as of
+	// the last segment received by the TCP endpoint. This field is zero for UDP
+	// and unless the stack tracks the bytes in flight (see [UNetStackOptions]).
+	BytesInFlight int64
+}
+
+// StatsConn is a [net.Conn] that collects per-connection statistics. The conns
+// returned by [UNetStack.DialContext] and by the Accept method of the listeners
+// returned by [UNetStack.ListenTCP] implement this interface, therefore you
+// can use a type assertion to obtain the statistics of a flow.
+type StatsConn interface {
+	net.Conn
+
+	// ConnStats returns a snapshot of the connection statistics.
+	ConnStats() *ConnStats
+}
+
+// connStatsCollector collects the [ConnStats] of a conn. The zero value is
+// invalid; please, construct using [newConnStatsCollector].
+type connStatsCollector struct {
+	// bytesRead is the number of bytes read.
+	bytesRead atomic.Int64
+
+	// bytesWritten is the number of bytes written.
+	bytesWritten atomic.Int64
+
+	// closed is the time when the conn was closed.
+	closed time.Time
+
+	// created is the time when the conn was created.
+	created time.Time
+
+	// ep is the OPTIONAL TCP endpoint.
+	ep tcpip.Endpoint
+
+	// inFlight is the OPTIONAL counter of the bytes in flight.
+	inFlight *atomic.Int64
+
+	// mu protects closed.
+	mu sync.Mutex
+
+	// untrack is the OPTIONAL function to stop updating inFlight.
+	untrack func()
+}
+
+// newConnStatsCollector creates a new [connStatsCollector]. The endpoint
+// is OPTIONAL and allows us to also collect TCP statistics.
+func newConnStatsCollector(ep tcpip.Endpoint) *connStatsCollector {
+	return &connStatsCollector{
+		created: time.Now(),
+		ep:      ep,
+	}
+}
+
+// onRead accounts for bytes read.
+func (csc *connStatsCollector) onRead(count int) {
+	csc.bytesRead.Add(int64(count))
+}
+
+// onWrite accounts for bytes written.
+func (csc *connStatsCollector) onWrite(count int) {
+	csc.bytesWritten.Add(int64(count))
+}
+
+// onClose records the time when the conn was closed.
+func (csc *connStatsCollector) onClose() {
+	defer csc.mu.Unlock()
+	csc.mu.Lock()
+	if csc.closed.IsZero() {
+		csc.closed = time.Now()
+		if csc.untrack != nil {
+			csc.untrack()
+		}
+	}
+}
+
+// snapshot returns a snapshot of the [ConnStats].
+func (csc *connStatsCollector) snapshot() *ConnStats {
+	csc.mu.Lock()
+	end := csc.closed
+	csc.mu.Unlock()
+	if end.IsZero() {
+		end = time.Now()
+	}
+	stats := &ConnStats{
+		BytesRead:    csc.bytesRead.Load(),
+		BytesWritten: csc.bytesWritten.Load(),
+		Duration:     end.Sub(csc.created),
+	}
+	if csc.ep != nil {
+		if tcpStats, good := csc.ep.Stats().(*tcp.Stats); good {
+			stats.SegmentsReceived = tcpStats.SegmentsReceived.Value()
+			stats.SegmentsSent = tcpStats.SegmentsSent.Value()
+			stats.Retransmissions = tcpStats.SendErrors.Retransmits.Value()
+		}
+		var info tcpip.TCPInfoOption
+		if err := csc.ep.GetSockOpt(&info); err == nil {
+			stats.RTT = info.RTT
+			stats.RTTVar = info.RTTVar
+			stats.RTO = info.RTO
+			stats.CongestionWindow = info.SndCwnd
+			stats.SlowStartThreshold = info.SndSsthresh
+		}
+	}
+	if csc.inFlight != nil {
+		stats.BytesInFlight = csc.inFlight.Load()
+	}
+	return stats
+}
@@ -0,0 +1,172 @@
+package netem
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnStats(t *testing.T) {
+	t.Run("we collect TCP stats for dialed and accepted conns", func(t *testing.T) {
+		lc := &LinkConfig{
+			LeftToRightDelay: time.Millisecond,
+			RightToLeftDelay: time.Millisecond,
+			RightToLeftPLR:   0.05,
+		}
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, lc)
+		defer topology.Close()
+
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+
+		const size = 1 << 20
+		accepted := make(chan StatsConn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			_, _ = conn.Write(make([]byte, size))
+			conn.Close()
+			accepted <- conn.(StatsConn)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		conn, err := topology.Client.DialContext(ctx, "tcp", "10.0.0.1:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		Must0(conn.SetDeadline(time.Now().Add(30 * time.Second)))
+		count, err := io.Copy(io.Discard, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != size {
+			t.Fatal("unexpected count", count)
+		}
+
+		clientStats := conn.(StatsConn).ConnStats()
+		if clientStats.BytesRead != size || clientStats.BytesWritten != 0 {
+			t.Fatalf("unexpected client stats %+v", clientStats)
+		}
+		if clientStats.SegmentsReceived <= 0 || clientStats.SegmentsSent <= 0 || clientStats.Duration <= 0 {
+			t.Fatalf("unexpected client stats %+v", clientStats)
+		}
+
+		serverConn := <-accepted
+		if serverConn == nil {
+			t.Fatal("accept failed")
+		}
+		serverStats := serverConn.ConnStats()
+		if serverStats.BytesWritten != size || serverStats.BytesRead != 0 {
+			t.Fatalf("unexpected server stats %+v", serverStats)
+		}
+		if serverStats.Retransmissions <= 0 || serverStats.RTT <= 0 {
+			t.Fatalf("unexpected server stats %+v", serverStats)
+		}
+		if serverStats.RTO <= 0 || serverStats.CongestionWindow <= 0 || serverStats.SlowStartThreshold <= 0 {
+			t.Fatalf("unexpected server stats %+v", serverStats)
+		}
+
+		// the duration does not change after we close the conn
+		time.Sleep(10 * time.Millisecond)
+		if duration := serverConn.ConnStats().Duration; duration != serverStats.Duration {
+			t.Fatal("the duration changed after close", duration, serverStats.Duration)
+		}
+	})
+
+	t.Run("we collect byte counters for UDP conns", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "udp", "10.0.0.1:53"))
+		defer conn.Close()
+		if _, err := conn.Write([]byte("abcdef")); err != nil {
+			t.Fatal(err)
+		}
+		stats := conn.(StatsConn).ConnStats()
+		if stats.BytesWritten != 6 || stats.BytesRead != 0 || stats.SegmentsSent != 0 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	})
+	t.Run("we do not track the TCP bytes in flight by default", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		defer conn.Close()
+		if topology.Client.ns.tcpProbeInstalled.Load() {
+			t.Fatal("expected no TCP probe")
+		}
+		if stats := conn.(StatsConn).ConnStats(); stats.BytesInFlight != 0 {
+			t.Fatalf("expected no bytes in flight %+v", stats)
+		}
+	})
+
+	t.Run("we track the TCP bytes in flight when requested", func(t *testing.T) {
+		lc := &LinkConfig{
+			LeftToRightDelay: 50 * time.Millisecond,
+			RightToLeftDelay: 50 * time.Millisecond,
+		}
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		server := Must1(topology.AddHost("10.0.0.1", "0.0.0.0", lc))
+		client := Must1(topology.AddHostWithOptions("10.0.0.2", "0.0.0.0", lc, &UNetStackOptions{
+			TrackTCPBytesInFlight: true,
+		}))
+
+		listener := Must1(server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}()
+
+		conn := Must1(client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		written := make(chan any)
+		go func() {
+			defer close(written)
+			_, _ = conn.Write(make([]byte, 1<<20))
+		}()
+
+		// while writing, we should have some bytes in flight
+		time.Sleep(300 * time.Millisecond)
+		if stats := conn.(StatsConn).ConnStats(); stats.BytesInFlight <= 0 {
+			t.Fatalf("expected bytes in flight %+v", stats)
+		}
+
+		// once the peer has acknowledged everything, we should have none
+		<-written
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+			stats := conn.(StatsConn).ConnStats()
+			if stats.BytesInFlight == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected no bytes in flight %+v", stats)
+			}
+		}
+
+		// closing the conn stops tracking
+		conn.Close()
+		var count int
+		client.ns.tcpInFlight.Range(func(key, value any) bool {
+			count++
+			return true
+		})
+		if count != 0 {
+			t.Fatal("expected to stop tracking", count)
+		}
+	})
+}
@@ -0,0 +1,285 @@
+package netem
+
+//
+// Connection tracking
+//
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConntrackState is the state of a [ConntrackEntry].
+type ConntrackState string
+
+const (
+	// ConntrackStateNew indicates that we only saw packets sent by the client.
+	ConntrackStateNew = ConntrackState("new")
+
+	// ConntrackStateEstablished indicates that we saw packets in both directions.
+	ConntrackStateEstablished = ConntrackState("established")
+
+	// ConntrackStateClosing indicates that we saw a TCP FIN in one direction.
+	ConntrackStateClosing = ConntrackState("closing")
+
+	// ConntrackStateClosed indicates that we saw a TCP FIN in both directions
+	// or a TCP RST. A closed entry is never reopened: a TCP SYN for the same
+	// five-tuple after a closed entry creates a new entry.
+	ConntrackStateClosed = ConntrackState("closed")
+)
+
+// ConntrackEntry is a snapshot of a flow tracked by a [Conntrack].
+type ConntrackEntry struct {
+	// ClientBytes counts the bytes of the IP packets sent by the client.
+	ClientBytes int64 `json:"client_bytes"`
+
+	// ClientPackets counts the packets sent by the client.
+	ClientPackets int64 `json:"client_packets"`
+
+	// FirstSeen is when we saw the first packet.
+	FirstSeen time.Time `json:"first_seen"`
+
+	// FiveTuple is the five-tuple of the flow in the client->server
+	// direction, where the client is the endpoint that sent the first
+	// packet we saw. For ICMP flows, the ports are zero.
+	FiveTuple TraceFiveTuple `json:"five_tuple"`
+
+	// LastSeen is when we saw the last packet.
+	LastSeen time.Time `json:"last_seen"`
+
+	// ServerBytes counts the bytes of the IP packets sent by the server.
+	ServerBytes int64 `json:"server_bytes"`
+
+	// ServerPackets counts the packets sent by the server.
+	ServerPackets int64 `json:"server_packets"`
+
+	// State is the flow state.
+	State ConntrackState `json:"state"`
+}
+
+// Conntrack is a connection tracking table containing the flows observed by
+// the [Link]s and [Router]s using it, which allows tests to query the flows
+// along with their state and byte counters. Use the Conntrack field of [LinkConfig]
+// and [Router.SetConntrack] to attach a table. You can share a table among links
+// and routers, in which case each packet traversing several of them counts
+// several times. The [DPIEngine] also uses a [Conntrack] to keep track of the
+// flows it inspects (see [DPIEngine.Conntrack]).
+//
+// We consider a flow expired after [ConntrackIdleTimeout] of silence, in which
+// case the next packet with the same five-tuple creates a new entry. The table
+// keeps expired and closed entries until they are replaced, until it grows
+// too large, or until you call [Conntrack.Flush].
+//
+// The zero value is invalid; please, construct using [NewConntrack].
+type Conntrack struct {
+	// flows contains the flows indexed by direction-independent key.
+	flows map[string]*conntrackFlow
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+}
+
+// ConntrackIdleTimeout is the idle time after which a flow expires.
+const ConntrackIdleTimeout = 30 * time.Second
+
+// conntrackMaxFlows is the number of flows after which we garbage
+// collect the expired and closed flows when adding a new one.
+const conntrackMaxFlows = 1 << 14
+
+// NewConntrack creates a new [Conntrack] instance.
+func NewConntrack() *Conntrack {
+	return &Conntrack{
+		flows: map[string]*conntrackFlow{},
+		mu:    sync.Mutex{},
+	}
+}
+
+// Flows returns a snapshot of the tracked flows sorted by the time at which
+// we saw their first packet, including the expired and closed ones.
+func (ct *Conntrack) Flows() []ConntrackEntry {
+	defer ct.mu.Unlock()
+	ct.mu.Lock()
+	entries := []ConntrackEntry{}
+	for _, flow := range ct.flows {
+		entries = append(entries, flow.entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].FirstSeen.Before(entries[j].FirstSeen)
+	})
+	return entries
+}
+
+// Lookup returns a snapshot of the flow with the given five-tuple, which may
+// be in either the client->server or the server->client direction.
+func (ct *Conntrack) Lookup(ft TraceFiveTuple) (ConntrackEntry, bool) {
+	defer ct.mu.Unlock()
+	ct.mu.Lock()
+	flow := ct.flows[conntrackKey(ft)]
+	if flow == nil {
+		return ConntrackEntry{}, false
+	}
+	return flow.entry, true
+}
+
+// Flush removes all the flows from the table.
+func (ct *Conntrack) Flush() {
+	defer ct.mu.Unlock()
+	ct.mu.Lock()
+	ct.flows = map[string]*conntrackFlow{}
+}
+
+// observe tracks the given raw IP packet. It is safe to call this
+// method with a nil [Conntrack], in which case it does nothing.
+func (ct *Conntrack) observe(rawPacket []byte) {
+	if ct == nil {
+		return
+	}
+	packet, err := DissectPacket(rawPacket)
+	if err != nil {
+		return
+	}
+	ct.track(packet, len(rawPacket))
+}
+
+// track updates the flow to which the given packet of the given size belongs,
+// creating it if needed, and returns the flow and the packet direction.
+func (ct *Conntrack) track(packet *DissectedPacket, size int) (*conntrackFlow, DPIDirection) {
+	ft := conntrackFiveTuple(packet)
+	key := conntrackKey(ft)
+	now := time.Now()
+
+	defer ct.mu.Unlock()
+	ct.mu.Lock()
+
+	flow := ct.flows[key]
+	if flow == nil || flow.expiredLocked(now) || flow.reopenedLocked(packet) {
+		if len(ct.flows) >= conntrackMaxFlows {
+			ct.collectGarbageLocked(now)
+		}
+		flow = &conntrackFlow{
+			entry: ConntrackEntry{
+				FirstSeen: now,
+				FiveTuple: ft,
+				State:     ConntrackStateNew,
+			},
+			values: map[any]any{},
+		}
+		ct.flows[key] = flow
+	}
+
+	direction := DPIDirectionServerToClient
+	if ft == flow.entry.FiveTuple {
+		direction = DPIDirectionClientToServer
+	}
+	flow.updateLocked(packet, direction, size, now)
+	return flow, direction
+}
+
+// collectGarbageLocked removes the expired and closed flows. This method
+// MUST be called while holding the [Conntrack] mutex.
+func (ct *Conntrack) collectGarbageLocked(now time.Time) {
+	for key, flow := range ct.flows {
+		if flow.expiredLocked(now) || flow.entry.State == ConntrackStateClosed {
+			delete(ct.flows, key)
+		}
+	}
+}
+
+// value returns the value associated with the given key for the given flow,
+// using the given function to create the value on first use. This allows
+// components (e.g., the [DPIEngine]) to attach state to the flows.
+func (ct *Conntrack) value(flow *conntrackFlow, key any, create func() any) any {
+	defer ct.mu.Unlock()
+	ct.mu.Lock()
+	value, found := flow.values[key]
+	if !found {
+		value = create()
+		flow.values[key] = value
+	}
+	return value
+}
+
+// conntrackFlow is a flow tracked by [Conntrack].
+type conntrackFlow struct {
+	// entry is the public view of the flow.
+	entry ConntrackEntry
+
+	// finFromClient indicates that the client sent a TCP FIN.
+	finFromClient bool
+
+	// finFromServer indicates that the server sent a TCP FIN.
+	finFromServer bool
+
+	// values contains the values attached to the flow.
+	values map[any]any
+}
+
+// expiredLocked returns whether the flow has been silent for too long. This
+// method MUST be called while holding the [Conntrack] mutex.
+func (cf *conntrackFlow) expiredLocked(now time.Time) bool {
+	return now.Sub(cf.entry.LastSeen) > ConntrackIdleTimeout
+}
+
+// reopenedLocked returns whether the given packet opens a new connection
+// reusing the five-tuple of a closed flow. This method MUST be called
+// while holding the [Conntrack] mutex.
+func (cf *conntrackFlow) reopenedLocked(packet *DissectedPacket) bool {
+	return cf.entry.State == ConntrackStateClosed && packet.TCP != nil && packet.TCP.SYN && !packet.TCP.ACK
+}
+
+// updateLocked updates the flow using the given packet. This method
+// MUST be called while holding the [Conntrack] mutex.
+func (cf *conntrackFlow) updateLocked(packet *DissectedPacket, direction DPIDirection, size int, now time.Time) {
+	cf.entry.LastSeen = now
+	switch direction {
+	case DPIDirectionClientToServer:
+		cf.entry.ClientBytes += int64(size)
+		cf.entry.ClientPackets++
+	default:
+		cf.entry.ServerBytes += int64(size)
+		cf.entry.ServerPackets++
+		if cf.entry.State == ConntrackStateNew {
+			cf.entry.State = ConntrackStateEstablished
+		}
+	}
+	if packet.TCP == nil {
+		return
+	}
+	switch {
+	case packet.TCP.RST:
+		cf.entry.State = ConntrackStateClosed
+	case packet.TCP.FIN:
+		if direction == DPIDirectionClientToServer {
+			cf.finFromClient = true
+		} else {
+			cf.finFromServer = true
+		}
+		cf.entry.State = ConntrackStateClosing
+		if cf.finFromClient && cf.finFromServer {
+			cf.entry.State = ConntrackStateClosed
+		}
+	}
+}
+
+// conntrackFiveTuple returns the five-tuple of the given packet.
+func conntrackFiveTuple(packet *DissectedPacket) TraceFiveTuple {
+	return TraceFiveTuple{
+		DestinationIP:   packet.DestinationIPAddress(),
+		DestinationPort: packet.DestinationPort(),
+		Protocol:        packet.TransportProtocol(),
+		SourceIP:        packet.SourceIPAddress(),
+		SourcePort:      packet.SourcePort(),
+	}
+}
+
+// conntrackKey returns a key identifying both directions of a flow.
+func conntrackKey(ft TraceFiveTuple) string {
+	source := fmt.Sprintf("%s/%d", ft.SourceIP, ft.SourcePort)
+	dest := fmt.Sprintf("%s/%d", ft.DestinationIP, ft.DestinationPort)
+	if source > dest {
+		source, dest = dest, source
+	}
+	return fmt.Sprintf("%s %s %d", source, dest, ft.Protocol)
+}
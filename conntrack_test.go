@@ -0,0 +1,233 @@
+package netem
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket/layers"
+)
+
+func TestConntrack(t *testing.T) {
+	client, server := net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1)
+
+	// newSegment returns a TCP segment using the given flags
+	newSegment := func(fromClient bool, flags string, payload []byte) []byte {
+		tcp := &layers.TCP{SrcPort: 54321, DstPort: 443, Window: 65535}
+		src, dst := client, server
+		if !fromClient {
+			tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+			src, dst = dst, src
+		}
+		for _, flag := range flags {
+			switch flag {
+			case 'S':
+				tcp.SYN = true
+			case 'A':
+				tcp.ACK = true
+			case 'F':
+				tcp.FIN = true
+			case 'R':
+				tcp.RST = true
+			}
+		}
+		return fuzzSerializeIPv4(src, dst, tcp, payload)
+	}
+
+	// expectState checks the state of the only flow in the table
+	expectState := func(t *testing.T, ct *Conntrack, expect ConntrackState) {
+		t.Helper()
+		flows := ct.Flows()
+		if len(flows) != 1 {
+			t.Fatal("expected exactly one flow, got", len(flows))
+		}
+		if flows[0].State != expect {
+			t.Fatal("expected", expect, "got", flows[0].State)
+		}
+	}
+
+	t.Run("we track the TCP state and counters", func(t *testing.T) {
+		ct := NewConntrack()
+		syn := newSegment(true, "S", nil)
+		ct.observe(syn)
+		expectState(t, ct, ConntrackStateNew)
+		ct.observe(newSegment(false, "SA", nil))
+		expectState(t, ct, ConntrackStateEstablished)
+		data := newSegment(true, "A", []byte("hello"))
+		ct.observe(data)
+		ct.observe(newSegment(true, "FA", nil))
+		expectState(t, ct, ConntrackStateClosing)
+		ct.observe(newSegment(false, "FA", nil))
+		expectState(t, ct, ConntrackStateClosed)
+		ct.observe(newSegment(true, "A", nil)) // the last ACK does not create a new flow
+		expectState(t, ct, ConntrackStateClosed)
+
+		entry := ct.Flows()[0]
+		if entry.FirstSeen.IsZero() || entry.LastSeen.Before(entry.FirstSeen) {
+			t.Fatal("unexpected timestamps", entry.FirstSeen, entry.LastSeen)
+		}
+		expect := ConntrackEntry{
+			ClientBytes:   int64(len(syn)*3 + len(data)),
+			ClientPackets: 4,
+			FiveTuple: TraceFiveTuple{
+				DestinationIP:   "10.0.0.1",
+				DestinationPort: 443,
+				Protocol:        layers.IPProtocolTCP,
+				SourceIP:        "10.0.0.2",
+				SourcePort:      54321,
+			},
+			ServerBytes:   int64(len(syn) * 2),
+			ServerPackets: 2,
+			State:         ConntrackStateClosed,
+		}
+		entry.FirstSeen, entry.LastSeen = time.Time{}, time.Time{}
+		if diff := cmp.Diff(expect, entry); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("a RST closes the flow and a SYN reopens it", func(t *testing.T) {
+		ct := NewConntrack()
+		ct.observe(newSegment(true, "S", nil))
+		ct.observe(newSegment(false, "RA", nil))
+		expectState(t, ct, ConntrackStateClosed)
+		ct.observe(newSegment(true, "S", nil))
+		expectState(t, ct, ConntrackStateNew)
+		if entry := ct.Flows()[0]; entry.ClientPackets != 1 || entry.ServerPackets != 0 {
+			t.Fatal("expected new counters", entry)
+		}
+	})
+
+	t.Run("we can lookup a flow in either direction", func(t *testing.T) {
+		ct := NewConntrack()
+		ct.observe(fuzzSerializeIPv4(client, server, &layers.UDP{SrcPort: 5353, DstPort: 53}, []byte("query")))
+		expectState(t, ct, ConntrackStateNew)
+		ct.observe(fuzzSerializeIPv4(server, client, &layers.UDP{SrcPort: 53, DstPort: 5353}, []byte("response")))
+		expectState(t, ct, ConntrackStateEstablished)
+		ft := TraceFiveTuple{
+			DestinationIP:   "10.0.0.2",
+			DestinationPort: 5353,
+			Protocol:        layers.IPProtocolUDP,
+			SourceIP:        "10.0.0.1",
+			SourcePort:      53,
+		}
+		entry, found := ct.Lookup(ft)
+		if !found {
+			t.Fatal("expected to find the flow")
+		}
+		if entry.FiveTuple.SourceIP != "10.0.0.2" || entry.ClientPackets != 1 || entry.ServerPackets != 1 {
+			t.Fatal("unexpected entry", entry)
+		}
+		ft.SourcePort = 54
+		if _, found := ct.Lookup(ft); found {
+			t.Fatal("expected not to find the flow")
+		}
+	})
+
+	t.Run("an expired flow starts over", func(t *testing.T) {
+		ct := NewConntrack()
+		ct.observe(newSegment(true, "S", nil))
+		ct.observe(newSegment(false, "SA", nil))
+		for _, flow := range ct.flows {
+			flow.entry.LastSeen = time.Now().Add(-2 * ConntrackIdleTimeout)
+		}
+		ct.observe(newSegment(false, "A", nil))
+		expectState(t, ct, ConntrackStateNew)
+		if entry := ct.Flows()[0]; entry.FiveTuple.SourcePort != 443 {
+			t.Fatal("expected the server to become the client", entry)
+		}
+	})
+
+	t.Run("Flush removes all the flows", func(t *testing.T) {
+		ct := NewConntrack()
+		ct.observe(newSegment(true, "S", nil))
+		ct.observe([]byte{0x45}) // ignored
+		ct.Flush()
+		if flows := ct.Flows(); len(flows) != 0 {
+			t.Fatal("expected no flows", flows)
+		}
+	})
+
+	t.Run("observe is safe with a nil Conntrack", func(t *testing.T) {
+		var ct *Conntrack
+		ct.observe(newSegment(true, "S", nil))
+	})
+}
+
+func TestConntrackTopology(t *testing.T) {
+	// create a star topology where the router and the client link
+	// each use their own conntrack and the client link uses DPI
+	routerConntrack, linkConntrack := NewConntrack(), NewConntrack()
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+	topology.SetConntrack(routerConntrack)
+	server := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", &LinkConfig{}))
+	dpi := NewDPIEngine(&NullLogger{})
+	client := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{
+		Conntrack:        linkConntrack,
+		DPIEngine:        dpi,
+		LeftToRightDelay: time.Millisecond,
+	}))
+
+	// exchange a message over TCP and close the connection
+	listener := Must1(server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+	defer listener.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		done <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := Must1(client.DialContext(ctx, "tcp", "10.0.0.1:80"))
+	buffer := make([]byte, 5)
+	if _, err := conn.Read(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// wait for the FIN segments to traverse the topology
+	lookup := func(ct *Conntrack) (entry ConntrackEntry) {
+		ft := TraceFiveTuple{
+			DestinationIP:   "10.0.0.1",
+			DestinationPort: 80,
+			Protocol:        layers.IPProtocolTCP,
+			SourceIP:        "10.0.0.2",
+			SourcePort:      uint16(conn.LocalAddr().(*net.TCPAddr).Port),
+		}
+		for attempt := 0; attempt < 100; attempt++ {
+			entry, _ = ct.Lookup(ft)
+			if entry.State == ConntrackStateClosed {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return
+	}
+
+	for name, ct := range map[string]*Conntrack{"router": routerConntrack, "link": linkConntrack, "dpi": dpi.Conntrack()} {
+		t.Run(name, func(t *testing.T) {
+			entry := lookup(ct)
+			if entry.State != ConntrackStateClosed {
+				t.Fatal("expected closed flow, got", entry.State)
+			}
+			if entry.FiveTuple.SourceIP != "10.0.0.2" {
+				t.Fatal("expected the client to open the flow", entry.FiveTuple)
+			}
+			if entry.ClientPackets <= 0 || entry.ServerPackets <= 0 || entry.ServerBytes <= 0 {
+				t.Fatal("unexpected counters", entry)
+			}
+		})
+	}
+}
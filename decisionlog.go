@@ -0,0 +1,296 @@
+package netem
+
+//
+// Record and replay of nondeterministic decisions
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DecisionKind is the kind of a [Decision].
+type DecisionKind string
+
+const (
+	// DecisionKindFloat64 is a random draw returning a float64 (e.g.,
+	// the draw deciding whether a [Link] loses a frame).
+	DecisionKindFloat64 = DecisionKind("float64")
+
+	// DecisionKindInt63n is a random draw returning an int64 (e.g.,
+	// the draw deciding the jitter a [Link] adds to a frame).
+	DecisionKindInt63n = DecisionKind("int63n")
+
+	// DecisionKindDPIVerdict is a [DPIPolicy] applied by the [DPIEngine].
+	DecisionKindDPIVerdict = DecisionKind("dpi_verdict")
+)
+
+// Decision is a nondeterministic decision recorded by a [DecisionLog].
+type Decision struct {
+	// Delay is the extra delay of [DecisionKindDPIVerdict].
+	Delay time.Duration `json:"delay,omitempty"`
+
+	// Flags contains the frame flags of [DecisionKindDPIVerdict].
+	Flags int64 `json:"flags,omitempty"`
+
+	// Float64 is the result of [DecisionKindFloat64].
+	Float64 float64 `json:"float64,omitempty"`
+
+	// Flow is the five-tuple of the packet of [DecisionKindDPIVerdict].
+	Flow string `json:"flow,omitempty"`
+
+	// Int63n is the result of [DecisionKindInt63n].
+	Int63n int64 `json:"int63n,omitempty"`
+
+	// Kind is the decision kind.
+	Kind DecisionKind `json:"kind"`
+
+	// PLR is the extra packet loss rate of [DecisionKindDPIVerdict].
+	PLR float64 `json:"plr,omitempty"`
+}
+
+// DecisionLog records the nondeterministic decisions taken during an emulation
+// run and allows to replay them, which helps to reproduce and debug anomalous
+// results. Use the DecisionLog field of [LinkConfig] and [DNSServerOptions] to
+// configure which components take part in the recording. The zero value is
+// invalid; please, construct using [NewDecisionRecorder] or [NewDecisionReplayer].
+//
+// We organize decisions in streams named after their source:
+//
+// - "link/<src>-><dst>" contains the random draws with which a [Link] direction
+// decides which frames to lose and how much jitter to add, where <src> and
+// <dst> are the IP addresses of the sending and receiving NICs;
+//
+// - "dpi/<src>-><dst>" contains the verdicts of the [DPIEngine] used by a
+// [Link] direction;
+//
+// - "dns/<address>" contains the random draws with which a [DNSServer] decides
+// which queries to drop and which [DNSRcodeRule]s to apply.
+//
+// When names collide (e.g., for links between NICs without addresses such as
+// [RouterPort]s), we append "#2", "#3", and so on in creation order.
+//
+// When replaying, each stream returns the recorded draws in order, therefore
+// a run that creates the same links and servers in the same order and that
+// exchanges the same traffic takes the same decisions. Because the DPI verdicts
+// only depend on the packets, we do not force them and we instead compare them
+// with the recorded ones. Each mismatch, including running out of recorded
+// decisions, is a divergence (see [DecisionLog.Divergences]), after which we
+// use fresh random draws. Because the traffic depends on the ephemeral ports,
+// consider using [UNetStack.SetSequentialPortAllocation] to reduce divergences.
+type DecisionLog struct {
+	// cursors contains the index of the next decision of each stream when replaying.
+	cursors map[string]int
+
+	// divergences contains the first divergence of each stream.
+	divergences map[string]string
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// names counts the streams created for each base name.
+	names map[string]int
+
+	// replay indicates whether we are replaying.
+	replay bool
+
+	// streams contains the decisions of each stream.
+	streams map[string][]*Decision
+}
+
+// NewDecisionRecorder creates a [DecisionLog] that records decisions. Use
+// [DecisionLog.Save] to write the recorded decisions when you are done.
+func NewDecisionRecorder() *DecisionLog {
+	return &DecisionLog{
+		cursors:     map[string]int{},
+		divergences: map[string]string{},
+		mu:          sync.Mutex{},
+		names:       map[string]int{},
+		replay:      false,
+		streams:     map[string][]*Decision{},
+	}
+}
+
+// ErrDecisionLog indicates that we cannot parse a [DecisionLog].
+var ErrDecisionLog = errors.New("netem: invalid decision log")
+
+// decisionLogFile is the format of the file written by [DecisionLog.Save].
+type decisionLogFile struct {
+	Streams map[string][]*Decision `json:"streams"`
+}
+
+// NewDecisionReplayer creates a [DecisionLog] that replays the decisions
+// that [DecisionLog.Save] wrote to the given reader.
+func NewDecisionReplayer(reader io.Reader) (*DecisionLog, error) {
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	file := &decisionLogFile{}
+	if err := decoder.Decode(file); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecisionLog, err.Error())
+	}
+	dl := NewDecisionRecorder()
+	dl.replay = true
+	if file.Streams != nil {
+		dl.streams = file.Streams
+	}
+	return dl, nil
+}
+
+// Save writes the decisions as JSON to the given writer. You should call this
+// method after closing the topology, to make sure no decision is missing.
+func (dl *DecisionLog) Save(writer io.Writer) error {
+	defer dl.mu.Unlock()
+	dl.mu.Lock()
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&decisionLogFile{Streams: dl.streams})
+}
+
+// Decisions returns a copy of the decisions of the given stream.
+func (dl *DecisionLog) Decisions(stream string) []*Decision {
+	defer dl.mu.Unlock()
+	dl.mu.Lock()
+	return append([]*Decision{}, dl.streams[stream]...)
+}
+
+// Divergences returns the sorted descriptions of the first divergence of each
+// stream that diverged while replaying. When recording, there are none.
+func (dl *DecisionLog) Divergences() []string {
+	defer dl.mu.Unlock()
+	dl.mu.Lock()
+	descriptions := []string{}
+	for _, description := range dl.divergences {
+		descriptions = append(descriptions, description)
+	}
+	sort.Strings(descriptions)
+	return descriptions
+}
+
+// newStream creates a new [decisionStream] using the given base name, or
+// returns nil when the [DecisionLog] is nil.
+func (dl *DecisionLog) newStream(base string) *decisionStream {
+	if dl == nil {
+		return nil
+	}
+	defer dl.mu.Unlock()
+	dl.mu.Lock()
+	dl.names[base]++
+	name := base
+	if count := dl.names[base]; count > 1 {
+		name = fmt.Sprintf("%s#%d", base, count)
+	}
+	return &decisionStream{
+		dl:   dl,
+		name: name,
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// decisionStream is a stream of decisions inside a [DecisionLog].
+type decisionStream struct {
+	dl   *DecisionLog
+	name string
+	rng  *rand.Rand
+}
+
+var _ LinkFwdRNG = &decisionStream{}
+
+// nextLocked returns the next recorded decision of the given kind when
+// replaying, and records a divergence on failure. This method MUST be
+// called while holding the [DecisionLog] mutex.
+func (ds *decisionStream) nextLocked(kind DecisionKind) (*Decision, bool) {
+	dl := ds.dl
+	index := dl.cursors[ds.name]
+	decisions := dl.streams[ds.name]
+	if index >= len(decisions) {
+		ds.divergeLocked(index, fmt.Sprintf("expected %s, found end of stream", kind))
+		return nil, false
+	}
+	decision := decisions[index]
+	if decision.Kind != kind {
+		ds.divergeLocked(index, fmt.Sprintf("expected %s, found %s", kind, decision.Kind))
+		return nil, false
+	}
+	dl.cursors[ds.name] = index + 1
+	return decision, true
+}
+
+// divergeLocked records a divergence at the given index unless the stream
+// already diverged, in which case we stop replaying the stream. This method
+// MUST be called while holding the [DecisionLog] mutex.
+func (ds *decisionStream) divergeLocked(index int, reason string) {
+	dl := ds.dl
+	if _, found := dl.divergences[ds.name]; !found {
+		dl.divergences[ds.name] = fmt.Sprintf("%s: decision #%d: %s", ds.name, index, reason)
+	}
+	dl.cursors[ds.name] = len(dl.streams[ds.name]) // stop replaying
+}
+
+// Float64 implements [LinkFwdRNG].
+func (ds *decisionStream) Float64() float64 {
+	dl := ds.dl
+	defer dl.mu.Unlock()
+	dl.mu.Lock()
+	if !dl.replay {
+		value := ds.rng.Float64()
+		dl.streams[ds.name] = append(dl.streams[ds.name], &Decision{Float64: value, Kind: DecisionKindFloat64})
+		return value
+	}
+	if decision, good := ds.nextLocked(DecisionKindFloat64); good {
+		return decision.Float64
+	}
+	return ds.rng.Float64()
+}
+
+// Int63n implements [LinkFwdRNG].
+func (ds *decisionStream) Int63n(n int64) int64 {
+	dl := ds.dl
+	defer dl.mu.Unlock()
+	dl.mu.Lock()
+	if !dl.replay {
+		value := ds.rng.Int63n(n)
+		dl.streams[ds.name] = append(dl.streams[ds.name], &Decision{Int63n: value, Kind: DecisionKindInt63n})
+		return value
+	}
+	index := dl.cursors[ds.name]
+	if decision, good := ds.nextLocked(DecisionKindInt63n); good {
+		if decision.Int63n >= 0 && decision.Int63n < n {
+			return decision.Int63n
+		}
+		ds.divergeLocked(index, fmt.Sprintf("recorded %d is out of range for %d", decision.Int63n, n))
+	}
+	return ds.rng.Int63n(n)
+}
+
+// onDPIVerdict records the given verdict or, when replaying, compares it with
+// the recorded one. It is safe to call this method with a nil stream.
+func (ds *decisionStream) onDPIVerdict(frame *Frame, policy *DPIPolicy) {
+	if ds == nil {
+		return
+	}
+	ev := newTraceEventForPacket(TraceEventDPIVerdict, "", frame.Payload)
+	current := &Decision{
+		Delay: policy.Delay,
+		Flags: policy.Flags,
+		Flow:  ev.FiveTuple.String(),
+		Kind:  DecisionKindDPIVerdict,
+		PLR:   policy.PLR,
+	}
+	dl := ds.dl
+	defer dl.mu.Unlock()
+	dl.mu.Lock()
+	if !dl.replay {
+		dl.streams[ds.name] = append(dl.streams[ds.name], current)
+		return
+	}
+	index := dl.cursors[ds.name]
+	if recorded, good := ds.nextLocked(DecisionKindDPIVerdict); good && *recorded != *current {
+		ds.divergeLocked(index, fmt.Sprintf("expected %+v, found %+v", *recorded, *current))
+	}
+}
@@ -0,0 +1,134 @@
+package netem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecisionLog(t *testing.T) {
+	t.Run("we can replay the recorded draws", func(t *testing.T) {
+		recorder := NewDecisionRecorder()
+		stream := recorder.newStream("link/10.0.0.2->0.0.0.0")
+		expectFloat, expectInt := stream.Float64(), stream.Int63n(1000)
+		buffer := &bytes.Buffer{}
+		Must0(recorder.Save(buffer))
+
+		replayer := Must1(NewDecisionReplayer(buffer))
+		stream = replayer.newStream("link/10.0.0.2->0.0.0.0")
+		if got := stream.Float64(); got != expectFloat {
+			t.Fatal("expected", expectFloat, "got", got)
+		}
+		if got := stream.Int63n(1000); got != expectInt {
+			t.Fatal("expected", expectInt, "got", got)
+		}
+		if diff := cmp.Diff([]string{}, replayer.Divergences()); diff != "" {
+			t.Fatal(diff)
+		}
+
+		// running out of recorded decisions is a divergence
+		_ = stream.Float64()
+		expect := []string{"link/10.0.0.2->0.0.0.0: decision #2: expected float64, found end of stream"}
+		if diff := cmp.Diff(expect, replayer.Divergences()); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("we report the first divergence when the kind does not match", func(t *testing.T) {
+		recorder := NewDecisionRecorder()
+		_ = recorder.newStream("dns/10.0.0.1").Float64()
+		buffer := &bytes.Buffer{}
+		Must0(recorder.Save(buffer))
+
+		replayer := Must1(NewDecisionReplayer(buffer))
+		stream := replayer.newStream("dns/10.0.0.1")
+		_ = stream.Int63n(1000)
+		_ = stream.Float64() // we stop replaying after the first divergence
+		expect := []string{"dns/10.0.0.1: decision #0: expected int63n, found float64"}
+		if diff := cmp.Diff(expect, replayer.Divergences()); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("we disambiguate streams with the same name", func(t *testing.T) {
+		recorder := NewDecisionRecorder()
+		_ = recorder.newStream("link/0.0.0.0->0.0.0.0").Float64()
+		_ = recorder.newStream("link/0.0.0.0->0.0.0.0").Float64()
+		for _, name := range []string{"link/0.0.0.0->0.0.0.0", "link/0.0.0.0->0.0.0.0#2"} {
+			if len(recorder.Decisions(name)) != 1 {
+				t.Fatal("expected one decision for", name)
+			}
+		}
+	})
+
+	t.Run("DNS servers record the drop decisions", func(t *testing.T) {
+		recorder := NewDecisionRecorder()
+		options := &DNSServerOptions{DecisionLog: recorder, DropRate: 0.5}
+		rng := options.newRNG("10.0.0.1")
+		_ = options.shouldDrop(rng)
+		if len(recorder.Decisions("dns/10.0.0.1")) != 1 {
+			t.Fatal("expected one decision")
+		}
+	})
+
+	t.Run("we reject invalid files", func(t *testing.T) {
+		_, err := NewDecisionReplayer(strings.NewReader(`{"nonexistent": 1}`))
+		if !errors.Is(err, ErrDecisionLog) {
+			t.Fatal("not the error we expected", err)
+		}
+	})
+
+	t.Run("replaying a link run loses the same packets", func(t *testing.T) {
+		// run sends datagrams over a lossy link and returns the received ones
+		run := func(dl *DecisionLog) []string {
+			topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{
+				DecisionLog:    dl,
+				LeftToRightPLR: 0.3,
+			})
+			defer topology.Close()
+			server := Must1(topology.Server.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5353}))
+			defer server.Close()
+			client := Must1(topology.Client.DialContext(context.Background(), "udp", "10.0.0.1:5353"))
+			defer client.Close()
+			for idx := 0; idx < 32; idx++ {
+				Must1(client.Write([]byte{byte(idx)}))
+				time.Sleep(time.Millisecond)
+			}
+			var received []string
+			buffer := make([]byte, 16)
+			for {
+				server.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+				count, _, err := server.ReadFrom(buffer)
+				if err != nil {
+					return received
+				}
+				received = append(received, string(buffer[:count]))
+			}
+		}
+
+		recorder := NewDecisionRecorder()
+		expect := run(recorder)
+		if len(expect) <= 0 || len(expect) >= 32 {
+			t.Fatal("expected some losses but not all", len(expect))
+		}
+		if len(recorder.Decisions("link/10.0.0.2->10.0.0.1")) <= 0 {
+			t.Fatal("expected to record some decisions")
+		}
+		buffer := &bytes.Buffer{}
+		Must0(recorder.Save(buffer))
+
+		replayer := Must1(NewDecisionReplayer(buffer))
+		if diff := cmp.Diff(expect, run(replayer)); diff != "" {
+			t.Fatal(diff)
+		}
+		if diff := cmp.Diff([]string{}, replayer.Divergences()); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+}
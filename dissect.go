@@ -5,14 +5,20 @@ package netem
 //
 
 import (
+	"encoding/binary"
 	"errors"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
 )
 
 // DissectedPacket is a dissected IP packet. The zero-value is invalid; you
-// MUST use the [dissectPacket] factory to create a new instance.
+// MUST use the [DissectPacket] factory to create a new instance.
+//
+// Besides the gopacket layers, this struct provides methods to access the
+// application layer (e.g., [DissectedPacket.TLSServerName]), which are
+// useful to write custom [DPIRule]s and test assertions.
 type DissectedPacket struct {
 	// Packet is the underlying packet.
 	Packet gopacket.Packet
@@ -25,6 +31,12 @@ type DissectedPacket struct {
 
 	// UDP is the POSSIBLY NIL UDP layer.
 	UDP *layers.UDP
+
+	// ICMPv4 is the POSSIBLY NIL ICMPv4 layer.
+	ICMPv4 *layers.ICMPv4
+
+	// ICMPv6 is the POSSIBLY NIL ICMPv6 layer.
+	ICMPv6 *layers.ICMPv6
 }
 
 // ErrDissectShortPacket indicates the packet is too short.
@@ -36,7 +48,9 @@ var ErrDissectNetwork = errors.New("netem: dissect: unsupported network protocol
 // ErrDissectTransport indicates that we do not support the packet's transport protocol.
 var ErrDissectTransport = errors.New("netem: dissect: unsupported transport protocol")
 
-// DissectPacket parses a packet TCP/IP layers.
+// DissectPacket parses the TCP/IP layers of the given raw IPv4 or IPv6 packet,
+// such as the ones read from a [NIC] or contained in a [Frame]. Parsing the
+// application layer happens lazily when calling the corresponding methods.
 func DissectPacket(rawPacket []byte) (*DissectedPacket, error) {
 	dp := &DissectedPacket{}
 
@@ -69,13 +83,36 @@ func DissectPacket(rawPacket []byte) (*DissectedPacket, error) {
 		return nil, ErrDissectNetwork
 	}
 
-	// parse the transport layer
+	// parse the transport layer (note that the transport layer may be
+	// missing, e.g., when the IP packet is a fragment)
 	switch dp.TransportProtocol() {
 	case layers.IPProtocolTCP:
-		dp.TCP = dp.Packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		tcp, good := dp.Packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !good {
+			return nil, ErrDissectTransport
+		}
+		dp.TCP = tcp
 
 	case layers.IPProtocolUDP:
-		dp.UDP = dp.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		udp, good := dp.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !good {
+			return nil, ErrDissectTransport
+		}
+		dp.UDP = udp
+
+	case layers.IPProtocolICMPv4:
+		icmp, good := dp.Packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		if !good {
+			return nil, ErrDissectTransport
+		}
+		dp.ICMPv4 = icmp
+
+	case layers.IPProtocolICMPv6:
+		icmp, good := dp.Packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+		if !good {
+			return nil, ErrDissectTransport
+		}
+		dp.ICMPv6 = icmp
 
 	default:
 		return nil, ErrDissectTransport
@@ -124,13 +161,16 @@ func (dp *DissectedPacket) DestinationIPAddress() string {
 	}
 }
 
-// DestinationPort returns the packet's destination port.
+// DestinationPort returns the packet's destination port. ICMP
+// packets do not have ports, so we return zero in such a case.
 func (dp *DissectedPacket) DestinationPort() uint16 {
 	switch {
 	case dp.TCP != nil:
 		return uint16(dp.TCP.DstPort)
 	case dp.UDP != nil:
 		return uint16(dp.UDP.DstPort)
+	case dp.ICMPv4 != nil, dp.ICMPv6 != nil:
+		return 0
 	default:
 		panic(ErrDissectTransport)
 	}
@@ -148,13 +188,16 @@ func (dp *DissectedPacket) SourceIPAddress() string {
 	}
 }
 
-// SourcePort returns the packet's source port.
+// SourcePort returns the packet's source port. ICMP packets
+// do not have ports, so we return zero in such a case.
 func (dp *DissectedPacket) SourcePort() uint16 {
 	switch {
 	case dp.TCP != nil:
 		return uint16(dp.TCP.SrcPort)
 	case dp.UDP != nil:
 		return uint16(dp.UDP.SrcPort)
+	case dp.ICMPv4 != nil, dp.ICMPv6 != nil:
+		return 0
 	default:
 		panic(ErrDissectTransport)
 	}
@@ -179,6 +222,10 @@ func (dp *DissectedPacket) Serialize() ([]byte, error) {
 		dp.TCP.SetNetworkLayerForChecksum(dp.IP)
 	case dp.UDP != nil:
 		dp.UDP.SetNetworkLayerForChecksum(dp.IP)
+	case dp.ICMPv4 != nil:
+		// the ICMPv4 checksum does not depend on the network layer
+	case dp.ICMPv6 != nil:
+		dp.ICMPv6.SetNetworkLayerForChecksum(dp.IP)
 	default:
 		return nil, ErrDissectTransport
 	}
@@ -193,6 +240,42 @@ func (dp *DissectedPacket) Serialize() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// ForwardedCopy returns a copy of rawPacket, which MUST be the packet we dissected,
+// with the IPv4 TTL or the IPv6 hop limit decremented by one, as a router would do when
+// forwarding the packet. Unlike [DissectedPacket.Serialize], this method does not
+// re-encode the layers and only incrementally updates the IPv4 header checksum (see
+// RFC 1624), which is much cheaper because the transport checksum does not cover
+// the TTL. Like Serialize, this method fails with [ErrDissectTransport] when the
+// packet's transport protocol is not TCP, UDP, ICMPv4, or ICMPv6.
+func (dp *DissectedPacket) ForwardedCopy(rawPacket []byte) ([]byte, error) {
+	if dp.TCP == nil && dp.UDP == nil && dp.ICMPv4 == nil && dp.ICMPv6 == nil {
+		return nil, ErrDissectTransport
+	}
+	output := append([]byte{}, rawPacket...)
+	switch dp.IP.(type) {
+	case *layers.IPv4:
+		if len(output) < 20 || output[8] <= 0 {
+			return nil, ErrDissectShortPacket
+		}
+		oldWord := binary.BigEndian.Uint16(output[8:10])
+		output[8]--
+		newWord := binary.BigEndian.Uint16(output[8:10])
+		checksum := binary.BigEndian.Uint16(output[10:12])
+		sum := uint32(^checksum) + uint32(^oldWord) + uint32(newWord)
+		sum = (sum & 0xffff) + (sum >> 16)
+		sum = (sum & 0xffff) + (sum >> 16)
+		binary.BigEndian.PutUint16(output[10:12], ^uint16(sum))
+	case *layers.IPv6:
+		if len(output) < 40 || output[7] <= 0 {
+			return nil, ErrDissectShortPacket
+		}
+		output[7]--
+	default:
+		return nil, ErrDissectNetwork
+	}
+	return output, nil
+}
+
 // MatchesDestination returns true when the given IPv4 packet has the
 // expected protocol, destination address, and port.
 func (dp *DissectedPacket) MatchesDestination(proto layers.IPProtocol, address string, port uint16) bool {
@@ -226,29 +309,74 @@ func (dp *DissectedPacket) MatchesSource(proto layers.IPProtocol, address string
 }
 
 // FlowHash returns the hash uniquely identifying the transport flow. Both
-// directions of a flow will have the same hash.
+// directions of a flow will have the same hash. For ICMP packets, which
+// do not have ports, we hash the source and destination addresses.
 func (dp *DissectedPacket) FlowHash() uint64 {
 	switch {
 	case dp.TCP != nil:
 		return dp.TCP.TransportFlow().FastHash()
 	case dp.UDP != nil:
 		return dp.UDP.TransportFlow().FastHash()
+	case dp.ICMPv4 != nil, dp.ICMPv6 != nil:
+		return dp.IP.NetworkFlow().FastHash()
 	default:
 		panic(ErrDissectTransport)
 	}
 }
 
-// parseTLSServerName attempts to parse this packet as
-// a TLS client hello and to return the SNI.
-func (dp *DissectedPacket) parseTLSServerName() (string, error) {
+// Payload returns the TCP or UDP payload, or nil for other transports.
+func (dp *DissectedPacket) Payload() []byte {
 	switch {
 	case dp.TCP != nil:
-		return ExtractTLSServerName(dp.TCP.Payload)
+		return dp.TCP.Payload
 	case dp.UDP != nil:
-		return ExtractTLSServerName(dp.UDP.Payload)
+		return dp.UDP.Payload
 	default:
+		return nil
+	}
+}
+
+// TLSServerName attempts to parse the TCP or UDP payload as a TLS record
+// containing a ClientHello and to return the SNI.
+func (dp *DissectedPacket) TLSServerName() (string, error) {
+	if dp.TCP == nil && dp.UDP == nil {
 		return "", ErrDissectTransport
 	}
+	return ExtractTLSServerName(dp.Payload())
+}
+
+// QUICInitial attempts to parse and decrypt the UDP payload as a QUIC
+// Initial packet sent by a client (see [UnmarshalQUICInitialPacket]). Use
+// [QUICInitialPacket.ServerName] to obtain the SNI.
+func (dp *DissectedPacket) QUICInitial() (*QUICInitialPacket, error) {
+	if dp.UDP == nil {
+		return nil, ErrDissectTransport
+	}
+	return UnmarshalQUICInitialPacket(dp.UDP.Payload)
+}
+
+// DNSMessage attempts to parse the TCP or UDP payload as a DNS message. For
+// TCP, the payload MUST start with the two-byte length of the message, which
+// means this method only works for messages contained in a single segment.
+func (dp *DissectedPacket) DNSMessage() (*dns.Msg, error) {
+	var rawMsg []byte
+	switch {
+	case dp.TCP != nil:
+		payload := dp.TCP.Payload
+		if len(payload) < 2 || len(payload) < 2+int(binary.BigEndian.Uint16(payload)) {
+			return nil, ErrDissectShortPacket
+		}
+		rawMsg = payload[2 : 2+int(binary.BigEndian.Uint16(payload))]
+	case dp.UDP != nil:
+		rawMsg = dp.UDP.Payload
+	default:
+		return nil, ErrDissectTransport
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(rawMsg); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
 // reflectDissectedTCPSegmentWithRSTFlag assumes that packet is an IPv4 packet
@@ -0,0 +1,126 @@
+package netem
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// dissectCaptureRule is a [DPIRule] collecting the client packets.
+type dissectCaptureRule struct {
+	mu      sync.Mutex
+	packets []*DissectedPacket
+}
+
+// Filter implements DPIRule
+func (r *dissectCaptureRule) Filter(direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	if direction == DPIDirectionClientToServer {
+		r.mu.Lock()
+		r.packets = append(r.packets, packet)
+		r.mu.Unlock()
+	}
+	return nil, false
+}
+
+// find returns the first captured packet for which fx returns true.
+func (r *dissectCaptureRule) find(fx func(packet *DissectedPacket) bool) (*DissectedPacket, bool) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	for _, packet := range r.packets {
+		if fx(packet) {
+			return packet, true
+		}
+	}
+	return nil, false
+}
+
+func TestDissectPacket(t *testing.T) {
+	capture := &dissectCaptureRule{}
+	dpiEngine := NewDPIEngine(&NullLogger{})
+	dpiEngine.AddRule(capture)
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{DPIEngine: dpiEngine})
+	defer topology.Close()
+
+	t.Run("we can access the TLS SNI", func(t *testing.T) {
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}))
+		defer listener.Close()
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:443"))
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		_ = tls.Client(conn, &tls.Config{ServerName: "www.example.com"}).HandshakeContext(ctx)
+
+		packet, found := capture.find(func(packet *DissectedPacket) bool {
+			return packet.MatchesDestination(layers.IPProtocolTCP, "10.0.0.1", 443) && len(packet.Payload()) > 0
+		})
+		if !found {
+			t.Fatal("did not capture the ClientHello")
+		}
+		sni, err := packet.TLSServerName()
+		if err != nil || sni != "www.example.com" {
+			t.Fatal("unexpected SNI", sni, err)
+		}
+	})
+
+	t.Run("we can decrypt the QUIC Initial and access the SNI", func(t *testing.T) {
+		pconn := Must1(topology.Client.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)}))
+		defer pconn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		tlsConfig := &tls.Config{NextProtos: []string{"h3"}, ServerName: "www.example.org"}
+		raddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+		_, _ = quic.DialEarly(ctx, pconn, raddr, tlsConfig, &quic.Config{})
+
+		packet, found := capture.find(func(packet *DissectedPacket) bool {
+			return packet.MatchesDestination(layers.IPProtocolUDP, "10.0.0.1", 443)
+		})
+		if !found {
+			t.Fatal("did not capture the Initial packet")
+		}
+		initial, err := packet.QUICInitial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if initial.Version != 1 || len(initial.DestinationConnectionID) <= 0 {
+			t.Fatal("unexpected Initial packet", initial)
+		}
+		sni, err := initial.ServerName()
+		if err != nil || sni != "www.example.org" {
+			t.Fatal("unexpected SNI", sni, err)
+		}
+	})
+
+	t.Run("we can access the DNS message", func(t *testing.T) {
+		conn := Must1(topology.Client.DialContext(context.Background(), "udp", "10.0.0.1:53"))
+		defer conn.Close()
+		Must1(conn.Write(Must1(NewDNSRequestA("www.example.com").Pack())))
+
+		var msg *dns.Msg
+		for start := time.Now(); msg == nil && time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+			if packet, found := capture.find(func(packet *DissectedPacket) bool {
+				return packet.MatchesDestination(layers.IPProtocolUDP, "10.0.0.1", 53)
+			}); found {
+				msg = Must1(packet.DNSMessage())
+			}
+		}
+		if msg == nil || len(msg.Question) != 1 || msg.Question[0].Name != "www.example.com." {
+			t.Fatal("unexpected DNS message", msg)
+		}
+	})
+
+	t.Run("we reject payloads that are not QUIC Initial packets", func(t *testing.T) {
+		for _, input := range [][]byte{nil, {0x40, 0x00}, {0xc0, 0x00, 0x00, 0x00, 0x02}} {
+			if _, err := UnmarshalQUICInitialPacket(input); !errors.Is(err, ErrQUICParse) {
+				t.Fatal("not the error we expected", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package netem
+
+//
+// DNS cache
+//
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSCacheConfig contains the [DNSCache] configuration.
+type DNSCacheConfig struct {
+	// DefaultTTL is the OPTIONAL TTL to use when we do not know the TTL of
+	// an answer, which happens when [Net] uses the stack's getaddrinfo
+	// (default: 60 seconds).
+	DefaultTTL time.Duration
+
+	// MaxSize is the OPTIONAL maximum number of cached domains (default: 1024). When
+	// the cache is full, we evict expired entries first and then the oldest entries.
+	MaxSize int
+
+	// NegativeTTL OPTIONALLY enables negative caching: when this field is
+	// positive, we cache NXDOMAIN and no answer failures for this long.
+	NegativeTTL time.Duration
+}
+
+// DNSCache caches the results of the lookups performed by a [Net], which allows
+// reproducing cache-related behaviors (e.g., stale answers after a block, TTL
+// expiry races). The zero value is invalid; please, construct using [NewDNSCache].
+//
+// We honor the minimum TTL of the answers when we know it. A [DNSCache] is
+// safe for concurrent use and multiple [Net] instances may share it.
+type DNSCache struct {
+	// config is the cache config.
+	config DNSCacheConfig
+
+	// entries contains the cached entries indexed by canonical domain.
+	entries map[string]*dnsCacheEntry
+
+	// mu protects entries and seq.
+	mu sync.Mutex
+
+	// seq is the sequence number of the next entry.
+	seq uint64
+
+	// timeNow allows mocking time.Now in tests.
+	timeNow func() time.Time
+}
+
+// dnsCacheEntry is an entry in the [DNSCache].
+type dnsCacheEntry struct {
+	addrs   []string
+	cname   string
+	err     error
+	expires time.Time
+	seq     uint64
+}
+
+// dnsCacheUnknownTTL indicates that we do not know the TTL of an answer.
+const dnsCacheUnknownTTL = time.Duration(-1)
+
+// NewDNSCache creates a new [DNSCache] with the given config.
+func NewDNSCache(config *DNSCacheConfig) *DNSCache {
+	const (
+		defaultTTL     = 60 * time.Second
+		defaultMaxSize = 1024
+	)
+	c := &DNSCache{
+		config:  *config,
+		entries: map[string]*dnsCacheEntry{},
+		mu:      sync.Mutex{},
+		seq:     0,
+		timeNow: time.Now,
+	}
+	if c.config.DefaultTTL <= 0 {
+		c.config.DefaultTTL = defaultTTL
+	}
+	if c.config.MaxSize <= 0 {
+		c.config.MaxSize = defaultMaxSize
+	}
+	return c
+}
+
+// Flush removes all the entries from the cache.
+func (c *DNSCache) Flush() {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	c.entries = map[string]*dnsCacheEntry{}
+}
+
+// Len returns the number of entries in the cache, including expired entries
+// we have not evicted yet.
+func (c *DNSCache) Len() int {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	return len(c.entries)
+}
+
+// lookup returns the cached result for the given domain, if any, and otherwise calls
+// the given function to perform the lookup and caches its result. The function returns
+// the addresses, the CNAME, the TTL (possibly [dnsCacheUnknownTTL]), and the error.
+func (c *DNSCache) lookup(
+	domain string,
+	fx func() ([]string, string, time.Duration, error),
+) ([]string, string, error) {
+	key := dns.CanonicalName(domain)
+
+	// check whether we have a fresh entry
+	c.mu.Lock()
+	if entry := c.entries[key]; entry != nil && c.timeNow().Before(entry.expires) {
+		c.mu.Unlock()
+		if entry.err != nil {
+			return nil, "", entry.err
+		}
+		return append([]string{}, entry.addrs...), entry.cname, nil
+	}
+	c.mu.Unlock()
+
+	// perform the lookup and determine for how long to cache the result
+	addrs, cname, ttl, err := fx()
+	switch {
+	case err != nil && c.config.NegativeTTL > 0 && dnsCacheIsNegativeAnswer(err):
+		ttl = c.config.NegativeTTL
+	case err != nil:
+		return nil, "", err
+	case ttl == dnsCacheUnknownTTL:
+		ttl = c.config.DefaultTTL
+	}
+	if ttl > 0 {
+		c.insert(key, &dnsCacheEntry{
+			addrs:   append([]string{}, addrs...),
+			cname:   cname,
+			err:     err,
+			expires: c.timeNow().Add(ttl),
+		})
+	}
+	return addrs, cname, err
+}
+
+// dnsCacheIsNegativeAnswer returns whether the error is a negative answer.
+func dnsCacheIsNegativeAnswer(err error) bool {
+	return errors.Is(err, ErrDNSNoSuchHost) || errors.Is(err, ErrDNSNoAnswer)
+}
+
+// insert inserts an entry into the cache evicting entries if needed.
+func (c *DNSCache) insert(key string, entry *dnsCacheEntry) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	delete(c.entries, key)
+
+	// evict the expired entries and then the oldest entries
+	if len(c.entries) >= c.config.MaxSize {
+		now := c.timeNow()
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	for len(c.entries) >= c.config.MaxSize {
+		var oldest string
+		for key, entry := range c.entries {
+			if oldest == "" || entry.seq < c.entries[oldest].seq {
+				oldest = key
+			}
+		}
+		delete(c.entries, oldest)
+	}
+
+	entry.seq = c.seq
+	c.seq++
+	c.entries[key] = entry
+}
+
+// dnsMinimumTTL returns the minimum TTL of the answers inside the given
+// response or [dnsCacheUnknownTTL] if the response does not contain answers.
+func dnsMinimumTTL(resp *dns.Msg) time.Duration {
+	ttl := dnsCacheUnknownTTL
+	for _, answer := range resp.Answer {
+		if value := time.Duration(answer.Header().Ttl) * time.Second; ttl < 0 || value < ttl {
+			ttl = value
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,113 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDNSCache(t *testing.T) {
+	// newNet creates a [Net] using the given cache and a resolver whose
+	// configuration contains www.example.com pointing to 10.0.0.3.
+	newNet := func(t *testing.T, cache *DNSCache) (*Net, *DNSConfig) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.3")
+		topology, _ := newDNSServerTestTopology(t, config, &DNSServerOptions{})
+		ns := &Net{
+			Cache:           cache,
+			ResolverAddress: "10.0.0.1",
+			Stack:           topology.Client,
+		}
+		return ns, config
+	}
+
+	// fakeNow is a fake clock we can move forward.
+	fakeNow := time.Now()
+
+	t.Run("we return cached answers until the TTL expires", func(t *testing.T) {
+		cache := NewDNSCache(&DNSCacheConfig{})
+		cache.timeNow = func() time.Time { return fakeNow }
+		ns, config := newNet(t, cache)
+
+		addrs := Must1(ns.LookupHost(context.Background(), "www.example.com"))
+		if diff := cmp.Diff([]string{"10.0.0.3"}, addrs); diff != "" {
+			t.Fatal(diff)
+		}
+
+		// emulate a DNS-based block
+		config.RemoveRecord("www.example.com")
+		addrs = Must1(ns.LookupHost(context.Background(), "www.example.com"))
+		if diff := cmp.Diff([]string{"10.0.0.3"}, addrs); diff != "" {
+			t.Fatal(diff)
+		}
+
+		// once the TTL has expired, we see the block
+		fakeNow = fakeNow.Add(3601 * time.Second)
+		if _, err := ns.LookupHost(context.Background(), "www.example.com"); !errors.Is(err, ErrDNSNoSuchHost) {
+			t.Fatal("not the error we expected", err)
+		}
+	})
+
+	t.Run("we use the default TTL with the stack's getaddrinfo", func(t *testing.T) {
+		cache := NewDNSCache(&DNSCacheConfig{DefaultTTL: time.Minute})
+		cache.timeNow = func() time.Time { return fakeNow }
+		ns, config := newNet(t, cache)
+		ns.ResolverAddress = "" // use the stack's getaddrinfo
+
+		Must1(ns.LookupHost(context.Background(), "www.example.com"))
+		config.RemoveRecord("www.example.com")
+		Must1(ns.LookupHost(context.Background(), "www.example.com"))
+		fakeNow = fakeNow.Add(61 * time.Second)
+		if _, err := ns.LookupHost(context.Background(), "www.example.com"); !errors.Is(err, ErrDNSNoSuchHost) {
+			t.Fatal("not the error we expected", err)
+		}
+	})
+
+	t.Run("we cache negative answers only if configured", func(t *testing.T) {
+		for _, negativeTTL := range []time.Duration{0, time.Minute} {
+			cache := NewDNSCache(&DNSCacheConfig{NegativeTTL: negativeTTL})
+			ns, config := newNet(t, cache)
+			if _, err := ns.LookupHost(context.Background(), "www.example.org"); !errors.Is(err, ErrDNSNoSuchHost) {
+				t.Fatal("not the error we expected", err)
+			}
+			config.AddRecord("www.example.org", "", "10.0.0.4")
+			_, err := ns.LookupHost(context.Background(), "www.example.org")
+			if negativeTTL > 0 && !errors.Is(err, ErrDNSNoSuchHost) {
+				t.Fatal("expected a cached negative answer, got", err)
+			}
+			if negativeTTL <= 0 && err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("we evict the oldest entries when the cache is full", func(t *testing.T) {
+		cache := NewDNSCache(&DNSCacheConfig{MaxSize: 2})
+		var lookups int
+		lookup := func(domain string) {
+			cache.lookup(domain, func() ([]string, string, time.Duration, error) {
+				lookups++
+				return []string{"10.0.0.3"}, "", time.Hour, nil
+			})
+		}
+		for idx := 0; idx < 3; idx++ {
+			lookup(fmt.Sprintf("www%d.example.com", idx))
+		}
+		if cache.Len() != 2 {
+			t.Fatal("expected two entries, got", cache.Len())
+		}
+		lookup("www2.example.com") // cached
+		lookup("www0.example.com") // evicted
+		if lookups != 4 {
+			t.Fatal("expected four lookups, got", lookups)
+		}
+		cache.Flush()
+		if cache.Len() != 0 {
+			t.Fatal("expected no entries")
+		}
+	})
+}
@@ -5,23 +5,95 @@ package netem
 //
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 // DNSRoundTrip performs a DNS round trip using a given [UnderlyingNetwork].
+//
+// This function uses UDP and retries using TCP when the response is truncated.
 func DNSRoundTrip(
 	ctx context.Context,
 	stack UnderlyingNetwork,
 	ipAddress string,
 	query *dns.Msg,
 ) (*dns.Msg, error) {
+	resp, err := dnsRoundTripWithContext(ctx, func() (*dns.Msg, error) {
+		return dnsRoundTripUDP(ctx, stack, ipAddress, query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		return DNSRoundTripTCP(ctx, stack, ipAddress, query)
+	}
+	return resp, nil
+}
+
+// DNSRoundTripTCP is like [DNSRoundTrip] but uses TCP.
+func DNSRoundTripTCP(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	query *dns.Msg,
+) (*dns.Msg, error) {
+	return dnsRoundTripWithContext(ctx, func() (*dns.Msg, error) {
+		conn, err := stack.DialContext(ctx, "tcp", net.JoinHostPort(ipAddress, "53"))
+		if err != nil {
+			return nil, err
+		}
+		return dnsRoundTripStream(ctx, conn, query)
+	})
+}
+
+// DNSRoundTripTLS is like [DNSRoundTrip] but uses DNS-over-TLS. We use the
+// stack's default cert pool to verify the server's certificate, which should
+// be valid for the server's ipAddress (see [NewDoTServer]).
+func DNSRoundTripTLS(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	query *dns.Msg,
+) (*dns.Msg, error) {
+	return dnsRoundTripWithContext(ctx, func() (*dns.Msg, error) {
+		conn, err := stack.DialContext(ctx, "tcp", net.JoinHostPort(ipAddress, "853"))
+		if err != nil {
+			return nil, err
+		}
+		config := &tls.Config{
+			KeyLogWriter: tlsKeyLogWriterFor(stack),
+			RootCAs:      stack.DefaultCertPool(),
+			NextProtos:   []string{"dot"},
+			ServerName:   ipAddress,
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return dnsRoundTripStream(ctx, tc, query)
+	})
+}
+
+// dnsRoundTripWithContext runs the given round trip function in a background
+// goroutine and returns early if the context is done.
+func dnsRoundTripWithContext(ctx context.Context, fx func() (*dns.Msg, error)) (*dns.Msg, error) {
 	responsech := make(chan *dns.Msg, 1)
 	errch := make(chan error, 1)
-	go dnsRoundTripAsync(ctx, stack, ipAddress, query, responsech, errch)
+	go dnsRoundTripAsync(fx, responsech, errch)
 	select {
 	case resp := <-responsech:
 		return resp, nil
@@ -34,14 +106,11 @@ func DNSRoundTrip(
 
 // dnsRoundTripAsync is an async DNS round trip.
 func dnsRoundTripAsync(
-	ctx context.Context,
-	stack UnderlyingNetwork,
-	ipAddress string,
-	query *dns.Msg,
+	fx func() (*dns.Msg, error),
 	responsech chan<- *dns.Msg,
 	errch chan<- error,
 ) {
-	response, err := dnsRoundTrip(ctx, stack, ipAddress, query)
+	response, err := fx()
 	if err != nil {
 		errch <- err
 		return
@@ -49,8 +118,8 @@ func dnsRoundTripAsync(
 	responsech <- response
 }
 
-// dnsRoundTrip performs a DNS round trip using a given [UnderlyingNetwork].
-func dnsRoundTrip(
+// dnsRoundTripUDP performs a DNS round trip over UDP using a given [UnderlyingNetwork].
+func dnsRoundTripUDP(
 	ctx context.Context,
 	stack UnderlyingNetwork,
 	ipAddress string,
@@ -94,6 +163,64 @@ func dnsRoundTrip(
 	return response, nil
 }
 
+// dnsRoundTripStream performs a DNS round trip using the given stream
+// connection (e.g., TCP or TLS), which this function TAKES OWNERSHIP of.
+func dnsRoundTripStream(ctx context.Context, conn net.Conn, query *dns.Msg) (*dns.Msg, error) {
+	if deadline, good := ctx.Deadline(); good {
+		_ = conn.SetDeadline(deadline)
+	}
+	defer conn.Close()
+
+	// serialize the DNS query
+	rawQuery, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	// send the query
+	if err := dnsWriteStreamMsg(conn, rawQuery); err != nil {
+		return nil, err
+	}
+
+	// receive the response from the DNS server
+	rawResponse, err := dnsReadStreamMsg(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// unmarshal the response
+	response := &dns.Msg{}
+	if err := response.Unpack(rawResponse); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// dnsWriteStreamMsg writes a length-prefixed DNS message on a stream connection.
+func dnsWriteStreamMsg(conn net.Conn, rawMsg []byte) error {
+	if len(rawMsg) > math.MaxUint16 {
+		return dns.ErrBuf
+	}
+	buffer := make([]byte, 2+len(rawMsg))
+	binary.BigEndian.PutUint16(buffer, uint16(len(rawMsg)))
+	copy(buffer[2:], rawMsg)
+	_, err := conn.Write(buffer)
+	return err
+}
+
+// dnsReadStreamMsg reads a length-prefixed DNS message from a stream connection.
+func dnsReadStreamMsg(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	rawMsg := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(conn, rawMsg); err != nil {
+		return nil, err
+	}
+	return rawMsg, nil
+}
+
 // ErrDNSNoAnswer is returned when the server response does not contain any
 // answer for the original query (i.e., no IPv4 addresses).
 var ErrDNSNoAnswer = errors.New("netem: dns: no answer from DNS server")
@@ -124,18 +251,46 @@ func DNSParseResponse(query, resp *dns.Msg) ([]string, string, error) {
 		return nil, "", ErrDNSServerMisbehaving
 	}
 
-	// search for A answers and CNAME
-	var (
-		A     []string
-		CNAME string
-	)
+	// collect the CNAMEs, which may form a chain
+	cnames := map[string]string{}
 	for _, answer := range resp.Answer {
+		if v, ok := answer.(*dns.CNAME); ok {
+			cnames[dns.CanonicalName(v.Hdr.Name)] = v.Target
+		}
+	}
+
+	// follow the CNAME chain starting from the query name
+	var CNAME string
+	names := map[string]bool{}
+	if len(query.Question) > 0 {
+		name := dns.CanonicalName(query.Question[0].Name)
+		names[name] = true
+		for {
+			target, found := cnames[name]
+			if !found || names[dns.CanonicalName(target)] {
+				break
+			}
+			CNAME, name = target, dns.CanonicalName(target)
+			names[name] = true
+		}
+	}
+
+	// search for A and AAAA answers belonging to the chain
+	var A []string
+	for _, answer := range resp.Answer {
+		var addr net.IP
 		switch v := answer.(type) {
 		case *dns.A:
-			A = append(A, v.A.String())
-		case *dns.CNAME:
-			CNAME = v.Target
+			addr = v.A
+		case *dns.AAAA:
+			addr = v.AAAA
+		default:
+			continue
 		}
+		if len(names) > 0 && !names[dns.CanonicalName(answer.Header().Name)] {
+			continue
+		}
+		A = append(A, addr.String())
 	}
 
 	// make sure we emit the same error the Go stdlib emits
@@ -146,14 +301,229 @@ func DNSParseResponse(query, resp *dns.Msg) ([]string, string, error) {
 	return A, CNAME, nil
 }
 
+// DNSRoundTripHTTPS performs a DNS-over-HTTPS round trip using the given
+// [UnderlyingNetwork] and the given URL (e.g., https://10.0.0.1/dns-query).
+//
+// We use the stack's default cert pool to verify the server certificate.
+func DNSRoundTripHTTPS(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	URL string,
+	query *dns.Msg,
+) (*dns.Msg, error) {
+	rawQuery, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", URL, bytes.NewReader(rawQuery))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	ns := &Net{Stack: stack}
+	txp := &http.Transport{
+		DialContext:       ns.DialContext,
+		DialTLSContext:    ns.DialTLSContext,
+		ForceAttemptHTTP2: true,
+	}
+	defer txp.CloseIdleConnections()
+	resp, err := txp.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%w: http status %d", ErrDNSServerMisbehaving, resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "application/dns-message" {
+		return nil, fmt.Errorf("%w: unexpected content type", ErrDNSServerMisbehaving)
+	}
+	rawResponse, err := io.ReadAll(io.LimitReader(resp.Body, math.MaxUint16))
+	if err != nil {
+		return nil, err
+	}
+	response := &dns.Msg{}
+	if err := response.Unpack(rawResponse); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// DNSTransport is the transport used by a [DNSClient].
+type DNSTransport string
+
+const (
+	// DNSTransportUDP is DNS over UDP with fallback to TCP for truncated responses.
+	DNSTransportUDP = DNSTransport("udp")
+
+	// DNSTransportTCP is DNS over TCP.
+	DNSTransportTCP = DNSTransport("tcp")
+
+	// DNSTransportDoT is DNS over TLS.
+	DNSTransportDoT = DNSTransport("dot")
+
+	// DNSTransportDoH is DNS over HTTPS.
+	DNSTransportDoH = DNSTransport("doh")
+)
+
+// ErrDNSUnknownTransport indicates that a [DNSClient] uses an unknown transport.
+var ErrDNSUnknownTransport = errors.New("netem: dns: unknown transport")
+
+// ErrDNSQuestionMismatch indicates that the question inside the response
+// does not match the question inside the query (e.g., because the server
+// did not preserve the case of the name when using 0x20 randomization).
+var ErrDNSQuestionMismatch = errors.New("netem: dns: response question does not match query")
+
+// DNSClient is a stub resolver using an [UnderlyingNetwork]. The zero
+// value is invalid; please, init all the fields marked as MANDATORY.
+type DNSClient struct {
+	// Randomize0x20 OPTIONALLY enables randomizing the case of the
+	// letters of the queried name (aka 0x20 randomization) and checking
+	// whether the response preserves the case of the question.
+	Randomize0x20 bool
+
+	// Retries is the OPTIONAL number of times we retry after the
+	// first attempt fails. By default, we do not retry.
+	Retries int
+
+	// ServerAddress is the MANDATORY server address. This field
+	// contains an IP address for the udp, tcp, and dot transports and an
+	// URL (e.g., https://10.0.0.1/dns-query) for the doh transport.
+	ServerAddress string
+
+	// Stack is the MANDATORY [UnderlyingNetwork] to use.
+	Stack UnderlyingNetwork
+
+	// Timeout is the OPTIONAL timeout for each attempt. When this
+	// field is zero or negative, we use a five seconds timeout.
+	Timeout time.Duration
+
+	// Transport is the OPTIONAL transport to use. By default,
+	// we use [DNSTransportUDP].
+	Transport DNSTransport
+}
+
+// dnsClientDefaultTimeout is the default [DNSClient] timeout.
+const dnsClientDefaultTimeout = 5 * time.Second
+
+// dnsClientRNG is the random number generator used by the [DNSClient].
+var dnsClientRNG = &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// RoundTrip sends the query and receives the response, retrying on failure
+// according to the [DNSClient] configuration. When using 0x20 randomization,
+// RoundTrip sends a copy of the query with a randomized name.
+func (c *DNSClient) RoundTrip(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	if c.Randomize0x20 {
+		query = query.Copy()
+		for idx := range query.Question {
+			query.Question[idx].Name = dnsRandomizeCase(query.Question[idx].Name)
+		}
+	}
+	var err error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		var resp *dns.Msg
+		resp, err = c.roundTripOnce(ctx, query)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// roundTripOnce performs a single round trip attempt.
+func (c *DNSClient) roundTripOnce(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = dnsClientDefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var (
+		resp *dns.Msg
+		err  error
+	)
+	switch transport := c.Transport; transport {
+	case DNSTransportUDP, "":
+		resp, err = DNSRoundTrip(ctx, c.Stack, c.ServerAddress, query)
+	case DNSTransportTCP:
+		resp, err = DNSRoundTripTCP(ctx, c.Stack, c.ServerAddress, query)
+	case DNSTransportDoT:
+		resp, err = DNSRoundTripTLS(ctx, c.Stack, c.ServerAddress, query)
+	case DNSTransportDoH:
+		resp, err = DNSRoundTripHTTPS(ctx, c.Stack, c.ServerAddress, query)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrDNSUnknownTransport, transport)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure the response question matches the query question
+	if c.Randomize0x20 && len(resp.Question) > 0 {
+		if len(resp.Question) != len(query.Question) || resp.Question[0].Name != query.Question[0].Name {
+			return nil, ErrDNSQuestionMismatch
+		}
+	}
+	return resp, nil
+}
+
+// LookupHost resolves the A records of the given domain and returns
+// the addresses and the CNAME, like [DNSParseResponse] does.
+func (c *DNSClient) LookupHost(ctx context.Context, domain string) ([]string, string, error) {
+	query := NewDNSRequestA(domain)
+	resp, err := c.RoundTrip(ctx, query)
+	if err != nil {
+		return nil, "", err
+	}
+	return DNSParseResponse(query, resp)
+}
+
+// dnsRandomizeCase randomizes the case of the letters inside name.
+func dnsRandomizeCase(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if dnsClientRNG.Float64() < 0.5 {
+			b.WriteString(strings.ToUpper(string(r)))
+		} else {
+			b.WriteString(strings.ToLower(string(r)))
+		}
+	}
+	return b.String()
+}
+
 // NewDNSRequestA creates a new A request.
 func NewDNSRequestA(domain string) *dns.Msg {
+	return newDNSRequest(domain, dns.TypeA)
+}
+
+// NewDNSRequestAAAA creates a new AAAA request.
+func NewDNSRequestAAAA(domain string) *dns.Msg {
+	return newDNSRequest(domain, dns.TypeAAAA)
+}
+
+// NewDNSRequestHTTPS creates a new HTTPS request.
+func NewDNSRequestHTTPS(domain string) *dns.Msg {
+	return newDNSRequest(domain, dns.TypeHTTPS)
+}
+
+// NewDNSRequestSVCB creates a new SVCB request.
+func NewDNSRequestSVCB(domain string) *dns.Msg {
+	return newDNSRequest(domain, dns.TypeSVCB)
+}
+
+// newDNSRequest creates a new request for the given domain and qtype.
+func newDNSRequest(domain string, qtype uint16) *dns.Msg {
 	query := &dns.Msg{}
 	query.RecursionDesired = true
 	query.Id = dns.Id()
 	query.Question = []dns.Question{{
 		Name:   dns.CanonicalName(domain),
-		Qtype:  dns.TypeA,
+		Qtype:  qtype,
 		Qclass: dns.ClassINET,
 	}}
 	return query
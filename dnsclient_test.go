@@ -0,0 +1,393 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+func TestDNSParseResponse(t *testing.T) {
+	// newA constructs a new A resource record.
+	newA := func(name, addr string) *dns.A {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.ParseIP(addr),
+		}
+	}
+
+	t.Run("we follow the CNAME chain regardless of the order of answers", func(t *testing.T) {
+		query := NewDNSRequestA("a.example.com")
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		resp.Answer = []dns.RR{
+			newA("c.example.com.", "10.0.0.1"),
+			dnsServerNewCNAME("b.example.com.", "c.example.com."),
+			dnsServerNewCNAME("A.example.com.", "b.example.com."),
+		}
+		addrs, cname, err := DNSParseResponse(query, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cname != "c.example.com." {
+			t.Fatal("unexpected CNAME", cname)
+		}
+		if diff := cmp.Diff([]string{"10.0.0.1"}, addrs); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("we ignore addresses not belonging to the chain", func(t *testing.T) {
+		query := NewDNSRequestA("a.example.com")
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		resp.Answer = []dns.RR{
+			newA("a.example.com.", "10.0.0.1"),
+			newA("x.example.com.", "10.0.0.2"),
+		}
+		addrs, cname, err := DNSParseResponse(query, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cname != "" {
+			t.Fatal("unexpected CNAME", cname)
+		}
+		if diff := cmp.Diff([]string{"10.0.0.1"}, addrs); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+}
+
+func TestDNSRoundTripTCP(t *testing.T) {
+	config := NewDNSConfig()
+	config.AddRecord("www.example.com", "", "10.0.0.3")
+	topology, _ := newDNSServerTestTopology(t, config, &DNSServerOptions{})
+
+	// perform more than a single round trip to make sure
+	// we correctly handle multiple TCP connections
+	for idx := 0; idx < 3; idx++ {
+		query := NewDNSRequestA("www.example.com")
+		resp, err := DNSRoundTripTCP(context.Background(), topology.Client, "10.0.0.1", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs, _, err := DNSParseResponse(query, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{"10.0.0.3"}, addrs); diff != "" {
+			t.Fatal(diff)
+		}
+	}
+}
+
+func TestDNSRoundTripTLS(t *testing.T) {
+	config := NewDNSConfig()
+	config.AddRecord("www.example.com", "", "10.0.0.3")
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+	server, err := NewDoTServer(&NullLogger{}, topology.Server, "10.0.0.1", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	query := NewDNSRequestA("www.example.com")
+	resp, err := DNSRoundTripTLS(context.Background(), topology.Client, "10.0.0.1", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, _, err := DNSParseResponse(query, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"10.0.0.3"}, addrs); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestDNSRoundTripTruncation(t *testing.T) {
+	// newConfig creates a config containing a large response.
+	newConfig := func() *DNSConfig {
+		config := NewDNSConfig()
+		config.AddRecord("small.example.com", "", "10.0.0.3")
+		config.AddRecord(
+			"large.example.com", "",
+			"10.0.1.1", "10.0.1.2", "10.0.1.3", "10.0.1.4",
+			"10.0.1.5", "10.0.1.6", "10.0.1.7", "10.0.1.8",
+		)
+		return config
+	}
+
+	type testcase struct {
+		name          string
+		options       *DNSServerOptions
+		domain        string
+		expectTrunc   bool
+		expectNumAddr int
+	}
+
+	testcases := []testcase{{
+		name:          "without truncation",
+		options:       &DNSServerOptions{},
+		domain:        "large.example.com",
+		expectTrunc:   false,
+		expectNumAddr: 8,
+	}, {
+		name:          "with forced truncation",
+		options:       &DNSServerOptions{TruncateUDP: true},
+		domain:        "small.example.com",
+		expectTrunc:   true,
+		expectNumAddr: 1,
+	}, {
+		name:          "with truncation above size for a small response",
+		options:       &DNSServerOptions{TruncateUDPAboveSize: 100},
+		domain:        "small.example.com",
+		expectTrunc:   false,
+		expectNumAddr: 1,
+	}, {
+		name:          "with truncation above size for a large response",
+		options:       &DNSServerOptions{TruncateUDPAboveSize: 100},
+		domain:        "large.example.com",
+		expectTrunc:   true,
+		expectNumAddr: 8,
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			topology, _ := newDNSServerTestTopology(t, newConfig(), tc.options)
+			ctx := context.Background()
+
+			// check whether the UDP response is truncated
+			query := NewDNSRequestA(tc.domain)
+			resp, err := dnsRoundTripUDP(ctx, topology.Client, "10.0.0.1", query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Truncated != tc.expectTrunc {
+				t.Fatal("expected truncated", tc.expectTrunc, "got", resp.Truncated)
+			}
+
+			// make sure DNSRoundTrip falls back to TCP when needed
+			resp, err = DNSRoundTrip(ctx, topology.Client, "10.0.0.1", query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs, _, err := DNSParseResponse(query, resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != tc.expectNumAddr {
+				t.Fatal("expected", tc.expectNumAddr, "addrs, got", addrs)
+			}
+		})
+	}
+}
+
+func TestDNSRoundTripEDNS0(t *testing.T) {
+	// newConfig creates a config containing a response larger than 512 bytes.
+	newConfig := func() *DNSConfig {
+		config := NewDNSConfig()
+		var addrs []string
+		for idx := 1; idx <= 60; idx++ {
+			addrs = append(addrs, fmt.Sprintf("10.0.1.%d", idx))
+		}
+		config.AddRecord("large.example.com", "", addrs...)
+		return config
+	}
+
+	type testcase struct {
+		name            string
+		options         *DNSServerOptions
+		clientUDPSize   uint16
+		expectTrunc     bool
+		expectOPTUDPLen uint16
+	}
+
+	testcases := []testcase{{
+		name:            "when the client does not use EDNS0",
+		options:         &DNSServerOptions{},
+		clientUDPSize:   0,
+		expectTrunc:     true,
+		expectOPTUDPLen: 0,
+	}, {
+		name:            "when the client uses EDNS0 and the server uses its defaults",
+		options:         &DNSServerOptions{},
+		clientUDPSize:   4096,
+		expectTrunc:     false,
+		expectOPTUDPLen: 1232,
+	}, {
+		name:            "when the client uses EDNS0 with a small buffer",
+		options:         &DNSServerOptions{},
+		clientUDPSize:   600,
+		expectTrunc:     true,
+		expectOPTUDPLen: 1232,
+	}, {
+		name:            "when the client uses EDNS0 and the server has a small buffer",
+		options:         &DNSServerOptions{MaxUDPPayload: 600},
+		clientUDPSize:   4096,
+		expectTrunc:     true,
+		expectOPTUDPLen: 600,
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			topology, _ := newDNSServerTestTopology(t, newConfig(), tc.options)
+
+			query := NewDNSRequestA("large.example.com")
+			if tc.clientUDPSize > 0 {
+				query.SetEdns0(tc.clientUDPSize, false)
+			}
+			resp, err := dnsRoundTripUDP(context.Background(), topology.Client, "10.0.0.1", query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Truncated != tc.expectTrunc {
+				t.Fatal("expected truncated", tc.expectTrunc, "got", resp.Truncated)
+			}
+			var optUDPLen uint16
+			if opt := resp.IsEdns0(); opt != nil {
+				optUDPLen = opt.UDPSize()
+			}
+			if optUDPLen != tc.expectOPTUDPLen {
+				t.Fatal("expected OPT UDP size", tc.expectOPTUDPLen, "got", optUDPLen)
+			}
+		})
+	}
+}
+
+// newDNSClientTestServers creates a topology where 10.0.0.1 runs DNS
+// servers for all the transports supported by the [DNSClient].
+func newDNSClientTestServers(t *testing.T, config *DNSConfig, options *DNSServerOptions) *PPPTopology {
+	topology, _ := newDNSServerTestTopology(t, config, options)
+
+	dot, err := NewDoTServerWithOptions(&NullLogger{}, topology.Server, "10.0.0.1", config, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dot.Close() })
+
+	ns := &Net{Stack: topology.Server}
+	listener, err := ns.ListenTLS("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443},
+		topology.Server.MustNewServerTLSConfig("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doh := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rawQuery, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			rawResponse, err := DNSServerRoundTrip(config, rawQuery)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(rawResponse)
+		}),
+	}
+	go doh.Serve(listener)
+	t.Cleanup(func() { doh.Close() })
+
+	return topology
+}
+
+func TestDNSClient(t *testing.T) {
+	t.Run("we can use all the transports", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.3")
+		topology := newDNSClientTestServers(t, config, &DNSServerOptions{})
+
+		for _, transport := range []DNSTransport{"", DNSTransportUDP, DNSTransportTCP, DNSTransportDoT, DNSTransportDoH} {
+			t.Run(string(transport), func(t *testing.T) {
+				client := &DNSClient{
+					ServerAddress: "10.0.0.1",
+					Stack:         topology.Client,
+					Transport:     transport,
+				}
+				if transport == DNSTransportDoH {
+					client.ServerAddress = "https://10.0.0.1/dns-query"
+				}
+				addrs, _, err := client.LookupHost(context.Background(), "www.example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff([]string{"10.0.0.3"}, addrs); diff != "" {
+					t.Fatal(diff)
+				}
+			})
+		}
+	})
+
+	t.Run("we reject unknown transports", func(t *testing.T) {
+		client := &DNSClient{ServerAddress: "10.0.0.1", Transport: "antani"}
+		_, _, err := client.LookupHost(context.Background(), "www.example.com")
+		if !errors.Is(err, ErrDNSUnknownTransport) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we retry after a timeout", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.3")
+		qlog := &DNSQueryLog{}
+		topology, _ := newDNSServerTestTopology(t, config, &DNSServerOptions{
+			DropRate: 1,
+			QueryLog: qlog.Add,
+		})
+		client := &DNSClient{
+			Retries:       2,
+			ServerAddress: "10.0.0.1",
+			Stack:         topology.Client,
+			Timeout:       100 * time.Millisecond,
+		}
+		_, _, err := client.LookupHost(context.Background(), "www.example.com")
+		var nerr net.Error
+		if !errors.As(err, &nerr) || !nerr.Timeout() {
+			t.Fatal("expected a timeout error, got", err)
+		}
+		if count := len(qlog.Entries()); count != 3 {
+			t.Fatal("expected three queries, got", count)
+		}
+	})
+
+	t.Run("we can use 0x20 randomization", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.3")
+		qlog := &DNSQueryLog{}
+		topology, _ := newDNSServerTestTopology(t, config, &DNSServerOptions{QueryLog: qlog.Add})
+		client := &DNSClient{
+			Randomize0x20: true,
+			ServerAddress: "10.0.0.1",
+			Stack:         topology.Client,
+		}
+
+		for idx := 0; idx < 4; idx++ {
+			addrs, _, err := client.LookupHost(context.Background(), "www.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]string{"10.0.0.3"}, addrs); diff != "" {
+				t.Fatal(diff)
+			}
+		}
+		// with 13 letters, all the queries having the same case is unlikely
+		names := map[string]bool{}
+		for _, entry := range qlog.Entries() {
+			names[entry.Name] = true
+		}
+		if len(names) < 2 {
+			t.Fatal("expected randomized names, got", names)
+		}
+	})
+}
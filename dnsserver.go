@@ -5,30 +5,398 @@ package netem
 //
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
+	"math"
+	"math/rand"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/google/gopacket/layers"
 	"github.com/miekg/dns"
 )
 
 // DNSServer is a DNS server. The zero value is invalid,
 // please construct using [NewDNSServer].
 type DNSServer struct {
-	once  sync.Once
-	pconn UDPLikeConn
-	wg    *sync.WaitGroup
+	address   string
+	closed    chan any
+	listener  net.Listener
+	once      sync.Once
+	pconn     UDPLikeConn
+	rng       dnsServerRandom
+	stack     UnderlyingNetwork
+	stats     DNSServerStats
+	statsMu   sync.Mutex
+	tlsConfig *tls.Config
+	wg        *sync.WaitGroup
+}
+
+// DNSServerStats contains [DNSServer] statistics.
+type DNSServerStats struct {
+	// Address is the server IP address.
+	Address string `json:"address"`
+
+	// Dropped counts the queries the server dropped.
+	Dropped int64 `json:"dropped"`
+
+	// Queries counts the queries the server received.
+	Queries int64 `json:"queries"`
+
+	// Rcodes counts the responses by response code (e.g., "NOERROR").
+	Rcodes map[string]int64 `json:"rcodes"`
+
+	// Truncated counts the responses with the TC bit set.
+	Truncated int64 `json:"truncated"`
+}
+
+// Stats returns a snapshot of the [DNSServer] statistics.
+func (ds *DNSServer) Stats() DNSServerStats {
+	defer ds.statsMu.Unlock()
+	ds.statsMu.Lock()
+	stats := ds.stats
+	stats.Address = ds.address
+	stats.Rcodes = map[string]int64{}
+	for key, value := range ds.stats.Rcodes {
+		stats.Rcodes[key] = value
+	}
+	return stats
+}
+
+// logQuery updates the statistics and calls [DNSServerOptions.logQuery].
+func (ds *DNSServer) logQuery(options *DNSServerOptions, network string, addr net.Addr, rawQuery, rawResponse []byte) {
+	ds.statsMu.Lock()
+	ds.stats.Queries++
+	switch {
+	case rawResponse == nil:
+		ds.stats.Dropped++
+	case len(rawResponse) >= 4:
+		// the flags are in the third and fourth bytes of the header
+		if ds.stats.Rcodes == nil {
+			ds.stats.Rcodes = map[string]int64{}
+		}
+		ds.stats.Rcodes[dns.RcodeToString[int(rawResponse[3]&0x0f)]]++
+		if rawResponse[2]&0x02 != 0 {
+			ds.stats.Truncated++
+		}
+	}
+	ds.statsMu.Unlock()
+	options.logQuery(network, addr, rawQuery, rawResponse)
+}
+
+// DNSServerOptions contains OPTIONAL settings for a [DNSServer]. The
+// zero value is valid and causes the [DNSServer] to respond immediately
+// to all the queries it receives.
+type DNSServerOptions struct {
+	// DecisionLog is the OPTIONAL [DecisionLog] recording or replaying
+	// the decisions taken according to DropRate and to the probability
+	// of the configured [DNSRcodeRule]s.
+	DecisionLog *DecisionLog
+
+	// Delay is the OPTIONAL delay to add before sending each response.
+	Delay time.Duration
+
+	// DelayPerName OPTIONALLY maps a domain name to the delay to add
+	// before sending a response for such a name, thus overriding Delay.
+	DelayPerName map[string]time.Duration
+
+	// DropRate is the OPTIONAL fraction of queries that the server
+	// should drop without sending any response.
+	DropRate float64
+
+	// TruncateUDP OPTIONALLY causes the server to set the TC bit and remove
+	// all the resource records from each UDP response, to force clients to
+	// retry using TCP. See also TruncateUDPAboveSize.
+	TruncateUDP bool
+
+	// TruncateUDPAboveSize is like TruncateUDP but only applies to UDP
+	// responses whose size is larger than the given number of bytes.
+	TruncateUDPAboveSize int
+
+	// MaxUDPPayload is the OPTIONAL maximum UDP payload size supported by
+	// the server, which we advertise using EDNS0. When the client advertises
+	// a smaller size, we use the client's size. When the response does not
+	// fit the size, we truncate it and set the TC bit. Clients not using EDNS0
+	// get responses of at most 512 bytes. When this field is zero or negative,
+	// we use the 1232 bytes value recommended by the DNS flag day 2020.
+	MaxUDPPayload int
+
+	// TLSServerNames contains OPTIONAL extra names to include into the
+	// certificate used by DNS-over-TLS servers. By default, the certificate
+	// only includes the server's IP address.
+	TLSServerNames []string
+
+	// Tracer is the OPTIONAL [Tracer] receiving a [TraceEventDNSQueryServed]
+	// event for each query the server responds to or drops.
+	Tracer Tracer
+
+	// Upstream is the OPTIONAL IPv4 address of an upstream DNS server inside
+	// the topology. When set, the server forwards the queries for the names
+	// that are not inside its [DNSConfig] to the upstream server using the
+	// server's stack, thus behaving like a forwarding resolver. This allows
+	// modeling multi-tier resolver setups (e.g., stub -> ISP resolver ->
+	// authoritative). When the upstream fails, the server returns SERVFAIL.
+	Upstream string
+
+	// DefaultRecord is the OPTIONAL record to use when responding to queries
+	// for names that are not inside the [DNSConfig]. When Upstream is also
+	// set, Upstream takes precedence. By default, we return NXDOMAIN.
+	DefaultRecord *DNSRecord
+
+	// GhostRecordsPerName OPTIONALLY maps a domain name to records the server
+	// uses to send extra (aka ghost) UDP responses for such a name before the
+	// genuine response. Each record produces a distinct response, which is
+	// NXDOMAIN when the record has neither addresses nor CNAME. Because the
+	// server sends the ghost responses immediately and the genuine response
+	// after the configured delay, if any, you can use DelayPerName to control
+	// the race between the injected and the genuine responses.
+	GhostRecordsPerName map[string][]*DNSRecord
+
+	// MalformedPerName OPTIONALLY maps a domain name to the way in which
+	// the server should corrupt the responses for such a name, which allows
+	// testing how clients deal with malformed responses.
+	MalformedPerName map[string]DNSMalformation
+
+	// QueryLog is the OPTIONAL function called for each query received
+	// by the server, including dropped queries. You can use this function
+	// to know which lookups happened without parsing PCAP files. Note that
+	// the server calls this function from several goroutines. See also the
+	// [DNSQueryLog] type, which collects [DNSQueryLogEntry] values.
+	QueryLog func(entry *DNSQueryLogEntry)
+}
+
+// DNSQueryLogEntry describes a query received by a [DNSServer].
+type DNSQueryLogEntry struct {
+	// Time is the time when the server created the response or dropped the query.
+	Time time.Time
+
+	// Network is the network used by the client: "udp", "tcp", or "dot".
+	Network string
+
+	// ClientAddress is the client's endpoint (i.e., address and port).
+	ClientAddress string
+
+	// Name is the queried name.
+	Name string
+
+	// Qtype is the query type (e.g., [dns.TypeA]).
+	Qtype uint16
+
+	// Dropped indicates that the server dropped the query.
+	Dropped bool
+
+	// Rcode is the response code.
+	Rcode int
+
+	// Truncated indicates whether the server set the TC bit.
+	Truncated bool
+
+	// CNAMEs contains the CNAMEs included in the answer.
+	CNAMEs []string
+
+	// Addresses contains the addresses included in the answer.
+	Addresses []string
+}
+
+// DNSQueryLog collects [DNSQueryLogEntry] values. The zero value is
+// ready to use. Use [DNSQueryLog.Add] as the [DNSServerOptions] QueryLog.
+type DNSQueryLog struct {
+	entries []*DNSQueryLogEntry
+	mu      sync.Mutex
+}
+
+// Add adds an entry to the [DNSQueryLog].
+func (ql *DNSQueryLog) Add(entry *DNSQueryLogEntry) {
+	ql.mu.Lock()
+	ql.entries = append(ql.entries, entry)
+	ql.mu.Unlock()
+}
+
+// Entries returns a copy of the entries inside the [DNSQueryLog].
+func (ql *DNSQueryLog) Entries() []*DNSQueryLogEntry {
+	defer ql.mu.Unlock()
+	ql.mu.Lock()
+	return append([]*DNSQueryLogEntry{}, ql.entries...)
+}
+
+// logQuery calls the QueryLog function, if any. A nil rawResponse
+// indicates that the server has dropped the query.
+func (opts *DNSServerOptions) logQuery(network string, addr net.Addr, rawQuery, rawResponse []byte) {
+	if opts.QueryLog == nil && opts.Tracer == nil {
+		return
+	}
+	entry := &DNSQueryLogEntry{
+		Time:          time.Now(),
+		Network:       network,
+		ClientAddress: addr.String(),
+		Dropped:       rawResponse == nil,
+	}
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err == nil && len(query.Question) == 1 {
+		entry.Name = query.Question[0].Name
+		entry.Qtype = query.Question[0].Qtype
+	}
+	resp := &dns.Msg{}
+	if rawResponse != nil && resp.Unpack(rawResponse) == nil {
+		entry.Rcode = resp.Rcode
+		entry.Truncated = resp.Truncated
+		for _, rr := range resp.Answer {
+			switch v := rr.(type) {
+			case *dns.CNAME:
+				entry.CNAMEs = append(entry.CNAMEs, v.Target)
+			case *dns.A:
+				entry.Addresses = append(entry.Addresses, v.A.String())
+			case *dns.AAAA:
+				entry.Addresses = append(entry.Addresses, v.AAAA.String())
+			}
+		}
+	}
+	if opts.QueryLog != nil {
+		opts.QueryLog(entry)
+	}
+	if opts.Tracer != nil {
+		opts.Tracer.OnTraceEvent(newTraceEventForDNSQuery(entry, len(rawQuery)))
+	}
+}
+
+// newTraceEventForDNSQuery creates a [TraceEvent] for the given [DNSQueryLogEntry].
+func newTraceEventForDNSQuery(entry *DNSQueryLogEntry, size int) *TraceEvent {
+	ev := &TraceEvent{
+		Domain:   entry.Name,
+		Location: "dns/" + entry.Network,
+		Reason:   dns.RcodeToString[entry.Rcode],
+		Size:     size,
+		Time:     entry.Time,
+		Type:     TraceEventDNSQueryServed,
+	}
+	if entry.Dropped {
+		ev.Reason = "dropped"
+	}
+	if host, port, err := net.SplitHostPort(entry.ClientAddress); err == nil {
+		ev.FiveTuple.SourceIP = host
+		if value, err := strconv.ParseUint(port, 10, 16); err == nil {
+			ev.FiveTuple.SourcePort = uint16(value)
+		}
+	}
+	ev.FiveTuple.Protocol = layers.IPProtocolUDP
+	if entry.Network != "udp" {
+		ev.FiveTuple.Protocol = layers.IPProtocolTCP
+	}
+	return ev
+}
+
+// dnsServerUpstreamTimeout is the maximum time to wait for the upstream server.
+const dnsServerUpstreamTimeout = 4 * time.Second
+
+// delayForName returns the delay to apply when responding to the given name.
+func (opts *DNSServerOptions) delayForName(name string) time.Duration {
+	name = dns.CanonicalName(name)
+	for key, value := range opts.DelayPerName {
+		if dns.CanonicalName(key) == name {
+			return value
+		}
+	}
+	return opts.Delay
+}
+
+// DNSMalformation is a way in which a [DNSServer] corrupts a response.
+type DNSMalformation int
+
+const (
+	// DNSMalformationNone indicates that we should not corrupt the response.
+	DNSMalformationNone = DNSMalformation(iota)
+
+	// DNSMalformationBadCompressionPointer replaces the name inside the
+	// question section with a compression pointer pointing outside the message.
+	DNSMalformationBadCompressionPointer
+
+	// DNSMalformationTruncatedRR removes the last bytes of the response, so
+	// that its last resource record (or the question) is incomplete.
+	DNSMalformationTruncatedRR
+
+	// DNSMalformationMismatchedID changes the ID of the response, so that it
+	// does not match the ID of the query anymore.
+	DNSMalformationMismatchedID
+)
+
+// malformationForName returns the malformation to use for the given name.
+func (opts *DNSServerOptions) malformationForName(name string) DNSMalformation {
+	name = dns.CanonicalName(name)
+	for key, value := range opts.MalformedPerName {
+		if dns.CanonicalName(key) == name {
+			return value
+		}
+	}
+	return DNSMalformationNone
+}
+
+// ghostRecordsForName returns the ghost records to use for the given name.
+func (opts *DNSServerOptions) ghostRecordsForName(name string) []*DNSRecord {
+	name = dns.CanonicalName(name)
+	for key, value := range opts.GhostRecordsPerName {
+		if dns.CanonicalName(key) == name {
+			return value
+		}
+	}
+	return nil
+}
+
+// maxUDPPayload returns the maximum UDP payload size to use.
+func (opts *DNSServerOptions) maxUDPPayload() uint16 {
+	switch {
+	case opts.MaxUDPPayload <= 0:
+		return dnsServerDefaultUDPPayload
+	case opts.MaxUDPPayload > math.MaxUint16:
+		return math.MaxUint16
+	default:
+		return uint16(opts.MaxUDPPayload)
+	}
+}
+
+// shouldTruncateUDP returns whether we should truncate the given UDP response.
+func (opts *DNSServerOptions) shouldTruncateUDP(rawResponse []byte) bool {
+	return opts.TruncateUDP || (opts.TruncateUDPAboveSize > 0 && len(rawResponse) > opts.TruncateUDPAboveSize)
+}
+
+// shouldDrop returns whether we should drop the current query.
+func (opts *DNSServerOptions) shouldDrop(rng dnsServerRandom) bool {
+	return opts.DropRate > 0 && rng.Float64() < opts.DropRate
+}
+
+// newRNG returns the random number generator to use for a server.
+func (opts *DNSServerOptions) newRNG(ipAddress string) dnsServerRandom {
+	if opts.DecisionLog != nil {
+		return opts.DecisionLog.newStream("dns/" + ipAddress)
+	}
+	return dnsServerRNG
 }
 
 // NewDNSServer creates a new [DNSServer] instance. Remember to
 // call [DNSServer.Close] when you are done using this server.
 //
-// The ipAddress argument is the IPv4 DNS server address.
+// The ipAddress argument is the IPv4 DNS server address. The server
+// listens on port 53 using both UDP and TCP.
 func NewDNSServer(
 	logger Logger,
 	stack UnderlyingNetwork,
 	ipAddress string,
 	config *DNSConfig,
+) (*DNSServer, error) {
+	return NewDNSServerWithOptions(logger, stack, ipAddress, config, &DNSServerOptions{})
+}
+
+// NewDNSServerWithOptions is like [NewDNSServer] but additionally
+// allows you to customize the server behavior using [DNSServerOptions].
+func NewDNSServerWithOptions(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *DNSConfig,
+	options *DNSServerOptions,
 ) (*DNSServer, error) {
 	parsedIP := net.ParseIP(ipAddress)
 	if parsedIP == nil {
@@ -46,69 +414,273 @@ func NewDNSServer(
 		return nil, err
 	}
 
-	// spawn a single worker
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go dnsServerWorker(logger, ipAddress, config, pconn, wg)
+	// create listening TCP server
+	tcpAddr := &net.TCPAddr{
+		IP:   parsedIP,
+		Port: 53,
+		Zone: "",
+	}
+	listener, err := stack.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
 
 	ds := &DNSServer{
-		once:  sync.Once{},
-		pconn: pconn,
-		wg:    wg,
+		address:  ipAddress,
+		closed:   make(chan any),
+		listener: listener,
+		once:     sync.Once{},
+		pconn:    pconn,
+		rng:      options.newRNG(ipAddress),
+		stack:    stack,
+		wg:       &sync.WaitGroup{},
 	}
+
+	// spawn a single UDP worker
+	ds.wg.Add(1)
+	go ds.worker(logger, ipAddress, config, options)
+
+	// spawn the TCP acceptor
+	ds.wg.Add(1)
+	go ds.streamAcceptor(logger, ipAddress, config, options)
+
+	return ds, nil
+}
+
+// NewDoTServer creates a new DNS-over-TLS [DNSServer] instance listening
+// on port 853. Remember to call [DNSServer.Close] when you are done.
+//
+// The server uses a certificate for its ipAddress created using the
+// stack's TLS MITM capabilities, so clients using the stack's default
+// cert pool (e.g., [DNSRoundTripTLS]) are able to verify it.
+func NewDoTServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *DNSConfig,
+) (*DNSServer, error) {
+	return NewDoTServerWithOptions(logger, stack, ipAddress, config, &DNSServerOptions{})
+}
+
+// NewDoTServerWithOptions is like [NewDoTServer] but additionally
+// allows you to customize the server behavior using [DNSServerOptions].
+func NewDoTServerWithOptions(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *DNSConfig,
+	options *DNSServerOptions,
+) (*DNSServer, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+
+	// create listening TCP server
+	tcpAddr := &net.TCPAddr{
+		IP:   parsedIP,
+		Port: 853,
+		Zone: "",
+	}
+	listener, err := stack.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// generate the server TLS config
+	tlsConfig := stack.MustNewServerTLSConfig(ipAddress, options.TLSServerNames...)
+	tlsConfig.NextProtos = []string{"dot"}
+
+	ds := &DNSServer{
+		address:   ipAddress,
+		closed:    make(chan any),
+		listener:  listener,
+		once:      sync.Once{},
+		pconn:     nil,
+		rng:       options.newRNG(ipAddress),
+		stack:     stack,
+		tlsConfig: tlsConfig,
+		wg:        &sync.WaitGroup{},
+	}
+
+	// spawn the TLS acceptor
+	ds.wg.Add(1)
+	go ds.streamAcceptor(logger, ipAddress, config, options)
+
 	return ds, nil
 }
 
 // Close shuts down the DNS server
 func (ds *DNSServer) Close() error {
 	ds.once.Do(func() {
-		ds.pconn.Close()
+		close(ds.closed)
+		if ds.pconn != nil {
+			ds.pconn.Close()
+		}
+		ds.listener.Close()
 	})
 	return nil
 }
 
 // DNSRecord is a DNS record in the [DNSConfig].
 type DNSRecord struct {
-	// A is the A resource record.
+	// A contains the addresses. The server uses IPv4 addresses to respond
+	// to A queries and IPv6 addresses to respond to AAAA queries.
 	A []net.IP
 
 	// CNAME is the CNAME.
 	CNAME string
+
+	// ECHConfigList is the OPTIONAL ECH config list, which the server returns
+	// inside an HTTPS record (see [DNSConfig.SetECHConfigList]).
+	ECHConfigList []byte
+
+	// HTTPS contains the OPTIONAL HTTPS records (see [DNSConfig.AddHTTPSRecord]).
+	HTTPS []*DNSServiceBinding
+
+	// SVCB contains the OPTIONAL SVCB records (see [DNSConfig.AddSVCBRecord]).
+	SVCB []*DNSServiceBinding
+}
+
+// DNSRcodeRule tells the [DNSServer] to respond to queries for
+// a given name using a specific DNS response code.
+type DNSRcodeRule struct {
+	// Rcode is the response code to return (e.g., [dns.RcodeServerFailure]).
+	Rcode int
+
+	// Probability is the probability of returning Rcode, which
+	// we interpret as 1 (i.e., always) when it's zero or negative. When we
+	// do not return Rcode, we respond using the name's records.
+	Probability float64
 }
 
 // DNSConfig is the DNS configuration to use. The zero
 // value is invalid; please use [NewDNSConfig].
+//
+// You can modify a [DNSConfig] while a [DNSServer] is using it: the
+// server takes a snapshot of the configuration for each query, so each
+// response reflects either the old or the new configuration. Use
+// [DNSConfig.Update] or [DNSConfig.Replace] to apply several changes
+// atomically and [DNSConfig.Generation] to know whether (and how many
+// times) the configuration changed.
+//
+// Use [DNSConfig.AddView] to serve different answers depending on the
+// address of the client (aka split-horizon DNS).
 type DNSConfig struct {
-	mu sync.Mutex
-	r  map[string]*DNSRecord
+	generation uint64
+	mu         sync.Mutex
+	r          map[string]*DNSRecord
+	rcodes     map[string]*DNSRcodeRule
+	views      []*dnsView
+}
+
+// dnsView is a view of the DNS configuration for clients in a given prefix.
+type dnsView struct {
+	prefix *net.IPNet
+	config *DNSConfig
 }
 
 // NewDNSConfig constructs a [DNSConfig] instance.
 func NewDNSConfig() *DNSConfig {
 	return &DNSConfig{
-		mu: sync.Mutex{},
-		r:  map[string]*DNSRecord{},
+		generation: 0,
+		mu:         sync.Mutex{},
+		r:          map[string]*DNSRecord{},
+		rcodes:     map[string]*DNSRcodeRule{},
+		views:      []*dnsView{},
 	}
 }
 
-// Clone clones a [DNSConfig].
+// Clone clones a [DNSConfig]. The clone has the same generation
+// of the original [DNSConfig] and shares its views with it.
 func (dc *DNSConfig) Clone() *DNSConfig {
 	defer dc.mu.Unlock()
 	dc.mu.Lock()
 	out := NewDNSConfig()
+	out.generation = dc.generation
 	for key, value := range dc.r {
-		out.r[key] = &DNSRecord{
-			A:     append([]net.IP{}, value.A...),
-			CNAME: value.CNAME,
+		out.r[key] = value.clone()
+	}
+	for key, value := range dc.rcodes {
+		out.rcodes[key] = &DNSRcodeRule{
+			Rcode:       value.Rcode,
+			Probability: value.Probability,
 		}
 	}
+	out.views = append(out.views, dc.views...)
 	return out
 }
 
+// Generation returns the generation of the [DNSConfig], which starts
+// from zero and increments by one every time the configuration changes.
+func (dc *DNSConfig) Generation() uint64 {
+	defer dc.mu.Unlock()
+	dc.mu.Lock()
+	return dc.generation
+}
+
+// Replace atomically replaces the content of the [DNSConfig] with
+// a copy of the content of other and increments the generation.
+func (dc *DNSConfig) Replace(other *DNSConfig) {
+	snapshot := other.Clone()
+	dc.mu.Lock()
+	dc.r = snapshot.r
+	dc.rcodes = snapshot.rcodes
+	dc.views = snapshot.views
+	dc.generation++
+	dc.mu.Unlock()
+}
+
+// Update atomically applies the changes made by fx to the [DNSConfig]. The
+// fx function receives a copy of the [DNSConfig] to modify. If fx returns an
+// error, Update discards the changes and returns such an error. Otherwise,
+// Update replaces the content of the [DNSConfig] with the modified copy and
+// increments the generation. If another goroutine modifies the [DNSConfig]
+// while fx is running, Update calls fx again using a fresh copy.
+//
+// For example, the following code moves a domain to another IP address:
+//
+//	err := config.Update(func(tx *DNSConfig) error {
+//		tx.RemoveRecord("www.example.com")
+//		return tx.AddRecord("www.example.com", "", "10.0.0.2")
+//	})
+func (dc *DNSConfig) Update(fx func(tx *DNSConfig) error) error {
+	for {
+		tx := dc.Clone()
+		generation := tx.generation
+		if err := fx(tx); err != nil {
+			return err
+		}
+		dc.mu.Lock()
+		if dc.generation == generation {
+			dc.r = tx.r
+			dc.rcodes = tx.rcodes
+			dc.views = tx.views
+			dc.generation++
+			dc.mu.Unlock()
+			return nil
+		}
+		dc.mu.Unlock()
+	}
+}
+
 // ErrNotIPAddress indicates that a string is not a serialized IP address.
 var ErrNotIPAddress = errors.New("netem: not a valid IP address")
 
 // AddRecord adds a record to the DNS server's database or returns an error.
+//
+// To create a CNAME chain, add a record containing just the CNAME for each
+// alias and a record containing the addresses for the last name in the
+// chain. For example, the following code creates the a -> b -> c chain:
+//
+//	config.AddRecord("a.example.com", "b.example.com")
+//	config.AddRecord("b.example.com", "c.example.com")
+//	config.AddRecord("c.example.com", "", "10.0.0.1")
+//
+// The DNS server follows the chain as long as the aliases have no addresses
+// and their CNAME is inside the [DNSConfig], and includes in the response all
+// the CNAMEs it followed along with the addresses of the last name.
 func (dc *DNSConfig) AddRecord(domain string, cname string, addrs ...string) error {
 	var a []net.IP
 	for _, addr := range addrs {
@@ -126,15 +698,29 @@ func (dc *DNSConfig) AddRecord(domain string, cname string, addrs ...string) err
 		A:     a,
 		CNAME: cname,
 	}
+	dc.generation++
 	dc.mu.Unlock()
 	return nil
 }
 
+// SetECHConfigList sets the ECH config list of the given domain, creating a record without
+// addresses if needed, such that the DNS server responds to HTTPS queries for the domain with
+// a record containing such a list (see [NewECHKey] and [ECHConfigList]). When the domain has
+// HTTPS records (see [DNSConfig.AddHTTPSRecord]), the server includes the list in the records
+// in service mode that do not specify their own list. Note that calling [DNSConfig.AddRecord]
+// for the domain replaces the record and clears the list.
+func (dc *DNSConfig) SetECHConfigList(domain string, echConfigList []byte) {
+	dc.updateRecord(domain, func(record *DNSRecord) {
+		record.ECHConfigList = echConfigList
+	})
+}
+
 // RemoveRecord removes a record from the DNS server's database. If the record
 // does not exist, this method does nothing.
 func (dc *DNSConfig) RemoveRecord(domain string) {
 	dc.mu.Lock()
 	delete(dc.r, dns.CanonicalName(domain))
+	dc.generation++
 	dc.mu.Unlock()
 }
 
@@ -146,68 +732,582 @@ func (dc *DNSConfig) Lookup(name string) (*DNSRecord, bool) {
 	return record, found
 }
 
-func dnsConfigWithWhoami(config *DNSConfig, endpoint net.Addr) *DNSConfig {
-	// make sure we operate on a copy
-	config = config.Clone()
+// ErrDNSInvalidRcode indicates that we cannot configure the given rcode.
+var ErrDNSInvalidRcode = errors.New("netem: dns: invalid rcode")
+
+// AddRcode tells the DNS server to respond to queries for the given
+// domain using the given rcode with the given probability. Use a zero
+// probability to always return the given rcode. The rcode MUST be one
+// of [dns.RcodeNameError], [dns.RcodeServerFailure], and [dns.RcodeRefused].
+//
+// The rcode takes precedence over the domain's records, if any. When the
+// probability is lower than one, the DNS server returns the domain's records
+// (or NXDOMAIN, if there are no records) for the remaining queries.
+func (dc *DNSConfig) AddRcode(domain string, rcode int, probability float64) error {
+	switch rcode {
+	case dns.RcodeNameError, dns.RcodeServerFailure, dns.RcodeRefused:
+		// all good
+	default:
+		return ErrDNSInvalidRcode
+	}
+	dc.mu.Lock()
+	dc.rcodes[dns.CanonicalName(domain)] = &DNSRcodeRule{
+		Rcode:       rcode,
+		Probability: probability,
+	}
+	dc.generation++
+	dc.mu.Unlock()
+	return nil
+}
+
+// RemoveRcode removes the rcode configured for the given domain. If there is
+// no such rcode, this method does nothing.
+func (dc *DNSConfig) RemoveRcode(domain string) {
+	dc.mu.Lock()
+	delete(dc.rcodes, dns.CanonicalName(domain))
+	dc.generation++
+	dc.mu.Unlock()
+}
+
+// LookupRcode searches the rcode rule for a given name inside the [DNSConfig].
+func (dc *DNSConfig) LookupRcode(name string) (*DNSRcodeRule, bool) {
+	defer dc.mu.Unlock()
+	dc.mu.Lock()
+	rule, found := dc.rcodes[dns.CanonicalName(name)]
+	return rule, found
+}
+
+// ErrNotIPPrefix indicates that a string is not a serialized IP prefix.
+var ErrNotIPPrefix = errors.New("netem: not a valid IP prefix")
+
+// AddView tells the DNS server to use the view configuration, rather than
+// this configuration, when responding to clients whose address belongs to the
+// given prefix (e.g., "10.0.0.0/24"). When several prefixes match, we use the
+// most specific one. Adding a view for an existing prefix replaces it.
+//
+// This functionality allows emulating geo-DNS, ISP-specific resolutions, and
+// resolvers that lie only to specific subnets. Because the server uses the
+// view instead of this configuration, the view MUST contain all the records
+// you want to serve to the clients in the prefix. Subsequent changes to the
+// view are visible to the DNS server, like for this configuration.
+func (dc *DNSConfig) AddView(prefix string, view *DNSConfig) error {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return ErrNotIPPrefix
+	}
+	dc.mu.Lock()
+	views := []*dnsView{}
+	for _, entry := range dc.views {
+		if entry.prefix.String() != ipNet.String() {
+			views = append(views, entry)
+		}
+	}
+	dc.views = append(views, &dnsView{prefix: ipNet, config: view})
+	dc.generation++
+	dc.mu.Unlock()
+	return nil
+}
 
+// RemoveView removes the view for the given prefix. If there is no
+// such view, this method does nothing.
+func (dc *DNSConfig) RemoveView(prefix string) {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return
+	}
+	dc.mu.Lock()
+	views := []*dnsView{}
+	for _, entry := range dc.views {
+		if entry.prefix.String() != ipNet.String() {
+			views = append(views, entry)
+		}
+	}
+	dc.views = views
+	dc.generation++
+	dc.mu.Unlock()
+}
+
+// LookupView returns the view to use for the client with the given IP address
+// along with true, or the [DNSConfig] itself and false when no view matches.
+func (dc *DNSConfig) LookupView(ipAddress string) (*DNSConfig, bool) {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return dc, false
+	}
+	defer dc.mu.Unlock()
+	dc.mu.Lock()
+	var (
+		bestConfig *DNSConfig
+		bestOnes   = -1
+	)
+	for _, entry := range dc.views {
+		if ones, _ := entry.prefix.Mask.Size(); entry.prefix.Contains(ip) && ones > bestOnes {
+			bestConfig, bestOnes = entry.config, ones
+		}
+	}
+	if bestConfig == nil {
+		return dc, false
+	}
+	return bestConfig, true
+}
+
+// dnsServerRandom is the random number generator used by the DNS server.
+type dnsServerRandom interface {
+	Float64() float64
+}
+
+// dnsServerRNG is the default random number generator used by the DNS server.
+var dnsServerRNG = &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// shouldApply returns whether we should apply the rule to the current query.
+func (rule *DNSRcodeRule) shouldApply(rng dnsServerRandom) bool {
+	return rule.Probability <= 0 || rng.Float64() < rule.Probability
+}
+
+// lockedRand is a [rand.Rand] that is safe to use from multiple goroutines.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// Float64 is like [rand.Rand.Float64].
+func (lr *lockedRand) Float64() float64 {
+	defer lr.mu.Unlock()
+	lr.mu.Lock()
+	return lr.r.Float64()
+}
+
+// dnsConfigWithWhoami returns a copy of the configuration to use for the
+// given client that also includes the whoami.v4.powerdns.org record.
+func dnsConfigWithWhoami(config *DNSConfig, endpoint net.Addr) *DNSConfig {
 	// extract the endpoint address
 	ipAddr, _, err := net.SplitHostPort(endpoint.String())
 	if err != nil {
-		return config
+		return config.Clone() // make sure we operate on a copy
 	}
 
+	// select the view for the client and make sure we operate on a copy
+	view, _ := config.LookupView(ipAddr)
+	config = view.Clone()
+
 	// add whoami.v4.powerdns.org record
 	_ = config.AddRecord("whoami.v4.powerdns.org", "", ipAddr)
 	return config
 }
 
-// dnsServerWorker is the [DNSServer] worker.
-func dnsServerWorker(
+// worker is the [DNSServer] worker.
+func (ds *DNSServer) worker(
 	logger Logger,
 	ipAddress string,
 	config *DNSConfig,
-	pconn UDPLikeConn,
-	wg *sync.WaitGroup,
+	options *DNSServerOptions,
 ) {
 	logger.Debugf("netem: dns server %s up", ipAddress)
 	defer func() {
 		logger.Debugf("netem: dns server %s down", ipAddress)
-		wg.Done()
+		ds.wg.Done()
 	}()
 
 	for {
 		// read incoming raw query
 		buffer := make([]byte, 8000)
-		count, addr, err := pconn.ReadFrom(buffer)
+		count, addr, err := ds.pconn.ReadFrom(buffer)
 		if err != nil {
 			logger.Warnf("netem: dns: pconn.ReadFrom: %s", err.Error())
 			return
 		}
 		rawQuery := buffer[:count]
 
-		rawResponse, err := DNSServerRoundTrip(dnsConfigWithWhoami(config, addr), rawQuery)
+		// emulate a lossy resolver
+		if options.shouldDrop(ds.rng) {
+			logger.Debugf("netem: dns: dropping query from %s", addr.String())
+			ds.logQuery(options, "udp", addr, rawQuery, nil)
+			continue
+		}
+
+		// forward to the upstream without blocking other queries
+		queryConfig := dnsConfigWithWhoami(config, addr)
+		if options.Upstream != "" && dnsServerIsUnknownName(queryConfig, rawQuery) {
+			ds.wg.Add(1)
+			go func() {
+				defer ds.wg.Done()
+				ds.respondUDP(logger, queryConfig, options, rawQuery, addr)
+			}()
+			continue
+		}
+
+		ds.respondUDP(logger, queryConfig, options, rawQuery, addr)
+	}
+}
+
+// respondUDP sends the response to a raw query received over UDP.
+func (ds *DNSServer) respondUDP(
+	logger Logger,
+	config *DNSConfig,
+	options *DNSServerOptions,
+	rawQuery []byte,
+	addr net.Addr,
+) {
+	rawResponse, err := ds.roundTrip(logger, config, options, rawQuery)
+	if err != nil {
+		logger.Warnf("netem: dnsServerRoundTrip: %s", err.Error())
+		return
+	}
+
+	// make sure the response fits the UDP payload size
+	rawResponse, err = dnsServerAdjustUDPResponse(rawQuery, rawResponse, options)
+	if err != nil {
+		logger.Warnf("netem: dnsServerAdjustUDPResponse: %s", err.Error())
+		return
+	}
+	rawResponse = dnsServerMalformResponse(rawResponse, options.malformationForName(dnsQueryName(rawQuery)))
+	ds.logQuery(options, "udp", addr, rawQuery, rawResponse)
+
+	// emulate DNS injection by sending ghost responses first
+	for _, rawGhost := range dnsServerNewGhostResponses(rawQuery, options) {
+		_, _ = ds.pconn.WriteTo(rawGhost, addr)
+	}
+
+	// emulate a slow resolver without blocking other queries
+	if delay := options.delayForName(dnsQueryName(rawQuery)); delay > 0 {
+		ds.wg.Add(1)
+		go ds.writeDelayed(rawResponse, addr, delay)
+		return
+	}
+
+	_, _ = ds.pconn.WriteTo(rawResponse, addr)
+}
+
+// roundTrip is like [DNSServerRoundTrip] but additionally forwards the queries
+// for unknown names to the upstream or uses the default record, if configured.
+// This function assumes that config is a private copy it can modify.
+func (ds *DNSServer) roundTrip(
+	logger Logger,
+	config *DNSConfig,
+	options *DNSServerOptions,
+	rawQuery []byte,
+) ([]byte, error) {
+	if dnsServerIsUnknownName(config, rawQuery) {
+		switch {
+		case options.Upstream != "":
+			return ds.forward(logger, options.Upstream, rawQuery)
+
+		case options.DefaultRecord != nil:
+			config.mu.Lock()
+			config.r[dns.CanonicalName(dnsQueryName(rawQuery))] = options.DefaultRecord
+			config.mu.Unlock()
+		}
+	}
+	return dnsServerRoundTrip(config, ds.rng, rawQuery)
+}
+
+// forward forwards the raw query to the upstream DNS server and returns
+// the upstream's response or a SERVFAIL response on failure.
+func (ds *DNSServer) forward(logger Logger, upstream string, rawQuery []byte) ([]byte, error) {
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil {
+		return nil, err
+	}
+
+	// make sure we stop waiting when the server is closed
+	ctx, cancel := context.WithTimeout(context.Background(), dnsServerUpstreamTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-ds.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := DNSRoundTrip(ctx, ds.stack, upstream, query)
+	if err != nil {
+		logger.Warnf("netem: dns: forwarding to %s: %s", upstream, err.Error())
+		resp = &dns.Msg{}
+		resp.SetRcode(query, dns.RcodeServerFailure)
+	}
+	return resp.Pack()
+}
+
+// dnsServerIsUnknownName returns whether the raw query is a well-formed query
+// for a name for which the [DNSConfig] contains neither records nor rcodes.
+func dnsServerIsUnknownName(config *DNSConfig, rawQuery []byte) bool {
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil {
+		return false
+	}
+	if query.Response || len(query.Question) != 1 || query.Question[0].Qclass != dns.ClassINET {
+		return false
+	}
+	name := query.Question[0].Name
+	if _, found := config.Lookup(name); found {
+		return false
+	}
+	_, found := config.LookupRcode(name)
+	return !found
+}
+
+// writeDelayed sends the response to the given address after the given delay.
+func (ds *DNSServer) writeDelayed(rawResponse []byte, addr net.Addr, delay time.Duration) {
+	defer ds.wg.Done()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		_, _ = ds.pconn.WriteTo(rawResponse, addr)
+	case <-ds.closed:
+	}
+}
+
+// streamAcceptor accepts stream connections (e.g., TCP) for the [DNSServer].
+func (ds *DNSServer) streamAcceptor(
+	logger Logger,
+	ipAddress string,
+	config *DNSConfig,
+	options *DNSServerOptions,
+) {
+	logger.Debugf("netem: dns stream server %s up", ipAddress)
+	defer func() {
+		logger.Debugf("netem: dns stream server %s down", ipAddress)
+		ds.wg.Done()
+	}()
+
+	for {
+		conn, err := ds.listener.Accept()
+		if err != nil {
+			logger.Warnf("netem: dns: listener.Accept: %s", err.Error())
+			return
+		}
+		ds.wg.Add(1)
+		go ds.serveStream(logger, conn, config, options)
+	}
+}
+
+// serveStream serves DNS queries received over a stream connection.
+func (ds *DNSServer) serveStream(
+	logger Logger,
+	conn net.Conn,
+	config *DNSConfig,
+	options *DNSServerOptions,
+) {
+	defer ds.wg.Done()
+
+	// possibly wrap the conn to use TLS
+	if ds.tlsConfig != nil {
+		conn = tls.Server(conn, ds.tlsConfig)
+	}
+
+	// make sure we close the conn when the server is closed
+	done := make(chan any)
+	defer close(done)
+	go func() {
+		select {
+		case <-ds.closed:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	network := "tcp"
+	if ds.tlsConfig != nil {
+		network = "dot"
+	}
+
+	addr := conn.RemoteAddr()
+	for {
+		// read incoming raw query
+		rawQuery, err := dnsReadStreamMsg(conn)
+		if err != nil {
+			return
+		}
+
+		// emulate a lossy resolver
+		if options.shouldDrop(ds.rng) {
+			logger.Debugf("netem: dns: dropping query from %s", addr.String())
+			ds.logQuery(options, network, addr, rawQuery, nil)
+			continue
+		}
+
+		rawResponse, err := ds.roundTrip(logger, dnsConfigWithWhoami(config, addr), options, rawQuery)
 		if err != nil {
 			logger.Warnf("netem: dnsServerRoundTrip: %s", err.Error())
+			return
+		}
+		rawResponse = dnsServerMalformResponse(rawResponse, options.malformationForName(dnsQueryName(rawQuery)))
+		ds.logQuery(options, network, addr, rawQuery, rawResponse)
+
+		// emulate a slow resolver
+		if delay := options.delayForName(dnsQueryName(rawQuery)); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ds.closed:
+				timer.Stop()
+				return
+			}
+		}
+
+		if err := dnsWriteStreamMsg(conn, rawResponse); err != nil {
+			return
+		}
+	}
+}
+
+// dnsServerAdjustUDPResponse ensures that the raw response fits the UDP
+// payload size, which is 512 bytes unless the client advertises a larger
+// size using EDNS0, in which case we use the minimum between the client's
+// and the server's size. We truncate the response when needed. We also
+// honour the explicit truncation settings inside the options.
+func dnsServerAdjustUDPResponse(rawQuery, rawResponse []byte, options *DNSServerOptions) ([]byte, error) {
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil {
+		return nil, err
+	}
+	resp := &dns.Msg{}
+	if err := resp.Unpack(rawResponse); err != nil {
+		return nil, err
+	}
+
+	// advertise the server's UDP payload size
+	if opt := resp.IsEdns0(); opt != nil {
+		opt.SetUDPSize(options.maxUDPPayload())
+	}
+
+	// compute the maximum size and possibly truncate
+	limit := dns.MinMsgSize
+	if opt := query.IsEdns0(); opt != nil && int(opt.UDPSize()) > limit {
+		limit = int(opt.UDPSize())
+	}
+	if serverLimit := int(options.maxUDPPayload()); serverLimit < limit {
+		limit = serverLimit
+	}
+	resp.Truncate(limit)
+	rawResponse, err := resp.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	// possibly force the client to retry using TCP
+	if options.shouldTruncateUDP(rawResponse) {
+		resp.Truncated = true
+		resp.Answer = nil
+		resp.Ns = nil
+		resp.Extra = dnsOnlyOPT(resp.Extra)
+		return resp.Pack()
+	}
+	return rawResponse, nil
+}
+
+// dnsServerNewGhostResponses returns the raw ghost responses for the raw query.
+func dnsServerNewGhostResponses(rawQuery []byte, options *DNSServerOptions) (out [][]byte) {
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil || len(query.Question) != 1 {
+		return nil
+	}
+	q0 := query.Question[0]
+	for _, rr := range options.ghostRecordsForName(q0.Name) {
+		rawGhost, err := dnsServerNewResponse(query, q0, len(rr.A) > 0 || rr.CNAME != "", rr)
+		if err != nil {
 			continue
 		}
+		out = append(out, rawGhost)
+	}
+	return
+}
+
+// dnsServerMalformResponse corrupts the raw response according to the given
+// malformation. This function returns the original response when the
+// malformation is [DNSMalformationNone] or we cannot apply it.
+func dnsServerMalformResponse(rawResponse []byte, malformation DNSMalformation) []byte {
+	const headerSize = 12
+	if len(rawResponse) <= headerSize {
+		return rawResponse
+	}
+	switch malformation {
+	case DNSMalformationBadCompressionPointer:
+		// find the end of the name inside the question section
+		offset := headerSize
+		for offset < len(rawResponse) && rawResponse[offset] != 0 {
+			offset += int(rawResponse[offset]) + 1
+		}
+		if offset >= len(rawResponse) {
+			return rawResponse
+		}
+		out := append([]byte{}, rawResponse[:headerSize]...)
+		out = append(out, 0xff, 0xff) // pointer to the 0x3fff offset
+		return append(out, rawResponse[offset+1:]...)
+
+	case DNSMalformationTruncatedRR:
+		return rawResponse[:len(rawResponse)-3]
+
+	case DNSMalformationMismatchedID:
+		out := append([]byte{}, rawResponse...)
+		binary.BigEndian.PutUint16(out, binary.BigEndian.Uint16(out)^0xffff)
+		return out
 
-		_, _ = pconn.WriteTo(rawResponse, addr)
+	default:
+		return rawResponse
 	}
 }
 
+// dnsOnlyOPT filters the given resource records keeping only the OPT record.
+func dnsOnlyOPT(rrs []dns.RR) (out []dns.RR) {
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.OPT); ok {
+			out = append(out, rr)
+		}
+	}
+	return
+}
+
+// dnsQueryName returns the name inside a raw query or an empty string.
+func dnsQueryName(rawQuery []byte) string {
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil || len(query.Question) != 1 {
+		return ""
+	}
+	return query.Question[0].Name
+}
+
 // DNSServerRoundTrip responds to a raw DNS query with a raw DNS response.
 func DNSServerRoundTrip(config *DNSConfig, rawQuery []byte) ([]byte, error) {
+	return dnsServerRoundTrip(config, dnsServerRNG, rawQuery)
+}
+
+// dnsServerRoundTrip is like [DNSServerRoundTrip] but uses the given
+// random number generator to apply the [DNSRcodeRule]s.
+func dnsServerRoundTrip(config *DNSConfig, rng dnsServerRandom, rawQuery []byte) ([]byte, error) {
 	// parse incoming query
 	query := &dns.Msg{}
 	if err := query.Unpack(rawQuery); err != nil {
 		return nil, err
 	}
+	return dnsServerRoundTripMsg(config, rng, query).Pack()
+}
+
+// dnsServerDefaultUDPPayload is the UDP payload size advertised by the
+// server using EDNS0, which is the one recommended by the DNS flag day 2020.
+const dnsServerDefaultUDPPayload = 1232
+
+// dnsServerRoundTripMsg responds to a DNS query with a DNS response.
+func dnsServerRoundTripMsg(config *DNSConfig, rng dnsServerRandom, query *dns.Msg) *dns.Msg {
+	resp := dnsServerNewResponseMsg(config, rng, query)
 
+	// echo EDNS0 back to the client if the client is using it
+	if opt := query.IsEdns0(); opt != nil {
+		resp.SetEdns0(dnsServerDefaultUDPPayload, opt.Do())
+	}
+
+	return resp
+}
+
+// dnsServerNewResponseMsg constructs the response to a DNS query.
+func dnsServerNewResponseMsg(config *DNSConfig, rng dnsServerRandom, query *dns.Msg) *dns.Msg {
 	// reject blatantly wrong queries
 	if query.Response || len(query.Question) != 1 {
 		resp := &dns.Msg{}
 		resp.SetRcode(query, dns.RcodeRefused)
-		return Must1(resp.Pack()), nil
+		return resp
 	}
 
 	// find the corresponding record
@@ -215,34 +1315,123 @@ func DNSServerRoundTrip(config *DNSConfig, rawQuery []byte) ([]byte, error) {
 	if q0.Qclass != dns.ClassINET {
 		resp := &dns.Msg{}
 		resp.SetRcode(query, dns.RcodeRefused)
-		return Must1(resp.Pack()), nil
+		return resp
+	}
+
+	// honour the configured rcode, if any
+	if rule, found := config.LookupRcode(q0.Name); found && rule.shouldApply(rng) {
+		resp := &dns.Msg{}
+		resp.SetRcode(query, rule.Rcode)
+		return resp
+	}
+
+	// follow the CNAME chain, if any
+	owner, chain, found, rr, err := dnsServerFollowCNAMEChain(config, q0.Name)
+	if err != nil {
+		resp := &dns.Msg{}
+		resp.SetRcode(query, dns.RcodeServerFailure)
+		return resp
+	}
+	return dnsServerNewResponseWithChain(query, q0, chain, owner, found, rr)
+}
+
+// dnsMaxCNAMEChainLength is the maximum number of CNAMEs we follow.
+const dnsMaxCNAMEChainLength = 16
+
+// errDNSCNAMELoop indicates that we have found a CNAME loop.
+var errDNSCNAMELoop = errors.New("netem: dns: CNAME loop")
+
+// dnsServerFollowCNAMEChain looks up the given name inside the config and follows
+// the CNAME chain, if any. This function returns the name owning the returned record,
+// the CNAMEs we followed, whether we found the name, and the record itself.
+func dnsServerFollowCNAMEChain(
+	config *DNSConfig, name string) (string, []*dns.CNAME, bool, *DNSRecord, error) {
+	var chain []*dns.CNAME
+	rr, found := config.Lookup(name)
+	for found && len(rr.A) <= 0 && rr.CNAME != "" {
+		next, nextFound := config.Lookup(rr.CNAME)
+		if !nextFound {
+			break // the chain leaves our zone
+		}
+		if len(chain) >= dnsMaxCNAMEChainLength {
+			return "", nil, false, nil, errDNSCNAMELoop
+		}
+		chain = append(chain, dnsServerNewCNAME(name, rr.CNAME))
+		name, rr = rr.CNAME, next
+	}
+	return name, chain, found, rr, nil
+}
+
+// dnsServerNewCNAME constructs a new CNAME resource record.
+func dnsServerNewCNAME(name, target string) *dns.CNAME {
+	return &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:     name,
+			Rrtype:   dns.TypeCNAME,
+			Class:    dns.ClassINET,
+			Ttl:      3600,
+			Rdlength: 0,
+		},
+		Target: target,
 	}
-	rr, found := config.Lookup(q0.Name)
+}
 
-	return dnsServerNewResponse(query, q0, found, rr)
+// dnsServerNewHTTPS constructs a new HTTPS resource record using the
+// service's own name as the target and advertising ECH.
+func dnsServerNewHTTPS(name string, echConfigList []byte) *dns.HTTPS {
+	return &dns.HTTPS{
+		SVCB: dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:     name,
+				Rrtype:   dns.TypeHTTPS,
+				Class:    dns.ClassINET,
+				Ttl:      3600,
+				Rdlength: 0,
+			},
+			Priority: 1,
+			Target:   ".",
+			Value: []dns.SVCBKeyValue{
+				&dns.SVCBAlpn{Alpn: []string{"h2", "http/1.1"}},
+				&dns.SVCBECHConfig{ECH: echConfigList},
+			},
+		},
+	}
 }
 
 // dnsServerNewResponse constructs a new response. If the found flag is false, the response
 // contains a NXDOMAIN error and otherwise the response is successful.
 func dnsServerNewResponse(query *dns.Msg, q0 dns.Question, found bool, rr *DNSRecord) ([]byte, error) {
+	return dnsServerNewResponseWithChain(query, q0, nil, q0.Name, found, rr).Pack()
+}
+
+// dnsServerNewResponseWithChain is like [dnsServerNewResponse] but the response
+// starts with the given CNAME chain and the record belongs to the given owner.
+func dnsServerNewResponseWithChain(query *dns.Msg, q0 dns.Question,
+	chain []*dns.CNAME, owner string, found bool, rr *DNSRecord) *dns.Msg {
 
 	// handle the NXDOMAIN case
 	if !found {
 		resp := &dns.Msg{}
 		resp.SetRcode(query, dns.RcodeNameError)
-		return Must1(resp.Pack()), nil
+		return resp
 	}
 
 	// fill the response
 	resp := &dns.Msg{}
 	resp.SetReply(query)
 
-	// insert A entries if needed
-	if q0.Qtype == dns.TypeA {
-		for _, addr := range rr.A {
+	// insert the CNAME chain first
+	for _, cname := range chain {
+		resp.Answer = append(resp.Answer, cname)
+	}
+
+	// insert A or AAAA entries if needed
+	for _, addr := range rr.A {
+		switch {
+		case q0.Qtype == dns.TypeA && addr.To4() != nil:
 			resp.Answer = append(resp.Answer, &dns.A{
 				Hdr: dns.RR_Header{
-					Name:     q0.Name,
+					Name:     owner,
 					Rrtype:   dns.TypeA,
 					Class:    dns.ClassINET,
 					Ttl:      3600,
@@ -250,22 +1439,27 @@ func dnsServerNewResponse(query *dns.Msg, q0 dns.Question, found bool, rr *DNSRe
 				},
 				A: addr,
 			})
+		case q0.Qtype == dns.TypeAAAA && addr.To4() == nil:
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:     owner,
+					Rrtype:   dns.TypeAAAA,
+					Class:    dns.ClassINET,
+					Ttl:      3600,
+					Rdlength: 0,
+				},
+				AAAA: addr,
+			})
 		}
 	}
 
+	// insert HTTPS or SVCB entries if needed
+	resp.Answer = append(resp.Answer, dnsServerNewServiceBindings(q0.Qtype, owner, rr)...)
+
 	// insert a CNAME entry if needed
 	if rr.CNAME != "" {
-		resp.Answer = append(resp.Answer, &dns.CNAME{
-			Hdr: dns.RR_Header{
-				Name:     q0.Name,
-				Rrtype:   dns.TypeCNAME,
-				Class:    dns.ClassINET,
-				Ttl:      3600,
-				Rdlength: 0,
-			},
-			Target: rr.CNAME,
-		})
+		resp.Answer = append(resp.Answer, dnsServerNewCNAME(owner, rr.CNAME))
 	}
 
-	return Must1(resp.Pack()), nil
+	return resp
 }
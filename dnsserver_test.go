@@ -1,10 +1,15 @@
 package netem
 
 import (
+	"context"
+	"errors"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/miekg/dns"
 )
 
 func TestDNSConfig(t *testing.T) {
@@ -69,3 +74,539 @@ func TestDNSConfig(t *testing.T) {
 		}
 	})
 }
+
+func TestDNSServerRoundTripRcode(t *testing.T) {
+	// roundTrip performs a round trip using the given config and returns the rcode.
+	roundTrip := func(t *testing.T, config *DNSConfig, domain string) int {
+		query := NewDNSRequestA(domain)
+		rawResponse, err := DNSServerRoundTrip(config, Must1(query.Pack()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := &dns.Msg{}
+		if err := response.Unpack(rawResponse); err != nil {
+			t.Fatal(err)
+		}
+		return response.Rcode
+	}
+
+	t.Run("we cannot configure an unsupported rcode", func(t *testing.T) {
+		config := NewDNSConfig()
+		if err := config.AddRcode("www.example.com", dns.RcodeNotImplemented, 0); err != ErrDNSInvalidRcode {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("the rcode takes precedence over the records", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "130.192.91.211")
+		for _, rcode := range []int{dns.RcodeNameError, dns.RcodeServerFailure, dns.RcodeRefused} {
+			if err := config.AddRcode("www.example.com", rcode, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got := roundTrip(t, config, "www.example.com"); got != rcode {
+				t.Fatal("expected", rcode, "got", got)
+			}
+		}
+	})
+
+	t.Run("removing the rcode restores the records", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "130.192.91.211")
+		config.AddRcode("www.example.com", dns.RcodeServerFailure, 0)
+		config.RemoveRcode("www.example.com")
+		if got := roundTrip(t, config, "www.example.com"); got != dns.RcodeSuccess {
+			t.Fatal("unexpected rcode", got)
+		}
+	})
+
+	t.Run("the rcode is applied with the given probability", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "130.192.91.211")
+		config.AddRcode("www.example.com", dns.RcodeServerFailure, 0.5)
+		var failures int
+		const repetitions = 1000
+		for idx := 0; idx < repetitions; idx++ {
+			if roundTrip(t, config, "www.example.com") == dns.RcodeServerFailure {
+				failures++
+			}
+		}
+		if failures < 350 || failures > 650 {
+			t.Fatal("unexpected number of failures", failures)
+		}
+	})
+}
+
+func TestDNSServerRoundTripCNAMEChain(t *testing.T) {
+	// roundTrip performs a round trip using the given config and parses the response.
+	roundTrip := func(t *testing.T, config *DNSConfig, domain string) ([]string, string, error) {
+		query := NewDNSRequestA(domain)
+		rawResponse, err := DNSServerRoundTrip(config, Must1(query.Pack()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := &dns.Msg{}
+		if err := response.Unpack(rawResponse); err != nil {
+			t.Fatal(err)
+		}
+		return DNSParseResponse(query, response)
+	}
+
+	t.Run("we follow a multi-step CNAME chain", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("a.example.com", "b.example.com")
+		config.AddRecord("b.example.com", "c.example.com")
+		config.AddRecord("c.example.com", "", "10.0.0.1", "10.0.0.2")
+		addrs, cname, err := roundTrip(t, config, "a.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cname != "c.example.com." {
+			t.Fatal("unexpected CNAME", cname)
+		}
+		if diff := cmp.Diff([]string{"10.0.0.1", "10.0.0.2"}, addrs); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("we stop following when the chain leaves the config", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("a.example.com", "b.example.com")
+		_, _, err := roundTrip(t, config, "a.example.com")
+		if err != ErrDNSNoAnswer {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we return SERVFAIL in case of CNAME loops", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("a.example.com", "b.example.com")
+		config.AddRecord("b.example.com", "a.example.com")
+		_, _, err := roundTrip(t, config, "a.example.com")
+		if err != ErrDNSServerMisbehaving {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+// newDNSServerTestTopology creates a PPP topology where the server runs
+// a DNS server using the given config and options.
+func newDNSServerTestTopology(
+	t *testing.T, config *DNSConfig, options *DNSServerOptions) (*PPPTopology, *DNSServer) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	t.Cleanup(func() { topology.Close() })
+	server, err := NewDNSServerWithOptions(&NullLogger{}, topology.Server, "10.0.0.1", config, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return topology, server
+}
+
+func TestDNSServerOptions(t *testing.T) {
+	t.Run("we can delay the responses for specific names", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("fast.example.com", "", "10.0.0.3")
+		config.AddRecord("slow.example.com", "", "10.0.0.4")
+		options := &DNSServerOptions{
+			DelayPerName: map[string]time.Duration{
+				"slow.example.com": 500 * time.Millisecond,
+			},
+		}
+		topology, _ := newDNSServerTestTopology(t, config, options)
+
+		measure := func(domain string) time.Duration {
+			t0 := time.Now()
+			if _, _, err := topology.Client.GetaddrinfoLookupANY(context.Background(), domain); err != nil {
+				t.Fatal(err)
+			}
+			return time.Since(t0)
+		}
+
+		if elapsed := measure("slow.example.com"); elapsed < 500*time.Millisecond {
+			t.Fatal("expected a delayed response", elapsed)
+		}
+		if elapsed := measure("fast.example.com"); elapsed >= 500*time.Millisecond {
+			t.Fatal("expected a fast response", elapsed)
+		}
+	})
+
+	t.Run("we can drop queries", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.3")
+		options := &DNSServerOptions{
+			DropRate: 1,
+		}
+		topology, _ := newDNSServerTestTopology(t, config, options)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		_, _, err := topology.Client.GetaddrinfoLookupANY(ctx, "www.example.com")
+		var nerr net.Error
+		if !errors.As(err, &nerr) || !nerr.Timeout() {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestDNSConfigUpdates(t *testing.T) {
+	t.Run("the generation increments on each change", func(t *testing.T) {
+		config := NewDNSConfig()
+		if config.Generation() != 0 {
+			t.Fatal("expected zero generation")
+		}
+		config.AddRecord("www.example.com", "", "10.0.0.1")
+		config.AddRcode("www.example.com", dns.RcodeServerFailure, 0)
+		config.RemoveRcode("www.example.com")
+		config.RemoveRecord("www.example.com")
+		if gen := config.Generation(); gen != 4 {
+			t.Fatal("expected generation 4, got", gen)
+		}
+		if gen := config.Clone().Generation(); gen != 4 {
+			t.Fatal("expected the clone to have generation 4, got", gen)
+		}
+	})
+
+	t.Run("Replace replaces the whole configuration", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.1")
+		other := NewDNSConfig()
+		other.AddRecord("www.example.org", "", "10.0.0.2")
+		config.Replace(other)
+		if _, found := config.Lookup("www.example.com"); found {
+			t.Fatal("expected www.example.com to be gone")
+		}
+		if _, found := config.Lookup("www.example.org"); !found {
+			t.Fatal("expected to find www.example.org")
+		}
+		if gen := config.Generation(); gen != 2 {
+			t.Fatal("expected generation 2, got", gen)
+		}
+
+		// make sure we copied the other config
+		other.AddRecord("www.example.net", "", "10.0.0.3")
+		if _, found := config.Lookup("www.example.net"); found {
+			t.Fatal("expected config not to share data with other")
+		}
+	})
+
+	t.Run("Update discards the changes on error", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.1")
+		err := config.Update(func(tx *DNSConfig) error {
+			tx.RemoveRecord("www.example.com")
+			return tx.AddRecord("www.example.com", "", "antani")
+		})
+		if !errors.Is(err, ErrNotIPAddress) {
+			t.Fatal("unexpected error", err)
+		}
+		if _, found := config.Lookup("www.example.com"); !found {
+			t.Fatal("expected to still find www.example.com")
+		}
+		if gen := config.Generation(); gen != 1 {
+			t.Fatal("expected generation 1, got", gen)
+		}
+	})
+
+	t.Run("a running server uses the updated configuration", func(t *testing.T) {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.3")
+		topology, _ := newDNSServerTestTopology(t, config, &DNSServerOptions{})
+
+		lookup := func() []string {
+			addrs, _, err := topology.Client.GetaddrinfoLookupANY(context.Background(), "www.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return addrs
+		}
+
+		if diff := cmp.Diff([]string{"10.0.0.3"}, lookup()); diff != "" {
+			t.Fatal(diff)
+		}
+		err := config.Update(func(tx *DNSConfig) error {
+			tx.RemoveRecord("www.example.com")
+			return tx.AddRecord("www.example.com", "", "10.0.0.4")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{"10.0.0.4"}, lookup()); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+}
+
+func TestDNSServerForwarding(t *testing.T) {
+	// newTopology creates a topology containing a client, a forwarding
+	// resolver, and an authoritative server, and returns the client.
+	newTopology := func(t *testing.T, options *DNSServerOptions) *UNetStack {
+		topology := MustNewStarTopology(&NullLogger{})
+		t.Cleanup(func() { topology.Close() })
+		client := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{}))
+		resolverStack := Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+		authStack := Must1(topology.AddHost("10.0.0.3", "0.0.0.0", &LinkConfig{}))
+
+		resolverConfig := NewDNSConfig()
+		resolverConfig.AddRecord("local.example.com", "", "10.0.0.10")
+		resolver := Must1(NewDNSServerWithOptions(
+			&NullLogger{}, resolverStack, "10.0.0.1", resolverConfig, options))
+		t.Cleanup(func() { resolver.Close() })
+
+		authConfig := NewDNSConfig()
+		authConfig.AddRecord("remote.example.com", "", "10.0.0.11")
+		auth := Must1(NewDNSServer(&NullLogger{}, authStack, "10.0.0.3", authConfig))
+		t.Cleanup(func() { auth.Close() })
+
+		return client
+	}
+
+	t.Run("we forward unknown names to the upstream", func(t *testing.T) {
+		client := newTopology(t, &DNSServerOptions{Upstream: "10.0.0.3"})
+		for domain, expect := range map[string]string{
+			"local.example.com":  "10.0.0.10",
+			"remote.example.com": "10.0.0.11",
+		} {
+			addrs, _, err := client.GetaddrinfoLookupANY(context.Background(), domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]string{expect}, addrs); diff != "" {
+				t.Fatal(diff)
+			}
+		}
+		_, _, err := client.GetaddrinfoLookupANY(context.Background(), "nonexistent.example.com")
+		if !errors.Is(err, ErrDNSNoSuchHost) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we return SERVFAIL when the upstream is not working", func(t *testing.T) {
+		client := newTopology(t, &DNSServerOptions{Upstream: "10.0.0.4"})
+		query := NewDNSRequestA("remote.example.com")
+		resp, err := DNSRoundTrip(context.Background(), client, "10.0.0.1", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != dns.RcodeServerFailure {
+			t.Fatal("expected SERVFAIL, got", dns.RcodeToString[resp.Rcode])
+		}
+	})
+
+	t.Run("we can use a default record for unknown names", func(t *testing.T) {
+		client := newTopology(t, &DNSServerOptions{
+			DefaultRecord: &DNSRecord{A: []net.IP{net.IPv4(10, 0, 0, 12)}},
+		})
+		addrs, _, err := client.GetaddrinfoLookupANY(context.Background(), "remote.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{"10.0.0.12"}, addrs); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+}
+
+func TestDNSConfigViews(t *testing.T) {
+	t.Run("AddView rejects invalid prefixes", func(t *testing.T) {
+		config := NewDNSConfig()
+		if err := config.AddView("10.0.0.1", NewDNSConfig()); !errors.Is(err, ErrNotIPPrefix) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("LookupView uses the most specific prefix", func(t *testing.T) {
+		config := NewDNSConfig()
+		wide, narrow := NewDNSConfig(), NewDNSConfig()
+		Must0(config.AddView("10.0.0.0/8", wide))
+		Must0(config.AddView("10.0.1.0/24", narrow))
+		expect := map[string]*DNSConfig{
+			"10.0.1.7":    narrow,
+			"10.0.2.7":    wide,
+			"192.168.1.1": config,
+			"antani":      config,
+		}
+		for addr, view := range expect {
+			if got, _ := config.LookupView(addr); got != view {
+				t.Fatal("unexpected view for", addr)
+			}
+		}
+		config.RemoveView("10.0.1.0/24")
+		if got, found := config.LookupView("10.0.1.7"); !found || got != wide {
+			t.Fatal("expected the wide view after removing the narrow one")
+		}
+	})
+
+	t.Run("the server responds according to the client's view", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		serverStack := Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+		clientA := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{}))
+		clientB := Must1(topology.AddHost("10.0.1.2", "10.0.0.1", &LinkConfig{}))
+
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.3")
+		view := NewDNSConfig()
+		view.AddRecord("www.example.com", "", "10.0.0.4")
+		Must0(config.AddView("10.0.1.0/24", view))
+
+		server := Must1(NewDNSServer(&NullLogger{}, serverStack, "10.0.0.1", config))
+		defer server.Close()
+
+		for client, expect := range map[*UNetStack]string{clientA: "10.0.0.3", clientB: "10.0.0.4"} {
+			addrs, _, err := client.GetaddrinfoLookupANY(context.Background(), "www.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]string{expect}, addrs); diff != "" {
+				t.Fatal(diff)
+			}
+		}
+	})
+}
+
+func TestDNSServerQueryLog(t *testing.T) {
+	config := NewDNSConfig()
+	config.AddRecord("www.example.com", "web.example.com")
+	config.AddRecord("web.example.com", "", "10.0.0.3")
+	qlog := &DNSQueryLog{}
+	topology, _ := newDNSServerTestTopology(t, config, &DNSServerOptions{QueryLog: qlog.Add})
+
+	query := NewDNSRequestA("www.example.com")
+	if _, err := DNSRoundTrip(context.Background(), topology.Client, "10.0.0.1", query); err != nil {
+		t.Fatal(err)
+	}
+	query = NewDNSRequestA("nonexistent.example.com")
+	if _, err := DNSRoundTripTCP(context.Background(), topology.Client, "10.0.0.1", query); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := qlog.Entries()
+	if len(entries) != 2 {
+		t.Fatal("expected two entries, got", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Time.IsZero() || entry.ClientAddress == "" {
+			t.Fatal("expected time and client address to be set")
+		}
+		entry.Time, entry.ClientAddress = time.Time{}, ""
+	}
+	expect := []*DNSQueryLogEntry{{
+		Network:   "udp",
+		Name:      "www.example.com.",
+		Qtype:     dns.TypeA,
+		Rcode:     dns.RcodeSuccess,
+		CNAMEs:    []string{"web.example.com."},
+		Addresses: []string{"10.0.0.3"},
+	}, {
+		Network: "tcp",
+		Name:    "nonexistent.example.com.",
+		Qtype:   dns.TypeA,
+		Rcode:   dns.RcodeNameError,
+	}}
+	if diff := cmp.Diff(expect, entries); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestDNSServerGhostResponses(t *testing.T) {
+	config := NewDNSConfig()
+	config.AddRecord("www.example.com", "", "10.0.0.3")
+	options := &DNSServerOptions{
+		DelayPerName: map[string]time.Duration{
+			"www.example.com": 100 * time.Millisecond,
+		},
+		GhostRecordsPerName: map[string][]*DNSRecord{
+			"www.example.com": {
+				{A: []net.IP{net.IPv4(10, 10, 34, 35)}},
+				{},
+			},
+		},
+	}
+	topology, _ := newDNSServerTestTopology(t, config, options)
+
+	conn, err := topology.Client.DialContext(context.Background(), "udp", "10.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	query := NewDNSRequestA("www.example.com")
+	rawQuery := Must1(query.Pack())
+	if _, err := conn.Write(rawQuery); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		Addrs []string
+		Err   error
+	}
+	var results []result
+	for idx := 0; idx < 3; idx++ {
+		buffer := make([]byte, 1024)
+		count, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &dns.Msg{}
+		if err := resp.Unpack(buffer[:count]); err != nil {
+			t.Fatal(err)
+		}
+		addrs, _, err := DNSParseResponse(query, resp)
+		results = append(results, result{addrs, err})
+	}
+
+	expect := []result{
+		{Addrs: []string{"10.10.34.35"}},
+		{Err: ErrDNSNoSuchHost},
+		{Addrs: []string{"10.0.0.3"}},
+	}
+	if diff := cmp.Diff(expect, results, cmpopts.EquateErrors()); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestDNSServerMalformedResponses(t *testing.T) {
+	config := NewDNSConfig()
+	config.AddRecord("pointer.example.com", "", "10.0.0.3")
+	config.AddRecord("truncated.example.com", "", "10.0.0.3")
+	config.AddRecord("id.example.com", "", "10.0.0.3")
+	config.AddRecord("www.example.com", "", "10.0.0.3")
+	options := &DNSServerOptions{
+		MalformedPerName: map[string]DNSMalformation{
+			"pointer.example.com":   DNSMalformationBadCompressionPointer,
+			"truncated.example.com": DNSMalformationTruncatedRR,
+			"id.example.com":        DNSMalformationMismatchedID,
+		},
+	}
+	topology, _ := newDNSServerTestTopology(t, config, options)
+
+	for _, roundTrip := range []func(context.Context, UnderlyingNetwork, string, *dns.Msg) (*dns.Msg, error){
+		DNSRoundTrip,
+		DNSRoundTripTCP,
+	} {
+		for _, domain := range []string{"pointer.example.com", "truncated.example.com"} {
+			query := NewDNSRequestA(domain)
+			if _, err := roundTrip(context.Background(), topology.Client, "10.0.0.1", query); err == nil {
+				t.Fatal("expected an error for", domain)
+			}
+		}
+
+		query := NewDNSRequestA("id.example.com")
+		resp, err := roundTrip(context.Background(), topology.Client, "10.0.0.1", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := DNSParseResponse(query, resp); !errors.Is(err, ErrDNSServerMisbehaving) {
+			t.Fatal("unexpected error", err)
+		}
+
+		query = NewDNSRequestA("www.example.com")
+		resp, err = roundTrip(context.Background(), topology.Client, "10.0.0.1", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := DNSParseResponse(query, resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package netem
+
+//
+// HTTPS and SVCB records (RFC 9460)
+//
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// DNSServiceBinding is an HTTPS or SVCB record inside a [DNSRecord], which
+// modern clients use to discover the ALPN (e.g., HTTP/3), the addresses, and
+// the ECH config of a service before connecting to it. Use
+// [DNSConfig.AddHTTPSRecord] and [DNSConfig.AddSVCBRecord] to add records.
+type DNSServiceBinding struct {
+	// Priority is the SvcPriority. Zero means alias mode, in which the Target is an
+	// alias of the owner name and the server does not send any parameter. Otherwise,
+	// the record is in service mode and lower values indicate higher preference.
+	Priority uint16
+
+	// Target is the OPTIONAL TargetName. When empty, the target is the owner name.
+	Target string
+
+	// ALPN contains the OPTIONAL ALPN protocols (e.g., "h3", "h2").
+	ALPN []string
+
+	// Port is the OPTIONAL port.
+	Port uint16
+
+	// IPv4Hint contains the OPTIONAL IPv4 address hints.
+	IPv4Hint []net.IP
+
+	// IPv6Hint contains the OPTIONAL IPv6 address hints.
+	IPv6Hint []net.IP
+
+	// ECHConfigList is the OPTIONAL ECH config list. When empty, we use the
+	// list configured using [DNSConfig.SetECHConfigList], if any.
+	ECHConfigList []byte
+}
+
+// AddHTTPSRecord adds an HTTPS record for the given domain, creating a record without
+// addresses if needed, such that the DNS server includes the binding in the responses
+// to HTTPS queries for the domain. You can call this method several times to add several
+// bindings. The [DNSConfig] takes ownership of the binding, which you should not modify
+// after calling this method. Note that calling [DNSConfig.AddRecord] for the domain
+// replaces the record and clears the bindings.
+//
+// For example, the following code advertises HTTP/3 support for www.example.com:
+//
+//	config.AddHTTPSRecord("www.example.com", &DNSServiceBinding{Priority: 1, ALPN: []string{"h3", "h2"}})
+func (dc *DNSConfig) AddHTTPSRecord(domain string, binding *DNSServiceBinding) {
+	dc.updateRecord(domain, func(record *DNSRecord) {
+		record.HTTPS = append(record.HTTPS, binding)
+	})
+}
+
+// AddSVCBRecord is like [DNSConfig.AddHTTPSRecord] but adds a SVCB record, which is
+// the generic version of the HTTPS record used by other protocols (e.g., DNS servers
+// advertising DoT and DoH using the _dns.resolver.arpa domain).
+func (dc *DNSConfig) AddSVCBRecord(domain string, binding *DNSServiceBinding) {
+	dc.updateRecord(domain, func(record *DNSRecord) {
+		record.SVCB = append(record.SVCB, binding)
+	})
+}
+
+// updateRecord replaces the record of the given domain with a copy modified by fx,
+// creating a record without addresses if needed, and increments the generation.
+func (dc *DNSConfig) updateRecord(domain string, fx func(record *DNSRecord)) {
+	name := dns.CanonicalName(domain)
+	dc.mu.Lock()
+	record := &DNSRecord{}
+	if prev := dc.r[name]; prev != nil {
+		record = prev.clone()
+	}
+	fx(record)
+	dc.r[name] = record
+	dc.generation++
+	dc.mu.Unlock()
+}
+
+// clone returns a copy of the record sharing the bindings and the ECH config list.
+func (rr *DNSRecord) clone() *DNSRecord {
+	return &DNSRecord{
+		A:             append([]net.IP{}, rr.A...),
+		CNAME:         rr.CNAME,
+		ECHConfigList: rr.ECHConfigList,
+		HTTPS:         append([]*DNSServiceBinding(nil), rr.HTTPS...),
+		SVCB:          append([]*DNSServiceBinding(nil), rr.SVCB...),
+	}
+}
+
+// dnsServerNewServiceBindings constructs the HTTPS or SVCB resource records
+// for the given owner and record depending on the given query type.
+func dnsServerNewServiceBindings(qtype uint16, owner string, rr *DNSRecord) (out []dns.RR) {
+	switch qtype {
+	case dns.TypeHTTPS:
+		if len(rr.HTTPS) <= 0 && len(rr.ECHConfigList) > 0 {
+			return append(out, dnsServerNewHTTPS(owner, rr.ECHConfigList))
+		}
+		for _, binding := range rr.HTTPS {
+			out = append(out, &dns.HTTPS{SVCB: binding.svcb(owner, dns.TypeHTTPS, rr.ECHConfigList)})
+		}
+	case dns.TypeSVCB:
+		for _, binding := range rr.SVCB {
+			svcb := binding.svcb(owner, dns.TypeSVCB, rr.ECHConfigList)
+			out = append(out, &svcb)
+		}
+	}
+	return
+}
+
+// svcb converts the binding to a [dns.SVCB] with the given owner and rrtype.
+func (b *DNSServiceBinding) svcb(owner string, rrtype uint16, echConfigList []byte) dns.SVCB {
+	svcb := dns.SVCB{
+		Hdr: dns.RR_Header{
+			Name:     owner,
+			Rrtype:   rrtype,
+			Class:    dns.ClassINET,
+			Ttl:      3600,
+			Rdlength: 0,
+		},
+		Priority: b.Priority,
+		Target:   ".",
+	}
+	if b.Target != "" {
+		svcb.Target = dns.CanonicalName(b.Target)
+	}
+	if b.Priority == 0 {
+		return svcb // alias mode
+	}
+
+	// Implementation note: RFC 9460 requires sorting the parameters by key
+	if len(b.ALPN) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBAlpn{Alpn: b.ALPN})
+	}
+	if b.Port != 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBPort{Port: b.Port})
+	}
+	if len(b.IPv4Hint) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: b.IPv4Hint})
+	}
+	if len(b.ECHConfigList) > 0 {
+		echConfigList = b.ECHConfigList
+	}
+	if len(echConfigList) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBECHConfig{ECH: echConfigList})
+	}
+	if len(b.IPv6Hint) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: b.IPv6Hint})
+	}
+	return svcb
+}
+
+// DNSParseServiceBindings parses the HTTPS or SVCB records inside a [dns.Msg]
+// answering the given query, depending on the query type. This function maps errors
+// like [DNSParseResponse] does and returns [ErrDNSNoAnswer] if there are no records.
+func DNSParseServiceBindings(query, resp *dns.Msg) ([]*DNSServiceBinding, error) {
+	if _, _, err := DNSParseResponse(query, resp); err != nil && !errors.Is(err, ErrDNSNoAnswer) {
+		return nil, err
+	}
+	var out []*DNSServiceBinding
+	for _, answer := range resp.Answer {
+		switch v := answer.(type) {
+		case *dns.HTTPS:
+			out = append(out, dnsNewServiceBinding(&v.SVCB))
+		case *dns.SVCB:
+			out = append(out, dnsNewServiceBinding(v))
+		}
+	}
+	if len(out) <= 0 {
+		return nil, ErrDNSNoAnswer
+	}
+	return out, nil
+}
+
+// dnsNewServiceBinding converts a [dns.SVCB] to a [DNSServiceBinding].
+func dnsNewServiceBinding(svcb *dns.SVCB) *DNSServiceBinding {
+	binding := &DNSServiceBinding{Priority: svcb.Priority}
+	if svcb.Target != "." {
+		binding.Target = svcb.Target
+	}
+	for _, value := range svcb.Value {
+		switch v := value.(type) {
+		case *dns.SVCBAlpn:
+			binding.ALPN = v.Alpn
+		case *dns.SVCBPort:
+			binding.Port = v.Port
+		case *dns.SVCBIPv4Hint:
+			binding.IPv4Hint = v.Hint
+		case *dns.SVCBIPv6Hint:
+			binding.IPv6Hint = v.Hint
+		case *dns.SVCBECHConfig:
+			binding.ECHConfigList = v.ECH
+		}
+	}
+	return binding
+}
+
+// LookupHTTPS resolves the HTTPS records of the given domain.
+func (c *DNSClient) LookupHTTPS(ctx context.Context, domain string) ([]*DNSServiceBinding, error) {
+	return c.lookupServiceBindings(ctx, NewDNSRequestHTTPS(domain))
+}
+
+// LookupSVCB resolves the SVCB records of the given domain.
+func (c *DNSClient) LookupSVCB(ctx context.Context, domain string) ([]*DNSServiceBinding, error) {
+	return c.lookupServiceBindings(ctx, NewDNSRequestSVCB(domain))
+}
+
+// lookupServiceBindings sends the given query and parses the response.
+func (c *DNSClient) lookupServiceBindings(ctx context.Context, query *dns.Msg) ([]*DNSServiceBinding, error) {
+	resp, err := c.RoundTrip(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return DNSParseServiceBindings(query, resp)
+}
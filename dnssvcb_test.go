@@ -0,0 +1,92 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDNSServiceBindings(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	h3 := &DNSServiceBinding{
+		Priority: 1,
+		ALPN:     []string{"h3", "h2"},
+		Port:     8443,
+		IPv4Hint: []net.IP{net.IPv4(10, 0, 0, 1).To4()},
+		IPv6Hint: []net.IP{net.ParseIP("2001:db8::1")},
+	}
+	alias := &DNSServiceBinding{Priority: 0, Target: "cdn.example.net."}
+	dot := &DNSServiceBinding{Priority: 1, Target: "dns.example.com.", ALPN: []string{"dot"}, Port: 853}
+
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.1"))
+	dnsConfig.AddHTTPSRecord("www.example.com", h3)
+	dnsConfig.AddHTTPSRecord("alias.example.com", alias)
+	dnsConfig.AddSVCBRecord("_dns.resolver.arpa", dot)
+	dnsConfig.AddHTTPSRecord("ech.example.com", &DNSServiceBinding{Priority: 1, ALPN: []string{"h2"}})
+	dnsConfig.SetECHConfigList("ech.example.com", []byte{0, 1, 2})
+	dnsServer := Must1(NewDNSServer(&NullLogger{}, topology.Server, "10.0.0.1", dnsConfig))
+	defer dnsServer.Close()
+
+	client := &DNSClient{ServerAddress: "10.0.0.1", Stack: topology.Client}
+
+	t.Run("we resolve HTTPS records in service mode", func(t *testing.T) {
+		bindings, err := client.LookupHTTPS(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]*DNSServiceBinding{h3}, bindings); diff != "" {
+			t.Fatal(diff)
+		}
+
+		// adding HTTPS records does not remove the addresses
+		addrs, _, err := client.LookupHost(context.Background(), "www.example.com")
+		if err != nil || len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+			t.Fatal("unexpected lookup result", addrs, err)
+		}
+	})
+
+	t.Run("we resolve HTTPS records in alias mode", func(t *testing.T) {
+		bindings, err := client.LookupHTTPS(context.Background(), "alias.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]*DNSServiceBinding{alias}, bindings); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("we resolve SVCB records", func(t *testing.T) {
+		bindings, err := client.LookupSVCB(context.Background(), "_dns.resolver.arpa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]*DNSServiceBinding{dot}, bindings); diff != "" {
+			t.Fatal(diff)
+		}
+		if _, err := client.LookupHTTPS(context.Background(), "_dns.resolver.arpa"); !errors.Is(err, ErrDNSNoAnswer) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("HTTPS records include the domain's ECH config list", func(t *testing.T) {
+		bindings, err := client.LookupHTTPS(context.Background(), "ech.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bindings) != 1 || string(bindings[0].ECHConfigList) != "\x00\x01\x02" {
+			t.Fatal("unexpected bindings", bindings)
+		}
+	})
+
+	t.Run("we fail for nonexistent domains", func(t *testing.T) {
+		if _, err := client.LookupHTTPS(context.Background(), "nx.example.com"); !errors.Is(err, ErrDNSNoSuchHost) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
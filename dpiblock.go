@@ -52,7 +52,7 @@ func (r *DPIResetTrafficForTLSSNI) Filter(
 	}
 
 	// try to obtain the SNI
-	sni, err := packet.parseTLSServerName()
+	sni, err := packet.TLSServerName()
 	if err != nil {
 		return nil, false
 	}
@@ -222,8 +222,8 @@ func (r *DPISpoofDNSResponse) Filter(
 	}
 
 	// try to parse the DNS request
-	request := &dns.Msg{}
-	if err := request.Unpack(packet.UDP.Payload); err != nil {
+	request, err := packet.DNSMessage()
+	if err != nil {
 		return nil, false
 	}
 
@@ -320,7 +320,7 @@ func (r *DPICloseConnectionForTLSSNI) Filter(
 	}
 
 	// try to obtain the SNI
-	sni, err := packet.parseTLSServerName()
+	sni, err := packet.TLSServerName()
 	if err != nil {
 		return nil, false
 	}
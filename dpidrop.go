@@ -82,7 +82,7 @@ func (r *DPIDropTrafficForTLSSNI) Filter(
 	}
 
 	// try to obtain the SNI
-	sni, err := packet.parseTLSServerName()
+	sni, err := packet.TLSServerName()
 	if err != nil {
 		return nil, false
 	}
@@ -174,3 +174,38 @@ func (r *DPIDropTrafficForString) Filter(
 	}
 	return policy, true
 }
+
+// DPIDropICMPFragmentationNeeded is a [DPIRule] that drops the ICMP Fragmentation
+// Needed messages, which emulates a path MTU discovery black hole when used along
+// with a [RouterPort] having a small MTU (see [RouterPortConfig]). The zero value
+// is invalid; please fill all the fields marked as MANDATORY.
+type DPIDropICMPFragmentationNeeded struct {
+	// Logger is the MANDATORY logger
+	Logger Logger
+}
+
+var _ DPIRule = &DPIDropICMPFragmentationNeeded{}
+
+// Filter implements DPIRule
+func (r *DPIDropICMPFragmentationNeeded) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	if packet.ICMPv4 == nil {
+		return nil, false
+	}
+	if packet.ICMPv4.TypeCode != layers.CreateICMPv4TypeCode(
+		layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded) {
+		return nil, false
+	}
+	r.Logger.Infof(
+		"netem: dpi: dropping ICMP fragmentation needed from %s to %s",
+		packet.SourceIPAddress(),
+		packet.DestinationIPAddress(),
+	)
+	policy := &DPIPolicy{
+		Delay:   0,
+		Flags:   FrameFlagDrop,
+		PLR:     0,
+		Spoofed: nil,
+	}
+	return policy, true
+}
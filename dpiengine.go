@@ -5,10 +5,11 @@ package netem
 //
 
 import (
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/google/gopacket/layers"
 )
 
 // DPIDirection is the direction of packets within a
@@ -50,8 +51,14 @@ type DPIRule interface {
 // DPIEngine is a deep packet inspection engine. The zero
 // value is invalid; construct using [NewDPIEngine].
 type DPIEngine struct {
-	// flows contains information about flows.
-	flows map[uint64]*dpiFlow
+	// conntrack tracks the inspected flows.
+	conntrack *Conntrack
+
+	// expired counts the packets that would not reach the censor.
+	expired atomic.Int64
+
+	// hops is the distance in hops between the censor and the sender.
+	hops atomic.Int64
 
 	// logger is the logger.
 	logger Logger
@@ -59,32 +66,109 @@ type DPIEngine struct {
 	// mu provides mutual exclusion.
 	mu sync.Mutex
 
+	// packets counts the inspected packets.
+	packets atomic.Int64
+
 	// rules contains the rules.
 	rules []DPIRule
+
+	// ruleCounters contains the counters of each rule.
+	ruleCounters []*dpiRuleCounters
+}
+
+// dpiRuleCounters contains the counters of a [DPIRule].
+type dpiRuleCounters struct {
+	flows   atomic.Int64
+	packets atomic.Int64
 }
 
 // NewDPIEngine creates a new [DPIEngine] instance.
 func NewDPIEngine(logger Logger) *DPIEngine {
 	return &DPIEngine{
-		flows:  map[uint64]*dpiFlow{},
-		logger: logger,
-		mu:     sync.Mutex{},
-		rules:  nil,
+		conntrack: NewConntrack(),
+		logger:    logger,
+		mu:        sync.Mutex{},
+		rules:     nil,
 	}
 }
 
+// DPIEngineStats contains [DPIEngine] statistics.
+type DPIEngineStats struct {
+	// Expired counts the packets ignored because their TTL would expire before
+	// reaching the censor (see [DPIEngine.SetHopCount]), which are not included
+	// in the Packets count.
+	Expired int64 `json:"expired"`
+
+	// Packets counts the packets passed to the engine.
+	Packets int64 `json:"packets"`
+
+	// Rules contains the statistics of each rule in the order
+	// in which the rules were added to the engine.
+	Rules []DPIRuleStats `json:"rules"`
+}
+
+// DPIRuleStats contains the statistics of a [DPIRule].
+type DPIRuleStats struct {
+	// Flows counts the flows matched by the rule.
+	Flows int64 `json:"flows"`
+
+	// Packets counts the packets to which we applied the rule's policy,
+	// including the packets following the one that matched the rule.
+	Packets int64 `json:"packets"`
+
+	// Rule is the rule type name (e.g., "DPIDropTrafficForTLSSNI").
+	Rule string `json:"rule"`
+}
+
+// Stats returns a snapshot of the [DPIEngine] statistics.
+func (de *DPIEngine) Stats() DPIEngineStats {
+	rules, counters := de.getRulesShallowCopy()
+	stats := DPIEngineStats{
+		Expired: de.expired.Load(),
+		Packets: de.packets.Load(),
+		Rules:   []DPIRuleStats{},
+	}
+	for idx, rule := range rules {
+		stats.Rules = append(stats.Rules, DPIRuleStats{
+			Flows:   counters[idx].flows.Load(),
+			Packets: counters[idx].packets.Load(),
+			Rule:    strings.TrimPrefix(fmt.Sprintf("%T", rule), "*netem."),
+		})
+	}
+	return stats
+}
+
+// Conntrack returns the [Conntrack] containing the flows passed to the engine,
+// which we use to determine the direction of packets and to remember the
+// [DPIPolicy] applied to each flow. A flow that expires or that is reopened
+// after being closed starts over with no policy.
+func (de *DPIEngine) Conntrack() *Conntrack {
+	return de.conntrack
+}
+
+// SetHopCount emulates a censor located the given number of router hops away
+// from the sender of each packet. The engine ignores the packets whose IPv4 TTL
+// or IPv6 hop limit is not larger than the hop count, because they would expire
+// before reaching the censor, which allows to study TTL-limited insertion evasion
+// strategies (see also [SocketOptions]). The default, zero, means that the censor
+// sees all the packets, regardless of their TTL.
+func (de *DPIEngine) SetHopCount(count int64) {
+	de.hops.Store(count)
+}
+
 // AddRule adds a [DPIRule] to the [DPIEngine].
 func (de *DPIEngine) AddRule(rule DPIRule) {
 	defer de.mu.Unlock()
 	de.mu.Lock()
 	de.rules = append(de.rules, rule)
+	de.ruleCounters = append(de.ruleCounters, &dpiRuleCounters{})
 }
 
-// getRulesShallowCopy returns a shallow copy of the rules.
-func (de *DPIEngine) getRulesShallowCopy() []DPIRule {
+// getRulesShallowCopy returns a shallow copy of the rules and of their counters.
+func (de *DPIEngine) getRulesShallowCopy() ([]DPIRule, []*dpiRuleCounters) {
 	defer de.mu.Unlock()
 	de.mu.Lock()
-	return append([]DPIRule{}, de.rules...) // copy
+	return append([]DPIRule{}, de.rules...), append([]*dpiRuleCounters{}, de.ruleCounters...) // copy
 }
 
 // inspect applies DPI to an IP packet.
@@ -95,8 +179,14 @@ func (de *DPIEngine) inspect(rawPacket []byte) (*DPIPolicy, bool) {
 		return nil, false
 	}
 
-	// obtain flow
-	flow := de.getFlow(packet)
+	// ignore packets that would expire before reaching the censor
+	if hops := de.hops.Load(); hops > 0 && packet.TimeToLive() <= hops {
+		de.expired.Add(1)
+		return nil, false
+	}
+
+	// obtain flow and packet direction
+	flow, direction := de.getFlow(packet, len(rawPacket))
 
 	// lock the flow record while we're processing it
 	defer flow.mu.Unlock()
@@ -104,9 +194,11 @@ func (de *DPIEngine) inspect(rawPacket []byte) (*DPIPolicy, bool) {
 
 	// increment number of seen packets
 	flow.numPackets++
+	de.packets.Add(1)
 
 	// if we have already computed a policy, just use it
 	if flow.policy != nil {
+		flow.counters.packets.Add(1)
 		return flow.policy, true
 	}
 
@@ -116,14 +208,15 @@ func (de *DPIEngine) inspect(rawPacket []byte) (*DPIPolicy, bool) {
 		return nil, false
 	}
 
-	// compute direction
-	direction := flow.directionLocked(packet)
-
 	// execute all the rules and stop at the first non-accept result
-	for _, rule := range de.getRulesShallowCopy() {
+	rules, counters := de.getRulesShallowCopy()
+	for idx, rule := range rules {
 		policy, match := rule.Filter(direction, packet)
 		if match {
 			flow.policy = policy // remember the policy
+			flow.counters = counters[idx]
+			flow.counters.flows.Add(1)
+			flow.counters.packets.Add(1)
 			return policy, true
 		}
 	}
@@ -131,32 +224,22 @@ func (de *DPIEngine) inspect(rawPacket []byte) (*DPIPolicy, bool) {
 	return nil, false
 }
 
-// getFlow returns the flow associated with this packet.
-func (de *DPIEngine) getFlow(packet *DissectedPacket) *dpiFlow {
-	defer de.mu.Unlock()
-	de.mu.Lock()
+// dpiFlowKey is the key of the [dpiFlow] attached to a [Conntrack] flow.
+type dpiFlowKey struct{}
 
-	// when a flow has not been modified in 30 seconds, we assume that
-	// the record is now stale and we create a new record
-	const maxSilence = 30 * time.Second
-	fh := packet.FlowHash()
-	flow := de.flows[fh]
-	if flow == nil || time.Since(flow.updated) > maxSilence {
-		flow = newDPIFlow(packet)
-		de.flows[fh] = flow
-	}
-	flow.updated = time.Now()
-
-	return flow
+// getFlow returns the flow associated with this packet and the packet direction.
+func (de *DPIEngine) getFlow(packet *DissectedPacket, size int) (*dpiFlow, DPIDirection) {
+	ctFlow, direction := de.conntrack.track(packet, size)
+	flow := de.conntrack.value(ctFlow, dpiFlowKey{}, func() any {
+		return &dpiFlow{}
+	})
+	return flow.(*dpiFlow), direction
 }
 
-// dpiFlow is a TCP/UDP flow tracked by DPI.
+// dpiFlow is the DPI state of a flow tracked by the engine's [Conntrack].
 type dpiFlow struct {
-	// destIP is the dest IP address.
-	destIP string
-
-	// destPort is the dest port.
-	destPort uint16
+	// counters contains the counters of the rule that matched or nil.
+	counters *dpiRuleCounters
 
 	// mu provides mutual exclusion.
 	mu sync.Mutex
@@ -166,39 +249,4 @@ type dpiFlow struct {
 
 	// policy is the policy we previously evaluated or nil.
 	policy *DPIPolicy
-
-	// protocol is the protocol used by the flow.
-	protocol layers.IPProtocol
-
-	// sourceIP is the source IP address.
-	sourceIP string
-
-	// sourcePort is the source port.
-	sourcePort uint16
-
-	// updated is the last time this flow was updated.
-	updated time.Time
-}
-
-// newDPIFlow creates a new [dpiFlow] instance.
-func newDPIFlow(packet *DissectedPacket) *dpiFlow {
-	return &dpiFlow{
-		destIP:     packet.DestinationIPAddress(),
-		destPort:   packet.DestinationPort(),
-		mu:         sync.Mutex{},
-		numPackets: 0,
-		policy:     nil,
-		protocol:   packet.TransportProtocol(),
-		sourceIP:   packet.SourceIPAddress(),
-		sourcePort: packet.SourcePort(),
-		updated:    time.Now(),
-	}
-}
-
-// directionLocked returns the flow direction
-func (df *dpiFlow) directionLocked(packet *DissectedPacket) DPIDirection {
-	if packet.MatchesDestination(df.protocol, df.destIP, df.destPort) {
-		return DPIDirectionClientToServer
-	}
-	return DPIDirectionServerToClient
 }
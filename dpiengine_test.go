@@ -0,0 +1,67 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDPIEngineHopCount(t *testing.T) {
+	// exchange writes the offending string using the given TTL and returns
+	// the error that occurred when the server tried to read it.
+	exchange := func(t *testing.T, ttl int) (DPIEngineStats, error) {
+		dpi := NewDPIEngine(&NullLogger{})
+		dpi.SetHopCount(5)
+		dpi.AddRule(&DPIDropTrafficForString{
+			Logger:          &NullLogger{},
+			ServerIPAddress: "10.0.0.1",
+			ServerPort:      80,
+			String:          "ultrasurf",
+		})
+		lc := &LinkConfig{DPIEngine: dpi}
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, lc)
+		defer topology.Close()
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		defer conn.Close()
+		Must0(conn.(SocketOptions).SetTTL(ttl))
+		Must1(conn.Write([]byte("ultrasurf")))
+
+		serverConn := Must1(listener.Accept())
+		defer serverConn.Close()
+		Must0(serverConn.SetDeadline(time.Now().Add(time.Second)))
+		_, err := serverConn.Read(make([]byte, 16))
+		return dpi.Stats(), err
+	}
+
+	t.Run("the censor ignores packets that would expire before reaching it", func(t *testing.T) {
+		stats, err := exchange(t, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Expired != 1 {
+			t.Fatal("expected one expired packet, got", stats.Expired)
+		}
+		if stats.Rules[0].Flows != 0 {
+			t.Fatal("expected the rule not to match")
+		}
+	})
+
+	t.Run("the censor inspects packets that reach it", func(t *testing.T) {
+		stats, err := exchange(t, 6)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("expected a timeout, got", err)
+		}
+		if stats.Expired != 0 {
+			t.Fatal("expected no expired packets, got", stats.Expired)
+		}
+		if stats.Rules[0].Flows != 1 {
+			t.Fatal("expected the rule to match")
+		}
+	})
+}
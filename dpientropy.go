@@ -0,0 +1,271 @@
+package netem
+
+//
+// DPI: rules to filter random-looking traffic
+//
+
+import (
+	"bytes"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// DPIFilterRandomTraffic is a [DPIRule] that drops or throttles TCP flows
+// that look fully encrypted (e.g., obfs4, Shadowsocks), emulating the blocking
+// of random-looking traffic documented by Wu et al. in "How the Great Firewall
+// of China Detects and Blocks Fully Encrypted Traffic" (USENIX Security 2023).
+// The zero value is invalid; please, fill all the fields marked as MANDATORY.
+//
+// The rule inspects the first client-to-server packets carrying payload. A
+// packet is random-looking unless it is exempted by the heuristics described
+// in the paper, which means that (1) it does not start like TLS or HTTP, (2)
+// its first six bytes are not all printable ASCII, (3) at most half of its
+// bytes are printable ASCII, (4) it does not contain more than twenty contiguous
+// printable ASCII bytes, and (5) the average number of bits set per byte is
+// between 3.4 and 4.6. Additionally, the rule requires the normalized Shannon
+// entropy of the payload to be at least MinEntropy and, optionally, the payload
+// lengths to vary by at least MinLengthStdDev, which targets random padding.
+//
+// The rule classifies a flow once and remembers the result, so that it does
+// not filter, e.g., a TLS flow because of the encrypted records following the
+// handshake. Because the [DPIEngine] stops inspecting flows after a few packets,
+// you should keep Packets small.
+type DPIFilterRandomTraffic struct {
+	// Delay is the OPTIONAL extra delay to add to the flow when not dropping.
+	Delay time.Duration
+
+	// Drop OPTIONALLY drops the flow rather than throttling it.
+	Drop bool
+
+	// Logger is the MANDATORY logger.
+	Logger Logger
+
+	// MinEntropy is the OPTIONAL minimum normalized Shannon entropy of each
+	// payload, ranging from zero to one (default: 0.8). We normalize by the
+	// maximum entropy achievable given the payload length.
+	MinEntropy float64
+
+	// MinLengthStdDev is the OPTIONAL minimum standard deviation of the
+	// payload lengths of the inspected packets. By default, we do not
+	// consider the payload lengths.
+	MinLengthStdDev float64
+
+	// PLR is the OPTIONAL extra packet loss rate to apply when not dropping.
+	PLR float64
+
+	// Packets is the OPTIONAL number of client-to-server packets carrying
+	// payload that we inspect to classify a flow (default: 1).
+	Packets int
+
+	// flows contains the per-flow classification state.
+	flows map[uint64]*dpiRandomFlow
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+}
+
+// dpiRandomFlow is the classification state of a flow.
+type dpiRandomFlow struct {
+	// done indicates that we already classified the flow.
+	done bool
+
+	// lengths contains the payload lengths we have seen so far.
+	lengths []int
+
+	// updated is the last time we updated this record.
+	updated time.Time
+}
+
+var _ DPIRule = &DPIFilterRandomTraffic{}
+
+// Filter implements DPIRule
+func (r *DPIFilterRandomTraffic) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
+		return nil, false
+	}
+
+	// short circuit for UDP packets
+	if packet.TransportProtocol() != layers.IPProtocolTCP {
+		return nil, false
+	}
+
+	// short circuit for packets without payload (e.g., the handshake)
+	payload := packet.TCP.Payload
+	if len(payload) <= 0 {
+		return nil, false
+	}
+
+	// update the flow state and decide whether the flow is random-looking
+	if !r.classify(packet.FlowHash(), payload) {
+		return nil, false
+	}
+
+	r.Logger.Infof(
+		"netem: dpi: filtering flow %s:%d %s:%d/%s because it looks fully encrypted",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+	)
+	policy := &DPIPolicy{
+		Delay:   r.Delay,
+		Flags:   0,
+		PLR:     r.PLR,
+		Spoofed: nil,
+	}
+	if r.Drop {
+		policy.Delay, policy.Flags, policy.PLR = 0, FrameFlagDrop, 0
+	}
+	return policy, true
+}
+
+// classify returns true when we have seen enough random-looking packets
+// for the given flow and the payload lengths are distributed as configured.
+func (r *DPIFilterRandomTraffic) classify(flowHash uint64, payload []byte) bool {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	// same policy as the DPIEngine for considering flow records stale, which
+	// also allows us to garbage collect the records of old flows
+	const maxSilence = 30 * time.Second
+	if r.flows == nil {
+		r.flows = map[uint64]*dpiRandomFlow{}
+	}
+	now := time.Now()
+	flow := r.flows[flowHash]
+	if flow == nil || now.Sub(flow.updated) > maxSilence {
+		for key, value := range r.flows {
+			if now.Sub(value.updated) > maxSilence {
+				delete(r.flows, key)
+			}
+		}
+		flow = &dpiRandomFlow{}
+		r.flows[flowHash] = flow
+	}
+	flow.updated = now
+	if flow.done {
+		return false
+	}
+
+	if !dpiLooksRandom(payload, r.minEntropy()) {
+		flow.done = true
+		return false
+	}
+	flow.lengths = append(flow.lengths, len(payload))
+	if len(flow.lengths) < r.packets() {
+		return false
+	}
+	flow.done = true
+	return dpiStdDev(flow.lengths) >= r.MinLengthStdDev
+}
+
+// minEntropy returns the configured minimum entropy or the default.
+func (r *DPIFilterRandomTraffic) minEntropy() float64 {
+	if r.MinEntropy > 0 {
+		return r.MinEntropy
+	}
+	return 0.8
+}
+
+// packets returns the configured number of packets or the default.
+func (r *DPIFilterRandomTraffic) packets() int {
+	if r.Packets > 0 {
+		return r.Packets
+	}
+	return 1
+}
+
+// dpiLooksRandom returns whether the payload is random-looking according to
+// the heuristics documented in [DPIFilterRandomTraffic].
+func dpiLooksRandom(payload []byte, minEntropy float64) bool {
+	// exemption: the payload starts like TLS or HTTP
+	if len(payload) >= 3 && payload[0] >= 0x14 && payload[0] <= 0x17 && payload[1] == 0x03 && payload[2] <= 0x04 {
+		return false
+	}
+	for _, method := range []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH "} {
+		if bytes.HasPrefix(payload, []byte(method)) {
+			return false
+		}
+	}
+
+	// exemptions based on printable ASCII characters
+	isPrintable := func(b byte) bool {
+		return b >= 0x20 && b <= 0x7e
+	}
+	if len(payload) >= 6 {
+		prefix := 0
+		for _, b := range payload[:6] {
+			if isPrintable(b) {
+				prefix++
+			}
+		}
+		if prefix == 6 {
+			return false
+		}
+	}
+	var printable, contiguous, popcount int
+	for _, b := range payload {
+		if isPrintable(b) {
+			printable++
+			contiguous++
+			if contiguous > 20 {
+				return false
+			}
+		} else {
+			contiguous = 0
+		}
+		popcount += bits.OnesCount8(b)
+	}
+	if printable*2 > len(payload) {
+		return false
+	}
+
+	// exemption: the average number of bits set per byte is unusual
+	avg := float64(popcount) / float64(len(payload))
+	if avg <= 3.4 || avg >= 4.6 {
+		return false
+	}
+
+	return dpiNormalizedEntropy(payload) >= minEntropy
+}
+
+// dpiNormalizedEntropy returns the Shannon entropy of the payload divided by
+// the maximum entropy achievable given the payload length.
+func dpiNormalizedEntropy(payload []byte) float64 {
+	if len(payload) < 2 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range payload {
+		counts[b]++
+	}
+	var entropy float64
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(payload))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy / math.Log2(float64(min(len(payload), 256)))
+}
+
+// dpiStdDev returns the standard deviation of the given values.
+func dpiStdDev(values []int) float64 {
+	var sum float64
+	for _, value := range values {
+		sum += float64(value)
+	}
+	mean := sum / float64(len(values))
+	var variance float64
+	for _, value := range values {
+		variance += (float64(value) - mean) * (float64(value) - mean)
+	}
+	return math.Sqrt(variance / float64(len(values)))
+}
@@ -0,0 +1,108 @@
+package netem
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDPILooksRandom(t *testing.T) {
+	random := make([]byte, 512)
+	Must1(rand.Read(random))
+
+	type testcase struct {
+		name    string
+		payload []byte
+		expect  bool
+	}
+
+	cases := []testcase{{
+		name:    "random bytes",
+		payload: random,
+		expect:  true,
+	}, {
+		name:    "TLS record",
+		payload: append([]byte{0x16, 0x03, 0x01}, random[3:]...),
+		expect:  false,
+	}, {
+		name:    "HTTP request",
+		payload: append([]byte("GET "), random[4:]...),
+		expect:  false,
+	}, {
+		name:    "printable prefix",
+		payload: append([]byte("SSH-2."), random[6:]...),
+		expect:  false,
+	}, {
+		name:    "mostly printable",
+		payload: []byte(strings.Repeat("a\x00", 200)),
+		expect:  false,
+	}, {
+		name:    "zero bytes",
+		payload: make([]byte, 512),
+		expect:  false,
+	}, {
+		name:    "low entropy with average popcount",
+		payload: []byte(strings.Repeat("\x0f\xf0\x33\xcc", 128)),
+		expect:  false,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := dpiLooksRandom(tc.payload, 0.8); got != tc.expect {
+				t.Fatal("expected", tc.expect, "got", got)
+			}
+		})
+	}
+}
+
+func TestDPIFilterRandomTraffic(t *testing.T) {
+	// create a star topology where 10.0.0.1 runs an obfuscated bridge and a
+	// TLS server and 10.0.0.2 is the client whose link uses the rule
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+	serverLink := &LinkConfig{LeftToRightDelay: 10 * time.Millisecond, RightToLeftDelay: 10 * time.Millisecond}
+	server := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", serverLink))
+	dpi := NewDPIEngine(&NullLogger{})
+	dpi.AddRule(&DPIFilterRandomTraffic{
+		Drop:   true,
+		Logger: &NullLogger{},
+	})
+	client := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{DPIEngine: dpi}))
+
+	config := &ObfsConfig{Secret: []byte("bridge-secret")}
+	topology.TrackServer(Must1(NewObfsBridge(&NullLogger{}, server, "10.0.0.1", &ObfsBridgeConfig{
+		Obfs: config,
+		Port: 9443,
+	})))
+	ns := &Net{Stack: server}
+	tlsConfig := server.MustNewServerTLSConfig("10.0.0.1")
+	listener := Must1(ns.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}))
+	httpServer := &http.Server{Handler: http.NotFoundHandler(), TLSConfig: tlsConfig}
+	topology.TrackServer(httpServer)
+	go httpServer.ServeTLS(listener, "", "")
+
+	t.Run("we drop obfuscated traffic", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		dialer := &ObfsDialer{BridgeAddress: "10.0.0.1:9443", Config: config, Stack: client}
+		conn, err := dialer.DialContext(ctx, "tcp", "10.0.0.1:443")
+		if err == nil || conn != nil {
+			t.Fatal("unexpected result", conn, err)
+		}
+	})
+
+	t.Run("we do not drop TLS traffic", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		ns := &Net{Stack: client}
+		conn, err := ns.DialTLSContext(ctx, "tcp", "10.0.0.1:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+}
@@ -43,7 +43,7 @@ func (r *DPIThrottleTrafficForTLSSNI) Filter(
 	}
 
 	// try to obtain the SNI
-	sni, err := packet.parseTLSServerName()
+	sni, err := packet.TLSServerName()
 	if err != nil {
 		return nil, false
 	}
@@ -0,0 +1,121 @@
+package netem
+
+//
+// Encrypted Client Hello (ECH)
+//
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ErrECHNotSupported indicates that we were compiled using a Go version
+// that does not support ECH (i.e., a version older than Go 1.24).
+var ErrECHNotSupported = errors.New("netem: ECH requires Go >= 1.24")
+
+// ErrNoECHConfigList indicates that a domain does not advertise ECH.
+var ErrNoECHConfigList = errors.New("netem: no ECH config list")
+
+// ErrInvalidECHPublicName indicates that the ECH public name is empty or too long.
+var ErrInvalidECHPublicName = errors.New("netem: invalid ECH public name")
+
+// ECHKey is an ECH key along with the corresponding ECH config. Use [NewECHKey]
+// to create a new key, [ECHConfigList] to publish the config using [DNSConfig.SetECHConfigList],
+// [ConfigureServerECH] to enable ECH on a server, and the ECHConfigList field of
+// [Net] to enable ECH on a client.
+type ECHKey struct {
+	// Config is the serialized ECHConfig.
+	Config []byte
+
+	// PrivateKey is the X25519 private key.
+	PrivateKey []byte
+
+	// PublicName is the name clients send in the outer ClientHello, which
+	// is what the censors observe. Servers should have a certificate valid
+	// for this name, which clients use to authenticate ECH rejections.
+	PublicName string
+}
+
+// The following constants define the only ECH config we generate.
+const (
+	echConfigVersion = 0xfe0d // draft-ietf-tls-esni-18
+	echKEMX25519     = 0x0020 // DHKEM(X25519, HKDF-SHA256)
+	echKDFSHA256     = 0x0001 // HKDF-SHA256
+	echAEADAES128GCM = 0x0001 // AES-128-GCM
+)
+
+// NewECHKey generates a new X25519 [ECHKey] with the given config ID and public name.
+func NewECHKey(configID uint8, publicName string) (*ECHKey, error) {
+	if len(publicName) <= 0 || len(publicName) > 255 {
+		return nil, ErrInvalidECHPublicName
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(echConfigVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(configID)
+		b.AddUint16(echKEMX25519)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(priv.PublicKey().Bytes())
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(echKDFSHA256)
+			b.AddUint16(echAEADAES128GCM)
+		})
+		b.AddUint8(0) // maximum_name_length
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) // no extensions
+	})
+	config, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	key := &ECHKey{
+		Config:     config,
+		PrivateKey: priv.Bytes(),
+		PublicName: publicName,
+	}
+	return key, nil
+}
+
+// ECHConfigList returns the serialized ECHConfigList containing the configs of the given keys.
+func ECHConfigList(keys ...*ECHKey) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, key := range keys {
+			b.AddBytes(key.Config)
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+// LookupECHConfigList sends an HTTPS query for the given domain to the DNS server at the given
+// address and returns the ECH config list contained in the response or [ErrNoECHConfigList].
+func LookupECHConfigList(ctx context.Context, stack UnderlyingNetwork, ipAddress, domain string) ([]byte, error) {
+	resp, err := DNSRoundTrip(ctx, stack, ipAddress, NewDNSRequestHTTPS(domain))
+	if err != nil {
+		return nil, err
+	}
+	for _, answer := range resp.Answer {
+		https, ok := answer.(*dns.HTTPS)
+		if !ok {
+			continue
+		}
+		for _, value := range https.Value {
+			if ech, ok := value.(*dns.SVCBECHConfig); ok && len(ech.ECH) > 0 {
+				return ech.ECH, nil
+			}
+		}
+	}
+	return nil, ErrNoECHConfigList
+}
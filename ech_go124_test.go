@@ -0,0 +1,81 @@
+//go:build go1.24
+
+package netem
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestECHEndToEnd(t *testing.T) {
+	recorder := &sockoptRecorder{}
+	lc := &LinkConfig{LeftNICWrapper: recorder}
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, lc)
+	defer topology.Close()
+
+	// publish the ECH config using DNS
+	key := Must1(NewECHKey(1, "public.example.com"))
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.1"))
+	dnsConfig.SetECHConfigList("www.example.com", ECHConfigList(key))
+	dnsServer := Must1(NewDNSServer(&NullLogger{}, topology.Server, "10.0.0.1", dnsConfig))
+	defer dnsServer.Close()
+
+	// create a server supporting ECH and recording the inner SNI
+	serverConfig := topology.Server.MustNewServerTLSConfig("10.0.0.1", "www.example.com", "public.example.com")
+	Must0(ConfigureServerECH(serverConfig, key))
+	serverNet := &Net{Stack: topology.Server}
+	listener := Must1(serverNet.ListenTLS("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, serverConfig))
+	defer listener.Close()
+	serverNames := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(serverNames)
+			return
+		}
+		defer conn.Close()
+		serverNames <- conn.(*tls.Conn).ConnectionState().ServerName
+		_, _ = conn.Read(make([]byte, 1))
+	}()
+
+	// dial using the ECH config list obtained using DNS
+	ctx := context.Background()
+	list := Must1(LookupECHConfigList(ctx, topology.Client, "10.0.0.1", "www.example.com"))
+	clientNet := &Net{Stack: topology.Client, ECHConfigList: list}
+	conn, err := clientNet.DialTLSContext(ctx, "tcp", "www.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !conn.(*tls.Conn).ConnectionState().ECHAccepted {
+		t.Fatal("the server did not accept ECH")
+	}
+	if name := <-serverNames; name != "www.example.com" {
+		t.Fatal("unexpected inner server name", name)
+	}
+
+	// the network only sees the public name
+	var sawPublicName bool
+	for _, packet := range recorder.find(layers.IPProtocolTCP) {
+		segment := gopacket.NewPacket(packet.Payload, layers.LayerTypeTCP, gopacket.Default)
+		tcp, good := segment.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !good {
+			continue
+		}
+		if bytes.Contains(tcp.Payload, []byte("www.example.com")) {
+			t.Fatal("the inner server name leaked")
+		}
+		sawPublicName = sawPublicName || bytes.Contains(tcp.Payload, []byte("public.example.com"))
+	}
+	if !sawPublicName {
+		t.Fatal("did not see the public name")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !go1.24
+
+package netem
+
+import "crypto/tls"
+
+// ConfigureServerECH enables ECH on the given server config using the given keys, such
+// that the server decrypts the inner ClientHello of the clients using such keys and sends
+// the keys' configs as retry configs to clients using unknown configs. This function
+// fails with [ErrECHNotSupported] when netem was compiled using Go < 1.24.
+func ConfigureServerECH(config *tls.Config, keys ...*ECHKey) error {
+	return ErrECHNotSupported
+}
+
+// netConfigureClientECH enables ECH on the given client config.
+func netConfigureClientECH(config *tls.Config, echConfigList []byte) error {
+	return ErrECHNotSupported
+}
@@ -0,0 +1,81 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+func TestECHKey(t *testing.T) {
+	t.Run("we generate a well formed ECHConfig", func(t *testing.T) {
+		key := Must1(NewECHKey(7, "public.example.com"))
+		if len(key.PrivateKey) != 32 {
+			t.Fatal("unexpected private key length", len(key.PrivateKey))
+		}
+
+		// parse the config list, which should contain a single config
+		cursor := cryptobyte.String(ECHConfigList(key))
+		var configs, contents, publicKey, suites, publicName cryptobyte.String
+		var version, kem uint16
+		var configID, maxNameLength uint8
+		if !cursor.ReadUint16LengthPrefixed(&configs) || !cursor.Empty() ||
+			!configs.ReadUint16(&version) || !configs.ReadUint16LengthPrefixed(&contents) || !configs.Empty() ||
+			!contents.ReadUint8(&configID) || !contents.ReadUint16(&kem) ||
+			!contents.ReadUint16LengthPrefixed(&publicKey) || !contents.ReadUint16LengthPrefixed(&suites) ||
+			!contents.ReadUint8(&maxNameLength) || !contents.ReadUint8LengthPrefixed(&publicName) {
+			t.Fatal("cannot parse the ECHConfigList")
+		}
+		if version != echConfigVersion || configID != 7 || kem != echKEMX25519 || len(publicKey) != 32 {
+			t.Fatal("unexpected config", version, configID, kem, len(publicKey))
+		}
+		if string(publicName) != "public.example.com" {
+			t.Fatal("unexpected public name", string(publicName))
+		}
+	})
+
+	t.Run("we reject invalid public names", func(t *testing.T) {
+		for _, name := range []string{"", strings.Repeat("a", 256)} {
+			if _, err := NewECHKey(0, name); !errors.Is(err, ErrInvalidECHPublicName) {
+				t.Fatal("unexpected error", err)
+			}
+		}
+	})
+}
+
+func TestLookupECHConfigList(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+	key := Must1(NewECHKey(1, "public.example.com"))
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.1"))
+	dnsConfig.SetECHConfigList("www.example.com", ECHConfigList(key))
+	Must0(dnsConfig.AddRecord("plain.example.com", "", "10.0.0.1"))
+	dnsServer := Must1(NewDNSServer(&NullLogger{}, topology.Server, "10.0.0.1", dnsConfig))
+	defer dnsServer.Close()
+
+	t.Run("we obtain the ECH config list of a domain advertising ECH", func(t *testing.T) {
+		list, err := LookupECHConfigList(context.Background(), topology.Client, "10.0.0.1", "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(list) != string(ECHConfigList(key)) {
+			t.Fatal("unexpected ECH config list")
+		}
+
+		// setting the list does not remove the addresses
+		addrs, _, err := topology.Client.GetaddrinfoLookupANY(context.Background(), "www.example.com")
+		if err != nil || len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+			t.Fatal("unexpected lookup result", addrs, err)
+		}
+	})
+
+	t.Run("we fail for domains not advertising ECH", func(t *testing.T) {
+		_, err := LookupECHConfigList(context.Background(), topology.Client, "10.0.0.1", "plain.example.com")
+		if !errors.Is(err, ErrNoECHConfigList) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package netem
+
+//
+// Echo (RFC 862) and discard (RFC 863) servers
+//
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// TCPEchoServer is a TCP echo server (see RFC 862), which sends back the bytes it
+// receives, useful as a universal counterpart for latency, loss, and DPI tests. The
+// zero value is invalid, please construct using [NewTCPEchoServer].
+type TCPEchoServer struct {
+	ss *simpleTCPServer
+}
+
+// NewTCPEchoServer creates a new [TCPEchoServer] listening on the given IP address
+// and TCP port (the standard port is 7). Remember to call [TCPEchoServer.Close] when done.
+func NewTCPEchoServer(logger Logger, stack UnderlyingNetwork, ipAddress string, port int) (*TCPEchoServer, error) {
+	ss, err := newSimpleTCPServer(logger, stack, ipAddress, port, "TCPEchoServer", func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TCPEchoServer{ss}, nil
+}
+
+// Close stops the echo server and closes the conns it is echoing.
+func (es *TCPEchoServer) Close() error {
+	return es.ss.Close()
+}
+
+// TCPDiscardServer is a TCP discard server (see RFC 863), which reads and throws
+// away the bytes it receives, useful as a sink for upload tests. The zero value is
+// invalid, please construct using [NewTCPDiscardServer].
+type TCPDiscardServer struct {
+	ss *simpleTCPServer
+}
+
+// NewTCPDiscardServer creates a new [TCPDiscardServer] listening on the given IP address
+// and TCP port (the standard port is 9). Remember to call [TCPDiscardServer.Close] when done.
+func NewTCPDiscardServer(logger Logger, stack UnderlyingNetwork, ipAddress string, port int) (*TCPDiscardServer, error) {
+	ss, err := newSimpleTCPServer(logger, stack, ipAddress, port, "TCPDiscardServer", func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TCPDiscardServer{ss}, nil
+}
+
+// Close stops the discard server and closes the conns it is draining.
+func (ds *TCPDiscardServer) Close() error {
+	return ds.ss.Close()
+}
+
+// simpleTCPServer is a TCP server running a handler for each connection.
+type simpleTCPServer struct {
+	closed   chan any
+	handler  func(conn net.Conn)
+	listener net.Listener
+	logger   Logger
+	name     string
+	once     sync.Once
+	wg       *sync.WaitGroup
+}
+
+// newSimpleTCPServer creates a new [simpleTCPServer].
+func newSimpleTCPServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	port int,
+	name string,
+	handler func(conn net.Conn),
+) (*simpleTCPServer, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	listener, err := stack.ListenTCP("tcp", &net.TCPAddr{IP: parsedIP, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	ss := &simpleTCPServer{
+		closed:   make(chan any),
+		handler:  handler,
+		listener: listener,
+		logger:   logger,
+		name:     name,
+		once:     sync.Once{},
+		wg:       &sync.WaitGroup{},
+	}
+	ss.wg.Add(1)
+	go ss.acceptor()
+	return ss, nil
+}
+
+// Close closes the listener, interrupts the handlers, and waits for them to return.
+func (ss *simpleTCPServer) Close() error {
+	ss.once.Do(func() {
+		close(ss.closed)
+		ss.listener.Close()
+		ss.wg.Wait()
+	})
+	return nil
+}
+
+// acceptor accepts connections until the server is closed.
+func (ss *simpleTCPServer) acceptor() {
+	defer ss.wg.Done()
+	for {
+		conn, err := ss.listener.Accept()
+		if err != nil {
+			select {
+			case <-ss.closed:
+			default:
+				ss.logger.Warnf("netem: %s: %s", ss.name, err.Error())
+			}
+			return
+		}
+		ss.wg.Add(1)
+		go ss.serve(conn)
+	}
+}
+
+// serve runs the handler and makes sure we close the
+// connection when the server is closed.
+func (ss *simpleTCPServer) serve(conn net.Conn) {
+	defer ss.wg.Done()
+	done := make(chan any)
+	defer close(done)
+	go func() {
+		select {
+		case <-ss.closed:
+		case <-done:
+		}
+		conn.Close()
+	}()
+	ss.handler(conn)
+}
+
+// UDPEchoServer is a UDP echo server (see RFC 862), which sends back each datagram
+// it receives. The zero value is invalid, please construct using [NewUDPEchoServer].
+type UDPEchoServer struct {
+	once  sync.Once
+	pconn UDPLikeConn
+	wg    *sync.WaitGroup
+}
+
+// NewUDPEchoServer creates a new [UDPEchoServer] listening on the given IP address
+// and UDP port (the standard port is 7). Remember to call [UDPEchoServer.Close] when done.
+func NewUDPEchoServer(logger Logger, stack UnderlyingNetwork, ipAddress string, port int) (*UDPEchoServer, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	pconn, err := stack.ListenUDP("udp", &net.UDPAddr{IP: parsedIP, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	es := &UDPEchoServer{
+		once:  sync.Once{},
+		pconn: pconn,
+		wg:    &sync.WaitGroup{},
+	}
+	es.wg.Add(1)
+	go es.serve(logger)
+	return es, nil
+}
+
+// serve echoes datagrams until the server is closed.
+func (es *UDPEchoServer) serve(logger Logger) {
+	defer es.wg.Done()
+	buffer := make([]byte, 1<<16)
+	for {
+		count, addr, err := es.pconn.ReadFrom(buffer)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warnf("netem: UDPEchoServer: %s", err.Error())
+			}
+			return
+		}
+		if _, err := es.pconn.WriteTo(buffer[:count], addr); err != nil {
+			logger.Debugf("netem: UDPEchoServer: %s", err.Error())
+		}
+	}
+}
+
+// Close closes the server.
+func (es *UDPEchoServer) Close() error {
+	es.once.Do(func() {
+		es.pconn.Close()
+		es.wg.Wait()
+	})
+	return nil
+}
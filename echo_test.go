@@ -0,0 +1,88 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEchoServers(t *testing.T) {
+	newTopology := func(t *testing.T) *PPPTopology {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{
+			LeftToRightDelay: 10 * time.Millisecond,
+			RightToLeftDelay: 10 * time.Millisecond,
+		})
+		t.Cleanup(func() { topology.Close() })
+		return topology
+	}
+
+	t.Run("the TCP echo server sends back the data", func(t *testing.T) {
+		topology := newTopology(t)
+		server := Must1(NewTCPEchoServer(&NullLogger{}, topology.Server, "10.0.0.1", 7))
+		defer server.Close()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:7"))
+		defer conn.Close()
+		Must0(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+		Must1(conn.Write([]byte("hello, world")))
+		data := make([]byte, 12)
+		Must1(io.ReadFull(conn, data))
+		if string(data) != "hello, world" {
+			t.Fatal("unexpected data", string(data))
+		}
+
+		// closing the server closes the connection
+		server.Close()
+		if _, err := conn.Read(data); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("the TCP discard server does not send any data", func(t *testing.T) {
+		topology := newTopology(t)
+		server := Must1(NewTCPDiscardServer(&NullLogger{}, topology.Server, "10.0.0.1", 9))
+		defer server.Close()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:9"))
+		defer conn.Close()
+		Must1(conn.Write(make([]byte, 1<<16)))
+		Must0(conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond)))
+		if _, err := conn.Read(make([]byte, 8)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("the UDP echo server sends back each datagram", func(t *testing.T) {
+		topology := newTopology(t)
+		server := Must1(NewUDPEchoServer(&NullLogger{}, topology.Server, "10.0.0.1", 7))
+		defer server.Close()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "udp", "10.0.0.1:7"))
+		defer conn.Close()
+		Must0(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+		for _, message := range []string{"abc", "de"} {
+			Must1(conn.Write([]byte(message)))
+			buffer := make([]byte, 8)
+			count := Must1(conn.Read(buffer))
+			if string(buffer[:count]) != message {
+				t.Fatal("unexpected data", string(buffer[:count]))
+			}
+		}
+	})
+
+	t.Run("we reject invalid IP addresses", func(t *testing.T) {
+		topology := newTopology(t)
+		if _, err := NewTCPEchoServer(&NullLogger{}, topology.Server, "10.0.0", 7); !errors.Is(err, ErrNotIPAddress) {
+			t.Fatal("unexpected error", err)
+		}
+		if _, err := NewTCPDiscardServer(&NullLogger{}, topology.Server, "10.0.0", 9); !errors.Is(err, ErrNotIPAddress) {
+			t.Fatal("unexpected error", err)
+		}
+		if _, err := NewUDPEchoServer(&NullLogger{}, topology.Server, "10.0.0", 7); !errors.Is(err, ErrNotIPAddress) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
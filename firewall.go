@@ -0,0 +1,231 @@
+package netem
+
+//
+// Host firewall
+//
+
+import (
+	"net/netip"
+
+	"github.com/google/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// FirewallAction is the action taken by a matching [FirewallRule].
+type FirewallAction int
+
+const (
+	// FirewallActionAccept accepts the packet.
+	FirewallActionAccept = FirewallAction(iota)
+
+	// FirewallActionDrop silently drops the packet.
+	FirewallActionDrop
+
+	// FirewallActionReject drops the packet and tells the sender, by replying to
+	// TCP segments with a RST segment and to other IPv4 packets with an ICMP Port
+	// Unreachable message. We never reply to RST segments, to ICMP errors, and to
+	// IPv6 packets, which we just drop.
+	FirewallActionReject
+)
+
+// FirewallDirection is the direction of the packets to which a [FirewallRule] applies.
+type FirewallDirection int
+
+const (
+	// FirewallDirectionIngress applies the rule to the packets received by the stack.
+	FirewallDirectionIngress = FirewallDirection(iota)
+
+	// FirewallDirectionEgress applies the rule to the packets sent by the stack.
+	FirewallDirectionEgress
+)
+
+// FirewallRule is a rule of the host firewall of a [UNetStack]. A rule matches a
+// packet when all the configured fields match. The zero value is valid and accepts
+// all the ingress packets.
+type FirewallRule struct {
+	// Action is the OPTIONAL action to take (default: [FirewallActionAccept]).
+	Action FirewallAction
+
+	// Direction is the OPTIONAL direction (default: [FirewallDirectionIngress]).
+	Direction FirewallDirection
+
+	// Port OPTIONALLY restricts the rule to the TCP segments and the UDP datagrams
+	// with the given destination port (i.e., the local port for ingress packets and
+	// the remote port for egress packets).
+	Port uint16
+
+	// Prefix OPTIONALLY restricts the rule to the packets whose remote address (i.e.,
+	// the source for ingress packets and the destination for egress packets) belongs
+	// to the given prefix (e.g., "10.0.0.0/8" or "10.0.0.1/32").
+	Prefix string
+
+	// Protocol OPTIONALLY restricts the rule to the given transport protocol (e.g.,
+	// [layers.IPProtocolTCP]). The zero value matches all the protocols.
+	Protocol layers.IPProtocol
+}
+
+// firewallRule is a [FirewallRule] with a parsed prefix.
+type firewallRule struct {
+	*FirewallRule
+	prefix netip.Prefix
+}
+
+// SetFirewallRules replaces the rules of the host firewall, which allows to model
+// a local firewall distinct from on-path DPI (e.g., a server that silently drops
+// pings or that rejects connections to port 25). We evaluate the rules in order
+// and apply the action of the first matching rule, accepting the packets that do
+// not match any rule. Calling this method without rules disables the firewall.
+//
+// This method returns an error if a prefix is invalid, in which case we leave
+// the rules unchanged.
+func (gs *UNetStack) SetFirewallRules(rules ...*FirewallRule) error {
+	var compiled []*firewallRule
+	for _, rule := range rules {
+		entry := &firewallRule{FirewallRule: rule}
+		if rule.Prefix != "" {
+			prefix, err := netip.ParsePrefix(rule.Prefix)
+			if err != nil {
+				return err
+			}
+			entry.prefix = prefix.Masked()
+		}
+		compiled = append(compiled, entry)
+	}
+	gs.ns.firewallRules.Store(&compiled)
+	return nil
+}
+
+// match returns whether the rule matches the given packet.
+func (r *firewallRule) match(direction FirewallDirection, packet *DissectedPacket) bool {
+	if r.Direction != direction {
+		return false
+	}
+	if r.Protocol != 0 && packet.TransportProtocol() != r.Protocol {
+		return false
+	}
+	if r.Port != 0 && packet.DestinationPort() != r.Port {
+		return false
+	}
+	if r.prefix.IsValid() {
+		remote := packet.SourceIPAddress()
+		if direction == FirewallDirectionEgress {
+			remote = packet.DestinationIPAddress()
+		}
+		addr, err := netip.ParseAddr(remote)
+		if err != nil || !r.prefix.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+	return true
+}
+
+// firewallAccepts applies the firewall rules to the given raw packet flowing in the
+// given direction and returns whether we should accept it. When we reject a packet,
+// we also deliver the reply (i.e., we send it for ingress packets and we inject it
+// into the stack for egress packets, such that the local socket sees an error).
+func (gvs *gvisorStack) firewallAccepts(direction FirewallDirection, rawPacket []byte) bool {
+	rules := gvs.firewallRules.Load()
+	if rules == nil || len(*rules) <= 0 {
+		return true
+	}
+	packet, err := DissectPacket(rawPacket)
+	if err != nil {
+		return true
+	}
+	for _, rule := range *rules {
+		if !rule.match(direction, packet) {
+			continue
+		}
+		switch rule.Action {
+		case FirewallActionDrop:
+			gvs.logger.Debugf(
+				"netem: firewall: dropping %s packet from %s to %s",
+				packet.TransportProtocol(),
+				packet.SourceIPAddress(),
+				packet.DestinationIPAddress(),
+			)
+			return false
+
+		case FirewallActionReject:
+			gvs.logger.Debugf(
+				"netem: firewall: rejecting %s packet from %s to %s",
+				packet.TransportProtocol(),
+				packet.SourceIPAddress(),
+				packet.DestinationIPAddress(),
+			)
+			if reply, err := newFirewallReject(packet, rawPacket); err == nil {
+				if direction == FirewallDirectionIngress {
+					gvs.writeOutbound(reply)
+				} else {
+					gvs.injectInbound(reply)
+				}
+			}
+			return false
+
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+// writeOutbound enqueues the given raw packet as if the stack had sent it.
+func (gvs *gvisorStack) writeOutbound(rawPacket []byte) {
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(rawPacket)})
+	var pkts stack.PacketBufferList
+	pkts.PushBack(pkb)
+	_, _ = gvs.endpoint.WritePackets(pkts)
+	pkb.DecRef() // the endpoint holds its own reference if needed
+}
+
+// injectInbound delivers the given raw packet to the stack.
+func (gvs *gvisorStack) injectInbound(rawPacket []byte) {
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(rawPacket)})
+	switch rawPacket[0] >> 4 {
+	case 4:
+		gvs.endpoint.InjectInbound(header.IPv4ProtocolNumber, pkb)
+	case 6:
+		gvs.endpoint.InjectInbound(header.IPv6ProtocolNumber, pkb)
+	}
+	pkb.DecRef() // the stack holds its own reference if needed
+}
+
+// newFirewallReject constructs the reply to a rejected packet (see [FirewallActionReject]).
+func newFirewallReject(packet *DissectedPacket, rawPacket []byte) ([]byte, error) {
+	ipv4, good := packet.IP.(*layers.IPv4)
+	if !good {
+		return nil, ErrDissectNetwork
+	}
+	switch {
+	case packet.TCP != nil:
+		if packet.TCP.RST {
+			return nil, ErrDissectTransport
+		}
+		// see RFC 793, Sect. 3.4, "Reset Generation"
+		incoming := packet.TCP
+		return reflectDissectedTCPSegmentWithSetter(packet, func(tcp *layers.TCP) {
+			tcp.RST = true
+			if incoming.ACK {
+				tcp.Seq, tcp.Ack = incoming.Ack, 0
+				return
+			}
+			length := uint32(len(incoming.Payload))
+			if incoming.SYN {
+				length++
+			}
+			if incoming.FIN {
+				length++
+			}
+			tcp.Seq, tcp.Ack, tcp.ACK = 0, incoming.Seq+length, true
+		})
+
+	case packet.ICMPv4 != nil && !routerIsICMPv4Query(packet.ICMPv4.TypeCode.Type()):
+		return nil, ErrDissectTransport
+
+	default:
+		typeCode := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)
+		return newICMPv4Error(ipv4.DstIP, ipv4.SrcIP, typeCode, 0, rawPacket)
+	}
+}
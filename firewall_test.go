@@ -0,0 +1,135 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestFirewall(t *testing.T) {
+	// newTopology creates a PPP topology where the server listens on ports 25 and 80.
+	newTopology := func(t *testing.T) *PPPTopology {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		t.Cleanup(func() { topology.Close() })
+		for _, port := range []int{25, 80} {
+			listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}))
+			t.Cleanup(func() { listener.Close() })
+		}
+		return topology
+	}
+
+	// dial connects to the given endpoint using the client stack.
+	dial := func(topology *PPPTopology, endpoint string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conn, err := topology.Client.DialContext(ctx, "tcp", endpoint)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+
+	t.Run("the server rejects connections to a given port", func(t *testing.T) {
+		topology := newTopology(t)
+		Must0(topology.Server.SetFirewallRules(&FirewallRule{
+			Action:   FirewallActionReject,
+			Port:     25,
+			Protocol: layers.IPProtocolTCP,
+		}))
+		if err := dial(topology, "10.0.0.1:25"); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatal("unexpected error", err)
+		}
+		if err := dial(topology, "10.0.0.1:80"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("the server silently drops pings", func(t *testing.T) {
+		topology := newTopology(t)
+		Must0(topology.Server.SetFirewallRules(&FirewallRule{
+			Action:   FirewallActionDrop,
+			Protocol: layers.IPProtocolICMPv4,
+		}))
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		if _, err := Ping(ctx, topology.Client, "10.0.0.1", 1, 0); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("unexpected error", err)
+		}
+		if err := dial(topology, "10.0.0.1:80"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("the client drops the egress traffic to a given prefix", func(t *testing.T) {
+		topology := newTopology(t)
+		Must0(topology.Client.SetFirewallRules(&FirewallRule{
+			Action:    FirewallActionDrop,
+			Direction: FirewallDirectionEgress,
+			Prefix:    "10.0.0.0/24",
+		}))
+		if err := dial(topology, "10.0.0.1:80"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("unexpected error", err)
+		}
+		Must0(topology.Client.SetFirewallRules())
+		if err := dial(topology, "10.0.0.1:80"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("the client rejects the egress UDP traffic", func(t *testing.T) {
+		topology := newTopology(t)
+		Must0(topology.Client.SetFirewallRules(&FirewallRule{
+			Action:    FirewallActionAccept,
+			Direction: FirewallDirectionEgress,
+			Port:      443,
+		}, &FirewallRule{
+			Action:    FirewallActionReject,
+			Direction: FirewallDirectionEgress,
+			Protocol:  layers.IPProtocolUDP,
+		}))
+		conn := Must1(topology.Client.DialContext(context.Background(), "udp", "10.0.0.1:53"))
+		defer conn.Close()
+		Must0(conn.SetDeadline(time.Now().Add(time.Second)))
+		Must1(conn.Write([]byte("abc")))
+		if _, err := conn.Read(make([]byte, 8)); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we reject invalid prefixes", func(t *testing.T) {
+		topology := newTopology(t)
+		if err := topology.Client.SetFirewallRules(&FirewallRule{Prefix: "10.0.0.1"}); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestNewFirewallReject(t *testing.T) {
+	t.Run("we do not reply to RST segments", func(t *testing.T) {
+		packet := &DissectedPacket{IP: &layers.IPv4{}, TCP: &layers.TCP{RST: true}}
+		if _, err := newFirewallReject(packet, nil); !errors.Is(err, ErrDissectTransport) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we do not reply to ICMP errors", func(t *testing.T) {
+		typeCode := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded)
+		packet := &DissectedPacket{IP: &layers.IPv4{}, ICMPv4: &layers.ICMPv4{TypeCode: typeCode}}
+		if _, err := newFirewallReject(packet, nil); !errors.Is(err, ErrDissectTransport) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we do not reply to IPv6 packets", func(t *testing.T) {
+		packet := &DissectedPacket{IP: &layers.IPv6{}, UDP: &layers.UDP{}}
+		if _, err := newFirewallReject(packet, nil); !errors.Is(err, ErrDissectNetwork) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package netem
+
+//
+// Frame allocator
+//
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// FrameBuffer is a reference-counted payload buffer owned by the frame
+// allocator. This type is opaque; see [Frame.Retain] and [Frame.Release].
+type FrameBuffer struct {
+	// data is the underlying buffer.
+	data []byte
+
+	// fresh indicates that we have just allocated this buffer.
+	fresh bool
+
+	// pool is the pool to which data belongs.
+	pool *sync.Pool
+
+	// refs is the reference count.
+	refs atomic.Int32
+}
+
+// frameAllocatorSizeClasses contains the capacity of the buffers in each
+// pool. We serve larger payloads by allocating directly from the heap.
+var frameAllocatorSizeClasses = []int{1 << 11, 1 << 14, 1 << 16}
+
+// frameAllocator is the central allocator of pooled frame payloads.
+var frameAllocator = newFrameAllocatorPools()
+
+// frameAllocatorCounters contains the frame allocator statistics.
+var frameAllocatorCounters struct {
+	allocations atomic.Uint64
+	reuses      atomic.Uint64
+	releases    atomic.Uint64
+	inUse       atomic.Int64
+}
+
+// newFrameAllocatorPools creates a pool for each size class.
+func newFrameAllocatorPools() (pools []*sync.Pool) {
+	for _, size := range frameAllocatorSizeClasses {
+		size := size
+		pool := &sync.Pool{}
+		pool.New = func() any {
+			frameAllocatorCounters.allocations.Add(1)
+			return &FrameBuffer{data: make([]byte, size), fresh: true, pool: pool}
+		}
+		pools = append(pools, pool)
+	}
+	return
+}
+
+// newPooledFrame creates a new [Frame] whose payload has the given size and comes
+// from the frame allocator. The returned frame has a reference count of one and the
+// component that finally consumes the frame should call [Frame.Release].
+func newPooledFrame(size int) *Frame {
+	for idx, capacity := range frameAllocatorSizeClasses {
+		if size <= capacity {
+			fb := frameAllocator[idx].Get().(*FrameBuffer)
+			if !fb.fresh {
+				frameAllocatorCounters.reuses.Add(1)
+			}
+			fb.fresh = false
+			frameAllocatorCounters.inUse.Add(1)
+			fb.refs.Store(1)
+			frame := NewFrame(fb.data[:size])
+			frame.Buffer = fb
+			return frame
+		}
+	}
+	return NewFrame(make([]byte, size))
+}
+
+// Retain increments the reference count of the frame payload. Frames emitted by
+// the [NIC]s of this package may use pooled payloads, which we recycle once the
+// frame reaches its destination. If you need to keep using the payload after passing
+// the frame to a [NIC] (e.g., to process it in a background goroutine), call this
+// method first and then call [Frame.Release] when done. For frames constructed
+// using [NewFrame], both Retain and Release are no-ops.
+func (f *Frame) Retain() {
+	if f.Buffer != nil {
+		f.Buffer.refs.Add(1)
+	}
+}
+
+// Release decrements the reference count of the frame payload and recycles the
+// payload when the count reaches zero, after which you MUST NOT use the payload
+// anymore. The [NIC]s of this package release the frames they consume, so you only
+// need to call this method to balance a previous call to [Frame.Retain] or when
+// you write a [NIC] that consumes frames (e.g., a NIC that drops frames).
+func (f *Frame) Release() {
+	if f.Buffer == nil {
+		return
+	}
+	switch refs := f.Buffer.refs.Add(-1); {
+	case refs == 0:
+		frameAllocatorCounters.releases.Add(1)
+		frameAllocatorCounters.inUse.Add(-1)
+		f.Buffer.pool.Put(f.Buffer)
+	case refs < 0:
+		panic("netem: Frame.Release called too many times")
+	}
+}
+
+// FrameAllocatorStats contains statistics about the allocator of the pooled
+// frame payloads, which allow you to check whether we are recycling frames.
+type FrameAllocatorStats struct {
+	// Allocations is the number of payloads we allocated from the heap.
+	Allocations uint64
+
+	// Reuses is the number of payloads we reused from the pool.
+	Reuses uint64
+
+	// Releases is the number of payloads returned to the pool.
+	Releases uint64
+
+	// InUse is the number of pooled payloads currently in use. Payloads
+	// that are never released do not go back to the pool, so this field
+	// also accounts for dropped frames that we did not release.
+	InUse int64
+}
+
+// ReadFrameAllocatorStats returns a snapshot of the frame allocator statistics.
+func ReadFrameAllocatorStats() *FrameAllocatorStats {
+	return &FrameAllocatorStats{
+		Allocations: frameAllocatorCounters.allocations.Load(),
+		Reuses:      frameAllocatorCounters.reuses.Load(),
+		Releases:    frameAllocatorCounters.releases.Load(),
+		InUse:       frameAllocatorCounters.inUse.Load(),
+	}
+}
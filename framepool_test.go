@@ -0,0 +1,99 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestFrameAllocator(t *testing.T) {
+	t.Run("we recycle pooled frames when the last reference goes away", func(t *testing.T) {
+		before := ReadFrameAllocatorStats()
+		frame := newPooledFrame(1500)
+		if len(frame.Payload) != 1500 {
+			t.Fatal("unexpected payload length", len(frame.Payload))
+		}
+		frame.Retain()
+		frame.Release()
+		if stats := ReadFrameAllocatorStats(); stats.Releases != before.Releases {
+			t.Fatal("released the frame too early")
+		}
+		frame.ShallowCopy().Release()
+		if stats := ReadFrameAllocatorStats(); stats.Releases != before.Releases+1 {
+			t.Fatal("did not release the frame")
+		}
+	})
+
+	t.Run("the middlebox NICs release the frames written after close", func(t *testing.T) {
+		mb := Must1(NewMiddlebox(&NullLogger{}, MustNewCA(), &MiddleboxConfig{}))
+		mb.Close()
+		before := ReadFrameAllocatorStats()
+		if err := mb.ClientSideNIC().WriteFrame(newPooledFrame(1500)); !errors.Is(err, ErrStackClosed) {
+			t.Fatal("unexpected error", err)
+		}
+		if stats := ReadFrameAllocatorStats(); stats.Releases != before.Releases+1 {
+			t.Fatal("did not release the frame")
+		}
+	})
+
+	t.Run("we panic when releasing too many times", func(t *testing.T) {
+		frame := newPooledFrame(1500)
+		frame.Release()
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected a panic")
+			}
+		}()
+		frame.Release()
+	})
+
+	t.Run("Retain and Release are no-ops for unpooled frames", func(t *testing.T) {
+		before := ReadFrameAllocatorStats()
+		frame := NewFrame([]byte("abc"))
+		frame.Retain()
+		frame.Release()
+		frame.Release()
+		if stats := ReadFrameAllocatorStats(); stats.Releases != before.Releases {
+			t.Fatal("unexpected release")
+		}
+	})
+
+	t.Run("we do not pool very large payloads", func(t *testing.T) {
+		frame := newPooledFrame(1 << 17)
+		if frame.Buffer != nil || len(frame.Payload) != 1<<17 {
+			t.Fatal("unexpected frame")
+		}
+	})
+
+	t.Run("we reuse frames when transferring data", func(t *testing.T) {
+		before := ReadFrameAllocatorStats()
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+
+		const size = 1 << 20
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(make([]byte, size))
+			conn.Close()
+		}()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		defer conn.Close()
+		if count := Must1(io.Copy(io.Discard, conn)); count != size {
+			t.Fatal("unexpected count", count)
+		}
+
+		after := ReadFrameAllocatorStats()
+		allocations, reuses := after.Allocations-before.Allocations, after.Reuses-before.Reuses
+		if reuses <= allocations {
+			t.Fatalf("expected more reuses than allocations %+v %+v", before, after)
+		}
+	})
+}
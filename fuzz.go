@@ -0,0 +1,230 @@
+package netem
+
+//
+// Fuzzing entry points
+//
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The DPI engine and the parsers it uses process bytes chosen by the emulated
+// hosts, hence they MUST NOT panic regardless of their input. The following
+// functions allow downstream users and OSS-Fuzz to fuzz them using go-fuzz like
+// harnesses: each of them returns 1 when the parser accepts the input, which
+// hints the fuzzer to prioritize it, and 0 otherwise. Use [FuzzSeedPackets]
+// and [FuzzSeedPayloads] to seed the corpus.
+
+// FuzzDissectPacket fuzzes [DissectPacket] and the [DissectedPacket] methods
+// parsing the application layer using the given raw IP packet.
+func FuzzDissectPacket(data []byte) int {
+	packet, err := DissectPacket(data)
+	if err != nil {
+		return 0
+	}
+	_ = packet.SourceIPAddress()
+	_ = packet.SourcePort()
+	_ = packet.DestinationIPAddress()
+	_ = packet.DestinationPort()
+	_ = packet.TimeToLive()
+	_ = packet.FlowHash()
+	_, _ = packet.TLSServerName()
+	if initial, err := packet.QUICInitial(); err == nil {
+		_, _ = initial.ServerName()
+	}
+	_, _ = packet.DNSMessage()
+	_, _ = packet.ForwardedCopy(data)
+	return 1
+}
+
+// FuzzTLSServerName fuzzes [ExtractTLSServerName] using the given TCP payload.
+func FuzzTLSServerName(data []byte) int {
+	if _, err := ExtractTLSServerName(data); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzQUICServerName fuzzes [ExtractQUICServerName] using the given UDP payload.
+func FuzzQUICServerName(data []byte) int {
+	if _, err := ExtractQUICServerName(data); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzDPIEngine fuzzes a [DPIEngine] using all the built-in [DPIRule]s with the given
+// raw IP packet, which the engine inspects as the first packet of its flow.
+func FuzzDPIEngine(data []byte) int {
+	const domain, address = "www.example.com", "10.0.0.1"
+	logger := &NullLogger{}
+	engine := NewDPIEngine(logger)
+	for _, proto := range []layers.IPProtocol{layers.IPProtocolTCP, layers.IPProtocolUDP} {
+		engine.AddRule(&DPIDropTrafficForServerEndpoint{
+			Logger: logger, ServerIPAddress: address, ServerPort: 1, ServerProtocol: proto})
+	}
+	engine.AddRule(&DPICloseConnectionForServerEndpoint{Logger: logger, ServerIPAddress: address, ServerPort: 2})
+	engine.AddRule(&DPIThrottleTrafficForTCPEndpoint{Logger: logger, ServerIPAddress: address, ServerPort: 3})
+	engine.AddRule(&DPIDropTrafficForTLSSNI{Logger: logger, SNI: "drop.example.com"})
+	engine.AddRule(&DPIThrottleTrafficForTLSSNI{Logger: logger, SNI: "throttle.example.com"})
+	engine.AddRule(&DPICloseConnectionForTLSSNI{Logger: logger, SNI: "close.example.com"})
+	engine.AddRule(&DPIResetTrafficForTLSSNI{Logger: logger, SNI: domain})
+	engine.AddRule(&DPISpoofDNSResponse{Addresses: []string{address}, Logger: logger, Domain: domain})
+	engine.AddRule(&DPIDropTrafficForString{Logger: logger, ServerIPAddress: address, ServerPort: 80, String: "drop"})
+	engine.AddRule(&DPIResetTrafficForString{Logger: logger, ServerIPAddress: address, ServerPort: 80, String: "reset"})
+	engine.AddRule(&DPICloseConnectionForString{Logger: logger, ServerIPAddress: address, ServerPort: 80, String: "close"})
+	engine.AddRule(&DPISpoofBlockpageForString{
+		HTTPResponse: []byte("HTTP/1.1 403 Forbidden\r\n\r\n"), Logger: logger,
+		ServerIPAddress: address, ServerPort: 80, String: domain})
+	engine.AddRule(&DPIDropICMPFragmentationNeeded{Logger: logger})
+	engine.AddRule(&DPIFilterRandomTraffic{Drop: true, Logger: logger})
+	if _, match := engine.inspect(data); !match {
+		return 0
+	}
+	return 1
+}
+
+// FuzzSeedPackets returns raw IP packets suitable to seed the corpus of
+// [FuzzDissectPacket] and [FuzzDPIEngine], including TCP segments carrying a
+// TLS ClientHello and an HTTP request, a UDP datagram carrying a QUIC Initial
+// packet, a UDP datagram carrying a DNS query, and an ICMP echo request.
+func FuzzSeedPackets() [][]byte {
+	clientHello, quicInitial, dnsQuery := fuzzSeedClientHello(), fuzzSeedQUICInitial(), fuzzSeedDNSQuery()
+	src, dst := net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1)
+	src6, dst6 := net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::1")
+	newTCP := func(port uint16) *layers.TCP {
+		return &layers.TCP{SrcPort: 54321, DstPort: layers.TCPPort(port), Seq: 1, Ack: 1, ACK: true, PSH: true, Window: 65535}
+	}
+	newUDP := func(port uint16) *layers.UDP {
+		return &layers.UDP{SrcPort: 54321, DstPort: layers.UDPPort(port)}
+	}
+	return [][]byte{
+		fuzzSerializeIPv4(src, dst, newTCP(443), clientHello),
+		fuzzSerializeIPv4(src, dst, newTCP(80), []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")),
+		fuzzSerializeIPv4(src, dst, newUDP(443), quicInitial),
+		fuzzSerializeIPv4(src, dst, newUDP(53), dnsQuery),
+		fuzzSerializeIPv6(src6, dst6, newTCP(443), clientHello),
+		fuzzSerializeIPv4(src, dst, &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: 1}, nil),
+	}
+}
+
+// FuzzSeedPayloads returns transport payloads suitable to seed the corpus of
+// [FuzzTLSServerName] and [FuzzQUICServerName], i.e., a TLS record containing
+// a ClientHello, a QUIC Initial packet, and a DNS query.
+func FuzzSeedPayloads() [][]byte {
+	return [][]byte{fuzzSeedClientHello(), fuzzSeedQUICInitial(), fuzzSeedDNSQuery()}
+}
+
+// fuzzSeedClientHello returns a TLS record containing a ClientHello for www.example.com.
+func fuzzSeedClientHello() []byte {
+	conn := &fuzzCaptureConn{}
+	_ = tls.Client(conn, &tls.Config{ServerName: "www.example.com"}).Handshake()
+	return conn.data
+}
+
+// fuzzSeedQUICInitial returns a QUIC Initial packet carrying a ClientHello for www.example.com.
+func fuzzSeedQUICInitial() []byte {
+	clientHello := fuzzSeedClientHello()
+	dcid := []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+	return quicSealInitialPacket(dcid, nil, 0, clientHello[5:]) // skip the TLS record header
+}
+
+// fuzzSeedDNSQuery returns a DNS query for www.example.com.
+func fuzzSeedDNSQuery() []byte {
+	return Must1(NewDNSRequestA("www.example.com").Pack())
+}
+
+// fuzzSerializeIPv4 serializes an IPv4 packet using the given transport layer and payload.
+func fuzzSerializeIPv4(src, dst net.IP, transport gopacket.SerializableLayer, payload []byte) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: src, DstIP: dst}
+	return fuzzSerialize(ip, transport, payload)
+}
+
+// fuzzSerializeIPv6 serializes an IPv6 packet using the given transport layer and payload.
+func fuzzSerializeIPv6(src, dst net.IP, transport gopacket.SerializableLayer, payload []byte) []byte {
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, SrcIP: src, DstIP: dst}
+	return fuzzSerialize(ip, transport, payload)
+}
+
+// fuzzSerialize serializes the given layers and payload.
+func fuzzSerialize(ip gopacket.NetworkLayer, transport gopacket.SerializableLayer, payload []byte) []byte {
+	var proto layers.IPProtocol
+	switch v := transport.(type) {
+	case *layers.TCP:
+		Must0(v.SetNetworkLayerForChecksum(ip))
+		proto = layers.IPProtocolTCP
+	case *layers.UDP:
+		Must0(v.SetNetworkLayerForChecksum(ip))
+		proto = layers.IPProtocolUDP
+	case *layers.ICMPv4:
+		proto = layers.IPProtocolICMPv4
+	}
+	switch v := ip.(type) {
+	case *layers.IPv4:
+		v.Protocol = proto
+	case *layers.IPv6:
+		v.NextHeader = proto
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	Must0(gopacket.SerializeLayers(buffer, options,
+		ip.(gopacket.SerializableLayer), transport, gopacket.Payload(payload)))
+	return buffer.Bytes()
+}
+
+// fuzzCaptureConn is a [net.Conn] capturing the first write and failing reads.
+type fuzzCaptureConn struct {
+	data []byte
+}
+
+var _ net.Conn = &fuzzCaptureConn{}
+
+// Read implements net.Conn
+func (c *fuzzCaptureConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Write implements net.Conn
+func (c *fuzzCaptureConn) Write(b []byte) (int, error) {
+	if c.data == nil {
+		c.data = append([]byte{}, b...)
+	}
+	return len(b), nil
+}
+
+// Close implements net.Conn
+func (c *fuzzCaptureConn) Close() error {
+	return nil
+}
+
+// LocalAddr implements net.Conn
+func (c *fuzzCaptureConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// RemoteAddr implements net.Conn
+func (c *fuzzCaptureConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// SetDeadline implements net.Conn
+func (c *fuzzCaptureConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline implements net.Conn
+func (c *fuzzCaptureConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn
+func (c *fuzzCaptureConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,66 @@
+package netem
+
+import "testing"
+
+func TestFuzzSeeds(t *testing.T) {
+	t.Run("the dissector accepts all the seed packets", func(t *testing.T) {
+		for idx, seed := range FuzzSeedPackets() {
+			if FuzzDissectPacket(seed) != 1 {
+				t.Fatal("cannot dissect seed packet", idx)
+			}
+		}
+	})
+
+	t.Run("the parsers accept the seed payloads", func(t *testing.T) {
+		payloads := FuzzSeedPayloads()
+		if FuzzTLSServerName(payloads[0]) != 1 {
+			t.Fatal("cannot parse the ClientHello")
+		}
+		sni, err := ExtractQUICServerName(payloads[1])
+		if err != nil || sni != "www.example.com" {
+			t.Fatal("cannot parse the QUIC Initial", sni, err)
+		}
+	})
+
+	t.Run("the DPI engine matches the ClientHello seed packet", func(t *testing.T) {
+		if FuzzDPIEngine(FuzzSeedPackets()[0]) != 1 {
+			t.Fatal("expected the DPI engine to match")
+		}
+	})
+}
+
+func FuzzDissector(f *testing.F) {
+	for _, seed := range FuzzSeedPackets() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzDissectPacket(data)
+	})
+}
+
+func FuzzDPI(f *testing.F) {
+	for _, seed := range FuzzSeedPackets() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzDPIEngine(data)
+	})
+}
+
+func FuzzTLSParser(f *testing.F) {
+	for _, seed := range FuzzSeedPayloads() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzTLSServerName(data)
+	})
+}
+
+func FuzzQUICParser(f *testing.F) {
+	for _, seed := range FuzzSeedPayloads() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzQUICServerName(data)
+	})
+}
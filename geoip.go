@@ -0,0 +1,322 @@
+package netem
+
+//
+// GeoIP and whois emulation
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GeoIPRecord contains the information about a network prefix.
+type GeoIPRecord struct {
+	// ASN is the autonomous system number (e.g., 15169).
+	ASN int64
+
+	// CountryCode is the two-letter country code (e.g., "US").
+	CountryCode string
+
+	// NetworkName is the AS name (e.g., "GOOGLE, US").
+	NetworkName string
+}
+
+// GeoIPDatabase maps network prefixes to [GeoIPRecord]s. The zero value is
+// invalid, please construct using [NewGeoIPDatabase].
+type GeoIPDatabase struct {
+	entries []*geoIPEntry
+	mu      sync.Mutex
+}
+
+// geoIPEntry is an entry inside [GeoIPDatabase].
+type geoIPEntry struct {
+	prefix netip.Prefix
+	record *GeoIPRecord
+}
+
+// NewGeoIPDatabase creates an empty [GeoIPDatabase].
+func NewGeoIPDatabase() *GeoIPDatabase {
+	return &GeoIPDatabase{}
+}
+
+// AddPrefix adds the record for the given prefix (e.g., "10.0.0.0/8"). When
+// prefixes overlap, [GeoIPDatabase.Lookup] uses the longest match.
+func (db *GeoIPDatabase) AddPrefix(prefix string, record *GeoIPRecord) error {
+	parsed, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+	db.mu.Lock()
+	db.entries = append(db.entries, &geoIPEntry{prefix: parsed.Masked(), record: record})
+	return nil
+}
+
+// Lookup returns the record for the given IP address and whether we found it.
+func (db *GeoIPDatabase) Lookup(ipAddress string) (*GeoIPRecord, bool) {
+	entry := db.lookup(ipAddress)
+	if entry == nil {
+		return nil, false
+	}
+	return entry.record, true
+}
+
+// lookup returns the longest matching entry or nil.
+func (db *GeoIPDatabase) lookup(ipAddress string) *geoIPEntry {
+	addr, err := netip.ParseAddr(ipAddress)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	defer db.mu.Unlock()
+	db.mu.Lock()
+	var best *geoIPEntry
+	for _, entry := range db.entries {
+		if entry.prefix.Contains(addr) && (best == nil || entry.prefix.Bits() > best.prefix.Bits()) {
+			best = entry
+		}
+	}
+	return best
+}
+
+// GeoIPResponse is the JSON returned by the [NewGeoIPHandler] handler.
+type GeoIPResponse struct {
+	ASN         int64  `json:"asn"`
+	CountryCode string `json:"country_code"`
+	IP          string `json:"ip"`
+	NetworkName string `json:"network_name"`
+}
+
+// NewGeoIPHandler returns an [http.Handler] serving the information about the
+// client's IP address or about the address in the "ip" query parameter. We emulate
+// the formats of the services commonly used by probes:
+//
+// - "/cdn-cgi/trace" returns "key=value" lines including "ip" and "loc";
+//
+// - "/lookup" returns XML like the Ubuntu GeoIP service;
+//
+// - any other path returns a JSON [GeoIPResponse].
+//
+// For addresses not in the database, we return the "ZZ" country code and zero ASN.
+func NewGeoIPHandler(db *GeoIPDatabase) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ipAddress := r.URL.Query().Get("ip")
+		if ipAddress == "" {
+			ipAddress, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+		resp := &GeoIPResponse{CountryCode: "ZZ", IP: ipAddress}
+		if record, found := db.Lookup(ipAddress); found {
+			resp.ASN = record.ASN
+			resp.CountryCode = record.CountryCode
+			resp.NetworkName = record.NetworkName
+		}
+
+		switch r.URL.Path {
+		case "/cdn-cgi/trace":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "ip=%s\nloc=%s\n", resp.IP, resp.CountryCode)
+
+		case "/lookup":
+			w.Header().Set("Content-Type", "text/xml")
+			data := Must1(xml.Marshal(&struct {
+				XMLName     xml.Name `xml:"Response"`
+				IP          string   `xml:"Ip"`
+				Status      string   `xml:"Status"`
+				CountryCode string   `xml:"CountryCode"`
+			}{IP: resp.IP, Status: "OK", CountryCode: resp.CountryCode}))
+			w.Write(data)
+
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		}
+	})
+}
+
+// GeoIPServerConfig contains the [GeoIPServer] configuration.
+type GeoIPServerConfig struct {
+	// Database is the MANDATORY [GeoIPDatabase].
+	Database *GeoIPDatabase
+
+	// HTTPPort is the OPTIONAL TCP port for HTTP (default: 80).
+	HTTPPort int
+
+	// HTTPSPort is the OPTIONAL TCP port for HTTPS (default: 443).
+	HTTPSPort int
+
+	// ServerNames contains the OPTIONAL names for which the server presents
+	// a certificate in addition to its IP address (e.g., "ipinfo.io").
+	ServerNames []string
+
+	// WhoisPort is the OPTIONAL TCP port for whois (default: 43).
+	WhoisPort int
+}
+
+// ErrGeoIPNoDatabase indicates that the [GeoIPServerConfig] lacks a database.
+var ErrGeoIPNoDatabase = errors.New("netem: GeoIPServer: no database")
+
+// GeoIPServer serves the [NewGeoIPHandler] API over HTTP and HTTPS and
+// answers Team Cymru-like whois queries. The zero value is invalid, please
+// construct using [NewGeoIPServer].
+type GeoIPServer struct {
+	closed   chan any
+	listener net.Listener
+	once     sync.Once
+	servers  []*http.Server
+	wg       *sync.WaitGroup
+}
+
+// NewGeoIPServer creates a new [GeoIPServer] listening on the given IP address.
+// Remember to call [GeoIPServer.Close] when done.
+//
+// The whois server reads one query per line, where each query is an IP address
+// optionally preceded by flags (e.g., " -v 8.8.8.8"), and responds like Team
+// Cymru's whois.cymru.com with a header followed by one line per query:
+//
+//	AS      | IP               | BGP Prefix          | CC | AS Name
+//	15169   | 8.8.8.8          | 8.8.8.0/24          | US | GOOGLE, US
+//
+// The server closes the connection after answering the first line, unless
+// such a line is "begin", in which case it answers the lines until "end".
+func NewGeoIPServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *GeoIPServerConfig,
+) (*GeoIPServer, error) {
+	if config.Database == nil {
+		return nil, ErrGeoIPNoDatabase
+	}
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	httpPort := config.HTTPPort
+	if httpPort <= 0 {
+		httpPort = 80
+	}
+	httpsPort := config.HTTPSPort
+	if httpsPort <= 0 {
+		httpsPort = 443
+	}
+	whoisPort := config.WhoisPort
+	if whoisPort <= 0 {
+		whoisPort = 43
+	}
+
+	ns := &Net{Stack: stack}
+	httpListener, err := ns.ListenTCP("tcp", &net.TCPAddr{IP: parsedIP, Port: httpPort})
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := stack.MustNewServerTLSConfig(ipAddress, config.ServerNames...)
+	httpsListener, err := ns.ListenTLS("tcp", &net.TCPAddr{IP: parsedIP, Port: httpsPort}, tlsConfig)
+	if err != nil {
+		httpListener.Close()
+		return nil, err
+	}
+	whoisListener, err := ns.ListenTCP("tcp", &net.TCPAddr{IP: parsedIP, Port: whoisPort})
+	if err != nil {
+		httpListener.Close()
+		httpsListener.Close()
+		return nil, err
+	}
+
+	gs := &GeoIPServer{
+		closed:   make(chan any),
+		listener: whoisListener,
+		once:     sync.Once{},
+		servers:  []*http.Server{},
+		wg:       &sync.WaitGroup{},
+	}
+	handler := NewGeoIPHandler(config.Database)
+	for _, listener := range []net.Listener{httpListener, httpsListener} {
+		server := &http.Server{Handler: handler}
+		gs.servers = append(gs.servers, server)
+		go func(listener net.Listener) {
+			err := server.Serve(listener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				logger.Warnf("netem: GeoIPServer: %s", err.Error())
+			}
+		}(listener)
+	}
+	gs.wg.Add(1)
+	go gs.whoisAcceptor(logger, config.Database)
+	return gs, nil
+}
+
+// Close closes the server.
+func (gs *GeoIPServer) Close() error {
+	gs.once.Do(func() {
+		close(gs.closed)
+		for _, server := range gs.servers {
+			server.Close()
+		}
+		gs.listener.Close()
+		gs.wg.Wait()
+	})
+	return nil
+}
+
+// whoisAcceptor accepts whois connections.
+func (gs *GeoIPServer) whoisAcceptor(logger Logger, db *GeoIPDatabase) {
+	defer gs.wg.Done()
+	for {
+		conn, err := gs.listener.Accept()
+		if err != nil {
+			select {
+			case <-gs.closed:
+			default:
+				logger.Warnf("netem: GeoIPServer: %s", err.Error())
+			}
+			return
+		}
+		gs.wg.Add(1)
+		go gs.whoisServe(conn, db)
+	}
+}
+
+// whoisServe serves a whois connection.
+func (gs *GeoIPServer) whoisServe(conn net.Conn, db *GeoIPDatabase) {
+	defer gs.wg.Done()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	writer := bufio.NewWriter(conn)
+	defer writer.Flush()
+	fmt.Fprintf(writer, "%-7s | %-16s | %-19s | CC | AS Name\n", "AS", "IP", "BGP Prefix")
+	bulk := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "begin":
+			bulk = true
+			continue
+		case line == "end":
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			ipAddress := fields[len(fields)-1]
+			entry := db.lookup(ipAddress)
+			if entry != nil {
+				fmt.Fprintf(writer, "%-7d | %-16s | %-19s | %-2s | %s\n", entry.record.ASN, ipAddress,
+					entry.prefix.String(), entry.record.CountryCode, entry.record.NetworkName)
+			} else {
+				fmt.Fprintf(writer, "%-7s | %-16s | %-19s | %-2s | %s\n", "NA", ipAddress, "NA", "", "NA")
+			}
+		}
+		if !bulk {
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package netem
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGeoIPServer(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	db := NewGeoIPDatabase()
+	Must0(db.AddPrefix("10.0.0.0/8", &GeoIPRecord{ASN: 64496, CountryCode: "IT", NetworkName: "EXAMPLE-ISP, IT"}))
+	Must0(db.AddPrefix("10.0.0.0/24", &GeoIPRecord{ASN: 64497, CountryCode: "DE", NetworkName: "EXAMPLE-LAN, DE"}))
+	server := Must1(NewGeoIPServer(&NullLogger{}, topology.Server, "10.0.0.1", &GeoIPServerConfig{Database: db}))
+	defer server.Close()
+
+	httpClient := NewHTTPClient(topology.Client)
+	get := func(t *testing.T, URL string) string {
+		resp, err := httpClient.Get(URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return string(Must1(io.ReadAll(resp.Body)))
+	}
+
+	t.Run("the JSON API uses the longest prefix match", func(t *testing.T) {
+		var resp GeoIPResponse
+		Must0(json.Unmarshal([]byte(get(t, "https://10.0.0.1/json")), &resp))
+		expect := GeoIPResponse{ASN: 64497, CountryCode: "DE", IP: "10.0.0.2", NetworkName: "EXAMPLE-LAN, DE"}
+		if resp != expect {
+			t.Fatal("unexpected response", resp)
+		}
+		Must0(json.Unmarshal([]byte(get(t, "http://10.0.0.1/?ip=10.1.2.3")), &resp))
+		if resp.ASN != 64496 || resp.CountryCode != "IT" {
+			t.Fatal("unexpected response", resp)
+		}
+		Must0(json.Unmarshal([]byte(get(t, "http://10.0.0.1/?ip=8.8.8.8")), &resp))
+		if resp.ASN != 0 || resp.CountryCode != "ZZ" {
+			t.Fatal("unexpected response", resp)
+		}
+	})
+
+	t.Run("we emulate the other formats", func(t *testing.T) {
+		if body := get(t, "https://10.0.0.1/cdn-cgi/trace"); body != "ip=10.0.0.2\nloc=DE\n" {
+			t.Fatal("unexpected body", body)
+		}
+		expect := "<Response><Ip>10.0.0.2</Ip><Status>OK</Status><CountryCode>DE</CountryCode></Response>"
+		if body := get(t, "https://10.0.0.1/lookup"); body != expect {
+			t.Fatal("unexpected body", body)
+		}
+	})
+
+	t.Run("the whois server answers bulk queries", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn := Must1(topology.Client.DialContext(ctx, "tcp", net.JoinHostPort("10.0.0.1", "43")))
+		defer conn.Close()
+		Must1(conn.Write([]byte("begin\n -v 10.0.0.2\n8.8.8.8\nend\n")))
+		data := Must1(io.ReadAll(conn))
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 3 {
+			t.Fatal("unexpected response", string(data))
+		}
+		if !strings.HasPrefix(lines[1], "64497 ") || !strings.Contains(lines[1], "| 10.0.0.0/24 ") {
+			t.Fatal("unexpected line", lines[1])
+		}
+		if !strings.HasPrefix(lines[2], "NA ") {
+			t.Fatal("unexpected line", lines[2])
+		}
+	})
+}
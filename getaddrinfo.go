@@ -0,0 +1,101 @@
+package netem
+
+//
+// getaddrinfo error mapping
+//
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ErrDNSTemporaryFailure is the equivalent of getaddrinfo's EAI_AGAIN.
+var ErrDNSTemporaryFailure = errors.New("netem: dns: temporary failure in name resolution")
+
+// ErrDNSNonRecoverableFailure is the equivalent of getaddrinfo's EAI_FAIL.
+var ErrDNSNonRecoverableFailure = errors.New("netem: dns: non-recoverable failure in name resolution")
+
+// GetaddrinfoErrorMapping configures how [UNetStack.GetaddrinfoLookupANY] maps
+// DNS failures to errors. Each field is OPTIONAL: when a field is nil, we return
+// the error we would return by default. Therefore, the zero value is valid and
+// preserves the default behavior, where:
+//
+// - NXDOMAIN causes [ErrDNSNoSuchHost];
+//
+// - a response without addresses causes [ErrDNSNoAnswer];
+//
+// - SERVFAIL, REFUSED, and other rcodes cause [ErrDNSServerMisbehaving];
+//
+// - a timeout causes the underlying timeout error.
+//
+// See [NewGetaddrinfoErrorMappingEAI] for a mapping similar to the one
+// implemented by the GNU C library getaddrinfo implementation.
+type GetaddrinfoErrorMapping struct {
+	// NoSuchHost is the OPTIONAL error to return for NXDOMAIN.
+	NoSuchHost error
+
+	// NoAnswer is the OPTIONAL error to return when the response
+	// does not contain any address for the given name.
+	NoAnswer error
+
+	// ServerFailure is the OPTIONAL error to return for SERVFAIL.
+	ServerFailure error
+
+	// Refused is the OPTIONAL error to return for REFUSED and for all the
+	// other unexpected rcodes (e.g., NOTIMP, FORMERR).
+	Refused error
+
+	// Timeout is the OPTIONAL error to return when the lookup times out.
+	Timeout error
+}
+
+// NewGetaddrinfoErrorMappingEAI returns a [GetaddrinfoErrorMapping] emulating
+// how the GNU C library maps DNS failures to getaddrinfo errors:
+//
+// - NXDOMAIN maps to [ErrDNSNoSuchHost] (i.e., EAI_NONAME);
+//
+// - no answer maps to [ErrDNSNoAnswer] (i.e., EAI_NODATA);
+//
+// - SERVFAIL and timeouts map to [ErrDNSTemporaryFailure] (i.e., EAI_AGAIN);
+//
+// - REFUSED and other rcodes map to [ErrDNSNonRecoverableFailure] (i.e., EAI_FAIL).
+func NewGetaddrinfoErrorMappingEAI() *GetaddrinfoErrorMapping {
+	return &GetaddrinfoErrorMapping{
+		NoSuchHost:    ErrDNSNoSuchHost,
+		NoAnswer:      ErrDNSNoAnswer,
+		ServerFailure: ErrDNSTemporaryFailure,
+		Refused:       ErrDNSNonRecoverableFailure,
+		Timeout:       ErrDNSTemporaryFailure,
+	}
+}
+
+// mapRoundTripError maps an error occurred during the DNS round trip.
+func (m *GetaddrinfoErrorMapping) mapRoundTripError(err error) error {
+	var nerr net.Error
+	if m.Timeout != nil && (errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &nerr) && nerr.Timeout())) {
+		return m.Timeout
+	}
+	return err
+}
+
+// mapResponseError maps an error returned by [DNSParseResponse].
+func (m *GetaddrinfoErrorMapping) mapResponseError(resp *dns.Msg, err error) error {
+	var mapped error
+	switch {
+	case errors.Is(err, ErrDNSNoSuchHost):
+		mapped = m.NoSuchHost
+	case errors.Is(err, ErrDNSNoAnswer):
+		mapped = m.NoAnswer
+	case resp.Rcode == dns.RcodeServerFailure:
+		mapped = m.ServerFailure
+	case resp.Rcode != dns.RcodeSuccess:
+		mapped = m.Refused
+	}
+	if mapped == nil {
+		return err
+	}
+	return mapped
+}
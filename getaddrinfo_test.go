@@ -0,0 +1,80 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestGetaddrinfoErrorMapping(t *testing.T) {
+	config := NewDNSConfig()
+	config.AddRecord("noanswer.example.com", "www.example.org")
+	config.AddRcode("servfail.example.com", dns.RcodeServerFailure, 0)
+	config.AddRcode("refused.example.com", dns.RcodeRefused, 0)
+	topology, _ := newDNSServerTestTopology(t, config, &DNSServerOptions{})
+
+	// isTimeout returns whether the error is a timeout error.
+	isTimeout := func(err error) bool {
+		var nerr net.Error
+		return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &nerr) && nerr.Timeout())
+	}
+
+	type testcase struct {
+		domain    string
+		expectDef func(err error) bool
+		expectEAI error
+	}
+
+	testcases := []testcase{{
+		domain:    "nxdomain.example.com",
+		expectDef: func(err error) bool { return errors.Is(err, ErrDNSNoSuchHost) },
+		expectEAI: ErrDNSNoSuchHost,
+	}, {
+		domain:    "noanswer.example.com",
+		expectDef: func(err error) bool { return errors.Is(err, ErrDNSNoAnswer) },
+		expectEAI: ErrDNSNoAnswer,
+	}, {
+		domain:    "servfail.example.com",
+		expectDef: func(err error) bool { return errors.Is(err, ErrDNSServerMisbehaving) },
+		expectEAI: ErrDNSTemporaryFailure,
+	}, {
+		domain:    "refused.example.com",
+		expectDef: func(err error) bool { return errors.Is(err, ErrDNSServerMisbehaving) },
+		expectEAI: ErrDNSNonRecoverableFailure,
+	}}
+
+	lookup := func(stack *UNetStack, domain string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		_, _, err := stack.GetaddrinfoLookupANY(ctx, domain)
+		return err
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.domain, func(t *testing.T) {
+			topology.Client.SetGetaddrinfoErrorMapping(nil)
+			if err := lookup(topology.Client, tc.domain); !tc.expectDef(err) {
+				t.Fatal("unexpected default error", err)
+			}
+			topology.Client.SetGetaddrinfoErrorMapping(NewGetaddrinfoErrorMappingEAI())
+			if err := lookup(topology.Client, tc.domain); !errors.Is(err, tc.expectEAI) {
+				t.Fatal("unexpected EAI error", err)
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		topology, _ := newDNSServerTestTopology(t, config, &DNSServerOptions{DropRate: 1})
+		if err := lookup(topology.Client, "www.example.com"); !isTimeout(err) {
+			t.Fatal("unexpected default error", err)
+		}
+		topology.Client.SetGetaddrinfoErrorMapping(NewGetaddrinfoErrorMappingEAI())
+		if err := lookup(topology.Client, "www.example.com"); !errors.Is(err, ErrDNSTemporaryFailure) {
+			t.Fatal("unexpected EAI error", err)
+		}
+	})
+}
@@ -1,21 +1,29 @@
 module github.com/ooni/netem
 
-go 1.20
+go 1.21
 
 require (
 	github.com/apex/log v1.9.0
 	github.com/google/gopacket v1.1.19
 	github.com/miekg/dns v1.1.57
+	github.com/quic-go/quic-go v0.41.0
 	golang.org/x/crypto v0.16.0
+	golang.org/x/net v0.19.0
 	gvisor.dev/gvisor v0.0.0-20230922204349-b3f36d574a7f
 )
 
 require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
 	github.com/google/btree v1.1.2 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/quic-go/qpack v0.4.0 // indirect
 	github.com/stretchr/testify v1.8.1 // indirect
-	golang.org/x/net v0.19.0 // indirect
+	go.uber.org/mock v0.3.0 // indirect
+	golang.org/x/exp v0.0.0-20230725093048-515e97ebf090 // indirect
 	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 )
 
@@ -11,10 +11,13 @@ package netem
 import (
 	"context"
 	"errors"
+	"net"
 	"net/netip"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 
-	"gvisor.dev/gvisor/pkg/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
@@ -23,8 +26,10 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/raw"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
 )
 
 // gvisorStack is a TCP/IP stack in userspace. Seen from above this
@@ -42,13 +47,19 @@ type gvisorStack struct {
 	// endpoint is the endpoint receiving gvisor notifications.
 	endpoint *channel.Endpoint
 
+	// firewallRules contains the OPTIONAL host firewall rules.
+	firewallRules atomic.Pointer[[]*firewallRule]
+
 	// incomingPacket is the channel posted by GVisor
 	// when there is an incoming IP packet.
 	incomingPacket chan any
 
-	// ipAddress is the IP address we're using.
+	// ipAddress is the primary IP address we're using.
 	ipAddress netip.Addr
 
+	// ipAddresses contains all the IP addresses we're using.
+	ipAddresses []netip.Addr
+
 	// logger is the logger to use.
 	logger Logger
 
@@ -57,10 +68,115 @@ type gvisorStack struct {
 
 	// stack is the network stack in userspace.
 	stack *stack.Stack
+
+	// stripTCPTimestamps indicates that we should remove the
+	// timestamps option from the SYN segments.
+	stripTCPTimestamps atomic.Bool
+
+	// tcpSegmentation is the OPTIONAL default [TCPSegmentation] of new TCP conns.
+	tcpSegmentation atomic.Pointer[TCPSegmentation]
+
+	// tcpMSS is the OPTIONAL MSS advertised by new TCP connections.
+	tcpMSS atomic.Int64
+
+	// tcpInFlight maps the [stack.TCPEndpointID] of the tracked TCP endpoints
+	// to an [*atomic.Int64] containing the bytes in flight.
+	tcpInFlight sync.Map
+
+	// tcpProbeInstalled indicates that we installed the probe tracking the
+	// bytes in flight (see [gvisorStack.enableTCPBytesInFlight]).
+	tcpProbeInstalled atomic.Bool
+
+	// sockets maps the key of each socket the user created and did not
+	// close yet to its description, which allows to detect leaks.
+	sockets sync.Map
+
+	// portMu protects portNext and portSequential.
+	portMu sync.Mutex
+
+	// portNext is the next port to try with sequential port allocation.
+	portNext uint16
+
+	// portSequential indicates whether to allocate ports sequentially.
+	portSequential bool
 }
 
-// newGVisorStack creates a new [gvisorStack] instance.
-func newGVisorStack(logger Logger, A netip.Addr, MTU uint32) (*gvisorStack, error) {
+// newGVisorStack creates a new [gvisorStack] instance using the given IPv4
+// and IPv6 addresses, where the first address is the primary address.
+func newGVisorStack(logger Logger, addrs []netip.Addr, MTU uint32) (*gvisorStack, error) {
+	if len(addrs) <= 0 {
+		return nil, errors.New("netem: newGVisorStack: no addresses")
+	}
+
+	// create the stack and the NIC
+	gvs, err := newGVisorStackWithNIC(logger, addrs[0], MTU, true)
+	if err != nil {
+		return nil, err
+	}
+	gvs.ipAddresses = addrs
+
+	logger.Debugf("netem: ifconfig %s mtu %d", gvs.name, MTU)
+	for _, A := range addrs {
+		// configure the IPv4 or IPv6 address for the NIC we created
+		var (
+			protoNumber tcpip.NetworkProtocolNumber
+			subnet      tcpip.Subnet
+		)
+		if A.Is4() {
+			protoNumber, subnet = ipv4.ProtocolNumber, header.IPv4EmptySubnet
+		} else {
+			protoNumber, subnet = ipv6.ProtocolNumber, header.IPv6EmptySubnet
+		}
+		protoAddr := tcpip.ProtocolAddress{
+			Protocol:          protoNumber,
+			AddressWithPrefix: tcpip.AddrFromSlice(A.AsSlice()).WithPrefix(),
+		}
+		if err := gvs.stack.AddProtocolAddress(1, protoAddr, stack.AddressProperties{}); err != nil {
+			return nil, errors.New(err.String())
+		}
+
+		// install the default route for the address family
+		gvs.stack.AddRoute(tcpip.Route{Destination: subnet, NIC: 1})
+
+		logger.Debugf("netem: ifconfig %s %s up", gvs.name, A)
+		logger.Debugf("netem: ip route add default dev %s", gvs.name)
+	}
+	return gvs, nil
+}
+
+// newGVisorStackPromiscuous creates a new [gvisorStack] instance without any
+// IP address, which accepts packets for any destination address and can send
+// packets using any source address. We use this kind of stack to terminate
+// and re-originate connections inside transparent proxies.
+func newGVisorStackPromiscuous(logger Logger, MTU uint32) (*gvisorStack, error) {
+	// create the stack and the NIC
+	//
+	// Note that we MUST disable HandleLocal, otherwise the stack would consider
+	// all the source addresses as its own and drop all the incoming packets.
+	gvs, err := newGVisorStackWithNIC(logger, netip.IPv4Unspecified(), MTU, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// accept packets for any address and send packets from any address
+	if err := gvs.stack.SetPromiscuousMode(1, true); err != nil {
+		return nil, errors.New(err.String())
+	}
+	if err := gvs.stack.SetSpoofing(1, true); err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	// install the default route
+	gvs.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: 1})
+
+	logger.Debugf("netem: ifconfig %s mtu %d promisc", gvs.name, MTU)
+	logger.Debugf("netem: ip route add default dev %s", gvs.name)
+	return gvs, nil
+}
+
+// newGVisorStackWithNIC creates a new [gvisorStack] instance with
+// a NIC but without any IP address or route.
+func newGVisorStackWithNIC(logger Logger, A netip.Addr, MTU uint32, handleLocal bool) (*gvisorStack, error) {
 
 	// create options for the new stack
 	stackOptions := stack.Options{
@@ -74,7 +190,8 @@ func newGVisorStack(logger Logger, A netip.Addr, MTU uint32) (*gvisorStack, erro
 			icmp.NewProtocol4,
 			icmp.NewProtocol6,
 		},
-		HandleLocal: true,
+		RawFactory:  raw.EndpointFactory{},
+		HandleLocal: handleLocal,
 	}
 
 	// create the stack instance
@@ -85,6 +202,7 @@ func newGVisorStack(logger Logger, A netip.Addr, MTU uint32) (*gvisorStack, erro
 		endpoint:       channel.New(1024, MTU, ""),
 		name:           name,
 		ipAddress:      A,
+		ipAddresses:    []netip.Addr{A},
 		incomingPacket: make(chan any, 1024),
 		logger:         logger,
 		stack:          stack.New(stackOptions),
@@ -98,31 +216,88 @@ func newGVisorStack(logger Logger, A netip.Addr, MTU uint32) (*gvisorStack, erro
 		return nil, errors.New(err.String())
 	}
 
-	// configure the IPv4 address for the NIC we created
-	protoAddr := tcpip.ProtocolAddress{
-		Protocol:          ipv4.ProtocolNumber,
-		AddressWithPrefix: tcpip.AddrFromSlice(A.AsSlice()).WithPrefix(),
+	return gvs, nil
+}
+
+var _ NIC = &gvisorStack{}
+
+// enableTCPBytesInFlight installs the probe tracking the bytes in flight. Because
+// the probe runs for every segment received by every TCP endpoint, we only install
+// it on demand. Endpoints copy the probe when created, so we only track the TCP
+// endpoints created after calling this method.
+func (gvs *gvisorStack) enableTCPBytesInFlight() {
+	if gvs.tcpProbeInstalled.CompareAndSwap(false, true) {
+		gvs.stack.AddTCPProbe(gvs.tcpProbe)
 	}
-	if err := gvs.stack.AddProtocolAddress(1, protoAddr, stack.AddressProperties{}); err != nil {
-		return nil, errors.New(err.String())
+}
+
+// tcpProbe is invoked by gvisor for every segment received by a TCP endpoint
+// and updates the bytes in flight if we're tracking the endpoint.
+func (gvs *gvisorStack) tcpProbe(state *stack.TCPEndpointState) {
+	if value, found := gvs.tcpInFlight.Load(state.ID); found {
+		inFlight := state.Sender.SndUna.Size(state.Sender.SndNxt)
+		value.(*atomic.Int64).Store(int64(inFlight))
 	}
+}
 
-	// install the IPv4 address in the routing table
-	gvs.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: 1})
+// trackTCPInFlight starts tracking the bytes in flight of the given TCP endpoint and
+// returns the counter along with a function to call to stop tracking. The counter
+// is nil unless we installed the probe (see [gvisorStack.enableTCPBytesInFlight]).
+func (gvs *gvisorStack) trackTCPInFlight(ep tcpip.Endpoint) (*atomic.Int64, func()) {
+	if !gvs.tcpProbeInstalled.Load() {
+		return nil, func() {}
+	}
+	info, good := ep.Info().(*stack.TransportEndpointInfo)
+	if !good {
+		return &atomic.Int64{}, func() {}
+	}
+	id := stack.TCPEndpointID(info.ID)
+	counter := &atomic.Int64{}
+	gvs.tcpInFlight.Store(id, counter)
+	return counter, func() {
+		gvs.tcpInFlight.CompareAndDelete(id, counter)
+	}
+}
 
-	logger.Debugf("netem: ifconfig %s mtu %d", name, MTU)
-	logger.Debugf("netem: ifconfig %s %s up", name, A)
-	logger.Debugf("netem: ip route add default dev %s", name)
-	return gvs, nil
+// trackSocket starts tracking a socket created by the user and returns an
+// idempotent function to call when the user closes the socket.
+func (gvs *gvisorStack) trackSocket(description string) func() {
+	key := &description // unique for each socket
+	gvs.sockets.Store(key, description)
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			gvs.sockets.Delete(key)
+		})
+	}
 }
 
-var _ NIC = &gvisorStack{}
+// openSockets returns the sorted descriptions of the sockets the user
+// created and did not close yet.
+func (gvs *gvisorStack) openSockets() []string {
+	descriptions := []string{}
+	gvs.sockets.Range(func(key, value any) bool {
+		descriptions = append(descriptions, value.(string))
+		return true
+	})
+	sort.Strings(descriptions)
+	return descriptions
+}
 
 // IPAddress implements NIC
 func (gvs *gvisorStack) IPAddress() string {
 	return gvs.ipAddress.String()
 }
 
+// IPAddresses returns all the IP addresses of the stack.
+func (gvs *gvisorStack) IPAddresses() []string {
+	var addrs []string
+	for _, A := range gvs.ipAddresses {
+		addrs = append(addrs, A.String())
+	}
+	return addrs
+}
+
 // FrameAvailable implements NIC
 func (gvs *gvisorStack) FrameAvailable() <-chan any {
 	return gvs.incomingPacket
@@ -143,25 +318,34 @@ func (gvs *gvisorStack) ReadFrameNonblocking() (*Frame, error) {
 	default:
 	}
 
-	// obtain the packet buffer from the endpoint
-	pktbuf := gvs.endpoint.Read()
-	if pktbuf.IsNil() {
-		return nil, ErrNoPacket
-	}
-	view := pktbuf.ToView()
-	pktbuf.DecRef()
-
-	// read the actual packet payload
-	buffer := make([]byte, gvs.endpoint.MTU())
-	count, err := view.Read(buffer)
-	if err != nil {
-		return nil, err
+	for {
+		// obtain the packet buffer from the endpoint
+		pktbuf := gvs.endpoint.Read()
+		if pktbuf.IsNil() {
+			return nil, ErrNoPacket
+		}
+
+		// copy the packet payload exactly once into a pooled frame, without
+		// going through an intermediate view, and release the packet buffer
+		// such that its chunks go back to the gvisor pools
+		frame := newPooledFrame(pktbuf.Size())
+		offset := 0
+		for _, slice := range pktbuf.AsSlices() {
+			offset += copy(frame.Payload[offset:], slice)
+		}
+		pktbuf.DecRef()
+
+		// skip the packets blocked by the host firewall
+		if !gvs.firewallAccepts(FirewallDirectionEgress, frame.Payload) {
+			frame.Release()
+			continue
+		}
+
+		if gvs.stripTCPTimestamps.Load() {
+			_ = unetStripTCPTimestamps(frame.Payload)
+		}
+		return frame, nil
 	}
-
-	// prepare the outgoing frame
-	payload := buffer[:count]
-	frame := NewFrame(payload)
-	return frame, nil
 }
 
 // InterfaceName implements NIC.
@@ -187,22 +371,30 @@ func (gvs *gvisorStack) WriteNotify() {
 func (gvs *gvisorStack) WriteFrame(frame *Frame) error {
 	// there is clearly a race condition with closing but the intent is just
 	// to behave and return ErrClose long after we've been closed
+	// we copy the payload into the stack, so we can release the frame
+	defer frame.Release()
+
 	select {
 	case <-gvs.closed:
 		return ErrStackClosed
 	default:
 	}
 
+	// silently discard the packets blocked by the host firewall
+	if !gvs.firewallAccepts(FirewallDirectionIngress, frame.Payload) {
+		return nil
+	}
+
 	// the following code is already ready for supporting IPv6
 	// should we want to do that in the future
 	packet := frame.Payload
-	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
-	switch packet[0] >> 4 {
-	case 4:
-		gvs.endpoint.InjectInbound(header.IPv4ProtocolNumber, pkb)
-	case 6:
-		gvs.endpoint.InjectInbound(header.IPv6ProtocolNumber, pkb)
+	if gvs.stripTCPTimestamps.Load() {
+		// we cannot modify the frame payload, which other
+		// parties (e.g., a PCAP dumper) may still be using
+		packet = append([]byte{}, packet...)
+		_ = unetStripTCPTimestamps(packet)
 	}
+	gvs.injectInbound(packet)
 
 	return nil
 }
@@ -221,29 +413,269 @@ func (gvs *gvisorStack) Close() error {
 	return nil
 }
 
-// DialContextTCPAddrPort establishes a new TCP connection.
+// DialContextTCPAddrPort establishes a new TCP connection. We also return
+// the underlying endpoint, which allows to query the connection stats.
 func (gvs *gvisorStack) DialContextTCPAddrPort(
-	ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
+	ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, tcpip.Endpoint, error) {
 	fa, pn := gvisorConvertToFullAddr(addr)
-	return gonet.DialContextTCP(ctx, gvs.stack, fa, pn)
+
+	// the following code is like gonet.DialContextTCP except that
+	// we return the endpoint along with the connection
+	wq := &waiter.Queue{}
+	ep, err := gvs.stack.NewEndpoint(tcp.ProtocolNumber, pn, wq)
+	if err != nil {
+		return nil, nil, errors.New(err.String())
+	}
+	gvs.maybeClampTCPMSS(ep)
+	if _, err := gvs.maybeBindSequentialPort(ep, tcpip.Address{}); err != nil {
+		ep.Close()
+		return nil, nil, &net.OpError{Op: "bind", Net: "tcp", Err: errors.New(err.String())}
+	}
+	entry, writable := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&entry)
+	defer wq.EventUnregister(&entry)
+
+	select {
+	case <-ctx.Done():
+		ep.Close()
+		return nil, nil, ctx.Err()
+	default:
+	}
+
+	err = ep.Connect(fa)
+	if _, ok := err.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, nil, ctx.Err()
+		case <-writable:
+		}
+		err = ep.LastError()
+	}
+	if err != nil {
+		ep.Close()
+		return nil, nil, &net.OpError{
+			Op:   "connect",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IP(fa.Addr.AsSlice()), Port: int(fa.Port)},
+			Err:  errors.New(err.String()),
+		}
+	}
+	return gonet.NewTCPConn(wq, ep), ep, nil
 }
 
-// ListenTCPAddrPort creates a new listening TCP socket.
-func (gvs *gvisorStack) ListenTCPAddrPort(addr netip.AddrPort) (*gonet.TCPListener, error) {
-	fa, pn := gvisorConvertToFullAddr(addr)
-	return gonet.ListenTCP(gvs.stack, fa, pn)
+// ListenTCPAddrPort creates a new listening TCP socket whose accept
+// queue holds at most backlog established connections.
+func (gvs *gvisorStack) ListenTCPAddrPort(addr netip.AddrPort, backlog int) (*gvisorTCPListener, error) {
+	fa, pn := gvisorConvertToLocalFullAddr(addr)
+
+	// the following code is like gonet.ListenTCP except that our
+	// listener returns the endpoint along with the connection
+	wq := &waiter.Queue{}
+	ep, err := gvs.stack.NewEndpoint(tcp.ProtocolNumber, pn, wq)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+	gvs.maybeClampTCPMSS(ep) // inherited by the accepted endpoints
+	if err := ep.Bind(fa); err != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "bind",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IP(fa.Addr.AsSlice()), Port: int(fa.Port)},
+			Err:  errors.New(err.String()),
+		}
+	}
+	if err := ep.Listen(backlog); err != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "listen",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IP(fa.Addr.AsSlice()), Port: int(fa.Port)},
+			Err:  errors.New(err.String()),
+		}
+	}
+	gtl := &gvisorTCPListener{
+		accepted: map[tcpip.Endpoint]struct{}{},
+		backlog:  backlog,
+		ep:       ep,
+		stack:    gvs.stack,
+		wq:       wq,
+	}
+	return gtl, nil
+}
+
+// gvisorTCPListener is a listening TCP socket created by [gvisorStack].
+type gvisorTCPListener struct {
+	// accepted contains the endpoints we have accepted, which we need to
+	// tell apart queued endpoints from accepted ones in PendingConnections.
+	accepted map[tcpip.Endpoint]struct{}
+
+	// backlog is the capacity of the accept queue.
+	backlog int
+
+	// ep is the listening endpoint.
+	ep tcpip.Endpoint
+
+	// mu protects accepted and pruneAt.
+	mu sync.Mutex
+
+	// pruneAt is the size of accepted that triggers pruning.
+	pruneAt int
+
+	// stack is the stack owning the endpoint.
+	stack *stack.Stack
+
+	// wq is the endpoint's waiter queue.
+	wq *waiter.Queue
+}
+
+// Accept accepts a new TCP connection and returns the connection
+// along with its endpoint, which allows to query the connection stats.
+func (gtl *gvisorTCPListener) Accept() (*gonet.TCPConn, tcpip.Endpoint, error) {
+	entry, readable := waiter.NewChannelEntry(waiter.ReadableEvents)
+	gtl.wq.EventRegister(&entry)
+	defer gtl.wq.EventUnregister(&entry)
+	for {
+		ep, wq, err := gtl.ep.Accept(nil)
+		if _, ok := err.(*tcpip.ErrWouldBlock); ok {
+			<-readable
+			continue
+		}
+		if err != nil {
+			return nil, nil, &net.OpError{
+				Op:   "accept",
+				Net:  "tcp",
+				Addr: gtl.Addr(),
+				Err:  errors.New(err.String()),
+			}
+		}
+		gtl.rememberAccepted(ep)
+		return gonet.NewTCPConn(wq, ep), ep, nil
+	}
+}
+
+// rememberAccepted adds the given endpoint to the accepted set. To avoid
+// growing the set forever, we periodically forget the endpoints that have
+// been closed, using a doubling threshold to amortize the cost.
+func (gtl *gvisorTCPListener) rememberAccepted(ep tcpip.Endpoint) {
+	defer gtl.mu.Unlock()
+	gtl.mu.Lock()
+	gtl.accepted[ep] = struct{}{}
+	if len(gtl.accepted) >= gtl.pruneAt {
+		gtl.pruneLocked(gtl.connectedEndpoints())
+		gtl.pruneAt = 2*len(gtl.accepted) + 64
+	}
+}
+
+// pruneLocked removes from the accepted set the endpoints that are no
+// longer connected. This method assumes the caller holds mu.
+func (gtl *gvisorTCPListener) pruneLocked(connected []tcpip.Endpoint) {
+	alive := map[tcpip.Endpoint]struct{}{}
+	for _, ep := range connected {
+		if _, found := gtl.accepted[ep]; found {
+			alive[ep] = struct{}{}
+		}
+	}
+	gtl.accepted = alive
+}
+
+// connectedEndpoints returns the connected endpoints sharing the local
+// address and port of the listening endpoint, which include both the
+// accepted endpoints and the ones waiting in the accept queue.
+func (gtl *gvisorTCPListener) connectedEndpoints() (out []tcpip.Endpoint) {
+	laddr, err := gtl.ep.GetLocalAddress()
+	if err != nil {
+		return
+	}
+	for _, te := range gtl.stack.RegisteredEndpoints() {
+		ep, good := te.(tcpip.Endpoint)
+		if !good {
+			continue
+		}
+		info, good := ep.Info().(*stack.TransportEndpointInfo)
+		if !good || info.TransProto != tcp.ProtocolNumber || info.ID.RemotePort == 0 {
+			continue
+		}
+		if info.ID.LocalPort != laddr.Port {
+			continue
+		}
+		if laddr.Addr.Len() > 0 && info.ID.LocalAddress != laddr.Addr {
+			continue
+		}
+		out = append(out, ep)
+	}
+	return
+}
+
+// PendingConnections returns the number of connections that completed
+// the three-way handshake but that we have not accepted yet.
+func (gtl *gvisorTCPListener) PendingConnections() (count int) {
+	connected := gtl.connectedEndpoints()
+	defer gtl.mu.Unlock()
+	gtl.mu.Lock()
+	gtl.pruneLocked(connected)
+	for _, ep := range connected {
+		if _, found := gtl.accepted[ep]; found {
+			continue
+		}
+		switch tcp.EndpointState(ep.State()) {
+		case tcp.StateEstablished, tcp.StateCloseWait:
+			count++
+		}
+	}
+	return
+}
+
+// Backlog returns the capacity of the accept queue.
+func (gtl *gvisorTCPListener) Backlog() int {
+	return gtl.backlog
+}
+
+// ListenOverflows returns the number of SYN and ACK segments that
+// we dropped because the accept queue was full.
+func (gtl *gvisorTCPListener) ListenOverflows() (synDrops, ackDrops uint64) {
+	stats, good := gtl.ep.Stats().(*tcp.Stats)
+	if !good {
+		return
+	}
+	return stats.ReceiveErrors.ListenOverflowSynDrop.Value(),
+		stats.ReceiveErrors.ListenOverflowAckDrop.Value()
+}
+
+// Addr returns the listening address.
+func (gtl *gvisorTCPListener) Addr() net.Addr {
+	fa, err := gtl.ep.GetLocalAddress()
+	if err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: net.IP(fa.Addr.AsSlice()), Port: int(fa.Port)}
+}
+
+// Close closes the listening socket, which interrupts pending Accept calls.
+func (gtl *gvisorTCPListener) Close() error {
+	gtl.ep.Close()
+	return nil
 }
 
 // DialUDPAddrPort allows to create UDP sockets. Using a nil
 // raddr is equivalent to [net.ListenUDP]. Using nil laddr instead
 // is equivalent to [net.DialContext] with an "udp" network.
-func (gvs *gvisorStack) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gonet.UDPConn, error) {
+//
+// Like with connected UDP sockets in the kernel, when raddr is valid, an
+// ICMP port unreachable message causes a pending read to fail with the
+// "connection refused" error. (Without special handling, the pending read
+// would not be notified and would only fail when it times out.)
+//
+// We also return the underlying endpoint, which allows to set socket options.
+func (gvs *gvisorStack) DialUDPAddrPort(
+	laddr, raddr netip.AddrPort) (*gonet.UDPConn, tcpip.Endpoint, error) {
 	var lfa, rfa *tcpip.FullAddress
 	var pn tcpip.NetworkProtocolNumber
 
 	if laddr.IsValid() || laddr.Port() > 0 {
 		var addr tcpip.FullAddress
-		addr, pn = gvisorConvertToFullAddr(laddr)
+		addr, pn = gvisorConvertToLocalFullAddr(laddr)
 		lfa = &addr
 	}
 
@@ -253,7 +685,183 @@ func (gvs *gvisorStack) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gonet.UDP
 		rfa = &addr
 	}
 
-	return gonet.DialUDP(gvs.stack, lfa, rfa, pn)
+	// the following code is like gonet.DialUDP except that we own the
+	// waiter queue, which allows us to wake up pending reads on errors
+	wq := &waiter.Queue{}
+	ep, err := gvs.stack.NewEndpoint(udp.ProtocolNumber, pn, wq)
+	if err != nil {
+		return nil, nil, errors.New(err.String())
+	}
+	if lfa == nil || lfa.Port == 0 {
+		var addr tcpip.Address
+		if lfa != nil {
+			addr = lfa.Addr
+		}
+		bound, err := gvs.maybeBindSequentialPort(ep, addr)
+		if err != nil {
+			ep.Close()
+			return nil, nil, &net.OpError{Op: "bind", Net: "udp", Err: errors.New(err.String())}
+		}
+		if bound {
+			lfa = nil // already bound
+		}
+	}
+	if lfa != nil {
+		if err := ep.Bind(*lfa); err != nil {
+			ep.Close()
+			return nil, nil, &net.OpError{
+				Op:   "bind",
+				Net:  "udp",
+				Addr: &net.UDPAddr{IP: net.IP(lfa.Addr.AsSlice()), Port: int(lfa.Port)},
+				Err:  errors.New(err.String()),
+			}
+		}
+	}
+	if rfa != nil {
+		if err := ep.Connect(*rfa); err != nil {
+			ep.Close()
+			return nil, nil, &net.OpError{
+				Op:   "connect",
+				Net:  "udp",
+				Addr: &net.UDPAddr{IP: net.IP(rfa.Addr.AsSlice()), Port: int(rfa.Port)},
+				Err:  errors.New(err.String()),
+			}
+		}
+		errEntry := waiter.NewFunctionEntry(waiter.EventErr, func(waiter.EventMask) {
+			// note: we cannot call Notify synchronously because the
+			// queue is read-locked while invoking this callback
+			go wq.Notify(waiter.ReadableEvents)
+		})
+		wq.EventRegister(&errEntry)
+	}
+	return gonet.NewUDPConn(gvs.stack, wq, ep), ep, nil
+}
+
+// SetTCPForwarder arranges for the stack to call the given handler for each
+// incoming TCP connection request. This is useful with promiscuous stacks.
+func (gvs *gvisorStack) SetTCPForwarder(handler func(req *tcp.ForwarderRequest)) {
+	const (
+		receiveWindow = 0 // use the default
+		maxInFlight   = 1024
+	)
+	forwarder := tcp.NewForwarder(gvs.stack, receiveWindow, maxInFlight, handler)
+	gvs.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
+}
+
+// DialContextTCPWithBind establishes a new TCP connection using the given local
+// endpoint. This is useful to spoof the source address with promiscuous stacks.
+func (gvs *gvisorStack) DialContextTCPWithBind(
+	ctx context.Context, laddr, raddr netip.AddrPort) (*gonet.TCPConn, error) {
+	lfa, _ := gvisorConvertToFullAddr(laddr)
+	rfa, pn := gvisorConvertToFullAddr(raddr)
+	return gonet.DialTCPWithBind(ctx, gvs.stack, lfa, rfa, pn)
+}
+
+// ListenICMPv4 creates a raw ICMPv4 socket. Reading from the returned
+// conn returns the IPv4 header followed by the ICMPv4 message, while writing
+// to it requires the caller to provide just the ICMPv4 message. We also
+// return the underlying endpoint, which allows to set socket options.
+func (gvs *gvisorStack) ListenICMPv4() (*gonet.UDPConn, tcpip.Endpoint, error) {
+	var wq waiter.Queue
+	ep, err := gvs.stack.NewRawEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, &wq, true)
+	if err != nil {
+		return nil, nil, errors.New(err.String())
+	}
+	return gonet.NewUDPConn(gvs.stack, &wq, ep), ep, nil
+}
+
+// SetTCPCongestionControl sets the TCP congestion control algorithm used
+// by the connections we create after calling this method.
+func (gvs *gvisorStack) SetTCPCongestionControl(name string) error {
+	option := tcpip.CongestionControlOption(name)
+	if err := gvs.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &option); err != nil {
+		return errors.New(err.String())
+	}
+	return nil
+}
+
+// TCPCongestionControl returns the TCP congestion control algorithm.
+func (gvs *gvisorStack) TCPCongestionControl() string {
+	var option tcpip.CongestionControlOption
+	_ = gvs.stack.TransportProtocolOption(tcp.ProtocolNumber, &option)
+	return string(option)
+}
+
+// AvailableTCPCongestionControls returns the available TCP congestion control algorithms.
+func (gvs *gvisorStack) AvailableTCPCongestionControls() []string {
+	var option tcpip.TCPAvailableCongestionControlOption
+	_ = gvs.stack.TransportProtocolOption(tcp.ProtocolNumber, &option)
+	return strings.Fields(string(option))
+}
+
+// SetTCPOption sets the given TCP protocol option.
+func (gvs *gvisorStack) SetTCPOption(option tcpip.SettableTransportProtocolOption) error {
+	if err := gvs.stack.SetTransportProtocolOption(tcp.ProtocolNumber, option); err != nil {
+		return errors.New(err.String())
+	}
+	return nil
+}
+
+// SetTCPMSS sets the MSS advertised by the TCP connections we create
+// after calling this method. A zero value restores the default MSS.
+func (gvs *gvisorStack) SetTCPMSS(mss int) {
+	gvs.tcpMSS.Store(int64(mss))
+}
+
+// maybeClampTCPMSS clamps the MSS of the given endpoint if needed.
+func (gvs *gvisorStack) maybeClampTCPMSS(ep tcpip.Endpoint) {
+	if mss := gvs.tcpMSS.Load(); mss > 0 {
+		_ = ep.SetSockOptInt(tcpip.MaxSegOption, int(mss))
+	}
+}
+
+// SetEphemeralPortRange sets the inclusive range of ephemeral ports.
+func (gvs *gvisorStack) SetEphemeralPortRange(first, last uint16) error {
+	if err := gvs.stack.SetPortRange(first, last); err != nil {
+		return errors.New(err.String())
+	}
+	return nil
+}
+
+// EphemeralPortRange returns the inclusive range of ephemeral ports.
+func (gvs *gvisorStack) EphemeralPortRange() (uint16, uint16) {
+	return gvs.stack.PortRange()
+}
+
+// SetSequentialPorts enables or disables sequential port allocation. Enabling
+// sequential port allocation restarts from the first ephemeral port.
+func (gvs *gvisorStack) SetSequentialPorts(enable bool) {
+	defer gvs.portMu.Unlock()
+	gvs.portMu.Lock()
+	gvs.portSequential = enable
+	gvs.portNext, _ = gvs.stack.PortRange()
+}
+
+// maybeBindSequentialPort binds the endpoint to the given address and to the
+// next free ephemeral port when using sequential port allocation. Otherwise, this
+// method does nothing. The boolean return value indicates whether we did bind.
+func (gvs *gvisorStack) maybeBindSequentialPort(ep tcpip.Endpoint, addr tcpip.Address) (bool, tcpip.Error) {
+	defer gvs.portMu.Unlock()
+	gvs.portMu.Lock()
+	if !gvs.portSequential {
+		return false, nil
+	}
+	first, last := gvs.stack.PortRange()
+	if gvs.portNext < first || gvs.portNext > last {
+		gvs.portNext = first
+	}
+	for count := int(last) - int(first) + 1; count > 0; count-- {
+		port := gvs.portNext
+		if gvs.portNext++; gvs.portNext > last || gvs.portNext == 0 {
+			gvs.portNext = first
+		}
+		err := ep.Bind(tcpip.FullAddress{NIC: 1, Addr: addr, Port: port})
+		if _, busy := err.(*tcpip.ErrPortInUse); busy {
+			continue
+		}
+		return true, err
+	}
+	return true, &tcpip.ErrNoPortAvailable{}
 }
 
 // gvisorConvertToFullAddr is a convenience function for converting
@@ -277,3 +885,14 @@ func gvisorConvertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.
 
 	return fa, protoNumber
 }
+
+// gvisorConvertToLocalFullAddr is like [gvisorConvertToFullAddr] but converts
+// the unspecified address (e.g., 0.0.0.0) to the empty address, which is how
+// gvisor represents binding to all the addresses.
+func gvisorConvertToLocalFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+	fa, protoNumber := gvisorConvertToFullAddr(endpoint)
+	if endpoint.Addr().IsUnspecified() {
+		fa.Addr = tcpip.Address{}
+	}
+	return fa, protoNumber
+}
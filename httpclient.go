@@ -5,7 +5,18 @@ package netem
 //
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/publicsuffix"
 )
 
 // HTTPUnderlyingNetwork is the [UnderlyingNetwork] used by HTTP code.
@@ -15,7 +26,21 @@ type HTTPUnderlyingNetwork interface {
 	Logger() Logger
 }
 
-// NewHTTPTransport creates a new [http.Transport] using an [UnderlyingNetwork].
+// NewHTTPTransport is equivalent to calling [NewHTTPTransportWithOptions]
+// with the given stack and empty [HTTPTransportOptions].
+func NewHTTPTransport(stack HTTPUnderlyingNetwork) *http.Transport {
+	return NewHTTPTransportWithOptions(stack, &HTTPTransportOptions{})
+}
+
+// HTTPTransportOptions contains OPTIONAL settings for [NewHTTPTransportWithOptions].
+// With the zero value, the transport speaks HTTP/1.1 for http URLs.
+type HTTPTransportOptions struct {
+	// H2C OPTIONALLY uses HTTP/2 cleartext with prior knowledge for http
+	// URLs, which requires servers supporting h2c (see [NewH2CHandler]).
+	H2C bool
+}
+
+// NewHTTPTransportWithOptions creates a new [http.Transport] using an [UnderlyingNetwork].
 //
 // We fill the following fields of the transport:
 //
@@ -24,11 +49,90 @@ type HTTPUnderlyingNetwork interface {
 // - DialTLSContext to use the stack's [MITMConfig];
 //
 // - ForceAttemptHTTP2 to force enabling the HTTP/2 protocol.
-func NewHTTPTransport(stack HTTPUnderlyingNetwork) *http.Transport {
-	ns := &Net{stack}
-	return &http.Transport{
+//
+// When options.H2C is true, we also register a round tripper for the http
+// scheme speaking HTTP/2 cleartext over connections created using DialContext.
+func NewHTTPTransportWithOptions(stack HTTPUnderlyingNetwork, options *HTTPTransportOptions) *http.Transport {
+	ns := &Net{Stack: stack}
+	txp := &http.Transport{
 		DialContext:       ns.DialContext,
 		DialTLSContext:    ns.DialTLSContext,
 		ForceAttemptHTTP2: true,
 	}
+	if options.H2C {
+		txp.RegisterProtocol("http", &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return ns.DialContext(ctx, network, addr)
+			},
+		})
+	}
+	return txp
+}
+
+// NewH2CHandler wraps the given [http.Handler] such that the server also
+// accepts HTTP/2 cleartext connections, both with prior knowledge and using
+// the HTTP/1.1 Upgrade mechanism, in addition to HTTP/1.x connections.
+func NewH2CHandler(handler http.Handler) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// HTTPClientOptions contains OPTIONAL settings for [NewHTTPClientWithOptions]. With
+// the zero value, the client stores cookies and follows up to ten redirects.
+type HTTPClientOptions struct {
+	// DisableCookies OPTIONALLY disables the cookie jar.
+	DisableCookies bool
+
+	// DisableRedirects OPTIONALLY prevents following redirects, in which
+	// case the client returns the redirect response to the caller.
+	DisableRedirects bool
+
+	// H2C OPTIONALLY uses HTTP/2 cleartext for http URLs (see [HTTPTransportOptions]).
+	H2C bool
+
+	// MaxRedirects is the OPTIONAL maximum number of redirects to
+	// follow before failing with [ErrHTTPTooManyRedirects] (default: 10).
+	MaxRedirects int
+
+	// Timeout is the OPTIONAL timeout of each request including following
+	// redirects and reading the body (default: no timeout).
+	Timeout time.Duration
+}
+
+// ErrHTTPTooManyRedirects indicates that the client followed too many redirects.
+var ErrHTTPTooManyRedirects = errors.New("netem: too many redirects")
+
+// NewHTTPClient is equivalent to calling [NewHTTPClientWithOptions]
+// with the given stack and empty [HTTPClientOptions].
+func NewHTTPClient(stack HTTPUnderlyingNetwork) *http.Client {
+	return NewHTTPClientWithOptions(stack, &HTTPClientOptions{})
+}
+
+// NewHTTPClientWithOptions creates a new [http.Client] using the transport
+// returned by [NewHTTPTransportWithOptions] along with a cookie jar using the public
+// suffix list and the configured redirect policy and timeout, which is
+// useful to emulate web-crawling-like flows.
+func NewHTTPClientWithOptions(stack HTTPUnderlyingNetwork, options *HTTPClientOptions) *http.Client {
+	client := &http.Client{
+		Transport: NewHTTPTransportWithOptions(stack, &HTTPTransportOptions{H2C: options.H2C}),
+		Timeout:   options.Timeout,
+	}
+	if !options.DisableCookies {
+		// note: cookiejar.New never returns an error
+		client.Jar = Must1(cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List}))
+	}
+	maxRedirects := options.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = 10
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if options.DisableRedirects {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("%w: %d", ErrHTTPTooManyRedirects, len(via))
+		}
+		return nil
+	}
+	return client
 }
@@ -0,0 +1,153 @@
+package netem
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.1"))
+	dnsServer := Must1(NewDNSServer(&NullLogger{}, topology.Server, "10.0.0.1", dnsConfig))
+	defer dnsServer.Close()
+
+	// the server sets a cookie, redirects N times, and finally
+	// returns whether the client sent back the cookie
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "deadbeef"})
+		http.Redirect(w, r, "/redirect?count=3", http.StatusFound)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+		if count > 0 {
+			http.Redirect(w, r, "/redirect?count="+strconv.Itoa(count-1), http.StatusFound)
+			return
+		}
+		if cookie, err := r.Cookie("session"); err == nil && cookie.Value == "deadbeef" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	tlsConfig := topology.Server.MustNewServerTLSConfig("www.example.com")
+	listener := Must1((&Net{Stack: topology.Server}).ListenTLS(
+		"tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, tlsConfig))
+	server := &http.Server{Handler: mux}
+	defer server.Close()
+	go server.Serve(listener)
+
+	t.Run("we follow redirects and send cookies", func(t *testing.T) {
+		client := NewHTTPClient(topology.Client)
+		resp, err := client.Get("https://www.example.com/login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("unexpected status code", resp.StatusCode)
+		}
+	})
+
+	t.Run("we can disable cookies", func(t *testing.T) {
+		client := NewHTTPClientWithOptions(topology.Client, &HTTPClientOptions{DisableCookies: true})
+		resp, err := client.Get("https://www.example.com/login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatal("unexpected status code", resp.StatusCode)
+		}
+	})
+
+	t.Run("we can disable redirects", func(t *testing.T) {
+		client := NewHTTPClientWithOptions(topology.Client, &HTTPClientOptions{DisableRedirects: true})
+		resp, err := client.Get("https://www.example.com/login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/redirect?count=3" {
+			t.Fatal("unexpected response", resp.StatusCode, resp.Header)
+		}
+	})
+
+	t.Run("we limit the number of redirects", func(t *testing.T) {
+		client := NewHTTPClientWithOptions(topology.Client, &HTTPClientOptions{MaxRedirects: 2})
+		_, err := client.Get("https://www.example.com/login")
+		if !errors.Is(err, ErrHTTPTooManyRedirects) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we honour the timeout", func(t *testing.T) {
+		client := NewHTTPClientWithOptions(topology.Client, &HTTPClientOptions{Timeout: 100 * time.Millisecond})
+		_, err := client.Get("https://www.example.com/slow")
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestNewHTTPTransportWithH2C(t *testing.T) {
+	// the DPI drops the traffic containing the domain name, which
+	// HPACK compresses, such that only h2c evades the DPI
+	dpiEngine := NewDPIEngine(&NullLogger{})
+	dpiEngine.AddRule(&DPIDropTrafficForString{
+		Logger:          &NullLogger{},
+		ServerIPAddress: "10.0.0.1",
+		ServerPort:      80,
+		String:          "www.example.com",
+	})
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{DPIEngine: dpiEngine})
+	defer topology.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	listener := Must1((&Net{Stack: topology.Server}).ListenTCP(
+		"tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}))
+	server := &http.Server{Handler: NewH2CHandler(handler)}
+	defer server.Close()
+	go server.Serve(listener)
+
+	t.Run("h2c evades the DPI", func(t *testing.T) {
+		client := NewHTTPClientWithOptions(topology.Client, &HTTPClientOptions{H2C: true})
+		req := Must1(http.NewRequest("GET", "http://10.0.0.1/", nil))
+		req.Host = "www.example.com"
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := Must1(io.ReadAll(resp.Body))
+		if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+			t.Fatal("expected HTTP/2, got", resp.Proto, string(body))
+		}
+	})
+
+	t.Run("HTTP/1.1 is blocked by the DPI", func(t *testing.T) {
+		client := NewHTTPClientWithOptions(topology.Client, &HTTPClientOptions{Timeout: time.Second})
+		req := Must1(http.NewRequest("GET", "http://10.0.0.1/", nil))
+		req.Host = "www.example.com"
+		if _, err := client.Do(req); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package netem
+
+//
+// ICMP sockets
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// ICMPConn is a raw ICMPv4 socket. The zero value is invalid; please,
+// use [UNetStack.ListenICMP] to construct.
+//
+// Each read returns a whole ICMPv4 message without the IPv4 header, while
+// each write sends the given ICMPv4 message, which MUST include a valid
+// checksum. This behavior is the same of the "ip4:icmp" network in the
+// standard library. Use [ICMPConn.SetTTL] to set the TTL of the packets
+// we send, which allows to implement traceroute like measurements.
+type ICMPConn struct {
+	// c is the underlying conn.
+	c *gonet.UDPConn
+
+	// ep is the underlying endpoint.
+	ep tcpip.Endpoint
+
+	// untrack stops tracking the conn as an open socket.
+	untrack func()
+}
+
+var _ net.PacketConn = &ICMPConn{}
+
+// ListenICMP creates a new [ICMPConn].
+func (gs *UNetStack) ListenICMP() (*ICMPConn, error) {
+	pconn, ep, err := gs.ns.ListenICMPv4()
+	if err != nil {
+		return nil, MapUNetError(err)
+	}
+	untrack := gs.ns.trackSocket(fmt.Sprintf("icmp %s", pconn.LocalAddr()))
+	return &ICMPConn{c: pconn, ep: ep, untrack: untrack}, nil
+}
+
+// SetTTL sets the TTL of the IPv4 packets we send.
+func (ic *ICMPConn) SetTTL(ttl int) error {
+	if ttl <= 0 || ttl > 255 {
+		return syscall.EINVAL
+	}
+	if err := ic.ep.SetSockOptInt(tcpip.IPv4TTLOption, ttl); err != nil {
+		return MapUNetError(errors.New(err.String()))
+	}
+	return nil
+}
+
+// ReadFrom implements net.PacketConn. The returned address is a [*net.IPAddr].
+func (ic *ICMPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buffer := make([]byte, 1<<16)
+	for {
+		count, addr, err := ic.c.ReadFrom(buffer)
+		if err != nil {
+			return 0, nil, MapUNetError(err)
+		}
+		// strip the IPv4 header, whose length we read from the IHL field
+		if count < 1 {
+			continue
+		}
+		headerLength := int(buffer[0]&0x0f) * 4
+		if headerLength > count {
+			continue
+		}
+		var ipAddr *net.IPAddr
+		if udpAddr, good := addr.(*net.UDPAddr); good {
+			ipAddr = &net.IPAddr{IP: udpAddr.IP}
+		}
+		return copy(p, buffer[headerLength:count]), ipAddr, nil
+	}
+}
+
+// WriteTo implements net.PacketConn. The addr argument MUST be
+// either a [*net.IPAddr] or a [*net.UDPAddr].
+func (ic *ICMPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	switch v := addr.(type) {
+	case *net.IPAddr:
+		addr = &net.UDPAddr{IP: v.IP}
+	case *net.UDPAddr:
+		// nothing
+	default:
+		return 0, syscall.EAFNOSUPPORT
+	}
+	count, err := ic.c.WriteTo(p, addr)
+	return count, MapUNetError(err)
+}
+
+// Close implements net.PacketConn.
+func (ic *ICMPConn) Close() error {
+	ic.untrack()
+	return ic.c.Close()
+}
+
+// LocalAddr implements net.PacketConn.
+func (ic *ICMPConn) LocalAddr() net.Addr {
+	return ic.c.LocalAddr()
+}
+
+// SetDeadline implements net.PacketConn.
+func (ic *ICMPConn) SetDeadline(t time.Time) error {
+	return ic.c.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (ic *ICMPConn) SetReadDeadline(t time.Time) error {
+	return ic.c.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.PacketConn.
+func (ic *ICMPConn) SetWriteDeadline(t time.Time) error {
+	return ic.c.SetWriteDeadline(t)
+}
@@ -187,6 +187,220 @@ func TestLinkPLR(t *testing.T) {
 	}
 }
 
+// TestNDT0Directions verifies that NDT0 measures the upload and both directions.
+func TestNDT0Directions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip test in short mode")
+	}
+
+	// testcase describes a test case
+	type testcase struct {
+		// direction is the direction to measure
+		direction netem.NDT0Direction
+
+		// expectSent indicates whether the client should send
+		expectSent bool
+
+		// expectReceived indicates whether the client should receive
+		expectReceived bool
+	}
+
+	var testcases = []testcase{{
+		direction:      netem.NDT0DirectionDownload,
+		expectSent:     false,
+		expectReceived: true,
+	}, {
+		direction:      netem.NDT0DirectionUpload,
+		expectSent:     true,
+		expectReceived: false,
+	}, {
+		direction:      netem.NDT0DirectionBidirectional,
+		expectSent:     true,
+		expectReceived: true,
+	}}
+
+	for _, tc := range testcases {
+		t.Run(string(tc.direction), func(t *testing.T) {
+			// create a point-to-point topology with some latency
+			topology := netem.MustNewPPPTopology(
+				"10.0.0.2",
+				"10.0.0.1",
+				log.Log,
+				&netem.LinkConfig{
+					LeftToRightDelay: 10 * time.Millisecond,
+					RightToLeftDelay: 10 * time.Millisecond,
+				},
+			)
+			defer topology.Close()
+
+			// make sure we have a deadline bound context
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			// start an NDT0 server in the background
+			options := &netem.NDT0Options{Direction: tc.direction}
+			ready, serverErrorCh := make(chan net.Listener, 1), make(chan error, 1)
+			go netem.RunNDT0ServerWithOptions(
+				ctx,
+				topology.Server,
+				net.ParseIP("10.0.0.1"),
+				443,
+				log.Log,
+				ready,
+				serverErrorCh,
+				false,
+				options,
+			)
+
+			// await for the NDT0 server to be listening
+			listener := <-ready
+			defer listener.Close()
+
+			// run NDT0 client in the background and measure speed
+			clientErrorCh := make(chan error, 1)
+			perfch := make(chan *netem.NDT0PerformanceSample)
+			go netem.RunNDT0ClientWithOptions(
+				ctx,
+				topology.Client,
+				"10.0.0.1:443",
+				log.Log,
+				false,
+				options,
+				clientErrorCh,
+				perfch,
+			)
+
+			// collect the final performance sample
+			var final *netem.NDT0PerformanceSample
+			for p := range perfch {
+				if p.Final {
+					final = p
+				}
+			}
+			if final == nil {
+				t.Fatal("did not collect the final sample")
+			}
+			t.Log("sent", final.AvgSendSpeedMbps(), "received", final.AvgSpeedMbps())
+
+			// make sure the sample includes the transport state
+			if final.ConnStats == nil || final.ConnStats.CongestionWindow <= 0 || final.ConnStats.RTT <= 0 {
+				t.Fatalf("unexpected conn stats %+v", final.ConnStats)
+			}
+
+			// make sure we moved data in the expected directions
+			if got := final.SentTotal > 0; got != tc.expectSent {
+				t.Fatal("unexpected sent total", final.SentTotal)
+			}
+			if got := final.ReceivedTotal > 0; got != tc.expectReceived {
+				t.Fatal("unexpected received total", final.ReceivedTotal)
+			}
+
+			// make sure that neither the client nor the server
+			// reported a fundamental error
+			if err := <-clientErrorCh; err != nil {
+				t.Fatal(err)
+			}
+			if err := <-serverErrorCh; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestNDT0SampleIntervalAndMessageSize verifies that we can configure
+// the NDT0 sample interval and message size.
+func TestNDT0SampleIntervalAndMessageSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip test in short mode")
+	}
+
+	// create a point-to-point topology with some latency
+	topology := netem.MustNewPPPTopology(
+		"10.0.0.2",
+		"10.0.0.1",
+		log.Log,
+		&netem.LinkConfig{
+			LeftToRightDelay: 10 * time.Millisecond,
+			RightToLeftDelay: 10 * time.Millisecond,
+		},
+	)
+	defer topology.Close()
+
+	// make sure we have a deadline bound context
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// start an NDT0 server in the background
+	options := &netem.NDT0Options{
+		Direction:      netem.NDT0DirectionUpload,
+		MessageSize:    1000,
+		SampleInterval: 100 * time.Millisecond,
+	}
+	ready, serverErrorCh := make(chan net.Listener, 1), make(chan error, 1)
+	go netem.RunNDT0ServerWithOptions(
+		ctx,
+		topology.Server,
+		net.ParseIP("10.0.0.1"),
+		443,
+		log.Log,
+		ready,
+		serverErrorCh,
+		false,
+		options,
+	)
+
+	// await for the NDT0 server to be listening
+	listener := <-ready
+	defer listener.Close()
+
+	// run NDT0 client in the background and measure speed
+	clientErrorCh := make(chan error, 1)
+	perfch := make(chan *netem.NDT0PerformanceSample)
+	go netem.RunNDT0ClientWithOptions(
+		ctx,
+		topology.Client,
+		"10.0.0.1:443",
+		log.Log,
+		false,
+		options,
+		clientErrorCh,
+		perfch,
+	)
+
+	// collect the performance samples
+	var samples []*netem.NDT0PerformanceSample
+	for p := range perfch {
+		samples = append(samples, p)
+	}
+	t.Log("got", len(samples), "samples")
+
+	// with a 100 ms interval we expect roughly 20 samples
+	if len(samples) < 15 || len(samples) > 21 {
+		t.Fatal("unexpected number of samples", len(samples))
+	}
+
+	// since the client only sends, the messages should be exactly sent unless
+	// we're interrupted in the middle of the last write
+	final := samples[len(samples)-1]
+	if final.SentTotal <= 0 {
+		t.Fatal("expected to send some data")
+	}
+	for _, sample := range samples[:len(samples)-1] {
+		if sample.SentTotal%1000 != 0 {
+			t.Fatal("expected whole messages", sample.SentTotal)
+		}
+	}
+
+	// make sure that neither the client nor the server
+	// reported a fundamental error
+	if err := <-clientErrorCh; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serverErrorCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
 // TestRoutingWorksDNS verifies that routing is working for a simple
 // network usage pattern such as using the DNS.
 func TestRoutingWorksDNS(t *testing.T) {
@@ -1331,7 +1545,7 @@ func TestDPISpoofDNSResponse(t *testing.T) {
 			defer dnsServer.Close()
 
 			// perform the DNS round trip
-			clientNetStack := &netem.Net{clientStack}
+			clientNetStack := &netem.Net{Stack: clientStack}
 			addrs, err := clientNetStack.LookupHost(ctx, tc.usedDomain)
 			if err != nil {
 				t.Fatal(err)
@@ -0,0 +1,226 @@
+package netem
+
+//
+// "Internet in a box" preset topology
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// InternetInABoxResolver describes a public resolver inside [InternetInABox].
+type InternetInABoxResolver struct {
+	// Address is the MANDATORY resolver IPv4 address (e.g., "8.8.8.8").
+	Address string
+
+	// Name is the OPTIONAL name used for DNS-over-TLS (e.g., "dns.google").
+	Name string
+}
+
+// InternetInABoxSite describes a website inside [InternetInABox].
+type InternetInABoxSite struct {
+	// Address is the MANDATORY website IPv4 address.
+	Address string
+
+	// Domains contains the MANDATORY domains of the website, the first
+	// of which is also used as the title of the served web page.
+	Domains []string
+
+	// QUIC OPTIONALLY indicates that the website also supports HTTP/3, in
+	// which case the HTTPS responses advertise HTTP/3 using Alt-Svc.
+	QUIC bool
+}
+
+// DefaultInternetInABoxResolvers contains the default resolvers.
+var DefaultInternetInABoxResolvers = []*InternetInABoxResolver{{
+	Address: "8.8.8.8",
+	Name:    "dns.google",
+}, {
+	Address: "1.1.1.1",
+	Name:    "one.one.one.one",
+}}
+
+// DefaultInternetInABoxSites contains the default websites.
+var DefaultInternetInABoxSites = []*InternetInABoxSite{{
+	Address: "93.184.215.14",
+	Domains: []string{"example.com", "www.example.com"},
+}, {
+	Address: "185.15.59.224",
+	Domains: []string{"www.wikipedia.org", "wikipedia.org"},
+}, {
+	Address: "116.202.120.166",
+	Domains: []string{"www.torproject.org", "torproject.org"},
+}, {
+	Address: "104.16.124.96",
+	Domains: []string{"www.cloudflare.com", "cloudflare.com"},
+	QUIC:    true,
+}}
+
+// InternetInABoxConfig contains the [InternetInABox] configuration. With the
+// zero value, we create the default resolvers and websites.
+type InternetInABoxConfig struct {
+	// Resolvers contains the OPTIONAL resolvers, which serve DNS over UDP,
+	// TCP, and TLS (default: [DefaultInternetInABoxResolvers]).
+	Resolvers []*InternetInABoxResolver
+
+	// Sites contains the OPTIONAL websites, which serve a web page over HTTP
+	// and HTTPS (default: [DefaultInternetInABoxSites]).
+	Sites []*InternetInABoxSite
+}
+
+// ErrInternetInABoxConfig indicates that an [InternetInABoxConfig] is invalid.
+var ErrInternetInABoxConfig = errors.New("netem: invalid InternetInABox config")
+
+// InternetInABox is a [StarTopology] with common public services running at
+// their well-known addresses, which allows integration tests to target
+// realistic addresses without building everything by hand. All the resolvers
+// share the same [DNSConfig], which contains the records of the websites, and
+// you can modify it using [InternetInABox.DNSConfig]. Use [InternetInABox.AddClient]
+// to add clients and [StarTopology.AddHost] to add other hosts. The zero value
+// is invalid, please construct using [NewInternetInABox].
+type InternetInABox struct {
+	// Topology is the underlying [StarTopology], which also
+	// owns the servers running on the hosts.
+	Topology *StarTopology
+
+	dnsConfig *DNSConfig
+	once      sync.Once
+	resolver  string
+}
+
+// NewInternetInABox creates a new [InternetInABox]. Remember to call
+// [InternetInABox.Close] when done.
+func NewInternetInABox(logger Logger, config *InternetInABoxConfig) (*InternetInABox, error) {
+	resolvers := config.Resolvers
+	if resolvers == nil {
+		resolvers = DefaultInternetInABoxResolvers
+	}
+	if len(resolvers) <= 0 {
+		return nil, fmt.Errorf("%w: no resolvers", ErrInternetInABoxConfig)
+	}
+	sites := config.Sites
+	if sites == nil {
+		sites = DefaultInternetInABoxSites
+	}
+
+	ib := &InternetInABox{
+		Topology:  MustNewStarTopology(logger),
+		dnsConfig: NewDNSConfig(),
+		once:      sync.Once{},
+		resolver:  resolvers[0].Address,
+	}
+	if err := ib.build(logger, resolvers, sites); err != nil {
+		ib.Close()
+		return nil, err
+	}
+	return ib, nil
+}
+
+// build creates the resolvers and the websites.
+func (ib *InternetInABox) build(logger Logger, resolvers []*InternetInABoxResolver, sites []*InternetInABoxSite) error {
+	for _, site := range sites {
+		for _, domain := range site.Domains {
+			if err := ib.dnsConfig.AddRecord(domain, "", site.Address); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, resolver := range resolvers {
+		host, err := ib.Topology.AddNamedHost(resolver.Name, resolver.Address, resolver.Address, &LinkConfig{})
+		if err != nil {
+			return err
+		}
+		server, err := NewDNSServer(logger, host, resolver.Address, ib.dnsConfig)
+		if err != nil {
+			return err
+		}
+		ib.Topology.TrackServer(server)
+		var serverNames []string
+		if resolver.Name != "" {
+			serverNames = append(serverNames, resolver.Name)
+		}
+		dotServer, err := NewDoTServerWithOptions(
+			logger, host, resolver.Address, ib.dnsConfig, &DNSServerOptions{TLSServerNames: serverNames})
+		if err != nil {
+			return err
+		}
+		ib.Topology.TrackServer(dotServer)
+	}
+
+	for _, site := range sites {
+		if len(site.Domains) <= 0 {
+			return fmt.Errorf("%w: no domains for %s", ErrInternetInABoxConfig, site.Address)
+		}
+		host, err := ib.Topology.AddNamedHost(site.Domains[0], site.Address, ib.resolver, &LinkConfig{})
+		if err != nil {
+			return err
+		}
+		if err := ib.startSite(logger, host, site); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startSite starts the servers of a website.
+func (ib *InternetInABox) startSite(logger Logger, host *UNetStack, site *InternetInABoxSite) error {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if site.QUIC && r.TLS != nil {
+			w.Header().Set("Alt-Svc", `h3=":443"`)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<html><head><title>%s</title></head><body><h1>%s</h1></body></html>\n",
+			site.Domains[0], site.Domains[0])
+	})
+
+	ns := &Net{Stack: host}
+	parsedIP := net.ParseIP(site.Address)
+	httpListener, err := ns.ListenTCP("tcp", &net.TCPAddr{IP: parsedIP, Port: 80})
+	if err != nil {
+		return err
+	}
+	tlsConfig := host.MustNewServerTLSConfig(site.Address, site.Domains...)
+	httpsListener, err := ns.ListenTLS("tcp", &net.TCPAddr{IP: parsedIP, Port: 443}, tlsConfig)
+	if err != nil {
+		httpListener.Close()
+		return err
+	}
+	for _, listener := range []net.Listener{httpListener, httpsListener} {
+		server := &http.Server{Handler: handler}
+		ib.Topology.TrackServer(server)
+		go server.Serve(listener)
+	}
+
+	if site.QUIC {
+		server, err := NewHTTP3Server(logger, host, site.Address, 443, handler, site.Domains...)
+		if err != nil {
+			return err
+		}
+		ib.Topology.TrackServer(server)
+	}
+	return nil
+}
+
+// AddClient adds a client with the given address and [LinkConfig] that
+// uses the first resolver (by default, 8.8.8.8).
+func (ib *InternetInABox) AddClient(address string, lc *LinkConfig) (*UNetStack, error) {
+	return ib.Topology.AddHost(address, ib.resolver, lc)
+}
+
+// DNSConfig returns the [DNSConfig] shared by all the resolvers.
+func (ib *InternetInABox) DNSConfig() *DNSConfig {
+	return ib.dnsConfig
+}
+
+// Close closes the topology and all the servers.
+func (ib *InternetInABox) Close() error {
+	ib.once.Do(func() {
+		ib.Topology.Close()
+	})
+	return nil
+}
@@ -0,0 +1,81 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestInternetInABox(t *testing.T) {
+	ib := Must1(NewInternetInABox(&NullLogger{}, &InternetInABoxConfig{}))
+	defer ib.Close()
+	client := Must1(ib.AddClient("10.0.0.2", &LinkConfig{}))
+
+	t.Run("the resolvers serve the websites records", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		addrs, _, err := client.GetaddrinfoLookupANY(ctx, "www.example.com")
+		if err != nil || len(addrs) != 1 || addrs[0] != "93.184.215.14" {
+			t.Fatal("unexpected lookup result", addrs, err)
+		}
+		for _, roundTrip := range []func(context.Context, UnderlyingNetwork, string, *dns.Msg) (*dns.Msg, error){
+			DNSRoundTrip, DNSRoundTripTLS,
+		} {
+			resp, err := roundTrip(ctx, client, "1.1.1.1", NewDNSRequestA("www.torproject.org"))
+			if err != nil || len(resp.Answer) != 1 {
+				t.Fatal("unexpected response", resp, err)
+			}
+		}
+	})
+
+	t.Run("the websites serve HTTP and HTTPS", func(t *testing.T) {
+		httpClient := NewHTTPClientWithOptions(client, &HTTPClientOptions{Timeout: 5 * time.Second})
+		for _, URL := range []string{"http://www.wikipedia.org/", "https://www.example.com/", "https://cloudflare.com/"} {
+			resp, err := httpClient.Get(URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := Must1(io.ReadAll(resp.Body))
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "<title>") {
+				t.Fatal("unexpected response", resp.StatusCode, string(body))
+			}
+		}
+	})
+
+	t.Run("the QUIC website advertises and serves HTTP/3", func(t *testing.T) {
+		httpClient := NewHTTPClientWithOptions(client, &HTTPClientOptions{Timeout: 5 * time.Second})
+		resp, err := httpClient.Get("https://www.cloudflare.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Alt-Svc") != `h3=":443"` {
+			t.Fatal("expected HTTP/3 to be advertised", resp.Header)
+		}
+
+		txp := NewHTTP3Transport(client)
+		defer txp.Close()
+		resp, err = (&http.Client{Transport: txp, Timeout: 5 * time.Second}).Get("https://www.cloudflare.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 3 {
+			t.Fatal("unexpected protocol", resp.Proto)
+		}
+	})
+
+	t.Run("we reject configs without resolvers", func(t *testing.T) {
+		_, err := NewInternetInABox(&NullLogger{}, &InternetInABoxConfig{Resolvers: []*InternetInABoxResolver{}})
+		if !errors.Is(err, ErrInternetInABoxConfig) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package netem
+
+//
+// Deliberately invalid TLS certificates
+//
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// InvalidCertificateKind describes how a certificate created by
+// [CA.MustNewInvalidTLSCertificate] is invalid.
+type InvalidCertificateKind int
+
+const (
+	// InvalidCertificateExpired is a certificate signed by the [CA]
+	// whose validity period ended in the past.
+	InvalidCertificateExpired = InvalidCertificateKind(iota + 1)
+
+	// InvalidCertificateWrongHostname is a certificate signed by the [CA]
+	// that is only valid for [InvalidCertificateHostname].
+	InvalidCertificateWrongHostname
+
+	// InvalidCertificateSelfSigned is a self-signed certificate.
+	InvalidCertificateSelfSigned
+
+	// InvalidCertificateUntrustedChain is a certificate signed by a
+	// freshly generated CA that clients do not trust.
+	InvalidCertificateUntrustedChain
+)
+
+// InvalidCertificateHostname is the only name for which a certificate
+// using [InvalidCertificateWrongHostname] is valid.
+const InvalidCertificateHostname = "wrong.host.netem.invalid"
+
+// String implements fmt.Stringer.
+func (kind InvalidCertificateKind) String() string {
+	switch kind {
+	case InvalidCertificateExpired:
+		return "expired"
+	case InvalidCertificateWrongHostname:
+		return "wrong_hostname"
+	case InvalidCertificateSelfSigned:
+		return "self_signed"
+	case InvalidCertificateUntrustedChain:
+		return "untrusted_chain"
+	default:
+		return fmt.Sprintf("InvalidCertificateKind(%d)", int(kind))
+	}
+}
+
+// MustNewInvalidTLSCertificate is like [CA.MustNewTLSCertificate] but returns a certificate
+// that clients using [CA.DefaultCertPool] reject with the given kind of error. This method
+// PANICS if the kind is unknown. Note that the returned certificate is freshly created
+// and does not take into account certificates registered with [CA.AddStaticCertificate].
+func (ca *CA) MustNewInvalidTLSCertificate(kind InvalidCertificateKind,
+	commonName string, extraNames ...string) *tls.Certificate {
+	switch kind {
+	case InvalidCertificateExpired:
+		tmpl := ca.newLeafTemplate(time.Now, commonName, extraNames...)
+		tmpl.NotAfter = time.Now().Add(-ca.validity)
+		tmpl.NotBefore = tmpl.NotAfter.Add(-2 * ca.validity)
+		return ca.mustIssueLeaf(tmpl)
+
+	case InvalidCertificateWrongHostname:
+		tmpl := ca.newLeafTemplate(time.Now, InvalidCertificateHostname)
+		return ca.mustIssueLeaf(tmpl)
+
+	case InvalidCertificateSelfSigned:
+		tmpl := ca.newLeafTemplate(time.Now, commonName, extraNames...)
+		return ca.mustSignLeaf(tmpl, ca.priv)
+
+	case InvalidCertificateUntrustedChain:
+		tmpl := ca.newLeafTemplate(time.Now, commonName, extraNames...)
+		untrusted, untrustedKey := caMustNewAuthority("jafar", "OONI Netem Untrusted CA", 24*time.Hour, time.Now)
+		return ca.mustSignLeaf(tmpl, untrustedKey, untrusted)
+
+	default:
+		panic(fmt.Sprintf("netem: unknown invalid certificate kind: %s", kind))
+	}
+}
+
+// AddInvalidCertificate uses [CA.MustNewInvalidTLSCertificate] to create an invalid certificate
+// for the given server name and registers it using [CA.AddStaticCertificate], such that TLS
+// servers present it to clients using serverName as the SNI. This allows to trigger client-side
+// certificate validation failures on demand. This method PANICS if the kind is unknown.
+func (ca *CA) AddInvalidCertificate(serverName string, kind InvalidCertificateKind) {
+	ca.AddStaticCertificate(serverName, ca.MustNewInvalidTLSCertificate(kind, serverName))
+}
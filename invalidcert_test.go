@@ -0,0 +1,93 @@
+package netem
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestInvalidCertificates(t *testing.T) {
+	type testcase struct {
+		kind  InvalidCertificateKind
+		check func(err error) bool
+	}
+
+	testcases := []testcase{{
+		kind: InvalidCertificateExpired,
+		check: func(err error) bool {
+			var certErr x509.CertificateInvalidError
+			return errors.As(err, &certErr) && certErr.Reason == x509.Expired
+		},
+	}, {
+		kind: InvalidCertificateWrongHostname,
+		check: func(err error) bool {
+			var hostErr x509.HostnameError
+			return errors.As(err, &hostErr)
+		},
+	}, {
+		kind: InvalidCertificateSelfSigned,
+		check: func(err error) bool {
+			var authErr x509.UnknownAuthorityError
+			return errors.As(err, &authErr)
+		},
+	}, {
+		kind: InvalidCertificateUntrustedChain,
+		check: func(err error) bool {
+			var authErr x509.UnknownAuthorityError
+			return errors.As(err, &authErr)
+		},
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.kind.String(), func(t *testing.T) {
+			topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+			defer topology.Close()
+			topology.CA().AddInvalidCertificate("bad.example.com", tc.kind)
+
+			serverNet := &Net{Stack: topology.Server}
+			tlsConfig := topology.Server.MustNewServerTLSConfig("10.0.0.1", "bad.example.com", "good.example.com")
+			listener := Must1(serverNet.ListenTLS("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, tlsConfig))
+			defer listener.Close()
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						_, _ = conn.Read(make([]byte, 1))
+					}()
+				}
+			}()
+
+			clientNet := &Net{Stack: topology.Client}
+			dial := func(sni string) error {
+				conn := Must1(clientNet.DialContext(context.Background(), "tcp", "10.0.0.1:443"))
+				defer conn.Close()
+				tlsConfig := &tls.Config{RootCAs: topology.Client.DefaultCertPool(), ServerName: sni}
+				return tls.Client(conn, tlsConfig).Handshake()
+			}
+
+			if err := dial("good.example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if err := dial("bad.example.com"); !tc.check(err) {
+				t.Fatal("unexpected error", err)
+			}
+		})
+	}
+
+	t.Run("we panic on unknown kinds", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(r.(string), "InvalidCertificateKind(0)") {
+				t.Fatal("unexpected recover value", r)
+			}
+		}()
+		MustNewCA().MustNewInvalidTLSCertificate(0, "example.com")
+	})
+}
@@ -0,0 +1,69 @@
+package netem
+
+//
+// TLS key logging
+//
+
+import (
+	"io"
+	"sync"
+)
+
+// TLSKeyLogger is the interface implemented by an [UnderlyingNetwork] that
+// logs the TLS session secrets. [UNetStack] implements this interface.
+type TLSKeyLogger interface {
+	// TLSKeyLogWriter returns the writer where to write the TLS session
+	// secrets in NSS key log format or nil if key logging is disabled.
+	TLSKeyLogWriter() io.Writer
+}
+
+var _ TLSKeyLogger = &UNetStack{}
+
+// SetTLSKeyLogWriter configures the writer where to write the secrets of the TLS
+// sessions using this stack in NSS key log format (i.e., the SSLKEYLOGFILE format),
+// which allows Wireshark to decrypt the PCAPs of emulated HTTPS traffic. Passing
+// nil disables key logging, which is the default.
+//
+// Key logging applies to the TLS configs created by [UNetStack.MustNewServerTLSConfig]
+// and to [Net.DialTLSContext], [Net.ListenTLS], and [DNSRoundTripTLS], therefore you
+// should call this method before creating servers and clients. You can share the same
+// writer among several stacks, since we serialize the writes.
+func (gs *UNetStack) SetTLSKeyLogWriter(w io.Writer) {
+	if w == nil {
+		gs.keyLogWriter.Store(nil)
+		return
+	}
+	gs.keyLogWriter.Store(&tlsKeyLogWriter{w})
+}
+
+// TLSKeyLogWriter implements TLSKeyLogger.
+func (gs *UNetStack) TLSKeyLogWriter() io.Writer {
+	if w := gs.keyLogWriter.Load(); w != nil {
+		return w
+	}
+	return nil // avoid returning a nil pointer wrapped by an interface
+}
+
+// tlsKeyLogWriterFor returns the key log writer of the given stack, if any.
+func tlsKeyLogWriterFor(stack any) io.Writer {
+	if kl, ok := stack.(TLSKeyLogger); ok {
+		return kl.TLSKeyLogWriter()
+	}
+	return nil
+}
+
+// tlsKeyLogMu serializes the writes of all the [tlsKeyLogWriter], such
+// that stacks sharing the same writer do not interleave lines.
+var tlsKeyLogMu sync.Mutex
+
+// tlsKeyLogWriter is an [io.Writer] serializing writes.
+type tlsKeyLogWriter struct {
+	w io.Writer
+}
+
+// Write implements io.Writer.
+func (kw *tlsKeyLogWriter) Write(data []byte) (int, error) {
+	defer tlsKeyLogMu.Unlock()
+	tlsKeyLogMu.Lock()
+	return kw.w.Write(data)
+}
@@ -0,0 +1,86 @@
+package netem
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// keyLogBuffer is a goroutine safe buffer.
+type keyLogBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (kb *keyLogBuffer) Write(data []byte) (int, error) {
+	defer kb.mu.Unlock()
+	kb.mu.Lock()
+	return kb.buf.Write(data)
+}
+
+// clientRandoms returns the client randoms of the CLIENT_TRAFFIC_SECRET_0 lines.
+func (kb *keyLogBuffer) clientRandoms() (out []string) {
+	defer kb.mu.Unlock()
+	kb.mu.Lock()
+	for _, line := range strings.Split(kb.buf.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "CLIENT_TRAFFIC_SECRET_0" {
+			out = append(out, fields[1])
+		}
+	}
+	return
+}
+
+func TestTLSKeyLog(t *testing.T) {
+	t.Run("we log the secrets on both the client and the server side", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		clientLog, serverLog := &keyLogBuffer{}, &keyLogBuffer{}
+		topology.Client.SetTLSKeyLogWriter(clientLog)
+		topology.Server.SetTLSKeyLogWriter(serverLog)
+
+		serverNet := &Net{Stack: topology.Server}
+		tlsConfig := topology.Server.CA().MustNewServerTLSConfig("10.0.0.1")
+		listener := Must1(serverNet.ListenTLS("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, tlsConfig))
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = conn.Read(make([]byte, 1))
+		}()
+
+		clientNet := &Net{Stack: topology.Client}
+		conn := Must1(clientNet.DialTLSContext(context.Background(), "tcp", "10.0.0.1:443"))
+		conn.Close()
+
+		clientRandoms := clientLog.clientRandoms()
+		if len(clientRandoms) != 1 {
+			t.Fatal("expected one client secret, got", len(clientRandoms))
+		}
+		serverRandoms := serverLog.clientRandoms()
+		if len(serverRandoms) != 1 || serverRandoms[0] != clientRandoms[0] {
+			t.Fatal("unexpected server secrets", serverRandoms, clientRandoms)
+		}
+	})
+
+	t.Run("key logging is disabled by default and when passing nil", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		if topology.Client.TLSKeyLogWriter() != nil {
+			t.Fatal("expected nil writer")
+		}
+		topology.Client.SetTLSKeyLogWriter(&keyLogBuffer{})
+		if topology.Client.MustNewServerTLSConfig("10.0.0.2").KeyLogWriter == nil {
+			t.Fatal("expected non-nil writer")
+		}
+		topology.Client.SetTLSKeyLogWriter(nil)
+		if topology.Client.TLSKeyLogWriter() != nil {
+			t.Fatal("expected nil writer")
+		}
+	})
+}
@@ -5,6 +5,9 @@ package netem
 //
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -17,6 +20,14 @@ type LinkNICWrapper interface {
 
 // LinkConfig contains config for creating a [Link].
 type LinkConfig struct {
+	// Conntrack is the OPTIONAL [Conntrack] tracking the flows of the
+	// frames that the link delivers in either direction.
+	Conntrack *Conntrack
+
+	// DecisionLog is the OPTIONAL [DecisionLog] recording or replaying the
+	// packet losses, the jitter, and the DPI verdicts of the link.
+	DecisionLog *DecisionLog
+
 	// DPIEngine is the OPTIONAL [DPIEngine].
 	DPIEngine *DPIEngine
 
@@ -37,6 +48,9 @@ type LinkConfig struct {
 
 	// RightToLeftPLR is the OPTIONAL packet-loss rate in the right->left direction.
 	RightToLeftPLR float64
+
+	// Tracer is the OPTIONAL [Tracer] receiving the link and DPI events.
+	Tracer Tracer
 }
 
 // maybeWrapNICs wraps the NICs if the configuration says we should do that.
@@ -63,12 +77,21 @@ type Link struct {
 	// closeOnce allows Close to have a "once" semantics.
 	closeOnce sync.Once
 
+	// config is the link config.
+	config *LinkConfig
+
+	// leftToRight contains the left->right counters.
+	leftToRight *linkFwdCounters
+
 	// left is the left network stack.
 	left NIC
 
 	// right is the right network stack.
 	right NIC
 
+	// rightToLeft contains the right->left counters.
+	rightToLeft *linkFwdCounters
+
 	// wg allows us to wait for the background goroutines
 	wg *sync.WaitGroup
 }
@@ -91,8 +114,12 @@ func NewLink(logger Logger, left, right NIC, config *LinkConfig) *Link {
 	left, right = config.maybeWrapNICs(left, right)
 
 	// forward traffic from left to right
+	leftToRight := &linkFwdCounters{}
 	wg.Add(1)
 	go linkForwardChooseBest(
+		leftToRight,
+		newLinkFwdDecisions(config.DecisionLog, left, right),
+		config.Conntrack,
 		left,
 		right,
 		wg,
@@ -100,11 +127,16 @@ func NewLink(logger Logger, left, right NIC, config *LinkConfig) *Link {
 		config.DPIEngine,
 		config.LeftToRightPLR,
 		config.LeftToRightDelay,
+		config.Tracer,
 	)
 
 	// forward traffic from right to left
+	rightToLeft := &linkFwdCounters{}
 	wg.Add(1)
 	go linkForwardChooseBest(
+		rightToLeft,
+		newLinkFwdDecisions(config.DecisionLog, right, left),
+		config.Conntrack,
 		right,
 		left,
 		wg,
@@ -112,18 +144,54 @@ func NewLink(logger Logger, left, right NIC, config *LinkConfig) *Link {
 		config.DPIEngine,
 		config.RightToLeftPLR,
 		config.RightToLeftDelay,
+		config.Tracer,
 	)
 
 	link := &Link{
-		closeOnce: sync.Once{},
-		left:      left,
-		right:     right,
-		wg:        wg,
+		closeOnce:   sync.Once{},
+		config:      config,
+		leftToRight: leftToRight,
+		left:        left,
+		right:       right,
+		rightToLeft: rightToLeft,
+		wg:          wg,
 	}
 	return link
 }
 
-// Close closes the [Link].
+// LinkStats contains [Link] statistics.
+type LinkStats struct {
+	// LeftToRight contains the left->right statistics.
+	LeftToRight LinkDirectionStats `json:"left_to_right"`
+
+	// RightToLeft contains the right->left statistics.
+	RightToLeft LinkDirectionStats `json:"right_to_left"`
+}
+
+// LinkDirectionStats contains the statistics of a [Link] direction.
+type LinkDirectionStats struct {
+	// BytesDelivered counts the bytes of the delivered frames.
+	BytesDelivered int64 `json:"bytes_delivered"`
+
+	// FramesDelivered counts the frames delivered to the receiving NIC.
+	FramesDelivered int64 `json:"frames_delivered"`
+
+	// FramesDropped counts the frames dropped because of losses, DPI,
+	// or because the transmission queue was full.
+	FramesDropped int64 `json:"frames_dropped"`
+}
+
+// Stats returns a snapshot of the [Link] statistics.
+func (lnk *Link) Stats() LinkStats {
+	return LinkStats{
+		LeftToRight: lnk.leftToRight.snapshot(),
+		RightToLeft: lnk.rightToLeft.snapshot(),
+	}
+}
+
+// Close closes the [Link]. This method closes both NICs, which flushes
+// any NIC wrapper (e.g., a [PCAPDumper]), and waits for the link's
+// goroutines to terminate. It is safe to call Close more than once.
 func (lnk *Link) Close() error {
 	lnk.closeOnce.Do(func() {
 		lnk.left.Close()
@@ -132,3 +200,23 @@ func (lnk *Link) Close() error {
 	})
 	return nil
 }
+
+// ErrShutdownTimeout indicates that some goroutines did not terminate before
+// the context passed to a Shutdown method expired, i.e., they leaked.
+var ErrShutdownTimeout = errors.New("netem: shutdown timed out")
+
+// Shutdown is like [Link.Close] but stops waiting for the link's goroutines
+// when the given context expires, in which case it returns [ErrShutdownTimeout].
+func (lnk *Link) Shutdown(ctx context.Context) error {
+	done := make(chan any)
+	go func() {
+		lnk.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: link goroutines still running", ErrShutdownTimeout)
+	}
+}
@@ -5,9 +5,11 @@ package netem
 //
 
 import (
+	"errors"
 	"math/rand"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +27,9 @@ var _ LinkFwdRNG = &rand.Rand{}
 // LinkFwdConfig contains config for frame forwarding algorithms. Make sure
 // you initialize all the fields marked as MANDATORY.
 type LinkFwdConfig struct {
+	// Conntrack is the OPTIONAL [Conntrack] tracking the delivered frames.
+	Conntrack *Conntrack
+
 	// DPIEngine is the OPTIONAL DPI engine.
 	DPIEngine *DPIEngine
 
@@ -44,6 +49,9 @@ type LinkFwdConfig struct {
 	// Reader is the MANDATORY [NIC] from which to read frames.
 	Reader ReadableNIC
 
+	// Tracer is the OPTIONAL [Tracer].
+	Tracer Tracer
+
 	// Writer is the MANDATORY [NIC] where to write frames.
 	Writer WriteableNIC
 
@@ -71,6 +79,93 @@ func (cfg *LinkFwdConfig) maybeInspectWithDPI(payload []byte) (*DPIPolicy, bool)
 	return nil, false
 }
 
+// linkFwdDecisions contains the OPTIONAL streams of a [DecisionLog]
+// used by a link direction.
+type linkFwdDecisions struct {
+	rng      *decisionStream
+	verdicts *decisionStream
+}
+
+// newLinkFwdDecisions creates the [linkFwdDecisions] for the direction
+// from the reader to the writer, or returns nil if the log is nil.
+func newLinkFwdDecisions(dl *DecisionLog, reader, writer NIC) *linkFwdDecisions {
+	if dl == nil {
+		return nil
+	}
+	direction := reader.IPAddress() + "->" + writer.IPAddress()
+	return &linkFwdDecisions{
+		rng:      dl.newStream("link/" + direction),
+		verdicts: dl.newStream("dpi/" + direction),
+	}
+}
+
+// linkFwdCounters contains the counters of a link direction.
+type linkFwdCounters struct {
+	bytesDelivered  atomic.Int64
+	framesDelivered atomic.Int64
+	framesDropped   atomic.Int64
+}
+
+// snapshot returns the [LinkDirectionStats].
+func (c *linkFwdCounters) snapshot() LinkDirectionStats {
+	return LinkDirectionStats{
+		BytesDelivered:  c.bytesDelivered.Load(),
+		FramesDelivered: c.framesDelivered.Load(),
+		FramesDropped:   c.framesDropped.Load(),
+	}
+}
+
+// countDelivered updates the OPTIONAL counters and the OPTIONAL [Conntrack]
+// after we delivered a frame.
+func (cfg *LinkFwdConfig) countDelivered(counters *linkFwdCounters, frame *Frame) {
+	cfg.Conntrack.observe(frame.Payload)
+	if counters != nil {
+		counters.bytesDelivered.Add(int64(len(frame.Payload)))
+		counters.framesDelivered.Add(1)
+	}
+}
+
+// countDropped updates the OPTIONAL counters after we dropped a frame.
+func (cfg *LinkFwdConfig) countDropped(counters *linkFwdCounters) {
+	if counters != nil {
+		counters.framesDropped.Add(1)
+	}
+}
+
+// maybeTrace emits a [TraceEvent] for the given frame if we have a [Tracer],
+// calling the given OPTIONAL function to fill the event-specific fields.
+func (cfg *LinkFwdConfig) maybeTrace(eventType TraceEventType, frame *Frame, fx func(ev *TraceEvent)) {
+	if cfg.Tracer == nil {
+		return
+	}
+	location := cfg.Reader.InterfaceName() + "->" + cfg.Writer.InterfaceName()
+	ev := newTraceEventForPacket(eventType, location, frame.Payload)
+	if fx != nil {
+		fx(ev)
+	}
+	cfg.Tracer.OnTraceEvent(ev)
+}
+
+// linkFwdDrain reads all the frames currently available from the reader
+// and passes each of them to the given function. Processing frames in batches
+// amortizes the cost of waking up the forwarding goroutine across all the
+// frames that arrived in the meanwhile. The spurious notifications left behind
+// by batching cause ReadFrameNonblocking to fail with [ErrNoPacket], which
+// is why we do not log this specific error.
+func linkFwdDrain(cfg *LinkFwdConfig, fx func(frame *Frame)) {
+	for {
+		frame, err := cfg.Reader.ReadFrameNonblocking()
+		if errors.Is(err, ErrNoPacket) {
+			return
+		}
+		if err != nil {
+			cfg.Logger.Warnf("netem: ReadFrameNonblocking: %s", err.Error())
+			return
+		}
+		fx(frame)
+	}
+}
+
 // linkFwdSortFrameSliceInPlace is a convenience function to sort
 // a slice containing frames in place.
 func linkFwdSortFrameSliceInPlace(frames []*Frame) {
@@ -79,9 +174,26 @@ func linkFwdSortFrameSliceInPlace(frames []*Frame) {
 	})
 }
 
+// linkFwdUntilNextFrame returns the time until the deadline of the first frame in
+// the given slice, which MUST be sorted by deadline, or the given idle interval
+// when the slice is empty. The returned value is always positive.
+func linkFwdUntilNextFrame(frames []*Frame, idle time.Duration) time.Duration {
+	if len(frames) <= 0 {
+		return idle
+	}
+	d := time.Until(frames[0].Deadline)
+	if d <= 0 {
+		d = time.Nanosecond // avoid panic
+	}
+	return d
+}
+
 // linkForwardChooseBest forwards frames on the link. This function selects the right
 // implementation depending on the provided configuration.
 func linkForwardChooseBest(
+	counters *linkFwdCounters,
+	decisions *linkFwdDecisions,
+	conntrack *Conntrack,
 	reader ReadableNIC,
 	writer WriteableNIC,
 	wg *sync.WaitGroup,
@@ -89,24 +201,34 @@ func linkForwardChooseBest(
 	dpiEngine *DPIEngine,
 	plr float64,
 	oneWayDelay time.Duration,
+	tracer Tracer,
 ) {
 	cfg := &LinkFwdConfig{
+		Conntrack:     conntrack,
 		DPIEngine:     dpiEngine,
 		Logger:        logger,
 		NewLinkFwdRNG: nil,
 		OneWayDelay:   oneWayDelay,
 		PLR:           plr,
 		Reader:        reader,
+		Tracer:        tracer,
 		Writer:        writer,
 		Wg:            wg,
 	}
+	var verdicts *decisionStream
+	if decisions != nil {
+		cfg.NewLinkFwdRNG = func() LinkFwdRNG {
+			return decisions.rng
+		}
+		verdicts = decisions.verdicts
+	}
 	if dpiEngine == nil && plr <= 0 && oneWayDelay <= 0 {
-		LinkFwdFast(cfg)
+		linkFwdFast(cfg, counters)
 		return
 	}
 	if dpiEngine == nil && plr <= 0 {
-		LinkFwdWithDelay(cfg)
+		linkFwdWithDelay(cfg, counters)
 		return
 	}
-	LinkFwdFull(cfg)
+	linkFwdFull(cfg, counters, verdicts)
 }
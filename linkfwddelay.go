@@ -12,6 +12,11 @@ import (
 // LinkFwdWithDelay is an implementation of link forwarding that only
 // delays packets without losses and deep packet inspection.
 func LinkFwdWithDelay(cfg *LinkFwdConfig) {
+	linkFwdWithDelay(cfg, nil)
+}
+
+// linkFwdWithDelay implements [LinkFwdWithDelay] updating the OPTIONAL counters.
+func linkFwdWithDelay(cfg *LinkFwdConfig, counters *linkFwdCounters) {
 	// informative logging
 	linkName := fmt.Sprintf(
 		"linkFwdWithDelay %s<->%s",
@@ -38,64 +43,43 @@ func LinkFwdWithDelay(cfg *LinkFwdConfig) {
 			return
 
 		case <-cfg.Reader.FrameAvailable():
-			frame, err := cfg.Reader.ReadFrameNonblocking()
-			if err != nil {
-				cfg.Logger.Warnf("netem: ReadFrameNonblocking: %s", err.Error())
-				continue
-			}
-
-			// avoid potential data races
-			frame = frame.ShallowCopy()
-
-			// create frame deadline
-			d := time.Now().Add(cfg.OneWayDelay)
-			frame.Deadline = d
-
-			// register as inflight and possibly rearm timer
-			inflight = append(inflight, frame)
-			if len(inflight) == 1 {
-				d := time.Until(frame.Deadline)
-				if d <= 0 {
-					d = time.Nanosecond // avoid panic
+			linkFwdDrain(cfg, func(frame *Frame) {
+				// avoid potential data races
+				frame = frame.ShallowCopy()
+				cfg.maybeTrace(TraceEventFrameEnqueued, frame, nil)
+				cfg.maybeTrace(TraceEventFrameDelayed, frame, func(ev *TraceEvent) {
+					ev.Delay = cfg.OneWayDelay
+				})
+
+				// create frame deadline
+				d := time.Now().Add(cfg.OneWayDelay)
+				frame.Deadline = d
+
+				// register as inflight and possibly rearm timer
+				inflight = append(inflight, frame)
+				if len(inflight) == 1 {
+					ticker.Reset(linkFwdUntilNextFrame(inflight, initialTimer))
 				}
-				ticker.Reset(d)
-			}
+			})
 
 		case <-ticker.C:
-			// avoid wasting CPU with a fast timer if there's nothing to do
-			if len(inflight) <= 0 {
-				ticker.Reset(initialTimer)
-				continue
+			// deliver all the frames that are due, such that we
+			// do not accumulate delay when we wake up late
+			now := time.Now()
+			for len(inflight) > 0 && !inflight[0].Deadline.After(now) {
+				frame := inflight[0]
+				inflight = inflight[1:]
+
+				// avoid leaking the frame deadline to the caller
+				frame.Deadline = time.Time{}
+				cfg.maybeTrace(TraceEventFrameDelivered, frame, nil)
+				cfg.countDelivered(counters, frame)
+				_ = cfg.Writer.WriteFrame(frame)
 			}
 
-			// if the front frame is still pending, rearm timer
-			frame := inflight[0]
-			d := time.Until(frame.Deadline)
-			if d > 0 {
-				ticker.Reset(d)
-				continue
-			}
-
-			// avoid leaking the frame deadline to the caller
-			frame.Deadline = time.Time{}
-
-			// then deliver the front frame
-			inflight = inflight[1:]
-			_ = cfg.Writer.WriteFrame(frame)
-
-			// again, if the channel is empty, avoid wasting CPU
-			if len(inflight) <= 0 {
-				ticker.Reset(initialTimer)
-				continue
-			}
-
-			// rearm timer for the next incoming frame
-			frame = inflight[0]
-			d = time.Until(frame.Deadline)
-			if d <= 0 {
-				d = time.Nanosecond // avoid panic
-			}
-			ticker.Reset(d)
+			// rearm timer for the next frame or, if there's
+			// nothing to do, avoid wasting CPU
+			ticker.Reset(linkFwdUntilNextFrame(inflight, initialTimer))
 		}
 	}
 }
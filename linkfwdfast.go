@@ -9,6 +9,11 @@ import "fmt"
 // LinkFwdFast is the fast implementation of frames forwarding. We select this
 // implementation when there are no configured losses, delay, or DPI.
 func LinkFwdFast(cfg *LinkFwdConfig) {
+	linkFwdFast(cfg, nil)
+}
+
+// linkFwdFast implements [LinkFwdFast] updating the OPTIONAL counters.
+func linkFwdFast(cfg *LinkFwdConfig, counters *linkFwdCounters) {
 	// informative logging
 	linkName := fmt.Sprintf(
 		"linkFwdFast %s<->%s",
@@ -27,12 +32,12 @@ func LinkFwdFast(cfg *LinkFwdConfig) {
 			return
 
 		case <-cfg.Reader.FrameAvailable():
-			frame, err := cfg.Reader.ReadFrameNonblocking()
-			if err != nil {
-				cfg.Logger.Warnf("netem: ReadFrameNonblocking: %s", err.Error())
-				continue
-			}
-			_ = cfg.Writer.WriteFrame(frame)
+			linkFwdDrain(cfg, func(frame *Frame) {
+				cfg.maybeTrace(TraceEventFrameEnqueued, frame, nil)
+				cfg.maybeTrace(TraceEventFrameDelivered, frame, nil)
+				cfg.countDelivered(counters, frame)
+				_ = cfg.Writer.WriteFrame(frame)
+			})
 		}
 	}
 }
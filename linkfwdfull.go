@@ -17,6 +17,12 @@ import (
 // ethernet link. For example, this link allows out-of-order
 // delivery of packets.
 func LinkFwdFull(cfg *LinkFwdConfig) {
+	linkFwdFull(cfg, nil, nil)
+}
+
+// linkFwdFull implements [LinkFwdFull] updating the OPTIONAL counters
+// and recording the DPI verdicts into the OPTIONAL stream.
+func linkFwdFull(cfg *LinkFwdConfig, counters *linkFwdCounters, verdicts *decisionStream) {
 
 	//
 	// 🚨 This algorithm is a bit complex. Be careful to check
@@ -52,31 +58,16 @@ func LinkFwdFull(cfg *LinkFwdConfig) {
 	// synchronize with stop
 	defer cfg.Wg.Done()
 
-	// outgoing contains outgoing frames
-	var outgoing []*Frame
-
-	// accouting for queued bytes
-	var queuedBytes int
-
-	// inflight contains the frames currently in flight
-	var inflight []*Frame
+	// state contains the queues and the transmitter state
+	state := newLinkFwdFullState(cfg, counters, verdicts)
 
-	// We assume that we can send 100 bit/µs (i.e., 100 Mbit/s). We also assume
-	// that a packet is 1500 bytes (i.e., 12000 bits). The constant TX rate
-	// is 120µs, and our code wakes up every 120µs to check for I/O.
-	const bitsPerMicrosecond = 100
-	const constantRate = 120 * time.Microsecond
-
-	// We assume the TX buffer cannot hold more than this amount of bytes
-	const maxQueuedBytes = 1 << 16
-
-	// ticker to schedule I/O
-	ticker := time.NewTicker(constantRate)
+	// We use a single timer, which we rearm to expire when the next frame is
+	// due, and we process all the frames that are due when we wake up. When there
+	// is nothing to do, we wake up rarely to avoid wasting CPU.
+	const idleTimer = 100 * time.Millisecond
+	ticker := time.NewTicker(idleTimer)
 	defer ticker.Stop()
 
-	// random number generator for jitter and PLR
-	rng := cfg.newLinkgFwdRNG()
-
 	for {
 		select {
 		case <-cfg.Reader.StackClosed():
@@ -88,99 +79,223 @@ func LinkFwdFull(cfg *LinkFwdConfig) {
 		// interface, account for the queuing delay, and moderate the queue
 		// to avoid the most severe bufferbloat.
 		case <-cfg.Reader.FrameAvailable():
-			frame, err := cfg.Reader.ReadFrameNonblocking()
-			if err != nil {
-				cfg.Logger.Warnf("netem: ReadFrameNonblocking: %s", err.Error())
-				continue
-			}
-
-			// drop incoming packet if the buffer is full
-			if queuedBytes > maxQueuedBytes {
-				continue
-			}
-
-			// avoid potential data races
-			frame = frame.ShallowCopy()
-
-			// create frame TX deadline accounting for time to send all the
-			// previously queued frames in the outgoing buffer
-			d := time.Now().Add(time.Duration(queuedBytes*8) / bitsPerMicrosecond)
-			frame.Deadline = d
-
-			// add to queue and wait for the TX to wakeup
-			outgoing = append(outgoing, frame)
-			queuedBytes += len(frame.Payload)
-
-		// Ticker to emulate (slotted) sending and receiving over the channel
+			linkFwdDrain(cfg, func(frame *Frame) {
+				state.enqueue(frame, time.Now())
+			})
+
+		// Timer to emulate sending and receiving over the channel
 		case <-ticker.C:
-			// wake up the transmitter first
-			if len(outgoing) > 0 {
-				// avoid head of line blocking that may be caused by adding jitter
-				linkFwdSortFrameSliceInPlace(outgoing)
-
-				// if the front frame is still pending, waste a cycle
-				frame := outgoing[0]
-				if d := time.Until(frame.Deadline); d > 0 {
-					continue
-				}
-
-				// dequeue the first frame in the buffer
-				queuedBytes -= len(frame.Payload)
-				outgoing = outgoing[1:]
-
-				// add random jitter to offset the effect of bursts
-				jitter := time.Duration(rng.Int63n(1000)) * time.Microsecond
-
-				// compute baseline frame PLR
-				framePLR := cfg.PLR
-
-				// allow the DPI to increase a flow's delay
-				var flowDelay time.Duration
-
-				// run the DPI engine, if configured
-				policy, match := cfg.maybeInspectWithDPI(frame.Payload)
-				if match {
-					frame.Flags |= policy.Flags
-					frame.Spoofed = policy.Spoofed
-					framePLR += policy.PLR
-					flowDelay += policy.Delay
-				}
-
-				// check whether we need to drop this frame (we will drop it
-				// at the RX so we simulate it being dropped in flight)
-				if rng.Float64() < framePLR {
-					frame.Flags |= FrameFlagDrop
-				}
-
-				// create frame RX deadline
-				d := time.Now().Add(cfg.OneWayDelay + jitter + flowDelay)
-				frame.Deadline = d
-
-				// congratulations, the frame is now in flight 🚀
-				inflight = append(inflight, frame)
-			}
-
-			// now wake up the receiver
-			if len(inflight) > 0 {
-				// avoid head of line blocking that may be caused by adding jitter
-				linkFwdSortFrameSliceInPlace(inflight)
-
-				// if the front frame is still pending, waste a cycle
-				frame := inflight[0]
-				if d := time.Until(frame.Deadline); d > 0 {
-					continue
-				}
-
-				// the frame is no longer in flight
-				inflight = inflight[1:]
-
-				// don't leak the deadline to the destination NIC
-				frame.Deadline = time.Time{}
-
-				// deliver or drop the frame
-				linkFwdDeliveryOrDrop(cfg.Writer, frame)
-			}
 		}
+
+		// wake up the transmitter first and then the receiver
+		now := time.Now()
+		state.transmit(now)
+		state.receive(now)
+
+		// rearm the timer to expire when the next frame is due
+		next := linkFwdUntilNextFrame(state.outgoing, idleTimer)
+		if d := linkFwdUntilNextFrame(state.inflight, idleTimer); d < next {
+			next = d
+		}
+		ticker.Reset(next)
+	}
+}
+
+// We assume that we can send 100 bit/µs (i.e., 100 Mbit/s), such that
+// sending a 1500 bytes packet (i.e., 12000 bits) takes 120µs.
+const linkFwdFullBitsPerMicrosecond = 100
+
+// We assume that the transmitter is slotted and that each frame occupies at
+// least a slot, which is the time required to send a 1500 bytes packet. Like
+// when we used to wake up at every slot, a frame reaching an idle transmitter
+// waits for the next slot, and the RX deadline starts when we actually send the
+// frame. This preserves the timing (and the relative ordering of segments racing
+// through distinct links) that existing topologies rely on.
+const linkFwdFullTXSlot = 120 * time.Microsecond
+
+// We assume the TX buffer cannot hold more than this amount of bytes
+const linkFwdFullMaxQueuedBytes = 1 << 16
+
+// linkFwdFullState contains the state of [LinkFwdFull]. We factor it out
+// of the forwarding loop, which owns the clock, such that we can process
+// all the frames due at any given time in a single wakeup.
+type linkFwdFullState struct {
+	// cfg is the link configuration.
+	cfg *LinkFwdConfig
+
+	// counters contains the OPTIONAL counters.
+	counters *linkFwdCounters
+
+	// inflight contains the frames currently in flight sorted by deadline.
+	inflight []*Frame
+
+	// outgoing contains outgoing frames sorted by deadline.
+	outgoing []*Frame
+
+	// queuedBytes accounts for the bytes in outgoing.
+	queuedBytes int
+
+	// rng is the random number generator for jitter and PLR.
+	rng LinkFwdRNG
+
+	// txFree is when the transmitter finishes sending the queued frames.
+	txFree time.Time
+
+	// verdicts is the OPTIONAL stream recording the DPI verdicts.
+	verdicts *decisionStream
+}
+
+// newLinkFwdFullState creates a new [linkFwdFullState].
+func newLinkFwdFullState(cfg *LinkFwdConfig, counters *linkFwdCounters, verdicts *decisionStream) *linkFwdFullState {
+	return &linkFwdFullState{
+		cfg:         cfg,
+		counters:    counters,
+		inflight:    []*Frame{},
+		outgoing:    []*Frame{},
+		queuedBytes: 0,
+		rng:         cfg.newLinkgFwdRNG(),
+		txFree:      time.Time{},
+		verdicts:    verdicts,
+	}
+}
+
+// enqueue adds a frame read at the given time to the TX queue.
+func (st *linkFwdFullState) enqueue(frame *Frame, now time.Time) {
+	cfg := st.cfg
+
+	// drop incoming packet if the buffer is full
+	if st.queuedBytes > linkFwdFullMaxQueuedBytes {
+		cfg.maybeTrace(TraceEventFrameDropped, frame, func(ev *TraceEvent) {
+			ev.Reason = "queue_full"
+		})
+		cfg.countDropped(st.counters)
+		frame.Release()
+		return
+	}
+
+	// avoid potential data races
+	frame = frame.ShallowCopy()
+	cfg.maybeTrace(TraceEventFrameEnqueued, frame, nil)
+
+	// create frame TX deadline accounting for time to send all the
+	// previously queued frames in the outgoing buffer, or waiting for
+	// the next slot if the transmitter is idle
+	if st.txFree.Before(now) {
+		st.txFree = now.Truncate(linkFwdFullTXSlot).Add(linkFwdFullTXSlot)
+	}
+	frame.Deadline = st.txFree
+	txTime := time.Duration(len(frame.Payload)*8) * time.Microsecond / linkFwdFullBitsPerMicrosecond
+	if txTime < linkFwdFullTXSlot {
+		txTime = linkFwdFullTXSlot
+	}
+	st.txFree = st.txFree.Add(txTime)
+
+	// add to queue and wait for the TX to wakeup (the queue remains
+	// sorted by deadline because txFree never goes backwards)
+	st.outgoing = append(st.outgoing, frame)
+	st.queuedBytes += len(frame.Payload)
+}
+
+// transmit moves all the frames whose TX deadline is not after now in flight.
+func (st *linkFwdFullState) transmit(now time.Time) {
+	cfg := st.cfg
+	numInflight := len(st.inflight)
+
+	for len(st.outgoing) > 0 {
+		// if the front frame is still pending, we're done for now
+		frame := st.outgoing[0]
+		if frame.Deadline.After(now) {
+			break
+		}
+
+		// dequeue the first frame in the buffer
+		st.queuedBytes -= len(frame.Payload)
+		st.outgoing = st.outgoing[1:]
+
+		// add random jitter to offset the effect of bursts
+		jitter := time.Duration(st.rng.Int63n(1000)) * time.Microsecond
+
+		// compute baseline frame PLR
+		framePLR := cfg.PLR
+
+		// allow the DPI to increase a flow's delay
+		var flowDelay time.Duration
+
+		// run the DPI engine, if configured
+		policy, match := cfg.maybeInspectWithDPI(frame.Payload)
+		if match {
+			frame.Flags |= policy.Flags
+			frame.Spoofed = policy.Spoofed
+			framePLR += policy.PLR
+			flowDelay += policy.Delay
+			cfg.maybeTrace(TraceEventDPIVerdict, frame, func(ev *TraceEvent) {
+				ev.Delay = policy.Delay
+				ev.Policy = policy
+			})
+			st.verdicts.onDPIVerdict(frame, policy)
+		}
+
+		// check whether we need to drop this frame (we will drop it
+		// at the RX so we simulate it being dropped in flight)
+		lost := st.rng.Float64() < framePLR
+		switch {
+		case frame.Flags&FrameFlagDrop != 0:
+			cfg.maybeTrace(TraceEventFrameDropped, frame, func(ev *TraceEvent) {
+				ev.Reason = "dpi"
+			})
+		case lost:
+			frame.Flags |= FrameFlagDrop
+			cfg.maybeTrace(TraceEventFrameDropped, frame, func(ev *TraceEvent) {
+				ev.Reason = "plr"
+			})
+		}
+
+		// create frame RX deadline starting from when we actually woke up
+		// rather than from the TX deadline, such that a frame does not recover
+		// the time it spent waiting for the timer to expire
+		delay := cfg.OneWayDelay + jitter + flowDelay
+		frame.Deadline = now.Add(delay)
+		if frame.Flags&FrameFlagDrop == 0 {
+			cfg.maybeTrace(TraceEventFrameDelayed, frame, func(ev *TraceEvent) {
+				ev.Delay = delay
+			})
+		}
+
+		// congratulations, the frame is now in flight 🚀
+		st.inflight = append(st.inflight, frame)
+	}
+
+	// avoid head of line blocking that may be caused by adding jitter
+	// by sorting once after adding new frames in flight
+	if len(st.inflight) > numInflight {
+		linkFwdSortFrameSliceInPlace(st.inflight)
+	}
+}
+
+// receive delivers or drops all the frames whose RX deadline is not after now.
+func (st *linkFwdFullState) receive(now time.Time) {
+	cfg := st.cfg
+	for len(st.inflight) > 0 {
+		// if the front frame is still pending, we're done for now
+		frame := st.inflight[0]
+		if frame.Deadline.After(now) {
+			break
+		}
+
+		// the frame is no longer in flight
+		st.inflight = st.inflight[1:]
+
+		// don't leak the deadline to the destination NIC
+		frame.Deadline = time.Time{}
+
+		// deliver or drop the frame
+		if frame.Flags&FrameFlagDrop == 0 {
+			cfg.maybeTrace(TraceEventFrameDelivered, frame, nil)
+			cfg.countDelivered(st.counters, frame)
+		} else {
+			cfg.countDropped(st.counters)
+		}
+		linkFwdDeliveryOrDrop(cfg.Writer, frame)
 	}
 }
 
@@ -189,7 +304,9 @@ func LinkFwdFull(cfg *LinkFwdConfig) {
 func linkFwdDeliveryOrDrop(writer WriteableNIC, frame *Frame) {
 	if frame.Flags&FrameFlagDrop == 0 {
 		_ = writer.WriteFrame(frame)
+		return
 	}
+	frame.Release()
 }
 
 var _ = LinkFwdFunc(LinkFwdFull)
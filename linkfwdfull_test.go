@@ -2,6 +2,7 @@ package netem
 
 import (
 	"bytes"
+	"math/rand"
 	"sort"
 	"sync"
 	"testing"
@@ -124,3 +125,87 @@ func TestLinkFwdFull(t *testing.T) {
 		})
 	}
 }
+
+func TestLinkFwdFullBatching(t *testing.T) {
+	// newState creates a state where the given number of small frames
+	// entered the TX queue at the given time.
+	newState := func(t0 time.Time, count int) (*linkFwdFullState, *StaticWriteableNIC) {
+		writer := NewStaticWriteableNIC("eth1")
+		state := newLinkFwdFullState(&LinkFwdConfig{
+			Logger:        &NullLogger{},
+			NewLinkFwdRNG: func() LinkFwdRNG { return rand.New(rand.NewSource(0)) },
+			OneWayDelay:   10 * time.Millisecond,
+			Writer:        writer,
+		}, nil, nil)
+		for idx := 0; idx < count; idx++ {
+			state.enqueue(NewFrame([]byte("abcdef")), t0)
+		}
+		return state, writer
+	}
+
+	// now returns the current time aligned to a slot boundary
+	now := func() time.Time {
+		return time.Now().Truncate(linkFwdFullTXSlot)
+	}
+
+	t.Run("each frame occupies a TX slot starting from the next one", func(t *testing.T) {
+		t0 := now()
+		state, _ := newState(t0, 4)
+		for idx, frame := range state.outgoing {
+			if expect := t0.Add(time.Duration(idx+1) * linkFwdFullTXSlot); !frame.Deadline.Equal(expect) {
+				t.Fatal("unexpected deadline for frame", idx, frame.Deadline.Sub(t0))
+			}
+		}
+	})
+
+	t.Run("a single wakeup transmits all the due frames", func(t *testing.T) {
+		t0 := now()
+		state, _ := newState(t0, 100)
+		state.transmit(t0.Add(50 * linkFwdFullTXSlot))
+		if len(state.outgoing) != 50 || len(state.inflight) != 50 {
+			t.Fatal("unexpected queues", len(state.outgoing), len(state.inflight))
+		}
+		state.transmit(t0.Add(100 * linkFwdFullTXSlot))
+		if len(state.outgoing) != 0 || len(state.inflight) != 100 || state.queuedBytes != 0 {
+			t.Fatal("unexpected queues", len(state.outgoing), len(state.inflight), state.queuedBytes)
+		}
+		if !sort.SliceIsSorted(state.inflight, func(i, j int) bool {
+			return state.inflight[i].Deadline.Before(state.inflight[j].Deadline)
+		}) {
+			t.Fatal("expected the inflight frames to be sorted")
+		}
+	})
+
+	t.Run("a single wakeup delivers all the due frames", func(t *testing.T) {
+		t0 := now()
+		state, writer := newState(t0, 100)
+		t1 := t0.Add(100 * linkFwdFullTXSlot)
+		state.transmit(t1)
+
+		// the writer is unbuffered, so collect the frames in the background
+		delivered := make(chan *Frame, 100)
+		go func() {
+			for frame := range writer.Frames() {
+				delivered <- frame
+			}
+		}()
+
+		// nothing is due before the one-way delay has elapsed since we sent the frames
+		state.receive(t1.Add(state.cfg.OneWayDelay - time.Nanosecond))
+		if len(state.inflight) != 100 {
+			t.Fatal("unexpected number of inflight frames", len(state.inflight))
+		}
+
+		// everything is due after the one-way delay and the jitter
+		state.receive(t1.Add(state.cfg.OneWayDelay + time.Millisecond))
+		if len(state.inflight) != 0 {
+			t.Fatal("unexpected number of inflight frames", len(state.inflight))
+		}
+		for idx := 0; idx < 100; idx++ {
+			frame := <-delivered
+			if !frame.Deadline.IsZero() {
+				t.Fatal("the deadline leaked to the writer")
+			}
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package netem
+
+//
+// Listen backlog and accept queue
+//
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// DefaultListenBacklog is the backlog used by [UNetStack.ListenTCP].
+const DefaultListenBacklog = 4096
+
+// ListenQueueStats contains statistics about the accept queue of a listener.
+type ListenQueueStats struct {
+	// Backlog is the maximum number of established connections
+	// waiting to be accepted that the accept queue can hold.
+	Backlog int
+
+	// Pending is the number of established connections waiting to be accepted.
+	Pending int
+
+	// SynDrops is the number of SYN segments dropped because the accept queue was full.
+	SynDrops uint64
+
+	// AckDrops is the number of handshake-completing ACK segments
+	// dropped because the accept queue was full.
+	AckDrops uint64
+}
+
+// StatsListener is a [net.Listener] that exposes statistics about its accept
+// queue. The listeners returned by [UNetStack.ListenTCP] and by
+// [UNetStack.ListenTCPWithBacklog] implement this interface, therefore you can
+// use a type assertion to observe accept-queue overflows.
+type StatsListener interface {
+	net.Listener
+
+	// ListenQueueStats returns a snapshot of the accept queue statistics.
+	ListenQueueStats() *ListenQueueStats
+}
+
+// ListenTCPWithBacklog is like [UNetStack.ListenTCP] but allows to configure
+// the backlog, i.e., the number of established connections waiting to be accepted
+// that the listener can hold. When the accept queue is full, the listener drops
+// incoming SYN segments, which allows to emulate overloaded servers.
+//
+// This method returns [syscall.EINVAL] if the backlog is not positive.
+func (gs *UNetStack) ListenTCPWithBacklog(network string, addr *net.TCPAddr, backlog int) (net.Listener, error) {
+	if network != "tcp" {
+		return nil, syscall.EPROTOTYPE
+	}
+	if backlog <= 0 {
+		return nil, syscall.EINVAL
+	}
+
+	// convert addr to [netip.AddrPort]
+	ipaddr, good := netip.AddrFromSlice(addr.IP)
+	if !good {
+		return nil, syscall.EADDRNOTAVAIL
+	}
+	addrport := netip.AddrPortFrom(ipaddr.Unmap(), uint16(addr.Port))
+
+	listener, err := gs.ns.ListenTCPAddrPort(addrport, backlog)
+	if err != nil {
+		return nil, MapUNetError(err)
+	}
+
+	return &unetListenerWrapper{
+		l:       listener,
+		ns:      gs.ns,
+		untrack: gs.ns.trackSocket(fmt.Sprintf("tcp listener %s", listener.Addr())),
+	}, nil
+}
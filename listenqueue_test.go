@@ -0,0 +1,71 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenTCPWithBacklog(t *testing.T) {
+	t.Run("we queue connections and drop SYNs when the queue is full", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+		listener := Must1(topology.Server.ListenTCPWithBacklog("tcp", addr, 2))
+		defer listener.Close()
+		statsListener := listener.(StatsListener)
+
+		for idx := 0; idx < 2; idx++ {
+			conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+			defer conn.Close()
+		}
+
+		// wait for the server to move the connections to the accept queue
+		deadline := time.Now().Add(5 * time.Second)
+		for statsListener.ListenQueueStats().Pending < 2 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		if conn, err := topology.Client.DialContext(ctx, "tcp", "10.0.0.1:80"); err == nil {
+			conn.Close()
+			t.Fatal("expected the dial to fail")
+		}
+
+		stats := statsListener.ListenQueueStats()
+		if stats.Backlog != 2 || stats.Pending != 2 || stats.SynDrops <= 0 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+
+		serverConn := Must1(listener.Accept())
+		defer serverConn.Close()
+		if pending := statsListener.ListenQueueStats().Pending; pending != 1 {
+			t.Fatal("unexpected number of pending connections", pending)
+		}
+	})
+
+	t.Run("we use the default backlog with ListenTCP", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+		stats := listener.(StatsListener).ListenQueueStats()
+		if stats.Backlog != DefaultListenBacklog || stats.Pending != 0 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("we reject a non-positive backlog", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+		if _, err := topology.Server.ListenTCPWithBacklog("tcp", addr, 0); !errors.Is(err, syscall.EINVAL) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,290 @@
+package netem
+
+//
+// Load balancer
+//
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancerStrategy is the strategy a [LoadBalancer] uses to choose the backend.
+type LoadBalancerStrategy int
+
+const (
+	// LoadBalancerRoundRobin selects the backends in round-robin order.
+	LoadBalancerRoundRobin = LoadBalancerStrategy(iota)
+
+	// LoadBalancerSourceHash selects the backend using a hash of the client's IP
+	// address, such that the same client always uses the same backend.
+	LoadBalancerSourceHash
+)
+
+// LoadBalancerConfig contains the [LoadBalancer] configuration.
+type LoadBalancerConfig struct {
+	// Backends is the MANDATORY list of the backends' IP addresses.
+	Backends []string
+
+	// Strategy is the OPTIONAL strategy for selecting the backend
+	// to use (default: [LoadBalancerRoundRobin]).
+	Strategy LoadBalancerStrategy
+
+	// TCPPorts contains the OPTIONAL TCP ports to proxy.
+	TCPPorts []uint16
+
+	// UDPPorts contains the OPTIONAL UDP ports to proxy.
+	UDPPorts []uint16
+
+	// UDPIdleTimeout is the OPTIONAL timeout after which we forget about
+	// an idle UDP session (default: 30 seconds).
+	UDPIdleTimeout time.Duration
+}
+
+// ErrNoBackends indicates that a [LoadBalancerConfig] does not contain any backend.
+var ErrNoBackends = errors.New("netem: load balancer without backends")
+
+// LoadBalancer accepts TCP connections and UDP datagrams on a virtual IP
+// address and proxies them to a pool of backends, thus allowing to emulate
+// CDN-like and anycast-like services behind a single address. The zero value
+// is invalid; please, construct using [NewLoadBalancer].
+//
+// The [LoadBalancer] is a full proxy: it uses its own stack to connect to the
+// backends, hence backends see connections coming from the virtual IP address.
+type LoadBalancer struct {
+	closeOnce sync.Once
+	closed    chan any
+	config    *LoadBalancerConfig
+	listeners []net.Listener
+	logger    Logger
+	next      atomic.Uint64
+	pconns    []UDPLikeConn
+	stack     UnderlyingNetwork
+	wg        *sync.WaitGroup
+}
+
+// NewLoadBalancer creates a new [LoadBalancer] listening on the given
+// IP address of the given stack using the given configuration.
+func NewLoadBalancer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *LoadBalancerConfig,
+) (*LoadBalancer, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	if len(config.Backends) <= 0 {
+		return nil, ErrNoBackends
+	}
+
+	lb := &LoadBalancer{
+		closeOnce: sync.Once{},
+		closed:    make(chan any),
+		config:    config,
+		listeners: []net.Listener{},
+		logger:    logger,
+		next:      atomic.Uint64{},
+		pconns:    []UDPLikeConn{},
+		stack:     stack,
+		wg:        &sync.WaitGroup{},
+	}
+
+	// create all the listening sockets before spawning the workers
+	for _, port := range config.TCPPorts {
+		listener, err := stack.ListenTCP("tcp", &net.TCPAddr{IP: parsedIP, Port: int(port)})
+		if err != nil {
+			lb.Close()
+			return nil, err
+		}
+		lb.listeners = append(lb.listeners, listener)
+	}
+	for _, port := range config.UDPPorts {
+		pconn, err := stack.ListenUDP("udp", &net.UDPAddr{IP: parsedIP, Port: int(port)})
+		if err != nil {
+			lb.Close()
+			return nil, err
+		}
+		lb.pconns = append(lb.pconns, pconn)
+	}
+
+	for idx, listener := range lb.listeners {
+		lb.wg.Add(1)
+		go lb.acceptLoop(listener, config.TCPPorts[idx])
+	}
+	for idx, pconn := range lb.pconns {
+		lb.wg.Add(1)
+		go lb.datagramLoop(pconn, config.UDPPorts[idx])
+	}
+
+	logger.Debugf("netem: load balancer %s -> %v", ipAddress, config.Backends)
+	return lb, nil
+}
+
+// Close stops the [LoadBalancer] and waits for its workers to terminate.
+func (lb *LoadBalancer) Close() error {
+	lb.closeOnce.Do(func() {
+		close(lb.closed)
+		for _, listener := range lb.listeners {
+			listener.Close()
+		}
+		for _, pconn := range lb.pconns {
+			pconn.Close()
+		}
+		lb.wg.Wait()
+	})
+	return nil
+}
+
+// selectBackend selects the backend for the given client address.
+func (lb *LoadBalancer) selectBackend(clientAddr net.Addr) string {
+	backends := lb.config.Backends
+	switch lb.config.Strategy {
+	case LoadBalancerSourceHash:
+		host, _, err := net.SplitHostPort(clientAddr.String())
+		if err != nil {
+			host = clientAddr.String()
+		}
+		hasher := fnv.New64a()
+		hasher.Write([]byte(host))
+		return backends[hasher.Sum64()%uint64(len(backends))]
+	default:
+		return backends[(lb.next.Add(1)-1)%uint64(len(backends))]
+	}
+}
+
+// acceptLoop accepts and proxies TCP connections.
+func (lb *LoadBalancer) acceptLoop(listener net.Listener, port uint16) {
+	defer lb.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		lb.wg.Add(1)
+		go lb.proxyStream(conn, port)
+	}
+}
+
+// proxyStream proxies a TCP connection to the selected backend.
+func (lb *LoadBalancer) proxyStream(conn net.Conn, port uint16) {
+	defer lb.wg.Done()
+	defer conn.Close()
+
+	backend := lb.selectBackend(conn.RemoteAddr())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-lb.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	endpoint := net.JoinHostPort(backend, strconv.Itoa(int(port)))
+	bconn, err := lb.stack.DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		lb.logger.Warnf("netem: load balancer: dial %s: %s", endpoint, err.Error())
+		return
+	}
+	defer bconn.Close()
+
+	// copy in both directions and tear down both conns
+	// as soon as either direction is done
+	done := make(chan any, 2)
+	go func() {
+		_, _ = io.Copy(bconn, conn)
+		done <- true
+	}()
+	go func() {
+		_, _ = io.Copy(conn, bconn)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-lb.closed:
+	}
+	conn.Close()
+	bconn.Close()
+	<-done
+}
+
+// datagramLoop reads UDP datagrams and proxies them to the selected backend
+// using a distinct session for each client address.
+func (lb *LoadBalancer) datagramLoop(pconn UDPLikeConn, port uint16) {
+	defer lb.wg.Done()
+
+	var (
+		mu       sync.Mutex
+		sessions = map[string]net.Conn{}
+	)
+
+	idleTimeout := lb.config.UDPIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = 30 * time.Second
+	}
+
+	buffer := make([]byte, 1<<16)
+	for {
+		count, clientAddr, err := pconn.ReadFrom(buffer)
+		if err != nil {
+			break
+		}
+		rawDatagram := append([]byte{}, buffer[:count]...)
+
+		mu.Lock()
+		bconn := sessions[clientAddr.String()]
+		if bconn == nil {
+			backend := lb.selectBackend(clientAddr)
+			endpoint := net.JoinHostPort(backend, strconv.Itoa(int(port)))
+			bconn, err = lb.stack.DialContext(context.Background(), "udp", endpoint)
+			if err != nil {
+				mu.Unlock()
+				lb.logger.Warnf("netem: load balancer: dial %s: %s", endpoint, err.Error())
+				continue
+			}
+			sessions[clientAddr.String()] = bconn
+
+			// route the backend responses back to the client until the session is idle
+			lb.wg.Add(1)
+			go func(clientAddr net.Addr, bconn net.Conn) {
+				defer lb.wg.Done()
+				defer func() {
+					mu.Lock()
+					delete(sessions, clientAddr.String())
+					mu.Unlock()
+					bconn.Close()
+				}()
+				buffer := make([]byte, 1<<16)
+				for {
+					_ = bconn.SetReadDeadline(time.Now().Add(idleTimeout))
+					count, err := bconn.Read(buffer)
+					if err != nil {
+						return
+					}
+					if _, err := pconn.WriteTo(buffer[:count], clientAddr); err != nil {
+						return
+					}
+				}
+			}(clientAddr, bconn)
+		}
+		mu.Unlock()
+
+		_, _ = bconn.Write(rawDatagram)
+	}
+
+	// close all the sessions to unblock their goroutines
+	mu.Lock()
+	for _, bconn := range sessions {
+		bconn.Close()
+	}
+	mu.Unlock()
+}
@@ -0,0 +1,90 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLoadBalancer(t *testing.T) {
+	// newTopology creates a topology with a client, a load balancer using the given
+	// strategy, and two DNS servers returning distinct addresses for the same name.
+	newTopology := func(t *testing.T, strategy LoadBalancerStrategy) *UNetStack {
+		topology := MustNewStarTopology(&NullLogger{})
+		t.Cleanup(func() { topology.Close() })
+		client := Must1(topology.AddHost("10.0.0.2", "0.0.0.0", &LinkConfig{}))
+		for _, address := range []string{"10.0.0.11", "10.0.0.12"} {
+			config := NewDNSConfig()
+			config.AddRecord("www.example.com", "", address)
+			stack := Must1(topology.AddHost(address, "0.0.0.0", &LinkConfig{}))
+			server := Must1(NewDNSServer(&NullLogger{}, stack, address, config))
+			t.Cleanup(func() { server.Close() })
+		}
+		stack := Must1(topology.AddHost("10.0.0.100", "0.0.0.0", &LinkConfig{}))
+		lb := Must1(NewLoadBalancer(&NullLogger{}, stack, "10.0.0.100", &LoadBalancerConfig{
+			Backends: []string{"10.0.0.11", "10.0.0.12"},
+			Strategy: strategy,
+			TCPPorts: []uint16{53},
+			UDPPorts: []uint16{53},
+		}))
+		t.Cleanup(func() { lb.Close() })
+		return client
+	}
+
+	// lookup returns the backend that served the query.
+	lookup := func(t *testing.T, client *UNetStack, roundTripper func(
+		context.Context, UnderlyingNetwork, string, *dns.Msg) (*dns.Msg, error)) string {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		query := NewDNSRequestA("www.example.com")
+		resp, err := roundTripper(ctx, client, "10.0.0.100", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs, _, err := DNSParseResponse(query, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 {
+			t.Fatal("expected a single address")
+		}
+		return addrs[0]
+	}
+
+	roundTrippers := map[string]func(context.Context, UnderlyingNetwork, string, *dns.Msg) (*dns.Msg, error){
+		"udp": DNSRoundTrip,
+		"tcp": DNSRoundTripTCP,
+	}
+
+	for network, roundTripper := range roundTrippers {
+		t.Run("round robin uses all the backends with "+network, func(t *testing.T) {
+			client := newTopology(t, LoadBalancerRoundRobin)
+			first := lookup(t, client, roundTripper)
+			second := lookup(t, client, roundTripper)
+			if first == second {
+				t.Fatal("expected distinct backends, got", first)
+			}
+		})
+
+		t.Run("source hash always uses the same backend with "+network, func(t *testing.T) {
+			client := newTopology(t, LoadBalancerSourceHash)
+			first := lookup(t, client, roundTripper)
+			second := lookup(t, client, roundTripper)
+			if first != second {
+				t.Fatal("expected the same backend, got", first, second)
+			}
+		})
+	}
+
+	t.Run("we need at least a backend", func(t *testing.T) {
+		stack := Must1(NewUNetStack(&NullLogger{}, 1500, "10.0.0.100", MustNewCA(), "0.0.0.0"))
+		defer stack.Close()
+		_, err := NewLoadBalancer(&NullLogger{}, stack, "10.0.0.100", &LoadBalancerConfig{})
+		if !errors.Is(err, ErrNoBackends) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,283 @@
+package netem
+
+//
+// SMTP and IMAP banner servers
+//
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// MailServerConfig contains the configuration of a [SMTPServer] or of
+// an [IMAPServer]. The zero value is valid and creates a plaintext server
+// listening on the standard port that does not support STARTTLS.
+type MailServerConfig struct {
+	// Hostname is the OPTIONAL hostname in the greeting (default: "mail.example.com").
+	Hostname string
+
+	// ImplicitTLS OPTIONALLY makes the server perform the TLS handshake as soon as the
+	// client connects (i.e., SMTPS and IMAPS), in which case TLSConfig is MANDATORY.
+	ImplicitTLS bool
+
+	// Port is the OPTIONAL TCP port (default: 25 for SMTP, 465 for SMTPS,
+	// 143 for IMAP, and 993 for IMAPS).
+	Port int
+
+	// TLSConfig is the OPTIONAL TLS config. When set, the plaintext server also
+	// advertises and supports STARTTLS. Use [UNetStack.MustNewServerTLSConfig]
+	// to obtain a config that the hosts of a [StarTopology] trust.
+	TLSConfig *tls.Config
+}
+
+// ErrMailServerNoTLSConfig indicates that we cannot use implicit TLS without a TLS config.
+var ErrMailServerNoTLSConfig = errors.New("netem: mail server: implicit TLS requires a TLS config")
+
+// hostname returns the hostname to use in the greeting.
+func (c *MailServerConfig) hostname() string {
+	if c.Hostname != "" {
+		return c.Hostname
+	}
+	return "mail.example.com"
+}
+
+// port returns the port to use given the plaintext and implicit TLS defaults.
+func (c *MailServerConfig) port(plaintext, implicitTLS int) int {
+	switch {
+	case c.Port > 0:
+		return c.Port
+	case c.ImplicitTLS:
+		return implicitTLS
+	default:
+		return plaintext
+	}
+}
+
+// mailSession is the state of a connection to a mail server.
+type mailSession struct {
+	config *MailServerConfig
+	conn   net.Conn
+	tp     *textproto.Conn
+	tls    bool
+}
+
+// newMailSession creates a new [mailSession], performing the TLS handshake when
+// using implicit TLS, and returns false if the handshake fails.
+func newMailSession(conn net.Conn, config *MailServerConfig) (*mailSession, bool) {
+	session := &mailSession{config: config, conn: conn}
+	if config.ImplicitTLS {
+		return session, session.startTLS()
+	}
+	session.tp = textproto.NewConn(conn)
+	return session, true
+}
+
+// canStartTLS returns whether the client can issue STARTTLS.
+func (ms *mailSession) canStartTLS() bool {
+	return ms.config.TLSConfig != nil && !ms.tls
+}
+
+// startTLS performs the TLS handshake and returns whether it succeeded.
+func (ms *mailSession) startTLS() bool {
+	tlsConn := tls.Server(ms.conn, ms.config.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return false
+	}
+	ms.tp = textproto.NewConn(tlsConn)
+	ms.tls = true
+	return true
+}
+
+// SMTPServer is a minimal SMTP server (see RFC 5321) that sends a banner and
+// supports the EHLO, HELO, NOOP, RSET, STARTTLS (see RFC 3207), and QUIT commands,
+// which is enough to measure port-25 blocking and STARTTLS stripping middleboxes
+// (see [MiddleboxConfig]). The zero value is invalid, please construct using
+// [NewSMTPServer].
+type SMTPServer struct {
+	ss *simpleTCPServer
+}
+
+// NewSMTPServer creates a new [SMTPServer] listening on the given IP address.
+// Remember to call [SMTPServer.Close] when done.
+func NewSMTPServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *MailServerConfig,
+) (*SMTPServer, error) {
+	if config.ImplicitTLS && config.TLSConfig == nil {
+		return nil, ErrMailServerNoTLSConfig
+	}
+	port := config.port(25, 465)
+	ss, err := newSimpleTCPServer(logger, stack, ipAddress, port, "SMTPServer", func(conn net.Conn) {
+		smtpServe(conn, config)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SMTPServer{ss}, nil
+}
+
+// Close stops the SMTP server and terminates the active SMTP sessions.
+func (s *SMTPServer) Close() error {
+	return s.ss.Close()
+}
+
+// smtpServe serves an SMTP connection.
+func smtpServe(conn net.Conn, config *MailServerConfig) {
+	session, good := newMailSession(conn, config)
+	if !good {
+		return
+	}
+	hostname := config.hostname()
+	if session.tp.PrintfLine("220 %s ESMTP netem", hostname) != nil {
+		return
+	}
+	for {
+		line, err := session.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			extensions := []string{hostname, "PIPELINING", "8BITMIME"}
+			if session.canStartTLS() {
+				extensions = append(extensions, "STARTTLS")
+			}
+			for idx, extension := range extensions {
+				separator := "-"
+				if idx == len(extensions)-1 {
+					separator = " "
+				}
+				err = session.tp.PrintfLine("250%s%s", separator, extension)
+			}
+
+		case "HELO":
+			err = session.tp.PrintfLine("250 %s", hostname)
+
+		case "NOOP", "RSET":
+			err = session.tp.PrintfLine("250 2.0.0 OK")
+
+		case "STARTTLS":
+			if !session.canStartTLS() {
+				err = session.tp.PrintfLine("454 4.7.0 TLS not available")
+				break
+			}
+			if session.tp.PrintfLine("220 2.0.0 Ready to start TLS") != nil || !session.startTLS() {
+				return
+			}
+
+		case "QUIT":
+			_ = session.tp.PrintfLine("221 2.0.0 Bye")
+			return
+
+		default:
+			err = session.tp.PrintfLine("502 5.5.2 Command not implemented")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// IMAPServer is a minimal IMAP server (see RFC 3501) that sends a banner and
+// supports the CAPABILITY, NOOP, STARTTLS, and LOGOUT commands, which is enough
+// to measure port-143/993 blocking and STARTTLS stripping middleboxes (see
+// [MiddleboxConfig]). The zero value is invalid, please construct using
+// [NewIMAPServer].
+type IMAPServer struct {
+	ss *simpleTCPServer
+}
+
+// NewIMAPServer creates a new [IMAPServer] listening on the given IP address.
+// Remember to call [IMAPServer.Close] when done.
+func NewIMAPServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *MailServerConfig,
+) (*IMAPServer, error) {
+	if config.ImplicitTLS && config.TLSConfig == nil {
+		return nil, ErrMailServerNoTLSConfig
+	}
+	port := config.port(143, 993)
+	ss, err := newSimpleTCPServer(logger, stack, ipAddress, port, "IMAPServer", func(conn net.Conn) {
+		imapServe(conn, config)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &IMAPServer{ss}, nil
+}
+
+// Close stops the IMAP server and terminates the active IMAP sessions.
+func (s *IMAPServer) Close() error {
+	return s.ss.Close()
+}
+
+// imapServe serves an IMAP connection.
+func imapServe(conn net.Conn, config *MailServerConfig) {
+	session, good := newMailSession(conn, config)
+	if !good {
+		return
+	}
+	hostname := config.hostname()
+	capabilities := func() string {
+		if session.canStartTLS() {
+			return "IMAP4rev1 STARTTLS"
+		}
+		return "IMAP4rev1"
+	}
+	if session.tp.PrintfLine("* OK [CAPABILITY %s] %s IMAP4rev1 netem ready", capabilities(), hostname) != nil {
+		return
+	}
+	for {
+		line, err := session.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		tag, command, found := strings.Cut(line, " ")
+		if !found || tag == "" {
+			if session.tp.PrintfLine("* BAD Invalid command") != nil {
+				return
+			}
+			continue
+		}
+		command, _, _ = strings.Cut(command, " ")
+		switch strings.ToUpper(command) {
+		case "CAPABILITY":
+			if session.tp.PrintfLine("* CAPABILITY %s", capabilities()) != nil {
+				return
+			}
+			err = session.tp.PrintfLine("%s OK CAPABILITY completed", tag)
+
+		case "NOOP":
+			err = session.tp.PrintfLine("%s OK NOOP completed", tag)
+
+		case "STARTTLS":
+			if !session.canStartTLS() {
+				err = session.tp.PrintfLine("%s BAD STARTTLS not available", tag)
+				break
+			}
+			if session.tp.PrintfLine("%s OK Begin TLS negotiation now", tag) != nil || !session.startTLS() {
+				return
+			}
+
+		case "LOGOUT":
+			if session.tp.PrintfLine("* BYE %s logging out", hostname) == nil {
+				_ = session.tp.PrintfLine("%s OK LOGOUT completed", tag)
+			}
+			return
+
+		default:
+			err = session.tp.PrintfLine("%s BAD Command not implemented", tag)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
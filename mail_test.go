@@ -0,0 +1,156 @@
+package netem
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailServers(t *testing.T) {
+	newTopology := func(t *testing.T) *PPPTopology {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		t.Cleanup(func() { topology.Close() })
+		return topology
+	}
+
+	// dial connects to the given endpoint, optionally using TLS.
+	dial := func(t *testing.T, topology *PPPTopology, endpoint string, useTLS bool) net.Conn {
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", endpoint))
+		t.Cleanup(func() { conn.Close() })
+		Must0(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+		if useTLS {
+			conn = tls.Client(conn, mailTestClientTLSConfig(topology.Client))
+		}
+		return conn
+	}
+
+	t.Run("the SMTP server supports STARTTLS", func(t *testing.T) {
+		topology := newTopology(t)
+		server := Must1(NewSMTPServer(&NullLogger{}, topology.Server, "10.0.0.1", &MailServerConfig{
+			TLSConfig: topology.Server.MustNewServerTLSConfig("mail.example.com"),
+		}))
+		defer server.Close()
+
+		client := Must1(smtp.NewClient(dial(t, topology, "10.0.0.1:25", false), "mail.example.com"))
+		Must0(client.Hello("client.example.com"))
+		if found, _ := client.Extension("STARTTLS"); !found {
+			t.Fatal("expected the server to offer STARTTLS")
+		}
+		Must0(client.StartTLS(mailTestClientTLSConfig(topology.Client)))
+		if found, _ := client.Extension("STARTTLS"); found {
+			t.Fatal("expected the server not to offer STARTTLS again")
+		}
+		Must0(client.Noop())
+		Must0(client.Quit())
+	})
+
+	t.Run("the SMTP server without TLS config does not support STARTTLS", func(t *testing.T) {
+		topology := newTopology(t)
+		server := Must1(NewSMTPServer(&NullLogger{}, topology.Server, "10.0.0.1", &MailServerConfig{Port: 587}))
+		defer server.Close()
+
+		client := Must1(smtp.NewClient(dial(t, topology, "10.0.0.1:587", false), "mail.example.com"))
+		Must0(client.Hello("client.example.com"))
+		if found, _ := client.Extension("STARTTLS"); found {
+			t.Fatal("expected the server not to offer STARTTLS")
+		}
+		var tperr *textproto.Error
+		if err := client.StartTLS(mailTestClientTLSConfig(topology.Client)); !errors.As(err, &tperr) || tperr.Code != 454 {
+			t.Fatal("unexpected error", err)
+		}
+		if err := client.Mail("alice@example.com"); !errors.As(err, &tperr) || tperr.Code != 502 {
+			t.Fatal("unexpected error", err)
+		}
+		Must0(client.Quit())
+	})
+
+	t.Run("the SMTP server supports implicit TLS", func(t *testing.T) {
+		topology := newTopology(t)
+		server := Must1(NewSMTPServer(&NullLogger{}, topology.Server, "10.0.0.1", &MailServerConfig{
+			ImplicitTLS: true,
+			TLSConfig:   topology.Server.MustNewServerTLSConfig("mail.example.com"),
+		}))
+		defer server.Close()
+
+		client := Must1(smtp.NewClient(dial(t, topology, "10.0.0.1:465", true), "mail.example.com"))
+		Must0(client.Hello("client.example.com"))
+		Must0(client.Quit())
+	})
+
+	t.Run("the IMAP server supports STARTTLS", func(t *testing.T) {
+		topology := newTopology(t)
+		server := Must1(NewIMAPServer(&NullLogger{}, topology.Server, "10.0.0.1", &MailServerConfig{
+			TLSConfig: topology.Server.MustNewServerTLSConfig("mail.example.com"),
+		}))
+		defer server.Close()
+
+		conn := dial(t, topology, "10.0.0.1:143", false)
+		tp := textproto.NewConn(conn)
+		mailTestExpectLine(t, tp, "* OK [CAPABILITY IMAP4rev1 STARTTLS] mail.example.com")
+		Must0(tp.PrintfLine("a1 CAPABILITY"))
+		mailTestExpectLine(t, tp, "* CAPABILITY IMAP4rev1 STARTTLS")
+		mailTestExpectLine(t, tp, "a1 OK")
+		Must0(tp.PrintfLine("a2 STARTTLS"))
+		mailTestExpectLine(t, tp, "a2 OK")
+
+		tp = textproto.NewConn(tls.Client(conn, mailTestClientTLSConfig(topology.Client)))
+		Must0(tp.PrintfLine("a3 CAPABILITY"))
+		mailTestExpectLine(t, tp, "* CAPABILITY IMAP4rev1")
+		mailTestExpectLine(t, tp, "a3 OK")
+		Must0(tp.PrintfLine("a4 STARTTLS"))
+		mailTestExpectLine(t, tp, "a4 BAD")
+		Must0(tp.PrintfLine("a5 LOGIN alice secret"))
+		mailTestExpectLine(t, tp, "a5 BAD")
+		Must0(tp.PrintfLine("a6 LOGOUT"))
+		mailTestExpectLine(t, tp, "* BYE")
+		mailTestExpectLine(t, tp, "a6 OK")
+	})
+
+	t.Run("the IMAP server supports implicit TLS", func(t *testing.T) {
+		topology := newTopology(t)
+		server := Must1(NewIMAPServer(&NullLogger{}, topology.Server, "10.0.0.1", &MailServerConfig{
+			ImplicitTLS: true,
+			TLSConfig:   topology.Server.MustNewServerTLSConfig("mail.example.com"),
+		}))
+		defer server.Close()
+
+		tp := textproto.NewConn(dial(t, topology, "10.0.0.1:993", true))
+		mailTestExpectLine(t, tp, "* OK [CAPABILITY IMAP4rev1] mail.example.com")
+		Must0(tp.PrintfLine("a1 NOOP"))
+		mailTestExpectLine(t, tp, "a1 OK")
+	})
+
+	t.Run("we require a TLS config for implicit TLS", func(t *testing.T) {
+		topology := newTopology(t)
+		config := &MailServerConfig{ImplicitTLS: true}
+		if _, err := NewSMTPServer(&NullLogger{}, topology.Server, "10.0.0.1", config); !errors.Is(err, ErrMailServerNoTLSConfig) {
+			t.Fatal("unexpected error", err)
+		}
+		if _, err := NewIMAPServer(&NullLogger{}, topology.Server, "10.0.0.1", config); !errors.Is(err, ErrMailServerNoTLSConfig) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+// mailTestClientTLSConfig returns the client TLS config for connecting to mail.example.com.
+func mailTestClientTLSConfig(stack *UNetStack) *tls.Config {
+	return &tls.Config{ServerName: "mail.example.com", RootCAs: stack.DefaultCertPool()}
+}
+
+// mailTestExpectLine reads a line and fails unless it starts with the given prefix.
+func mailTestExpectLine(t *testing.T, tp *textproto.Conn, prefix string) {
+	t.Helper()
+	line, err := tp.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, prefix) {
+		t.Fatalf("expected %q, got %q", prefix, line)
+	}
+}
@@ -0,0 +1,691 @@
+package netem
+
+//
+// Transparent proxy middlebox
+//
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// MiddleboxConfig contains the [Middlebox] configuration.
+type MiddleboxConfig struct {
+	// InterceptTCPPorts contains the MANDATORY server TCP ports
+	// for which the [Middlebox] terminates and re-originates the
+	// connections. All the other traffic flows unmodified.
+	InterceptTCPPorts []uint16
+
+	// HTTPProxy OPTIONALLY configures the [Middlebox] to proxy some of the
+	// intercepted connections at the HTTP layer, which allows to emulate
+	// transparent HTTP proxies modifying the requests and the responses.
+	HTTPProxy *MiddleboxHTTPProxyConfig
+
+	// HTTPResponder is the OPTIONAL function deciding whether the [Middlebox]
+	// should respond to an intercepted connection using the returned handler
+	// rather than proxying the connection to the server. When the function
+	// returns nil, the [Middlebox] proxies the connection. This functionality
+	// allows emulating captive portals and HTTP-speaking middleboxes. We do not
+	// call this function for the TLSMITMPorts and we call it before the Policy.
+	// Note that the [Middlebox] calls this function from several goroutines.
+	HTTPResponder func(info *MiddleboxConnInfo) http.Handler
+
+	// MTU is the OPTIONAL MTU of the [Middlebox] NICs (default: 1500).
+	MTU uint32
+
+	// Policy is the OPTIONAL function deciding whether the [Middlebox]
+	// should allow a connection. When the function returns false, the
+	// middlebox closes the client connection. By default, we allow all
+	// the connections. Note that the [Middlebox] calls this function
+	// from several goroutines.
+	Policy func(info *MiddleboxConnInfo) bool
+
+	// STARTTLSStripPorts contains the OPTIONAL subset of InterceptTCPPorts (e.g., 25
+	// and 143) for which the [Middlebox] strips STARTTLS from the plaintext mail protocols
+	// (see [SMTPServer] and [IMAPServer]). Like some firewalls performing SMTP inspection,
+	// the [Middlebox] replaces each occurrence of STARTTLS in both directions with the
+	// same-length string XXXXXXXA, such that the client does not see the server offering
+	// STARTTLS and the server rejects the STARTTLS command as an unknown command.
+	STARTTLSStripPorts []uint16
+
+	// TLSMITMPorts contains the OPTIONAL subset of InterceptTCPPorts for
+	// which the [Middlebox] performs TLS MITM using the [CA] passed to
+	// [NewMiddlebox]. Because [StarTopology] hosts trust such a [CA], the
+	// [Middlebox] can inspect the SNI and decrypt the traffic.
+	//
+	// Like a corporate or ISP interception proxy, the [Middlebox] reads the
+	// client's ClientHello, completes the TLS handshake with the real server
+	// offering the same SNI and ALPN protocols, and then completes the client
+	// handshake selecting the ALPN protocol negotiated with the server. To
+	// emulate interception using a CA distinct from the one used by the
+	// servers, pass such a CA to [NewMiddlebox] and make the clients trust it.
+	TLSMITMPorts []uint16
+
+	// TLSUpstreamConfig is the OPTIONAL TLS config for connecting to the real
+	// servers when performing TLS MITM. We clone this config and override the
+	// ServerName and NextProtos fields. By default, we only trust the [CA] passed
+	// to [NewMiddlebox], which is fine when the servers use the same [CA].
+	TLSUpstreamConfig *tls.Config
+}
+
+// MiddleboxConnInfo contains information about a connection intercepted
+// by a [Middlebox], which the [Middlebox] passes to the Policy function.
+type MiddleboxConnInfo struct {
+	// ClientAddress is the client endpoint (i.e., address and port).
+	ClientAddress string
+
+	// ServerAddress is the server endpoint (i.e., address and port).
+	ServerAddress string
+
+	// ServerName is the SNI sent by the client. This field is only
+	// set when the [Middlebox] performs TLS MITM for the connection.
+	ServerName string
+}
+
+// Middlebox is a transparent proxy that you can insert into the path between
+// a host and the rest of the network. The [Middlebox] terminates the TCP
+// connections towards the intercepted ports, optionally performs TLS MITM,
+// and re-originates the connections towards the original servers using the
+// client's address, thus allowing to model proxy-based censorship and
+// enterprise middleboxes. The zero value is invalid; please, construct
+// using [NewMiddlebox].
+//
+// Use [Middlebox.ClientSideNIC] and [Middlebox.ServerSideNIC] to connect
+// the [Middlebox] using [Link]s. For example:
+//
+//	host := Must1(NewUNetStack(logger, 1500, "10.0.0.2", ca, "10.0.0.1"))
+//	hostLink := NewLink(logger, host, mb.ClientSideNIC(), &LinkConfig{})
+//	port := NewRouterPort(router)
+//	router.AddRoute("10.0.0.2", port)
+//	routerLink := NewLink(logger, mb.ServerSideNIC(), port, &LinkConfig{})
+type Middlebox struct {
+	ca         *CA
+	clientNIC  *middleboxNIC
+	clientSide *gvisorStack
+	closeOnce  sync.Once
+	closed     chan any
+	config     *MiddleboxConfig
+	logger     Logger
+	mu         sync.Mutex
+	serverNIC  *middleboxNIC
+	serverSide *gvisorStack
+	wg         *sync.WaitGroup
+}
+
+// NewMiddlebox creates a new [Middlebox] using the given [CA] for TLS MITM.
+func NewMiddlebox(logger Logger, ca *CA, config *MiddleboxConfig) (*Middlebox, error) {
+	mtu := config.MTU
+	if mtu <= 0 {
+		mtu = 1500
+	}
+	clientSide, err := newGVisorStackPromiscuous(logger, mtu)
+	if err != nil {
+		return nil, err
+	}
+	serverSide, err := newGVisorStackPromiscuous(logger, mtu)
+	if err != nil {
+		clientSide.Close()
+		return nil, err
+	}
+	mb := &Middlebox{
+		ca:         ca,
+		clientNIC:  nil, // set below
+		clientSide: clientSide,
+		closeOnce:  sync.Once{},
+		closed:     make(chan any),
+		config:     config,
+		logger:     logger,
+		mu:         sync.Mutex{},
+		serverNIC:  nil, // set below
+		serverSide: serverSide,
+		wg:         &sync.WaitGroup{},
+	}
+
+	// frames coming from the client either go to the client-side stack,
+	// which terminates the connection, or pass through unmodified
+	mb.clientNIC = newMiddleboxNIC(logger, func(frame *Frame) error {
+		if mb.isIntercepted(frame, func(packet *DissectedPacket) uint16 { return packet.DestinationPort() }) {
+			return clientSide.WriteFrame(frame)
+		}
+		return mb.serverNIC.enqueue(frame)
+	})
+
+	// frames coming from the server either go to the server-side stack,
+	// which re-originated the connection, or pass through unmodified
+	mb.serverNIC = newMiddleboxNIC(logger, func(frame *Frame) error {
+		if mb.isIntercepted(frame, func(packet *DissectedPacket) uint16 { return packet.SourcePort() }) {
+			return serverSide.WriteFrame(frame)
+		}
+		return mb.clientNIC.enqueue(frame)
+	})
+
+	// move the frames emitted by the stacks to the corresponding NICs
+	mb.wg.Add(2)
+	go mb.pump(clientSide, mb.clientNIC)
+	go mb.pump(serverSide, mb.serverNIC)
+
+	clientSide.SetTCPForwarder(mb.handle)
+	return mb, nil
+}
+
+// ClientSideNIC returns the [NIC] to connect to the client's side of the path.
+func (mb *Middlebox) ClientSideNIC() NIC {
+	return mb.clientNIC
+}
+
+// ServerSideNIC returns the [NIC] to connect to the server's side of the path.
+func (mb *Middlebox) ServerSideNIC() NIC {
+	return mb.serverNIC
+}
+
+// Close stops the [Middlebox] and closes its [NIC]s.
+func (mb *Middlebox) Close() error {
+	mb.closeOnce.Do(func() {
+		// holding the mutex guarantees that no handler is between
+		// checking mb.closed and registering with the wait group
+		mb.mu.Lock()
+		close(mb.closed)
+		mb.mu.Unlock()
+		mb.clientNIC.Close()
+		mb.serverNIC.Close()
+		mb.clientSide.Close()
+		mb.serverSide.Close()
+		mb.wg.Wait()
+	})
+	return nil
+}
+
+// isIntercepted returns whether the given frame contains a TCP segment for
+// which the port returned by the given function is intercepted.
+func (mb *Middlebox) isIntercepted(frame *Frame, port func(packet *DissectedPacket) uint16) bool {
+	packet, err := DissectPacket(frame.Payload)
+	if err != nil || packet.TransportProtocol() != layers.IPProtocolTCP {
+		return false
+	}
+	return middleboxContainsPort(mb.config.InterceptTCPPorts, port(packet))
+}
+
+// middleboxContainsPort returns whether ports contains port.
+func middleboxContainsPort(ports []uint16, port uint16) bool {
+	for _, entry := range ports {
+		if entry == port {
+			return true
+		}
+	}
+	return false
+}
+
+// pump moves the frames emitted by the given stack to the given NIC.
+func (mb *Middlebox) pump(stack *gvisorStack, nic *middleboxNIC) {
+	defer mb.wg.Done()
+	for {
+		select {
+		case <-mb.closed:
+			return
+		case <-stack.FrameAvailable():
+			frame, err := stack.ReadFrameNonblocking()
+			if err != nil {
+				continue
+			}
+			_ = nic.enqueue(frame)
+		}
+	}
+}
+
+// middleboxDialTimeout is the timeout for connecting to the server.
+const middleboxDialTimeout = 10 * time.Second
+
+// middleboxHandshakeTimeout is the timeout for the TLS MITM handshakes.
+const middleboxHandshakeTimeout = 10 * time.Second
+
+// newContext returns a context with the given timeout that we also
+// cancel as soon as the [Middlebox] is closed.
+func (mb *Middlebox) newContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case <-mb.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// handle handles a TCP connection request received by the client-side stack.
+func (mb *Middlebox) handle(req *tcp.ForwarderRequest) {
+	// check whether we're closed and register with the wait group
+	// atomically, otherwise we could race with Close calling Wait
+	mb.mu.Lock()
+	select {
+	case <-mb.closed:
+		mb.mu.Unlock()
+		req.Complete(true)
+		return
+	default:
+	}
+	mb.wg.Add(1)
+	mb.mu.Unlock()
+	defer mb.wg.Done()
+
+	id := req.ID()
+	clientIP, _ := netip.AddrFromSlice(id.RemoteAddress.AsSlice())
+	serverIP, _ := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+	clientAddr := netip.AddrPortFrom(clientIP.Unmap(), id.RemotePort)
+	serverAddr := netip.AddrPortFrom(serverIP.Unmap(), id.LocalPort)
+	info := &MiddleboxConnInfo{
+		ClientAddress: clientAddr.String(),
+		ServerAddress: serverAddr.String(),
+		ServerName:    "",
+	}
+	mitm := middleboxContainsPort(mb.config.TLSMITMPorts, id.LocalPort)
+	httpProxy := mb.config.HTTPProxy != nil && middleboxContainsPort(mb.config.HTTPProxy.Ports, id.LocalPort)
+
+	// without MITM, we can respond to the client ourselves
+	if !mitm && mb.config.HTTPResponder != nil {
+		if handler := mb.config.HTTPResponder(info); handler != nil {
+			mb.logger.Debugf("netem: middlebox: responding to %s -> %s", info.ClientAddress, info.ServerAddress)
+			mb.respond(req, handler)
+			return
+		}
+	}
+
+	// without MITM, we can apply the policy before the handshake
+	if !mitm && !mb.allow(info) {
+		mb.logger.Infof("netem: middlebox: blocking %s -> %s", info.ClientAddress, info.ServerAddress)
+		req.Complete(true)
+		return
+	}
+
+	// connect to the server before completing the client handshake, such
+	// that the client observes a reset when the server is not reachable
+	ctx, cancel := mb.newContext(middleboxDialTimeout)
+	defer cancel()
+	serverConn, err := mb.serverSide.DialContextTCPWithBind(ctx, clientAddr, serverAddr)
+	if err != nil {
+		mb.logger.Warnf("netem: middlebox: dial %s: %s", info.ServerAddress, err.Error())
+		req.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := req.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		req.Complete(true)
+		serverConn.Close()
+		return
+	}
+	req.Complete(false)
+	var (
+		clientConn net.Conn = gonet.NewTCPConn(&wq, ep)
+		upstream   net.Conn = serverConn
+	)
+
+	if mitm {
+		clientConn, upstream, err = mb.mitm(clientConn, upstream, info, httpProxy)
+		if err != nil {
+			mb.logger.Warnf("netem: middlebox: mitm %s: %s", info.ServerAddress, err.Error())
+			clientConn.Close()
+			upstream.Close()
+			return
+		}
+	}
+
+	if httpProxy {
+		mb.logger.Debugf("netem: middlebox: HTTP proxying %s -> %s", info.ClientAddress, info.ServerAddress)
+		mb.proxyHTTP(clientConn, upstream, info)
+		return
+	}
+
+	if middleboxContainsPort(mb.config.STARTTLSStripPorts, id.LocalPort) {
+		mb.logger.Debugf("netem: middlebox: stripping STARTTLS %s -> %s", info.ClientAddress, info.ServerAddress)
+		mb.proxyWithCopier(clientConn, upstream, middleboxCopyStrippingSTARTTLS)
+		return
+	}
+
+	mb.logger.Debugf("netem: middlebox: proxying %s -> %s", info.ClientAddress, info.ServerAddress)
+	mb.proxy(clientConn, upstream)
+}
+
+// respond completes the client handshake and serves HTTP using the given
+// handler until the client closes the connection or the [Middlebox] is closed.
+func (mb *Middlebox) respond(req *tcp.ForwarderRequest, handler http.Handler) {
+	var wq waiter.Queue
+	ep, tcpErr := req.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		req.Complete(true)
+		return
+	}
+	req.Complete(false)
+	listener := newMiddleboxConnListener(gonet.NewTCPConn(&wq, ep))
+	server := &http.Server{
+		Handler: handler,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+	done := make(chan any)
+	defer close(done)
+	go func() {
+		select {
+		case <-mb.closed:
+			server.Close()
+		case <-done:
+		}
+	}()
+	_ = server.Serve(listener)
+}
+
+// allow applies the configured policy.
+func (mb *Middlebox) allow(info *MiddleboxConnInfo) bool {
+	return mb.config.Policy == nil || mb.config.Policy(info)
+}
+
+// errMiddleboxPolicy indicates that the policy blocked the connection.
+var errMiddleboxPolicy = errors.New("netem: middlebox: blocked by policy")
+
+// mitm performs TLS MITM for the given connections. When http1Only is true, we
+// only offer HTTP/1.1 to the server, since [Middlebox.proxyHTTP] cannot speak HTTP/2.
+func (mb *Middlebox) mitm(
+	clientConn, serverConn net.Conn, info *MiddleboxConnInfo, http1Only bool) (net.Conn, net.Conn, error) {
+	serverIP, _, _ := net.SplitHostPort(info.ServerAddress)
+	var (
+		blocked   bool
+		serverTLS *tls.Conn
+	)
+	clientTLS := tls.Server(clientConn, &tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			info.ServerName = chi.ServerName
+			serverName := info.ServerName
+			if serverName == "" {
+				serverName = serverIP
+			}
+			config := &tls.Config{
+				Certificates: []tls.Certificate{*mb.ca.MustNewTLSCertificate(serverName)},
+			}
+
+			// when blocking, complete the handshake without contacting the
+			// server, such that the client observes a closed connection
+			if blocked = !mb.allow(info); blocked {
+				return config, nil
+			}
+
+			// complete the server handshake first, such that we know which
+			// ALPN protocol the server selected and we can mirror it
+			nextProtos := chi.SupportedProtos
+			if http1Only {
+				nextProtos = []string{"http/1.1"}
+			}
+			serverTLS = tls.Client(serverConn, mb.upstreamTLSConfig(serverName, nextProtos))
+			if err := serverTLS.HandshakeContext(chi.Context()); err != nil {
+				return nil, err
+			}
+			if proto := serverTLS.ConnectionState().NegotiatedProtocol; proto != "" {
+				config.NextProtos = []string{proto}
+			}
+			return config, nil
+		},
+	})
+	// bound both handshakes, since the server handshake runs with the context
+	// of the client handshake, and abort them when the middlebox is closed
+	ctx, cancel := mb.newContext(middleboxHandshakeTimeout)
+	defer cancel()
+	if err := clientTLS.HandshakeContext(ctx); err != nil {
+		return clientConn, serverConn, err
+	}
+	if blocked {
+		mb.logger.Infof("netem: middlebox: blocking %s -> %s (%s)",
+			info.ClientAddress, info.ServerAddress, info.ServerName)
+		return clientTLS, serverConn, errMiddleboxPolicy
+	}
+	return clientTLS, serverTLS, nil
+}
+
+// upstreamTLSConfig returns the TLS config for connecting to the real server.
+func (mb *Middlebox) upstreamTLSConfig(serverName string, nextProtos []string) *tls.Config {
+	var config *tls.Config
+	if mb.config.TLSUpstreamConfig != nil {
+		config = mb.config.TLSUpstreamConfig.Clone()
+	} else {
+		config = &tls.Config{RootCAs: mb.ca.DefaultCertPool()}
+	}
+	config.ServerName = serverName
+	config.NextProtos = nextProtos
+	return config
+}
+
+// proxy copies data between the given connections until either
+// direction is done or the [Middlebox] is closed.
+func (mb *Middlebox) proxy(left, right net.Conn) {
+	mb.proxyWithCopier(left, right, io.Copy)
+}
+
+// proxyWithCopier is like [Middlebox.proxy] but uses the given
+// function to copy the data in each direction.
+func (mb *Middlebox) proxyWithCopier(
+	left, right net.Conn, copier func(dst io.Writer, src io.Reader) (int64, error)) {
+	done := make(chan any, 2)
+	go func() {
+		_, _ = copier(right, left)
+		done <- true
+	}()
+	go func() {
+		_, _ = copier(left, right)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-mb.closed:
+	}
+	left.Close()
+	right.Close()
+	<-done
+}
+
+// middleboxCopyStrippingSTARTTLS is like [io.Copy] but reads the source line
+// by line and replaces each case-insensitive occurrence of STARTTLS with XXXXXXXA.
+func middleboxCopyStrippingSTARTTLS(dst io.Writer, src io.Reader) (int64, error) {
+	reader := bufio.NewReader(src)
+	var total int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			middleboxStripSTARTTLS(line)
+			count, err := dst.Write(line)
+			total += int64(count)
+			if err != nil {
+				return total, err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// middleboxStripSTARTTLS replaces in place each case-insensitive
+// occurrence of STARTTLS in the given line with XXXXXXXA.
+func middleboxStripSTARTTLS(line []byte) {
+	const keyword, replacement = "STARTTLS", "XXXXXXXA"
+	for idx := 0; idx+len(keyword) <= len(line); idx++ {
+		if bytes.EqualFold(line[idx:idx+len(keyword)], []byte(keyword)) {
+			copy(line[idx:], replacement)
+			idx += len(keyword) - 1
+		}
+	}
+}
+
+// middleboxConnListener is a [net.Listener] returning a single conn.
+type middleboxConnListener struct {
+	closeOnce sync.Once
+	closed    chan any
+	conns     chan net.Conn
+	laddr     net.Addr
+}
+
+// newMiddleboxConnListener creates a [middleboxConnListener] returning the given conn.
+func newMiddleboxConnListener(conn net.Conn) *middleboxConnListener {
+	conns := make(chan net.Conn, 1)
+	conns <- conn
+	return &middleboxConnListener{
+		closeOnce: sync.Once{},
+		closed:    make(chan any),
+		conns:     conns,
+		laddr:     conn.LocalAddr(),
+	}
+}
+
+var _ net.Listener = &middleboxConnListener{}
+
+// Accept implements net.Listener.
+func (l *middleboxConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr implements net.Listener.
+func (l *middleboxConnListener) Addr() net.Addr {
+	return l.laddr
+}
+
+// Close implements net.Listener.
+func (l *middleboxConnListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		select {
+		case conn := <-l.conns:
+			conn.Close()
+		default:
+		}
+	})
+	return nil
+}
+
+// middleboxNIC is a [NIC] of a [Middlebox].
+type middleboxNIC struct {
+	closeOnce sync.Once
+	closed    chan any
+	logger    Logger
+	mu        sync.Mutex
+	name      string
+	notify    chan any
+	queue     []*Frame
+	writer    func(frame *Frame) error
+}
+
+// newMiddleboxNIC creates a new [middleboxNIC] calling
+// the given function for each frame written to it.
+func newMiddleboxNIC(logger Logger, writer func(frame *Frame) error) *middleboxNIC {
+	const maxNotifications = 1024
+	nic := &middleboxNIC{
+		closeOnce: sync.Once{},
+		closed:    make(chan any),
+		logger:    logger,
+		mu:        sync.Mutex{},
+		name:      newNICName(),
+		notify:    make(chan any, maxNotifications),
+		queue:     []*Frame{},
+		writer:    writer,
+	}
+	logger.Debugf("netem: ifconfig %s up", nic.name)
+	return nic
+}
+
+var _ NIC = &middleboxNIC{}
+
+// enqueue adds a frame to the queue of frames the NIC emits.
+func (nic *middleboxNIC) enqueue(frame *Frame) error {
+	defer nic.mu.Unlock()
+	nic.mu.Lock()
+	select {
+	case <-nic.closed:
+		frame.Release()
+		return ErrStackClosed
+	case nic.notify <- true:
+		nic.queue = append(nic.queue, frame)
+		return nil
+	default:
+		frame.Release()
+		return ErrPacketDropped
+	}
+}
+
+// FrameAvailable implements NIC
+func (nic *middleboxNIC) FrameAvailable() <-chan any {
+	return nic.notify
+}
+
+// ReadFrameNonblocking implements NIC
+func (nic *middleboxNIC) ReadFrameNonblocking() (*Frame, error) {
+	select {
+	case <-nic.closed:
+		return nil, ErrStackClosed
+	default:
+	}
+	defer nic.mu.Unlock()
+	nic.mu.Lock()
+	if len(nic.queue) <= 0 {
+		return nil, ErrNoPacket
+	}
+	frame := nic.queue[0]
+	nic.queue = nic.queue[1:]
+	return frame, nil
+}
+
+// StackClosed implements NIC
+func (nic *middleboxNIC) StackClosed() <-chan any {
+	return nic.closed
+}
+
+// Close implements NIC
+func (nic *middleboxNIC) Close() error {
+	nic.closeOnce.Do(func() {
+		nic.logger.Debugf("netem: ifconfig %s down", nic.name)
+		close(nic.closed)
+	})
+	return nil
+}
+
+// IPAddress implements NIC
+func (nic *middleboxNIC) IPAddress() string {
+	return "0.0.0.0"
+}
+
+// InterfaceName implements NIC
+func (nic *middleboxNIC) InterfaceName() string {
+	return nic.name
+}
+
+// WriteFrame implements NIC
+func (nic *middleboxNIC) WriteFrame(frame *Frame) error {
+	select {
+	case <-nic.closed:
+		frame.Release()
+		return ErrStackClosed
+	default:
+	}
+	return nic.writer(frame)
+}
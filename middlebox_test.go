@@ -0,0 +1,248 @@
+package netem
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMiddlebox(t *testing.T) {
+	// newTopologyWithCAs creates the following topology
+	//
+	//	10.0.0.2 <-> middlebox <-> router <-> 10.0.0.1
+	//
+	// where 10.0.0.1 runs DNS, DNS-over-TCP, and DNS-over-TLS servers. The
+	// client and the middlebox use mbCA, while the server uses serverCA.
+	newTopologyWithCAs := func(t *testing.T, config *MiddleboxConfig,
+		mbCA, serverCA *CA) (*UNetStack, *UNetStack, *DNSQueryLog) {
+		router := NewRouter(&NullLogger{})
+
+		mb := Must1(NewMiddlebox(&NullLogger{}, mbCA, config))
+		t.Cleanup(func() { mb.Close() })
+
+		client := Must1(NewUNetStack(&NullLogger{}, 1500, "10.0.0.2", mbCA, "10.0.0.1"))
+		clientLink := NewLink(&NullLogger{}, client, mb.ClientSideNIC(), &LinkConfig{})
+		t.Cleanup(func() { clientLink.Close() })
+		clientPort := NewRouterPort(router)
+		router.AddRoute("10.0.0.2", clientPort)
+		middleboxLink := NewLink(&NullLogger{}, mb.ServerSideNIC(), clientPort, &LinkConfig{})
+		t.Cleanup(func() { middleboxLink.Close() })
+
+		server := Must1(NewUNetStack(&NullLogger{}, 1500, "10.0.0.1", serverCA, "0.0.0.0"))
+		serverPort := NewRouterPort(router)
+		router.AddRoute("10.0.0.1", serverPort)
+		serverLink := NewLink(&NullLogger{}, server, serverPort, &LinkConfig{})
+		t.Cleanup(func() { serverLink.Close() })
+
+		queryLog := &DNSQueryLog{}
+		options := &DNSServerOptions{QueryLog: queryLog.Add}
+		dnsConfig := NewDNSConfig()
+		dnsConfig.AddRecord("www.example.com", "", "10.0.0.3")
+		dnsServer := Must1(NewDNSServerWithOptions(&NullLogger{}, server, "10.0.0.1", dnsConfig, options))
+		t.Cleanup(func() { dnsServer.Close() })
+		dotServer := Must1(NewDoTServerWithOptions(&NullLogger{}, server, "10.0.0.1", dnsConfig, options))
+		t.Cleanup(func() { dotServer.Close() })
+
+		return client, server, queryLog
+	}
+
+	// newTopology is like newTopologyWithCAs but all hosts use the same CA.
+	newTopology := func(t *testing.T, config *MiddleboxConfig) (*UNetStack, *DNSQueryLog) {
+		ca := MustNewCA()
+		client, _, queryLog := newTopologyWithCAs(t, config, ca, ca)
+		return client, queryLog
+	}
+
+	// interceptions collects the connections seen by the policy.
+	type interceptions struct {
+		infos []*MiddleboxConnInfo
+		mu    sync.Mutex
+	}
+
+	// policy returns a policy that records connections and blocks the given port.
+	policy := func(record *interceptions, blockedPort string) func(info *MiddleboxConnInfo) bool {
+		return func(info *MiddleboxConnInfo) bool {
+			record.mu.Lock()
+			record.infos = append(record.infos, info)
+			record.mu.Unlock()
+			return !strings.HasSuffix(info.ServerAddress, ":"+blockedPort)
+		}
+	}
+
+	// lookup performs a lookup using the given round tripper.
+	lookup := func(client *UNetStack, network string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		query := NewDNSRequestA("www.example.com")
+		var err error
+		switch network {
+		case "udp":
+			_, err = DNSRoundTrip(ctx, client, "10.0.0.1", query)
+		case "tcp":
+			_, err = DNSRoundTripTCP(ctx, client, "10.0.0.1", query)
+		case "dot":
+			_, err = DNSRoundTripTLS(ctx, client, "10.0.0.1", query)
+		}
+		return err
+	}
+
+	t.Run("the middlebox transparently proxies the intercepted connections", func(t *testing.T) {
+		record := &interceptions{}
+		client, queryLog := newTopology(t, &MiddleboxConfig{
+			InterceptTCPPorts: []uint16{53, 853},
+			Policy:            policy(record, ""),
+			TLSMITMPorts:      []uint16{853},
+		})
+		for _, network := range []string{"udp", "tcp", "dot"} {
+			if err := lookup(client, network); err != nil {
+				t.Fatal(network, err)
+			}
+		}
+
+		// the policy only sees the intercepted connections
+		record.mu.Lock()
+		defer record.mu.Unlock()
+		if len(record.infos) != 2 {
+			t.Fatal("expected two intercepted connections, got", len(record.infos))
+		}
+		for _, info := range record.infos {
+			if !strings.HasPrefix(info.ClientAddress, "10.0.0.2:") {
+				t.Fatal("unexpected client address", info.ClientAddress)
+			}
+		}
+
+		// the server sees connections coming from the client address
+		entries := queryLog.Entries()
+		if len(entries) != 3 {
+			t.Fatal("expected three queries, got", len(entries))
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.ClientAddress, "10.0.0.2:") {
+				t.Fatal("unexpected client address", entry.ClientAddress)
+			}
+		}
+	})
+
+	for _, network := range []string{"tcp", "dot"} {
+		t.Run("the policy can block connections with "+network, func(t *testing.T) {
+			blockedPort := map[string]string{"tcp": "53", "dot": "853"}[network]
+			client, queryLog := newTopology(t, &MiddleboxConfig{
+				InterceptTCPPorts: []uint16{53, 853},
+				Policy:            policy(&interceptions{}, blockedPort),
+				TLSMITMPorts:      []uint16{853},
+			})
+			if err := lookup(client, network); err == nil {
+				t.Fatal("expected an error")
+			}
+			if entries := queryLog.Entries(); len(entries) != 0 {
+				t.Fatal("expected no queries, got", len(entries))
+			}
+			if err := lookup(client, "udp"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("the middlebox intercepts TLS using its own CA and mirrors the ALPN", func(t *testing.T) {
+		mbCA, serverCA := MustNewCA(), MustNewCA()
+		client, server, _ := newTopologyWithCAs(t, &MiddleboxConfig{
+			InterceptTCPPorts: []uint16{443},
+			TLSMITMPorts:      []uint16{443},
+			TLSUpstreamConfig: &tls.Config{RootCAs: serverCA.DefaultCertPool()},
+		}, mbCA, serverCA)
+
+		serverConfig := server.MustNewServerTLSConfig("10.0.0.1", "www.example.com")
+		listener := Must1((&Net{Stack: server}).ListenTLS("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, serverConfig))
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn := Must1(client.DialContext(ctx, "tcp", "10.0.0.1:443"))
+		defer conn.Close()
+		tlsConn := tls.Client(conn, &tls.Config{
+			NextProtos: []string{"h2", "http/1.1"},
+			RootCAs:    client.DefaultCertPool(),
+			ServerName: "www.example.com",
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// the client sees the protocol selected by the server and a certificate
+		// that only validates using the middlebox's CA
+		state := tlsConn.ConnectionState()
+		if state.NegotiatedProtocol != "http/1.1" {
+			t.Fatal("unexpected negotiated protocol", state.NegotiatedProtocol)
+		}
+		leaf := state.PeerCertificates[0]
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: serverCA.DefaultCertPool()}); err == nil {
+			t.Fatal("the certificate validates using the server's CA")
+		}
+
+		// the data flows end to end through the middlebox
+		Must1(tlsConn.Write([]byte("abc")))
+		buffer := make([]byte, 3)
+		Must0(tlsConn.SetDeadline(time.Now().Add(5 * time.Second)))
+		Must1(io.ReadFull(tlsConn, buffer))
+		if string(buffer) != "abc" {
+			t.Fatal("unexpected data", string(buffer))
+		}
+	})
+
+	t.Run("the client observes a reset when the server is unreachable", func(t *testing.T) {
+		client, _ := newTopology(t, &MiddleboxConfig{InterceptTCPPorts: []uint16{80}})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := client.DialContext(ctx, "tcp", "10.0.0.1:80")
+		if err == nil || errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("expected connection refused, got", err)
+		}
+	})
+
+	t.Run("the middlebox can strip STARTTLS", func(t *testing.T) {
+		ca := MustNewCA()
+		client, server, _ := newTopologyWithCAs(t, &MiddleboxConfig{
+			InterceptTCPPorts:  []uint16{25},
+			STARTTLSStripPorts: []uint16{25},
+		}, ca, ca)
+		smtpServer := Must1(NewSMTPServer(&NullLogger{}, server, "10.0.0.1", &MailServerConfig{
+			TLSConfig: server.MustNewServerTLSConfig("mail.example.com"),
+		}))
+		t.Cleanup(func() { smtpServer.Close() })
+
+		conn := Must1(client.DialContext(context.Background(), "tcp", "10.0.0.1:25"))
+		defer conn.Close()
+		Must0(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+		smtpClient := Must1(smtp.NewClient(conn, "mail.example.com"))
+		Must0(smtpClient.Hello("client.example.com"))
+		if found, _ := smtpClient.Extension("STARTTLS"); found {
+			t.Fatal("expected the middlebox to strip STARTTLS")
+		}
+		if found, _ := smtpClient.Extension("XXXXXXXA"); !found {
+			t.Fatal("expected the middlebox to replace STARTTLS")
+		}
+		var tperr *textproto.Error
+		err := smtpClient.StartTLS(&tls.Config{ServerName: "mail.example.com", RootCAs: client.DefaultCertPool()})
+		if !errors.As(err, &tperr) || tperr.Code != 502 {
+			t.Fatal("unexpected error", err)
+		}
+		Must0(smtpClient.Quit())
+	})
+}
@@ -0,0 +1,120 @@
+package netem
+
+//
+// Transparent HTTP proxy middlebox
+//
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+)
+
+// MiddleboxHTTPProxyConfig configures a [Middlebox] to act as a transparent
+// HTTP proxy, thus emulating the ISP transparent proxies whose artifacts
+// (e.g., the Via and X-Forwarded-For headers) measurement tools look for.
+type MiddleboxHTTPProxyConfig struct {
+	// AddRequestHeaders contains the OPTIONAL headers to set in each request.
+	AddRequestHeaders map[string]string
+
+	// AddResponseHeaders contains the OPTIONAL headers to set in each response.
+	AddResponseHeaders map[string]string
+
+	// Ports contains the MANDATORY subset of the InterceptTCPPorts for which
+	// the [Middlebox] proxies at the HTTP layer. For ports that are also
+	// TLSMITMPorts, the [Middlebox] proxies the decrypted traffic. Because we
+	// only proxy HTTP/1.x, we only offer HTTP/1.1 to servers on such ports.
+	Ports []uint16
+
+	// RemoveRequestHeaders contains the OPTIONAL headers to remove from each request.
+	RemoveRequestHeaders []string
+
+	// RemoveResponseHeaders contains the OPTIONAL headers to remove from each response.
+	RemoveResponseHeaders []string
+
+	// RewriteBody is the OPTIONAL function to rewrite each response body. When
+	// this function is set, we read the whole body before rewriting it.
+	RewriteBody func(body []byte) []byte
+
+	// Via is the OPTIONAL value of the Via header to add to the requests
+	// and the responses (e.g., "1.1 proxy.isp.example").
+	Via string
+
+	// XForwardedFor OPTIONALLY adds the X-Forwarded-For header containing
+	// the client address to each request.
+	XForwardedFor bool
+}
+
+// proxyHTTP proxies HTTP/1.x requests and responses between the given conns
+// modifying them according to the configuration, until either conn is done
+// or the [Middlebox] is closed.
+func (mb *Middlebox) proxyHTTP(clientConn, serverConn net.Conn, info *MiddleboxConnInfo) {
+	done := make(chan any)
+	defer close(done)
+	go func() {
+		select {
+		case <-mb.closed:
+		case <-done:
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}()
+
+	config := mb.config.HTTPProxy
+	clientIP, _, _ := net.SplitHostPort(info.ClientAddress)
+	clientReader := bufio.NewReader(clientConn)
+	serverReader := bufio.NewReader(serverConn)
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			return
+		}
+		for _, key := range config.RemoveRequestHeaders {
+			req.Header.Del(key)
+		}
+		for key, value := range config.AddRequestHeaders {
+			req.Header.Set(key, value)
+		}
+		if config.Via != "" {
+			req.Header.Add("Via", config.Via)
+		}
+		if config.XForwardedFor {
+			req.Header.Add("X-Forwarded-For", clientIP)
+		}
+		if err := req.Write(serverConn); err != nil {
+			return
+		}
+
+		resp, err := http.ReadResponse(serverReader, req)
+		if err != nil {
+			return
+		}
+		for _, key := range config.RemoveResponseHeaders {
+			resp.Header.Del(key)
+		}
+		for key, value := range config.AddResponseHeaders {
+			resp.Header.Set(key, value)
+		}
+		if config.Via != "" {
+			resp.Header.Add("Via", config.Via)
+		}
+		if config.RewriteBody != nil {
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return
+			}
+			body = config.RewriteBody(body)
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			resp.ContentLength = int64(len(body))
+			resp.TransferEncoding = nil
+		}
+		err = resp.Write(clientConn)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package netem
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestMiddleboxHTTPProxy(t *testing.T) {
+	// create the following topology
+	//
+	//	10.0.0.2 <-> middlebox <-> router <-> 10.0.0.1
+	//
+	// where 10.0.0.1 runs a web server echoing the request headers.
+	ca := MustNewCA()
+	router := NewRouter(&NullLogger{})
+
+	mb := Must1(NewMiddlebox(&NullLogger{}, ca, &MiddleboxConfig{
+		HTTPProxy: &MiddleboxHTTPProxyConfig{
+			AddRequestHeaders:     map[string]string{"X-ISP": "isp"},
+			AddResponseHeaders:    map[string]string{"X-Cache": "MISS"},
+			Ports:                 []uint16{80, 443},
+			RemoveRequestHeaders:  []string{"X-Secret"},
+			RemoveResponseHeaders: []string{"X-Server-Secret"},
+			RewriteBody: func(body []byte) []byte {
+				return bytes.ReplaceAll(body, []byte("netem"), []byte("NETEM"))
+			},
+			Via:           "1.1 proxy.isp.example",
+			XForwardedFor: true,
+		},
+		InterceptTCPPorts: []uint16{80, 443},
+		TLSMITMPorts:      []uint16{443},
+	}))
+	defer mb.Close()
+
+	client := Must1(NewUNetStack(&NullLogger{}, 1500, "10.0.0.2", ca, "10.0.0.1"))
+	clientLink := NewLink(&NullLogger{}, client, mb.ClientSideNIC(), &LinkConfig{})
+	defer clientLink.Close()
+	clientPort := NewRouterPort(router)
+	router.AddRoute("10.0.0.2", clientPort)
+	middleboxLink := NewLink(&NullLogger{}, mb.ServerSideNIC(), clientPort, &LinkConfig{})
+	defer middleboxLink.Close()
+
+	server := Must1(NewUNetStack(&NullLogger{}, 1500, "10.0.0.1", ca, "0.0.0.0"))
+	serverPort := NewRouterPort(router)
+	router.AddRoute("10.0.0.1", serverPort)
+	serverLink := NewLink(&NullLogger{}, server, serverPort, &LinkConfig{})
+	defer serverLink.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Server-Secret", "42")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Header)
+	})
+	ns := &Net{Stack: server}
+	httpListener := Must1(ns.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}))
+	tlsConfig := server.MustNewServerTLSConfig("10.0.0.1")
+	httpsListener := Must1(ns.ListenTLS("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, tlsConfig))
+	for _, listener := range []net.Listener{httpListener, httpsListener} {
+		server := &http.Server{Handler: handler}
+		defer server.Close()
+		go server.Serve(listener)
+	}
+
+	httpClient := NewHTTPClient(client)
+	for _, URL := range []string{"http://10.0.0.1/", "https://10.0.0.1/"} {
+		t.Run("we mangle the headers and the body with "+URL, func(t *testing.T) {
+			// send several requests to make sure we handle persistent connections
+			for idx := 0; idx < 3; idx++ {
+				req := Must1(http.NewRequest("GET", URL, nil))
+				req.Header.Set("User-Agent", "netem")
+				req.Header.Set("X-Secret", "deadbeef")
+				resp, err := httpClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body := Must1(io.ReadAll(resp.Body))
+				resp.Body.Close()
+
+				if resp.Header.Get("Via") != "1.1 proxy.isp.example" || resp.Header.Get("X-Cache") != "MISS" {
+					t.Fatal("unexpected response headers", resp.Header)
+				}
+				if resp.Header.Get("X-Server-Secret") != "" {
+					t.Fatal("expected the server secret to be removed")
+				}
+
+				var headers http.Header
+				Must0(json.Unmarshal(body, &headers))
+				if headers.Get("Via") != "1.1 proxy.isp.example" || headers.Get("X-Forwarded-For") != "10.0.0.2" {
+					t.Fatal("unexpected request headers", headers)
+				}
+				if headers.Get("X-Isp") != "isp" || headers.Get("X-Secret") != "" {
+					t.Fatal("unexpected request headers", headers)
+				}
+				// the rewriting affects the echoed User-Agent
+				if headers.Get("User-Agent") != "NETEM" {
+					t.Fatal("expected the body to be rewritten", string(body))
+				}
+			}
+		})
+	}
+}
@@ -65,6 +65,11 @@ type Frame struct {
 	// spoof when processing this packet. We honor this field iff the
 	// FrameFlagSpoof flag is set in the Flags field.
 	Spoofed [][]byte
+
+	// Buffer is the OPTIONAL pooled buffer backing the Payload, which
+	// we use to implement [Frame.Retain] and [Frame.Release]. Frames
+	// created using [NewFrame] do not have a pooled buffer.
+	Buffer *FrameBuffer
 }
 
 // NewFrame constructs a [Frame] for the given [Payload].
@@ -85,6 +90,7 @@ func (f *Frame) ShallowCopy() *Frame {
 		Flags:    f.Flags,
 		Payload:  f.Payload,
 		Spoofed:  f.Spoofed,
+		Buffer:   f.Buffer,
 	}
 }
 
@@ -147,6 +153,10 @@ type NIC interface {
 
 	// WriteFrame writes a frame or returns an error. This function
 	// returns ErrStackClosed when the underlying stack has been closed.
+	//
+	// The NIC takes ownership of the frame and may recycle its payload
+	// once done (see [Frame.Release]), so you should not use the
+	// frame after calling this method unless you retained it.
 	WriteFrame(frame *Frame) error
 }
 
@@ -0,0 +1,301 @@
+package netem
+
+//
+// Multi-connection throughput
+//
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// multiFlowDirections maps the first byte sent by the client to the
+// [MultiFlowServer], which is the first letter of the direction, to
+// the direction of the measurement.
+var multiFlowDirections = map[byte]NDT0Direction{
+	'd': NDT0DirectionDownload,
+	'u': NDT0DirectionUpload,
+	'b': NDT0DirectionBidirectional,
+}
+
+// MultiFlowServer is the server for [MeasureMultiFlowThroughput], which
+// sends and/or receives bulk data using each connection depending on the
+// direction requested by the client. The zero value is invalid, please
+// construct using [NewMultiFlowServer].
+type MultiFlowServer struct {
+	closed   chan any
+	listener net.Listener
+	logger   Logger
+	once     sync.Once
+}
+
+// NewMultiFlowServer creates a new [MultiFlowServer] listening on the given
+// address and TCP port. Remember to call [MultiFlowServer.Close] when done.
+func NewMultiFlowServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	port int,
+) (*MultiFlowServer, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	tcpAddr := &net.TCPAddr{
+		IP:   parsedIP,
+		Port: port,
+		Zone: "",
+	}
+	listener, err := stack.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	mfs := &MultiFlowServer{
+		closed:   make(chan any),
+		listener: listener,
+		logger:   logger,
+	}
+	go mfs.acceptor()
+	return mfs, nil
+}
+
+// acceptor accepts connections until the server is closed.
+func (mfs *MultiFlowServer) acceptor() {
+	for {
+		conn, err := mfs.listener.Accept()
+		if err != nil {
+			mfs.logger.Debugf("netem: MultiFlowServer: %s", err.Error())
+			return
+		}
+		go mfs.serve(conn)
+	}
+}
+
+// serve serves a single flow until it fails or the server is closed.
+func (mfs *MultiFlowServer) serve(conn net.Conn) {
+	buffer := make([]byte, 65535)
+	if _, err := conn.Read(buffer[:1]); err != nil {
+		conn.Close()
+		return
+	}
+	direction, found := multiFlowDirections[buffer[0]]
+	if !found {
+		conn.Close()
+		return
+	}
+	if _, err := rand.Read(buffer); err != nil {
+		conn.Close()
+		return
+	}
+
+	// the server receives when the client sends and vice versa
+	receive, send, _ := direction.clientFlows()
+	flows := newNDT0Flows(conn, mfs.logger, "MultiFlowServer")
+	if send {
+		flows.startSending(buffer)
+	}
+	if receive {
+		flows.startReceiving()
+	}
+	select {
+	case <-flows.done:
+	case <-mfs.closed:
+	}
+	flows.stop()
+}
+
+// Close stops accepting flows and interrupts the flows still transferring data.
+func (mfs *MultiFlowServer) Close() error {
+	mfs.once.Do(func() {
+		close(mfs.closed)
+		mfs.listener.Close()
+	})
+	return nil
+}
+
+// MultiFlowOptions contains OPTIONAL settings for [MeasureMultiFlowThroughput]. With
+// the zero value, we download for five seconds using four parallel connections.
+type MultiFlowOptions struct {
+	// Direction is the OPTIONAL direction of the measurement (default:
+	// [NDT0DirectionDownload]).
+	Direction NDT0Direction
+
+	// Duration is the OPTIONAL duration of the measurement (default: 5 s).
+	Duration time.Duration
+
+	// Flows is the OPTIONAL number of parallel connections (default: 4).
+	Flows int
+
+	// MessageSize is the OPTIONAL size of each write (default: 65535 bytes).
+	MessageSize int
+}
+
+// MultiFlowStats contains the statistics of a single flow.
+type MultiFlowStats struct {
+	// Duration is the duration of the flow.
+	Duration time.Duration
+
+	// ReceivedTotal is the number of bytes received by the client.
+	ReceivedTotal int64
+
+	// SentTotal is the number of bytes sent by the client.
+	SentTotal int64
+}
+
+// AvgSpeedMbps returns the average download speed of the flow in Mbit/s.
+func (fs *MultiFlowStats) AvgSpeedMbps() float64 {
+	return multiFlowSpeedMbps(fs.ReceivedTotal, fs.Duration)
+}
+
+// AvgSendSpeedMbps returns the average upload speed of the flow in Mbit/s.
+func (fs *MultiFlowStats) AvgSendSpeedMbps() float64 {
+	return multiFlowSpeedMbps(fs.SentTotal, fs.Duration)
+}
+
+// MultiFlowReport is the result of [MeasureMultiFlowThroughput].
+type MultiFlowReport struct {
+	// Duration is the duration of the measurement.
+	Duration time.Duration
+
+	// Flows contains the statistics of each flow.
+	Flows []*MultiFlowStats
+}
+
+// AvgSpeedMbps returns the aggregate download speed in Mbit/s.
+func (r *MultiFlowReport) AvgSpeedMbps() float64 {
+	var total int64
+	for _, flow := range r.Flows {
+		total += flow.ReceivedTotal
+	}
+	return multiFlowSpeedMbps(total, r.Duration)
+}
+
+// AvgSendSpeedMbps returns the aggregate upload speed in Mbit/s.
+func (r *MultiFlowReport) AvgSendSpeedMbps() float64 {
+	var total int64
+	for _, flow := range r.Flows {
+		total += flow.SentTotal
+	}
+	return multiFlowSpeedMbps(total, r.Duration)
+}
+
+// FairnessIndex returns Jain's fairness index of the bytes transferred
+// by each flow, which is 1 when all the flows obtain the same throughput
+// and 1/N when a single flow out of N obtains all the throughput. We
+// return zero when there are no flows or no bytes were transferred.
+func (r *MultiFlowReport) FairnessIndex() float64 {
+	var sum, sumOfSquares float64
+	for _, flow := range r.Flows {
+		value := float64(flow.ReceivedTotal + flow.SentTotal)
+		sum += value
+		sumOfSquares += value * value
+	}
+	if sumOfSquares <= 0 {
+		return 0
+	}
+	return (sum * sum) / (float64(len(r.Flows)) * sumOfSquares)
+}
+
+// multiFlowSpeedMbps converts bytes transferred in the given time to Mbit/s.
+func multiFlowSpeedMbps(total int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return (float64(total*8) / elapsed.Seconds()) / (1000 * 1000)
+}
+
+// MeasureMultiFlowThroughput opens several parallel TCP connections to the
+// given [MultiFlowServer] endpoint (e.g., 10.0.0.1:8080), like speedtest-style
+// tools do, and measures the throughput of each flow and the aggregate
+// throughput, which allows to evaluate fairness across flows sharing an
+// impaired link. The upload statistics count the bytes written by the client.
+func MeasureMultiFlowThroughput(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	serverAddr string,
+	options *MultiFlowOptions,
+) (*MultiFlowReport, error) {
+	direction := options.Direction
+	if direction == "" {
+		direction = NDT0DirectionDownload
+	}
+	send, receive, err := direction.clientFlows()
+	if err != nil {
+		return nil, err
+	}
+	duration := options.Duration
+	if duration <= 0 {
+		duration = 5 * time.Second
+	}
+	numFlows := options.Flows
+	if numFlows <= 0 {
+		numFlows = 4
+	}
+	messageSize := (&NDT0Options{MessageSize: options.MessageSize}).messageSize()
+	buffer := make([]byte, messageSize)
+	if _, err := rand.Read(buffer); err != nil {
+		return nil, err
+	}
+
+	// open all the connections before starting to measure
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for idx := 0; idx < numFlows; idx++ {
+		conn, err := stack.DialContext(ctx, "tcp", serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+
+	// start all the flows at the same time
+	t0 := time.Now()
+	var flows []*ndt0Flows
+	for idx, conn := range conns {
+		if _, err := conn.Write([]byte{direction[0]}); err != nil {
+			return nil, err
+		}
+		flow := newNDT0Flows(conn, &NullLogger{}, fmt.Sprintf("MeasureMultiFlowThroughput#%d", idx))
+		if send {
+			flow.startSending(buffer)
+		}
+		if receive {
+			flow.startReceiving()
+		}
+		flows = append(flows, flow)
+	}
+
+	// wait for the measurement to complete
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		for _, flow := range flows {
+			flow.stop()
+		}
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+
+	// collect the statistics before stopping the flows
+	report := &MultiFlowReport{Duration: time.Since(t0)}
+	for _, flow := range flows {
+		report.Flows = append(report.Flows, &MultiFlowStats{
+			Duration:      report.Duration,
+			ReceivedTotal: flow.received.Load(),
+			SentTotal:     flow.sent.Load(),
+		})
+	}
+	for _, flow := range flows {
+		flow.stop()
+	}
+	return report, nil
+}
@@ -0,0 +1,99 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMeasureMultiFlowThroughput(t *testing.T) {
+	t.Run("the flows share the bottleneck", func(t *testing.T) {
+		ca := MustNewCA()
+		router := NewRouter(&NullLogger{})
+		lc := &LinkConfig{
+			LeftToRightDelay: 5 * time.Millisecond,
+			RightToLeftDelay: 5 * time.Millisecond,
+		}
+		client := routerTestAttachHost(t, ca, router, "10.0.0.2", &RouterPortConfig{RateBitsPerSecond: 10 * 1000 * 1000}, lc)
+		serverStack := routerTestAttachHost(t, ca, router, "10.0.0.1", &RouterPortConfig{}, lc)
+
+		server := Must1(NewMultiFlowServer(&NullLogger{}, serverStack, "10.0.0.1", 8080))
+		defer server.Close()
+
+		options := &MultiFlowOptions{Duration: 2 * time.Second, Flows: 4}
+		report, err := MeasureMultiFlowThroughput(context.Background(), client, "10.0.0.1:8080", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for idx, flow := range report.Flows {
+			t.Logf("flow #%d: %.1f Mbit/s", idx, flow.AvgSpeedMbps())
+		}
+		t.Logf("total: %.1f Mbit/s; fairness: %.2f", report.AvgSpeedMbps(), report.FairnessIndex())
+		if len(report.Flows) != 4 {
+			t.Fatal("unexpected number of flows")
+		}
+		if speed := report.AvgSpeedMbps(); speed < 5 || speed > 11 {
+			t.Fatal("unexpected aggregate speed", speed)
+		}
+		if report.AvgSendSpeedMbps() != 0 {
+			t.Fatal("expected no upload")
+		}
+		if index := report.FairnessIndex(); index < 0.5 {
+			t.Fatal("unexpected fairness index", index)
+		}
+	})
+
+	t.Run("we can measure the upload", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		server := Must1(NewMultiFlowServer(&NullLogger{}, topology.Server, "10.0.0.1", 8080))
+		defer server.Close()
+
+		options := &MultiFlowOptions{Direction: NDT0DirectionUpload, Duration: 500 * time.Millisecond, Flows: 2}
+		report, err := MeasureMultiFlowThroughput(context.Background(), topology.Client, "10.0.0.1:8080", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, flow := range report.Flows {
+			if flow.SentTotal <= 0 || flow.ReceivedTotal != 0 {
+				t.Fatalf("unexpected flow %+v", flow)
+			}
+		}
+	})
+
+	t.Run("we reject an unknown direction", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		options := &MultiFlowOptions{Direction: "sideways"}
+		_, err := MeasureMultiFlowThroughput(context.Background(), topology.Client, "10.0.0.1:8080", options)
+		if !errors.Is(err, ErrNDT0UnknownDirection) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestMultiFlowReport(t *testing.T) {
+	report := &MultiFlowReport{
+		Duration: time.Second,
+		Flows: []*MultiFlowStats{
+			{Duration: time.Second, ReceivedTotal: 1000 * 1000},
+			{Duration: time.Second, ReceivedTotal: 1000 * 1000},
+		},
+	}
+	if report.AvgSpeedMbps() != 16 || report.Flows[0].AvgSpeedMbps() != 8 {
+		t.Fatal("unexpected speed", report.AvgSpeedMbps())
+	}
+	if report.FairnessIndex() != 1 {
+		t.Fatal("unexpected fairness index", report.FairnessIndex())
+	}
+	report.Flows[1].ReceivedTotal = 0
+	if report.FairnessIndex() != 0.5 {
+		t.Fatal("unexpected fairness index", report.FairnessIndex())
+	}
+	if (&MultiFlowReport{}).FairnessIndex() != 0 {
+		t.Fatal("expected zero without flows")
+	}
+}
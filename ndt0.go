@@ -10,11 +10,79 @@ package netem
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// NDT0Direction is the direction of an NDT0 measurement.
+type NDT0Direction string
+
+const (
+	// NDT0DirectionDownload means the server sends and the client receives,
+	// which is the default when the direction is empty.
+	NDT0DirectionDownload = NDT0Direction("download")
+
+	// NDT0DirectionUpload means the client sends and the server receives.
+	NDT0DirectionUpload = NDT0Direction("upload")
+
+	// NDT0DirectionBidirectional means both the client and the server send
+	// and receive at the same time, which allows to evaluate duplex behavior.
+	NDT0DirectionBidirectional = NDT0Direction("bidirectional")
+)
+
+// ErrNDT0UnknownDirection indicates that we do not know an [NDT0Direction].
+var ErrNDT0UnknownDirection = errors.New("netem: ndt0: unknown direction")
+
+// clientFlows returns whether the client should send and receive.
+func (d NDT0Direction) clientFlows() (send, receive bool, err error) {
+	switch d {
+	case "", NDT0DirectionDownload:
+		return false, true, nil
+	case NDT0DirectionUpload:
+		return true, false, nil
+	case NDT0DirectionBidirectional:
+		return true, true, nil
+	default:
+		return false, false, fmt.Errorf("%w: %s", ErrNDT0UnknownDirection, string(d))
+	}
+}
+
+// NDT0Options contains options for [RunNDT0ClientWithOptions] and
+// [RunNDT0ServerWithOptions]. The zero value is a valid download measurement.
+type NDT0Options struct {
+	// Direction is the OPTIONAL direction of the measurement (default:
+	// [NDT0DirectionDownload]). The client and the server MUST use the
+	// same direction because the protocol does not negotiate it.
+	Direction NDT0Direction
+
+	// MessageSize is the OPTIONAL size of each write (default: 65535 bytes).
+	MessageSize int
+
+	// SampleInterval is the OPTIONAL interval between the performance
+	// samples emitted by the client (default: 500 ms).
+	SampleInterval time.Duration
+}
+
+// messageSize returns the configured message size or the default.
+func (options *NDT0Options) messageSize() int {
+	if options.MessageSize > 0 {
+		return options.MessageSize
+	}
+	return 65535
+}
+
+// sampleInterval returns the configured sample interval or the default.
+func (options *NDT0Options) sampleInterval() time.Duration {
+	if options.SampleInterval > 0 {
+		return options.SampleInterval
+	}
+	return 500 * time.Millisecond
+}
+
 // NDT0PerformanceSample is a performance sample returned by [RunNDT0Client].
 type NDT0PerformanceSample struct {
 	// Final indicates whether this is the final sample.
@@ -27,6 +95,13 @@ type NDT0PerformanceSample struct {
 	// we collected the last sample.
 	ReceivedLast int64
 
+	// SentTotal is the total number of bytes sent.
+	SentTotal int64
+
+	// SentLast is the total number of bytes sent since
+	// we collected the last sample.
+	SentLast int64
+
 	// TimeLast is the last time we collected a sample.
 	TimeLast time.Time
 
@@ -35,11 +110,25 @@ type NDT0PerformanceSample struct {
 
 	// TimeZero is when the measurement started.
 	TimeZero time.Time
+
+	// ConnStats contains the OPTIONAL statistics of the client connection when
+	// we collected the sample (e.g., the congestion window), which allow to explain
+	// the measured speed using the transport state. This field is nil when the
+	// underlying network does not collect statistics (see [StatsConn]).
+	ConnStats *ConnStats
 }
 
 // NDT0CSVHeader is the header for the CSV records returned
 // by the [NDT0PerformanceSample.CSVRecord] function.
-const NDT0CSVHeader = "filename,rtt(s),plr,final,elapsed (s),total (byte),current (byte),avg speed (Mbit/s),cur speed (Mbit/s)"
+//
+// Note that the records have grown over time and code that parses them by
+// position must account for that. Compared to the original eight columns, we
+// have added four columns describing the data sent by the client (from "sent
+// total" to "cur send speed") and then four columns describing the transport
+// state (from "rtt estimate" to "bytes in flight"), which are zero when the
+// connection does not collect statistics. The "bytes in flight" column is also
+// zero unless the client stack tracks them (see [UNetStackOptions]).
+const NDT0CSVHeader = "filename,rtt(s),plr,final,elapsed (s),total (byte),current (byte),avg speed (Mbit/s),cur speed (Mbit/s),sent total (byte),sent current (byte),avg send speed (Mbit/s),cur send speed (Mbit/s),rtt estimate (s),cwnd (segments),retransmits,bytes in flight"
 
 // ElapsedSeconds returns the elapsed time since the beginning
 // of the measurement expressed in seconds.
@@ -53,14 +142,25 @@ func (ps *NDT0PerformanceSample) AvgSpeedMbps() float64 {
 	return (float64(ps.ReceivedTotal*8) / ps.ElapsedSeconds()) / (1000 * 1000)
 }
 
+// AvgSendSpeedMbps is like [NDT0PerformanceSample.AvgSpeedMbps]
+// but uses the number of bytes sent rather than received.
+func (ps *NDT0PerformanceSample) AvgSendSpeedMbps() float64 {
+	return (float64(ps.SentTotal*8) / ps.ElapsedSeconds()) / (1000 * 1000)
+}
+
 // CSVRecord returns a CSV representation of the sample.
 func (ps *NDT0PerformanceSample) CSVRecord(pcapfile string, rtt time.Duration, plr float64) string {
 	elapsedTotal := ps.ElapsedSeconds()
 	avgSpeed := ps.AvgSpeedMbps()
 	elapsedLast := ps.TimeNow.Sub(ps.TimeLast).Seconds()
 	curSpeed := (float64(ps.ReceivedLast*8) / elapsedLast) / (1000 * 1000)
+	curSendSpeed := (float64(ps.SentLast*8) / elapsedLast) / (1000 * 1000)
+	stats := ps.ConnStats
+	if stats == nil {
+		stats = &ConnStats{}
+	}
 	return fmt.Sprintf(
-		"%s,%f,%e,%v,%f,%d,%d,%f,%f",
+		"%s,%f,%e,%v,%f,%d,%d,%f,%f,%d,%d,%f,%f,%f,%d,%d,%d",
 		pcapfile,
 		rtt.Seconds(),
 		plr,
@@ -70,6 +170,14 @@ func (ps *NDT0PerformanceSample) CSVRecord(pcapfile string, rtt time.Duration, p
 		ps.ReceivedLast,
 		avgSpeed,
 		curSpeed,
+		ps.SentTotal,
+		ps.SentLast,
+		ps.AvgSendSpeedMbps(),
+		curSendSpeed,
+		stats.RTT.Seconds(),
+		stats.CongestionWindow,
+		stats.Retransmissions,
+		stats.BytesInFlight,
 	)
 }
 
@@ -82,8 +190,7 @@ func (ps *NDT0PerformanceSample) CSVRecord(pcapfile string, rtt time.Duration, p
 // The version number is zero because we use the network like ndt7
 // but we have much less implementation overhead.
 //
-// This function prints on the standard output download speed information
-// every 250 milliseconds using the CSV data format.
+// This function emits download speed information every 500 milliseconds.
 //
 // Arguments:
 //
@@ -109,6 +216,23 @@ func RunNDT0Client(
 	TLS bool,
 	errch chan<- error,
 	perfch chan<- *NDT0PerformanceSample,
+) {
+	RunNDT0ClientWithOptions(ctx, stack, serverAddr, logger, TLS, &NDT0Options{}, errch, perfch)
+}
+
+// RunNDT0ClientWithOptions is like [RunNDT0Client] but allows to measure
+// the upload or both directions at the same time and to configure the
+// message size and the sample interval using [NDT0Options]. The samples
+// contain the bytes sent and received by the client.
+func RunNDT0ClientWithOptions(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	serverAddr string,
+	logger Logger,
+	TLS bool,
+	options *NDT0Options,
+	errch chan<- error,
+	perfch chan<- *NDT0PerformanceSample,
 ) {
 	// as documented, close perfch when done using it
 	defer close(perfch)
@@ -117,12 +241,26 @@ func RunNDT0Client(
 	// we don't explicitly return an error
 	defer close(errch)
 
+	// determine what we should do with the connection
+	send, receive, err := options.Direction.clientFlows()
+	if err != nil {
+		errch <- err
+		return
+	}
+
+	// create buffer with random data for sending to the server
+	buffer := make([]byte, options.messageSize())
+	if _, err := rand.Read(buffer); err != nil {
+		errch <- err
+		return
+	}
+
 	// create ticker for periodically printing the download speed
-	ticker := time.NewTicker(500 * time.Millisecond)
+	ticker := time.NewTicker(options.sampleInterval())
 	defer ticker.Stop()
 
 	// conditionally use TLS
-	ns := &Net{stack}
+	ns := &Net{Stack: stack}
 	dialers := map[bool]func(context.Context, string, string) (net.Conn, error){
 		false: ns.DialContext,
 		true:  ns.DialTLSContext,
@@ -141,62 +279,60 @@ func RunNDT0Client(
 		_ = conn.SetDeadline(deadline)
 	}
 
-	// buffer for receiving from the server
-	buffer := make([]byte, 65535)
-
-	// current is the number of bytes read since the last tick
-	var current int64
-
-	// total is the number of bytes read thus far
-	var total int64
+	// obtain the connection statistics, if possible
+	statsConn := ndt0StatsConn(conn)
 
 	// t0 is when we started measuring
 	t0 := time.Now()
 
+	// start sending and receiving in the background
+	flows := newNDT0Flows(conn, logger, "RunNDT0ClientNettest")
+	if send {
+		flows.startSending(buffer)
+	}
+	if receive {
+		flows.startReceiving()
+	}
+
 	// lastT is the last time we sampled the connection
-	lastT := time.Now()
+	lastT := t0
+
+	// lastReceived and lastSent are the counters at the last sample
+	var lastReceived, lastSent int64
 
 	// run the measurement loop
 	for {
-		var (
-			emit     bool
-			finished bool
-		)
-
-		count, err := conn.Read(buffer)
-		if err != nil {
-			logger.Warnf("RunNDT0ClientNettest: %s", err.Error())
+		var finished bool
+		select {
+		case <-ticker.C:
+			// nothing
+		case <-ctx.Done():
+			finished = true
+		case <-flows.done:
 			finished = true
-			emit = true
-		} else {
-			current += int64(count)
-			total += int64(count)
-			select {
-			case <-ticker.C:
-				emit = true
-			case <-ctx.Done():
-				finished = true
-				emit = true
-			default:
-				// nothing
-			}
 		}
 
-		if emit {
-			now := time.Now()
-			perfch <- &NDT0PerformanceSample{
-				Final:         finished,
-				ReceivedTotal: total,
-				ReceivedLast:  current,
-				TimeLast:      lastT,
-				TimeNow:       now,
-				TimeZero:      t0,
-			}
-			current = 0
-			lastT = now
+		now := time.Now()
+		received, sent := flows.received.Load(), flows.sent.Load()
+		var stats *ConnStats
+		if statsConn != nil {
+			stats = statsConn.ConnStats()
 		}
+		perfch <- &NDT0PerformanceSample{
+			Final:         finished,
+			ReceivedTotal: received,
+			ReceivedLast:  received - lastReceived,
+			SentTotal:     sent,
+			SentLast:      sent - lastSent,
+			TimeLast:      lastT,
+			TimeNow:       now,
+			TimeZero:      t0,
+			ConnStats:     stats,
+		}
+		lastReceived, lastSent, lastT = received, sent, now
 
 		if finished {
+			flows.stop()
 			return
 		}
 	}
@@ -241,8 +377,35 @@ func RunNDT0Server(
 	TLS bool,
 	serverNames ...string,
 ) {
+	RunNDT0ServerWithOptions(
+		ctx, stack, serverIPAddr, serverPort, logger, ready, errorch, TLS, &NDT0Options{}, serverNames...)
+}
+
+// RunNDT0ServerWithOptions is like [RunNDT0Server] but allows to measure
+// the upload or both directions at the same time and to configure the
+// message size using [NDT0Options].
+func RunNDT0ServerWithOptions(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	serverIPAddr net.IP,
+	serverPort int,
+	logger Logger,
+	ready chan<- net.Listener,
+	errorch chan<- error,
+	TLS bool,
+	options *NDT0Options,
+	serverNames ...string,
+) {
+	// determine what we should do with the connection, noting
+	// that the server receives when the client sends and vice versa
+	receive, send, err := options.Direction.clientFlows()
+	if err != nil {
+		errorch <- err
+		return
+	}
+
 	// create buffer with random data
-	buffer := make([]byte, 65535)
+	buffer := make([]byte, options.messageSize())
 	if _, err := rand.Read(buffer); err != nil {
 		errorch <- err
 		return
@@ -252,7 +415,7 @@ func RunNDT0Server(
 	tlsConfig := stack.MustNewServerTLSConfig(serverIPAddr.String(), serverNames...)
 
 	// conditionally use TLS
-	ns := &Net{stack}
+	ns := &Net{Stack: stack}
 	listeners := map[bool]func(network string, addr *net.TCPAddr) (net.Listener, error){
 		false: ns.ListenTCP,
 		true: func(network string, addr *net.TCPAddr) (net.Listener, error) {
@@ -284,18 +447,114 @@ func RunNDT0Server(
 		errorch <- err
 		return
 	}
+	defer conn.Close()
 
 	// if the context has a deadline, apply it to the connection as well
 	if deadline, okay := ctx.Deadline(); okay {
 		_ = conn.SetDeadline(deadline)
 	}
 
-	// run the measurement loop
-	for {
-		if _, err := conn.Write(buffer); err != nil {
-			logger.Warnf("RunNDT0Server: %s", err.Error())
-			errorch <- nil
-			return
-		}
+	// run the measurement until either flow fails
+	flows := newNDT0Flows(conn, logger, "RunNDT0Server")
+	if send {
+		flows.startSending(buffer)
+	}
+	if receive {
+		flows.startReceiving()
 	}
+	<-flows.done
+	flows.stop()
+	errorch <- nil
+}
+
+// ndt0StatsConn returns the [StatsConn] underlying the given conn, which
+// may be a TLS conn, or nil if the conn does not collect statistics.
+func ndt0StatsConn(conn net.Conn) StatsConn {
+	if tc, good := conn.(interface{ NetConn() net.Conn }); good {
+		conn = tc.NetConn()
+	}
+	statsConn, _ := conn.(StatsConn)
+	return statsConn
+}
+
+// ndt0Flows sends and/or receives using a connection in the background.
+type ndt0Flows struct {
+	// conn is the connection.
+	conn net.Conn
+
+	// done is closed when the first flow terminates.
+	done chan struct{}
+
+	// logger is the logger to use.
+	logger Logger
+
+	// once ensures we close done just once.
+	once sync.Once
+
+	// prefix is the prefix for log messages.
+	prefix string
+
+	// received is the number of bytes received.
+	received atomic.Int64
+
+	// sent is the number of bytes sent.
+	sent atomic.Int64
+
+	// wg tracks the running flows.
+	wg sync.WaitGroup
+}
+
+// newNDT0Flows creates a new [*ndt0Flows] for the given conn.
+func newNDT0Flows(conn net.Conn, logger Logger, prefix string) *ndt0Flows {
+	return &ndt0Flows{
+		conn:   conn,
+		done:   make(chan struct{}),
+		logger: logger,
+		prefix: prefix,
+	}
+}
+
+// startSending starts writing the given buffer in the background.
+func (nf *ndt0Flows) startSending(buffer []byte) {
+	nf.wg.Add(1)
+	go func() {
+		defer nf.terminate()
+		for {
+			count, err := nf.conn.Write(buffer)
+			nf.sent.Add(int64(count))
+			if err != nil {
+				nf.logger.Warnf("%s: %s", nf.prefix, err.Error())
+				return
+			}
+		}
+	}()
+}
+
+// startReceiving starts reading in the background.
+func (nf *ndt0Flows) startReceiving() {
+	nf.wg.Add(1)
+	go func() {
+		defer nf.terminate()
+		buffer := make([]byte, 65535)
+		for {
+			count, err := nf.conn.Read(buffer)
+			nf.received.Add(int64(count))
+			if err != nil {
+				nf.logger.Warnf("%s: %s", nf.prefix, err.Error())
+				return
+			}
+		}
+	}()
+}
+
+// terminate marks a flow as terminated.
+func (nf *ndt0Flows) terminate() {
+	nf.once.Do(func() { close(nf.done) })
+	nf.wg.Done()
+}
+
+// stop closes the connection and waits for the flows to terminate.
+func (nf *ndt0Flows) stop() {
+	nf.conn.Close()
+	nf.wg.Wait()
 }
@@ -0,0 +1,499 @@
+package netem
+
+//
+// Network diagnostic tool (NDT) v7.
+//
+// This is a minimal implementation of the ndt7 protocol, which is
+// documented at https://github.com/m-lab/ndt-server/blob/main/spec/ndt7-protocol.md,
+// and of the locate API v2 that clients use to discover servers.
+//
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// The following constants define the ndt7 protocol.
+const (
+	// ndt7Subprotocol is the WebSocket subprotocol used by ndt7.
+	ndt7Subprotocol = "net.measurementlab.ndt.v7"
+
+	// ndt7DownloadPath is the path of the download test.
+	ndt7DownloadPath = "/ndt/v7/download"
+
+	// ndt7UploadPath is the path of the upload test.
+	ndt7UploadPath = "/ndt/v7/upload"
+
+	// ndt7LocatePath is the path of the locate API v2.
+	ndt7LocatePath = "/v2/nearest/ndt/ndt7"
+
+	// ndt7MaxDuration is the maximum duration of a test.
+	ndt7MaxDuration = 10 * time.Second
+
+	// ndt7MeasurementInterval is the interval between measurement messages.
+	ndt7MeasurementInterval = 250 * time.Millisecond
+
+	// ndt7InitialMessageSize is the initial size of binary messages.
+	ndt7InitialMessageSize = 1 << 13
+
+	// ndt7MaxMessageSize is the maximum size of binary messages.
+	ndt7MaxMessageSize = 1 << 24
+
+	// ndt7MessageScalingFraction controls when we double the message size.
+	ndt7MessageScalingFraction = 16
+)
+
+// ndt7AppInfo is the AppInfo of an ndt7 measurement.
+type ndt7AppInfo struct {
+	ElapsedTime int64
+	NumBytes    int64
+}
+
+// ndt7ConnectionInfo is the ConnectionInfo of an ndt7 measurement.
+type ndt7ConnectionInfo struct {
+	Client string
+	Server string
+	UUID   string
+}
+
+// ndt7TCPInfo is the subset of the Linux TCP_INFO inside an ndt7
+// measurement that we can fill using [ConnStats].
+type ndt7TCPInfo struct {
+	BytesReceived int64
+	BytesSent     int64
+	ElapsedTime   int64
+	RTO           int64
+	RTT           int64
+	RTTVar        int64
+	SegsIn        uint64
+	SegsOut       uint64
+	SndCwnd       uint32
+	SndSsThresh   uint32
+	TotalRetrans  uint64
+}
+
+// ndt7Measurement is an ndt7 measurement message.
+type ndt7Measurement struct {
+	AppInfo        *ndt7AppInfo        `json:",omitempty"`
+	ConnectionInfo *ndt7ConnectionInfo `json:",omitempty"`
+	Origin         string              `json:",omitempty"`
+	Test           string              `json:",omitempty"`
+	TCPInfo        *ndt7TCPInfo        `json:",omitempty"`
+}
+
+// ndt7ConnKey is the context key for the conn serving a request.
+type ndt7ConnKey struct{}
+
+// NewNDT7Handler returns an [http.Handler] implementing the ndt7 download
+// and upload tests as well as the locate API v2, which returns the URLs of
+// the tests using the Host header of the request. To serve real clients, you
+// typically want to use this handler with TLS and to configure the DNS such
+// that the locate API domain (locate.measurementlab.net) and the server
+// domain both resolve to the server address. Each test runs for at most
+// ten seconds, as the protocol requires, or until the request context is done.
+func NewNDT7Handler(logger Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ndt7LocatePath, ndt7HandleLocate)
+	for path, fx := range map[string]func(Logger, *websocket.Conn){
+		ndt7DownloadPath: ndt7ServeDownload,
+		ndt7UploadPath:   ndt7ServeUpload,
+	} {
+		fx := fx
+		mux.Handle(path, NewWebSocketHandler(func(conn *websocket.Conn) {
+			fx(logger, conn)
+		}, ndt7Subprotocol))
+	}
+	return mux
+}
+
+// ndt7HandleLocate implements the locate API v2.
+func ndt7HandleLocate(w http.ResponseWriter, req *http.Request) {
+	urls := map[string]string{}
+	for _, scheme := range []string{"ws", "wss"} {
+		for _, path := range []string{ndt7DownloadPath, ndt7UploadPath} {
+			URL := &url.URL{Scheme: scheme, Host: req.Host, Path: path, RawQuery: "access_token=netem"}
+			urls[scheme+"://"+path] = URL.String()
+		}
+	}
+	result := map[string]any{
+		"results": []any{map[string]any{
+			"machine":  req.Host,
+			"location": map[string]string{"city": "Netem", "country": "ZZ"},
+			"urls":     urls,
+		}},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// ndt7ServeDownload implements the download test.
+func ndt7ServeDownload(logger Logger, conn *websocket.Conn) {
+	t0 := time.Now()
+	ctx, cancel := ndt7InterruptibleContext(conn)
+	defer cancel()
+
+	// the client may send measurements, which we ignore
+	go func() {
+		defer cancel()
+		for {
+			var msg webSocketMessage
+			if err := webSocketRawCodec.Receive(conn, &msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	message := make([]byte, ndt7InitialMessageSize)
+	if _, err := rand.Read(message); err != nil {
+		conn.Close()
+		return
+	}
+	var total int64
+	lastMeasurement := t0
+	for ctx.Err() == nil && time.Since(t0) < ndt7MaxDuration {
+		if time.Since(lastMeasurement) >= ndt7MeasurementInterval {
+			lastMeasurement = time.Now()
+			measurement := ndt7NewServerMeasurement(conn, "download", t0, total)
+			if err := websocket.JSON.Send(conn, measurement); err != nil {
+				break
+			}
+		}
+		if err := websocket.Message.Send(conn, message); err != nil {
+			break
+		}
+		total += int64(len(message))
+		message = ndt7MaybeScaleMessage(message, total)
+	}
+	conn.Close()
+	logger.Debugf("netem: ndt7: download done after sending %d bytes", total)
+}
+
+// ndt7ServeUpload implements the upload test.
+func ndt7ServeUpload(logger Logger, conn *websocket.Conn) {
+	t0 := time.Now()
+	ctx, cancel := ndt7InterruptibleContext(conn)
+	defer cancel()
+
+	// periodically send measurements in the background
+	var total atomic.Int64
+	stop := make(chan any)
+	stopped := make(chan any)
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(ndt7MeasurementInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				measurement := ndt7NewServerMeasurement(conn, "upload", t0, total.Load())
+				if err := websocket.JSON.Send(conn, measurement); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	// read the messages sent by the client for at most the maximum duration
+	_ = conn.SetReadDeadline(t0.Add(ndt7MaxDuration))
+	for ctx.Err() == nil {
+		var msg webSocketMessage
+		if err := webSocketRawCodec.Receive(conn, &msg); err != nil {
+			break
+		}
+		total.Add(int64(len(msg.data)))
+	}
+	close(stop)
+	<-stopped
+	conn.Close()
+	logger.Debugf("netem: ndt7: upload done after receiving %d bytes", total.Load())
+}
+
+// ndt7InterruptibleContext returns a context derived from the request context
+// that interrupts any pending I/O on the conn when it is done.
+func ndt7InterruptibleContext(conn *websocket.Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(conn.Request().Context())
+	go func() {
+		<-ctx.Done()
+		_ = conn.SetDeadline(time.Now())
+	}()
+	return ctx, cancel
+}
+
+// ndt7NewServerMeasurement creates a measurement for the given test.
+func ndt7NewServerMeasurement(conn *websocket.Conn, test string, t0 time.Time, total int64) *ndt7Measurement {
+	elapsed := time.Since(t0).Microseconds()
+	measurement := &ndt7Measurement{
+		AppInfo: &ndt7AppInfo{
+			ElapsedTime: elapsed,
+			NumBytes:    total,
+		},
+		ConnectionInfo: &ndt7ConnectionInfo{
+			Client: conn.Request().RemoteAddr,
+			Server: conn.Request().Host,
+		},
+		Origin: "server",
+		Test:   test,
+	}
+	if netConn, good := conn.Request().Context().Value(ndt7ConnKey{}).(net.Conn); good {
+		if statsConn := ndt0StatsConn(netConn); statsConn != nil {
+			stats := statsConn.ConnStats()
+			measurement.TCPInfo = &ndt7TCPInfo{
+				BytesReceived: stats.BytesRead,
+				BytesSent:     stats.BytesWritten,
+				ElapsedTime:   elapsed,
+				RTO:           stats.RTO.Microseconds(),
+				RTT:           stats.RTT.Microseconds(),
+				RTTVar:        stats.RTTVar.Microseconds(),
+				SegsIn:        stats.SegmentsReceived,
+				SegsOut:       stats.SegmentsSent,
+				SndCwnd:       stats.CongestionWindow,
+				SndSsThresh:   stats.SlowStartThreshold,
+				TotalRetrans:  stats.Retransmissions,
+			}
+		}
+	}
+	return measurement
+}
+
+// ndt7MaybeScaleMessage doubles the message size, as recommended by the
+// protocol, when the message is small compared to the bytes sent so far.
+func ndt7MaybeScaleMessage(message []byte, total int64) []byte {
+	size := int64(len(message))
+	if size >= ndt7MaxMessageSize || size > total/ndt7MessageScalingFraction {
+		return message
+	}
+	scaled := make([]byte, 2*size)
+	if _, err := rand.Read(scaled); err != nil {
+		return message
+	}
+	return scaled
+}
+
+// RunNDT7Server runs an ndt7 server using [NewNDT7Handler] until ctx is
+// done. The arguments have the same meaning of the arguments of
+// [RunNDT0Server], except that the server serves several clients and
+// that ctx also limits the runtime of the tests.
+func RunNDT7Server(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	serverIPAddr net.IP,
+	serverPort int,
+	logger Logger,
+	ready chan<- net.Listener,
+	errorch chan<- error,
+	TLS bool,
+	serverNames ...string,
+) {
+	// conditionally use TLS
+	ns := &Net{Stack: stack}
+	addr := &net.TCPAddr{
+		IP:   serverIPAddr,
+		Port: serverPort,
+		Zone: "",
+	}
+	var (
+		listener net.Listener
+		err      error
+	)
+	if TLS {
+		tlsConfig := stack.MustNewServerTLSConfig(serverIPAddr.String(), serverNames...)
+		listener, err = ns.ListenTLS("tcp", addr, tlsConfig)
+	} else {
+		listener, err = ns.ListenTCP("tcp", addr)
+	}
+	if err != nil {
+		errorch <- err
+		return
+	}
+
+	// notify the caller that the listener is ready and
+	// transfer ownership such that they can close it
+	ready <- listener
+
+	srv := &http.Server{
+		Handler: NewNDT7Handler(logger),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, ndt7ConnKey{}, conn)
+		},
+	}
+	// make sure we stop serving when the context is done
+	done := make(chan any)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.Close()
+		case <-done:
+		}
+	}()
+
+	err = srv.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	errorch <- err
+}
+
+// RunNDT7Client runs the ndt7 download or upload test using the given server
+// URL (e.g., wss://ndt7.local/ndt/v7/download), where the path selects the
+// test, and [UnderlyingNetwork]. The arguments have the same meaning of the
+// arguments of [RunNDT0Client]. For the download test, the samples contain the
+// bytes received and, for the upload test, the bytes sent. The test runs until
+// the server closes the connection or ctx is done.
+func RunNDT7Client(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	serverURL string,
+	logger Logger,
+	errch chan<- error,
+	perfch chan<- *NDT0PerformanceSample,
+) {
+	// as documented, close perfch when done using it
+	defer close(perfch)
+
+	// close errch when we leave the scope such that we return nil when
+	// we don't explicitly return an error
+	defer close(errch)
+
+	conn, statsConn, err := ndt7Dial(ctx, stack, serverURL)
+	if err != nil {
+		errch <- err
+		return
+	}
+	defer conn.Close()
+
+	// interrupt any pending I/O when the context is done
+	testDone := make(chan any)
+	defer close(testDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-testDone:
+		}
+	}()
+
+	// run the test in the background
+	var (
+		received atomic.Int64
+		sent     atomic.Int64
+	)
+	done := make(chan any)
+	go func() {
+		defer close(done)
+		switch conn.Config().Location.Path {
+		case ndt7UploadPath:
+			ndt7Upload(ctx, conn, &sent)
+		default:
+			ndt7Download(conn, &received)
+		}
+	}()
+
+	t0 := time.Now()
+	lastT := t0
+	var lastReceived, lastSent int64
+	ticker := time.NewTicker(ndt7MeasurementInterval)
+	defer ticker.Stop()
+	for {
+		var finished bool
+		select {
+		case <-ticker.C:
+			// nothing
+		case <-ctx.Done():
+			finished = true
+		case <-done:
+			finished = true
+		}
+
+		now := time.Now()
+		received, sent := received.Load(), sent.Load()
+		var stats *ConnStats
+		if statsConn != nil {
+			stats = statsConn.ConnStats()
+		}
+		perfch <- &NDT0PerformanceSample{
+			Final:         finished,
+			ReceivedTotal: received,
+			ReceivedLast:  received - lastReceived,
+			SentTotal:     sent,
+			SentLast:      sent - lastSent,
+			TimeLast:      lastT,
+			TimeNow:       now,
+			TimeZero:      t0,
+			ConnStats:     stats,
+		}
+		lastReceived, lastSent, lastT = received, sent, now
+
+		if finished {
+			<-done
+			logger.Debugf("netem: ndt7: client done")
+			return
+		}
+	}
+}
+
+// ndt7Dial establishes a WebSocket connection with the given ndt7 server URL and
+// returns it along with the underlying [StatsConn], which may be nil.
+func ndt7Dial(
+	ctx context.Context, stack UnderlyingNetwork, serverURL string) (*websocket.Conn, StatsConn, error) {
+	conn, netConn, err := dialWebSocket(ctx, stack, serverURL, ndt7Subprotocol)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, ndt0StatsConn(netConn), nil
+}
+
+// ndt7Download receives messages until the server closes the connection.
+func ndt7Download(conn *websocket.Conn, received *atomic.Int64) {
+	for {
+		var msg webSocketMessage
+		if err := webSocketRawCodec.Receive(conn, &msg); err != nil {
+			return
+		}
+		received.Add(int64(len(msg.data)))
+	}
+}
+
+// ndt7Upload sends messages until the maximum duration elapses.
+func ndt7Upload(ctx context.Context, conn *websocket.Conn, sent *atomic.Int64) {
+	ctx, cancel := context.WithTimeout(ctx, ndt7MaxDuration)
+	defer cancel()
+
+	// the server sends measurements, which we ignore
+	go func() {
+		defer cancel()
+		for {
+			var msg webSocketMessage
+			if err := webSocketRawCodec.Receive(conn, &msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	message := make([]byte, ndt7InitialMessageSize)
+	if _, err := rand.Read(message); err != nil {
+		return
+	}
+	for ctx.Err() == nil {
+		if err := websocket.Message.Send(conn, message); err != nil {
+			return
+		}
+		sent.Add(int64(len(message)))
+		message = ndt7MaybeScaleMessage(message, sent.Load())
+	}
+}
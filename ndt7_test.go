@@ -0,0 +1,142 @@
+package netem
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestNDT7(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{
+		LeftToRightDelay: 5 * time.Millisecond,
+		RightToLeftDelay: 5 * time.Millisecond,
+	})
+	defer topology.Close()
+
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("ndt7.local", "", "10.0.0.1"))
+	Must0(dnsConfig.AddRecord("locate.measurementlab.net", "", "10.0.0.1"))
+	dnsServer := Must1(NewDNSServer(&NullLogger{}, topology.Server, "10.0.0.1", dnsConfig))
+	defer dnsServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ready, serverErrch := make(chan net.Listener, 1), make(chan error, 1)
+	go RunNDT7Server(
+		ctx,
+		topology.Server,
+		net.ParseIP("10.0.0.1"),
+		443,
+		&NullLogger{},
+		ready,
+		serverErrch,
+		true,
+		"ndt7.local",
+		"locate.measurementlab.net",
+	)
+	<-ready
+
+	// runClient runs the client for the given URL and returns the samples.
+	runClient := func(t *testing.T, URL string) []*NDT0PerformanceSample {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		errch := make(chan error, 1)
+		perfch := make(chan *NDT0PerformanceSample)
+		go RunNDT7Client(ctx, topology.Client, URL, &NullLogger{}, errch, perfch)
+		var samples []*NDT0PerformanceSample
+		for sample := range perfch {
+			samples = append(samples, sample)
+		}
+		if err := <-errch; err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) <= 0 || !samples[len(samples)-1].Final {
+			t.Fatal("expected samples ending with the final sample")
+		}
+		return samples
+	}
+
+	t.Run("we can run the download test", func(t *testing.T) {
+		samples := runClient(t, "wss://ndt7.local/ndt/v7/download")
+		final := samples[len(samples)-1]
+		if final.ReceivedTotal <= 0 || final.SentTotal != 0 {
+			t.Fatalf("unexpected final sample %+v", final)
+		}
+		if final.ConnStats == nil || final.ConnStats.RTT <= 0 {
+			t.Fatalf("unexpected conn stats %+v", final.ConnStats)
+		}
+	})
+
+	t.Run("we can run the upload test", func(t *testing.T) {
+		samples := runClient(t, "wss://ndt7.local:443/ndt/v7/upload")
+		final := samples[len(samples)-1]
+		if final.SentTotal <= 0 || final.ReceivedTotal != 0 {
+			t.Fatalf("unexpected final sample %+v", final)
+		}
+	})
+
+	t.Run("the server sends measurements", func(t *testing.T) {
+		config := Must1(websocket.NewConfig("wss://ndt7.local/ndt/v7/download", "https://ndt7.local/"))
+		config.Protocol = []string{ndt7Subprotocol}
+		netConn := Must1((&Net{Stack: topology.Client}).DialTLSContext(context.Background(), "tcp", "10.0.0.1:443"))
+		conn := Must1(websocket.NewClient(config, netConn))
+		defer conn.Close()
+		for {
+			var msg webSocketMessage
+			Must0(webSocketRawCodec.Receive(conn, &msg))
+			if msg.payloadType != websocket.TextFrame {
+				continue
+			}
+			var measurement ndt7Measurement
+			Must0(json.Unmarshal(msg.data, &measurement))
+			if measurement.Origin != "server" || measurement.Test != "download" || measurement.AppInfo == nil {
+				t.Fatalf("unexpected measurement %s", string(msg.data))
+			}
+			if measurement.TCPInfo == nil || measurement.TCPInfo.RTT <= 0 || measurement.TCPInfo.SndCwnd <= 0 {
+				t.Fatalf("unexpected measurement %s", string(msg.data))
+			}
+			return
+		}
+	})
+
+	t.Run("the server requires the ndt7 subprotocol", func(t *testing.T) {
+		config := Must1(websocket.NewConfig("wss://ndt7.local/ndt/v7/download", "https://ndt7.local/"))
+		netConn := Must1((&Net{Stack: topology.Client}).DialTLSContext(context.Background(), "tcp", "10.0.0.1:443"))
+		defer netConn.Close()
+		if _, err := websocket.NewClient(config, netConn); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("the locate API returns the URLs of the server", func(t *testing.T) {
+		client := &http.Client{Transport: NewHTTPTransport(topology.Client)}
+		resp, err := client.Get("https://locate.measurementlab.net/v2/nearest/ndt/ndt7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			Results []struct {
+				URLs map[string]string `json:"urls"`
+			} `json:"results"`
+		}
+		Must0(json.NewDecoder(resp.Body).Decode(&result))
+		if len(result.Results) != 1 {
+			t.Fatal("unexpected number of results")
+		}
+		expect := "wss://locate.measurementlab.net/ndt/v7/download?access_token=netem"
+		if got := result.Results[0].URLs["wss:///ndt/v7/download"]; got != expect {
+			t.Fatal("unexpected URL", got)
+		}
+	})
+
+	cancel()
+	if err := <-serverErrch; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,21 +6,103 @@ package netem
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 // Net is a drop-in replacement for the [net] package. The zero
-// value is invalid; please init all the MANDATORY fields.
+// value is invalid; please init all the MANDATORY fields. Use keyed
+// fields (e.g., &Net{Stack: stack}), since we may add more fields.
+//
+// By default, we resolve domain names using the getaddrinfo emulation
+// of the underlying stack. Set ResolverAddress to use a specific resolver
+// instead, which allows to emulate applications using distinct resolvers
+// (e.g., a browser using DoH) on the same stack. Set Cache to cache the
+// results of the lookups.
 type Net struct {
 	// Stack is the MANDATORY underlying stack.
 	Stack UnderlyingNetwork
+
+	// ResolverAddress is the OPTIONAL address of the resolver to use
+	// instead of the stack's getaddrinfo. This field contains an IP address
+	// for the udp, tcp, and dot transports and an URL (e.g.,
+	// https://10.0.0.1/dns-query) for the doh transport.
+	ResolverAddress string
+
+	// ResolverTransport is the OPTIONAL transport to use with the
+	// ResolverAddress. By default, we use [DNSTransportUDP].
+	ResolverTransport DNSTransport
+
+	// ALPN is the OPTIONAL list of ALPN protocols used by [Net.DialTLSContext]. When
+	// this field is nil, we choose the ALPN based on the port (see [Net.DialTLSContext]).
+	// Set this field to an empty slice to disable ALPN.
+	ALPN []string
+
+	// Cache is the OPTIONAL [DNSCache] to use.
+	Cache *DNSCache
+
+	// ClientSessionCache is the OPTIONAL cache used by [Net.DialTLSContext] to store
+	// the TLS sessions, which enables session resumption (e.g., using PSKs with TLS 1.3).
+	// When nil, we disable resumption and each dial performs a full handshake. Use
+	// [tls.NewLRUClientSessionCache] to create a cache and use the ConnectionState
+	// method of the returned conn to know whether the handshake was resumed.
+	ClientSessionCache tls.ClientSessionCache
+
+	// ECHConfigList is the OPTIONAL ECH config list used by [Net.DialTLSContext] to
+	// encrypt the ClientHello (see [LookupECHConfigList]). Dialing fails with
+	// [ErrECHNotSupported] when netem was compiled using Go < 1.24.
+	ECHConfigList []byte
+
+	// RootCAs is the OPTIONAL pool used by [Net.DialTLSContext] to verify servers
+	// instead of the stack's [CertificationAuthority.DefaultCertPool], which allows
+	// applications sharing the same stack to use distinct trust stores.
+	RootCAs *x509.CertPool
+
+	// TLSClientFactory is the OPTIONAL factory used by [Net.DialTLSContext] to
+	// create the client side of TLS connections (default: [tls.Client]).
+	TLSClientFactory TLSClientFactory
 }
 
+// TLSListener is a [net.Listener] performing the server side of the TLS handshake. The
+// listeners returned by [Net.ListenTLS] implement this interface.
+type TLSListener interface {
+	net.Listener
+
+	// RotateSessionTicketKeys replaces the keys used to encrypt and decrypt the session
+	// tickets with a fresh random key, such that clients cannot resume the sessions
+	// established before the rotation and need to perform a full handshake. Note that
+	// rotating keys modifies the config passed to [Net.ListenTLS], if the listener is
+	// using it directly, and has no effect if session tickets are disabled.
+	RotateSessionTicketKeys() error
+}
+
+// TLSClientConn is the client side of a TLS connection. Both [*tls.Conn] and
+// third-party TLS implementations (e.g., the UConn type of uTLS) implement it.
+type TLSClientConn interface {
+	net.Conn
+	HandshakeContext(ctx context.Context) error
+}
+
+// TLSClientFactory creates a [TLSClientConn] using the given conn and config, which
+// contains the root CAs, the server name, and the ALPN chosen by [Net.DialTLSContext].
+//
+// Use a custom factory to perform the handshake using a parroted or otherwise
+// customized ClientHello (e.g., with a distinct extension order, distinct ciphers,
+// or GREASE values), which allows to study how DPI reacts to distinct fingerprints.
+// See [NewTLSClientHelloFactory] for a factory sending a customized ClientHello.
+type TLSClientFactory func(conn net.Conn, config *tls.Config) TLSClientConn
+
 // ErrDial contains all the errors occurred during a [DialContext] operation.
 type ErrDial struct {
 	// Errors contains the list of errors.
@@ -52,7 +134,11 @@ func (e *ErrDial) Is(target error) bool {
 	return false
 }
 
-// DialContext is a drop-in replacement for [net.Dialer.DialContext].
+// DialContext is a drop-in replacement for [net.Dialer.DialContext]. We support
+// the "tcp", "tcp4", "tcp6", "udp", "udp4", and "udp6" networks and we resolve
+// domain names using [UnderlyingNetwork.GetaddrinfoLookupANY]. With "udp", the
+// returned conn is a connected UDP socket, whose reads fail with [syscall.ECONNREFUSED]
+// after the remote host replies with an ICMP port unreachable message.
 func (n *Net) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	// determine the domain or IP address we're connecting to
 	domain, port, err := net.SplitHostPort(address)
@@ -72,9 +158,13 @@ func (n *Net) DialContext(ctx context.Context, network, address string) (net.Con
 		}
 	}
 
-	// try each available address
+	// try each available address compatible with the network, which for
+	// "udp" means connecting the socket to the first available address
 	errlist := &ErrDial{}
 	for _, ip := range addresses {
+		if addr, err := netip.ParseAddr(ip); err == nil && !unetNetworkAllowsAddr(network, addr.Unmap()) {
+			continue
+		}
 		endpoint := net.JoinHostPort(ip, port)
 		conn, err := n.Stack.DialContext(ctx, network, endpoint)
 		if err != nil {
@@ -83,26 +173,47 @@ func (n *Net) DialContext(ctx context.Context, network, address string) (net.Con
 		}
 		return conn, nil
 	}
+	if len(errlist.Errors) <= 0 {
+		errlist.Errors = append(errlist.Errors, fmt.Errorf("%s: %w", domain, syscall.EAFNOSUPPORT))
+	}
 
 	return nil, errlist
 }
 
 // DialTLSContext is like [Net.DialContext] but also performs a TLS handshake.
+//
+// Unless the ALPN field overrides this behavior, we use "h2" and "http/1.1" as
+// the ALPN for ports 443 and 8443 and no ALPN otherwise, which allows negotiating
+// HTTP/2 like real dialers do with https URLs. Because many DoT servers do not
+// expect an ALPN, set the ALPN field to use "dot" with port 853.
 func (n *Net) DialTLSContext(ctx context.Context, network, address string) (net.Conn, error) {
-	hostname, _, err := net.SplitHostPort(address)
+	hostname, port, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
+	config := &tls.Config{
+		ClientSessionCache: n.ClientSessionCache,
+		KeyLogWriter:       tlsKeyLogWriterFor(n.Stack),
+		RootCAs:            n.rootCAs(),
+		NextProtos:         n.alpn(port),
+		ServerName:         hostname,
+	}
+	if len(n.ECHConfigList) > 0 {
+		if err := netConfigureClientECH(config, n.ECHConfigList); err != nil {
+			return nil, err
+		}
+	}
 	conn, err := n.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
-	config := &tls.Config{
-		RootCAs:    n.Stack.DefaultCertPool(),
-		NextProtos: nil, // TODO(bassosimone): automatically generate the right ALPN
-		ServerName: hostname,
+	factory := n.TLSClientFactory
+	if factory == nil {
+		factory = func(conn net.Conn, config *tls.Config) TLSClientConn {
+			return tls.Client(conn, config)
+		}
 	}
-	tc := tls.Client(conn, config)
+	tc := factory(conn, config)
 	if err := n.tlsHandshake(ctx, tc); err != nil {
 		conn.Close() // closing the conn here unblocks the background goroutine
 		return nil, err
@@ -110,8 +221,30 @@ func (n *Net) DialTLSContext(ctx context.Context, network, address string) (net.
 	return tc, nil
 }
 
+// rootCAs returns the root CAs to use.
+func (n *Net) rootCAs() *x509.CertPool {
+	if n.RootCAs != nil {
+		return n.RootCAs
+	}
+	return n.Stack.DefaultCertPool()
+}
+
+// netDefaultALPN maps a port to the default ALPN to use for such a port.
+var netDefaultALPN = map[string][]string{
+	"443":  {"h2", "http/1.1"},
+	"8443": {"h2", "http/1.1"},
+}
+
+// alpn returns the ALPN to use for the given port.
+func (n *Net) alpn(port string) []string {
+	if n.ALPN != nil {
+		return n.ALPN
+	}
+	return netDefaultALPN[port]
+}
+
 // tlsHandshake ensures we honour the context's deadline and cancellation
-func (n *Net) tlsHandshake(ctx context.Context, tc *tls.Conn) error {
+func (n *Net) tlsHandshake(ctx context.Context, tc TLSClientConn) error {
 	if deadline, ok := ctx.Deadline(); ok {
 		tc.SetDeadline(deadline)
 		defer tc.SetDeadline(time.Time{})
@@ -130,16 +263,72 @@ func (n *Net) tlsHandshake(ctx context.Context, tc *tls.Conn) error {
 
 // LookupHost is a drop-in replacement for [net.Resolver.LookupHost].
 func (n *Net) LookupHost(ctx context.Context, domain string) ([]string, error) {
-	addrs, _, err := n.Stack.GetaddrinfoLookupANY(ctx, domain)
+	addrs, _, err := n.lookup(ctx, domain)
 	return addrs, err
 }
 
 // LookupCNAME is a drop-in replacement for [net.Resolver.LookupCNAME].
 func (n *Net) LookupCNAME(ctx context.Context, domain string) (string, error) {
-	_, cname, err := n.Stack.GetaddrinfoLookupANY(ctx, domain)
+	_, cname, err := n.lookup(ctx, domain)
 	return cname, err
 }
 
+// lookup resolves the given domain using the cache, if configured.
+func (n *Net) lookup(ctx context.Context, domain string) ([]string, string, error) {
+	if n.Cache == nil || net.ParseIP(domain) != nil {
+		addrs, cname, _, err := n.resolve(ctx, domain)
+		return addrs, cname, err
+	}
+	return n.Cache.lookup(domain, func() ([]string, string, time.Duration, error) {
+		return n.resolve(ctx, domain)
+	})
+}
+
+// resolve resolves the given domain using either the stack's getaddrinfo
+// or the configured resolver. In the latter case, we send both an A and an
+// AAAA query, and we return the IPv4 addresses first. We also return the
+// minimum TTL of the answers, or [dnsCacheUnknownTTL] if we don't know it.
+func (n *Net) resolve(ctx context.Context, domain string) ([]string, string, time.Duration, error) {
+	if n.ResolverAddress == "" || net.ParseIP(domain) != nil {
+		addrs, cname, err := n.Stack.GetaddrinfoLookupANY(ctx, domain)
+		return addrs, cname, dnsCacheUnknownTTL, err
+	}
+	reso := &DNSClient{
+		ServerAddress: n.ResolverAddress,
+		Stack:         n.Stack,
+		Transport:     n.ResolverTransport,
+	}
+	var (
+		addrs   []string
+		cname   string
+		lastErr error
+		ttl     = dnsCacheUnknownTTL
+	)
+	for _, query := range []*dns.Msg{NewDNSRequestA(domain), NewDNSRequestAAAA(domain)} {
+		resp, err := reso.RoundTrip(ctx, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		qaddrs, qcname, err := DNSParseResponse(query, resp)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs = append(addrs, qaddrs...)
+		if cname == "" {
+			cname = qcname
+		}
+		if qttl := dnsMinimumTTL(resp); ttl < 0 || qttl < ttl {
+			ttl = qttl
+		}
+	}
+	if len(addrs) <= 0 {
+		return nil, "", dnsCacheUnknownTTL, lastErr
+	}
+	return addrs, cname, ttl, nil
+}
+
 // ListenTCP is a drop-in replacement for [net.ListenTCP].
 func (n *Net) ListenTCP(network string, addr *net.TCPAddr) (net.Listener, error) {
 	return n.Stack.ListenTCP(network, addr)
@@ -150,13 +339,80 @@ func (n *Net) ListenUDP(network string, addr *net.UDPAddr) (UDPLikeConn, error)
 	return n.Stack.ListenUDP(network, addr)
 }
 
+// netICMPListener is an [UnderlyingNetwork] supporting ICMP sockets.
+type netICMPListener interface {
+	ListenICMP() (*ICMPConn, error)
+}
+
+// ListenPacket is a drop-in replacement for [net.ListenPacket] returning a standard
+// [net.PacketConn], such that libraries expecting this interface work unmodified.
+//
+// We support the "udp", "udp4", and "udp6" networks, for which the address MUST
+// contain a literal IP address (possibly empty to mean the unspecified address) and
+// a port (possibly zero), and the "ip4:icmp" and "ip4:1" networks, for which we
+// ignore the address since raw ICMP sockets receive all the ICMP messages. ICMP
+// requires the Stack to be a [*UNetStack] and [*ICMPConn] documents how to use it.
+func (n *Net) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		// handled below
+
+	case "ip4:icmp", "ip4:1":
+		stack, good := n.Stack.(netICMPListener)
+		if !good {
+			return nil, syscall.EPROTONOSUPPORT
+		}
+		conn, err := stack.ListenICMP()
+		if err != nil {
+			return nil, err // avoid returning a nil *ICMPConn as a non-nil net.PacketConn
+		}
+		return conn, nil
+
+	default:
+		return nil, syscall.EPROTOTYPE
+	}
+
+	// parse the address, which must contain an IP address
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, syscall.EINVAL
+	}
+	var addr netip.Addr
+	switch {
+	case host != "":
+		addr, err = netip.ParseAddr(host)
+		if err != nil {
+			return nil, syscall.EADDRNOTAVAIL
+		}
+		addr = addr.Unmap()
+	case network == "udp6":
+		addr = netip.IPv6Unspecified()
+	default:
+		addr = netip.IPv4Unspecified()
+	}
+	if !unetNetworkAllowsAddr(network, addr) {
+		return nil, syscall.EAFNOSUPPORT
+	}
+	return n.Stack.ListenUDP("udp", &net.UDPAddr{IP: addr.AsSlice(), Port: int(portnum)})
+}
+
 // ListenTLS is a replacement for [tls.Listen] that uses the underlying
-// stack's TLS MITM capabilities during the TLS handshake.
+// stack's TLS MITM capabilities during the TLS handshake. The returned
+// listener implements [TLSListener], which allows rotating the session
+// ticket keys using a type assertion.
 func (n *Net) ListenTLS(network string, laddr *net.TCPAddr, config *tls.Config) (net.Listener, error) {
 	listener, err := n.ListenTCP(network, laddr)
 	if err != nil {
 		return nil, err
 	}
+	if w := tlsKeyLogWriterFor(n.Stack); w != nil && config.KeyLogWriter == nil {
+		config = config.Clone()
+		config.KeyLogWriter = w
+	}
 	lw := &netListenerTLS{
 		config:   config,
 		listener: listener,
@@ -172,7 +428,7 @@ type netListenerTLS struct {
 	stack    UnderlyingNetwork
 }
 
-var _ net.Listener = &netListenerTLS{}
+var _ TLSListener = &netListenerTLS{}
 
 // Accept implements net.Listener
 func (lw *netListenerTLS) Accept() (net.Conn, error) {
@@ -200,3 +456,13 @@ func (lw *netListenerTLS) Addr() net.Addr {
 func (lw *netListenerTLS) Close() error {
 	return lw.listener.Close()
 }
+
+// RotateSessionTicketKeys implements TLSListener
+func (lw *netListenerTLS) RotateSessionTicketKeys() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	lw.config.SetSessionTicketKeys([][32]byte{key})
+	return nil
+}
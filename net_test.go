@@ -0,0 +1,450 @@
+package netem
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+func TestNetDialContextUDP(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+	config := NewDNSConfig()
+	config.AddRecord("dns.example.com", "", "10.0.0.1")
+	config.AddRecord("www.example.com", "", "10.0.0.3")
+	server := Must1(NewDNSServer(&NullLogger{}, topology.Server, "10.0.0.1", config))
+	defer server.Close()
+	ns := &Net{Stack: topology.Client}
+
+	t.Run("we can resolve and use a connected UDP socket", func(t *testing.T) {
+		conn, err := ns.DialContext(context.Background(), "udp", "dns.example.com:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		Must0(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+		query := NewDNSRequestA("www.example.com")
+		if _, err := conn.Write(Must1(query.Pack())); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 1024)
+		count, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &dns.Msg{}
+		Must0(resp.Unpack(buffer[:count]))
+		addrs, _, err := DNSParseResponse(query, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0] != "10.0.0.3" {
+			t.Fatal("unexpected addresses", addrs)
+		}
+	})
+
+	t.Run("reading fails with ECONNREFUSED when the port is closed", func(t *testing.T) {
+		conn, err := ns.DialContext(context.Background(), "udp4", "dns.example.com:54")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		Must0(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+		if _, err := conn.Write([]byte("abc")); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 1024)
+		if _, err := conn.Read(buffer); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatal("not the error we expected", err)
+		}
+	})
+
+	t.Run("we honour the address family of the network", func(t *testing.T) {
+		_, err := ns.DialContext(context.Background(), "udp6", "dns.example.com:53")
+		if !errors.Is(err, syscall.EAFNOSUPPORT) {
+			t.Fatal("not the error we expected", err)
+		}
+	})
+}
+
+func TestNetListenPacket(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+	client := &Net{Stack: topology.Client}
+	server := &Net{Stack: topology.Server}
+
+	// echo runs an UDP echo server using the given conn
+	echo := func(pconn net.PacketConn) {
+		buffer := make([]byte, 1024)
+		for {
+			count, addr, err := pconn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = pconn.WriteTo(buffer[:count], addr)
+		}
+	}
+
+	for _, address := range []string{":5353", "10.0.0.1:5353", "0.0.0.0:5353"} {
+		t.Run(fmt.Sprintf("we can use UDP with %s", address), func(t *testing.T) {
+			pconn, err := server.ListenPacket("udp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pconn.Close()
+			go echo(pconn)
+
+			conn := Must1(client.ListenPacket("udp4", "10.0.0.2:0"))
+			defer conn.Close()
+			Must0(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+			Must1(conn.WriteTo([]byte("abc"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5353}))
+			buffer := make([]byte, 1024)
+			count, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buffer[:count]) != "abc" || addr.String() != "10.0.0.1:5353" {
+				t.Fatal("unexpected response", string(buffer[:count]), addr)
+			}
+		})
+	}
+
+	t.Run("we can use ICMP", func(t *testing.T) {
+		conn, err := client.ListenPacket("ip4:icmp", "0.0.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		Must0(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+		Must1(conn.WriteTo(Must1(newICMPv4Echo(17, 0)), &net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}))
+		buffer := make([]byte, 1024)
+		for {
+			count, _, err := conn.ReadFrom(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seq, good := pingParseEchoReply(buffer[:count], 17); good && seq == 0 {
+				break
+			}
+		}
+	})
+
+	t.Run("we reject invalid arguments", func(t *testing.T) {
+		inputs := []struct {
+			network string
+			address string
+			err     error
+		}{
+			{"tcp", "10.0.0.2:0", syscall.EPROTOTYPE},
+			{"udp6", "10.0.0.2:0", syscall.EAFNOSUPPORT},
+			{"udp4", "[::1]:0", syscall.EAFNOSUPPORT},
+			{"udp", "www.example.com:0", syscall.EADDRNOTAVAIL},
+			{"udp", "10.0.0.2:antani", syscall.EINVAL},
+		}
+		for _, input := range inputs {
+			pconn, err := client.ListenPacket(input.network, input.address)
+			if !errors.Is(err, input.err) {
+				t.Fatal(input.network, input.address, "unexpected error", err)
+			}
+			if pconn != nil {
+				t.Fatal("expected nil conn")
+			}
+		}
+	})
+}
+
+func TestNetDialTLSContextALPN(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+	server := &Net{Stack: topology.Server}
+	config := topology.Server.MustNewServerTLSConfig("10.0.0.1")
+	config.NextProtos = []string{"h2", "http/1.1"}
+	for _, port := range []int{443, 8080} {
+		listener := Must1(server.ListenTLS("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}, config))
+		defer listener.Close()
+		srvr := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Proto))
+			}),
+		}
+		go srvr.Serve(listener)
+		defer srvr.Close()
+	}
+
+	cases := []struct {
+		name    string
+		alpn    []string
+		address string
+		expect  string
+	}{
+		{"we use h2 for port 443 by default", nil, "10.0.0.1:443", "h2"},
+		{"we do not use ALPN for other ports by default", nil, "10.0.0.1:8080", ""},
+		{"we can override the ALPN", []string{"http/1.1"}, "10.0.0.1:443", "http/1.1"},
+		{"we can disable the ALPN", []string{}, "10.0.0.1:443", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &Net{ALPN: tc.alpn, Stack: topology.Client}
+			conn, err := client.DialTLSContext(context.Background(), "tcp", tc.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if proto := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; proto != tc.expect {
+				t.Fatal("unexpected protocol", proto)
+			}
+		})
+	}
+
+	t.Run("the HTTP transport negotiates HTTP/2", func(t *testing.T) {
+		txp := NewHTTPTransport(topology.Client)
+		defer txp.CloseIdleConnections()
+		client := &http.Client{Transport: txp}
+		resp, err := client.Get("https://10.0.0.1/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := Must1(io.ReadAll(resp.Body))
+		if string(body) != "HTTP/2.0" || resp.Proto != "HTTP/2.0" {
+			t.Fatal("unexpected protocol", string(body), resp.Proto)
+		}
+	})
+}
+
+func TestNetDialTLSContextWithTLSClientFactory(t *testing.T) {
+	dpi := NewDPIEngine(&NullLogger{})
+	dpi.AddRule(&DPIResetTrafficForTLSSNI{Logger: &NullLogger{}, SNI: "blocked.example.com"})
+	// note: the DPI rule requires a router in the path and delays
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+	clientStack := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{
+		DPIEngine:        dpi,
+		LeftToRightDelay: 10 * time.Millisecond,
+		RightToLeftDelay: 10 * time.Millisecond,
+	}))
+	serverStack := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", &LinkConfig{
+		LeftToRightDelay: 10 * time.Millisecond,
+		RightToLeftDelay: 10 * time.Millisecond,
+	}))
+	listener := Must1(serverStack.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}))
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	var gotConfig *tls.Config
+	client := &Net{
+		Stack: clientStack,
+		TLSClientFactory: func(conn net.Conn, config *tls.Config) TLSClientConn {
+			gotConfig = config.Clone()
+			config.ServerName = "blocked.example.com" // we're dialing an IP address
+			return NewTLSClientHelloFactory(&TLSClientHelloSpec{GREASE: true})(conn, config)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := client.DialTLSContext(ctx, "tcp", "10.0.0.1:443")
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("unexpected error", err)
+	}
+	if conn != nil {
+		t.Fatal("expected nil conn")
+	}
+	if gotConfig == nil || gotConfig.ServerName != "10.0.0.1" || len(gotConfig.NextProtos) != 2 {
+		t.Fatalf("unexpected config %+v", gotConfig)
+	}
+}
+
+func TestNetRootCAs(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	// the server uses a certificate issued by a private CA
+	private := MustNewCA()
+	topology.CA().AddStaticCertificate("10.0.0.1", private.MustNewTLSCertificate("10.0.0.1"))
+	tlsConfig := topology.Server.MustNewServerTLSConfig("10.0.0.1")
+	listener := Must1((&Net{Stack: topology.Server}).ListenTCP(
+		"tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}))
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Note: we handshake here because a failed handshake
+			// would otherwise cause [Net.ListenTLS] Accept to fail
+			go func() {
+				defer conn.Close()
+				_ = tls.Server(conn, tlsConfig).Handshake()
+			}()
+		}
+	}()
+
+	dial := func(client *Net) error {
+		conn, err := client.DialTLSContext(context.Background(), "tcp", "10.0.0.1:443")
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	t.Run("by default the client does not trust the private CA", func(t *testing.T) {
+		var authErr x509.UnknownAuthorityError
+		if err := dial(&Net{Stack: topology.Client}); !errors.As(err, &authErr) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we can override the root CAs of a Net", func(t *testing.T) {
+		if err := dial(&Net{Stack: topology.Client, RootCAs: private.DefaultCertPool()}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("we can override and restore the root CAs of a stack", func(t *testing.T) {
+		topology.Client.SetRootCAs(private.DefaultCertPool())
+		if err := dial(&Net{Stack: topology.Client}); err != nil {
+			t.Fatal(err)
+		}
+		topology.Client.SetRootCAs(nil)
+		var authErr x509.UnknownAuthorityError
+		if err := dial(&Net{Stack: topology.Client}); !errors.As(err, &authErr) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestNetTLSSessionResumption(t *testing.T) {
+	// newServer starts a TLS server writing one byte to each client, which ensures the
+	// client reads the TLS 1.3 session tickets the server sends after the handshake.
+	newServer := func(t *testing.T, topology *PPPTopology, options *TLSServerOptions) TLSListener {
+		tlsConfig := topology.Server.MustNewServerTLSConfigWithOptions(options, "10.0.0.1")
+		listener := Must1((&Net{Stack: topology.Server}).ListenTLS(
+			"tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, tlsConfig))
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte{0})
+				conn.Close()
+			}
+		}()
+		return listener.(TLSListener)
+	}
+
+	// dial connects to the server and returns whether the session was resumed.
+	dial := func(t *testing.T, client *Net) bool {
+		conn := Must1(client.DialTLSContext(context.Background(), "tcp", "10.0.0.1:443"))
+		defer conn.Close()
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		return conn.(*tls.Conn).ConnectionState().DidResume
+	}
+
+	t.Run("without a session cache we always perform a full handshake", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		newServer(t, topology, &TLSServerOptions{})
+		client := &Net{Stack: topology.Client}
+		if dial(t, client) || dial(t, client) {
+			t.Fatal("expected full handshakes")
+		}
+	})
+
+	t.Run("with a session cache we resume until the keys are rotated", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		listener := newServer(t, topology, &TLSServerOptions{})
+		client := &Net{Stack: topology.Client, ClientSessionCache: tls.NewLRUClientSessionCache(4)}
+		if dial(t, client) {
+			t.Fatal("expected a full handshake")
+		}
+		if !dial(t, client) {
+			t.Fatal("expected a resumed handshake")
+		}
+		if err := listener.RotateSessionTicketKeys(); err != nil {
+			t.Fatal(err)
+		}
+		if dial(t, client) {
+			t.Fatal("expected a full handshake after rotating keys")
+		}
+		if !dial(t, client) {
+			t.Fatal("expected a resumed handshake with the new keys")
+		}
+	})
+
+	t.Run("the server can disable session tickets", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		newServer(t, topology, &TLSServerOptions{SessionTicketsDisabled: true})
+		client := &Net{Stack: topology.Client, ClientSessionCache: tls.NewLRUClientSessionCache(4)}
+		if dial(t, client) || dial(t, client) {
+			t.Fatal("expected full handshakes")
+		}
+	})
+}
+
+func TestNetResolver(t *testing.T) {
+	config := NewDNSConfig()
+	config.AddRecord("www.example.com", "", "10.0.0.3", "2001:db8::3")
+	topology := newDNSClientTestServers(t, config, &DNSServerOptions{})
+
+	t.Run("by default we use the stack's getaddrinfo", func(t *testing.T) {
+		// note: the server stack does not have a resolver
+		ns := &Net{Stack: topology.Server}
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		if _, err := ns.LookupHost(ctx, "www.example.com"); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	cases := []struct {
+		transport DNSTransport
+		address   string
+	}{
+		{DNSTransportUDP, "10.0.0.1"},
+		{DNSTransportTCP, "10.0.0.1"},
+		{DNSTransportDoT, "10.0.0.1"},
+		{DNSTransportDoH, "https://10.0.0.1/dns-query"},
+	}
+	for _, tc := range cases {
+		t.Run("we can use a specific resolver over "+string(tc.transport), func(t *testing.T) {
+			ns := &Net{
+				ResolverAddress:   tc.address,
+				ResolverTransport: tc.transport,
+				Stack:             topology.Server,
+			}
+			addrs, err := ns.LookupHost(context.Background(), "www.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]string{"10.0.0.3", "2001:db8::3"}, addrs); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
@@ -197,7 +197,9 @@ func (n *StaticWriteableNIC) InterfaceName() string {
 	return n.name
 }
 
-// WriteFrame implements WriteableNIC
+// WriteFrame implements WriteableNIC. We post the frame to the channel returned
+// by [StaticWriteableNIC.Frames] without releasing it, therefore the reader owns
+// the frame and should call [Frame.Release] when done with it.
 func (n *StaticWriteableNIC) WriteFrame(frame *Frame) error {
 	n.frames <- frame
 	return nil
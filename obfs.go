@@ -0,0 +1,425 @@
+package netem
+
+//
+// Obfuscated circumvention transport and bridge
+//
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// ObfsConfig contains the configuration of the obfuscated transport.
+//
+// Like obfs4, the transport aims to look like uniformly random bytes on the
+// wire: each peer sends a random nonce followed by frames encrypted using
+// AES-CTR with keys derived from the shared secret and the nonce, and each
+// frame contains random padding, so that packet sizes do not reveal much.
+type ObfsConfig struct {
+	// MaxPadding is the OPTIONAL maximum number of padding bytes we add
+	// to each frame (default: 256; max: 65535). The peers do not need to
+	// use the same value.
+	MaxPadding int
+
+	// Secret is the MANDATORY secret shared by the client and the bridge.
+	Secret []byte
+}
+
+// maxPadding returns the configured maximum padding or the default.
+func (c *ObfsConfig) maxPadding() int {
+	if c.MaxPadding > 0 {
+		return min(c.MaxPadding, 65535)
+	}
+	return 256
+}
+
+// ErrObfsHandshake indicates that the obfuscated handshake failed, which
+// typically happens when the peers do not share the same secret.
+var ErrObfsHandshake = errors.New("netem: obfs: handshake failed")
+
+// ErrObfsBridgeDial indicates that the bridge could not dial the destination.
+var ErrObfsBridgeDial = errors.New("netem: obfs: bridge cannot dial destination")
+
+// obfsMagic is the payload of the handshake frame.
+var obfsMagic = []byte("netem-obfs-v1")
+
+const (
+	// obfsNonceSize is the size of the nonce sent by each peer.
+	obfsNonceSize = 32
+
+	// obfsMaxPayload is the maximum payload size of a frame.
+	obfsMaxPayload = 16384
+)
+
+// NewObfsClientConn performs the client side of the obfuscated handshake over
+// the given conn and returns the obfuscated conn. The ctx bounds the handshake.
+// On failure, this function closes the conn.
+func NewObfsClientConn(ctx context.Context, conn net.Conn, config *ObfsConfig) (net.Conn, error) {
+	return obfsHandshake(ctx, conn, config, false)
+}
+
+// NewObfsServerConn is like [NewObfsClientConn] but for the server side. Like
+// obfs4, when the client does not use the right secret, we keep reading until
+// the client closes the conn or the ctx is done, to make active probing harder.
+func NewObfsServerConn(ctx context.Context, conn net.Conn, config *ObfsConfig) (net.Conn, error) {
+	return obfsHandshake(ctx, conn, config, true)
+}
+
+// obfsHandshake sends our nonce and handshake frame and verifies the peer's ones.
+func obfsHandshake(ctx context.Context, conn net.Conn, config *ObfsConfig, server bool) (net.Conn, error) {
+	writeLabel, readLabel := "client", "server"
+	if server {
+		writeLabel, readLabel = "server", "client"
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	nonce := make([]byte, obfsNonceSize)
+	Must1(rand.Read(nonce))
+	oc := &obfsConn{
+		Conn:       conn,
+		maxPadding: config.maxPadding(),
+		pending:    nil,
+		reader:     nil,
+		rmu:        sync.Mutex{},
+		writer:     obfsNewStream(config.Secret, writeLabel, nonce),
+		wmu:        sync.Mutex{},
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := oc.Write(obfsMagic); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	peerNonce := make([]byte, obfsNonceSize)
+	if _, err := io.ReadFull(conn, peerNonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	oc.reader = obfsNewStream(config.Secret, readLabel, peerNonce)
+	payload, err := oc.readFrame(len(obfsMagic))
+	if errors.Is(err, errObfsFrame) || (err == nil && !hmac.Equal(payload, obfsMagic)) {
+		if server {
+			_, _ = io.Copy(io.Discard, conn)
+		}
+		conn.Close()
+		return nil, ErrObfsHandshake
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return oc, nil
+}
+
+// obfsNewStream derives the key from the secret, the label, and the nonce and
+// returns the corresponding AES-CTR stream.
+func obfsNewStream(secret []byte, label string, nonce []byte) cipher.Stream {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	mac.Write(nonce)
+	block := Must1(aes.NewCipher(mac.Sum(nil)))
+	return cipher.NewCTR(block, make([]byte, block.BlockSize()))
+}
+
+// errObfsFrame indicates that we read an invalid frame.
+var errObfsFrame = errors.New("netem: obfs: invalid frame")
+
+// obfsConn is the obfuscated [net.Conn].
+//
+// Each frame consists of a four-byte header containing the payload length and
+// the padding length, followed by the payload and by the padding. We encrypt
+// the whole frame, including the header.
+type obfsConn struct {
+	net.Conn
+	maxPadding int
+	pending    []byte
+	reader     cipher.Stream
+	rmu        sync.Mutex
+	writer     cipher.Stream
+	wmu        sync.Mutex
+}
+
+// Read implements net.Conn.
+func (oc *obfsConn) Read(data []byte) (int, error) {
+	defer oc.rmu.Unlock()
+	oc.rmu.Lock()
+	for len(oc.pending) <= 0 {
+		payload, err := oc.readFrame(obfsMaxPayload)
+		if err != nil {
+			return 0, err
+		}
+		oc.pending = payload
+	}
+	count := copy(data, oc.pending)
+	oc.pending = oc.pending[count:]
+	return count, nil
+}
+
+// readFrame reads and decrypts the next frame and returns its payload, which
+// must not be larger than maxPayload bytes.
+func (oc *obfsConn) readFrame(maxPayload int) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(oc.Conn, header); err != nil {
+		return nil, err
+	}
+	oc.reader.XORKeyStream(header, header)
+	payloadLen := int(binary.BigEndian.Uint16(header[0:2]))
+	paddingLen := int(binary.BigEndian.Uint16(header[2:4]))
+	if payloadLen > maxPayload {
+		return nil, errObfsFrame
+	}
+	body := make([]byte, payloadLen+paddingLen)
+	if _, err := io.ReadFull(oc.Conn, body); err != nil {
+		return nil, err
+	}
+	oc.reader.XORKeyStream(body, body)
+	return body[:payloadLen], nil
+}
+
+// Write implements net.Conn.
+func (oc *obfsConn) Write(data []byte) (int, error) {
+	defer oc.wmu.Unlock()
+	oc.wmu.Lock()
+	var total int
+	for len(data) > 0 {
+		payload := data
+		if len(payload) > obfsMaxPayload {
+			payload = payload[:obfsMaxPayload]
+		}
+		paddingLen := int(Must1(rand.Int(rand.Reader, big.NewInt(int64(oc.maxPadding)+1))).Int64())
+		frame := make([]byte, 4+len(payload)+paddingLen)
+		binary.BigEndian.PutUint16(frame[0:2], uint16(len(payload)))
+		binary.BigEndian.PutUint16(frame[2:4], uint16(paddingLen))
+		copy(frame[4:], payload)
+		Must1(rand.Read(frame[4+len(payload):]))
+		oc.writer.XORKeyStream(frame, frame)
+		if _, err := oc.Conn.Write(frame); err != nil {
+			return total, err
+		}
+		total += len(payload)
+		data = data[len(payload):]
+	}
+	return total, nil
+}
+
+// ObfsBridgeConfig contains the [ObfsBridge] configuration.
+type ObfsBridgeConfig struct {
+	// Obfs is the MANDATORY obfuscated transport configuration.
+	Obfs *ObfsConfig
+
+	// Port is the OPTIONAL TCP port (default: 443).
+	Port int
+}
+
+// ObfsBridge is a circumvention bridge accepting obfuscated connections and
+// proxying them to the destination requested by the client (see [ObfsDialer]).
+// The zero value is invalid, please construct using [NewObfsBridge].
+type ObfsBridge struct {
+	closed   chan any
+	config   *ObfsConfig
+	listener net.Listener
+	logger   Logger
+	ns       *Net
+	once     sync.Once
+	wg       *sync.WaitGroup
+}
+
+// NewObfsBridge creates a new [ObfsBridge] listening on the given IP address.
+// The bridge uses the given stack to dial the destinations, so, in a [StarTopology],
+// the traffic towards the destinations originates from the bridge. Remember to
+// call [ObfsBridge.Close] when done.
+func NewObfsBridge(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *ObfsBridgeConfig,
+) (*ObfsBridge, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	port := config.Port
+	if port <= 0 {
+		port = 443
+	}
+	ns := &Net{Stack: stack}
+	listener, err := ns.ListenTCP("tcp", &net.TCPAddr{IP: parsedIP, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	ob := &ObfsBridge{
+		closed:   make(chan any),
+		config:   config.Obfs,
+		listener: listener,
+		logger:   logger,
+		ns:       ns,
+		once:     sync.Once{},
+		wg:       &sync.WaitGroup{},
+	}
+	ob.wg.Add(1)
+	go ob.acceptor()
+	return ob, nil
+}
+
+// Close closes the bridge and the proxied connections.
+func (ob *ObfsBridge) Close() error {
+	ob.once.Do(func() {
+		close(ob.closed)
+		ob.listener.Close()
+		ob.wg.Wait()
+	})
+	return nil
+}
+
+// acceptor accepts obfuscated connections.
+func (ob *ObfsBridge) acceptor() {
+	defer ob.wg.Done()
+	for {
+		conn, err := ob.listener.Accept()
+		if err != nil {
+			select {
+			case <-ob.closed:
+			default:
+				ob.logger.Warnf("netem: ObfsBridge: %s", err.Error())
+			}
+			return
+		}
+		ob.wg.Add(1)
+		go ob.serve(conn)
+	}
+}
+
+// serve handles an obfuscated connection.
+func (ob *ObfsBridge) serve(conn net.Conn) {
+	defer ob.wg.Done()
+	defer conn.Close()
+
+	// bound the setup time and make sure closing the bridge interrupts the setup
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() {
+		select {
+		case <-ob.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	oc, err := NewObfsServerConn(ctx, conn, ob.config)
+	if err != nil {
+		ob.logger.Infof("netem: ObfsBridge: %s: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	// the first frame contains the destination and we reply with an empty
+	// frame on success and with the error message on failure
+	destination, err := oc.(*obfsConn).readFrame(obfsMaxPayload)
+	if err != nil {
+		return
+	}
+	ob.logger.Infof("netem: ObfsBridge: %s => %s", conn.RemoteAddr(), string(destination))
+	upstream, err := ob.ns.DialContext(ctx, "tcp", string(destination))
+	if err != nil {
+		oc.Write([]byte(err.Error()))
+		return
+	}
+	defer upstream.Close()
+	if _, err := oc.Write([]byte{0}); err != nil {
+		return
+	}
+	if !stop() {
+		return // the setup timed out or we have been closed
+	}
+
+	done := make(chan any, 2)
+	go func() {
+		_, _ = io.Copy(upstream, oc)
+		done <- true
+	}()
+	go func() {
+		_, _ = io.Copy(oc, upstream)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-ob.closed:
+	}
+	oc.Close()
+	upstream.Close()
+	<-done
+}
+
+// ObfsDialer dials TCP connections through an [ObfsBridge]. You can use its
+// DialContext method with, e.g., [http.Transport] to tunnel HTTP traffic.
+type ObfsDialer struct {
+	// BridgeAddress is the MANDATORY bridge TCP endpoint (e.g., "10.0.0.3:443").
+	BridgeAddress string
+
+	// Config is the MANDATORY obfuscated transport configuration.
+	Config *ObfsConfig
+
+	// Stack is the MANDATORY stack used to connect to the bridge.
+	Stack UnderlyingNetwork
+}
+
+// DialContext asks the bridge to connect to the given TCP address, which
+// the bridge resolves when it contains a domain name.
+func (d *ObfsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrObfsBridgeDial, network)
+	}
+	ns := &Net{Stack: d.Stack}
+	conn, err := ns.DialContext(ctx, "tcp", d.BridgeAddress)
+	if err != nil {
+		return nil, err
+	}
+	oc, err := NewObfsClientConn(ctx, conn, d.Config)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		oc.SetReadDeadline(deadline)
+	}
+	if _, err := oc.Write([]byte(address)); err != nil {
+		oc.Close()
+		return nil, err
+	}
+	status, err := oc.(*obfsConn).readFrame(obfsMaxPayload)
+	if err != nil {
+		oc.Close()
+		return nil, err
+	}
+	oc.SetReadDeadline(time.Time{})
+	if len(status) != 1 || status[0] != 0 {
+		oc.Close()
+		return nil, fmt.Errorf("%w: %s", ErrObfsBridgeDial, string(status))
+	}
+	return oc, nil
+}
@@ -0,0 +1,130 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestObfsBridge(t *testing.T) {
+	// newTopology creates a star topology where 10.0.0.1 is the website,
+	// 10.0.0.3 is the bridge, and 10.0.0.2 is the censored client
+	newTopology := func(t *testing.T, dpi *DPIEngine) *UNetStack {
+		topology := MustNewStarTopology(&NullLogger{})
+		t.Cleanup(func() { topology.Close() })
+		serverLink := &LinkConfig{LeftToRightDelay: 10 * time.Millisecond, RightToLeftDelay: 10 * time.Millisecond}
+		website := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", serverLink))
+		bridge := Must1(topology.AddHost("10.0.0.3", "10.0.0.1", serverLink))
+		client := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{DPIEngine: dpi}))
+
+		dnsConfig := NewDNSConfig()
+		Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.1"))
+		topology.TrackServer(Must1(NewDNSServer(&NullLogger{}, website, "10.0.0.1", dnsConfig)))
+
+		ns := &Net{Stack: website}
+		listener := Must1(ns.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}))
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Bonsoir, Elliot!"))
+		})}
+		topology.TrackServer(server)
+		go server.Serve(listener)
+
+		topology.TrackServer(Must1(NewObfsBridge(&NullLogger{}, bridge, "10.0.0.3", &ObfsBridgeConfig{
+			Obfs: &ObfsConfig{Secret: []byte("bridge-secret")},
+		})))
+		return client
+	}
+
+	// fetch fetches http://www.example.com/ using the given dialer
+	fetch := func(dialContext func(ctx context.Context, network, address string) (net.Conn, error)) (string, error) {
+		client := &http.Client{Transport: &http.Transport{DialContext: dialContext}, Timeout: time.Second}
+		resp, err := client.Get("http://www.example.com/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	t.Run("the bridge evades string-based blocking", func(t *testing.T) {
+		dpi := NewDPIEngine(&NullLogger{})
+		dpi.AddRule(&DPIDropTrafficForString{
+			Logger:          &NullLogger{},
+			ServerIPAddress: "10.0.0.1",
+			ServerPort:      80,
+			String:          "www.example.com",
+		})
+		client := newTopology(t, dpi)
+
+		if _, err := fetch((&Net{Stack: client}).DialContext); err == nil {
+			t.Fatal("expected the direct fetch to fail")
+		}
+
+		dialer := &ObfsDialer{
+			BridgeAddress: "10.0.0.3:443",
+			Config:        &ObfsConfig{Secret: []byte("bridge-secret")},
+			Stack:         client,
+		}
+		body, err := fetch(dialer.DialContext)
+		if err != nil || body != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected result", body, err)
+		}
+	})
+
+	t.Run("endpoint-based blocking affects the bridge", func(t *testing.T) {
+		dpi := NewDPIEngine(&NullLogger{})
+		dpi.AddRule(&DPIDropTrafficForServerEndpoint{
+			Logger:          &NullLogger{},
+			ServerIPAddress: "10.0.0.3",
+			ServerPort:      443,
+			ServerProtocol:  layers.IPProtocolTCP,
+		})
+		client := newTopology(t, dpi)
+
+		dialer := &ObfsDialer{
+			BridgeAddress: "10.0.0.3:443",
+			Config:        &ObfsConfig{Secret: []byte("bridge-secret")},
+			Stack:         client,
+		}
+		if _, err := fetch(dialer.DialContext); err == nil {
+			t.Fatal("expected the fetch to fail")
+		}
+	})
+
+	t.Run("we reject clients using the wrong secret", func(t *testing.T) {
+		client := newTopology(t, NewDPIEngine(&NullLogger{}))
+		dialer := &ObfsDialer{
+			BridgeAddress: "10.0.0.3:443",
+			Config:        &ObfsConfig{Secret: []byte("wrong-secret")},
+			Stack:         client,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conn, err := dialer.DialContext(ctx, "tcp", "www.example.com:80")
+		if !errors.Is(err, ErrObfsHandshake) || conn != nil {
+			t.Fatal("unexpected result", conn, err)
+		}
+	})
+
+	t.Run("we report the bridge's dial errors", func(t *testing.T) {
+		client := newTopology(t, NewDPIEngine(&NullLogger{}))
+		dialer := &ObfsDialer{
+			BridgeAddress: "10.0.0.3:443",
+			Config:        &ObfsConfig{Secret: []byte("bridge-secret"), MaxPadding: 1024},
+			Stack:         client,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conn, err := dialer.DialContext(ctx, "tcp", "10.0.0.1:81")
+		if !errors.Is(err, ErrObfsBridgeDial) || conn != nil {
+			t.Fatal("unexpected result", conn, err)
+		}
+	})
+}
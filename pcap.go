@@ -6,6 +6,8 @@ package netem
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -18,19 +20,117 @@ import (
 // PCAPDumper collects a PCAP trace. The zero value is invalid and you should
 // use [NewPCAPDumper] to instantiate. Once you have a valid instance, you
 // should register the PCAPDumper as a [LinkNICWrapper] inside the [LinkConfig].
+//
+// To capture all the packets forwarded by a [Router] instead, use a
+// [PCAPCapture] along with [Router.SetPacketObserver].
 type PCAPDumper struct {
 	// filename is the PCAP file name.
 	filename string
 
+	// keyLog forwards the TLS secrets to the captures.
+	keyLog *pcapDumperKeyLog
+
 	// logger is the logger to use.
 	logger Logger
+
+	// options contains the capture options.
+	options *PCAPOptions
+}
+
+// PCAPFormat is the file format written by [PCAPCapture] and [PCAPDumper].
+type PCAPFormat int
+
+const (
+	// PCAPFormatPCAP is the legacy pcap format, which is the default.
+	PCAPFormatPCAP = PCAPFormat(iota)
+
+	// PCAPFormatPCAPNG is the pcapng format, which allows to include metadata
+	// such as the interface name and description, the direction of each
+	// packet, comments, and the TLS session secrets.
+	PCAPFormatPCAPNG
+)
+
+// PCAPOptions contains OPTIONAL settings for [PCAPCapture] and [PCAPDumper]. The zero
+// value is valid and causes the capture to use the legacy pcap format.
+type PCAPOptions struct {
+	// Format is the OPTIONAL file format (default: [PCAPFormatPCAP]).
+	Format PCAPFormat
+
+	// Comment is the OPTIONAL comment describing the capture (e.g., the experiment
+	// parameters). We only write this field when using [PCAPFormatPCAPNG].
+	Comment string
+
+	// InterfaceName is the OPTIONAL name of the capture interface, which we only
+	// write when using [PCAPFormatPCAPNG]. By default, [PCAPDumper] uses the name
+	// of the [NIC] it wraps and [PCAPCapture] does not write any name.
+	InterfaceName string
+
+	// InterfaceDescription is the OPTIONAL description of the capture interface,
+	// which we only write when using [PCAPFormatPCAPNG]. By default, [PCAPDumper]
+	// uses the IP address of the [NIC] it wraps and [PCAPCapture] does not write
+	// any description.
+	InterfaceDescription string
+
+	// Filter is the OPTIONAL function deciding whether to record a packet, which
+	// allows keeping captures small in long-running experiments. We do not record
+	// the packets for which this function returns false and the packets we cannot
+	// dissect. Because we call this function from the packet forwarding path, its
+	// implementation MUST be fast and MUST NOT retain or modify the packet.
+	//
+	// For example, the following filter only records DNS traffic:
+	//
+	//	func(packet *DissectedPacket) bool {
+	//		return packet.SourcePort() == 53 || packet.DestinationPort() == 53
+	//	}
+	Filter func(packet *DissectedPacket) bool
+
+	// SnapLen is the OPTIONAL maximum number of bytes of each packet we record,
+	// which we also write into the file header. Use a small value (e.g., 96 bytes)
+	// to only record the headers, thus reducing disk usage in throughput tests
+	// where the payload is irrelevant. Use [math.MaxUint16] to record whole packets.
+	// When zero or negative, we use [DefaultPCAPSnapLen].
+	SnapLen int
+
+	// NanosecondTimestamps OPTIONALLY enables writing timestamps with nanosecond
+	// rather than microsecond resolution, which allows to analyze the sub-millisecond
+	// dynamics of the emulated links. With [PCAPFormatPCAP], we use the nanosecond
+	// variant of the pcap format, which most tools (e.g., Wireshark) support.
+	NanosecondTimestamps bool
+}
+
+// DefaultPCAPSnapLen is the default [PCAPOptions] SnapLen.
+const DefaultPCAPSnapLen = 256
+
+// snapLen returns the snap length to use.
+func (options *PCAPOptions) snapLen() int {
+	if options.SnapLen <= 0 {
+		return DefaultPCAPSnapLen
+	}
+	return options.SnapLen
+}
+
+// shouldCapture returns whether we should record the given packet.
+func (options *PCAPOptions) shouldCapture(packet []byte) bool {
+	if options.Filter == nil {
+		return true
+	}
+	dp, err := DissectPacket(packet)
+	return err == nil && options.Filter(dp)
 }
 
 // NewPCAPDumper creates a new [PCAPDumper].
 func NewPCAPDumper(filename string, logger Logger) *PCAPDumper {
+	return NewPCAPDumperWithOptions(filename, logger, &PCAPOptions{})
+}
+
+// NewPCAPDumperWithOptions is like [NewPCAPDumper] but additionally
+// allows you to customize the capture using [PCAPOptions].
+func NewPCAPDumperWithOptions(filename string, logger Logger, options *PCAPOptions) *PCAPDumper {
 	return &PCAPDumper{
 		filename: filename,
+		keyLog:   &pcapDumperKeyLog{},
 		logger:   logger,
+		options:  options,
 	}
 }
 
@@ -38,56 +138,81 @@ var _ LinkNICWrapper = &PCAPDumper{}
 
 // WrapNIC implements the [LinkNICWrapper] interface.
 func (pd *PCAPDumper) WrapNIC(nic NIC) NIC {
-	return newPCAPDumperNIC(pd.filename, nic, pd.logger)
+	options := *pd.options // make a copy
+	if options.InterfaceName == "" {
+		options.InterfaceName = nic.InterfaceName()
+	}
+	if options.InterfaceDescription == "" {
+		options.InterfaceDescription = fmt.Sprintf("netem NIC with address %s", nic.IPAddress())
+	}
+	dumper := newPCAPDumperNIC(pd.filename, nic, pd.logger, &options)
+	pd.keyLog.add(dumper.capture)
+	return dumper
+}
+
+// TLSKeyLogWriter returns a writer that stores the TLS session secrets it receives in NSS
+// key log format inside the capture, which allows Wireshark to decrypt the capture without
+// an external key log file. Use [UNetStack.SetTLSKeyLogWriter] to register this writer with
+// the stack whose TLS sessions you want to decrypt. We only store the secrets when using
+// [PCAPFormatPCAPNG] and we also store the secrets written before wrapping the NIC.
+func (pd *PCAPDumper) TLSKeyLogWriter() io.Writer {
+	return pd.keyLog
+}
+
+// pcapDumperKeyLog forwards the TLS secrets to the captures created by a [PCAPDumper].
+type pcapDumperKeyLog struct {
+	captures []*PCAPCapture
+	mu       sync.Mutex
+	secrets  [][]byte
 }
 
-// pcapDumperNIC is a [NIC] but also an open PCAP file. The zero
-// value is invalid; use [newPCAPDumperNIC] to instantiate.
+// Write implements io.Writer.
+func (kl *pcapDumperKeyLog) Write(data []byte) (int, error) {
+	secrets := append([]byte{}, data...) // duplicate
+	defer kl.mu.Unlock()
+	kl.mu.Lock()
+	kl.secrets = append(kl.secrets, secrets)
+	for _, capture := range kl.captures {
+		capture.observeSecrets(secrets)
+	}
+	return len(data), nil
+}
+
+// add registers a capture and writes the secrets collected so far into it.
+func (kl *pcapDumperKeyLog) add(capture *PCAPCapture) {
+	defer kl.mu.Unlock()
+	kl.mu.Lock()
+	kl.captures = append(kl.captures, capture)
+	for _, secrets := range kl.secrets {
+		capture.observeSecrets(secrets)
+	}
+}
+
+// pcapDumperNIC is a [NIC] that also captures the packets it reads
+// and writes. The zero value is invalid; use [newPCAPDumperNIC] to instantiate.
 type pcapDumperNIC struct {
-	// cancel stops the background goroutines.
-	cancel context.CancelFunc
+	// capture is the PCAP capture.
+	capture *PCAPCapture
 
 	// closeOnce provides "once" semantics for close.
 	closeOnce sync.Once
 
-	// logger is the logger to use.
-	logger Logger
-
-	// joined is closed when the background goroutine has terminated
-	joined chan any
-
-	// DPIStack is the wrapped NIC
+	// nic is the wrapped NIC
 	nic NIC
-
-	// pich is the channel where we post packets to capture
-	pich chan *pcapDumperPacketInfo
 }
 
 var _ NIC = &pcapDumperNIC{}
 
-// pcapDumperPacketInfo contains info about a packet.
-type pcapDumperPacketInfo struct {
-	originalLength int
-	snapshot       []byte
-}
-
 // newPCAPDumpernic wraps an existing [NIC], intercepts the packets read
 // and written, and stores them into the given PCAP file. This function
 // creates background goroutines for writing into the PCAP file. To
 // join the goroutines, call [PCAPDumper.Close].
-func newPCAPDumperNIC(filename string, nic NIC, logger Logger) *pcapDumperNIC {
-	const manyPackets = 4096
-	ctx, cancel := context.WithCancel(context.Background())
-	pd := &pcapDumperNIC{
-		cancel:    cancel,
+func newPCAPDumperNIC(filename string, nic NIC, logger Logger, options *PCAPOptions) *pcapDumperNIC {
+	return &pcapDumperNIC{
+		capture:   NewPCAPCaptureWithOptions(filename, logger, options),
 		closeOnce: sync.Once{},
-		joined:    make(chan any),
-		logger:    logger,
 		nic:       nic,
-		pich:      make(chan *pcapDumperPacketInfo, manyPackets),
 	}
-	go pd.loop(ctx, filename)
-	return pd
 }
 
 // FrameAvailable implements NIC
@@ -119,56 +244,218 @@ func (pd *pcapDumperNIC) ReadFrameNonblocking() (*Frame, error) {
 	}
 
 	// send packet information to the background writer
-	pd.deliverPacketInfo(frame.Payload)
+	pd.capture.observeFrame(frame, pcapDirectionOutbound)
 
 	// provide it to the caller
 	return frame, nil
 }
 
-// deliverPacketInfo delivers packet info to the background writer.
-func (pd *pcapDumperNIC) deliverPacketInfo(packet []byte) {
-	// make sure the capture length makes sense
+// WriteFrame implements NIC
+func (pd *pcapDumperNIC) WriteFrame(frame *Frame) error {
+	// send packet information to the background writer
+	pd.capture.observeFrame(frame, pcapDirectionInbound)
+
+	// provide frame to the stack
+	return pd.nic.WriteFrame(frame)
+}
+
+// Close implements NIC
+func (pd *pcapDumperNIC) Close() error {
+	pd.closeOnce.Do(func() {
+		// notify the underlying stack to stop
+		pd.nic.Close()
+
+		// stop capturing packets
+		pd.capture.Close()
+	})
+	return nil
+}
+
+// PacketObserver observes raw IP packets.
+type PacketObserver interface {
+	// ObservePacket is called for each packet. The implementation MUST NOT
+	// block and MUST NOT retain or modify the packet after returning.
+	ObservePacket(packet []byte)
+}
+
+// PCAPCapture is a [PacketObserver] that writes the packets it observes
+// into a PCAP file. The zero value is invalid; use [NewPCAPCapture] to
+// instantiate. You can use a PCAPCapture with [Router.SetPacketObserver] to
+// capture all the packets forwarded by a [Router].
+type PCAPCapture struct {
+	// cancel stops the background goroutines.
+	cancel context.CancelFunc
+
+	// closeOnce provides "once" semantics for close.
+	closeOnce sync.Once
+
+	// logger is the logger to use.
+	logger Logger
+
+	// done is closed when we're asked to stop.
+	done <-chan struct{}
+
+	// joined is closed when the background goroutine has terminated
+	joined chan any
+
+	// options contains the capture options.
+	options *PCAPOptions
+
+	// pich is the channel where we post packets to capture
+	pich chan *pcapDumperPacketInfo
+
+	// secretsch is the channel where we post TLS secrets to capture
+	secretsch chan []byte
+}
+
+var _ PacketObserver = &PCAPCapture{}
+
+// pcapDirection is the direction of a packet relative to the capture interface.
+type pcapDirection int
+
+const (
+	pcapDirectionUnknown = pcapDirection(iota)
+	pcapDirectionInbound
+	pcapDirectionOutbound
+)
+
+// epbFlags returns the pcapng enhanced packet block flags for the direction.
+func (d pcapDirection) epbFlags() uint32 {
+	switch d {
+	case pcapDirectionInbound:
+		return pcapngEpbFlagsInbound
+	case pcapDirectionOutbound:
+		return pcapngEpbFlagsOutbound
+	default:
+		return 0
+	}
+}
+
+// pcapDumperPacketInfo contains info about a packet.
+type pcapDumperPacketInfo struct {
+	// frame is the OPTIONAL retained frame backing the snapshot.
+	frame *Frame
+
+	direction      pcapDirection
+	originalLength int
+	snapshot       []byte
+	timestamp      time.Time
+}
+
+// NewPCAPCapture creates a new [PCAPCapture] writing into the given PCAP
+// file. This function creates background goroutines for writing into the
+// PCAP file. To join the goroutines, call [PCAPCapture.Close].
+func NewPCAPCapture(filename string, logger Logger) *PCAPCapture {
+	return NewPCAPCaptureWithOptions(filename, logger, &PCAPOptions{})
+}
+
+// NewPCAPCaptureWithOptions is like [NewPCAPCapture] but additionally
+// allows you to customize the capture using [PCAPOptions].
+func NewPCAPCaptureWithOptions(filename string, logger Logger, options *PCAPOptions) *PCAPCapture {
+	const manyPackets = 4096
+	ctx, cancel := context.WithCancel(context.Background())
+	pc := &PCAPCapture{
+		cancel:    cancel,
+		closeOnce: sync.Once{},
+		done:      ctx.Done(),
+		joined:    make(chan any),
+		logger:    logger,
+		options:   options,
+		pich:      make(chan *pcapDumperPacketInfo, manyPackets),
+		secretsch: make(chan []byte, manyPackets),
+	}
+	go pc.loop(ctx, filename)
+	return pc
+}
+
+// captureLength returns the number of bytes of the packet we capture.
+func (options *PCAPOptions) captureLength(packet []byte) int {
 	packetLength := len(packet)
-	captureLength := 256
+	captureLength := options.snapLen()
 	if packetLength < captureLength {
 		captureLength = packetLength
 	}
+	return captureLength
+}
+
+// observeFrame is like ObservePacket but avoids copying pooled frames, which
+// we retain until the background writer has written them, and records the
+// direction of the frame relative to the capture interface.
+func (pc *PCAPCapture) observeFrame(frame *Frame, direction pcapDirection) {
+	if frame.Buffer == nil {
+		pc.observePacket(frame.Payload, direction)
+		return
+	}
+	if !pc.options.shouldCapture(frame.Payload) {
+		return
+	}
+	frame.Retain()
+	pinfo := &pcapDumperPacketInfo{
+		frame:          frame,
+		direction:      direction,
+		originalLength: len(frame.Payload),
+		timestamp:      time.Now(),
+		snapshot:       frame.Payload[:pc.options.captureLength(frame.Payload)],
+	}
+	select {
+	case pc.pich <- pinfo:
+	default:
+		// just drop from the capture
+		frame.Release()
+	}
+}
+
+// ObservePacket implements [PacketObserver].
+func (pc *PCAPCapture) ObservePacket(packet []byte) {
+	pc.observePacket(packet, pcapDirectionUnknown)
+}
+
+// observePacket is like ObservePacket but records the packet direction.
+func (pc *PCAPCapture) observePacket(packet []byte, direction pcapDirection) {
+	// honour the filter, if any
+	if !pc.options.shouldCapture(packet) {
+		return
+	}
+
+	// make sure the capture length makes sense
+	captureLength := pc.options.captureLength(packet)
 
 	// actually deliver the packet info
 	pinfo := &pcapDumperPacketInfo{
+		direction:      direction,
 		originalLength: len(packet),
+		timestamp:      time.Now(),
 		snapshot:       append([]byte{}, packet[:captureLength]...), // duplicate
 	}
 	select {
-	case pd.pich <- pinfo:
+	case pc.pich <- pinfo:
 	default:
 		// just drop from the capture
 	}
 }
 
 // loop is the loop that writes pcaps
-func (pd *pcapDumperNIC) loop(ctx context.Context, filename string) {
+func (pc *PCAPCapture) loop(ctx context.Context, filename string) {
 	// synchronize with parent
-	defer close(pd.joined)
+	defer close(pc.joined)
 
 	// open the file where to create the pcap
 	filep, err := os.Create(filename)
 	if err != nil {
-		pd.logger.Warnf("netem: PCAPDumper: os.Create: %s", err.Error())
+		pc.logger.Warnf("netem: PCAPDumper: os.Create: %s", err.Error())
 		return
 	}
 	defer func() {
 		if err := filep.Close(); err != nil {
-			pd.logger.Warnf("netem: PCAPDumper: filep.Close: %s", err.Error())
+			pc.logger.Warnf("netem: PCAPDumper: filep.Close: %s", err.Error())
 			// fallthrough
 		}
 	}()
 
 	// write the PCAP header
-	w := pcapgo.NewWriter(filep)
-	const largeSnapLen = 262144
-	if err := w.WriteFileHeader(largeSnapLen, layers.LinkTypeRaw); err != nil {
-		pd.logger.Warnf("netem: PCAPDumper: os.Create: %s", err.Error())
+	w, err := pc.newWriter(filep, uint32(pc.options.snapLen()))
+	if err != nil {
+		pc.logger.Warnf("netem: PCAPDumper: cannot write header: %s", err.Error())
 		return
 	}
 
@@ -176,49 +463,131 @@ func (pd *pcapDumperNIC) loop(ctx context.Context, filename string) {
 	for {
 		select {
 		case <-ctx.Done():
+			pc.drain(w)
 			return
-		case pinfo := <-pd.pich:
-			pd.doWritePCAPEntry(pinfo, w)
+		case pinfo := <-pc.pich:
+			pc.doWritePCAPEntry(pinfo, w)
+		case secrets := <-pc.secretsch:
+			pc.doWriteSecrets(secrets, w)
 		}
 	}
 }
 
-// doWritePCAPEntry writes the given packet entry into the PCAP file.
-func (pd *pcapDumperNIC) doWritePCAPEntry(pinfo *pcapDumperPacketInfo, w *pcapgo.Writer) {
+// pcapWriter writes packets and secrets into a capture file.
+type pcapWriter interface {
+	writePacket(pinfo *pcapDumperPacketInfo) error
+	writeSecrets(secrets []byte) error
+}
+
+// newWriter writes the file header and returns the [pcapWriter] to use.
+func (pc *PCAPCapture) newWriter(w io.Writer, snaplen uint32) (pcapWriter, error) {
+	switch pc.options.Format {
+	case PCAPFormatPCAPNG:
+		return newPCAPNGWriter(w, snaplen, pc.options)
+	default:
+		pw := pcapgo.NewWriter(w)
+		if pc.options.NanosecondTimestamps {
+			pw = pcapgo.NewWriterNanos(w)
+		}
+		if err := pw.WriteFileHeader(snaplen, layers.LinkTypeRaw); err != nil {
+			return nil, err
+		}
+		return &pcapLegacyWriter{pw}, nil
+	}
+}
+
+// pcapLegacyWriter is a [pcapWriter] using the legacy pcap format.
+type pcapLegacyWriter struct {
+	w *pcapgo.Writer
+}
+
+// writePacket implements pcapWriter.
+func (pw *pcapLegacyWriter) writePacket(pinfo *pcapDumperPacketInfo) error {
 	ci := gopacket.CaptureInfo{
-		Timestamp:      time.Now(),
+		Timestamp:      pinfo.timestamp,
 		CaptureLength:  len(pinfo.snapshot),
 		Length:         pinfo.originalLength,
 		InterfaceIndex: 0,
 		AncillaryData:  []interface{}{},
 	}
-	if err := w.WritePacket(ci, pinfo.snapshot); err != nil {
-		pd.logger.Warnf("netem: w.WritePacket: %s", err.Error())
+	return pw.w.WritePacket(ci, pinfo.snapshot)
+}
+
+// writeSecrets implements pcapWriter.
+func (pw *pcapLegacyWriter) writeSecrets(secrets []byte) error {
+	return nil // the legacy format cannot store secrets
+}
+
+// drain writes the entries still queued when we're asked to stop.
+func (pc *PCAPCapture) drain(w pcapWriter) {
+	for {
+		select {
+		case pinfo := <-pc.pich:
+			pc.doWritePCAPEntry(pinfo, w)
+		case secrets := <-pc.secretsch:
+			pc.doWriteSecrets(secrets, w)
+		default:
+			return
+		}
+	}
+}
+
+// doWritePCAPEntry writes the given packet entry into the PCAP file.
+func (pc *PCAPCapture) doWritePCAPEntry(pinfo *pcapDumperPacketInfo, w pcapWriter) {
+	if err := w.writePacket(pinfo); err != nil {
+		pc.logger.Warnf("netem: w.WritePacket: %s", err.Error())
+		// fallthrough
+	}
+	if pinfo.frame != nil {
+		pinfo.frame.Release()
+	}
+}
+
+// doWriteSecrets writes the given TLS secrets into the PCAP file.
+func (pc *PCAPCapture) doWriteSecrets(secrets []byte, w pcapWriter) {
+	if err := w.writeSecrets(secrets); err != nil {
+		pc.logger.Warnf("netem: w.WriteSecrets: %s", err.Error())
 		// fallthrough
 	}
 }
 
-// WriteFrame implements NIC
-func (pd *pcapDumperNIC) WriteFrame(frame *Frame) error {
-	// send packet information to the background writer
-	pd.deliverPacketInfo(frame.Payload)
+// TLSKeyLogWriter returns a writer that stores the TLS session secrets it receives in NSS
+// key log format inside the capture (see [PCAPDumper.TLSKeyLogWriter]). We only store the
+// secrets when using [PCAPFormatPCAPNG].
+func (pc *PCAPCapture) TLSKeyLogWriter() io.Writer {
+	return &pcapCaptureKeyLog{pc}
+}
 
-	// provide frame to the stack
-	return pd.nic.WriteFrame(frame)
+// pcapCaptureKeyLog is the writer returned by [PCAPCapture.TLSKeyLogWriter].
+type pcapCaptureKeyLog struct {
+	pc *PCAPCapture
 }
 
-// Close implements NIC
-func (pd *pcapDumperNIC) Close() error {
-	pd.closeOnce.Do(func() {
-		// notify the underlying stack to stop
-		pd.nic.Close()
+// Write implements io.Writer.
+func (kl *pcapCaptureKeyLog) Write(data []byte) (int, error) {
+	kl.pc.observeSecrets(append([]byte{}, data...)) // duplicate
+	return len(data), nil
+}
+
+// observeSecrets sends the given secrets to the background writer. Unlike packets,
+// we do not drop secrets when the writer is slow, since we need them to decrypt.
+func (pc *PCAPCapture) observeSecrets(secrets []byte) {
+	select {
+	case pc.secretsch <- secrets:
+	case <-pc.done:
+	}
+}
 
+// Close stops capturing and waits for the background writer to
+// finish writing the packets observed so far.
+func (pc *PCAPCapture) Close() error {
+	pc.closeOnce.Do(func() {
 		// notify the background goroutine to terminate
-		pd.cancel()
+		pc.cancel()
 
 		// wait until the channel is drained
-		pd.logger.Debugf("netem: PCAPDumper: awaiting for background writer to finish writing")
-		<-pd.joined
+		pc.logger.Debugf("netem: PCAPDumper: awaiting for background writer to finish writing")
+		<-pc.joined
 	})
 	return nil
 }
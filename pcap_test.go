@@ -0,0 +1,248 @@
+package netem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPCAPCaptureFormats(t *testing.T) {
+	packet := []byte{0x45, 0, 0, 20, 1, 2, 3}
+	secrets := []byte("CLIENT_RANDOM 0011 2233\n")
+
+	// capture writes a packet in each direction and the secrets using the given options.
+	capture := func(t *testing.T, options *PCAPOptions) []byte {
+		filename := filepath.Join(t.TempDir(), "capture")
+		pc := NewPCAPCaptureWithOptions(filename, &NullLogger{}, options)
+		pc.observePacket(packet, pcapDirectionInbound)
+		pc.observeFrame(NewFrame(packet), pcapDirectionOutbound)
+		if _, err := pc.TLSKeyLogWriter().Write(secrets); err != nil {
+			t.Fatal(err)
+		}
+		pc.Close()
+		return Must1(os.ReadFile(filename))
+	}
+
+	t.Run("by default we write the legacy pcap format", func(t *testing.T) {
+		data := capture(t, &PCAPOptions{})
+		reader := Must1(pcapgo.NewReader(bytes.NewReader(data)))
+		if reader.LinkType() != layers.LinkTypeRaw {
+			t.Fatal("unexpected link type", reader.LinkType())
+		}
+		for idx := 0; idx < 2; idx++ {
+			got, _, err := reader.ReadPacketData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(packet, got) {
+				t.Fatal("unexpected packet", got)
+			}
+		}
+		if bytes.Contains(data, secrets) {
+			t.Fatal("the legacy format should not contain the secrets")
+		}
+	})
+
+	t.Run("we can write pcapng with metadata", func(t *testing.T) {
+		options := &PCAPOptions{
+			Format:               PCAPFormatPCAPNG,
+			Comment:              "experiment 1",
+			InterfaceName:        "eth0",
+			InterfaceDescription: "client link",
+		}
+		data := capture(t, options)
+		reader := Must1(pcapgo.NewNgReader(bytes.NewReader(data), pcapgo.DefaultNgReaderOptions))
+		if comment := reader.SectionInfo().Comment; comment != "experiment 1" {
+			t.Fatal("unexpected comment", comment)
+		}
+		intf := Must1(reader.Interface(0))
+		if intf.Name != "eth0" || intf.Description != "client link" || intf.LinkType != layers.LinkTypeRaw {
+			t.Fatal("unexpected interface", intf)
+		}
+		for idx := 0; idx < 2; idx++ {
+			got, _, err := reader.ReadPacketData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(packet, got) {
+				t.Fatal("unexpected packet", got)
+			}
+		}
+
+		// make sure we wrote the direction flags and the secrets
+		epbFlags := func(flags byte) []byte {
+			return []byte{pcapngOptionEpbFlags, 0, 4, 0, flags, 0, 0, 0}
+		}
+		if !bytes.Contains(data, epbFlags(pcapngEpbFlagsInbound)) {
+			t.Fatal("missing inbound flags")
+		}
+		if !bytes.Contains(data, epbFlags(pcapngEpbFlagsOutbound)) {
+			t.Fatal("missing outbound flags")
+		}
+		dsb := []byte{pcapngBlockDecryptionSecrets, 0, 0, 0}
+		if !bytes.Contains(data, dsb) || !bytes.Contains(data, secrets) {
+			t.Fatal("missing decryption secrets block")
+		}
+	})
+}
+
+func TestPCAPDumperTLSKeyLogWriter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "capture.pcapng")
+	dumper := NewPCAPDumperWithOptions(filename, &NullLogger{}, &PCAPOptions{Format: PCAPFormatPCAPNG})
+
+	// the secrets written before wrapping the NIC are not lost
+	Must1(dumper.TLSKeyLogWriter().Write([]byte("CLIENT_RANDOM 00 11\n")))
+
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{LeftNICWrapper: dumper})
+	Must1(dumper.TLSKeyLogWriter().Write([]byte("CLIENT_RANDOM 22 33\n")))
+	topology.Close()
+
+	data := Must1(os.ReadFile(filename))
+	for _, secrets := range []string{"CLIENT_RANDOM 00 11\n", "CLIENT_RANDOM 22 33\n"} {
+		if !bytes.Contains(data, []byte(secrets)) {
+			t.Fatal("missing secrets", secrets)
+		}
+	}
+	reader := Must1(pcapgo.NewNgReader(bytes.NewReader(data), pcapgo.DefaultNgReaderOptions))
+	intf := Must1(reader.Interface(0))
+	if intf.Description != "netem NIC with address 10.0.0.2" {
+		t.Fatal("unexpected interface description", intf.Description)
+	}
+}
+
+func TestPCAPCaptureFilter(t *testing.T) {
+	newUDP := func(dstPort uint16) []byte {
+		ipv4 := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    net.IPv4(10, 0, 0, 2),
+			DstIP:    net.IPv4(10, 0, 0, 1),
+		}
+		udp := &layers.UDP{SrcPort: 54321, DstPort: layers.UDPPort(dstPort)}
+		udp.SetNetworkLayerForChecksum(ipv4)
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		Must0(gopacket.SerializeLayers(buf, opts, ipv4, udp, gopacket.Payload("abcdef")))
+		return buf.Bytes()
+	}
+
+	filename := filepath.Join(t.TempDir(), "capture.pcap")
+	options := &PCAPOptions{
+		Filter: func(packet *DissectedPacket) bool {
+			return packet.DestinationPort() == 53
+		},
+	}
+	pc := NewPCAPCaptureWithOptions(filename, &NullLogger{}, options)
+	pc.ObservePacket(newUDP(443))
+	pc.ObservePacket(newUDP(53))
+	pc.observeFrame(NewFrame(newUDP(123)), pcapDirectionInbound)
+	pc.ObservePacket([]byte{0x45}) // cannot dissect
+	pc.Close()
+
+	reader := Must1(pcapgo.NewReader(bytes.NewReader(Must1(os.ReadFile(filename)))))
+	got, _, err := reader.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newUDP(53), got) {
+		t.Fatal("unexpected packet", got)
+	}
+	if _, _, err := reader.ReadPacketData(); !errors.Is(err, io.EOF) {
+		t.Fatal("expected EOF, got", err)
+	}
+}
+
+func TestPCAPCaptureSnapLen(t *testing.T) {
+	packet := bytes.Repeat([]byte{0x45}, 1500)
+
+	// capture writes the packet using the given snap length and returns the reader.
+	capture := func(t *testing.T, snapLen int) *pcapgo.Reader {
+		filename := filepath.Join(t.TempDir(), "capture.pcap")
+		pc := NewPCAPCaptureWithOptions(filename, &NullLogger{}, &PCAPOptions{SnapLen: snapLen})
+		pc.ObservePacket(packet)
+		pc.observeFrame(NewFrame(packet), pcapDirectionInbound)
+		pc.Close()
+		return Must1(pcapgo.NewReader(bytes.NewReader(Must1(os.ReadFile(filename)))))
+	}
+
+	for _, tc := range []struct {
+		snapLen int
+		expect  int
+	}{{0, DefaultPCAPSnapLen}, {96, 96}, {65535, 1500}} {
+		t.Run(fmt.Sprintf("with snapLen=%d", tc.snapLen), func(t *testing.T) {
+			reader := capture(t, tc.snapLen)
+			if tc.snapLen > 0 && reader.Snaplen() != uint32(tc.snapLen) {
+				t.Fatal("unexpected snaplen in header", reader.Snaplen())
+			}
+			for idx := 0; idx < 2; idx++ {
+				data, ci, err := reader.ReadPacketData()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(data) != tc.expect || ci.CaptureLength != tc.expect || ci.Length != len(packet) {
+					t.Fatal("unexpected lengths", len(data), ci.CaptureLength, ci.Length)
+				}
+			}
+		})
+	}
+}
+
+func TestPCAPCaptureNanosecondTimestamps(t *testing.T) {
+	packet := []byte{0x45, 0, 0, 20}
+
+	// capture writes some packets and returns the file content and the time bounds.
+	capture := func(t *testing.T, options *PCAPOptions) ([]byte, time.Time, time.Time) {
+		filename := filepath.Join(t.TempDir(), "capture")
+		pc := NewPCAPCaptureWithOptions(filename, &NullLogger{}, options)
+		before := time.Now()
+		for idx := 0; idx < 4; idx++ {
+			pc.ObservePacket(packet)
+		}
+		after := time.Now()
+		pc.Close()
+		return Must1(os.ReadFile(filename)), before, after
+	}
+
+	// check reads the packets and checks their timestamps.
+	check := func(t *testing.T, reader gopacket.PacketDataSource, before, after time.Time) {
+		var subMicro bool
+		for idx := 0; idx < 4; idx++ {
+			_, ci, err := reader.ReadPacketData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ci.Timestamp.Before(before) || ci.Timestamp.After(after) {
+				t.Fatal("timestamp out of bounds", ci.Timestamp, before, after)
+			}
+			subMicro = subMicro || ci.Timestamp.Nanosecond()%1000 != 0
+		}
+		if !subMicro {
+			t.Fatal("expected nanosecond resolution")
+		}
+	}
+
+	t.Run("with pcap", func(t *testing.T) {
+		data, before, after := capture(t, &PCAPOptions{NanosecondTimestamps: true})
+		if !bytes.HasPrefix(data, []byte{0x4d, 0x3c, 0xb2, 0xa1}) {
+			t.Fatal("expected the nanosecond magic")
+		}
+		check(t, Must1(pcapgo.NewReader(bytes.NewReader(data))), before, after)
+	})
+
+	t.Run("with pcapng", func(t *testing.T) {
+		data, before, after := capture(t, &PCAPOptions{Format: PCAPFormatPCAPNG, NanosecondTimestamps: true})
+		reader := Must1(pcapgo.NewNgReader(bytes.NewReader(data), pcapgo.DefaultNgReaderOptions))
+		check(t, reader, before, after)
+	})
+}
@@ -0,0 +1,142 @@
+package netem
+
+//
+// pcapng writer
+//
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/google/gopacket/layers"
+)
+
+// The following constants define the pcapng blocks and options we use. See
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html.
+const (
+	pcapngBlockSectionHeader     = 0x0A0D0D0A
+	pcapngBlockInterfaceDesc     = 0x00000001
+	pcapngBlockEnhancedPacket    = 0x00000006
+	pcapngBlockDecryptionSecrets = 0x0000000A
+	pcapngByteOrderMagic         = 0x1A2B3C4D
+	pcapngOptionComment          = 1
+	pcapngOptionShbUserAppl      = 4
+	pcapngOptionIfName           = 2
+	pcapngOptionIfDescription    = 3
+	pcapngOptionIfTsresol        = 9
+	pcapngOptionEpbFlags         = 2
+	pcapngSecretsTypeTLSKeyLog   = 0x544c534b
+	pcapngEpbFlagsInbound        = 1
+	pcapngEpbFlagsOutbound       = 2
+)
+
+// pcapngOption is a pcapng option.
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+// pcapngWriter writes pcapng files containing a single section with a single
+// interface. The zero value is invalid; use [newPCAPNGWriter] to construct.
+type pcapngWriter struct {
+	nanos bool
+	w     io.Writer
+}
+
+var _ pcapWriter = &pcapngWriter{}
+
+// newPCAPNGWriter writes the section header block and the interface
+// description block into w and returns a new [*pcapngWriter].
+func newPCAPNGWriter(w io.Writer, snaplen uint32, options *PCAPOptions) (*pcapngWriter, error) {
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+	shbOptions := []pcapngOption{{code: pcapngOptionShbUserAppl, value: []byte("netem")}}
+	if options.Comment != "" {
+		shbOptions = append(shbOptions, pcapngOption{code: pcapngOptionComment, value: []byte(options.Comment)})
+	}
+
+	idb := binary.LittleEndian.AppendUint16(nil, uint16(layers.LinkTypeRaw))
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // reserved
+	idb = binary.LittleEndian.AppendUint32(idb, snaplen)
+	tsresol := byte(6) // microseconds
+	if options.NanosecondTimestamps {
+		tsresol = 9
+	}
+	idbOptions := []pcapngOption{{code: pcapngOptionIfTsresol, value: []byte{tsresol}}}
+	if options.InterfaceName != "" {
+		idbOptions = append(idbOptions, pcapngOption{code: pcapngOptionIfName, value: []byte(options.InterfaceName)})
+	}
+	if options.InterfaceDescription != "" {
+		idbOptions = append(idbOptions, pcapngOption{
+			code: pcapngOptionIfDescription, value: []byte(options.InterfaceDescription)})
+	}
+
+	out := pcapngAppendBlock(nil, pcapngBlockSectionHeader, shb, shbOptions)
+	out = pcapngAppendBlock(out, pcapngBlockInterfaceDesc, idb, idbOptions)
+	if _, err := w.Write(out); err != nil {
+		return nil, err
+	}
+	return &pcapngWriter{nanos: options.NanosecondTimestamps, w: w}, nil
+}
+
+// writePacket implements pcapWriter.
+func (pw *pcapngWriter) writePacket(pinfo *pcapDumperPacketInfo) error {
+	timestamp := uint64(pinfo.timestamp.UnixMicro())
+	if pw.nanos {
+		timestamp = uint64(pinfo.timestamp.UnixNano())
+	}
+	epb := binary.LittleEndian.AppendUint32(nil, 0) // interface ID
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(timestamp>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(timestamp))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pinfo.snapshot)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(pinfo.originalLength))
+	epb = pcapngAppendPadded(epb, pinfo.snapshot)
+	var options []pcapngOption
+	if pinfo.direction != pcapDirectionUnknown {
+		options = append(options, pcapngOption{
+			code:  pcapngOptionEpbFlags,
+			value: binary.LittleEndian.AppendUint32(nil, pinfo.direction.epbFlags()),
+		})
+	}
+	_, err := pw.w.Write(pcapngAppendBlock(nil, pcapngBlockEnhancedPacket, epb, options))
+	return err
+}
+
+// writeSecrets implements pcapWriter.
+func (pw *pcapngWriter) writeSecrets(secrets []byte) error {
+	dsb := binary.LittleEndian.AppendUint32(nil, pcapngSecretsTypeTLSKeyLog)
+	dsb = binary.LittleEndian.AppendUint32(dsb, uint32(len(secrets)))
+	dsb = pcapngAppendPadded(dsb, secrets)
+	_, err := pw.w.Write(pcapngAppendBlock(nil, pcapngBlockDecryptionSecrets, dsb, nil))
+	return err
+}
+
+// pcapngAppendBlock appends to out the block with the given type, body, and options.
+func pcapngAppendBlock(out []byte, blockType uint32, body []byte, options []pcapngOption) []byte {
+	var rawOptions []byte
+	for _, option := range options {
+		rawOptions = binary.LittleEndian.AppendUint16(rawOptions, option.code)
+		rawOptions = binary.LittleEndian.AppendUint16(rawOptions, uint16(len(option.value)))
+		rawOptions = pcapngAppendPadded(rawOptions, option.value)
+	}
+	if len(rawOptions) > 0 {
+		rawOptions = append(rawOptions, 0, 0, 0, 0) // opt_endofopt
+	}
+	length := uint32(12 + len(body) + len(rawOptions))
+	out = binary.LittleEndian.AppendUint32(out, blockType)
+	out = binary.LittleEndian.AppendUint32(out, length)
+	out = append(out, body...)
+	out = append(out, rawOptions...)
+	return binary.LittleEndian.AppendUint32(out, length)
+}
+
+// pcapngAppendPadded appends data to out padding to a 32 bit boundary.
+func pcapngAppendPadded(out, data []byte) []byte {
+	out = append(out, data...)
+	for idx := len(data); idx%4 != 0; idx++ {
+		out = append(out, 0)
+	}
+	return out
+}
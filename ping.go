@@ -0,0 +1,152 @@
+package netem
+
+//
+// Ping
+//
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pingID is the ICMP echo identifier of the next [Ping].
+var pingID = &atomic.Uint32{}
+
+// Ping sends count ICMP echo requests to the given IPv4 address using the given
+// [UNetStack], waiting the given interval between consecutive requests, and
+// returns the RTT of the echo replies received before the context expires,
+// ordered by sequence number. Note that every [UNetStack] answers pings.
+//
+// Ping returns as soon as we have received all the replies, so you should
+// use a context with a deadline to bound the time spent waiting for replies
+// that were lost. Ping returns an error when we did not receive any reply.
+func Ping(
+	ctx context.Context,
+	stack *UNetStack,
+	ipAddress string,
+	count int,
+	interval time.Duration,
+) ([]time.Duration, error) {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil || ip.To4() == nil {
+		return nil, ErrNotIPv4Address
+	}
+	if count <= 0 {
+		return nil, syscall.EINVAL
+	}
+
+	conn, err := stack.ListenICMP()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// make sure we unblock the reader when the context is done
+	done := make(chan any)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var (
+		mu   sync.Mutex
+		sent = make([]time.Time, count)
+	)
+	id := uint16(pingID.Add(1))
+
+	// send the echo requests in the background
+	go func() {
+		for seq := 0; seq < count; seq++ {
+			if seq > 0 {
+				select {
+				case <-time.After(interval):
+				case <-done:
+					return
+				}
+			}
+			rawRequest, err := newICMPv4Echo(id, uint16(seq))
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			sent[seq] = time.Now()
+			mu.Unlock()
+			if _, err := conn.WriteTo(rawRequest, &net.IPAddr{IP: ip}); err != nil {
+				return
+			}
+		}
+	}()
+
+	// collect the echo replies
+	rtts := make([]time.Duration, count)
+	var received int
+	buffer := make([]byte, 1<<16)
+	for received < count {
+		nread, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			break
+		}
+		seq, good := pingParseEchoReply(buffer[:nread], id)
+		if !good || seq >= count || rtts[seq] != 0 {
+			continue
+		}
+		if ipAddr, good := addr.(*net.IPAddr); !good || ipAddr == nil || !ipAddr.IP.Equal(ip) {
+			continue
+		}
+		mu.Lock()
+		rtts[seq] = time.Since(sent[seq])
+		mu.Unlock()
+		received++
+	}
+
+	samples := []time.Duration{}
+	for _, rtt := range rtts {
+		if rtt != 0 {
+			samples = append(samples, rtt)
+		}
+	}
+	if len(samples) <= 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, net.ErrClosed
+	}
+	return samples, nil
+}
+
+// newICMPv4Echo serializes an ICMPv4 echo request.
+func newICMPv4Echo(id, seq uint16) ([]byte, error) {
+	echo := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+		Id:       id,
+		Seq:      seq,
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, echo, gopacket.Payload("netem")); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// pingParseEchoReply parses an ICMPv4 echo reply with the given
+// identifier and returns its sequence number on success.
+func pingParseEchoReply(rawMessage []byte, id uint16) (int, bool) {
+	packet := gopacket.NewPacket(rawMessage, layers.LayerTypeICMPv4, gopacket.Default)
+	icmp, good := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !good || icmp.TypeCode.Type() != layers.ICMPv4TypeEchoReply || icmp.Id != id {
+		return 0, false
+	}
+	return int(icmp.Seq), true
+}
@@ -0,0 +1,51 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{
+		LeftToRightDelay: 10 * time.Millisecond,
+		RightToLeftDelay: 10 * time.Millisecond,
+	})
+	defer topology.Close()
+
+	t.Run("we receive a reply for each request", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		rtts, err := Ping(ctx, topology.Client, "10.0.0.1", 3, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rtts) != 3 {
+			t.Fatal("expected three samples, got", len(rtts))
+		}
+		for _, rtt := range rtts {
+			if rtt < 20*time.Millisecond {
+				t.Fatal("the RTT is too small", rtt)
+			}
+		}
+	})
+
+	t.Run("we fail if we do not receive any reply", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		rtts, err := Ping(ctx, topology.Client, "10.0.0.3", 1, 0)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("not the error we expected", err)
+		}
+		if len(rtts) != 0 {
+			t.Fatal("expected no samples")
+		}
+	})
+
+	t.Run("we reject invalid arguments", func(t *testing.T) {
+		if _, err := Ping(context.Background(), topology.Client, "::1", 1, 0); !errors.Is(err, ErrNotIPv4Address) {
+			t.Fatal("not the error we expected", err)
+		}
+	})
+}
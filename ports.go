@@ -0,0 +1,35 @@
+package netem
+
+//
+// Ephemeral ports
+//
+
+import "syscall"
+
+// SetEphemeralPortRange sets the inclusive range of ephemeral ports used by the
+// TCP and UDP sockets that do not explicitly bind to a port. A small range allows
+// to deliberately construct port-collision and port-exhaustion scenarios, in which
+// case dialing fails with [syscall.EADDRNOTAVAIL]. This method returns
+// [syscall.EINVAL] if first is zero or greater than last.
+func (gs *UNetStack) SetEphemeralPortRange(first, last uint16) error {
+	if first == 0 || first > last {
+		return syscall.EINVAL
+	}
+	return gs.ns.SetEphemeralPortRange(first, last)
+}
+
+// EphemeralPortRange returns the inclusive range of ephemeral ports.
+func (gs *UNetStack) EphemeralPortRange() (first, last uint16) {
+	return gs.ns.EphemeralPortRange()
+}
+
+// SetSequentialPortAllocation enables or disables the deterministic port allocation
+// mode. By default, we pick ephemeral ports pseudo-randomly. In deterministic mode,
+// instead, we allocate ephemeral ports sequentially starting from the first port of
+// the range, skipping ports in use and wrapping around, such that running the same
+// experiment twice produces comparable packet captures and DPI logs.
+//
+// Enabling this mode restarts the allocation from the first port of the range.
+func (gs *UNetStack) SetSequentialPortAllocation(enable bool) {
+	gs.ns.SetSequentialPorts(enable)
+}
@@ -0,0 +1,102 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEphemeralPorts(t *testing.T) {
+	newTopology := func() (*PPPTopology, net.Listener) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		return topology, listener
+	}
+
+	localPort := func(addr net.Addr) int {
+		switch addr := addr.(type) {
+		case *net.TCPAddr:
+			return addr.Port
+		case *net.UDPAddr:
+			return addr.Port
+		default:
+			return 0
+		}
+	}
+
+	t.Run("we can configure the ephemeral port range", func(t *testing.T) {
+		topology, listener := newTopology()
+		defer topology.Close()
+		defer listener.Close()
+		Must0(topology.Client.SetEphemeralPortRange(40000, 40000))
+		if first, last := topology.Client.EphemeralPortRange(); first != 40000 || last != 40000 {
+			t.Fatal("unexpected range", first, last)
+		}
+
+		conn, err := topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if port := localPort(conn.LocalAddr()); port != 40000 {
+			t.Fatal("unexpected port", port)
+		}
+
+		// the only available port is busy for the same destination
+		_, err = topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		if !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we can allocate ports sequentially", func(t *testing.T) {
+		topology, listener := newTopology()
+		defer topology.Close()
+		defer listener.Close()
+		Must0(topology.Client.SetEphemeralPortRange(50000, 50010))
+		topology.Client.SetSequentialPortAllocation(true)
+
+		var ports []int
+		for _, network := range []string{"tcp", "tcp", "udp", "tcp"} {
+			conn, err := topology.Client.DialContext(context.Background(), network, "10.0.0.1:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ports = append(ports, localPort(conn.LocalAddr()))
+		}
+		pconn := Must1(topology.Client.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)}))
+		defer pconn.Close()
+		ports = append(ports, localPort(pconn.LocalAddr()))
+
+		expect := []int{50000, 50001, 50002, 50003, 50004}
+		if diff := cmp.Diff(expect, ports); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("we reject invalid ranges", func(t *testing.T) {
+		topology, listener := newTopology()
+		defer topology.Close()
+		defer listener.Close()
+		if err := topology.Client.SetEphemeralPortRange(0, 10); !errors.Is(err, syscall.EINVAL) {
+			t.Fatal("unexpected error", err)
+		}
+		if err := topology.Client.SetEphemeralPortRange(20, 10); !errors.Is(err, syscall.EINVAL) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package netem
+
+//
+// QUIC and HTTP/3 helpers
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// QUICEchoALPN is the ALPN used by [QUICEchoServer].
+const QUICEchoALPN = "netem-echo"
+
+// QUICEchoServer is a QUIC server echoing back the content of each stream
+// opened by the client, which is useful to exercise the QUIC-related DPI
+// rules and UDP link impairments. The zero value is invalid, please construct
+// using [NewQUICEchoServer].
+type QUICEchoServer struct {
+	closed   chan any
+	listener *quic.Listener
+	once     sync.Once
+	pconn    UDPLikeConn
+}
+
+// NewQUICEchoServer creates a new [QUICEchoServer] listening on the given IP
+// address and UDP port and using [QUICEchoALPN]. The certificate includes the
+// IP address and the given server names and is signed by the stack's CA, hence
+// [DialQUIC] and clients using the MITM config validate it. Remember to call
+// [QUICEchoServer.Close] when done.
+func NewQUICEchoServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	port int,
+	serverNames ...string,
+) (*QUICEchoServer, error) {
+	pconn, err := quicListen(stack, ipAddress, port)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := stack.MustNewServerTLSConfig(ipAddress, serverNames...)
+	tlsConfig.NextProtos = []string{QUICEchoALPN}
+	listener, err := quic.Listen(pconn, tlsConfig, &quic.Config{})
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+	qes := &QUICEchoServer{
+		closed:   make(chan any),
+		listener: listener,
+		once:     sync.Once{},
+		pconn:    pconn,
+	}
+	go qes.serve(logger)
+	return qes, nil
+}
+
+// serve accepts and serves QUIC connections.
+func (qes *QUICEchoServer) serve(logger Logger) {
+	for {
+		conn, err := qes.listener.Accept(context.Background())
+		if err != nil {
+			select {
+			case <-qes.closed:
+			default:
+				logger.Warnf("netem: QUICEchoServer: %s", err.Error())
+			}
+			return
+		}
+		go qes.serveConn(conn)
+	}
+}
+
+// serveConn echoes the streams of a QUIC connection.
+func (qes *QUICEchoServer) serveConn(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func(stream quic.Stream) {
+			io.Copy(stream, stream)
+			stream.Close()
+		}(stream)
+	}
+}
+
+// Close stops the server.
+func (qes *QUICEchoServer) Close() error {
+	qes.once.Do(func() {
+		close(qes.closed)
+		qes.listener.Close()
+		qes.pconn.Close()
+	})
+	return nil
+}
+
+// HTTP3Server is an HTTP/3 server. The zero value is invalid, please
+// construct using [NewHTTP3Server].
+type HTTP3Server struct {
+	once   sync.Once
+	pconn  UDPLikeConn
+	server *http3.Server
+}
+
+// NewHTTP3Server creates a new [HTTP3Server] serving the given [http.Handler]
+// on the given IP address and UDP port. The certificate includes the IP address
+// and the given server names and is signed by the stack's CA, hence clients
+// created using [NewHTTP3Transport] validate it. Remember to call
+// [HTTP3Server.Close] when done.
+func NewHTTP3Server(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	port int,
+	handler http.Handler,
+	serverNames ...string,
+) (*HTTP3Server, error) {
+	pconn, err := quicListen(stack, ipAddress, port)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := stack.MustNewServerTLSConfig(ipAddress, serverNames...)
+	hs := &HTTP3Server{
+		once:  sync.Once{},
+		pconn: pconn,
+		server: &http3.Server{
+			Handler:   handler,
+			TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+		},
+	}
+	go func() {
+		err := hs.server.Serve(pconn)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, quic.ErrServerClosed) {
+			logger.Warnf("netem: HTTP3Server: %s", err.Error())
+		}
+	}()
+	return hs, nil
+}
+
+// Close stops the server.
+func (hs *HTTP3Server) Close() error {
+	hs.once.Do(func() {
+		hs.server.Close()
+		hs.pconn.Close()
+	})
+	return nil
+}
+
+// quicListen creates the UDP socket used by QUIC servers.
+func quicListen(stack UnderlyingNetwork, ipAddress string, port int) (UDPLikeConn, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	return stack.ListenUDP("udp", &net.UDPAddr{IP: parsedIP, Port: port})
+}
+
+// DialQUIC establishes a QUIC connection with the given endpoint using a new
+// UDP socket, which we close when the connection is closed. The SNI is the
+// hostname of the address and we validate the certificate using the stack's
+// default cert pool. If you do not specify any ALPN, we use [QUICEchoALPN].
+func DialQUIC(ctx context.Context, stack UnderlyingNetwork, address string, alpn ...string) (quic.Connection, error) {
+	if len(alpn) <= 0 {
+		alpn = []string{QUICEchoALPN}
+	}
+	tlsConfig := &tls.Config{NextProtos: alpn, RootCAs: stack.DefaultCertPool()}
+	return quicDial(ctx, stack, address, tlsConfig, &quic.Config{})
+}
+
+// quicDial is the common implementation of [DialQUIC] and [NewHTTP3Transport].
+func quicDial(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	address string,
+	tlsConfig *tls.Config,
+	config *quic.Config,
+) (quic.EarlyConnection, error) {
+	hostname, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{hostname}
+	if net.ParseIP(hostname) == nil {
+		if addrs, err = (&Net{Stack: stack}).LookupHost(ctx, hostname); err != nil {
+			return nil, err
+		}
+	}
+	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(addrs[0], port))
+	if err != nil {
+		return nil, err
+	}
+	pconn, err := stack.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = hostname
+	}
+	conn, err := quic.DialEarly(ctx, pconn, raddr, tlsConfig, config)
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+	go func() {
+		<-conn.Context().Done()
+		pconn.Close()
+	}()
+	return conn, nil
+}
+
+// NewHTTP3Transport creates a new [http.RoundTripper] speaking HTTP/3 using
+// the given stack, which validates certificates using the stack's default cert
+// pool. Call the Close method of the returned transport when done.
+func NewHTTP3Transport(stack UnderlyingNetwork) *http3.RoundTripper {
+	return &http3.RoundTripper{
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return quicDial(ctx, stack, addr, tlsCfg, cfg)
+		},
+		TLSClientConfig: &tls.Config{RootCAs: stack.DefaultCertPool()},
+	}
+}
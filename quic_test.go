@@ -0,0 +1,60 @@
+package netem
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQUIC(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	t.Run("the echo server echoes each stream", func(t *testing.T) {
+		server := Must1(NewQUICEchoServer(&NullLogger{}, topology.Server, "10.0.0.1", 443))
+		defer server.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := DialQUIC(ctx, topology.Client, "10.0.0.1:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.CloseWithError(0, "")
+		for idx := 0; idx < 3; idx++ {
+			stream := Must1(conn.OpenStreamSync(ctx))
+			Must1(stream.Write([]byte("hello, world")))
+			Must0(stream.Close())
+			data, err := io.ReadAll(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "hello, world" {
+				t.Fatal("unexpected data", string(data))
+			}
+		}
+	})
+
+	t.Run("the HTTP/3 server serves the handler", func(t *testing.T) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		})
+		server := Must1(NewHTTP3Server(&NullLogger{}, topology.Server, "10.0.0.1", 443, handler))
+		defer server.Close()
+
+		txp := NewHTTP3Transport(topology.Client)
+		defer txp.Close()
+		client := &http.Client{Transport: txp, Timeout: 5 * time.Second}
+		resp, err := client.Get("https://10.0.0.1/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := Must1(io.ReadAll(resp.Body))
+		if resp.ProtoMajor != 3 || string(body) != "HTTP/3.0" {
+			t.Fatal("unexpected response", resp.Proto, string(body))
+		}
+	})
+}
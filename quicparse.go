@@ -0,0 +1,371 @@
+package netem
+
+//
+// References:
+//
+// - https://datatracker.ietf.org/doc/html/rfc9000
+//
+// - https://datatracker.ietf.org/doc/html/rfc9001
+//
+// - https://quic.xargs.org/#client-initial-packet
+//
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrQUICParse is the error returned in case there is a QUIC parse error.
+var ErrQUICParse = errors.New("quicparse: parse error")
+
+// newErrQUICParse returns a new [ErrQUICParse].
+func newErrQUICParse(message string) error {
+	return fmt.Errorf("%w: %s", ErrQUICParse, message)
+}
+
+// QUICInitialPacket is a decrypted QUIC version 1 Initial packet sent by a client.
+type QUICInitialPacket struct {
+	// Version is the QUIC version.
+	Version uint32
+
+	// DestinationConnectionID is the destination connection ID.
+	DestinationConnectionID []byte
+
+	// SourceConnectionID is the source connection ID.
+	SourceConnectionID []byte
+
+	// Token is the POSSIBLY EMPTY token.
+	Token []byte
+
+	// PacketNumber is the packet number.
+	PacketNumber uint64
+
+	// CryptoData contains the data of the CRYPTO frames reassembled starting
+	// from offset zero, which typically is the beginning of the TLS ClientHello.
+	CryptoData []byte
+}
+
+// quicInitialSaltV1 is the salt used to derive the initial secrets of QUIC version 1.
+var quicInitialSaltV1 = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// UnmarshalQUICInitialPacket parses and decrypts the first QUIC packet contained in
+// the given UDP payload, which MUST be a version 1 Initial packet sent by a client.
+//
+// Because the keys protecting Initial packets only depend on the destination connection
+// ID chosen by the client, anyone observing the packet can decrypt it, which is what
+// allows censors to inspect the ClientHello carried by QUIC.
+func UnmarshalQUICInitialPacket(rawInput []byte) (*QUICInitialPacket, error) {
+	cursor := cryptobyte.String(rawInput)
+	packet := &QUICInitialPacket{}
+
+	var first uint8
+	if !cursor.ReadUint8(&first) {
+		return nil, newErrQUICParse("cannot read first byte")
+	}
+	if first&0x80 == 0 {
+		return nil, newErrQUICParse("not a long header packet")
+	}
+	if !cursor.ReadUint32(&packet.Version) {
+		return nil, newErrQUICParse("cannot read version")
+	}
+	if packet.Version != 1 {
+		return nil, newErrQUICParse("unsupported version")
+	}
+	if (first>>4)&0x03 != 0 {
+		return nil, newErrQUICParse("not an initial packet")
+	}
+
+	var (
+		dcid, scid cryptobyte.String
+		token      []byte
+	)
+	if !cursor.ReadUint8LengthPrefixed(&dcid) {
+		return nil, newErrQUICParse("cannot read destination connection ID")
+	}
+	packet.DestinationConnectionID = dcid
+	if !cursor.ReadUint8LengthPrefixed(&scid) {
+		return nil, newErrQUICParse("cannot read source connection ID")
+	}
+	packet.SourceConnectionID = scid
+	tokenLength, good := readQUICVarint(&cursor)
+	if !good || !cursor.ReadBytes(&token, int(tokenLength)) {
+		return nil, newErrQUICParse("cannot read token")
+	}
+	packet.Token = token
+	length, good := readQUICVarint(&cursor)
+	if !good || length > uint64(len(cursor)) {
+		return nil, newErrQUICParse("cannot read length")
+	}
+
+	// as documented by RFC 9001, header protection samples 16 bytes starting
+	// four bytes after the beginning of the packet number field
+	pnOffset := len(rawInput) - len(cursor)
+	if length < 4+16 {
+		return nil, newErrQUICParse("packet too short")
+	}
+	raw := append([]byte{}, rawInput[:pnOffset+int(length)]...)
+
+	// derive the client keys and remove header protection
+	key, iv, hp := quicInitialClientKeys(packet.DestinationConnectionID)
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, raw[pnOffset+4:pnOffset+4+16])
+	raw[0] ^= mask[0] & 0x0f
+	pnLength := int(raw[0]&0x03) + 1
+	for idx := 0; idx < pnLength; idx++ {
+		raw[pnOffset+idx] ^= mask[1+idx]
+		packet.PacketNumber = packet.PacketNumber<<8 | uint64(raw[pnOffset+idx])
+	}
+
+	// decrypt the payload using the header as additional data
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := append([]byte{}, iv...)
+	for idx := 0; idx < 8; idx++ {
+		nonce[len(nonce)-1-idx] ^= byte(packet.PacketNumber >> (8 * idx))
+	}
+	header := raw[:pnOffset+pnLength]
+	plaintext, err := aead.Open(nil, nonce, raw[pnOffset+pnLength:], header)
+	if err != nil {
+		return nil, newErrQUICParse("cannot decrypt payload")
+	}
+
+	packet.CryptoData, err = quicReassembleCryptoFrames(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// ServerName returns the SNI of the ClientHello contained by the packet.
+func (p *QUICInitialPacket) ServerName() (string, error) {
+	hx, err := UnmarshalTLSHandshakeMsg(cryptobyte.String(p.CryptoData))
+	if err != nil {
+		return "", err
+	}
+	if hx.ClientHello == nil {
+		return "", newErrTLSParse("no client hello")
+	}
+	exts, err := UnmarshalTLSExtensions(hx.ClientHello.Extensions)
+	if err != nil {
+		return "", err
+	}
+	snext, found := FindTLSServerNameExtension(exts)
+	if !found {
+		return "", newErrTLSParse("no server name extension")
+	}
+	return UnmarshalTLSServerNameExtension(snext.Data)
+}
+
+// ExtractQUICServerName takes in input a UDP payload, attempts to parse it as a
+// QUIC Initial packet sent by a client, and, if successful, extracts the SNI.
+func ExtractQUICServerName(rawInput []byte) (string, error) {
+	packet, err := UnmarshalQUICInitialPacket(rawInput)
+	if err != nil {
+		return "", err
+	}
+	return packet.ServerName()
+}
+
+// quicInitialClientKeys derives the key, the IV, and the header protection key
+// protecting the client Initial packets with the given destination connection ID.
+func quicInitialClientKeys(dcid []byte) (key, iv, hp []byte) {
+	initialSecret := hkdf.Extract(sha256.New, dcid, quicInitialSaltV1)
+	clientSecret := quicHKDFExpandLabel(initialSecret, "client in", 32)
+	key = quicHKDFExpandLabel(clientSecret, "quic key", 16)
+	iv = quicHKDFExpandLabel(clientSecret, "quic iv", 12)
+	hp = quicHKDFExpandLabel(clientSecret, "quic hp", 16)
+	return
+}
+
+// quicHKDFExpandLabel implements the HKDF-Expand-Label function defined by
+// RFC 8446 using SHA-256 and an empty context.
+func quicHKDFExpandLabel(secret []byte, label string, length int) []byte {
+	builder := cryptobyte.NewBuilder(nil)
+	builder.AddUint16(uint16(length))
+	builder.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	builder.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	output := make([]byte, length)
+	Must1(io.ReadFull(hkdf.Expand(sha256.New, secret, builder.BytesOrPanic()), output))
+	return output
+}
+
+// readQUICVarint reads a variable-length integer as defined by RFC 9000.
+func readQUICVarint(cursor *cryptobyte.String) (uint64, bool) {
+	var first uint8
+	if !cursor.ReadUint8(&first) {
+		return 0, false
+	}
+	value := uint64(first & 0x3f)
+	for idx := 1; idx < 1<<(first>>6); idx++ {
+		var next uint8
+		if !cursor.ReadUint8(&next) {
+			return 0, false
+		}
+		value = value<<8 | uint64(next)
+	}
+	return value, true
+}
+
+// quicCryptoFragment is the data of a CRYPTO frame.
+type quicCryptoFragment struct {
+	data   []byte
+	offset uint64
+}
+
+// quicReassembleCryptoFrames parses the frames of a decrypted Initial packet
+// and returns the data of the CRYPTO frames reassembled from offset zero.
+func quicReassembleCryptoFrames(plaintext []byte) ([]byte, error) {
+	cursor := cryptobyte.String(plaintext)
+	var fragments []*quicCryptoFragment
+	for !cursor.Empty() {
+		frameType, good := readQUICVarint(&cursor)
+		if !good {
+			return nil, newErrQUICParse("cannot read frame type")
+		}
+		switch frameType {
+		case 0x00, 0x01: // PADDING, PING
+
+		case 0x02, 0x03: // ACK
+			if !quicSkipACKFrame(&cursor, frameType == 0x03) {
+				return nil, newErrQUICParse("cannot read ACK frame")
+			}
+
+		case 0x06: // CRYPTO
+			offset, good := readQUICVarint(&cursor)
+			if !good {
+				return nil, newErrQUICParse("cannot read CRYPTO frame offset")
+			}
+			length, good := readQUICVarint(&cursor)
+			var data []byte
+			if !good || !cursor.ReadBytes(&data, int(length)) {
+				return nil, newErrQUICParse("cannot read CRYPTO frame data")
+			}
+			fragments = append(fragments, &quicCryptoFragment{data: data, offset: offset})
+
+		default:
+			return nil, newErrQUICParse("unsupported frame type")
+		}
+	}
+
+	// reassemble the fragments, which clients MAY send out of order
+	sort.SliceStable(fragments, func(i, j int) bool {
+		return fragments[i].offset < fragments[j].offset
+	})
+	var output []byte
+	for _, fragment := range fragments {
+		if fragment.offset > uint64(len(output)) {
+			break // we cannot reassemble beyond a gap
+		}
+		if end := fragment.offset + uint64(len(fragment.data)); end > uint64(len(output)) {
+			output = append(output, fragment.data[uint64(len(output))-fragment.offset:]...)
+		}
+	}
+	if len(output) <= 0 {
+		return nil, newErrQUICParse("no CRYPTO frames")
+	}
+	return output, nil
+}
+
+// quicSkipACKFrame skips the body of an ACK frame.
+func quicSkipACKFrame(cursor *cryptobyte.String, withECN bool) bool {
+	var values [4]uint64
+	for idx := range values { // largest, delay, range count, first range
+		value, good := readQUICVarint(cursor)
+		if !good {
+			return false
+		}
+		values[idx] = value
+	}
+	fields := 2 * values[2] // gap and length of each range
+	if withECN {
+		fields += 3
+	}
+	for idx := uint64(0); idx < fields; idx++ {
+		if _, good := readQUICVarint(cursor); !good {
+			return false
+		}
+	}
+	return true
+}
+
+// quicSealInitialPacket is the inverse of [UnmarshalQUICInitialPacket] and creates a
+// client Initial packet padded to 1200 bytes containing the given crypto data.
+func quicSealInitialPacket(dcid, scid []byte, packetNumber uint32, cryptoData []byte) []byte {
+	// create the payload consisting of a CRYPTO frame followed by padding
+	var plaintext []byte
+	plaintext = append(plaintext, 0x06, 0x00) // CRYPTO frame at offset zero
+	plaintext = appendQUICVarint(plaintext, uint64(len(cryptoData)))
+	plaintext = append(plaintext, cryptoData...)
+	const pnLength, tagLength, minSize = 4, 16, 1200
+	overhead := 7 + len(dcid) + len(scid) + 1 + 2 + pnLength + tagLength
+	if padding := minSize - overhead - len(plaintext); padding > 0 {
+		plaintext = append(plaintext, make([]byte, padding)...)
+	}
+
+	// create the header including the unprotected packet number
+	header := []byte{0xc0 | (pnLength - 1), 0x00, 0x00, 0x00, 0x01}
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, byte(len(scid)))
+	header = append(header, scid...)
+	header = append(header, 0x00) // empty token
+	header = append(header, 0x40|byte((pnLength+len(plaintext)+tagLength)>>8), byte(pnLength+len(plaintext)+tagLength))
+	pnOffset := len(header)
+	header = append(header, byte(packetNumber>>24), byte(packetNumber>>16), byte(packetNumber>>8), byte(packetNumber))
+
+	// encrypt the payload
+	key, iv, hp := quicInitialClientKeys(dcid)
+	aead := Must1(cipher.NewGCM(Must1(aes.NewCipher(key))))
+	nonce := append([]byte{}, iv...)
+	for idx := 0; idx < 4; idx++ {
+		nonce[len(nonce)-1-idx] ^= byte(packetNumber >> (8 * idx))
+	}
+	packet := aead.Seal(header, nonce, plaintext, header)
+
+	// apply header protection
+	mask := make([]byte, aes.BlockSize)
+	Must1(aes.NewCipher(hp)).Encrypt(mask, packet[pnOffset+4:pnOffset+4+16])
+	packet[0] ^= mask[0] & 0x0f
+	for idx := 0; idx < pnLength; idx++ {
+		packet[pnOffset+idx] ^= mask[1+idx]
+	}
+	return packet
+}
+
+// appendQUICVarint appends a variable-length integer as defined by RFC 9000.
+func appendQUICVarint(buffer []byte, value uint64) []byte {
+	switch {
+	case value < 1<<6:
+		return append(buffer, byte(value))
+	case value < 1<<14:
+		return append(buffer, 0x40|byte(value>>8), byte(value))
+	case value < 1<<30:
+		return append(buffer, 0x80|byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	default:
+		return append(buffer, 0xc0|byte(value>>56), byte(value>>48), byte(value>>40),
+			byte(value>>32), byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+}
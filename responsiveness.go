@@ -0,0 +1,335 @@
+package netem
+
+//
+// Latency under load (responsiveness)
+//
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The following constants define the first byte sent by the client
+// to tell the [ResponsivenessServer] what to do with a connection.
+const (
+	responsivenessLoad  = 'L'
+	responsivenessProbe = 'P'
+)
+
+// ResponsivenessServer is the server for [MeasureResponsiveness], which sends
+// bulk data using load-generating connections and echoes bytes sent using
+// probe connections. The zero value is invalid, please construct using
+// [NewResponsivenessServer].
+type ResponsivenessServer struct {
+	closed   chan any
+	listener net.Listener
+	once     sync.Once
+}
+
+// NewResponsivenessServer creates a new [ResponsivenessServer] listening on the given
+// address and TCP port. Remember to call [ResponsivenessServer.Close] when done.
+func NewResponsivenessServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	port int,
+) (*ResponsivenessServer, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	tcpAddr := &net.TCPAddr{
+		IP:   parsedIP,
+		Port: port,
+		Zone: "",
+	}
+	listener, err := stack.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	rs := &ResponsivenessServer{
+		closed:   make(chan any),
+		listener: listener,
+	}
+	go rs.acceptor(logger)
+	return rs, nil
+}
+
+// acceptor accepts connections until the server is closed.
+func (rs *ResponsivenessServer) acceptor(logger Logger) {
+	for {
+		conn, err := rs.listener.Accept()
+		if err != nil {
+			logger.Debugf("netem: ResponsivenessServer: %s", err.Error())
+			return
+		}
+		go rs.serve(conn)
+	}
+}
+
+// serve serves a load-generating or probe connection.
+func (rs *ResponsivenessServer) serve(conn net.Conn) {
+	// make sure we close the connection when the server is closed
+	done := make(chan any)
+	defer close(done)
+	go func() {
+		select {
+		case <-rs.closed:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	buffer := make([]byte, 65535)
+	if _, err := conn.Read(buffer[:1]); err != nil {
+		return
+	}
+	switch buffer[0] {
+	case responsivenessLoad:
+		if _, err := rand.Read(buffer); err != nil {
+			return
+		}
+		for {
+			if _, err := conn.Write(buffer); err != nil {
+				return
+			}
+		}
+
+	case responsivenessProbe:
+		for {
+			count, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(buffer[:count]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Close stops accepting connections and interrupts the active load and probe flows.
+func (rs *ResponsivenessServer) Close() error {
+	rs.once.Do(func() {
+		close(rs.closed)
+		rs.listener.Close()
+	})
+	return nil
+}
+
+// ResponsivenessOptions contains OPTIONAL settings for [MeasureResponsiveness]. With
+// the zero value, we load the path for five seconds using four connections.
+type ResponsivenessOptions struct {
+	// Duration is the OPTIONAL duration of the loaded phase (default: 5 s).
+	Duration time.Duration
+
+	// Flows is the OPTIONAL number of load-generating connections (default: 4).
+	Flows int
+
+	// IdleProbes is the OPTIONAL number of probes we send before generating
+	// load to measure the baseline round-trip time (default: 5).
+	IdleProbes int
+
+	// ProbeInterval is the OPTIONAL interval between probes (default: 100 ms).
+	ProbeInterval time.Duration
+}
+
+// ResponsivenessReport is the result of [MeasureResponsiveness].
+type ResponsivenessReport struct {
+	// IdleRTTs contains the round-trip times measured before generating load.
+	IdleRTTs []time.Duration
+
+	// LoadedRTTs contains the round-trip times measured while generating load.
+	LoadedRTTs []time.Duration
+
+	// ReceivedTotal is the number of bytes received by the load-generating connections.
+	ReceivedTotal int64
+
+	// LoadedDuration is the duration of the loaded phase.
+	LoadedDuration time.Duration
+}
+
+// IdleRTT returns the median of the round-trip times measured before generating load.
+func (r *ResponsivenessReport) IdleRTT() time.Duration {
+	return responsivenessMedian(r.IdleRTTs)
+}
+
+// LoadedRTT returns the median of the round-trip times measured while generating load.
+func (r *ResponsivenessReport) LoadedRTT() time.Duration {
+	return responsivenessMedian(r.LoadedRTTs)
+}
+
+// RPM returns the responsiveness under load expressed in round-trips per minute.
+func (r *ResponsivenessReport) RPM() float64 {
+	return responsivenessRPM(r.LoadedRTT())
+}
+
+// IdleRPM is like [ResponsivenessReport.RPM] but uses the idle round-trip times.
+func (r *ResponsivenessReport) IdleRPM() float64 {
+	return responsivenessRPM(r.IdleRTT())
+}
+
+// ThroughputMbps returns the goodput of the load-generating connections in Mbit/s.
+func (r *ResponsivenessReport) ThroughputMbps() float64 {
+	if r.LoadedDuration <= 0 {
+		return 0
+	}
+	return (float64(r.ReceivedTotal*8) / r.LoadedDuration.Seconds()) / (1000 * 1000)
+}
+
+// responsivenessMedian returns the median of the given samples or zero.
+func responsivenessMedian(samples []time.Duration) time.Duration {
+	if len(samples) <= 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// responsivenessRPM converts a round-trip time to round-trips per minute.
+func responsivenessRPM(rtt time.Duration) float64 {
+	if rtt <= 0 {
+		return 0
+	}
+	return float64(time.Minute) / float64(rtt)
+}
+
+// MeasureResponsiveness measures the latency under load using the given
+// [ResponsivenessServer] endpoint (e.g., 10.0.0.1:8080), which allows to
+// validate the emulation of bufferbloat using the responsiveness metric,
+// i.e., the number of round-trips per minute (RPM).
+//
+// We first send some probes on an idle network, then we open several
+// load-generating connections downloading bulk data and keep sending probes.
+// Each probe uses a new connection and its round-trip time is the average of
+// the TCP handshake time and of the time to echo a byte, thus combining
+// TCP-level and application-level pings.
+func MeasureResponsiveness(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	serverAddr string,
+	options *ResponsivenessOptions,
+) (*ResponsivenessReport, error) {
+	duration := options.Duration
+	if duration <= 0 {
+		duration = 5 * time.Second
+	}
+	flows := options.Flows
+	if flows <= 0 {
+		flows = 4
+	}
+	idleProbes := options.IdleProbes
+	if idleProbes <= 0 {
+		idleProbes = 5
+	}
+	interval := options.ProbeInterval
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	report := &ResponsivenessReport{}
+
+	// measure the baseline round-trip time
+	for idx := 0; idx < idleProbes; idx++ {
+		rtt, err := responsivenessProbeOnce(ctx, stack, serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		report.IdleRTTs = append(report.IdleRTTs, rtt)
+	}
+
+	// open the load-generating connections
+	var (
+		conns    []net.Conn
+		received atomic.Int64
+		wg       sync.WaitGroup
+	)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		wg.Wait()
+	}()
+	for idx := 0; idx < flows; idx++ {
+		conn, err := stack.DialContext(ctx, "tcp", serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+		if _, err := conn.Write([]byte{responsivenessLoad}); err != nil {
+			return nil, err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, 65535)
+			for {
+				count, err := conn.Read(buffer)
+				received.Add(int64(count))
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// send probes while the network is loaded
+	t0 := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			done = true
+		case <-ticker.C:
+			rtt, err := responsivenessProbeOnce(ctx, stack, serverAddr)
+			if err != nil {
+				return nil, err
+			}
+			report.LoadedRTTs = append(report.LoadedRTTs, rtt)
+		}
+	}
+	report.LoadedDuration = time.Since(t0)
+	report.ReceivedTotal = received.Load()
+	return report, nil
+}
+
+// responsivenessProbeOnce connects to the server and echoes a byte, returning the
+// average of the TCP handshake round-trip time and of the echo round-trip time.
+func responsivenessProbeOnce(ctx context.Context, stack UnderlyingNetwork, serverAddr string) (time.Duration, error) {
+	t0 := time.Now()
+	conn, err := stack.DialContext(ctx, "tcp", serverAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	handshakeRTT := time.Since(t0)
+
+	// make sure the context interrupts the echo
+	if deadline, okay := ctx.Deadline(); okay {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte{responsivenessProbe}); err != nil {
+		return 0, err
+	}
+	t1 := time.Now()
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return 0, err
+	}
+	buffer := make([]byte, 1)
+	if _, err := conn.Read(buffer); err != nil {
+		return 0, err
+	}
+	echoRTT := time.Since(t1)
+	return (handshakeRTT + echoRTT) / 2, nil
+}
@@ -0,0 +1,80 @@
+package netem
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMeasureResponsiveness(t *testing.T) {
+	ca := MustNewCA()
+
+	lc := &LinkConfig{
+		LeftToRightDelay: 5 * time.Millisecond,
+		RightToLeftDelay: 5 * time.Millisecond,
+	}
+
+	// measure creates a topology where the router port towards the client uses
+	// the given queue size and runs the measurement.
+	measure := func(t *testing.T, queueSize int) *ResponsivenessReport {
+		router := NewRouter(&NullLogger{})
+		client := routerTestAttachHost(t, ca, router, "10.0.0.2", &RouterPortConfig{
+			QueueSize:         queueSize,
+			RateBitsPerSecond: 10 * 1000 * 1000,
+		}, lc)
+		serverStack := routerTestAttachHost(t, ca, router, "10.0.0.1", &RouterPortConfig{}, lc)
+
+		server := Must1(NewResponsivenessServer(&NullLogger{}, serverStack, "10.0.0.1", 8080))
+		t.Cleanup(func() { server.Close() })
+
+		options := &ResponsivenessOptions{Duration: time.Second, Flows: 2}
+		report, err := MeasureResponsiveness(context.Background(), client, "10.0.0.1:8080", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("idle %s (%.0f RPM) loaded %s (%.0f RPM) throughput %.1f Mbit/s",
+			report.IdleRTT(), report.IdleRPM(), report.LoadedRTT(), report.RPM(), report.ThroughputMbps())
+		if len(report.IdleRTTs) != 5 || len(report.LoadedRTTs) <= 0 {
+			t.Fatal("unexpected number of samples")
+		}
+		if report.ThroughputMbps() <= 0 || report.ThroughputMbps() > 11 {
+			t.Fatal("unexpected throughput", report.ThroughputMbps())
+		}
+		return report
+	}
+
+	t.Run("a large queue reduces the responsiveness", func(t *testing.T) {
+		small := measure(t, 16)
+		large := measure(t, 512)
+		if large.LoadedRTT() <= small.LoadedRTT() {
+			t.Fatal("expected a larger loaded RTT with a larger queue")
+		}
+		if large.LoadedRTT() <= 4*large.IdleRTT() {
+			t.Fatal("expected bufferbloat with a large queue")
+		}
+		if large.RPM() >= small.RPM() {
+			t.Fatal("expected lower RPM with a larger queue")
+		}
+	})
+}
+
+func TestResponsivenessReport(t *testing.T) {
+	report := &ResponsivenessReport{
+		IdleRTTs:       []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond},
+		LoadedRTTs:     []time.Duration{time.Second, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond},
+		ReceivedTotal:  1000 * 1000,
+		LoadedDuration: 2 * time.Second,
+	}
+	if report.IdleRTT() != 20*time.Millisecond || report.IdleRPM() != 3000 {
+		t.Fatal("unexpected idle values", report.IdleRTT(), report.IdleRPM())
+	}
+	if report.LoadedRTT() != 300*time.Millisecond || report.RPM() != 200 {
+		t.Fatal("unexpected loaded values", report.LoadedRTT(), report.RPM())
+	}
+	if report.ThroughputMbps() != 4 {
+		t.Fatal("unexpected throughput", report.ThroughputMbps())
+	}
+	if (&ResponsivenessReport{}).RPM() != 0 {
+		t.Fatal("expected zero RPM without samples")
+	}
+}
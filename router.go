@@ -6,11 +6,56 @@ package netem
 
 import (
 	"errors"
+	"net"
 	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// RouterQueueDiscipline is the discipline used by a [RouterPort]
+// outgoing queue when the queue is full.
+type RouterQueueDiscipline int
+
+const (
+	// RouterQueueDropTail drops the incoming packet when the queue is full.
+	RouterQueueDropTail = RouterQueueDiscipline(iota)
+
+	// RouterQueueDropHead drops the oldest queued packet when the queue is full.
+	RouterQueueDropHead
 )
 
+// RouterPortConfig contains the configuration of a [RouterPort]. The
+// zero value is valid and models a fast port with a drop-tail queue.
+type RouterPortConfig struct {
+	// MTU is the OPTIONAL maximum size of the IP packets emitted by the port
+	// (default: no limit). Because we do not emulate IP fragmentation, the
+	// router drops larger packets as if they had the DF bit set and, if it has
+	// an IPv4 address (see [Router.SetIPAddress]), it sends an ICMP Fragmentation
+	// Needed message to the source, which allows the [UNetStack]'s TCP to reduce
+	// its segment size (i.e., path MTU discovery). Dropping these ICMP messages
+	// using DPI (see [DPIDropICMPFragmentationNeeded]) emulates a PMTUD black hole.
+	MTU int
+
+	// QueueDiscipline is the OPTIONAL discipline to use when the
+	// outgoing queue is full (default: [RouterQueueDropTail]).
+	QueueDiscipline RouterQueueDiscipline
+
+	// QueueSize is the OPTIONAL maximum number of packets in the
+	// outgoing queue (default: 1024 packets).
+	QueueSize int
+
+	// RateBitsPerSecond is the OPTIONAL rate at which the port emits
+	// packets. When this field is zero or negative, the port emits packets
+	// as soon as the router routes them. Otherwise, packets wait in the
+	// outgoing queue for their transmission time, thus allowing the
+	// router itself to become the bottleneck.
+	RateBitsPerSecond int64
+}
+
 // RouterPort is a port of a [Router]. The zero value is invalid, use
-// the [NewRouterPort] constructor to instantiate.
+// the [NewRouterPort] or [NewRouterPortWithConfig] constructors to instantiate.
 type RouterPort struct {
 	// closeOnce provides once semantics for the Close method
 	closeOnce sync.Once
@@ -18,13 +63,16 @@ type RouterPort struct {
 	// closed is closed when we close this port
 	closed chan any
 
+	// config is the port configuration
+	config *RouterPortConfig
+
 	// ifaceName is the interface name
 	ifaceName string
 
 	// logger is the logger to use
 	logger Logger
 
-	// outgoingMu protects outgoingQueue
+	// outgoingMu protects outgoingQueue, pacedQueue, and queueDrops
 	outgoingMu sync.Mutex
 
 	// outgoingNotify is posted each time a new packet is queued
@@ -33,24 +81,62 @@ type RouterPort struct {
 	// outgoingQueue is the outgoing queue
 	outgoingQueue [][]byte
 
+	// pacedQueue contains the packets waiting for their transmission
+	// time when the port has a configured rate
+	pacedQueue [][]byte
+
+	// pacerWakeup wakes up the pacer goroutine
+	pacerWakeup chan any
+
+	// queueDrops counts the packets dropped by the outgoing queue
+	queueDrops int64
+
 	// router is the router.
 	router *Router
 }
 
 // NewRouterPort creates a new [RouterPort] for a given [Router].
 func NewRouterPort(router *Router) *RouterPort {
-	const maxNotifications = 1024
+	return NewRouterPortWithConfig(router, &RouterPortConfig{})
+}
+
+// NewRouterPortWithConfig is like [NewRouterPort] but
+// allows to configure the port queue and rate.
+func NewRouterPortWithConfig(router *Router, config *RouterPortConfig) *RouterPort {
+	const defaultQueueSize = 1024
+	config = &RouterPortConfig{
+		MTU:               config.MTU,
+		QueueDiscipline:   config.QueueDiscipline,
+		QueueSize:         config.QueueSize,
+		RateBitsPerSecond: config.RateBitsPerSecond,
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
 	port := &RouterPort{
 		closeOnce:      sync.Once{},
 		closed:         make(chan any),
+		config:         config,
 		logger:         router.logger,
 		ifaceName:      newNICName(),
 		outgoingMu:     sync.Mutex{},
-		outgoingNotify: make(chan any, maxNotifications),
+		outgoingNotify: make(chan any, config.QueueSize),
 		outgoingQueue:  [][]byte{},
+		pacedQueue:     [][]byte{},
+		pacerWakeup:    make(chan any, 1),
+		queueDrops:     0,
 		router:         router,
 	}
 	port.logger.Debugf("netem: ifconfig %s up", port.ifaceName)
+	if config.RateBitsPerSecond > 0 {
+		port.logger.Debugf(
+			"netem: tc qdisc add dev %s root tbf rate %dbit limit %d",
+			port.ifaceName,
+			config.RateBitsPerSecond,
+			config.QueueSize,
+		)
+		go port.pacerLoop()
+	}
 	return port
 }
 
@@ -59,22 +145,117 @@ var _ NIC = &RouterPort{}
 // writeOutgoingPacket is the function a [Router] calls
 // to write an outgoing packet of this port.
 func (sp *RouterPort) writeOutgoingPacket(packet []byte) error {
-	// enqueue
-	sp.outgoingMu.Lock()
-	sp.outgoingQueue = append(sp.outgoingQueue, packet)
-	sp.outgoingMu.Unlock()
-
-	// notify
+	// honour the port-closed flag
 	select {
 	case <-sp.closed:
 		return ErrStackClosed
+	default:
+		// fallthrough
+	}
+
+	// when we're pacing, the pacer moves packets to the outgoing queue
+	if sp.config.RateBitsPerSecond > 0 {
+		sp.outgoingMu.Lock()
+		queue, enqueued := sp.enqueueLocked(sp.pacedQueue, packet)
+		sp.pacedQueue = queue
+		sp.outgoingMu.Unlock()
+		if !enqueued {
+			return ErrPacketDropped
+		}
+		select {
+		case sp.pacerWakeup <- true:
+		default:
+		}
+		return nil
+	}
+
+	defer sp.outgoingMu.Unlock()
+	sp.outgoingMu.Lock()
+	before := len(sp.outgoingQueue)
+	queue, enqueued := sp.enqueueLocked(sp.outgoingQueue, packet)
+	sp.outgoingQueue = queue
+	if !enqueued {
+		return ErrPacketDropped
+	}
+	if len(sp.outgoingQueue) <= before {
+		return nil // we replaced the head, so there's already a notification
+	}
+	return sp.notifyLocked()
+}
+
+// enqueueLocked appends the packet to the given queue honouring the configured queue
+// size and discipline. It returns the new queue and whether we enqueued the packet.
+func (sp *RouterPort) enqueueLocked(queue [][]byte, packet []byte) ([][]byte, bool) {
+	if len(queue) < sp.config.QueueSize {
+		return append(queue, packet), true
+	}
+	sp.queueDrops++
+	switch sp.config.QueueDiscipline {
+	case RouterQueueDropHead:
+		return append(queue[1:], packet), true
+	default:
+		return queue, false
+	}
+}
+
+// notifyLocked notifies the reader that the last packet in the outgoing queue
+// is available or removes such a packet when we cannot notify.
+func (sp *RouterPort) notifyLocked() error {
+	select {
 	case sp.outgoingNotify <- true:
 		return nil
 	default:
+		sp.outgoingQueue = sp.outgoingQueue[:len(sp.outgoingQueue)-1]
+		sp.queueDrops++
 		return ErrPacketDropped
 	}
 }
 
+// pacerLoop moves packets from the paced queue to the
+// outgoing queue according to their transmission time.
+func (sp *RouterPort) pacerLoop() {
+	var next time.Time
+	for {
+		select {
+		case <-sp.closed:
+			return
+		case <-sp.pacerWakeup:
+		}
+
+		for {
+			// dequeue the first packet waiting for transmission
+			sp.outgoingMu.Lock()
+			if len(sp.pacedQueue) <= 0 {
+				sp.outgoingMu.Unlock()
+				break
+			}
+			packet := sp.pacedQueue[0]
+			sp.pacedQueue = sp.pacedQueue[1:]
+			sp.outgoingMu.Unlock()
+
+			// wait for the packet transmission time
+			now := time.Now()
+			if next.Before(now) {
+				next = now
+			}
+			next = next.Add(time.Duration(int64(len(packet)) * 8 * int64(time.Second) / sp.config.RateBitsPerSecond))
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-sp.closed:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			// make the packet available to the reader
+			sp.outgoingMu.Lock()
+			sp.outgoingQueue = append(sp.outgoingQueue, packet)
+			_ = sp.notifyLocked()
+			sp.outgoingMu.Unlock()
+		}
+	}
+}
+
 // FrameAvailable implements NIC
 func (sp *RouterPort) FrameAvailable() <-chan any {
 	return sp.outgoingNotify
@@ -135,29 +316,187 @@ var ErrPacketDropped = errors.New("netem: packet was dropped")
 
 // WriteFrame implements NIC
 func (sp *RouterPort) WriteFrame(frame *Frame) error {
+	// the router forwards a copy of the packet, so we can release the frame
+	defer frame.Release()
 	return sp.router.tryRoute(frame)
 }
 
 // Router routes traffic between [RouterPort]s. The zero value of this
 // structure isn't invalid; construct using [NewRouter].
+//
+// You can connect two [Router]s using [ConnectRouters] and use
+// [Router.AddPrefixRoute] to configure static routes for reaching
+// the hosts attached to other [Router]s.
+//
+// When you assign an IPv4 address to a [Router] using [Router.SetIPAddress],
+// the router emits ICMP Time Exceeded messages for packets whose TTL
+// expires in transit, thus allowing traceroute-style measurements.
 type Router struct {
+	// conntrack is the OPTIONAL [Conntrack].
+	conntrack *Conntrack
+
+	// ipAddress is the OPTIONAL router IPv4 address.
+	ipAddress net.IP
+
 	// logger is the Logger we're using.
 	logger Logger
 
 	// mu provides mutual exclusion.
 	mu sync.Mutex
 
+	// observer is the OPTIONAL observer of the forwarded packets.
+	observer PacketObserver
+
+	// prefixes contains the prefix routes.
+	prefixes []*routerPrefixRoute
+
+	// stats contains the statistics.
+	stats RouterStats
+
+	// statsMu protects stats.
+	statsMu sync.Mutex
+
 	// table is the routing table.
 	table map[string]*RouterPort
+
+	// tracer is the OPTIONAL [Tracer].
+	tracer Tracer
+}
+
+// routerPrefixRoute is a route for an IP prefix.
+type routerPrefixRoute struct {
+	prefix *net.IPNet
+	port   *RouterPort
 }
 
 // NewRouter creates a new [Router] instance.
 func NewRouter(logger Logger) *Router {
 	return &Router{
-		logger: logger,
-		mu:     sync.Mutex{},
-		table:  map[string]*RouterPort{},
+		conntrack: nil,
+		ipAddress: nil,
+		logger:    logger,
+		mu:        sync.Mutex{},
+		observer:  nil,
+		prefixes:  []*routerPrefixRoute{},
+		stats:     RouterStats{Hosts: map[string]RouterHostStats{}},
+		statsMu:   sync.Mutex{},
+		table:     map[string]*RouterPort{},
+		tracer:    nil,
+	}
+}
+
+// ErrNotIPv4Address indicates that a string is not a valid IPv4 address.
+var ErrNotIPv4Address = errors.New("netem: not a valid IPv4 address")
+
+// SetIPAddress sets the IPv4 address that the [Router] uses as the source
+// address of the ICMP messages it generates. By default, a [Router] does not
+// have an IP address and silently drops packets whose TTL expires. Note that
+// the router does not reply to packets sent to this address, so a host
+// cannot ping the router. Remember to configure routes such that the ICMP
+// messages can reach the hosts that should receive them.
+func (r *Router) SetIPAddress(address string) error {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() == nil {
+		return ErrNotIPv4Address
+	}
+	r.logger.Debugf("netem: router address %s", address)
+	r.mu.Lock()
+	r.ipAddress = ip.To4()
+	r.mu.Unlock()
+	return nil
+}
+
+// SetPacketObserver sets the [PacketObserver] observing all the packets
+// forwarded by the [Router], which gives you a single vantage point for
+// capturing the traffic of a whole topology (e.g., using a [PCAPCapture]).
+// Passing nil disables observing packets. The [Router] does not take
+// ownership of the observer, hence you should close it yourself.
+func (r *Router) SetPacketObserver(observer PacketObserver) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	r.observer = observer
+}
+
+// getPacketObserver returns the [PacketObserver] or nil.
+func (r *Router) getPacketObserver() PacketObserver {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	return r.observer
+}
+
+// SetConntrack sets the [Conntrack] tracking the flows of the packets
+// forwarded by the [Router]. Passing nil disables connection tracking.
+func (r *Router) SetConntrack(conntrack *Conntrack) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	r.conntrack = conntrack
+}
+
+// getConntrack returns the [Conntrack] or nil.
+func (r *Router) getConntrack() *Conntrack {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	return r.conntrack
+}
+
+// SetTracer sets the [Tracer] receiving the [TraceEventRouterForward] and
+// [TraceEventRouterDrop] events. Passing nil disables tracing.
+func (r *Router) SetTracer(tracer Tracer) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	r.tracer = tracer
+}
+
+// maybeTrace emits a [TraceEvent] for the given raw packet if we have
+// a [Tracer], using the given reason for drop events.
+func (r *Router) maybeTrace(eventType TraceEventType, rawPacket []byte, reason string) {
+	r.mu.Lock()
+	tracer := r.tracer
+	r.mu.Unlock()
+	if tracer == nil {
+		return
 	}
+	ev := newTraceEventForPacket(eventType, "router", rawPacket)
+	ev.Reason = reason
+	tracer.OnTraceEvent(ev)
+}
+
+// getIPAddress returns the router IPv4 address or nil.
+func (r *Router) getIPAddress() net.IP {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	return r.ipAddress
+}
+
+// ConnectRouters creates a [RouterPort] for each [Router] and a [Link]
+// connecting the two ports, thus allowing the routers to exchange packets. The
+// left router's port is the left NIC of the [Link] and the right router's port
+// is its right NIC, so you can use config to add delay, losses, and DPI only to
+// this router-to-router hop (e.g., an international gateway). Use the returned
+// ports with [Router.AddPrefixRoute] to configure the next hop for reaching the
+// hosts attached to the other router. Closing the [Link] closes both ports.
+func ConnectRouters(
+	logger Logger,
+	left *Router,
+	right *Router,
+	config *LinkConfig,
+) (*RouterPort, *RouterPort, *Link) {
+	return ConnectRoutersWithConfig(logger, left, right, &RouterPortConfig{}, config)
+}
+
+// ConnectRoutersWithConfig is like [ConnectRouters] but uses the given [RouterPortConfig]
+// for both ports, which allows, e.g., to emulate a router-to-router hop with a smaller MTU.
+func ConnectRoutersWithConfig(
+	logger Logger,
+	left *Router,
+	right *Router,
+	portConfig *RouterPortConfig,
+	config *LinkConfig,
+) (*RouterPort, *RouterPort, *Link) {
+	leftPort := NewRouterPortWithConfig(left, portConfig)
+	rightPort := NewRouterPortWithConfig(right, portConfig)
+	link := NewLink(logger, leftPort, rightPort, config) // TAKES OWNERSHIP of the ports
+	return leftPort, rightPort, link
 }
 
 // AddRoute adds a route to the routing table.
@@ -168,21 +507,101 @@ func (r *Router) AddRoute(destIP string, destPort *RouterPort) {
 	r.mu.Unlock()
 }
 
+// RemoveRoute removes the route for the given destination IP added
+// using [Router.AddRoute]. If there is no such route, this method does nothing.
+func (r *Router) RemoveRoute(destIP string) {
+	r.logger.Debugf("netem: route del %s/32", destIP)
+	r.mu.Lock()
+	delete(r.table, destIP)
+	r.mu.Unlock()
+}
+
+// AddPrefixRoute adds a route for the given prefix (e.g., 10.0.0.0/8)
+// using the given port as the next hop. Use 0.0.0.0/0 to add a default
+// route. Routes added using [Router.AddRoute] take precedence over prefix
+// routes. When several prefix routes match, we use the most specific
+// one. Adding a route for an existing prefix replaces it.
+func (r *Router) AddPrefixRoute(prefix string, destPort *RouterPort) error {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return ErrNotIPPrefix
+	}
+	r.logger.Debugf("netem: route add %s %s", ipNet.String(), destPort.ifaceName)
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	routes := []*routerPrefixRoute{}
+	for _, route := range r.prefixes {
+		if route.prefix.String() != ipNet.String() {
+			routes = append(routes, route)
+		}
+	}
+	r.prefixes = append(routes, &routerPrefixRoute{prefix: ipNet, port: destPort})
+	return nil
+}
+
+// RemovePrefixRoute removes the route for the given prefix added using
+// [Router.AddPrefixRoute]. If there is no such route, this method does nothing.
+func (r *Router) RemovePrefixRoute(prefix string) error {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return ErrNotIPPrefix
+	}
+	r.logger.Debugf("netem: route del %s", ipNet.String())
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	routes := []*routerPrefixRoute{}
+	for _, route := range r.prefixes {
+		if route.prefix.String() != ipNet.String() {
+			routes = append(routes, route)
+		}
+	}
+	r.prefixes = routes
+	return nil
+}
+
+// lookupRoute returns the port to use for the given destination or nil.
+func (r *Router) lookupRoute(destAddr string) *RouterPort {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	if destPort := r.table[destAddr]; destPort != nil {
+		return destPort
+	}
+	ip := net.ParseIP(destAddr)
+	if ip == nil {
+		return nil
+	}
+	var (
+		bestPort *RouterPort
+		bestOnes = -1
+	)
+	for _, route := range r.prefixes {
+		if ones, _ := route.prefix.Mask.Size(); route.prefix.Contains(ip) && ones > bestOnes {
+			bestPort, bestOnes = route.port, ones
+		}
+	}
+	return bestPort
+}
+
 // tryRoute attempts to route a raw packet.
 func (r *Router) tryRoute(frame *Frame) error {
 	// parse the packet
 	packet, err := DissectPacket(frame.Payload)
 	if err != nil {
 		r.logger.Warnf("netem: tryRoute: %s", err.Error())
+		r.updateStats(func(stats *RouterStats) { stats.MalformedDrops++ })
+		r.maybeTrace(TraceEventRouterDrop, frame.Payload, "malformed")
 		return err
 	}
 
-	// check whether we should drop this packet
-	if ttl := packet.TimeToLive(); ttl <= 0 {
+	// check whether we should drop this packet because forwarding
+	// it would cause its TTL to reach zero
+	if ttl := packet.TimeToLive(); ttl <= 1 {
 		r.logger.Warn("netem: tryRoute: TTL exceeded in transit")
+		r.updateStats(func(stats *RouterStats) { stats.TTLExceededDrops++ })
+		r.maybeTrace(TraceEventRouterDrop, frame.Payload, "ttl_exceeded")
+		r.maybeSendTimeExceeded(packet, frame.Payload)
 		return ErrPacketDropped
 	}
-	packet.DecrementTimeToLive()
 
 	// check whether we should spoof packets
 	if frame.Flags&FrameFlagSpoof != 0 {
@@ -194,20 +613,142 @@ func (r *Router) tryRoute(frame *Frame) error {
 
 	// figure out the interface where to emit the packet
 	destAddr := packet.DestinationIPAddress()
-	r.mu.Lock()
-	destPort := r.table[destAddr]
-	r.mu.Unlock()
+	destPort := r.lookupRoute(destAddr)
 	if destPort == nil {
 		r.logger.Warnf("netem: tryRoute: %s: no route to host", destAddr)
+		r.updateStats(func(stats *RouterStats) { stats.NoRouteDrops++ })
+		r.maybeTrace(TraceEventRouterDrop, frame.Payload, "no_route")
 		return ErrPacketDropped
 	}
 
-	// serialize a TCP or UDP packet while ignoring other protocols
-	rawOutput, err := packet.Serialize()
+	// check whether the packet is too large for the outgoing port
+	if mtu := destPort.config.MTU; mtu > 0 && len(frame.Payload) > mtu {
+		r.logger.Warnf("netem: tryRoute: %s: packet size %d exceeds MTU %d", destAddr, len(frame.Payload), mtu)
+		r.updateStats(func(stats *RouterStats) { stats.MTUExceededDrops++ })
+		r.maybeTrace(TraceEventRouterDrop, frame.Payload, "mtu_exceeded")
+		r.maybeSendFragmentationNeeded(packet, frame.Payload, mtu)
+		return ErrPacketDropped
+	}
+
+	// decrement the TTL of a copy of the packet, such that we do not modify
+	// the frame payload, which other parties (e.g., a PCAP dumper) may still be
+	// using, and without re-encoding the packet, which is expensive
+	rawOutput, err := packet.ForwardedCopy(frame.Payload)
 	if err != nil {
 		r.logger.Warnf("netem: tryRoute: %s", err.Error())
+		r.updateStats(func(stats *RouterStats) { stats.MalformedDrops++ })
+		r.maybeTrace(TraceEventRouterDrop, frame.Payload, "malformed")
 		return err
 	}
 
-	return destPort.writeOutgoingPacket(rawOutput)
+	if err := destPort.writeOutgoingPacket(rawOutput); err != nil {
+		if errors.Is(err, ErrPacketDropped) {
+			r.updateStats(func(stats *RouterStats) { stats.QueueFullDrops++ })
+			r.maybeTrace(TraceEventRouterDrop, rawOutput, "queue_full")
+		}
+		return err
+	}
+	r.countRoutedBytes(packet.SourceIPAddress(), destAddr, len(rawOutput))
+	if conntrack := r.getConntrack(); conntrack != nil {
+		conntrack.track(packet, len(rawOutput))
+	}
+	r.maybeTrace(TraceEventRouterForward, rawOutput, "")
+	if observer := r.getPacketObserver(); observer != nil {
+		observer.ObservePacket(rawOutput)
+	}
+	return nil
+}
+
+// maybeSendTimeExceeded routes an ICMP Time Exceeded message to the source
+// of the given packet (see [Router.maybeSendICMPv4Error]).
+func (r *Router) maybeSendTimeExceeded(packet *DissectedPacket, rawPacket []byte) {
+	typeCode := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded)
+	r.maybeSendICMPv4Error(packet, rawPacket, typeCode, 0)
+}
+
+// maybeSendFragmentationNeeded routes an ICMP Fragmentation Needed message
+// containing the given next-hop MTU to the source of the given packet (see
+// [Router.maybeSendICMPv4Error]).
+func (r *Router) maybeSendFragmentationNeeded(packet *DissectedPacket, rawPacket []byte, mtu int) {
+	typeCode := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded)
+	r.maybeSendICMPv4Error(packet, rawPacket, typeCode, uint16(mtu))
+}
+
+// maybeSendICMPv4Error routes an ICMP error message with the given type and code
+// to the source of the given packet, provided that the router has an IPv4 address
+// and the packet is not itself an ICMP error message (see RFC 1812 Sect. 4.3.2.7).
+func (r *Router) maybeSendICMPv4Error(
+	packet *DissectedPacket, rawPacket []byte, typeCode layers.ICMPv4TypeCode, nextHopMTU uint16) {
+	ipAddress := r.getIPAddress()
+	if ipAddress == nil {
+		return
+	}
+	ipv4, good := packet.IP.(*layers.IPv4)
+	if !good {
+		return
+	}
+	if packet.ICMPv4 != nil && !routerIsICMPv4Query(packet.ICMPv4.TypeCode.Type()) {
+		return
+	}
+	rawICMP, err := newICMPv4Error(ipAddress, ipv4.SrcIP, typeCode, nextHopMTU, rawPacket)
+	if err != nil {
+		r.logger.Warnf("netem: tryRoute: %s", err.Error())
+		return
+	}
+	_ = r.tryRoute(NewFrame(rawICMP))
+}
+
+// routerIsICMPv4Query returns whether the given ICMPv4 type is a query
+// message (e.g., echo request) rather than an error message.
+func routerIsICMPv4Query(t uint8) bool {
+	switch t {
+	case layers.ICMPv4TypeEchoReply,
+		layers.ICMPv4TypeEchoRequest,
+		layers.ICMPv4TypeTimestampRequest,
+		layers.ICMPv4TypeTimestampReply,
+		layers.ICMPv4TypeInfoRequest,
+		layers.ICMPv4TypeInfoReply,
+		layers.ICMPv4TypeAddressMaskRequest,
+		layers.ICMPv4TypeAddressMaskReply:
+		return true
+	default:
+		return false
+	}
+}
+
+// newICMPv4Error constructs a serialized IPv4 packet containing an ICMP
+// error message with the given type and code that quotes the original IP
+// header and the first eight bytes of the original datagram's payload (see
+// RFC 792). The nextHopMTU is only meaningful for Fragmentation Needed
+// messages (see RFC 1191) and should otherwise be zero.
+func newICMPv4Error(
+	source, dest net.IP, typeCode layers.ICMPv4TypeCode, nextHopMTU uint16, rawPacket []byte) ([]byte, error) {
+	if len(rawPacket) < 20 {
+		return nil, ErrDissectShortPacket
+	}
+	quoteLength := int(rawPacket[0]&0x0f)*4 + 8
+	if quoteLength > len(rawPacket) {
+		quoteLength = len(rawPacket)
+	}
+	ipv4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    source,
+		DstIP:    dest,
+	}
+	icmp := &layers.ICMPv4{
+		TypeCode: typeCode,
+		Seq:      nextHopMTU, // the second half of the rest of the header
+	}
+	payload := gopacket.Payload(rawPacket[:quoteLength])
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts, ipv4, icmp, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,521 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestRouterChain(t *testing.T) {
+	ca := MustNewCA()
+
+	// we create the following topology where the gateway link uses DPI:
+	//
+	//	10.0.1.2 <-> routerA <-> (gateway) <-> routerB <-> {10.0.2.2, 10.0.2.3}
+	routerA := NewRouter(&NullLogger{})
+	routerB := NewRouter(&NullLogger{})
+	dpi := NewDPIEngine(&NullLogger{})
+	dpi.AddRule(&DPIDropTrafficForServerEndpoint{
+		Logger:          &NullLogger{},
+		ServerIPAddress: "10.0.2.3",
+		ServerPort:      53,
+		ServerProtocol:  layers.IPProtocolUDP,
+	})
+	portA, portB, gateway := ConnectRouters(&NullLogger{}, routerA, routerB, &LinkConfig{DPIEngine: dpi})
+	t.Cleanup(func() { gateway.Close() })
+	Must0(routerA.AddPrefixRoute("10.0.2.0/24", portA))
+	Must0(routerB.AddPrefixRoute("0.0.0.0/0", portB))
+
+	client := routerTestAttachHost(t, ca, routerA, "10.0.1.2", &RouterPortConfig{}, &LinkConfig{})
+	for _, address := range []string{"10.0.2.2", "10.0.2.3"} {
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.2.4")
+		host := routerTestAttachHost(t, ca, routerB, address, &RouterPortConfig{}, &LinkConfig{})
+		server := Must1(NewDNSServer(&NullLogger{}, host, address, config))
+		t.Cleanup(func() { server.Close() })
+	}
+
+	t.Run("we can reach hosts attached to another router", func(t *testing.T) {
+		query := NewDNSRequestA("www.example.com")
+		resp, err := DNSRoundTrip(context.Background(), client, "10.0.2.2", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := DNSParseResponse(query, resp); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("the DPI on the gateway link applies", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		query := NewDNSRequestA("www.example.com")
+		_, err := DNSRoundTrip(ctx, client, "10.0.2.3", query)
+		var nerr net.Error
+		if !errors.Is(err, context.DeadlineExceeded) && !(errors.As(err, &nerr) && nerr.Timeout()) {
+			t.Fatal("expected a timeout, got", err)
+		}
+	})
+
+	t.Run("the routers count the bytes routed for each host", func(t *testing.T) {
+		stats := routerA.Stats()
+		if stats.Hosts["10.0.1.2"].BytesSent <= 0 {
+			t.Fatal("expected the client to have sent bytes")
+		}
+		if stats.Hosts["10.0.2.2"].BytesReceived <= 0 {
+			t.Fatal("expected the server to have received bytes")
+		}
+	})
+
+	t.Run("we can capture the packets forwarded by a router", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "capture.pcap")
+		capture := NewPCAPCapture(filename, &NullLogger{})
+		routerA.SetPacketObserver(capture)
+		query := NewDNSRequestA("www.example.com")
+		_, err := DNSRoundTrip(context.Background(), client, "10.0.2.2", query)
+		routerA.SetPacketObserver(nil)
+		capture.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filep := Must1(os.Open(filename))
+		defer filep.Close()
+		reader := Must1(pcapgo.NewReader(filep))
+		var count int
+		for {
+			_, _, err := reader.ReadPacketData()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			count++
+		}
+		if count != 2 {
+			t.Fatal("expected to capture the query and the response, got", count)
+		}
+	})
+
+	t.Run("RemovePrefixRoute removes prefix routes", func(t *testing.T) {
+		router := NewRouter(&NullLogger{})
+		port := NewRouterPort(router)
+		defer port.Close()
+		Must0(router.AddPrefixRoute("10.1.0.0/16", port))
+		if router.lookupRoute("10.1.2.3") != port {
+			t.Fatal("expected a route")
+		}
+		Must0(router.RemovePrefixRoute("10.1.0.0/16"))
+		if router.lookupRoute("10.1.2.3") != nil {
+			t.Fatal("expected no route")
+		}
+		if err := router.RemovePrefixRoute("10.1.0.0"); !errors.Is(err, ErrNotIPPrefix) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("AddPrefixRoute rejects invalid prefixes", func(t *testing.T) {
+		if err := routerA.AddPrefixRoute("10.0.2.0", portA); !errors.Is(err, ErrNotIPPrefix) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestRouterTraceroute(t *testing.T) {
+	ca := MustNewCA()
+
+	// we create the following topology:
+	//
+	//	10.0.1.2 <-> routerA (10.0.1.1) <-> routerB (10.0.2.1) <-> 10.0.2.2
+	routerA := NewRouter(&NullLogger{})
+	Must0(routerA.SetIPAddress("10.0.1.1"))
+	routerB := NewRouter(&NullLogger{})
+	Must0(routerB.SetIPAddress("10.0.2.1"))
+	portA, portB, gateway := ConnectRouters(&NullLogger{}, routerA, routerB, &LinkConfig{})
+	t.Cleanup(func() { gateway.Close() })
+	Must0(routerA.AddPrefixRoute("10.0.2.0/24", portA))
+	Must0(routerB.AddPrefixRoute("0.0.0.0/0", portB))
+
+	client := routerTestAttachHost(t, ca, routerA, "10.0.1.2", &RouterPortConfig{}, &LinkConfig{})
+	_ = routerTestAttachHost(t, ca, routerB, "10.0.2.2", &RouterPortConfig{}, &LinkConfig{})
+
+	conn := Must1(client.ListenICMP())
+	t.Cleanup(func() { conn.Close() })
+
+	// probe sends an echo request with the given TTL and returns the
+	// address and the type of the ICMP message we receive in response.
+	probe := func(t *testing.T, ttl int) (string, uint8) {
+		if err := conn.SetTTL(ttl); err != nil {
+			t.Fatal(err)
+		}
+		echo := &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+			Id:       17,
+			Seq:      uint16(ttl),
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{ComputeChecksums: true}
+		Must0(gopacket.SerializeLayers(buf, opts, echo, gopacket.Payload("traceroute")))
+		if _, err := conn.WriteTo(buf.Bytes(), &net.IPAddr{IP: net.ParseIP("10.0.2.2")}); err != nil {
+			t.Fatal(err)
+		}
+		Must0(conn.SetReadDeadline(time.Now().Add(time.Second)))
+		for {
+			data := make([]byte, 1500)
+			count, addr, err := conn.ReadFrom(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet := gopacket.NewPacket(data[:count], layers.LayerTypeICMPv4, gopacket.Default)
+			icmp, good := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+			if !good {
+				t.Fatal("cannot parse ICMPv4 message")
+			}
+			if icmp.TypeCode.Type() == layers.ICMPv4TypeEchoRequest {
+				continue // skip our own requests looping back
+			}
+			return addr.String(), icmp.TypeCode.Type()
+		}
+	}
+
+	expectations := []struct {
+		ttl         int
+		expectAddr  string
+		expectType  uint8
+		description string
+	}{{
+		ttl:         1,
+		expectAddr:  "10.0.1.1",
+		expectType:  layers.ICMPv4TypeTimeExceeded,
+		description: "the first router sends time exceeded",
+	}, {
+		ttl:         2,
+		expectAddr:  "10.0.2.1",
+		expectType:  layers.ICMPv4TypeTimeExceeded,
+		description: "the second router sends time exceeded",
+	}, {
+		ttl:         3,
+		expectAddr:  "10.0.2.2",
+		expectType:  layers.ICMPv4TypeEchoReply,
+		description: "the destination sends an echo reply",
+	}}
+
+	for _, expect := range expectations {
+		t.Run(expect.description, func(t *testing.T) {
+			addr, icmpType := probe(t, expect.ttl)
+			if addr != expect.expectAddr {
+				t.Fatal("expected", expect.expectAddr, "got", addr)
+			}
+			if icmpType != expect.expectType {
+				t.Fatal("expected", expect.expectType, "got", icmpType)
+			}
+		})
+	}
+
+	t.Run("the routers count the packets whose TTL expired", func(t *testing.T) {
+		for _, router := range []*Router{routerA, routerB} {
+			if stats := router.Stats(); stats.TTLExceededDrops != 1 {
+				t.Fatal("expected one drop, got", stats.TTLExceededDrops)
+			}
+		}
+	})
+
+	t.Run("SetIPAddress rejects invalid addresses", func(t *testing.T) {
+		if err := routerA.SetIPAddress("::1"); !errors.Is(err, ErrNotIPv4Address) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestRouterPortQueue(t *testing.T) {
+	packet := func(id byte) []byte {
+		return append(make([]byte, 99), id)
+	}
+
+	t.Run("drop-tail drops the incoming packet when full", func(t *testing.T) {
+		port := NewRouterPortWithConfig(NewRouter(&NullLogger{}), &RouterPortConfig{QueueSize: 2})
+		defer port.Close()
+		for id := byte(0); id < 3; id++ {
+			err := port.writeOutgoingPacket(packet(id))
+			if id < 2 && err != nil {
+				t.Fatal(err)
+			}
+			if id == 2 && !errors.Is(err, ErrPacketDropped) {
+				t.Fatal("expected ErrPacketDropped, got", err)
+			}
+		}
+		expect := RouterPortStats{QueueDepth: 2, QueueDrops: 1}
+		if diff := cmp.Diff(expect, port.Stats()); diff != "" {
+			t.Fatal(diff)
+		}
+		frame := Must1(port.ReadFrameNonblocking())
+		if frame.Payload[99] != 0 {
+			t.Fatal("expected the first packet")
+		}
+	})
+
+	t.Run("drop-head drops the oldest packet when full", func(t *testing.T) {
+		port := NewRouterPortWithConfig(NewRouter(&NullLogger{}), &RouterPortConfig{
+			QueueDiscipline: RouterQueueDropHead,
+			QueueSize:       2,
+		})
+		defer port.Close()
+		for id := byte(0); id < 3; id++ {
+			if err := port.writeOutgoingPacket(packet(id)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expect := RouterPortStats{QueueDepth: 2, QueueDrops: 1}
+		if diff := cmp.Diff(expect, port.Stats()); diff != "" {
+			t.Fatal(diff)
+		}
+		for expectID := byte(1); expectID < 3; expectID++ {
+			<-port.FrameAvailable()
+			frame := Must1(port.ReadFrameNonblocking())
+			if frame.Payload[99] != expectID {
+				t.Fatal("expected", expectID, "got", frame.Payload[99])
+			}
+		}
+	})
+
+	t.Run("the configured rate paces the outgoing packets", func(t *testing.T) {
+		port := NewRouterPortWithConfig(NewRouter(&NullLogger{}), &RouterPortConfig{
+			RateBitsPerSecond: 8000, // 100 bytes every 100 ms
+		})
+		defer port.Close()
+		t0 := time.Now()
+		for id := byte(0); id < 3; id++ {
+			if err := port.writeOutgoingPacket(packet(id)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := port.ReadFrameNonblocking(); !errors.Is(err, ErrNoPacket) {
+			t.Fatal("expected ErrNoPacket, got", err)
+		}
+		for expectID := byte(0); expectID < 3; expectID++ {
+			<-port.FrameAvailable()
+			frame := Must1(port.ReadFrameNonblocking())
+			if frame.Payload[99] != expectID {
+				t.Fatal("expected", expectID, "got", frame.Payload[99])
+			}
+		}
+		if elapsed := time.Since(t0); elapsed < 250*time.Millisecond {
+			t.Fatal("packets were not paced", elapsed)
+		}
+	})
+}
+
+func TestRouterForwardedCopy(t *testing.T) {
+	serialize := func(layers ...gopacket.SerializableLayer) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		Must0(gopacket.SerializeLayers(buf, opts, layers...))
+		return buf.Bytes()
+	}
+
+	newIPv4 := func(ttl uint8) []byte {
+		ipv4 := &layers.IPv4{
+			Version:  4,
+			TTL:      ttl,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    net.IPv4(10, 0, 0, 2),
+			DstIP:    net.IPv4(10, 0, 0, 1),
+		}
+		tcp := &layers.TCP{SrcPort: 54321, DstPort: 443, Seq: 17, ACK: true, PSH: true, Window: 1024}
+		tcp.SetNetworkLayerForChecksum(ipv4)
+		return serialize(ipv4, tcp, gopacket.Payload("abcdef"))
+	}
+
+	newIPv6 := func(hopLimit uint8) []byte {
+		ipv6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   hopLimit,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      net.ParseIP("2001:db8::2"),
+			DstIP:      net.ParseIP("2001:db8::1"),
+		}
+		udp := &layers.UDP{SrcPort: 54321, DstPort: 53}
+		udp.SetNetworkLayerForChecksum(ipv6)
+		return serialize(ipv6, udp, gopacket.Payload("abcdef"))
+	}
+
+	for _, ttl := range []uint8{2, 64, 255} {
+		t.Run("IPv4", func(t *testing.T) {
+			rawPacket := newIPv4(ttl)
+			original := append([]byte{}, rawPacket...)
+			packet := Must1(DissectPacket(rawPacket))
+			output := Must1(packet.ForwardedCopy(rawPacket))
+			if diff := cmp.Diff(newIPv4(ttl-1), output); diff != "" {
+				t.Fatal(diff)
+			}
+			if diff := cmp.Diff(original, rawPacket); diff != "" {
+				t.Fatal("modified the original packet", diff)
+			}
+		})
+
+		t.Run("IPv6", func(t *testing.T) {
+			rawPacket := newIPv6(ttl)
+			packet := Must1(DissectPacket(rawPacket))
+			output := Must1(packet.ForwardedCopy(rawPacket))
+			if diff := cmp.Diff(newIPv6(ttl-1), output); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+
+	t.Run("we reject packets without a supported transport layer", func(t *testing.T) {
+		packet := &DissectedPacket{IP: &layers.IPv4{}}
+		if _, err := packet.ForwardedCopy(newIPv4(64)); !errors.Is(err, ErrDissectTransport) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestRouterDrops(t *testing.T) {
+	tracer := &TraceRecorder{}
+	router := NewRouter(&NullLogger{})
+	router.SetTracer(tracer)
+	port := NewRouterPortWithConfig(router, &RouterPortConfig{QueueSize: 1})
+	defer port.Close()
+	router.AddRoute("10.0.0.1", port)
+
+	newPacket := func(dest net.IP) []byte {
+		return fuzzSerializeIPv4(net.IPv4(10, 0, 0, 2), dest, &layers.UDP{SrcPort: 5353, DstPort: 53}, []byte("abc"))
+	}
+	expired := newPacket(net.IPv4(10, 0, 0, 1))
+	expired[8] = 1 // TTL
+
+	for _, raw := range [][]byte{
+		{0x45, 0x00},                      // malformed
+		newPacket(net.IPv4(10, 0, 0, 99)), // no route
+		expired,                           // TTL exceeded
+		newPacket(net.IPv4(10, 0, 0, 1)),  // enqueued
+		newPacket(net.IPv4(10, 0, 0, 1)),  // queue full
+	} {
+		_ = port.WriteFrame(NewFrame(raw))
+	}
+
+	expect := RouterStats{
+		Hosts: map[string]RouterHostStats{
+			"10.0.0.1": {BytesReceived: int64(len(expired))},
+			"10.0.0.2": {BytesSent: int64(len(expired))},
+		},
+		MalformedDrops:   1,
+		NoRouteDrops:     1,
+		QueueFullDrops:   1,
+		TTLExceededDrops: 1,
+	}
+	stats := router.Stats()
+	if diff := cmp.Diff(expect, stats); diff != "" {
+		t.Fatal(diff)
+	}
+	if stats.Drops() != 4 {
+		t.Fatal("expected four drops, got", stats.Drops())
+	}
+
+	reasons := []string{}
+	for _, ev := range tracer.Events() {
+		if ev.Type == TraceEventRouterDrop {
+			reasons = append(reasons, ev.Reason)
+		}
+	}
+	if diff := cmp.Diff([]string{"malformed", "no_route", "ttl_exceeded", "queue_full"}, reasons); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestRouterPathMTUDiscovery(t *testing.T) {
+	// newTopology creates the following topology, where the hop between
+	// the routers has a 1280 bytes MTU and the hosts have a 1500 bytes MTU:
+	//
+	//	10.0.1.2 <-> routerA (10.0.1.1) <=> routerB (10.0.2.1) <-> 10.0.2.2
+	//
+	// When dpi is not nil, we use it on the client link.
+	newTopology := func(t *testing.T, dpi *DPIEngine) (*Router, *UNetStack, *UNetStack) {
+		ca := MustNewCA()
+		routerA := NewRouter(&NullLogger{})
+		Must0(routerA.SetIPAddress("10.0.1.1"))
+		routerB := NewRouter(&NullLogger{})
+		Must0(routerB.SetIPAddress("10.0.2.1"))
+		portA, portB, gateway := ConnectRoutersWithConfig(
+			&NullLogger{}, routerA, routerB, &RouterPortConfig{MTU: 1280}, &LinkConfig{})
+		t.Cleanup(func() { gateway.Close() })
+		Must0(routerA.AddPrefixRoute("10.0.2.0/24", portA))
+		Must0(routerB.AddPrefixRoute("0.0.0.0/0", portB))
+		client := routerTestAttachHost(t, ca, routerA, "10.0.1.2", &RouterPortConfig{}, &LinkConfig{DPIEngine: dpi})
+		server := routerTestAttachHost(t, ca, routerB, "10.0.2.2", &RouterPortConfig{}, &LinkConfig{})
+		return routerA, client, server
+	}
+
+	// upload sends data from the client to the server and returns the
+	// number of bytes received by the server before the timeout.
+	upload := func(t *testing.T, client, server *UNetStack, timeout time.Duration) int64 {
+		listener := Must1(server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 2, 2), Port: 80}))
+		t.Cleanup(func() { listener.Close() })
+		received := make(chan int64, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				received <- 0
+				return
+			}
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(timeout))
+			count, _ := io.Copy(io.Discard, conn)
+			received <- count
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		conn := Must1(client.DialContext(ctx, "tcp", "10.0.2.2:80"))
+		defer conn.Close()
+		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+		_, _ = conn.Write(make([]byte, 1<<16))
+		conn.Close()
+		return <-received
+	}
+
+	t.Run("the client adapts its segment size", func(t *testing.T) {
+		router, client, server := newTopology(t, nil)
+		if count := upload(t, client, server, 5*time.Second); count != 1<<16 {
+			t.Fatal("expected to upload all the data, got", count)
+		}
+		if stats := router.Stats(); stats.MTUExceededDrops <= 0 {
+			t.Fatal("expected MTU drops, got", stats.MTUExceededDrops)
+		}
+	})
+
+	t.Run("dropping the ICMP messages creates a black hole", func(t *testing.T) {
+		dpi := NewDPIEngine(&NullLogger{})
+		dpi.AddRule(&DPIDropICMPFragmentationNeeded{Logger: &NullLogger{}})
+		_, client, server := newTopology(t, dpi)
+		if count := upload(t, client, server, time.Second); count >= 1<<16 {
+			t.Fatal("expected the upload to stall, got", count)
+		}
+		if stats := dpi.Stats(); stats.Rules[0].Packets <= 0 {
+			t.Fatal("expected the DPI to drop ICMP messages")
+		}
+	})
+}
+
+// routerTestAttachHost creates a host trusting the given CA and attaches it to the
+// given router using a port and a link with the given configs.
+func routerTestAttachHost(
+	t *testing.T, ca *CA, router *Router, address string, pc *RouterPortConfig, lc *LinkConfig) *UNetStack {
+	host := Must1(NewUNetStack(&NullLogger{}, 1500, address, ca, "0.0.0.0"))
+	port := NewRouterPortWithConfig(router, pc)
+	link := NewLink(&NullLogger{}, host, port, lc)
+	t.Cleanup(func() { link.Close() })
+	router.AddRoute(address, port)
+	return host
+}
@@ -0,0 +1,101 @@
+package netem
+
+//
+// Router statistics
+//
+
+// RouterStats contains [Router] statistics. Use [RouterPort.Stats]
+// to obtain the statistics of each port's outgoing queue.
+type RouterStats struct {
+	// Hosts contains per-host byte counters indexed by IP address.
+	Hosts map[string]RouterHostStats `json:"hosts"`
+
+	// MTUExceededDrops counts the packets dropped because they were larger
+	// than the MTU of the destination [RouterPort].
+	MTUExceededDrops int64 `json:"mtu_exceeded_drops"`
+
+	// MalformedDrops counts the packets dropped because we could not parse them.
+	MalformedDrops int64 `json:"malformed_drops"`
+
+	// NoRouteDrops counts the packets dropped because there was no route.
+	NoRouteDrops int64 `json:"no_route_drops"`
+
+	// QueueFullDrops counts the packets dropped because the outgoing queue
+	// of the destination [RouterPort] was full. See [RouterPort.Stats] for
+	// the drops of each port, which also include the packets that the
+	// [RouterQueueDropHead] discipline discarded to make room.
+	QueueFullDrops int64 `json:"queue_full_drops"`
+
+	// TTLExceededDrops counts the packets dropped because their TTL expired.
+	TTLExceededDrops int64 `json:"ttl_exceeded_drops"`
+}
+
+// RouterHostStats contains the byte counters of a host.
+type RouterHostStats struct {
+	// BytesReceived counts the bytes routed to the host.
+	BytesReceived int64 `json:"bytes_received"`
+
+	// BytesSent counts the bytes routed from the host.
+	BytesSent int64 `json:"bytes_sent"`
+}
+
+// RouterPortStats contains [RouterPort] statistics.
+type RouterPortStats struct {
+	// QueueDepth is the number of packets currently queued.
+	QueueDepth int `json:"queue_depth"`
+
+	// QueueDrops counts the packets dropped by the outgoing queue.
+	QueueDrops int64 `json:"queue_drops"`
+}
+
+// Stats returns a snapshot of the [RouterPort] statistics.
+func (sp *RouterPort) Stats() RouterPortStats {
+	defer sp.outgoingMu.Unlock()
+	sp.outgoingMu.Lock()
+	return RouterPortStats{
+		QueueDepth: len(sp.outgoingQueue) + len(sp.pacedQueue),
+		QueueDrops: sp.queueDrops,
+	}
+}
+
+// Stats returns a snapshot of the [Router] statistics.
+func (r *Router) Stats() RouterStats {
+	defer r.statsMu.Unlock()
+	r.statsMu.Lock()
+	stats := RouterStats{
+		Hosts:            map[string]RouterHostStats{},
+		MTUExceededDrops: r.stats.MTUExceededDrops,
+		MalformedDrops:   r.stats.MalformedDrops,
+		NoRouteDrops:     r.stats.NoRouteDrops,
+		QueueFullDrops:   r.stats.QueueFullDrops,
+		TTLExceededDrops: r.stats.TTLExceededDrops,
+	}
+	for address, hostStats := range r.stats.Hosts {
+		stats.Hosts[address] = hostStats
+	}
+	return stats
+}
+
+// updateStats calls the given function to update the statistics.
+func (r *Router) updateStats(fx func(stats *RouterStats)) {
+	defer r.statsMu.Unlock()
+	r.statsMu.Lock()
+	fx(&r.stats)
+}
+
+// Drops returns the total number of packets dropped by the [Router].
+func (rs RouterStats) Drops() int64 {
+	return rs.MTUExceededDrops + rs.MalformedDrops + rs.NoRouteDrops + rs.QueueFullDrops + rs.TTLExceededDrops
+}
+
+// countRoutedBytes updates the per-host byte counters.
+func (r *Router) countRoutedBytes(source, dest string, count int) {
+	r.updateStats(func(stats *RouterStats) {
+		sourceStats := stats.Hosts[source]
+		sourceStats.BytesSent += int64(count)
+		stats.Hosts[source] = sourceStats
+		destStats := stats.Hosts[dest]
+		destStats.BytesReceived += int64(count)
+		stats.Hosts[dest] = destStats
+	})
+}
@@ -0,0 +1,120 @@
+package netem
+
+//
+// Slow HTTP responses
+//
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// SlowHTTPConfig configures [NewSlowHTTPHandler]. The zero value is valid
+// and writes the body in 1024 bytes chunks without slowing it down.
+type SlowHTTPConfig struct {
+	// ChunkSize is the OPTIONAL size of each body chunk (default: 1024 bytes).
+	ChunkSize int
+
+	// FirstByteDelay is the OPTIONAL delay before calling the wrapped
+	// handler, which delays sending the response headers.
+	FirstByteDelay time.Duration
+
+	// Rate is the OPTIONAL rate at which we write the body in bit/s. By
+	// default, we write the body as fast as possible.
+	Rate int64
+
+	// Stall is the OPTIONAL pause after writing each chunk, which allows
+	// to emulate a server dripping the body with long stalls.
+	Stall time.Duration
+}
+
+// chunkSize returns the configured chunk size or the default.
+func (c *SlowHTTPConfig) chunkSize() int {
+	if c.ChunkSize > 0 {
+		return c.ChunkSize
+	}
+	return 1024
+}
+
+// pause returns how long to wait after writing a chunk of the given size.
+func (c *SlowHTTPConfig) pause(size int) time.Duration {
+	pause := c.Stall
+	if c.Rate > 0 {
+		if interval := time.Duration(float64(size*8) / float64(c.Rate) * float64(time.Second)); interval > pause {
+			pause = interval
+		}
+	}
+	return pause
+}
+
+// NewSlowHTTPHandler wraps the given [http.Handler] such that it sends the
+// response headers after the configured delay and writes the response body
+// in chunks at the configured rate and/or with stalls between chunks, flushing
+// after each chunk. This allows testing client read timeouts and throttling
+// detection heuristics at the application layer. Each write fails when the
+// request context is done, e.g., because the client closed the connection.
+func NewSlowHTTPHandler(handler http.Handler, config *SlowHTTPConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slowHTTPSleep(r.Context(), config.FirstByteDelay) {
+			return
+		}
+		handler.ServeHTTP(&slowHTTPResponseWriter{
+			ResponseWriter: w,
+			config:         config,
+			ctx:            r.Context(),
+		}, r)
+	})
+}
+
+// slowHTTPResponseWriter is the [http.ResponseWriter] used by [NewSlowHTTPHandler].
+type slowHTTPResponseWriter struct {
+	http.ResponseWriter
+	config *SlowHTTPConfig
+	ctx    context.Context
+}
+
+// Write implements http.ResponseWriter.
+func (w *slowHTTPResponseWriter) Write(data []byte) (int, error) {
+	var total int
+	for len(data) > 0 {
+		size := w.config.chunkSize()
+		if size > len(data) {
+			size = len(data)
+		}
+		count, err := w.ResponseWriter.Write(data[:size])
+		total += count
+		if err != nil {
+			return total, err
+		}
+		if flusher, good := w.ResponseWriter.(http.Flusher); good {
+			flusher.Flush()
+		}
+		data = data[size:]
+		if !slowHTTPSleep(w.ctx, w.config.pause(size)) {
+			return total, w.ctx.Err()
+		}
+	}
+	return total, nil
+}
+
+// Unwrap allows [http.ResponseController] to access the wrapped writer.
+func (w *slowHTTPResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// slowHTTPSleep sleeps for the given duration and returns false if
+// the context is done before the duration elapses.
+func slowHTTPSleep(ctx context.Context, duration time.Duration) bool {
+	if duration <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,94 @@
+package netem
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSlowHTTPHandler(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	body := bytes.Repeat([]byte("A"), 4096)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+
+	// serve runs the handler with the given config on the given port.
+	serve := func(t *testing.T, port int, config *SlowHTTPConfig) string {
+		ns := &Net{Stack: topology.Server}
+		listener := Must1(ns.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: port}))
+		server := &http.Server{Handler: NewSlowHTTPHandler(inner, config)}
+		t.Cleanup(func() { server.Close() })
+		go server.Serve(listener)
+		return (&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: port}).String()
+	}
+
+	t.Run("we write the body at the configured rate", func(t *testing.T) {
+		// at 64 kbit/s, each 1024 bytes chunk takes 128 ms
+		address := serve(t, 8080, &SlowHTTPConfig{Rate: 64 * 1000})
+		client := &http.Client{Transport: NewHTTPTransport(topology.Client)}
+		t0 := time.Now()
+		resp, err := client.Get("http://" + address + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data := Must1(io.ReadAll(resp.Body))
+		elapsed := time.Since(t0)
+		t.Log("elapsed", elapsed)
+		if !bytes.Equal(data, body) {
+			t.Fatal("unexpected body")
+		}
+		if elapsed < 380*time.Millisecond || elapsed > 2*time.Second {
+			t.Fatal("unexpected elapsed time", elapsed)
+		}
+	})
+
+	t.Run("we stall between chunks", func(t *testing.T) {
+		address := serve(t, 8081, &SlowHTTPConfig{ChunkSize: 100, Stall: time.Second})
+		client := &http.Client{Transport: NewHTTPTransport(topology.Client)}
+		resp, err := client.Get("http://" + address + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		buffer := make([]byte, 4096)
+		count, err := resp.Body.Read(buffer)
+		if err != nil || count != 100 {
+			t.Fatal("unexpected first read", count, err)
+		}
+
+		// the second chunk arrives after the stall
+		timeout := time.NewTimer(250 * time.Millisecond)
+		defer timeout.Stop()
+		readch := make(chan error, 1)
+		go func() {
+			_, err := resp.Body.Read(buffer)
+			readch <- err
+		}()
+		select {
+		case err := <-readch:
+			t.Fatal("expected the read to block", err)
+		case <-timeout.C:
+		}
+	})
+
+	t.Run("we delay the response headers", func(t *testing.T) {
+		address := serve(t, 8082, &SlowHTTPConfig{FirstByteDelay: time.Second})
+		client := &http.Client{
+			Timeout:   250 * time.Millisecond,
+			Transport: NewHTTPTransport(topology.Client),
+		}
+		_, err := client.Get("http://" + address + "/")
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package netem
+
+//
+// Socket options
+//
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// SocketOptions allows to set socket options that affect the emitted packets. The
+// conns returned by [UNetStack.DialContext], by the Accept method of the listeners
+// returned by [UNetStack.ListenTCP], and by [UNetStack.ListenUDP] implement this
+// interface, therefore you can use a type assertion to set socket options.
+type SocketOptions interface {
+	// SetTTL sets the IPv4 TTL or the IPv6 hop limit of the emitted packets.
+	SetTTL(ttl int) error
+
+	// SetTOS sets the IPv4 TOS or the IPv6 traffic class of the emitted packets. Note that
+	// the DSCP is the upper six bits of this field, so DSCP X corresponds to TOS X<<2.
+	SetTOS(tos int) error
+
+	// SetKeepAlive enables or disables TCP keepalives. This method fails with
+	// [syscall.ENOPROTOOPT] for UDP sockets, as do the other keepalive methods.
+	SetKeepAlive(enable bool) error
+
+	// SetKeepAlivePeriod sets the idle time before the first keepalive
+	// probe as well as the interval between subsequent probes.
+	SetKeepAlivePeriod(period time.Duration) error
+
+	// SetKeepAliveCount sets the number of unacknowledged keepalive
+	// probes after which we consider the connection dead.
+	SetKeepAliveCount(count int) error
+
+	// SetTCPSegmentation controls how we split the data written into TCP segments (see
+	// [TCPSegmentation]), where a nil config restores the default behavior. This method
+	// fails with [syscall.ENOPROTOOPT] for UDP sockets.
+	SetTCPSegmentation(config *TCPSegmentation) error
+}
+
+// TCPSegmentation controls how a TCP conn splits the data passed to Write into
+// segments, which allows to deterministically generate the segmentation used by
+// some circumvention techniques (e.g., splitting the TLS ClientHello). We implement
+// segmentation by writing each chunk separately, which produces distinct segments
+// because the stack disables Nagle's algorithm by default (see [UNetStackOptions]),
+// provided that the congestion and receive windows allow sending each chunk. The
+// zero value is valid and does not change the default behavior.
+type TCPSegmentation struct {
+	// Offsets contains the OPTIONAL offsets, relative to the beginning of the stream
+	// of written bytes, at which we end a segment. For example, 5 splits the TLS
+	// record header from the first handshake message and 7 splits the ClientHello
+	// two bytes after the beginning of the handshake message.
+	Offsets []int64
+
+	// SegmentSize is the OPTIONAL maximum number of bytes we send in each segment.
+	SegmentSize int
+}
+
+// valid returns whether the segmentation config is valid.
+func (ts *TCPSegmentation) valid() bool {
+	for _, offset := range ts.Offsets {
+		if offset < 0 {
+			return false
+		}
+	}
+	return ts.SegmentSize >= 0
+}
+
+// split splits the data written at the given offset of the stream into chunks.
+func (ts *TCPSegmentation) split(offset int64, data []byte) (chunks [][]byte) {
+	for len(data) > 0 {
+		size := int64(len(data))
+		if ts.SegmentSize > 0 && size > int64(ts.SegmentSize) {
+			size = int64(ts.SegmentSize)
+		}
+		for _, boundary := range ts.Offsets {
+			if distance := boundary - offset; distance > 0 && distance < size {
+				size = distance
+			}
+		}
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+		offset += size
+	}
+	return
+}
+
+// unetSocketOptions implements [SocketOptions] for a gvisor endpoint.
+type unetSocketOptions struct {
+	// ep is the OPTIONAL endpoint: when nil, all operations fail.
+	ep tcpip.Endpoint
+
+	// segmentation is the OPTIONAL TCP segmentation config.
+	segmentation atomic.Pointer[TCPSegmentation]
+
+	// tcp indicates whether this is a TCP endpoint.
+	tcp bool
+}
+
+var _ SocketOptions = &unetSocketOptions{}
+
+// SetTTL implements SocketOptions
+func (so *unetSocketOptions) SetTTL(ttl int) error {
+	if ttl < 1 || ttl > 255 {
+		return syscall.EINVAL
+	}
+	option := tcpip.IPv4TTLOption
+	if so.isIPv6() {
+		option = tcpip.IPv6HopLimitOption
+	}
+	return so.setSockOptInt(option, ttl)
+}
+
+// SetTOS implements SocketOptions
+func (so *unetSocketOptions) SetTOS(tos int) error {
+	if tos < 0 || tos > 255 {
+		return syscall.EINVAL
+	}
+	option := tcpip.IPv4TOSOption
+	if so.isIPv6() {
+		option = tcpip.IPv6TrafficClassOption
+	}
+	return so.setSockOptInt(option, tos)
+}
+
+// SetKeepAlive implements SocketOptions
+func (so *unetSocketOptions) SetKeepAlive(enable bool) error {
+	if so.ep == nil || !so.tcp {
+		return syscall.ENOPROTOOPT
+	}
+	so.ep.SocketOptions().SetKeepAlive(enable)
+	return nil
+}
+
+// SetKeepAlivePeriod implements SocketOptions
+func (so *unetSocketOptions) SetKeepAlivePeriod(period time.Duration) error {
+	if so.ep == nil || !so.tcp {
+		return syscall.ENOPROTOOPT
+	}
+	if period <= 0 {
+		return syscall.EINVAL
+	}
+	idle := tcpip.KeepaliveIdleOption(period)
+	if err := so.ep.SetSockOpt(&idle); err != nil {
+		return MapUNetError(errors.New(err.String()))
+	}
+	interval := tcpip.KeepaliveIntervalOption(period)
+	if err := so.ep.SetSockOpt(&interval); err != nil {
+		return MapUNetError(errors.New(err.String()))
+	}
+	return nil
+}
+
+// SetKeepAliveCount implements SocketOptions
+func (so *unetSocketOptions) SetKeepAliveCount(count int) error {
+	if so.ep == nil || !so.tcp {
+		return syscall.ENOPROTOOPT
+	}
+	if count <= 0 {
+		return syscall.EINVAL
+	}
+	return so.setSockOptInt(tcpip.KeepaliveCountOption, count)
+}
+
+// SetTCPSegmentation implements SocketOptions
+func (so *unetSocketOptions) SetTCPSegmentation(config *TCPSegmentation) error {
+	if so.ep == nil || !so.tcp {
+		return syscall.ENOPROTOOPT
+	}
+	if config != nil && !config.valid() {
+		return syscall.EINVAL
+	}
+	so.segmentation.Store(config)
+	return nil
+}
+
+// isIPv6 returns whether the endpoint uses IPv6.
+func (so *unetSocketOptions) isIPv6() bool {
+	if so.ep == nil {
+		return false
+	}
+	addr, err := so.ep.GetLocalAddress()
+	return err == nil && addr.Addr.Len() == 16
+}
+
+// setSockOptInt sets an integer socket option.
+func (so *unetSocketOptions) setSockOptInt(option tcpip.SockOptInt, value int) error {
+	if so.ep == nil {
+		return syscall.ENOPROTOOPT
+	}
+	if err := so.ep.SetSockOptInt(option, value); err != nil {
+		return MapUNetError(errors.New(err.String()))
+	}
+	return nil
+}
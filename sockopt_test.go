@@ -0,0 +1,201 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// sockoptRecorder is a [LinkNICWrapper] recording the IPv4 packets
+// emitted by the stack owning the wrapped NIC.
+type sockoptRecorder struct {
+	mu      sync.Mutex
+	packets []*layers.IPv4
+}
+
+// WrapNIC implements LinkNICWrapper.
+func (sr *sockoptRecorder) WrapNIC(nic NIC) NIC {
+	return &sockoptRecorderNIC{NIC: nic, sr: sr}
+}
+
+// find returns the recorded packets using the given transport protocol.
+func (sr *sockoptRecorder) find(proto layers.IPProtocol) (out []*layers.IPv4) {
+	defer sr.mu.Unlock()
+	sr.mu.Lock()
+	for _, packet := range sr.packets {
+		if packet.Protocol == proto {
+			out = append(out, packet)
+		}
+	}
+	return
+}
+
+type sockoptRecorderNIC struct {
+	NIC
+	sr *sockoptRecorder
+}
+
+func (nic *sockoptRecorderNIC) ReadFrameNonblocking() (*Frame, error) {
+	frame, err := nic.NIC.ReadFrameNonblocking()
+	if err == nil {
+		packet := gopacket.NewPacket(frame.Payload, layers.LayerTypeIPv4, gopacket.Default)
+		if ipv4, good := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); good {
+			nic.sr.mu.Lock()
+			nic.sr.packets = append(nic.sr.packets, ipv4)
+			nic.sr.mu.Unlock()
+		}
+	}
+	return frame, err
+}
+
+func TestSocketOptions(t *testing.T) {
+	newTopology := func() (*PPPTopology, *sockoptRecorder) {
+		recorder := &sockoptRecorder{}
+		lc := &LinkConfig{LeftNICWrapper: recorder}
+		return MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, lc), recorder
+	}
+
+	t.Run("we honor the TTL and the TOS for TCP", func(t *testing.T) {
+		topology, recorder := newTopology()
+		defer topology.Close()
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		defer conn.Close()
+		sockopts := conn.(SocketOptions)
+		Must0(sockopts.SetTTL(7))
+		Must0(sockopts.SetTOS(46 << 2)) // DSCP EF
+		Must1(conn.Write([]byte("abc")))
+
+		serverConn := Must1(listener.Accept())
+		defer serverConn.Close()
+		Must0(serverConn.SetDeadline(time.Now().Add(5 * time.Second)))
+		Must1(serverConn.Read(make([]byte, 8)))
+
+		var found bool
+		for _, packet := range recorder.find(layers.IPProtocolTCP) {
+			segment := gopacket.NewPacket(packet.Payload, layers.LayerTypeTCP, gopacket.Default)
+			if tcp, good := segment.Layer(layers.LayerTypeTCP).(*layers.TCP); good && len(tcp.Payload) > 0 {
+				if packet.TTL != 7 || packet.TOS != 46<<2 {
+					t.Fatal("unexpected TTL or TOS", packet.TTL, packet.TOS)
+				}
+				found = true
+			}
+		}
+		if !found {
+			t.Fatal("did not find the packet containing data")
+		}
+	})
+
+	t.Run("we honor the TTL and the TOS for UDP", func(t *testing.T) {
+		topology, recorder := newTopology()
+		defer topology.Close()
+		conn := Must1(topology.Client.DialContext(context.Background(), "udp", "10.0.0.1:53"))
+		defer conn.Close()
+		sockopts := conn.(SocketOptions)
+		Must0(sockopts.SetTTL(3))
+		Must0(sockopts.SetTOS(8 << 2))
+		Must1(conn.Write([]byte("abc")))
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(recorder.find(layers.IPProtocolUDP)) <= 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		packets := recorder.find(layers.IPProtocolUDP)
+		if len(packets) != 1 {
+			t.Fatal("expected one packet, got", len(packets))
+		}
+		if packets[0].TTL != 3 || packets[0].TOS != 8<<2 {
+			t.Fatal("unexpected TTL or TOS", packets[0].TTL, packets[0].TOS)
+		}
+	})
+
+	t.Run("we send TCP keepalives when enabled", func(t *testing.T) {
+		topology, recorder := newTopology()
+		defer topology.Close()
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		defer conn.Close()
+		serverConn := Must1(listener.Accept())
+		defer serverConn.Close()
+
+		sockopts := conn.(SocketOptions)
+		Must0(sockopts.SetKeepAlivePeriod(100 * time.Millisecond))
+		Must0(sockopts.SetKeepAliveCount(5))
+		Must0(sockopts.SetKeepAlive(true))
+
+		before := len(recorder.find(layers.IPProtocolTCP))
+		time.Sleep(time.Second)
+		if after := len(recorder.find(layers.IPProtocolTCP)); after-before < 3 {
+			t.Fatal("expected keepalives, got", after-before, "packets")
+		}
+	})
+
+	t.Run("we split the written data into segments", func(t *testing.T) {
+		topology, recorder := newTopology()
+		defer topology.Close()
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		defer conn.Close()
+		sockopts := conn.(SocketOptions)
+		if err := sockopts.SetTCPSegmentation(&TCPSegmentation{SegmentSize: -1}); !errors.Is(err, syscall.EINVAL) {
+			t.Fatal("unexpected error", err)
+		}
+		Must0(sockopts.SetTCPSegmentation(&TCPSegmentation{Offsets: []int64{5, 7}, SegmentSize: 8}))
+		Must1(conn.Write([]byte("\x16\x03\x01")))
+		Must1(conn.Write([]byte("abcdefghijklmnopq")))
+
+		serverConn := Must1(listener.Accept())
+		defer serverConn.Close()
+		Must0(serverConn.SetDeadline(time.Now().Add(5 * time.Second)))
+		Must1(io.ReadFull(serverConn, make([]byte, 20)))
+
+		var sizes []int
+		for _, packet := range recorder.find(layers.IPProtocolTCP) {
+			segment := gopacket.NewPacket(packet.Payload, layers.LayerTypeTCP, gopacket.Default)
+			if tcp, good := segment.Layer(layers.LayerTypeTCP).(*layers.TCP); good && len(tcp.Payload) > 0 {
+				sizes = append(sizes, len(tcp.Payload))
+			}
+		}
+		if diff := cmp.Diff([]int{3, 2, 2, 8, 5}, sizes); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("we reject invalid values and unsupported options", func(t *testing.T) {
+		topology, _ := newTopology()
+		defer topology.Close()
+		conn := Must1(topology.Client.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)}))
+		defer conn.Close()
+		sockopts := conn.(SocketOptions)
+		if err := sockopts.SetTTL(0); !errors.Is(err, syscall.EINVAL) {
+			t.Fatal("unexpected error", err)
+		}
+		if err := sockopts.SetTOS(256); !errors.Is(err, syscall.EINVAL) {
+			t.Fatal("unexpected error", err)
+		}
+		if err := sockopts.SetKeepAlive(true); !errors.Is(err, syscall.ENOPROTOOPT) {
+			t.Fatal("unexpected error", err)
+		}
+		if err := sockopts.SetTCPSegmentation(&TCPSegmentation{}); !errors.Is(err, syscall.ENOPROTOOPT) {
+			t.Fatal("unexpected error", err)
+		}
+		if err := sockopts.SetTTL(64); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
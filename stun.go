@@ -0,0 +1,570 @@
+package netem
+
+//
+// STUN server and NAT behavior discovery (RFC 5389 and RFC 5780)
+//
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// STUNServerConfig contains the [STUNServer] configuration. The zero value
+// is valid and creates a server that only supports binding requests.
+type STUNServerConfig struct {
+	// AlternateIPAddress is the OPTIONAL address of AlternateStack. When both
+	// this field and AlternateStack are set, the server also supports the
+	// RFC 5780 CHANGE-REQUEST attribute and advertises its OTHER-ADDRESS,
+	// which is required to perform NAT behavior discovery.
+	AlternateIPAddress string
+
+	// AlternatePort is the OPTIONAL alternate UDP port (default: Port+1).
+	AlternatePort int
+
+	// AlternateStack is the OPTIONAL stack owning AlternateIPAddress.
+	AlternateStack UnderlyingNetwork
+
+	// Port is the OPTIONAL UDP port (default: 3478).
+	Port int
+}
+
+// STUNServer is a STUN server. The zero value is invalid, please construct
+// using [NewSTUNServer].
+type STUNServer struct {
+	closed chan any
+	conns  map[stunServerSocket]UDPLikeConn
+	once   sync.Once
+	other  *net.UDPAddr
+	wg     *sync.WaitGroup
+}
+
+// stunServerSocket identifies a socket of the [STUNServer] using whether
+// it uses the alternate IP address and whether it uses the alternate port.
+type stunServerSocket struct {
+	alternateIP   bool
+	alternatePort bool
+}
+
+// NewSTUNServer creates a new [STUNServer] listening on the given IP address
+// of the given stack. Remember to call [STUNServer.Close] when done.
+func NewSTUNServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *STUNServerConfig,
+) (*STUNServer, error) {
+	port := config.Port
+	if port <= 0 {
+		port = 3478
+	}
+	alternatePort := config.AlternatePort
+	if alternatePort <= 0 {
+		alternatePort = port + 1
+	}
+
+	ss := &STUNServer{
+		closed: make(chan any),
+		conns:  map[stunServerSocket]UDPLikeConn{},
+		once:   sync.Once{},
+		other:  nil,
+		wg:     &sync.WaitGroup{},
+	}
+	listen := func(socket stunServerSocket, stack UnderlyingNetwork, ipAddress string) error {
+		parsedIP := net.ParseIP(ipAddress)
+		if parsedIP == nil {
+			return ErrNotIPAddress
+		}
+		udpAddr := &net.UDPAddr{IP: parsedIP, Port: port}
+		if socket.alternatePort {
+			udpAddr.Port = alternatePort
+		}
+		pconn, err := stack.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+		ss.conns[socket] = pconn
+		return nil
+	}
+
+	sockets := []stunServerSocket{{false, false}, {false, true}}
+	if config.AlternateStack != nil && config.AlternateIPAddress != "" {
+		sockets = append(sockets, stunServerSocket{true, false}, stunServerSocket{true, true})
+		ss.other = &net.UDPAddr{IP: net.ParseIP(config.AlternateIPAddress), Port: alternatePort}
+	}
+	for _, socket := range sockets {
+		stack, ipAddress := stack, ipAddress
+		if socket.alternateIP {
+			stack, ipAddress = config.AlternateStack, config.AlternateIPAddress
+		}
+		if err := listen(socket, stack, ipAddress); err != nil {
+			ss.Close()
+			return nil, err
+		}
+	}
+
+	for socket := range ss.conns {
+		ss.wg.Add(1)
+		go ss.serve(logger, socket)
+	}
+	return ss, nil
+}
+
+// Close stops the server.
+func (ss *STUNServer) Close() error {
+	ss.once.Do(func() {
+		close(ss.closed)
+		for _, pconn := range ss.conns {
+			pconn.Close()
+		}
+		ss.wg.Wait()
+	})
+	return nil
+}
+
+// serve serves the requests received by the given socket.
+func (ss *STUNServer) serve(logger Logger, socket stunServerSocket) {
+	defer ss.wg.Done()
+	pconn := ss.conns[socket]
+	buffer := make([]byte, 1500)
+	for {
+		count, addr, err := pconn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-ss.closed:
+			default:
+				logger.Warnf("netem: STUNServer: %s", err.Error())
+			}
+			return
+		}
+		req, err := stunParseMessage(buffer[:count])
+		if err != nil || req.messageType != stunBindingRequest {
+			logger.Debugf("netem: STUNServer: ignoring invalid request from %s", addr.String())
+			continue
+		}
+		udpAddr, good := addr.(*net.UDPAddr)
+		if !good {
+			continue
+		}
+
+		// honour the CHANGE-REQUEST attribute, if we can
+		from := socket
+		if value, found := req.attributes[stunAttrChangeRequest]; found && len(value) == 4 {
+			flags := binary.BigEndian.Uint32(value)
+			from.alternateIP = from.alternateIP != (flags&stunChangeIP != 0)
+			from.alternatePort = from.alternatePort != (flags&stunChangePort != 0)
+		}
+		out, found := ss.conns[from]
+		if !found {
+			logger.Debugf("netem: STUNServer: cannot honour CHANGE-REQUEST from %s", addr.String())
+			continue
+		}
+
+		resp := &stunMessage{
+			attributes:    map[uint16][]byte{},
+			messageType:   stunBindingSuccessResponse,
+			transactionID: req.transactionID,
+		}
+		resp.attributes[stunAttrXORMappedAddress] = stunEncodeAddress(udpAddr, true)
+		resp.attributes[stunAttrResponseOrigin] = stunEncodeAddress(out.LocalAddr().(*net.UDPAddr), false)
+		if ss.other != nil {
+			resp.attributes[stunAttrOtherAddress] = stunEncodeAddress(ss.other, false)
+		}
+		_, _ = out.WriteTo(resp.serialize(), addr)
+	}
+}
+
+// NATMapping describes how a NAT maps internal endpoints to external
+// endpoints according to RFC 4787 and RFC 5780.
+type NATMapping string
+
+// NATFiltering describes which external endpoints a NAT allows to send
+// packets to an internal endpoint according to RFC 4787 and RFC 5780.
+type NATFiltering string
+
+const (
+	// NATMappingNone means there is no NAT because the mapped endpoint
+	// is equal to the local endpoint.
+	NATMappingNone = NATMapping("none")
+
+	// NATMappingEndpointIndependent means the NAT reuses the same mapping
+	// regardless of the destination endpoint.
+	NATMappingEndpointIndependent = NATMapping("endpoint-independent")
+
+	// NATMappingAddressDependent means the NAT reuses the same mapping
+	// only for the same destination address.
+	NATMappingAddressDependent = NATMapping("address-dependent")
+
+	// NATMappingAddressAndPortDependent means the NAT reuses the same
+	// mapping only for the same destination endpoint.
+	NATMappingAddressAndPortDependent = NATMapping("address-and-port-dependent")
+
+	// NATMappingUnknown means that we could not determine the mapping,
+	// typically because the server does not have an alternate address.
+	NATMappingUnknown = NATMapping("unknown")
+
+	// NATFilteringEndpointIndependent means the NAT accepts packets from
+	// any external endpoint once there is a mapping.
+	NATFilteringEndpointIndependent = NATFiltering("endpoint-independent")
+
+	// NATFilteringAddressDependent means the NAT only accepts packets from
+	// the addresses to which the internal endpoint sent packets.
+	NATFilteringAddressDependent = NATFiltering("address-dependent")
+
+	// NATFilteringAddressAndPortDependent means the NAT only accepts packets
+	// from the endpoints to which the internal endpoint sent packets.
+	NATFilteringAddressAndPortDependent = NATFiltering("address-and-port-dependent")
+
+	// NATFilteringUnknown means that we could not determine the filtering,
+	// typically because the server does not have an alternate address.
+	NATFilteringUnknown = NATFiltering("unknown")
+)
+
+// NATBehavior is the result of [DiscoverNATBehavior].
+type NATBehavior struct {
+	// Filtering is the discovered filtering behavior.
+	Filtering NATFiltering
+
+	// LocalAddress is the local endpoint we used for discovery.
+	LocalAddress string
+
+	// MappedAddress is the endpoint seen by the STUN server.
+	MappedAddress string
+
+	// Mapping is the discovered mapping behavior.
+	Mapping NATMapping
+}
+
+// STUNOptions contains OPTIONAL settings for the STUN client functions. With
+// the zero value, we retransmit each request twice before giving up.
+type STUNOptions struct {
+	// Retries is the OPTIONAL number of times we retransmit each request
+	// before concluding that we will not receive a response (default: 2).
+	Retries int
+
+	// Timeout is the OPTIONAL time to wait for each response (default: 500ms).
+	Timeout time.Duration
+}
+
+// retries returns the configured retries or the default.
+func (options *STUNOptions) retries() int {
+	if options.Retries > 0 {
+		return options.Retries
+	}
+	return 2
+}
+
+// timeout returns the configured timeout or the default.
+func (options *STUNOptions) timeout() time.Duration {
+	if options.Timeout > 0 {
+		return options.Timeout
+	}
+	return 500 * time.Millisecond
+}
+
+// ErrSTUNNoResponse indicates that the STUN server did not respond.
+var ErrSTUNNoResponse = errors.New("netem: stun: no response")
+
+// ErrSTUNInvalidResponse indicates that the STUN response is invalid.
+var ErrSTUNInvalidResponse = errors.New("netem: stun: invalid response")
+
+// STUNMappedAddress sends a binding request to the given STUN server endpoint
+// using the given [net.PacketConn] and returns the mapped endpoint. Because
+// the caller owns the conn, it can reuse the mapping for hole punching.
+func STUNMappedAddress(
+	ctx context.Context,
+	pconn net.PacketConn,
+	serverAddr string,
+	options *STUNOptions,
+) (*net.UDPAddr, error) {
+	raddr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	result, err := stunBinding(ctx, pconn, raddr, 0, options)
+	if err != nil {
+		return nil, err
+	}
+	return result.mapped, nil
+}
+
+// DiscoverNATBehavior uses the STUN server at the given endpoint to discover
+// the mapping and filtering behavior of the NATs between the stack and the
+// server using the RFC 5780 procedure. Determining the mapping and the filtering
+// requires a [STUNServer] configured with an alternate address. Because we
+// cannot distinguish between a filtering NAT and packet loss, make sure the
+// path does not lose packets or increase the retries.
+func DiscoverNATBehavior(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	serverAddr string,
+	options *STUNOptions,
+) (*NATBehavior, error) {
+	raddr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	pconn, err := stack.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer pconn.Close()
+
+	// test I: obtain the mapped address
+	first, err := stunBinding(ctx, pconn, raddr, 0, options)
+	if err != nil {
+		return nil, err
+	}
+	behavior := &NATBehavior{
+		Filtering:     NATFilteringUnknown,
+		LocalAddress:  pconn.LocalAddr().String(),
+		MappedAddress: first.mapped.String(),
+		Mapping:       NATMappingUnknown,
+	}
+	if ipAddr, ok := stack.(interface{ IPAddress() string }); ok {
+		local := &net.UDPAddr{IP: net.ParseIP(ipAddr.IPAddress()), Port: pconn.LocalAddr().(*net.UDPAddr).Port}
+		behavior.LocalAddress = local.String()
+		if local.String() == first.mapped.String() {
+			behavior.Mapping = NATMappingNone
+		}
+	}
+	if first.other == nil {
+		return behavior, nil
+	}
+
+	// mapping tests II and III (RFC 5780 Sect. 4.3)
+	if behavior.Mapping != NATMappingNone {
+		second, err := stunBinding(ctx, pconn, &net.UDPAddr{IP: first.other.IP, Port: raddr.Port}, 0, options)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case second.mapped.String() == first.mapped.String():
+			behavior.Mapping = NATMappingEndpointIndependent
+		default:
+			third, err := stunBinding(ctx, pconn, first.other, 0, options)
+			if err != nil {
+				return nil, err
+			}
+			if third.mapped.String() == second.mapped.String() {
+				behavior.Mapping = NATMappingAddressDependent
+			} else {
+				behavior.Mapping = NATMappingAddressAndPortDependent
+			}
+		}
+	}
+
+	// filtering tests II and III (RFC 5780 Sect. 4.4)
+	_, err = stunBinding(ctx, pconn, raddr, stunChangeIP|stunChangePort, options)
+	switch {
+	case err == nil:
+		behavior.Filtering = NATFilteringEndpointIndependent
+		return behavior, nil
+	case !errors.Is(err, ErrSTUNNoResponse):
+		return nil, err
+	}
+	_, err = stunBinding(ctx, pconn, raddr, stunChangePort, options)
+	switch {
+	case err == nil:
+		behavior.Filtering = NATFilteringAddressDependent
+	case errors.Is(err, ErrSTUNNoResponse):
+		behavior.Filtering = NATFilteringAddressAndPortDependent
+	default:
+		return nil, err
+	}
+	return behavior, nil
+}
+
+// stunBindingResult is the result of stunBinding.
+type stunBindingResult struct {
+	mapped *net.UDPAddr
+	other  *net.UDPAddr
+}
+
+// stunBinding sends a binding request with the given CHANGE-REQUEST flags
+// and waits for the response, retransmitting the request as needed.
+func stunBinding(
+	ctx context.Context,
+	pconn net.PacketConn,
+	raddr *net.UDPAddr,
+	changeFlags uint32,
+	options *STUNOptions,
+) (*stunBindingResult, error) {
+	req := &stunMessage{
+		attributes:    map[uint16][]byte{},
+		messageType:   stunBindingRequest,
+		transactionID: [12]byte{},
+	}
+	if _, err := rand.Read(req.transactionID[:]); err != nil {
+		return nil, err
+	}
+	if changeFlags != 0 {
+		req.attributes[stunAttrChangeRequest] = binary.BigEndian.AppendUint32(nil, changeFlags)
+	}
+	rawReq := req.serialize()
+
+	buffer := make([]byte, 1500)
+	for attempt := 0; attempt <= options.retries(); attempt++ {
+		if _, err := pconn.WriteTo(rawReq, raddr); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(options.timeout())
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		pconn.SetReadDeadline(deadline)
+		for {
+			count, _, err := pconn.ReadFrom(buffer)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break // retransmit
+				}
+				return nil, err
+			}
+			resp, err := stunParseMessage(buffer[:count])
+			if err != nil || resp.transactionID != req.transactionID {
+				continue // ignore stale or unrelated responses
+			}
+			pconn.SetReadDeadline(time.Time{})
+			if resp.messageType != stunBindingSuccessResponse {
+				return nil, ErrSTUNInvalidResponse
+			}
+			result := &stunBindingResult{}
+			if value, found := resp.attributes[stunAttrXORMappedAddress]; found {
+				result.mapped = stunDecodeAddress(value, true)
+			}
+			if result.mapped == nil {
+				return nil, ErrSTUNInvalidResponse
+			}
+			if value, found := resp.attributes[stunAttrOtherAddress]; found {
+				result.other = stunDecodeAddress(value, false)
+			}
+			return result, nil
+		}
+	}
+	pconn.SetReadDeadline(time.Time{})
+	return nil, ErrSTUNNoResponse
+}
+
+const (
+	stunBindingRequest         = 0x0001
+	stunBindingSuccessResponse = 0x0101
+	stunMagicCookie            = 0x2112a442
+	stunHeaderSize             = 20
+
+	stunAttrChangeRequest    = 0x0003
+	stunAttrXORMappedAddress = 0x0020
+	stunAttrResponseOrigin   = 0x802b
+	stunAttrOtherAddress     = 0x802c
+
+	stunChangeIP   = 0x04
+	stunChangePort = 0x02
+)
+
+// stunMessage is a STUN message.
+type stunMessage struct {
+	attributes    map[uint16][]byte
+	messageType   uint16
+	transactionID [12]byte
+}
+
+// errSTUNInvalidMessage indicates that we cannot parse a STUN message.
+var errSTUNInvalidMessage = errors.New("netem: stun: invalid message")
+
+// stunParseMessage parses a STUN message.
+func stunParseMessage(data []byte) (*stunMessage, error) {
+	if len(data) < stunHeaderSize || binary.BigEndian.Uint32(data[4:8]) != stunMagicCookie {
+		return nil, errSTUNInvalidMessage
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if len(data) != stunHeaderSize+length {
+		return nil, errSTUNInvalidMessage
+	}
+	msg := &stunMessage{
+		attributes:  map[uint16][]byte{},
+		messageType: binary.BigEndian.Uint16(data[0:2]),
+	}
+	copy(msg.transactionID[:], data[8:20])
+	data = data[stunHeaderSize:]
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errSTUNInvalidMessage
+		}
+		attrType := binary.BigEndian.Uint16(data[0:2])
+		attrLength := int(binary.BigEndian.Uint16(data[2:4]))
+		padded := (attrLength + 3) &^ 3
+		if len(data) < 4+padded {
+			return nil, errSTUNInvalidMessage
+		}
+		msg.attributes[attrType] = bytes.Clone(data[4 : 4+attrLength])
+		data = data[4+padded:]
+	}
+	return msg, nil
+}
+
+// serialize serializes a STUN message.
+func (msg *stunMessage) serialize() []byte {
+	var body []byte
+	for _, attrType := range []uint16{
+		stunAttrChangeRequest,
+		stunAttrXORMappedAddress,
+		stunAttrResponseOrigin,
+		stunAttrOtherAddress,
+	} {
+		value, found := msg.attributes[attrType]
+		if !found {
+			continue
+		}
+		body = binary.BigEndian.AppendUint16(body, attrType)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(value)))
+		body = append(body, value...)
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+	}
+	out := binary.BigEndian.AppendUint16(nil, msg.messageType)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(body)))
+	out = binary.BigEndian.AppendUint32(out, stunMagicCookie)
+	out = append(out, msg.transactionID[:]...)
+	return append(out, body...)
+}
+
+// stunEncodeAddress encodes an IPv4 address attribute, possibly using XOR.
+func stunEncodeAddress(addr *net.UDPAddr, xor bool) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	port := uint16(addr.Port)
+	ipValue := binary.BigEndian.Uint32(ip)
+	if xor {
+		port ^= stunMagicCookie >> 16
+		ipValue ^= stunMagicCookie
+	}
+	out := []byte{0, 0x01} // reserved, IPv4 family
+	out = binary.BigEndian.AppendUint16(out, port)
+	return binary.BigEndian.AppendUint32(out, ipValue)
+}
+
+// stunDecodeAddress decodes an IPv4 address attribute, possibly using XOR.
+func stunDecodeAddress(value []byte, xor bool) *net.UDPAddr {
+	if len(value) != 8 || value[1] != 0x01 {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:4])
+	ipValue := binary.BigEndian.Uint32(value[4:8])
+	if xor {
+		port ^= stunMagicCookie >> 16
+		ipValue ^= stunMagicCookie
+	}
+	return &net.UDPAddr{IP: binary.BigEndian.AppendUint32(nil, ipValue), Port: int(port)}
+}
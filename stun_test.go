@@ -0,0 +1,115 @@
+package netem
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// stunTestDropFromPort is a [DPIRule] dropping the traffic from a port.
+type stunTestDropFromPort uint16
+
+// Filter implements DPIRule
+func (r stunTestDropFromPort) Filter(direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	if packet.SourcePort() != uint16(r) {
+		return nil, false
+	}
+	return &DPIPolicy{Flags: FrameFlagDrop}, true
+}
+
+func TestSTUN(t *testing.T) {
+	// newTopology creates a topology with a client and a STUN server with two
+	// hosts, where the DPI rules apply to the client link.
+	newTopology := func(rules ...DPIRule) (*StarTopology, *UNetStack, *STUNServer) {
+		dpiEngine := NewDPIEngine(&NullLogger{})
+		for _, rule := range rules {
+			dpiEngine.AddRule(rule)
+		}
+		topology := MustNewStarTopology(&NullLogger{})
+		client := Must1(topology.AddHost("10.0.0.2", "0.0.0.0", &LinkConfig{DPIEngine: dpiEngine}))
+		primary := Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+		alternate := Must1(topology.AddHost("10.0.0.3", "0.0.0.0", &LinkConfig{}))
+		server := Must1(NewSTUNServer(&NullLogger{}, primary, "10.0.0.1", &STUNServerConfig{
+			AlternateIPAddress: "10.0.0.3",
+			AlternateStack:     alternate,
+		}))
+		return topology, client, server
+	}
+
+	t.Run("we obtain the mapped address", func(t *testing.T) {
+		topology, client, server := newTopology()
+		defer topology.Close()
+		defer server.Close()
+
+		pconn := Must1(client.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 5555}))
+		defer pconn.Close()
+		mapped, err := STUNMappedAddress(context.Background(), pconn, "10.0.0.1:3478", &STUNOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mapped.String() != "10.0.0.2:5555" {
+			t.Fatal("unexpected mapped address", mapped)
+		}
+	})
+
+	t.Run("without NAT and filtering", func(t *testing.T) {
+		topology, client, server := newTopology()
+		defer topology.Close()
+		defer server.Close()
+
+		behavior, err := DiscoverNATBehavior(context.Background(), client, "10.0.0.1:3478", &STUNOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if behavior.Mapping != NATMappingNone || behavior.Filtering != NATFilteringEndpointIndependent {
+			t.Fatal("unexpected behavior", behavior)
+		}
+		if behavior.LocalAddress != behavior.MappedAddress {
+			t.Fatal("expected the local and the mapped address to be equal", behavior)
+		}
+	})
+
+	t.Run("with address-and-port-dependent filtering", func(t *testing.T) {
+		// dropping the traffic from the alternate port emulates a
+		// firewall that only allows the contacted endpoints
+		topology, client, server := newTopology(stunTestDropFromPort(3479))
+		defer topology.Close()
+		defer server.Close()
+
+		options := &STUNOptions{Retries: 1, Timeout: 100 * time.Millisecond}
+		behavior, err := DiscoverNATBehavior(context.Background(), client, "10.0.0.1:3478", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if behavior.Filtering != NATFilteringAddressAndPortDependent {
+			t.Fatal("unexpected behavior", behavior)
+		}
+	})
+
+	t.Run("we cannot discover the behavior without an alternate address", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		server := Must1(NewSTUNServer(&NullLogger{}, topology.Server, "10.0.0.1", &STUNServerConfig{}))
+		defer server.Close()
+
+		behavior, err := DiscoverNATBehavior(context.Background(), topology.Client, "10.0.0.1:3478", &STUNOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if behavior.Mapping != NATMappingNone || behavior.Filtering != NATFilteringUnknown {
+			t.Fatal("unexpected behavior", behavior)
+		}
+	})
+
+	t.Run("we time out when there is no server", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		options := &STUNOptions{Retries: 1, Timeout: 50 * time.Millisecond}
+		_, err := DiscoverNATBehavior(context.Background(), topology.Client, "10.0.0.1:3478", options)
+		if err != ErrSTUNNoResponse {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
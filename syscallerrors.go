@@ -0,0 +1,190 @@
+package netem
+
+//
+// Mapping unet errors to stdlib errors
+//
+
+import (
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// unetSuffixToError maps a gvisor error suffix to an stdlib error.
+type unetSuffixToError struct {
+	// suffix is the unet err.Error() suffix.
+	suffix string
+
+	// err is generally a syscall error but it could
+	// also be any other stdlib error.
+	err error
+}
+
+// allUNetSyscallErrors defines [unetSuffixToError] rules for all the errors
+// emitted by unet. Where possible, we use the errno that Linux would return
+// in the same situation, which is also what gvisor returns to the applications
+// running inside its sandbox, except that we map "closed for receive" and
+// "closed for send" to [net.ErrClosed] and "no ports are available" to
+// [syscall.EADDRNOTAVAIL] like the stdlib does when using the kernel.
+//
+// See https://github.com/google/gvisor/blob/master/pkg/tcpip/errors.go
+//
+// See https://github.com/google/gvisor/blob/master/pkg/syserr/netstack.go
+var allUNetSyscallErrors = []*unetSuffixToError{{
+	suffix: "endpoint is closed for receive",
+	err:    net.ErrClosed,
+}, {
+	suffix: "endpoint is closed for send",
+	err:    net.ErrClosed,
+}, {
+	suffix: "connection aborted",
+	err:    syscall.ECONNABORTED,
+}, {
+	suffix: "connection was refused",
+	err:    syscall.ECONNREFUSED,
+}, {
+	suffix: "connection reset by peer",
+	err:    syscall.ECONNRESET,
+}, {
+	suffix: "network is unreachable",
+	err:    syscall.ENETUNREACH,
+}, {
+	suffix: "no route to host",
+	err:    syscall.EHOSTUNREACH,
+}, {
+	suffix: "host is down",
+	err:    syscall.EHOSTDOWN,
+}, {
+	suffix: "machine is not on the network",
+	err:    syscall.ENETDOWN,
+}, {
+	suffix: "operation timed out",
+	err:    syscall.ETIMEDOUT,
+}, {
+	suffix: "i/o timeout",
+	err:    os.ErrDeadlineExceeded,
+}, {
+	suffix: "endpoint is in invalid state",
+	err:    syscall.EINVAL,
+}, {
+	suffix: "port is in use",
+	err:    syscall.EADDRINUSE,
+}, {
+	suffix: "no ports are available",
+	err:    syscall.EADDRNOTAVAIL,
+}, {
+	suffix: "bad local address",
+	err:    syscall.EADDRNOTAVAIL,
+}, {
+	suffix: "bad address",
+	err:    syscall.EFAULT,
+}, {
+	suffix: "address family not supported by protocol",
+	err:    syscall.EAFNOSUPPORT,
+}, {
+	suffix: "endpoint already bound",
+	err:    syscall.EINVAL,
+}, {
+	suffix: "endpoint is already connected",
+	err:    syscall.EISCONN,
+}, {
+	suffix: "endpoint is already connecting",
+	err:    syscall.EALREADY,
+}, {
+	suffix: "endpoint not connected",
+	err:    syscall.ENOTCONN,
+}, {
+	suffix: "connection attempt started",
+	err:    syscall.EINPROGRESS,
+}, {
+	suffix: "destination address is required",
+	err:    syscall.EDESTADDRREQ,
+}, {
+	suffix: "invalid option value specified",
+	err:    syscall.EINVAL,
+}, {
+	suffix: "unknown option for protocol",
+	err:    syscall.ENOPROTOOPT,
+}, {
+	suffix: "message too long",
+	err:    syscall.EMSGSIZE,
+}, {
+	suffix: "no buffer space available",
+	err:    syscall.ENOBUFS,
+}, {
+	suffix: "broadcast socket option disabled",
+	err:    syscall.EACCES,
+}, {
+	suffix: "operation not permitted",
+	err:    syscall.EPERM,
+}, {
+	suffix: "operation not supported",
+	err:    syscall.EOPNOTSUPP,
+}, {
+	suffix: "operation would block",
+	err:    syscall.EAGAIN,
+}, {
+	suffix: "operation aborted",
+	err:    syscall.EPIPE,
+}}
+
+// MapUNetError maps an error emitted by the userspace TCP/IP stack to the
+// corresponding stdlib error, i.e., a [syscall.Errno], [net.ErrClosed], or
+// [os.ErrDeadlineExceeded]. The [UNetStack] already applies this mapping to the
+// errors returned by its methods and by the conns and listeners it creates, so
+// that you can check for exact errno semantics using [errors.Is]:
+//
+//	if errors.Is(err, syscall.ECONNRESET) {
+//		// ...
+//	}
+//
+// You only need to call this function for errors obtained by using the stack
+// through other means. Errors that do not originate from the stack and the nil
+// error are returned unchanged; already mapped errors map to themselves.
+//
+// The following table lists the mapping rules:
+//
+//	endpoint is closed for receive             net.ErrClosed
+//	endpoint is closed for send                net.ErrClosed
+//	connection aborted                         ECONNABORTED
+//	connection was refused                     ECONNREFUSED
+//	connection reset by peer                   ECONNRESET
+//	network is unreachable                     ENETUNREACH
+//	no route to host                           EHOSTUNREACH
+//	host is down                               EHOSTDOWN
+//	machine is not on the network              ENETDOWN
+//	operation timed out                        ETIMEDOUT
+//	i/o timeout                                os.ErrDeadlineExceeded
+//	endpoint is in invalid state               EINVAL
+//	port is in use                             EADDRINUSE
+//	no ports are available                     EADDRNOTAVAIL
+//	bad local address                          EADDRNOTAVAIL
+//	bad address                                EFAULT
+//	address family not supported by protocol   EAFNOSUPPORT
+//	endpoint already bound                     EINVAL
+//	endpoint is already connected              EISCONN
+//	endpoint is already connecting             EALREADY
+//	endpoint not connected                     ENOTCONN
+//	connection attempt started                 EINPROGRESS
+//	destination address is required            EDESTADDRREQ
+//	invalid option value specified             EINVAL
+//	unknown option for protocol                ENOPROTOOPT
+//	message too long                           EMSGSIZE
+//	no buffer space available                  ENOBUFS
+//	broadcast socket option disabled           EACCES
+//	operation not permitted                    EPERM
+//	operation not supported                    EOPNOTSUPP
+//	operation would block                      EAGAIN
+//	operation aborted                          EPIPE
+func MapUNetError(err error) error {
+	if err != nil {
+		estring := err.Error()
+		for _, entry := range allUNetSyscallErrors {
+			if strings.HasSuffix(estring, entry.suffix) {
+				return entry.err
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func TestMapUNetError(t *testing.T) {
+	t.Run("we map all the tcpip errors", func(t *testing.T) {
+		expectations := []struct {
+			err  tcpip.Error
+			want error
+		}{
+			{&tcpip.ErrAborted{}, syscall.EPIPE},
+			{&tcpip.ErrAddressFamilyNotSupported{}, syscall.EAFNOSUPPORT},
+			{&tcpip.ErrAlreadyBound{}, syscall.EINVAL},
+			{&tcpip.ErrAlreadyConnected{}, syscall.EISCONN},
+			{&tcpip.ErrAlreadyConnecting{}, syscall.EALREADY},
+			{&tcpip.ErrBadAddress{}, syscall.EFAULT},
+			{&tcpip.ErrBadLocalAddress{}, syscall.EADDRNOTAVAIL},
+			{&tcpip.ErrBroadcastDisabled{}, syscall.EACCES},
+			{&tcpip.ErrClosedForReceive{}, net.ErrClosed},
+			{&tcpip.ErrClosedForSend{}, net.ErrClosed},
+			{&tcpip.ErrConnectStarted{}, syscall.EINPROGRESS},
+			{&tcpip.ErrConnectionAborted{}, syscall.ECONNABORTED},
+			{&tcpip.ErrConnectionRefused{}, syscall.ECONNREFUSED},
+			{&tcpip.ErrConnectionReset{}, syscall.ECONNRESET},
+			{&tcpip.ErrDestinationRequired{}, syscall.EDESTADDRREQ},
+			{&tcpip.ErrHostDown{}, syscall.EHOSTDOWN},
+			{&tcpip.ErrHostUnreachable{}, syscall.EHOSTUNREACH},
+			{&tcpip.ErrInvalidEndpointState{}, syscall.EINVAL},
+			{&tcpip.ErrInvalidOptionValue{}, syscall.EINVAL},
+			{&tcpip.ErrMessageTooLong{}, syscall.EMSGSIZE},
+			{&tcpip.ErrNetworkUnreachable{}, syscall.ENETUNREACH},
+			{&tcpip.ErrNoBufferSpace{}, syscall.ENOBUFS},
+			{&tcpip.ErrNoNet{}, syscall.ENETDOWN},
+			{&tcpip.ErrNoPortAvailable{}, syscall.EADDRNOTAVAIL},
+			{&tcpip.ErrNotConnected{}, syscall.ENOTCONN},
+			{&tcpip.ErrNotPermitted{}, syscall.EPERM},
+			{&tcpip.ErrNotSupported{}, syscall.EOPNOTSUPP},
+			{&tcpip.ErrPortInUse{}, syscall.EADDRINUSE},
+			{&tcpip.ErrTimeout{}, syscall.ETIMEDOUT},
+			{&tcpip.ErrUnknownProtocolOption{}, syscall.ENOPROTOOPT},
+			{&tcpip.ErrWouldBlock{}, syscall.EAGAIN},
+		}
+		for _, expect := range expectations {
+			t.Run(expect.err.String(), func(t *testing.T) {
+				// emulate how gonet wraps the errors
+				err := &net.OpError{Op: "read", Net: "tcp", Err: errors.New(expect.err.String())}
+				if got := MapUNetError(err); !errors.Is(got, expect.want) {
+					t.Fatal("expected", expect.want, "got", got)
+				}
+			})
+		}
+	})
+
+	t.Run("mapping is idempotent", func(t *testing.T) {
+		for _, entry := range allUNetSyscallErrors {
+			if got := MapUNetError(entry.err); got != entry.err {
+				t.Fatal("expected", entry.err, "got", got)
+			}
+		}
+	})
+
+	t.Run("we do not change nil and unrelated errors", func(t *testing.T) {
+		if err := MapUNetError(nil); err != nil {
+			t.Fatal("expected nil, got", err)
+		}
+		if err := MapUNetError(io.EOF); err != io.EOF {
+			t.Fatal("expected io.EOF, got", err)
+		}
+	})
+
+	t.Run("the stack returns mapped errors", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		_, err := topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatal("expected ECONNREFUSED, got", err)
+		}
+
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		defer conn.Close()
+
+		Must0(conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)))
+		_, err = conn.Read(make([]byte, 8))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("expected os.ErrDeadlineExceeded, got", err)
+		}
+		var nerr net.Error
+		if !errors.As(err, &nerr) || !nerr.Timeout() {
+			t.Fatal("expected a timeout error, got", err)
+		}
+	})
+}
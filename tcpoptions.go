@@ -0,0 +1,146 @@
+package netem
+
+//
+// TCP options
+//
+
+import (
+	"errors"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// The TCP congestion control algorithms supported by [UNetStack.SetTCPCongestionControl]. The
+// default is [TCPCongestionControlReno]. (The underlying stack does not implement BBR.)
+const (
+	TCPCongestionControlCUBIC = "cubic"
+	TCPCongestionControlReno  = "reno"
+)
+
+// ErrUnsupportedCongestionControl indicates that the stack does not
+// support the requested TCP congestion control algorithm.
+var ErrUnsupportedCongestionControl = errors.New("netem: unsupported TCP congestion control algorithm")
+
+// SetTCPCongestionControl sets the TCP congestion control algorithm (e.g.,
+// [TCPCongestionControlCUBIC]) used by the TCP connections created after calling
+// this method, which allows comparing algorithms under identical impairments.
+//
+// This method returns [ErrUnsupportedCongestionControl] if the algorithm is not
+// listed by [UNetStack.AvailableTCPCongestionControls].
+func (gs *UNetStack) SetTCPCongestionControl(name string) error {
+	for _, available := range gs.ns.AvailableTCPCongestionControls() {
+		if name == available {
+			return gs.ns.SetTCPCongestionControl(name)
+		}
+	}
+	return ErrUnsupportedCongestionControl
+}
+
+// TCPCongestionControl returns the current TCP congestion control algorithm.
+func (gs *UNetStack) TCPCongestionControl() string {
+	return gs.ns.TCPCongestionControl()
+}
+
+// AvailableTCPCongestionControls returns the TCP congestion
+// control algorithms supported by the stack.
+func (gs *UNetStack) AvailableTCPCongestionControls() []string {
+	return gs.ns.AvailableTCPCongestionControls()
+}
+
+// TCPConfig contains the TCP parameters of a [UNetStack]. The zero value
+// is valid and corresponds to the default parameters.
+type TCPConfig struct {
+	// DisableWindowScaling OPTIONALLY prevents scaling the receive window
+	// by limiting the receive buffer to 64 KiB and disabling the receive
+	// buffer auto-tuning, such that we advertise a zero window scale.
+	DisableWindowScaling bool
+
+	// EnableSACK OPTIONALLY enables selective acknowledgments
+	// (the underlying stack disables SACK by default).
+	EnableSACK bool
+
+	// MSS OPTIONALLY clamps the MSS advertised by new TCP connections, which
+	// limits the size of the segments sent by the peer (default: derived from the MTU).
+	MSS int
+
+	// ReceiveBufferSize OPTIONALLY fixes the receive buffer size in bytes and
+	// disables the receive buffer auto-tuning (default: 1 MiB with auto-tuning).
+	ReceiveBufferSize int
+
+	// SendBufferSize OPTIONALLY fixes the send buffer size in bytes (default: 1 MiB).
+	SendBufferSize int
+}
+
+// SetTCPConfig configures the TCP parameters used by the TCP connections created
+// after calling this method. Calling this method again replaces the previous config
+// and calling it with an empty config restores the default TCP parameters.
+//
+// This method returns [syscall.EINVAL] if the buffer sizes are negative or smaller
+// than 4 KiB or if the MSS is out of range (i.e., the MSS must be 0 or between 88
+// and 65535 bytes), in which case we leave the TCP parameters unchanged.
+func (gs *UNetStack) SetTCPConfig(config *TCPConfig) error {
+	// validate the config before changing anything
+	validBufferSize := func(size int) bool {
+		return size == 0 || size >= tcp.MinBufferSize
+	}
+	if !validBufferSize(config.ReceiveBufferSize) || !validBufferSize(config.SendBufferSize) {
+		return syscall.EINVAL
+	}
+	if config.MSS != 0 && (config.MSS < header.TCPMinimumMSS || config.MSS > header.TCPMaximumMSS) {
+		return syscall.EINVAL
+	}
+
+	// compute the receive buffer size range and whether to auto-tune
+	recvBufferSize := tcpip.TCPReceiveBufferSizeRangeOption{
+		Min:     tcp.MinBufferSize,
+		Default: tcp.DefaultReceiveBufferSize,
+		Max:     tcp.MaxBufferSize,
+	}
+	moderateReceiveBuffer := true
+	if config.ReceiveBufferSize > 0 {
+		recvBufferSize.Default = config.ReceiveBufferSize
+		recvBufferSize.Max = config.ReceiveBufferSize
+		moderateReceiveBuffer = false
+	}
+	if config.DisableWindowScaling {
+		const maxUnscaledWindow = 1<<16 - 1
+		if recvBufferSize.Max > maxUnscaledWindow {
+			recvBufferSize.Max = maxUnscaledWindow
+		}
+		if recvBufferSize.Default > maxUnscaledWindow {
+			recvBufferSize.Default = maxUnscaledWindow
+		}
+		moderateReceiveBuffer = false
+	}
+
+	// compute the send buffer size range
+	sendBufferSize := tcpip.TCPSendBufferSizeRangeOption{
+		Min:     tcp.MinBufferSize,
+		Default: tcp.DefaultSendBufferSize,
+		Max:     tcp.MaxBufferSize,
+	}
+	if config.SendBufferSize > 0 {
+		sendBufferSize.Default = config.SendBufferSize
+		sendBufferSize.Max = config.SendBufferSize
+	}
+
+	// apply the config
+	moderate := tcpip.TCPModerateReceiveBufferOption(moderateReceiveBuffer)
+	sack := tcpip.TCPSACKEnabled(config.EnableSACK)
+	options := []tcpip.SettableTransportProtocolOption{
+		&recvBufferSize,
+		&sendBufferSize,
+		&moderate,
+		&sack,
+	}
+	for _, option := range options {
+		if err := gs.ns.SetTCPOption(option); err != nil {
+			return err
+		}
+	}
+	gs.ns.SetTCPMSS(config.MSS)
+	return nil
+}
@@ -0,0 +1,190 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func TestTCPCongestionControl(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{
+		LeftToRightDelay: time.Millisecond,
+		RightToLeftDelay: time.Millisecond,
+	})
+	defer topology.Close()
+
+	t.Run("we list the available algorithms", func(t *testing.T) {
+		expect := []string{TCPCongestionControlReno, TCPCongestionControlCUBIC}
+		if diff := cmp.Diff(expect, topology.Server.AvailableTCPCongestionControls()); diff != "" {
+			t.Fatal(diff)
+		}
+		if cc := topology.Server.TCPCongestionControl(); cc != TCPCongestionControlReno {
+			t.Fatal("unexpected default", cc)
+		}
+	})
+
+	t.Run("we reject unsupported algorithms", func(t *testing.T) {
+		if err := topology.Server.SetTCPCongestionControl("bbr"); !errors.Is(err, ErrUnsupportedCongestionControl) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("new connections use the selected algorithm", func(t *testing.T) {
+		Must0(topology.Server.SetTCPCongestionControl(TCPCongestionControlCUBIC))
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+
+		const size = 1 << 18
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			var option tcpip.CongestionControlOption
+			tcpErr := conn.(*unetConnWrapper).ep.GetSockOpt(&option)
+			if tcpErr != nil || string(option) != TCPCongestionControlCUBIC {
+				return // causes the client to read less than size bytes
+			}
+			_, _ = conn.Write(make([]byte, size))
+		}()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		defer conn.Close()
+		Must0(conn.SetDeadline(time.Now().Add(10 * time.Second)))
+		count, err := io.Copy(io.Discard, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != size {
+			t.Fatal("unexpected count", count)
+		}
+	})
+}
+
+func TestTCPConfig(t *testing.T) {
+	// connect establishes a connection using the given config for both stacks and
+	// uploads the given amount of bytes, returning the recorded client packets.
+	connect := func(t *testing.T, config *TCPConfig, size int) []*layers.TCP {
+		recorder := &sockoptRecorder{}
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{
+			LeftNICWrapper: recorder,
+		})
+		defer topology.Close()
+		Must0(topology.Client.SetTCPConfig(config))
+		Must0(topology.Server.SetTCPConfig(config))
+
+		listener := Must1(topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+		done := make(chan int64)
+		go func() {
+			defer close(done)
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			Must0(conn.SetDeadline(time.Now().Add(10 * time.Second)))
+			count, _ := io.Copy(io.Discard, conn)
+			done <- count
+		}()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		Must1(conn.Write(make([]byte, size)))
+		conn.Close()
+		if count := <-done; count != int64(size) {
+			t.Fatal("unexpected count", count)
+		}
+
+		var segments []*layers.TCP
+		for _, packet := range recorder.find(layers.IPProtocolTCP) {
+			segment := gopacket.NewPacket(packet.Payload, layers.LayerTypeTCP, gopacket.Default)
+			if tcp, good := segment.Layer(layers.LayerTypeTCP).(*layers.TCP); good {
+				segments = append(segments, tcp)
+			}
+		}
+		if len(segments) <= 0 || !segments[0].SYN {
+			t.Fatal("expected to see the SYN segment first")
+		}
+		return segments
+	}
+
+	// findOption returns the given option of the given segment.
+	findOption := func(segment *layers.TCP, kind layers.TCPOptionKind) (layers.TCPOption, bool) {
+		for _, option := range segment.Options {
+			if option.OptionType == kind {
+				return option, true
+			}
+		}
+		return layers.TCPOption{}, false
+	}
+
+	t.Run("by default we disable SACK and scale the window", func(t *testing.T) {
+		syn := connect(t, &TCPConfig{}, 1024)[0]
+		if _, found := findOption(syn, layers.TCPOptionKindSACKPermitted); found {
+			t.Fatal("expected SACK to be disabled")
+		}
+		if option, found := findOption(syn, layers.TCPOptionKindWindowScale); !found || option.OptionData[0] <= 0 {
+			t.Fatal("expected a nonzero window scale")
+		}
+	})
+
+	t.Run("we can enable SACK", func(t *testing.T) {
+		syn := connect(t, &TCPConfig{EnableSACK: true}, 1024)[0]
+		if _, found := findOption(syn, layers.TCPOptionKindSACKPermitted); !found {
+			t.Fatal("expected SACK to be enabled")
+		}
+	})
+
+	t.Run("we can disable window scaling", func(t *testing.T) {
+		syn := connect(t, &TCPConfig{DisableWindowScaling: true}, 1024)[0]
+		if option, found := findOption(syn, layers.TCPOptionKindWindowScale); found && option.OptionData[0] != 0 {
+			t.Fatal("expected a zero window scale")
+		}
+	})
+
+	t.Run("we can set the receive buffer size", func(t *testing.T) {
+		syn := connect(t, &TCPConfig{ReceiveBufferSize: 8192}, 1024)[0]
+		if syn.Window > 8192 {
+			t.Fatal("unexpected window", syn.Window)
+		}
+	})
+
+	t.Run("we can clamp the MSS", func(t *testing.T) {
+		segments := connect(t, &TCPConfig{MSS: 500}, 1<<16)
+		var maxPayload int
+		for _, segment := range segments {
+			if len(segment.Payload) > maxPayload {
+				maxPayload = len(segment.Payload)
+			}
+		}
+		if maxPayload <= 0 || maxPayload > 500 {
+			t.Fatal("unexpected max payload", maxPayload)
+		}
+	})
+
+	t.Run("we reject invalid configs", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		configs := []*TCPConfig{
+			{MSS: 10},
+			{MSS: 1 << 16},
+			{ReceiveBufferSize: 1},
+			{SendBufferSize: -1},
+		}
+		for _, config := range configs {
+			if err := topology.Client.SetTCPConfig(config); !errors.Is(err, syscall.EINVAL) {
+				t.Fatal("unexpected error", err)
+			}
+		}
+	})
+}
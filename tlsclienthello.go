@@ -0,0 +1,294 @@
+package netem
+
+//
+// Customized TLS ClientHello
+//
+// References:
+//
+// - https://datatracker.ietf.org/doc/html/rfc8446
+//
+// - https://datatracker.ietf.org/doc/html/rfc8701
+//
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ErrTLSAlert indicates that the server answered a customized ClientHello
+// sent by [NewTLSClientHelloFactory] with a TLS alert.
+var ErrTLSAlert = errors.New("netem: received TLS alert")
+
+// These are the extension types for which [NewTLSClientHelloFactory]
+// generates the extension data. We send other extensions empty.
+const (
+	TLSExtensionServerName          = 0
+	TLSExtensionSupportedGroups     = 10
+	TLSExtensionECPointFormats      = 11
+	TLSExtensionSignatureAlgorithms = 13
+	TLSExtensionALPN                = 16
+	TLSExtensionSupportedVersions   = 43
+	TLSExtensionPSKKeyExchangeModes = 45
+	TLSExtensionKeyShare            = 51
+)
+
+// TLSClientHelloSpec describes the ClientHello sent by [NewTLSClientHelloFactory].
+type TLSClientHelloSpec struct {
+	// CipherSuites is the OPTIONAL list of cipher suites in the order in
+	// which we send them (default: the TLS 1.3 suites, followed by the ECDHE
+	// AES-GCM TLS 1.2 suites).
+	CipherSuites []uint16
+
+	// Extensions is the OPTIONAL list of extension types in the order in which
+	// we send them (default: server_name, ec_point_formats, supported_groups,
+	// alpn, signature_algorithms, key_share, psk_key_exchange_modes, and
+	// supported_versions). We omit the server_name extension when the server
+	// name is an IP address and the alpn extension when there is no ALPN.
+	Extensions []uint16
+
+	// GREASE OPTIONALLY adds random GREASE values (see RFC 8701) as the first
+	// cipher suite and as the first and the last extension, like Chrome does.
+	GREASE bool
+}
+
+var tlsClientHelloDefaultCipherSuites = []uint16{
+	tls.TLS_AES_128_GCM_SHA256,
+	tls.TLS_AES_256_GCM_SHA384,
+	tls.TLS_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+var tlsClientHelloDefaultExtensions = []uint16{
+	TLSExtensionServerName,
+	TLSExtensionECPointFormats,
+	TLSExtensionSupportedGroups,
+	TLSExtensionALPN,
+	TLSExtensionSignatureAlgorithms,
+	TLSExtensionKeyShare,
+	TLSExtensionPSKKeyExchangeModes,
+	TLSExtensionSupportedVersions,
+}
+
+// NewTLSClientHelloFactory returns a [TLSClientFactory] sending a ClientHello
+// customized according to the given spec, which allows to study how the DPI
+// and the servers react to distinct TLS fingerprints.
+//
+// Because the standard library cannot continue the handshake after a ClientHello
+// it did not create, the handshake succeeds as soon as the server answers with a
+// ServerHello and fails with [ErrTLSAlert] when the server answers with an alert.
+// Therefore, you cannot use the returned connection to exchange application data.
+// If you need to do that, write a [TLSClientFactory] wrapping uTLS instead.
+func NewTLSClientHelloFactory(spec *TLSClientHelloSpec) TLSClientFactory {
+	return func(conn net.Conn, config *tls.Config) TLSClientConn {
+		return &tlsClientHelloConn{
+			Conn:   conn,
+			config: config,
+			spec:   spec,
+		}
+	}
+}
+
+// tlsClientHelloConn is the [TLSClientConn] created by [NewTLSClientHelloFactory].
+type tlsClientHelloConn struct {
+	net.Conn
+	config *tls.Config
+	spec   *TLSClientHelloSpec
+}
+
+// HandshakeContext implements TLSClientConn
+func (c *tlsClientHelloConn) HandshakeContext(ctx context.Context) error {
+	rawHello, err := c.spec.marshal(c.config)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(rawHello); err != nil {
+		return err
+	}
+	return tlsClientHelloReadServerResponse(c.Conn)
+}
+
+// tlsClientHelloReadServerResponse reads the first record sent by the server
+// and returns nil if it contains a ServerHello.
+func tlsClientHelloReadServerResponse(conn net.Conn) error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return err
+	}
+	switch {
+	case header[0] == 21 && len(body) == 2: // alert
+		return fmt.Errorf("%w: %d", ErrTLSAlert, body[1])
+	case header[0] == 22 && len(body) > 0 && body[0] == 2: // handshake, server_hello
+		return nil
+	default:
+		return newErrTLSParse("server hello: unexpected message")
+	}
+}
+
+// marshal serializes the ClientHello record for the given config.
+func (spec *TLSClientHelloSpec) marshal(config *tls.Config) ([]byte, error) {
+	random := make([]byte, 32)
+	sessionID := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(sessionID); err != nil {
+		return nil, err
+	}
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites := spec.CipherSuites
+	if len(cipherSuites) <= 0 {
+		cipherSuites = tlsClientHelloDefaultCipherSuites
+	}
+	extensions := spec.Extensions
+	if len(extensions) <= 0 {
+		extensions = tlsClientHelloDefaultExtensions
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(22)                // handshake
+	b.AddUint16(tls.VersionTLS10) // for compatibility
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(1) // client_hello
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(tls.VersionTLS12) // for compatibility
+			b.AddBytes(random)
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(sessionID)
+			})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				if spec.GREASE {
+					b.AddUint16(tlsClientHelloNewGREASE())
+				}
+				for _, cipher := range cipherSuites {
+					b.AddUint16(cipher)
+				}
+			})
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(0) // null compression
+			})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				grease := tlsClientHelloNewGREASE()
+				if spec.GREASE {
+					b.AddUint16(grease)
+					b.AddUint16(0) // empty
+				}
+				for _, extType := range extensions {
+					tlsClientHelloAddExtension(b, extType, config, privateKey.PublicKey().Bytes())
+				}
+				if spec.GREASE {
+					b.AddUint16(grease ^ 0x1010) // must differ from the first one
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddUint8(0) // like Chrome does
+					})
+				}
+			})
+		})
+	})
+	return b.Bytes()
+}
+
+// tlsClientHelloAddExtension adds the extension with the given type.
+func tlsClientHelloAddExtension(b *cryptobyte.Builder, extType uint16, config *tls.Config, publicKey []byte) {
+	switch extType {
+	case TLSExtensionServerName:
+		if _, err := netip.ParseAddr(config.ServerName); err == nil || config.ServerName == "" {
+			return // RFC 6066 does not allow IP addresses
+		}
+	case TLSExtensionALPN:
+		if len(config.NextProtos) <= 0 {
+			return
+		}
+	}
+	b.AddUint16(extType)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		switch extType {
+		case TLSExtensionServerName:
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(0) // host_name
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes([]byte(config.ServerName))
+				})
+			})
+
+		case TLSExtensionSupportedGroups:
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(uint16(tls.X25519))
+			})
+
+		case TLSExtensionECPointFormats:
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(0) // uncompressed
+			})
+
+		case TLSExtensionSignatureAlgorithms:
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, scheme := range []tls.SignatureScheme{
+					tls.ECDSAWithP256AndSHA256,
+					tls.PSSWithSHA256,
+					tls.PKCS1WithSHA256,
+					tls.ECDSAWithP384AndSHA384,
+					tls.PSSWithSHA384,
+					tls.PKCS1WithSHA384,
+					tls.PSSWithSHA512,
+					tls.PKCS1WithSHA512,
+				} {
+					b.AddUint16(uint16(scheme))
+				}
+			})
+
+		case TLSExtensionALPN:
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, proto := range config.NextProtos {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes([]byte(proto))
+					})
+				}
+			})
+
+		case TLSExtensionSupportedVersions:
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(tls.VersionTLS13)
+				b.AddUint16(tls.VersionTLS12)
+			})
+
+		case TLSExtensionPSKKeyExchangeModes:
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(1) // psk_dhe_ke
+			})
+
+		case TLSExtensionKeyShare:
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(uint16(tls.X25519))
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(publicKey)
+				})
+			})
+		}
+	})
+}
+
+// tlsClientHelloNewGREASE returns a random GREASE value (e.g., 0x1a1a).
+func tlsClientHelloNewGREASE() uint16 {
+	value := make([]byte, 1)
+	_, _ = rand.Read(value)
+	nibble := uint16(value[0] & 0x0f)
+	return 0x0a0a | nibble<<12 | nibble<<4
+}
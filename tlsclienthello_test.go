@@ -0,0 +1,186 @@
+package netem
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// tlsClientHelloTestIsGREASE returns whether the given value is a GREASE value.
+func tlsClientHelloTestIsGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// tlsClientHelloTestCapture returns the ClientHello sent using the given spec and config.
+func tlsClientHelloTestCapture(t *testing.T, spec *TLSClientHelloSpec, config *tls.Config) *TLSClientHello {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		_ = NewTLSClientHelloFactory(spec)(client, config).HandshakeContext(context.Background())
+	}()
+	record := make([]byte, 1<<14)
+	count := Must1(server.Read(record))
+	rh, _ := Must2(UnmarshalTLSRecordHeader(record[:count]))
+	hx := Must1(UnmarshalTLSHandshakeMsg(rh.Rest))
+	if hx.ClientHello == nil {
+		t.Fatal("expected a ClientHello")
+	}
+	return hx.ClientHello
+}
+
+// tlsClientHelloTestUint16s parses a list of uint16 values.
+func tlsClientHelloTestUint16s(cursor cryptobyte.String) (out []uint16) {
+	for !cursor.Empty() {
+		var value uint16
+		cursor.ReadUint16(&value)
+		out = append(out, value)
+	}
+	return
+}
+
+func TestTLSClientHelloFactory(t *testing.T) {
+	t.Run("we send the extensions and the ciphers in the configured order", func(t *testing.T) {
+		spec := &TLSClientHelloSpec{
+			CipherSuites: []uint16{tls.TLS_CHACHA20_POLY1305_SHA256, tls.TLS_AES_128_GCM_SHA256},
+			Extensions: []uint16{
+				TLSExtensionSupportedVersions,
+				TLSExtensionKeyShare,
+				TLSExtensionALPN,
+				0x4469, // unknown types are sent empty
+				TLSExtensionServerName,
+			},
+		}
+		config := &tls.Config{ServerName: "www.example.com", NextProtos: []string{"h2"}}
+		ch := tlsClientHelloTestCapture(t, spec, config)
+
+		if diff := cmp.Diff(spec.CipherSuites, tlsClientHelloTestUint16s(ch.CipherSuites)); diff != "" {
+			t.Fatal(diff)
+		}
+		exts := Must1(UnmarshalTLSExtensions(ch.Extensions))
+		var types []uint16
+		for _, ext := range exts {
+			types = append(types, ext.Type)
+		}
+		if diff := cmp.Diff(spec.Extensions, types); diff != "" {
+			t.Fatal(diff)
+		}
+		if len(exts[3].Data) != 0 {
+			t.Fatal("expected an empty extension")
+		}
+		sni, _ := FindTLSServerNameExtension(exts)
+		if name := Must1(UnmarshalTLSServerNameExtension(sni.Data)); name != "www.example.com" {
+			t.Fatal("unexpected server name", name)
+		}
+	})
+
+	t.Run("we add GREASE values when requested", func(t *testing.T) {
+		config := &tls.Config{ServerName: "www.example.com"}
+		ch := tlsClientHelloTestCapture(t, &TLSClientHelloSpec{GREASE: true}, config)
+
+		ciphers := tlsClientHelloTestUint16s(ch.CipherSuites)
+		if !tlsClientHelloTestIsGREASE(ciphers[0]) {
+			t.Fatal("expected GREASE as the first cipher suite", ciphers)
+		}
+		exts := Must1(UnmarshalTLSExtensions(ch.Extensions))
+		first, last := exts[0].Type, exts[len(exts)-1].Type
+		if !tlsClientHelloTestIsGREASE(first) || !tlsClientHelloTestIsGREASE(last) || first == last {
+			t.Fatal("expected distinct GREASE extensions at both ends", first, last)
+		}
+		// the default extensions do not include ALPN when there are no protocols
+		if len(exts) != 2+len(tlsClientHelloDefaultExtensions)-1 {
+			t.Fatal("unexpected number of extensions", len(exts))
+		}
+	})
+
+	t.Run("we omit the server name when it is an IP address", func(t *testing.T) {
+		config := &tls.Config{ServerName: "10.0.0.1"}
+		ch := tlsClientHelloTestCapture(t, &TLSClientHelloSpec{}, config)
+		if _, found := FindTLSServerNameExtension(Must1(UnmarshalTLSExtensions(ch.Extensions))); found {
+			t.Fatal("expected no server name extension")
+		}
+	})
+
+	t.Run("the handshake succeeds when the server answers with a ServerHello", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		serverConfig := MustNewCA().MustNewServerTLSConfig("www.example.com")
+		go func() {
+			_ = tls.Server(server, serverConfig).Handshake()
+		}()
+		config := &tls.Config{ServerName: "www.example.com"}
+		conn := NewTLSClientHelloFactory(&TLSClientHelloSpec{GREASE: true})(client, config)
+		if err := conn.HandshakeContext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("the handshake fails when the server answers with an alert", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		serverConfig := MustNewCA().MustNewServerTLSConfig("www.example.com")
+		go func() {
+			_ = tls.Server(server, serverConfig).Handshake()
+		}()
+		config := &tls.Config{ServerName: "www.example.com"}
+		spec := &TLSClientHelloSpec{CipherSuites: []uint16{0x0005}} // TLS_RSA_WITH_RC4_128_SHA
+		conn := NewTLSClientHelloFactory(spec)(client, config)
+		if err := conn.HandshakeContext(context.Background()); !errors.Is(err, ErrTLSAlert) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("the DPI extracts the SNI regardless of the extensions order", func(t *testing.T) {
+		dpi := NewDPIEngine(&NullLogger{})
+		dpi.AddRule(&DPIResetTrafficForTLSSNI{Logger: &NullLogger{}, SNI: "blocked.example.com"})
+		// note: the DPI rule requires a router in the path and delays
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		clientStack := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{
+			DPIEngine:        dpi,
+			LeftToRightDelay: 10 * time.Millisecond,
+			RightToLeftDelay: 10 * time.Millisecond,
+		}))
+		serverStack := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", &LinkConfig{
+			LeftToRightDelay: 10 * time.Millisecond,
+			RightToLeftDelay: 10 * time.Millisecond,
+		}))
+		listener := Must1(serverStack.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}))
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		factory := NewTLSClientHelloFactory(&TLSClientHelloSpec{
+			Extensions: []uint16{TLSExtensionSupportedVersions, TLSExtensionServerName},
+			GREASE:     true,
+		})
+		client := &Net{
+			Stack: clientStack,
+			TLSClientFactory: func(conn net.Conn, config *tls.Config) TLSClientConn {
+				config.ServerName = "blocked.example.com" // we're dialing an IP address
+				return factory(conn, config)
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := client.DialTLSContext(ctx, "tcp", "10.0.0.1:443"); !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package netem
+
+//
+// Server-side TLS options
+//
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// TLSServerOptions contains the TLS parameters of an emulated server, which allow
+// to study protocol-version blocking (e.g., networks breaking TLS 1.3) and how
+// clients behave when a server only supports old versions or weak parameters.
+type TLSServerOptions struct {
+	// MinVersion is the OPTIONAL minimum TLS version (e.g., [tls.VersionTLS12]).
+	MinVersion uint16
+
+	// MaxVersion is the OPTIONAL maximum TLS version (e.g., [tls.VersionTLS12]).
+	MaxVersion uint16
+
+	// CipherSuites contains the OPTIONAL TLS 1.0-1.2 cipher suites. Note that
+	// the Go TLS stack does not allow configuring the TLS 1.3 cipher suites.
+	CipherSuites []uint16
+
+	// CurvePreferences contains the OPTIONAL key exchange curves.
+	CurvePreferences []tls.CurveID
+
+	// SessionTicketsDisabled OPTIONALLY disables session tickets, which prevents
+	// clients from resuming sessions and forces a full handshake for each connection.
+	SessionTicketsDisabled bool
+}
+
+// apply sets the options inside the given config.
+func (options *TLSServerOptions) apply(config *tls.Config) {
+	config.MinVersion = options.MinVersion
+	config.MaxVersion = options.MaxVersion
+	config.CipherSuites = options.CipherSuites
+	config.CurvePreferences = options.CurvePreferences
+	config.SessionTicketsDisabled = options.SessionTicketsDisabled
+}
+
+// MustNewServerTLSConfigWithOptions is like [UNetStack.MustNewServerTLSConfig] but
+// also configures the TLS versions, cipher suites, curves, and session tickets using the
+// given options.
+// You can pass the returned config to [Net.ListenTLS] or to an [http.Server].
+func (gs *UNetStack) MustNewServerTLSConfigWithOptions(
+	options *TLSServerOptions, commonName string, extraNames ...string) *tls.Config {
+	config := gs.MustNewServerTLSConfig(commonName, extraNames...)
+	options.apply(config)
+	return config
+}
+
+// ErrUnknownTLSParameter indicates that we do not know a TLS version, cipher suite, or curve.
+var ErrUnknownTLSParameter = errors.New("netem: unknown TLS parameter")
+
+// tlsVersions maps version names to versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version name (e.g., "1.2"), where the
+// empty string maps to zero, which means using the default.
+func ParseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	version, found := tlsVersions[name]
+	if !found {
+		return 0, fmt.Errorf("%w: TLS version %s", ErrUnknownTLSParameter, name)
+	}
+	return version, nil
+}
+
+// ParseTLSCipherSuite parses a cipher suite name as returned by [tls.CipherSuiteName]
+// (e.g., "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"), including insecure cipher suites.
+func ParseTLSCipherSuite(name string) (uint16, error) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: cipher suite %s", ErrUnknownTLSParameter, name)
+}
+
+// tlsCurves maps curve names to curves.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// ParseTLSCurve parses a curve name (one of "X25519", "P-256", "P-384", and "P-521").
+func ParseTLSCurve(name string) (tls.CurveID, error) {
+	curve, found := tlsCurves[name]
+	if !found {
+		return 0, fmt.Errorf("%w: curve %s", ErrUnknownTLSParameter, name)
+	}
+	return curve, nil
+}
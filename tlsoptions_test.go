@@ -0,0 +1,88 @@
+package netem
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTLSServerOptions(t *testing.T) {
+	// handshake connects to a server using the given options and the given client config.
+	handshake := func(t *testing.T, options *TLSServerOptions, clientConfig *tls.Config) (tls.ConnectionState, error) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		serverConfig := topology.Server.MustNewServerTLSConfigWithOptions(options, "10.0.0.1")
+		serverNet := &Net{Stack: topology.Server}
+		listener := Must1(serverNet.ListenTLS("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, serverConfig))
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = conn.Read(make([]byte, 1))
+		}()
+
+		conn := Must1(topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:443"))
+		defer conn.Close()
+		clientConfig.RootCAs = topology.Client.DefaultCertPool()
+		clientConfig.ServerName = "10.0.0.1"
+		tc := tls.Client(conn, clientConfig)
+		err := tc.Handshake()
+		return tc.ConnectionState(), err
+	}
+
+	t.Run("we honor the maximum version and the cipher suites", func(t *testing.T) {
+		options := &TLSServerOptions{
+			MaxVersion:       tls.VersionTLS12,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256},
+			CurvePreferences: []tls.CurveID{tls.CurveP384},
+		}
+		state, err := handshake(t, options, &tls.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Version != tls.VersionTLS12 {
+			t.Fatal("unexpected version", tls.VersionName(state.Version))
+		}
+		if state.CipherSuite != tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256 {
+			t.Fatal("unexpected cipher suite", tls.CipherSuiteName(state.CipherSuite))
+		}
+	})
+
+	t.Run("clients requiring TLS 1.3 fail with a TLS 1.2 server", func(t *testing.T) {
+		options := &TLSServerOptions{MaxVersion: tls.VersionTLS12}
+		_, err := handshake(t, options, &tls.Config{MinVersion: tls.VersionTLS13})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("we parse the TLS parameters", func(t *testing.T) {
+		if version := Must1(ParseTLSVersion("1.3")); version != tls.VersionTLS13 {
+			t.Fatal("unexpected version", version)
+		}
+		if version := Must1(ParseTLSVersion("")); version != 0 {
+			t.Fatal("unexpected version", version)
+		}
+		if suite := Must1(ParseTLSCipherSuite("TLS_RSA_WITH_RC4_128_SHA")); suite != tls.TLS_RSA_WITH_RC4_128_SHA {
+			t.Fatal("unexpected cipher suite", suite)
+		}
+		if curve := Must1(ParseTLSCurve("X25519")); curve != tls.X25519 {
+			t.Fatal("unexpected curve", curve)
+		}
+		if _, err := ParseTLSVersion("1.4"); !errors.Is(err, ErrUnknownTLSParameter) {
+			t.Fatal("unexpected error", err)
+		}
+		if _, err := ParseTLSCipherSuite("antani"); !errors.Is(err, ErrUnknownTLSParameter) {
+			t.Fatal("unexpected error", err)
+		}
+		if _, err := ParseTLSCurve("antani"); !errors.Is(err, ErrUnknownTLSParameter) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
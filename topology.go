@@ -5,9 +5,15 @@ package netem
 //
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // PPPTopology is a point-to-point topology with two network stacks and
@@ -24,8 +30,17 @@ type PPPTopology struct {
 	// closeOnce allows to have a "once" semantics for Close
 	closeOnce sync.Once
 
+	// leakCheck indicates whether we should check for leaks when closing.
+	leakCheck atomic.Bool
+
 	// link is the link connecting the stacks.
 	link *Link
+
+	// mu protects servers
+	mu sync.Mutex
+
+	// servers contains the servers to stop when closing
+	servers []io.Closer
 }
 
 // MustNewPPPTopology creates a [PPPTopology]. Use the Close method
@@ -78,20 +93,112 @@ func MustNewPPPTopology(
 		Server:    server,
 		closeOnce: sync.Once{},
 		link:      link,
+		mu:        sync.Mutex{},
+		servers:   []io.Closer{},
 	}
 	return t
 }
 
-// Close closes all the hosts and links allocated by the topology
+// CA exposes the [*CA] shared by the client and the server.
+func (t *PPPTopology) CA() *CA {
+	return t.Client.CA()
+}
+
+// TrackServer registers a server (e.g., a [DNSServer]) running on the
+// topology's hosts, such that closing the topology also stops the server.
+func (t *PPPTopology) TrackServer(server io.Closer) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.servers = append(t.servers, server)
+}
+
+// Close closes all the servers, hosts and links allocated by the topology
+// and waits for their goroutines to terminate. Because closing the link
+// closes the NIC wrappers as well, when Close returns any [PCAPDumper]
+// has finished writing. It is safe to call Close more than once.
+//
+// When the leak check is enabled (see [PPPTopology.SetLeakCheck]), Close
+// panics if it detects leaks, so that they cannot go unnoticed.
 func (t *PPPTopology) Close() error {
 	t.closeOnce.Do(func() {
-		// note: closing a [Link] also closes the
-		// two hosts using the [Link]
-		t.link.Close()
+		topologyShutdown(t.leakCheck.Load(), t.Shutdown)
 	})
 	return nil
 }
 
+// SetLeakCheck enables or disables the leak check debug mode. When enabled,
+// [PPPTopology.Shutdown] also checks whether the client and the server have
+// sockets that are still open (see [UNetStack.OpenSockets]), in which case it
+// returns [ErrResourceLeak], and [PPPTopology.Close] panics when the link
+// goroutines do not terminate within ten seconds or there are open sockets.
+func (t *PPPTopology) SetLeakCheck(enabled bool) {
+	t.leakCheck.Store(enabled)
+}
+
+// Shutdown is like [PPPTopology.Close] but stops waiting when the given
+// context expires, in which case it returns [ErrShutdownTimeout] to report
+// that some goroutines leaked. It is safe to call Shutdown more than once.
+func (t *PPPTopology) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	servers := t.servers
+	t.servers = []io.Closer{}
+	t.mu.Unlock()
+	topologyCloseServers(servers)
+
+	// note: closing a [Link] also closes the
+	// two hosts using the [Link]
+	if err := t.link.Shutdown(ctx); err != nil {
+		return err
+	}
+	if t.leakCheck.Load() {
+		return topologyCheckSockets(t.Client, t.Server)
+	}
+	return nil
+}
+
+// topologyCloseServers closes the given servers in reverse order.
+func topologyCloseServers(servers []io.Closer) {
+	for idx := len(servers) - 1; idx >= 0; idx-- {
+		servers[idx].Close()
+	}
+}
+
+// ErrResourceLeak indicates that the leak check of a topology found
+// sockets that have not been closed (see [StarTopology.SetLeakCheck]).
+var ErrResourceLeak = errors.New("netem: resource leak")
+
+// topologyLeakCheckTimeout is the time Close waits for the goroutines
+// to terminate when the leak check is enabled.
+const topologyLeakCheckTimeout = 10 * time.Second
+
+// topologyShutdown calls the given shutdown function. When the leak check is
+// enabled, we bound the time to wait and we panic on failure.
+func topologyShutdown(leakCheck bool, shutdown func(ctx context.Context) error) {
+	if !leakCheck {
+		_ = shutdown(context.Background())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), topologyLeakCheckTimeout)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		panic(err)
+	}
+}
+
+// topologyCheckSockets returns [ErrResourceLeak] if the given hosts have open sockets.
+func topologyCheckSockets(hosts ...*UNetStack) error {
+	var leaked []string
+	for _, host := range hosts {
+		for _, socket := range host.OpenSockets() {
+			leaked = append(leaked, fmt.Sprintf("%s: %s", host.IPAddress(), socket))
+		}
+	}
+	if len(leaked) > 0 {
+		return fmt.Errorf("%w: open sockets: %s", ErrResourceLeak, strings.Join(leaked, ", "))
+	}
+	return nil
+}
+
 // StarTopology is the star network topology: there is a router in the
 // middle and all hosts connect to it. The zero value is invalid; please,
 // construct using the [NewStarTopology].
@@ -105,6 +212,15 @@ type StarTopology struct {
 	// closeOnce allows to have a "once" semantics for Close
 	closeOnce sync.Once
 
+	// hostAddresses maps each link to the addresses of its host.
+	hostAddresses map[*Link][]string
+
+	// hosts contains all the hosts we have created, including the removed ones.
+	hosts []*UNetStack
+
+	// leakCheck indicates whether we should check for leaks when closing.
+	leakCheck atomic.Bool
+
 	// links contains all the links we have created
 	links []*Link
 
@@ -114,8 +230,20 @@ type StarTopology struct {
 	// mtu is the MTU to use
 	mtu uint32
 
+	// mu protects addresses, hostAddresses, hosts, links, names, servers, and subnets
+	mu sync.Mutex
+
+	// names maps the name of each named host to the host
+	names map[string]*starTopologyNamedHost
+
 	// router is the topology's router
 	router *Router
+
+	// servers contains the servers to stop when closing
+	servers []io.Closer
+
+	// subnets maps each subnet to the link we use to reach it
+	subnets map[string]*Link
 }
 
 // MustNewStarTopology constructs a new, empty [StarTopology] consisting
@@ -123,16 +251,28 @@ type StarTopology struct {
 // you can now add hosts using [AddHost], [AddHTTPServer], etc.
 func MustNewStarTopology(logger Logger) *StarTopology {
 	return &StarTopology{
-		addresses: map[string]int{},
-		ca:        MustNewCA(),
-		closeOnce: sync.Once{},
-		links:     []*Link{},
-		logger:    logger,
-		mtu:       1500,
-		router:    NewRouter(logger),
+		addresses:     map[string]int{},
+		ca:            MustNewCA(),
+		closeOnce:     sync.Once{},
+		hostAddresses: map[*Link][]string{},
+		hosts:         []*UNetStack{},
+		links:         []*Link{},
+		logger:        logger,
+		mtu:           1500,
+		mu:            sync.Mutex{},
+		names:         map[string]*starTopologyNamedHost{},
+		router:        NewRouter(logger),
+		servers:       []io.Closer{},
+		subnets:       map[string]*Link{},
 	}
 }
 
+// starTopologyNamedHost is a host added using [StarTopology.AddNamedHost].
+type starTopologyNamedHost struct {
+	host *UNetStack
+	link *Link
+}
+
 // ErrDuplicateAddr indicates that an address has already been added to a topology.
 var ErrDuplicateAddr = errors.New("netem: address has already been added")
 
@@ -144,46 +284,324 @@ var ErrDuplicateAddr = errors.New("netem: address has already been added")
 //
 // Arguments:
 //
-// - hostAddress is the IPv4 address to assign to the [UNetStack];
+// - hostAddress is the IPv4 or IPv6 address to assign to the [UNetStack];
 //
-// - resolverAddress is the IPv4 address of the resolver the [UNetStack]
+// - resolverAddress is the IPv4 or IPv6 address of the resolver the [UNetStack]
 // should use; use 0.0.0.0 if you don't need DNS resolution;
 //
 // - lc contains config for the [Link] connecting the [UNetStack]
 // to the [Router] of the [StarTopology].
+//
+// It is safe to call this method while other hosts are exchanging traffic.
+//
+// See also [StarTopology.AddDualStackHost].
 func (t *StarTopology) AddHost(
 	hostAddress string,
 	resolverAddress string,
 	lc *LinkConfig,
 ) (*UNetStack, error) {
-	if t.addresses[hostAddress] > 0 {
-		return nil, fmt.Errorf("%w: %s", ErrDuplicateAddr, hostAddress)
+	return t.addHost("", []string{hostAddress}, lc, func() (*UNetStack, error) {
+		return NewUNetStack(t.logger, t.mtu, hostAddress, t.ca, resolverAddress)
+	})
+}
+
+// AddHostWithOptions is like [StarTopology.AddHost] but also allows to configure
+// the transport-level features of the [UNetStack] (see [UNetStackOptions]).
+func (t *StarTopology) AddHostWithOptions(
+	hostAddress string,
+	resolverAddress string,
+	lc *LinkConfig,
+	options *UNetStackOptions,
+) (*UNetStack, error) {
+	return t.addHost("", []string{hostAddress}, lc, func() (*UNetStack, error) {
+		return NewUNetStackWithOptions(t.logger, t.mtu, hostAddress, t.ca, resolverAddress, options)
+	})
+}
+
+// ErrDuplicateHostName indicates that a host name has already been added to a topology.
+var ErrDuplicateHostName = errors.New("netem: host name has already been added")
+
+// AddNamedHost is like [StarTopology.AddHost] but also registers the host
+// using the given name (e.g., "client", "resolver"), such that you can later
+// get the host using [StarTopology.Host] rather than passing the returned
+// [UNetStack] around. The name is unregistered when the host is removed.
+func (t *StarTopology) AddNamedHost(
+	name string,
+	hostAddress string,
+	resolverAddress string,
+	lc *LinkConfig,
+) (*UNetStack, error) {
+	return t.addHost(name, []string{hostAddress}, lc, func() (*UNetStack, error) {
+		return NewUNetStack(t.logger, t.mtu, hostAddress, t.ca, resolverAddress)
+	})
+}
+
+// Host returns the host added using [StarTopology.AddNamedHost] with the
+// given name, if any, and whether we found such a host.
+func (t *StarTopology) Host(name string) (*UNetStack, bool) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	entry, found := t.names[name]
+	if !found {
+		return nil, false
+	}
+	return entry.host, true
+}
+
+// AddDualStackHost is like [StarTopology.AddHost] but creates a dual-stack
+// host with the given IPv4 and IPv6 addresses, which is useful to test Happy
+// Eyeballs. You can remove the host using either address.
+func (t *StarTopology) AddDualStackHost(
+	ipv4Address string,
+	ipv6Address string,
+	resolverAddress string,
+	lc *LinkConfig,
+) (*UNetStack, error) {
+	return t.addHost("", []string{ipv4Address, ipv6Address}, lc, func() (*UNetStack, error) {
+		return NewDualStackUNetStack(t.logger, t.mtu, ipv4Address, ipv6Address, t.ca, resolverAddress)
+	})
+}
+
+// addHost is the common implementation of AddHost, AddNamedHost, and
+// AddDualStackHost. The empty name means that the host is not named.
+func (t *StarTopology) addHost(
+	name string,
+	addresses []string,
+	lc *LinkConfig,
+	newHost func() (*UNetStack, error),
+) (*UNetStack, error) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	if _, found := t.names[name]; name != "" && found {
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateHostName, name)
+	}
+	for _, address := range addresses {
+		if t.addresses[address] > 0 {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateAddr, address)
+		}
 	}
-	host, err := NewUNetStack(t.logger, t.mtu, hostAddress, t.ca, resolverAddress)
+	host, err := newHost()
 	if err != nil {
 		return nil, err
 	}
 	port0 := NewRouterPort(t.router)
 	link := NewLink(t.logger, host, port0, lc) // TAKES OWNERSHIP of host and port0
 	t.links = append(t.links, link)
-	t.router.AddRoute(hostAddress, port0)
-	t.addresses[hostAddress]++
+	t.hosts = append(t.hosts, host)
+	t.hostAddresses[link] = host.IPAddresses()
+	for _, address := range host.IPAddresses() {
+		t.router.AddRoute(address, port0)
+		t.addresses[address]++
+	}
+	if name != "" {
+		t.names[name] = &starTopologyNamedHost{host: host, link: link}
+	}
 	return host, nil
 }
 
-// Close closes (a) the router and (b) all the links and
-// the hosts created using this [StarTopology].
+// linkHasAddressLocked returns whether the host connected by the given link has
+// the given address. This method MUST be called while holding the mutex.
+func (t *StarTopology) linkHasAddressLocked(ln *Link, address string) bool {
+	for _, entry := range t.hostAddresses[ln] {
+		if entry == address {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrUnknownAddr indicates that an address has not been added to a topology.
+var ErrUnknownAddr = errors.New("netem: address has not been added")
+
+// RemoveHost detaches the host with the given address from the [StarTopology]:
+// we remove the route towards the host, close the [Link] connecting the host
+// to the [Router], wait for the link's goroutines to terminate, and close the
+// host's [UNetStack]. Once the host has been removed, you can add a new host
+// using the same address. It is safe to call this method while other hosts
+// are exchanging traffic, which allows emulating devices leaving a network.
+func (t *StarTopology) RemoveHost(hostAddress string) error {
+	t.mu.Lock()
+	if t.addresses[hostAddress] <= 0 {
+		t.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownAddr, hostAddress)
+	}
+	var link *Link
+	links := []*Link{}
+	for _, ln := range t.links {
+		if link == nil && t.linkHasAddressLocked(ln, hostAddress) {
+			link = ln
+			continue
+		}
+		links = append(links, ln)
+	}
+	t.links = links
+	addresses := []string{hostAddress}
+	if link != nil {
+		addresses = t.hostAddresses[link]
+		delete(t.hostAddresses, link)
+	}
+	for name, entry := range t.names {
+		if entry.link == link {
+			delete(t.names, name)
+		}
+	}
+	for _, address := range addresses {
+		delete(t.addresses, address)
+		t.router.RemoveRoute(address)
+	}
+	t.mu.Unlock()
+
+	// note: closing a [Link] also closes the two hosts using the [Link]
+	if link != nil {
+		link.Close()
+	}
+	return nil
+}
+
+// ErrDuplicateSubnet indicates that a subnet has already been added to a topology.
+var ErrDuplicateSubnet = errors.New("netem: subnet has already been added")
+
+// ErrUnknownSubnet indicates that a subnet has not been added to a topology.
+var ErrUnknownSubnet = errors.New("netem: subnet has not been added")
+
+// AddSubnet creates a [RouterPort], creates a [Link] connecting the given
+// [NIC] to such a port, and routes the given prefix (e.g., 10.1.0.0/24)
+// through the port. The [NIC] is typically a [RouterPort] of another [Router]
+// or the server side of a [Middlebox], which allows building multi-router
+// topologies where whole subnets live behind another device. The returned
+// [Link] TAKES OWNERSHIP of the [NIC] and closing the [StarTopology] closes it.
+//
+// It is safe to call this method while other hosts are exchanging traffic.
+func (t *StarTopology) AddSubnet(prefix string, nic NIC, lc *LinkConfig) error {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return ErrNotIPPrefix
+	}
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	if t.subnets[ipNet.String()] != nil {
+		return fmt.Errorf("%w: %s", ErrDuplicateSubnet, ipNet.String())
+	}
+	port0 := NewRouterPort(t.router)
+	link := NewLink(t.logger, nic, port0, lc) // TAKES OWNERSHIP of nic and port0
+	if err := t.router.AddPrefixRoute(ipNet.String(), port0); err != nil {
+		link.Close()
+		return err
+	}
+	t.links = append(t.links, link)
+	t.subnets[ipNet.String()] = link
+	return nil
+}
+
+// RemoveSubnet removes the route for a prefix added using [StarTopology.AddSubnet]
+// and closes the corresponding [Link], thus also closing the [NIC].
+func (t *StarTopology) RemoveSubnet(prefix string) error {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return ErrNotIPPrefix
+	}
+	t.mu.Lock()
+	link := t.subnets[ipNet.String()]
+	if link == nil {
+		t.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownSubnet, ipNet.String())
+	}
+	delete(t.subnets, ipNet.String())
+	links := []*Link{}
+	for _, ln := range t.links {
+		if ln != link {
+			links = append(links, ln)
+		}
+	}
+	t.links = links
+	_ = t.router.RemovePrefixRoute(ipNet.String())
+	t.mu.Unlock()
+
+	// note: closing a [Link] also closes the two NICs using the [Link]
+	link.Close()
+	return nil
+}
+
+// SetConntrack sets the [Conntrack] of the topology's [Router] (see [Router.SetConntrack]),
+// which tracks all the flows between hosts. To track the flows of specific hosts,
+// use the Conntrack field of the [LinkConfig] of each host.
+func (t *StarTopology) SetConntrack(conntrack *Conntrack) {
+	t.router.SetConntrack(conntrack)
+}
+
+// SetTracer sets the [Tracer] of the topology's [Router] (see [Router.SetTracer]).
+// To trace the links, use the Tracer field of the [LinkConfig] of each host.
+func (t *StarTopology) SetTracer(tracer Tracer) {
+	t.router.SetTracer(tracer)
+}
+
+// TrackServer registers a server (e.g., a [DNSServer]) running on the
+// topology's hosts, such that closing the topology also stops the server.
+func (t *StarTopology) TrackServer(server io.Closer) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.servers = append(t.servers, server)
+}
+
+// Close closes (a) the servers registered using [StarTopology.TrackServer],
+// (b) the router, and (c) all the links and the hosts created using this
+// [StarTopology], and waits for their goroutines to terminate. Because closing
+// the links closes the NIC wrappers as well, when Close returns any [PCAPDumper]
+// has finished writing. It is safe to call Close more than once.
+//
+// When the leak check is enabled (see [StarTopology.SetLeakCheck]), Close
+// panics if it detects leaks, so that they cannot go unnoticed.
 func (t *StarTopology) Close() error {
 	t.closeOnce.Do(func() {
-		for _, ln := range t.links {
-			// note: closing a [Link] also closes the
-			// two hosts using the [Link]
-			ln.Close()
-		}
+		topologyShutdown(t.leakCheck.Load(), t.Shutdown)
 	})
 	return nil
 }
 
+// SetLeakCheck enables or disables the leak check debug mode. When enabled,
+// [StarTopology.Shutdown] also checks whether the hosts (including the removed
+// ones) have sockets that are still open (see [UNetStack.OpenSockets]), in which
+// case it returns [ErrResourceLeak], and [StarTopology.Close] panics when the
+// link goroutines do not terminate within ten seconds or there are open sockets.
+func (t *StarTopology) SetLeakCheck(enabled bool) {
+	t.leakCheck.Store(enabled)
+}
+
+// Shutdown is like [StarTopology.Close] but stops waiting when the given
+// context expires, in which case it returns [ErrShutdownTimeout] to report
+// that some goroutines leaked. It is safe to call Shutdown more than once.
+func (t *StarTopology) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	servers := t.servers
+	t.servers = []io.Closer{}
+	links := t.links
+	hosts := t.hosts
+	t.mu.Unlock()
+	topologyCloseServers(servers)
+
+	// note: closing a [Link] also closes the two hosts
+	// using the [Link], so we close all links in parallel
+	errch := make(chan error, len(links))
+	for _, ln := range links {
+		go func(ln *Link) {
+			errch <- ln.Shutdown(ctx)
+		}(ln)
+	}
+	var leaked int
+	for range links {
+		if err := <-errch; err != nil {
+			leaked++
+		}
+	}
+	if leaked > 0 {
+		return fmt.Errorf("%w: %d links still running", ErrShutdownTimeout, leaked)
+	}
+	if t.leakCheck.Load() {
+		return topologyCheckSockets(hosts...)
+	}
+	return nil
+}
+
 // CA exposes the [*CA].
 func (t *StarTopology) CA() *CA {
 	return t.ca
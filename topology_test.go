@@ -1,8 +1,15 @@
 package netem
 
 import (
+	"context"
 	"errors"
+	"net"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestStartTopology(t *testing.T) {
@@ -22,4 +29,397 @@ func TestStartTopology(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("AddNamedHost", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		client := Must1(topology.AddNamedHost("client", "10.0.0.2", "0.0.0.0", &LinkConfig{}))
+
+		t.Run("we can get a host by name", func(t *testing.T) {
+			host, found := topology.Host("client")
+			if !found || host != client {
+				t.Fatal("expected to find the client")
+			}
+			if _, found := topology.Host("server"); found {
+				t.Fatal("did not expect to find the server")
+			}
+		})
+
+		t.Run("we cannot add the same name more than once", func(t *testing.T) {
+			_, err := topology.AddNamedHost("client", "10.0.0.3", "0.0.0.0", &LinkConfig{})
+			if !errors.Is(err, ErrDuplicateHostName) {
+				t.Fatal("not the error we expected", err)
+			}
+		})
+
+		t.Run("removing a host unregisters its name", func(t *testing.T) {
+			Must0(topology.RemoveHost("10.0.0.2"))
+			if _, found := topology.Host("client"); found {
+				t.Fatal("did not expect to find the client")
+			}
+			if _, err := topology.AddNamedHost("client", "10.0.0.3", "0.0.0.0", &LinkConfig{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+
+	t.Run("RemoveHost", func(t *testing.T) {
+		t.Run("we cannot remove an unknown address", func(t *testing.T) {
+			topology := MustNewStarTopology(&NullLogger{})
+			defer topology.Close()
+			if err := topology.RemoveHost("1.2.3.4"); !errors.Is(err, ErrUnknownAddr) {
+				t.Fatal("not the error we expected", err)
+			}
+		})
+
+		t.Run("we can add and remove hosts while there is traffic", func(t *testing.T) {
+			topology := MustNewStarTopology(&NullLogger{})
+			defer topology.Close()
+			client := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{}))
+			serverStack := Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+			config := NewDNSConfig()
+			config.AddRecord("www.example.com", "", "10.0.0.3")
+			server := Must1(NewDNSServer(&NullLogger{}, serverStack, "10.0.0.1", config))
+			defer server.Close()
+
+			// lookup performs a lookup using the given client
+			lookup := func(client *UNetStack) error {
+				ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+				defer cancel()
+				_, _, err := client.GetaddrinfoLookupANY(ctx, "www.example.com")
+				return err
+			}
+
+			if err := lookup(client); err != nil {
+				t.Fatal(err)
+			}
+
+			// add a new host after traffic started
+			other := Must1(topology.AddHost("10.0.0.4", "10.0.0.1", &LinkConfig{}))
+			if err := lookup(other); err != nil {
+				t.Fatal(err)
+			}
+
+			// remove the first client and make sure the others still work
+			if err := topology.RemoveHost("10.0.0.2"); err != nil {
+				t.Fatal(err)
+			}
+			if err := lookup(client); err == nil {
+				t.Fatal("expected the removed host to fail")
+			}
+			if err := lookup(other); err != nil {
+				t.Fatal(err)
+			}
+
+			// make sure we can reuse the address of the removed host
+			client = Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{}))
+			if err := lookup(client); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+
+	t.Run("AddSubnet", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		client := Must1(topology.AddHost("10.0.0.2", "0.0.0.0", &LinkConfig{}))
+
+		// create a DNS server attached to another router
+		router := NewRouter(&NullLogger{})
+		serverStack := Must1(NewUNetStack(&NullLogger{}, 1500, "10.1.0.2", topology.CA(), "0.0.0.0"))
+		serverPort := NewRouterPort(router)
+		router.AddRoute("10.1.0.2", serverPort)
+		serverLink := NewLink(&NullLogger{}, serverStack, serverPort, &LinkConfig{})
+		defer serverLink.Close()
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.1.0.3")
+		server := Must1(NewDNSServer(&NullLogger{}, serverStack, "10.1.0.2", config))
+		defer server.Close()
+
+		// connect the other router to the star topology
+		gateway := NewRouterPort(router)
+		Must0(router.AddPrefixRoute("0.0.0.0/0", gateway))
+		if err := topology.AddSubnet("10.1.0.0/24", gateway, &LinkConfig{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// lookup sends a query to the DNS server
+		lookup := func(timeout time.Duration) error {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			_, err := DNSRoundTrip(ctx, client, "10.1.0.2", NewDNSRequestA("www.example.com"))
+			return err
+		}
+
+		t.Run("we can reach hosts inside the subnet", func(t *testing.T) {
+			if err := lookup(5 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		t.Run("we cannot add the same subnet twice", func(t *testing.T) {
+			err := topology.AddSubnet("10.1.0.0/24", NewRouterPort(router), &LinkConfig{})
+			if !errors.Is(err, ErrDuplicateSubnet) {
+				t.Fatal("unexpected error", err)
+			}
+		})
+
+		t.Run("we cannot reach hosts inside a removed subnet", func(t *testing.T) {
+			if err := topology.RemoveSubnet("10.1.0.0/24"); err != nil {
+				t.Fatal(err)
+			}
+			if err := lookup(250 * time.Millisecond); err == nil {
+				t.Fatal("expected an error")
+			}
+			if err := topology.RemoveSubnet("10.1.0.0/24"); !errors.Is(err, ErrUnknownSubnet) {
+				t.Fatal("unexpected error", err)
+			}
+		})
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		t.Run("we stop the servers and close the links", func(t *testing.T) {
+			topology := MustNewStarTopology(&NullLogger{})
+			host := Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+			server := Must1(NewDNSServer(&NullLogger{}, host, "10.0.0.1", NewDNSConfig()))
+			topology.TrackServer(server)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := topology.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-server.closed:
+			default:
+				t.Fatal("expected the server to be closed")
+			}
+			select {
+			case <-host.StackClosed():
+			default:
+				t.Fatal("expected the host to be closed")
+			}
+			topology.Close() // should be idempotent
+		})
+
+		t.Run("we report goroutines that do not terminate", func(t *testing.T) {
+			topology := MustNewStarTopology(&NullLogger{})
+			release, stackClosed := make(chan any), make(chan any)
+			nic := &MockableNIC{
+				MockFrameAvailable: func() <-chan any {
+					return make(chan any)
+				},
+				MockStackClosed: func() <-chan any {
+					return stackClosed
+				},
+				MockClose: func() error {
+					<-release // simulate a NIC that takes forever to close
+					close(stackClosed)
+					return nil
+				},
+				MockInterfaceName: func() string {
+					return "eth0"
+				},
+			}
+			Must0(topology.AddSubnet("10.1.0.0/24", nic, &LinkConfig{}))
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if err := topology.Shutdown(ctx); !errors.Is(err, ErrShutdownTimeout) {
+				t.Fatal("not the error we expected", err)
+			}
+			close(release)
+			topology.Close() // should wait for the link to terminate
+		})
+	})
+
+	t.Run("IPv6 and dual-stack hosts", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+
+		// create a dual-stack DNS server
+		serverStack := Must1(topology.AddDualStackHost("10.0.0.1", "2001:db8::1", "0.0.0.0", &LinkConfig{}))
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.3", "2001:db8::3")
+		for _, address := range serverStack.IPAddresses() {
+			server := Must1(NewDNSServer(&NullLogger{}, serverStack, address, config))
+			defer server.Close()
+		}
+
+		// lookup performs a lookup using the given client
+		lookup := func(client *UNetStack) ([]string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			addrs, _, err := client.GetaddrinfoLookupANY(ctx, "www.example.com")
+			return addrs, err
+		}
+
+		expectations := []struct {
+			name   string
+			create func() (*UNetStack, error)
+			expect []string
+		}{{
+			name: "IPv4-only hosts only receive IPv4 addresses",
+			create: func() (*UNetStack, error) {
+				return topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{})
+			},
+			expect: []string{"10.0.0.3"},
+		}, {
+			name: "IPv6-only hosts only receive IPv6 addresses",
+			create: func() (*UNetStack, error) {
+				return topology.AddHost("2001:db8::2", "2001:db8::1", &LinkConfig{})
+			},
+			expect: []string{"2001:db8::3"},
+		}, {
+			name: "dual-stack hosts receive IPv6 addresses first",
+			create: func() (*UNetStack, error) {
+				return topology.AddDualStackHost("10.0.0.4", "2001:db8::4", "10.0.0.1", &LinkConfig{})
+			},
+			expect: []string{"2001:db8::3", "10.0.0.3"},
+		}}
+
+		for _, expectation := range expectations {
+			t.Run(expectation.name, func(t *testing.T) {
+				client := Must1(expectation.create())
+				addrs, err := lookup(client)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(expectation.expect, addrs); diff != "" {
+					t.Fatal(diff)
+				}
+			})
+		}
+
+		t.Run("we can use TCP over IPv6", func(t *testing.T) {
+			client := Must1(topology.AddHost("2001:db8::5", "2001:db8::1", &LinkConfig{}))
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			query := NewDNSRequestAAAA("www.example.com")
+			resp, err := DNSRoundTripTCP(ctx, client, "2001:db8::1", query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs, _, err := DNSParseResponse(query, resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]string{"2001:db8::3"}, addrs); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+
+		t.Run("removing a dual-stack host releases both addresses", func(t *testing.T) {
+			Must1(topology.AddDualStackHost("10.0.0.6", "2001:db8::6", "10.0.0.1", &LinkConfig{}))
+			if err := topology.RemoveHost("2001:db8::6"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := topology.AddHost("10.0.0.6", "10.0.0.1", &LinkConfig{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		t.Run("AddDualStackHost rejects swapped address families", func(t *testing.T) {
+			_, err := topology.AddDualStackHost("2001:db8::7", "10.0.0.7", "10.0.0.1", &LinkConfig{})
+			if !errors.Is(err, syscall.EAFNOSUPPORT) {
+				t.Fatal("unexpected error", err)
+			}
+		})
+	})
+}
+
+func TestPPPTopologyIPv6(t *testing.T) {
+	topology := MustNewPPPTopology("2001:db8::2", "2001:db8::1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+	config := NewDNSConfig()
+	config.AddRecord("www.example.com", "", "2001:db8::3")
+	server := Must1(NewDNSServer(&NullLogger{}, topology.Server, "2001:db8::1", config))
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	addrs, _, err := topology.Client.GetaddrinfoLookupANY(ctx, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"2001:db8::3"}, addrs); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestStarTopologyLeakCheck(t *testing.T) {
+	t.Run("Shutdown reports the sockets that are still open", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		topology.SetLeakCheck(true)
+		client := Must1(topology.AddHost("10.0.0.2", "0.0.0.0", &LinkConfig{}))
+		server := Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+		listener := Must1(server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		conn := Must1(client.DialContext(context.Background(), "tcp", "10.0.0.1:80"))
+		serverConn := Must1(listener.Accept())
+
+		// closing the accepted conn stops tracking it
+		serverConn.Close()
+		if diff := cmp.Diff([]string{"tcp listener 10.0.0.1:80"}, server.OpenSockets()); diff != "" {
+			t.Fatal(diff)
+		}
+
+		err := topology.Shutdown(context.Background())
+		if !errors.Is(err, ErrResourceLeak) {
+			t.Fatal("not the error we expected", err)
+		}
+		for _, expect := range []string{"10.0.0.1: tcp listener 10.0.0.1:80", "10.0.0.2: tcp 10.0.0.2:"} {
+			if !strings.Contains(err.Error(), expect) {
+				t.Fatal("expected", expect, "in", err.Error())
+			}
+		}
+
+		// once we close the sockets, there should be no more leaks
+		conn.Close()
+		listener.Close()
+		listener.Close() // closing twice should be harmless
+		if err := topology.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Close panics if there are open sockets", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		topology.SetLeakCheck(true)
+		host := Must1(topology.AddHost("10.0.0.2", "0.0.0.0", &LinkConfig{}))
+		pconn := Must1(host.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353}))
+		defer pconn.Close()
+
+		defer func() {
+			err, good := recover().(error)
+			if !good || !errors.Is(err, ErrResourceLeak) {
+				t.Fatal("not the panic we expected", err)
+			}
+		}()
+		topology.Close()
+	})
+
+	t.Run("Close does not panic when the tracked servers close their sockets", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		topology.SetLeakCheck(true)
+		defer topology.Close()
+		client := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{}))
+		server := Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+		config := NewDNSConfig()
+		config.AddRecord("www.example.com", "", "10.0.0.3")
+		topology.TrackServer(Must1(NewDNSServer(&NullLogger{}, server, "10.0.0.1", config)))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, _, err := client.GetaddrinfoLookupANY(ctx, "www.example.com"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestPPPTopologyLeakCheck(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	topology.SetLeakCheck(true)
+	icmpConn := Must1(topology.Client.ListenICMP())
+	err := topology.Shutdown(context.Background())
+	if !errors.Is(err, ErrResourceLeak) || !strings.Contains(err.Error(), "10.0.0.2: icmp") {
+		t.Fatal("not the error we expected", err)
+	}
+	icmpConn.Close()
+	topology.Close()
 }
@@ -0,0 +1,557 @@
+package netem
+
+//
+// Declarative topologies
+//
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TopologyConfig is the declarative description of a star topology, which
+// you typically load from a JSON file using [LoadTopology]. For example:
+//
+//	{
+//	  "hosts": [{
+//	    "name": "client",
+//	    "address": "10.0.0.2",
+//	    "resolver": "10.0.0.1",
+//	    "link": {
+//	      "left_to_right_delay": "10ms",
+//	      "right_to_left_delay": "10ms",
+//	      "dpi": [{"rule": "reset_tls_sni", "sni": "example.com"}]
+//	    }
+//	  }, {
+//	    "address": "10.0.0.1"
+//	  }, {
+//	    "address": "10.0.0.3"
+//	  }],
+//	  "dns_servers": [{
+//	    "address": "10.0.0.1",
+//	    "records": [{"domain": "example.com", "addresses": ["10.0.0.3"]}]
+//	  }],
+//	  "http_servers": [{
+//	    "address": "10.0.0.3",
+//	    "tls": true,
+//	    "server_names": ["example.com"],
+//	    "body": "Bonsoir, Elliot!"
+//	  }]
+//	}
+type TopologyConfig struct {
+	// Hosts contains the hosts to attach to the star topology's router.
+	Hosts []*TopologyHostConfig `json:"hosts"`
+
+	// DNSServers contains the DNS servers to run on the hosts.
+	DNSServers []*TopologyDNSServerConfig `json:"dns_servers"`
+
+	// HTTPServers contains the HTTP servers to run on the hosts.
+	HTTPServers []*TopologyHTTPServerConfig `json:"http_servers"`
+}
+
+// TopologyHostConfig describes a host inside a [TopologyConfig].
+type TopologyHostConfig struct {
+	// Name is the OPTIONAL host name (e.g., "client"), which allows
+	// getting the host using [StarTopology.Host].
+	Name string `json:"name"`
+
+	// Address is the MANDATORY host IPv4 address.
+	Address string `json:"address"`
+
+	// Resolver is the OPTIONAL resolver IPv4 address (default: 0.0.0.0).
+	Resolver string `json:"resolver"`
+
+	// CongestionControl is the OPTIONAL TCP congestion control algorithm
+	// used by the host (e.g., "cubic"); see [UNetStack.SetTCPCongestionControl].
+	CongestionControl string `json:"congestion_control"`
+
+	// Link is the OPTIONAL configuration of the link connecting the
+	// host (the left NIC) to the router (the right NIC).
+	Link *TopologyLinkConfig `json:"link"`
+}
+
+// TopologyLinkConfig describes a [LinkConfig] inside a [TopologyConfig].
+type TopologyLinkConfig struct {
+	// LeftToRightDelay is the OPTIONAL left->right delay (e.g., "10ms").
+	LeftToRightDelay string `json:"left_to_right_delay"`
+
+	// LeftToRightPLR is the OPTIONAL left->right packet-loss rate.
+	LeftToRightPLR float64 `json:"left_to_right_plr"`
+
+	// RightToLeftDelay is the OPTIONAL right->left delay (e.g., "10ms").
+	RightToLeftDelay string `json:"right_to_left_delay"`
+
+	// RightToLeftPLR is the OPTIONAL right->left packet-loss rate.
+	RightToLeftPLR float64 `json:"right_to_left_plr"`
+
+	// DPI contains the OPTIONAL DPI rules to apply to the link.
+	DPI []*TopologyDPIRuleConfig `json:"dpi"`
+}
+
+// TopologyDPIRuleConfig describes a [DPIRule] inside a [TopologyConfig]. The
+// Rule field selects the rule and determines which other fields are used:
+//
+// - "close_endpoint": [DPICloseConnectionForServerEndpoint] (address, port);
+//
+// - "close_string": [DPICloseConnectionForString] (address, port, string);
+//
+// - "close_tls_sni": [DPICloseConnectionForTLSSNI] (sni);
+//
+// - "drop_endpoint": [DPIDropTrafficForServerEndpoint] (address, port, protocol);
+//
+// - "drop_string": [DPIDropTrafficForString] (address, port, string);
+//
+// - "drop_tls_sni": [DPIDropTrafficForTLSSNI] (sni);
+//
+// - "reset_string": [DPIResetTrafficForString] (address, port, string);
+//
+// - "reset_tls_sni": [DPIResetTrafficForTLSSNI] (sni);
+//
+// - "spoof_blockpage": [DPISpoofBlockpageForString] (address, port, string, body);
+//
+// - "spoof_dns": [DPISpoofDNSResponse] (domain, addresses);
+//
+// - "throttle_endpoint": [DPIThrottleTrafficForTCPEndpoint] (address, port, delay, plr);
+//
+// - "throttle_tls_sni": [DPIThrottleTrafficForTLSSNI] (sni, delay, plr).
+type TopologyDPIRuleConfig struct {
+	// Rule is the MANDATORY rule name.
+	Rule string `json:"rule"`
+
+	// Address is the server IPv4 address.
+	Address string `json:"address"`
+
+	// Addresses contains the addresses for spoofed DNS responses.
+	Addresses []string `json:"addresses"`
+
+	// Body is the blockpage body.
+	Body string `json:"body"`
+
+	// Delay is the throttling delay (e.g., "10ms").
+	Delay string `json:"delay"`
+
+	// Domain is the domain for spoofed DNS responses.
+	Domain string `json:"domain"`
+
+	// PLR is the throttling packet-loss rate.
+	PLR float64 `json:"plr"`
+
+	// Port is the server port.
+	Port uint16 `json:"port"`
+
+	// Protocol is the server protocol: "tcp" (the default) or "udp".
+	Protocol string `json:"protocol"`
+
+	// SNI is the TLS SNI.
+	SNI string `json:"sni"`
+
+	// String is the string to search inside the packets.
+	String string `json:"string"`
+}
+
+// TopologyDNSServerConfig describes a [DNSServer] inside a [TopologyConfig].
+type TopologyDNSServerConfig struct {
+	// Address is the MANDATORY address of the host running the server.
+	Address string `json:"address"`
+
+	// Records contains the OPTIONAL records to serve.
+	Records []*TopologyDNSRecordConfig `json:"records"`
+}
+
+// TopologyDNSRecordConfig describes a record served by a DNS server
+// inside a [TopologyConfig]. See [DNSConfig.AddRecord].
+type TopologyDNSRecordConfig struct {
+	// Domain is the MANDATORY domain.
+	Domain string `json:"domain"`
+
+	// CNAME is the OPTIONAL CNAME.
+	CNAME string `json:"cname"`
+
+	// Addresses contains the OPTIONAL IP addresses.
+	Addresses []string `json:"addresses"`
+}
+
+// TopologyHTTPServerConfig describes an HTTP server inside a [TopologyConfig]
+// that responds to all the requests using the same status code and body.
+type TopologyHTTPServerConfig struct {
+	// Address is the MANDATORY address of the host running the server.
+	Address string `json:"address"`
+
+	// Port is the OPTIONAL port (default: 80 for HTTP and 443 for HTTPS).
+	Port uint16 `json:"port"`
+
+	// TLS OPTIONALLY indicates we should serve HTTPS.
+	TLS bool `json:"tls"`
+
+	// H2C OPTIONALLY indicates we should also serve HTTP/2 cleartext when not using TLS.
+	H2C bool `json:"h2c"`
+
+	// ServerNames contains OPTIONAL extra names for the certificate, which
+	// by default only includes the server's IP address.
+	ServerNames []string `json:"server_names"`
+
+	// TLSMinVersion is the OPTIONAL minimum TLS version (e.g., "1.2").
+	TLSMinVersion string `json:"tls_min_version"`
+
+	// TLSMaxVersion is the OPTIONAL maximum TLS version (e.g., "1.2").
+	TLSMaxVersion string `json:"tls_max_version"`
+
+	// TLSCipherSuites contains the OPTIONAL TLS 1.0-1.2 cipher suites
+	// (e.g., "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256").
+	TLSCipherSuites []string `json:"tls_cipher_suites"`
+
+	// TLSCurves contains the OPTIONAL key exchange curves (e.g., "X25519").
+	TLSCurves []string `json:"tls_curves"`
+
+	// TLSSessionTicketsDisabled OPTIONALLY disables TLS session resumption.
+	TLSSessionTicketsDisabled bool `json:"tls_session_tickets_disabled"`
+
+	// StatusCode is the OPTIONAL status code (default: 200).
+	StatusCode int `json:"status_code"`
+
+	// Body is the OPTIONAL response body.
+	Body string `json:"body"`
+}
+
+// ErrTopologyConfig indicates that a [TopologyConfig] is invalid.
+var ErrTopologyConfig = errors.New("netem: invalid topology config")
+
+// LoadedTopology is a [StarTopology] built using [LoadTopology] along with
+// the servers running on its hosts. The zero value is invalid; please, use
+// [LoadTopology] to construct. Remember to call [LoadedTopology.Close].
+type LoadedTopology struct {
+	// Hosts maps the address of each host to the corresponding [UNetStack].
+	Hosts map[string]*UNetStack
+
+	// Topology is the underlying [StarTopology], which also
+	// owns the servers running on the hosts.
+	Topology *StarTopology
+}
+
+// LoadTopology reads a JSON [TopologyConfig] from the given reader and
+// uses it to build a [LoadedTopology]. We reject unknown JSON fields.
+func LoadTopology(logger Logger, reader io.Reader) (*LoadedTopology, error) {
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	config := &TopologyConfig{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTopologyConfig, err.Error())
+	}
+	return NewTopologyFromConfig(logger, config)
+}
+
+// NewTopologyFromConfig is like [LoadTopology] but uses an
+// already-parsed [TopologyConfig].
+func NewTopologyFromConfig(logger Logger, config *TopologyConfig) (*LoadedTopology, error) {
+	lt := &LoadedTopology{
+		Hosts:    map[string]*UNetStack{},
+		Topology: MustNewStarTopology(logger),
+	}
+	if err := lt.build(logger, config); err != nil {
+		lt.Close()
+		return nil, err
+	}
+	return lt, nil
+}
+
+// build builds the topology described by the config.
+func (lt *LoadedTopology) build(logger Logger, config *TopologyConfig) error {
+	for _, hc := range config.Hosts {
+		lc, err := hc.Link.newLinkConfig(logger)
+		if err != nil {
+			return err
+		}
+		resolver := hc.Resolver
+		if resolver == "" {
+			resolver = "0.0.0.0"
+		}
+		host, err := lt.Topology.AddNamedHost(hc.Name, hc.Address, resolver, lc)
+		if err != nil {
+			return err
+		}
+		if hc.CongestionControl != "" {
+			if err := host.SetTCPCongestionControl(hc.CongestionControl); err != nil {
+				return fmt.Errorf("%w: %s: %s", ErrTopologyConfig, hc.Address, err.Error())
+			}
+		}
+		lt.Hosts[hc.Address] = host
+	}
+
+	for _, sc := range config.DNSServers {
+		host, err := lt.host(sc.Address)
+		if err != nil {
+			return err
+		}
+		dnsConfig := NewDNSConfig()
+		for _, rc := range sc.Records {
+			if err := dnsConfig.AddRecord(rc.Domain, rc.CNAME, rc.Addresses...); err != nil {
+				return fmt.Errorf("%w: %s: %s", ErrTopologyConfig, rc.Domain, err.Error())
+			}
+		}
+		server, err := NewDNSServer(logger, host, sc.Address, dnsConfig)
+		if err != nil {
+			return err
+		}
+		lt.Topology.TrackServer(server)
+	}
+
+	for _, sc := range config.HTTPServers {
+		host, err := lt.host(sc.Address)
+		if err != nil {
+			return err
+		}
+		server, err := sc.newServer(host)
+		if err != nil {
+			return err
+		}
+		lt.Topology.TrackServer(server)
+	}
+
+	return nil
+}
+
+// host returns the host with the given address or an error.
+func (lt *LoadedTopology) host(address string) (*UNetStack, error) {
+	host, found := lt.Hosts[address]
+	if !found {
+		return nil, fmt.Errorf("%w: no such host: %s", ErrTopologyConfig, address)
+	}
+	return host, nil
+}
+
+// Close closes the servers and the underlying [StarTopology].
+func (lt *LoadedTopology) Close() error {
+	return lt.Topology.Close()
+}
+
+// Shutdown is like [LoadedTopology.Close] but stops waiting when the given
+// context expires. See [StarTopology.Shutdown] for more details.
+func (lt *LoadedTopology) Shutdown(ctx context.Context) error {
+	return lt.Topology.Shutdown(ctx)
+}
+
+// newLinkConfig creates a new [LinkConfig] from a [TopologyLinkConfig].
+func (tlc *TopologyLinkConfig) newLinkConfig(logger Logger) (*LinkConfig, error) {
+	lc := &LinkConfig{}
+	if tlc == nil {
+		return lc, nil
+	}
+	var err error
+	if lc.LeftToRightDelay, err = topologyParseDuration(tlc.LeftToRightDelay); err != nil {
+		return nil, err
+	}
+	if lc.RightToLeftDelay, err = topologyParseDuration(tlc.RightToLeftDelay); err != nil {
+		return nil, err
+	}
+	lc.LeftToRightPLR = tlc.LeftToRightPLR
+	lc.RightToLeftPLR = tlc.RightToLeftPLR
+	if len(tlc.DPI) > 0 {
+		lc.DPIEngine = NewDPIEngine(logger)
+		for _, rc := range tlc.DPI {
+			rule, err := rc.newRule(logger)
+			if err != nil {
+				return nil, err
+			}
+			lc.DPIEngine.AddRule(rule)
+		}
+	}
+	return lc, nil
+}
+
+// newRule creates a new [DPIRule] from a [TopologyDPIRuleConfig].
+func (rc *TopologyDPIRuleConfig) newRule(logger Logger) (DPIRule, error) {
+	delay, err := topologyParseDuration(rc.Delay)
+	if err != nil {
+		return nil, err
+	}
+	switch rc.Rule {
+	case "close_endpoint":
+		return &DPICloseConnectionForServerEndpoint{
+			Logger:          logger,
+			ServerIPAddress: rc.Address,
+			ServerPort:      rc.Port,
+		}, nil
+
+	case "close_string":
+		return &DPICloseConnectionForString{
+			Logger:          logger,
+			ServerIPAddress: rc.Address,
+			ServerPort:      rc.Port,
+			String:          rc.String,
+		}, nil
+
+	case "close_tls_sni":
+		return &DPICloseConnectionForTLSSNI{
+			Logger: logger,
+			SNI:    rc.SNI,
+		}, nil
+
+	case "drop_endpoint":
+		protocol := layers.IPProtocolTCP
+		switch strings.ToLower(rc.Protocol) {
+		case "", "tcp":
+			// nothing
+		case "udp":
+			protocol = layers.IPProtocolUDP
+		default:
+			return nil, fmt.Errorf("%w: unknown protocol: %s", ErrTopologyConfig, rc.Protocol)
+		}
+		return &DPIDropTrafficForServerEndpoint{
+			Logger:          logger,
+			ServerIPAddress: rc.Address,
+			ServerPort:      rc.Port,
+			ServerProtocol:  protocol,
+		}, nil
+
+	case "drop_string":
+		return &DPIDropTrafficForString{
+			Logger:          logger,
+			ServerIPAddress: rc.Address,
+			ServerPort:      rc.Port,
+			String:          rc.String,
+		}, nil
+
+	case "drop_tls_sni":
+		return &DPIDropTrafficForTLSSNI{
+			Logger: logger,
+			SNI:    rc.SNI,
+		}, nil
+
+	case "reset_string":
+		return &DPIResetTrafficForString{
+			Logger:          logger,
+			ServerIPAddress: rc.Address,
+			ServerPort:      rc.Port,
+			String:          rc.String,
+		}, nil
+
+	case "reset_tls_sni":
+		return &DPIResetTrafficForTLSSNI{
+			Logger: logger,
+			SNI:    rc.SNI,
+		}, nil
+
+	case "spoof_blockpage":
+		return &DPISpoofBlockpageForString{
+			HTTPResponse:    DPIFormatHTTPResponse([]byte(rc.Body)),
+			Logger:          logger,
+			ServerIPAddress: rc.Address,
+			ServerPort:      rc.Port,
+			String:          rc.String,
+		}, nil
+
+	case "spoof_dns":
+		return &DPISpoofDNSResponse{
+			Addresses: rc.Addresses,
+			Logger:    logger,
+			Domain:    rc.Domain,
+		}, nil
+
+	case "throttle_endpoint":
+		return &DPIThrottleTrafficForTCPEndpoint{
+			Delay:           delay,
+			Logger:          logger,
+			PLR:             rc.PLR,
+			ServerIPAddress: rc.Address,
+			ServerPort:      rc.Port,
+		}, nil
+
+	case "throttle_tls_sni":
+		return &DPIThrottleTrafficForTLSSNI{
+			Delay:  delay,
+			Logger: logger,
+			PLR:    rc.PLR,
+			SNI:    rc.SNI,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: unknown DPI rule: %s", ErrTopologyConfig, rc.Rule)
+	}
+}
+
+// newServer creates and starts a new HTTP server on the given host.
+func (sc *TopologyHTTPServerConfig) newServer(host *UNetStack) (io.Closer, error) {
+	port := sc.Port
+	if port == 0 {
+		port = 80
+		if sc.TLS {
+			port = 443
+		}
+	}
+	statusCode := sc.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	tlsOptions, err := sc.tlsOptions()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := host.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(sc.Address), Port: int(port)})
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(statusCode)
+			w.Write([]byte(sc.Body))
+		}),
+	}
+	if sc.H2C && !sc.TLS {
+		server.Handler = NewH2CHandler(server.Handler)
+	}
+	if sc.TLS {
+		server.TLSConfig = host.MustNewServerTLSConfigWithOptions(tlsOptions, sc.Address, sc.ServerNames...)
+		go server.ServeTLS(listener, "", "") // empty string: use .TLSConfig
+		return server, nil
+	}
+	go server.Serve(listener)
+	return server, nil
+}
+
+// tlsOptions returns the [TLSServerOptions] of the server.
+func (sc *TopologyHTTPServerConfig) tlsOptions() (*TLSServerOptions, error) {
+	options := &TLSServerOptions{SessionTicketsDisabled: sc.TLSSessionTicketsDisabled}
+	var err error
+	if options.MinVersion, err = ParseTLSVersion(sc.TLSMinVersion); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTopologyConfig, err.Error())
+	}
+	if options.MaxVersion, err = ParseTLSVersion(sc.TLSMaxVersion); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTopologyConfig, err.Error())
+	}
+	for _, name := range sc.TLSCipherSuites {
+		suite, err := ParseTLSCipherSuite(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrTopologyConfig, err.Error())
+		}
+		options.CipherSuites = append(options.CipherSuites, suite)
+	}
+	for _, name := range sc.TLSCurves {
+		curve, err := ParseTLSCurve(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrTopologyConfig, err.Error())
+		}
+		options.CurvePreferences = append(options.CurvePreferences, curve)
+	}
+	return options, nil
+}
+
+// topologyParseDuration parses a duration where the empty string means zero.
+func topologyParseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrTopologyConfig, err.Error())
+	}
+	return duration, nil
+}
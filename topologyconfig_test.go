@@ -0,0 +1,111 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLoadTopology(t *testing.T) {
+	t.Run("we can load a topology", func(t *testing.T) {
+		const config = `{
+			"hosts": [{
+				"name": "client",
+				"address": "10.0.0.2",
+				"resolver": "10.0.0.1",
+				"link": {
+					"left_to_right_delay": "1ms",
+					"right_to_left_delay": "1ms",
+					"dpi": [{"rule": "reset_tls_sni", "sni": "blocked.example.com"}]
+				}
+			}, {
+				"address": "10.0.0.1"
+			}, {
+				"address": "10.0.0.3",
+				"congestion_control": "cubic"
+			}],
+			"dns_servers": [{
+				"address": "10.0.0.1",
+				"records": [
+					{"domain": "www.example.com", "addresses": ["10.0.0.3"]},
+					{"domain": "blocked.example.com", "addresses": ["10.0.0.3"]}
+				]
+			}],
+			"http_servers": [{
+				"address": "10.0.0.3",
+				"tls": true,
+				"server_names": ["www.example.com", "blocked.example.com"],
+				"tls_max_version": "1.2",
+				"tls_cipher_suites": ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"],
+				"body": "Bonsoir, Elliot!"
+			}]
+		}`
+		topology, err := LoadTopology(&NullLogger{}, strings.NewReader(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer topology.Close()
+
+		host, found := topology.Topology.Host("client")
+		if !found || host != topology.Hosts["10.0.0.2"] {
+			t.Fatal("expected to find the client by name")
+		}
+		if cc := topology.Hosts["10.0.0.3"].TCPCongestionControl(); cc != TCPCongestionControlCUBIC {
+			t.Fatal("unexpected congestion control", cc)
+		}
+		client := &http.Client{Transport: NewHTTPTransport(host)}
+		fetch := func(URL string) (string, error) {
+			req, err := http.NewRequestWithContext(context.Background(), "GET", URL, nil)
+			if err != nil {
+				return "", err
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			return string(data), err
+		}
+
+		body, err := fetch("https://www.example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected body", body)
+		}
+		if _, err := fetch("https://blocked.example.com/"); !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we reject invalid configurations", func(t *testing.T) {
+		configs := map[string]string{
+			"unknown field":   `{"antani": 1}`,
+			"unknown rule":    `{"hosts": [{"address": "10.0.0.1", "link": {"dpi": [{"rule": "antani"}]}}]}`,
+			"bad duration":    `{"hosts": [{"address": "10.0.0.1", "link": {"left_to_right_delay": "antani"}}]}`,
+			"bad protocol":    `{"hosts": [{"address": "10.0.0.1", "link": {"dpi": [{"rule": "drop_endpoint", "protocol": "sctp"}]}}]}`,
+			"unknown host":    `{"dns_servers": [{"address": "10.0.0.1"}]}`,
+			"bad congestion":  `{"hosts": [{"address": "10.0.0.1", "congestion_control": "antani"}]}`,
+			"bad DNS address": `{"hosts": [{"address": "10.0.0.1"}], "dns_servers": [{"address": "10.0.0.1", "records": [{"domain": "x.org", "addresses": ["antani"]}]}]}`,
+			"bad TLS version": `{"hosts": [{"address": "10.0.0.1"}], "http_servers": [{"address": "10.0.0.1", "tls": true, "tls_max_version": "1.4"}]}`,
+			"bad TLS curve":   `{"hosts": [{"address": "10.0.0.1"}], "http_servers": [{"address": "10.0.0.1", "tls": true, "tls_curves": ["antani"]}]}`,
+		}
+		for name, config := range configs {
+			t.Run(name, func(t *testing.T) {
+				topology, err := LoadTopology(&NullLogger{}, strings.NewReader(config))
+				if !errors.Is(err, ErrTopologyConfig) {
+					t.Fatal("unexpected error", err)
+				}
+				if topology != nil {
+					t.Fatal("expected nil topology")
+				}
+			})
+		}
+	})
+}
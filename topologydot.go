@@ -0,0 +1,61 @@
+package netem
+
+//
+// Graphviz export of topologies
+//
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExportDOT returns a Graphviz DOT graph describing the [PPPTopology],
+// where the edge representing the [Link] is annotated with the link's
+// delay, packet-loss rate, and DPI rules. You can render the graph
+// using, e.g., `dot -Tpng -o topology.png`.
+func (t *PPPTopology) ExportDOT() string {
+	var b strings.Builder
+	b.WriteString("graph netem {\n")
+	fmt.Fprintf(&b, "\t%q [shape=ellipse];\n", t.Client.IPAddress())
+	fmt.Fprintf(&b, "\t%q [shape=ellipse];\n", t.Server.IPAddress())
+	fmt.Fprintf(&b, "\t%q -- %q [label=%q];\n", t.Client.IPAddress(), t.Server.IPAddress(), t.link.config.dotLabel())
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// ExportDOT returns a Graphviz DOT graph describing the [StarTopology],
+// where each edge connecting a host to the router is annotated with the
+// corresponding [Link]'s delay, packet-loss rate, and DPI rules. You can
+// render the graph using, e.g., `dot -Tpng -o topology.png`.
+func (t *StarTopology) ExportDOT() string {
+	t.mu.Lock()
+	links := append([]*Link{}, t.links...)
+	t.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("graph netem {\n")
+	b.WriteString("\t\"router\" [shape=box];\n")
+	for _, link := range links {
+		fmt.Fprintf(&b, "\t%q [shape=ellipse];\n", link.left.IPAddress())
+	}
+	for _, link := range links {
+		fmt.Fprintf(&b, "\t%q -- \"router\" [label=%q];\n", link.left.IPAddress(), link.config.dotLabel())
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// dotLabel returns the label describing the [LinkConfig] in a DOT graph.
+func (lc *LinkConfig) dotLabel() string {
+	lines := []string{
+		fmt.Sprintf("L->R: delay=%s plr=%g", lc.LeftToRightDelay, lc.LeftToRightPLR),
+		fmt.Sprintf("R->L: delay=%s plr=%g", lc.RightToLeftDelay, lc.RightToLeftPLR),
+	}
+	if lc.DPIEngine != nil {
+		rules, _ := lc.DPIEngine.getRulesShallowCopy()
+		for _, rule := range rules {
+			lines = append(lines, "DPI: "+strings.TrimPrefix(fmt.Sprintf("%T", rule), "*netem."))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,52 @@
+package netem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExportDOT(t *testing.T) {
+	t.Run("StarTopology", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		dpi := NewDPIEngine(&NullLogger{})
+		dpi.AddRule(&DPIResetTrafficForTLSSNI{Logger: &NullLogger{}, SNI: "example.com"})
+		Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{
+			DPIEngine:        dpi,
+			LeftToRightDelay: 10 * time.Millisecond,
+			RightToLeftPLR:   0.01,
+		}))
+		Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+
+		expect := `graph netem {
+	"router" [shape=box];
+	"10.0.0.2" [shape=ellipse];
+	"10.0.0.1" [shape=ellipse];
+	"10.0.0.2" -- "router" [label="L->R: delay=10ms plr=0\nR->L: delay=0s plr=0.01\nDPI: DPIResetTrafficForTLSSNI"];
+	"10.0.0.1" -- "router" [label="L->R: delay=0s plr=0\nR->L: delay=0s plr=0"];
+}
+`
+		if diff := cmp.Diff(expect, topology.ExportDOT()); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("PPPTopology", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{
+			LeftToRightDelay: time.Millisecond,
+			RightToLeftDelay: time.Millisecond,
+		})
+		defer topology.Close()
+		expect := `graph netem {
+	"10.0.0.2" [shape=ellipse];
+	"10.0.0.1" [shape=ellipse];
+	"10.0.0.2" -- "10.0.0.1" [label="L->R: delay=1ms plr=0\nR->L: delay=1ms plr=0"];
+}
+`
+		if diff := cmp.Diff(expect, topology.ExportDOT()); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+}
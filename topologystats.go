@@ -0,0 +1,121 @@
+package netem
+
+//
+// Topology statistics
+//
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// TopologyStats aggregates the statistics of the components of a topology
+// into a single JSON-serializable struct, which allows long-running emulations
+// to periodically report their health and results.
+type TopologyStats struct {
+	// DNSServers contains the statistics of the [DNSServer]s registered
+	// using the topology's TrackServer method.
+	DNSServers []DNSServerStats `json:"dns_servers"`
+
+	// Links contains the statistics of each link.
+	Links []TopologyLinkStats `json:"links"`
+
+	// Router contains the statistics of the router, if any.
+	Router *RouterStats `json:"router,omitempty"`
+
+	// Time is when we collected the statistics.
+	Time time.Time `json:"time"`
+}
+
+// TopologyLinkStats contains the statistics of a link within a topology.
+type TopologyLinkStats struct {
+	// Addresses contains the addresses of the host connected by the link
+	// or the subnet reachable through the link.
+	Addresses []string `json:"addresses"`
+
+	// DPI contains the statistics of the link's [DPIEngine], if any.
+	DPI *DPIEngineStats `json:"dpi,omitempty"`
+
+	// Link contains the link statistics. For a [StarTopology], the left
+	// side of the link is the host and the right side is the router.
+	Link LinkStats `json:"link"`
+
+	// RouterPort contains the statistics of the router port, if any.
+	RouterPort *RouterPortStats `json:"router_port,omitempty"`
+}
+
+// newTopologyLinkStats creates the [TopologyLinkStats] of the given link.
+func newTopologyLinkStats(link *Link, addresses []string) TopologyLinkStats {
+	stats := TopologyLinkStats{
+		Addresses: addresses,
+		Link:      link.Stats(),
+	}
+	if dpi := link.config.DPIEngine; dpi != nil {
+		dpiStats := dpi.Stats()
+		stats.DPI = &dpiStats
+	}
+	return stats
+}
+
+// topologyDNSServerStats returns the statistics of the [DNSServer]s among the servers.
+func topologyDNSServerStats(servers []io.Closer) []DNSServerStats {
+	out := []DNSServerStats{}
+	for _, server := range servers {
+		if ds, good := server.(*DNSServer); good {
+			out = append(out, ds.Stats())
+		}
+	}
+	return out
+}
+
+// Stats returns a snapshot of the [PPPTopology] statistics.
+func (t *PPPTopology) Stats() *TopologyStats {
+	t.mu.Lock()
+	servers := append([]io.Closer{}, t.servers...)
+	t.mu.Unlock()
+	addresses := append(t.Client.IPAddresses(), t.Server.IPAddresses()...)
+	return &TopologyStats{
+		DNSServers: topologyDNSServerStats(servers),
+		Links:      []TopologyLinkStats{newTopologyLinkStats(t.link, addresses)},
+		Router:     nil,
+		Time:       time.Now(),
+	}
+}
+
+// Stats returns a snapshot of the [StarTopology] statistics.
+func (t *StarTopology) Stats() *TopologyStats {
+	t.mu.Lock()
+	servers := append([]io.Closer{}, t.servers...)
+	links := []TopologyLinkStats{}
+	for _, link := range t.links {
+		addresses := t.hostAddresses[link]
+		for prefix, subnetLink := range t.subnets {
+			if subnetLink == link {
+				addresses = []string{prefix}
+			}
+		}
+		stats := newTopologyLinkStats(link, addresses)
+		if len(addresses) > 0 {
+			ip, _, _ := net.ParseCIDR(addresses[0])
+			address := addresses[0]
+			if ip != nil {
+				address = ip.String()
+			}
+			if port := t.router.lookupRoute(address); port != nil {
+				portStats := port.Stats()
+				stats.RouterPort = &portStats
+			}
+		}
+		links = append(links, stats)
+	}
+	t.mu.Unlock()
+
+	routerStats := t.router.Stats()
+	return &TopologyStats{
+		DNSServers: topologyDNSServerStats(servers),
+		Links:      links,
+		Router:     &routerStats,
+		Time:       time.Now(),
+	}
+}
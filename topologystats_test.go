@@ -0,0 +1,118 @@
+package netem
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+)
+
+func TestStarTopologyStats(t *testing.T) {
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+
+	server := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", &LinkConfig{}))
+	dpi := NewDPIEngine(&NullLogger{})
+	dpi.AddRule(&DPIDropTrafficForServerEndpoint{
+		Logger:          &NullLogger{},
+		ServerIPAddress: "10.0.0.1",
+		ServerPort:      443,
+		ServerProtocol:  layers.IPProtocolTCP,
+	})
+	client := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{DPIEngine: dpi}))
+
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.1"))
+	topology.TrackServer(Must1(NewDNSServer(&NullLogger{}, server, "10.0.0.1", dnsConfig)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if _, _, err := client.GetaddrinfoLookupANY(ctx, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.GetaddrinfoLookupANY(ctx, "www.example.org"); err == nil {
+		t.Fatal("expected NXDOMAIN")
+	}
+	if conn, err := client.DialContext(ctx, "tcp", "10.0.0.1:443"); err == nil {
+		conn.Close()
+		t.Fatal("expected the DPI to drop the SYN")
+	}
+
+	stats := topology.Stats()
+
+	t.Run("the DNS server statistics", func(t *testing.T) {
+		if len(stats.DNSServers) != 1 {
+			t.Fatal("expected one DNS server")
+		}
+		dnsStats := stats.DNSServers[0]
+		if dnsStats.Address != "10.0.0.1" || dnsStats.Queries < 2 || dnsStats.Dropped != 0 ||
+			dnsStats.Rcodes[dns.RcodeToString[dns.RcodeSuccess]] < 1 ||
+			dnsStats.Rcodes[dns.RcodeToString[dns.RcodeNameError]] < 1 {
+			t.Fatalf("unexpected DNS server stats: %+v", dnsStats)
+		}
+	})
+
+	t.Run("the link and DPI statistics", func(t *testing.T) {
+		if len(stats.Links) != 2 {
+			t.Fatal("expected two links")
+		}
+		clientLink := stats.Links[1]
+		if len(clientLink.Addresses) != 1 || clientLink.Addresses[0] != "10.0.0.2" {
+			t.Fatal("unexpected addresses", clientLink.Addresses)
+		}
+		if clientLink.Link.LeftToRight.FramesDelivered <= 0 || clientLink.Link.LeftToRight.BytesDelivered <= 0 ||
+			clientLink.Link.LeftToRight.FramesDropped <= 0 || clientLink.Link.RightToLeft.FramesDelivered <= 0 {
+			t.Fatalf("unexpected link stats: %+v", clientLink.Link)
+		}
+		if clientLink.DPI == nil || len(clientLink.DPI.Rules) != 1 || clientLink.DPI.Packets <= 0 {
+			t.Fatalf("unexpected DPI stats: %+v", clientLink.DPI)
+		}
+		rule := clientLink.DPI.Rules[0]
+		if rule.Rule != "DPIDropTrafficForServerEndpoint" || rule.Flows != 1 || rule.Packets < 1 {
+			t.Fatalf("unexpected rule stats: %+v", rule)
+		}
+		if clientLink.RouterPort == nil || stats.Links[0].DPI != nil {
+			t.Fatal("unexpected router port or DPI stats")
+		}
+	})
+
+	t.Run("the router statistics", func(t *testing.T) {
+		if stats.Router == nil || stats.Router.Hosts["10.0.0.2"].BytesSent <= 0 {
+			t.Fatalf("unexpected router stats: %+v", stats.Router)
+		}
+	})
+
+	t.Run("the statistics are JSON serializable", func(t *testing.T) {
+		data := Must1(json.Marshal(stats))
+		var decoded TopologyStats
+		Must0(json.Unmarshal(data, &decoded))
+		if decoded.Links[1].Link.LeftToRight.FramesDropped != stats.Links[1].Link.LeftToRight.FramesDropped {
+			t.Fatal("unexpected decoded stats")
+		}
+	})
+}
+
+func TestPPPTopologyStats(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.1"))
+	topology.TrackServer(Must1(NewDNSServer(&NullLogger{}, topology.Server, "10.0.0.1", dnsConfig)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := topology.Client.GetaddrinfoLookupANY(ctx, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := topology.Stats()
+	if stats.Router != nil || len(stats.Links) != 1 || len(stats.DNSServers) != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if stats.Links[0].Link.LeftToRight.FramesDelivered <= 0 || stats.DNSServers[0].Queries <= 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
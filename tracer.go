@@ -0,0 +1,162 @@
+package netem
+
+//
+// Event tracing along the packet path
+//
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Tracer receives the [TraceEvent]s emitted along the packet path, which
+// allows experiments to reconstruct causality (e.g., which DPI verdict caused
+// a frame to be dropped) without comparing PCAP files. Use the Tracer field of
+// [LinkConfig] and [DNSServerOptions] and [Router.SetTracer] to configure
+// tracing. Implementations MUST be safe for concurrent use and SHOULD NOT
+// block, since we call them from the packet forwarding goroutines.
+type Tracer interface {
+	OnTraceEvent(ev *TraceEvent)
+}
+
+// TraceEventType is the type of a [TraceEvent].
+type TraceEventType string
+
+const (
+	// TraceEventFrameEnqueued indicates that a link read a frame from its
+	// sending NIC and enqueued it for transmission.
+	TraceEventFrameEnqueued = TraceEventType("frame_enqueued")
+
+	// TraceEventFrameDelayed indicates that a link scheduled a frame for
+	// delivery after the delay contained in the event.
+	TraceEventFrameDelayed = TraceEventType("frame_delayed")
+
+	// TraceEventFrameDropped indicates that a link dropped a frame for
+	// the reason contained in the event (e.g., "plr").
+	TraceEventFrameDropped = TraceEventType("frame_dropped")
+
+	// TraceEventFrameDelivered indicates that a link wrote a frame to
+	// its receiving NIC.
+	TraceEventFrameDelivered = TraceEventType("frame_delivered")
+
+	// TraceEventDPIVerdict indicates that the [DPIEngine] applied the
+	// [DPIPolicy] contained in the event to a frame.
+	TraceEventDPIVerdict = TraceEventType("dpi_verdict")
+
+	// TraceEventRouterForward indicates that a [Router] forwarded a packet.
+	TraceEventRouterForward = TraceEventType("router_forward")
+
+	// TraceEventRouterDrop indicates that a [Router] dropped a packet for
+	// the reason contained in the event (e.g., "no_route"). See [RouterStats]
+	// for the counters of the dropped packets by reason.
+	TraceEventRouterDrop = TraceEventType("router_drop")
+
+	// TraceEventDNSQueryServed indicates that a [DNSServer] responded to
+	// a query or dropped it, as indicated by the event reason.
+	TraceEventDNSQueryServed = TraceEventType("dns_query_served")
+)
+
+// TraceFiveTuple is the five-tuple of the packet a [TraceEvent] refers to. For
+// packets without ports (e.g., ICMP), the ports are zero.
+type TraceFiveTuple struct {
+	// DestinationIP is the destination IP address.
+	DestinationIP string
+
+	// DestinationPort is the destination port.
+	DestinationPort uint16
+
+	// Protocol is the transport protocol.
+	Protocol layers.IPProtocol
+
+	// SourceIP is the source IP address.
+	SourceIP string
+
+	// SourcePort is the source port.
+	SourcePort uint16
+}
+
+// String returns a string representation of the five-tuple.
+func (ft TraceFiveTuple) String() string {
+	return fmt.Sprintf("%s:%d %s:%d/%s", ft.SourceIP, ft.SourcePort, ft.DestinationIP, ft.DestinationPort, ft.Protocol)
+}
+
+// TraceEvent is an event emitted along the packet path.
+type TraceEvent struct {
+	// Delay is the delay of [TraceEventFrameDelayed] and [TraceEventDPIVerdict].
+	Delay time.Duration
+
+	// Domain is the queried domain of [TraceEventDNSQueryServed].
+	Domain string
+
+	// FiveTuple is the five-tuple of the packet.
+	FiveTuple TraceFiveTuple
+
+	// Location identifies where the event occurred: the link direction (e.g.,
+	// "eth0->eth1") for link and DPI events, "router" for router events, and
+	// "dns/<network>" (e.g., "dns/udp") for DNS events.
+	Location string
+
+	// Policy is the [DPIPolicy] of [TraceEventDPIVerdict].
+	Policy *DPIPolicy
+
+	// Reason explains drop events (e.g., "dpi", "plr", "queue_full", "no_route",
+	// "ttl_exceeded", "mtu_exceeded", "malformed") and contains the response code of DNS events (e.g., "NOERROR")
+	// or "dropped" when the DNS server dropped the query.
+	Reason string
+
+	// Size is the size of the IP packet or of the DNS query in bytes.
+	Size int
+
+	// Time is when the event occurred.
+	Time time.Time
+
+	// Type is the event type.
+	Type TraceEventType
+}
+
+// newTraceEventForPacket creates a [TraceEvent] for the given raw IP packet.
+func newTraceEventForPacket(eventType TraceEventType, location string, rawPacket []byte) *TraceEvent {
+	ev := &TraceEvent{
+		Location: location,
+		Size:     len(rawPacket),
+		Time:     time.Now(),
+		Type:     eventType,
+	}
+	if packet, err := DissectPacket(rawPacket); err == nil {
+		ev.FiveTuple = TraceFiveTuple{
+			DestinationIP:   packet.DestinationIPAddress(),
+			DestinationPort: packet.DestinationPort(),
+			Protocol:        packet.TransportProtocol(),
+			SourceIP:        packet.SourceIPAddress(),
+			SourcePort:      packet.SourcePort(),
+		}
+	}
+	return ev
+}
+
+// TraceRecorder is a [Tracer] collecting the events in memory. The zero value
+// is ready to use. You can share a single recorder among links, routers, and DNS
+// servers to obtain a time-ordered view of the whole topology.
+type TraceRecorder struct {
+	events []*TraceEvent
+	mu     sync.Mutex
+}
+
+var _ Tracer = &TraceRecorder{}
+
+// OnTraceEvent implements [Tracer].
+func (tr *TraceRecorder) OnTraceEvent(ev *TraceEvent) {
+	tr.mu.Lock()
+	tr.events = append(tr.events, ev)
+	tr.mu.Unlock()
+}
+
+// Events returns a copy of the events collected so far.
+func (tr *TraceRecorder) Events() []*TraceEvent {
+	defer tr.mu.Unlock()
+	tr.mu.Lock()
+	return append([]*TraceEvent{}, tr.events...)
+}
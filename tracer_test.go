@@ -0,0 +1,115 @@
+package netem
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestTracer(t *testing.T) {
+	// create a star topology where the client link uses DPI and all
+	// the components share the same tracer
+	tracer := &TraceRecorder{}
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+	topology.SetTracer(tracer)
+
+	serverLink := &LinkConfig{LeftToRightDelay: time.Millisecond, RightToLeftDelay: time.Millisecond, Tracer: tracer}
+	server := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", serverLink))
+	dpi := NewDPIEngine(&NullLogger{})
+	dpi.AddRule(&DPIDropTrafficForServerEndpoint{
+		Logger:          &NullLogger{},
+		ServerIPAddress: "10.0.0.1",
+		ServerPort:      443,
+		ServerProtocol:  layers.IPProtocolTCP,
+	})
+	client := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{DPIEngine: dpi, Tracer: tracer}))
+
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.1"))
+	dnsServer := Must1(NewDNSServerWithOptions(&NullLogger{}, server, "10.0.0.1", dnsConfig, &DNSServerOptions{
+		Tracer: tracer,
+	}))
+	defer dnsServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if _, _, err := client.GetaddrinfoLookupANY(ctx, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := client.DialContext(ctx, "tcp", "10.0.0.1:443"); err == nil {
+		conn.Close()
+		t.Fatal("expected the DPI to drop the SYN")
+	}
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	if conn, err := client.DialContext(shortCtx, "tcp", "10.0.0.99:80"); err == nil {
+		conn.Close()
+		t.Fatal("expected the router to drop the SYN")
+	}
+
+	// count returns the number of events matching the given predicate
+	events := tracer.Events()
+	count := func(fx func(ev *TraceEvent) bool) (total int) {
+		for _, ev := range events {
+			if fx(ev) {
+				total++
+			}
+		}
+		return
+	}
+
+	t.Run("we trace the DNS query", func(t *testing.T) {
+		if count(func(ev *TraceEvent) bool {
+			return ev.Type == TraceEventDNSQueryServed && ev.Domain == "www.example.com." &&
+				ev.Reason == "NOERROR" && ev.FiveTuple.SourceIP == "10.0.0.2" && ev.Location == "dns/udp"
+		}) <= 0 {
+			t.Fatal("missing DNS event")
+		}
+	})
+
+	t.Run("we trace the link and router events for the query", func(t *testing.T) {
+		for _, eventType := range []TraceEventType{TraceEventFrameEnqueued, TraceEventFrameDelivered, TraceEventRouterForward} {
+			if count(func(ev *TraceEvent) bool {
+				return ev.Type == eventType && ev.FiveTuple.DestinationPort == 53 &&
+					ev.FiveTuple.Protocol == layers.IPProtocolUDP && ev.Size > 0
+			}) <= 0 {
+				t.Fatal("missing event", eventType)
+			}
+		}
+		if count(func(ev *TraceEvent) bool {
+			return ev.Type == TraceEventFrameDelayed && ev.FiveTuple.SourcePort == 53 && ev.Delay >= time.Millisecond
+		}) <= 0 {
+			t.Fatal("missing delay event")
+		}
+	})
+
+	t.Run("we trace the DPI verdict and the drop", func(t *testing.T) {
+		if count(func(ev *TraceEvent) bool {
+			return ev.Type == TraceEventDPIVerdict && ev.FiveTuple.DestinationPort == 443 &&
+				ev.Policy != nil && ev.Policy.Flags&FrameFlagDrop != 0
+		}) <= 0 {
+			t.Fatal("missing DPI verdict")
+		}
+		if count(func(ev *TraceEvent) bool {
+			return ev.Type == TraceEventFrameDropped && ev.FiveTuple.DestinationPort == 443 && ev.Reason == "dpi"
+		}) <= 0 {
+			t.Fatal("missing drop event")
+		}
+		if count(func(ev *TraceEvent) bool {
+			return ev.Type == TraceEventRouterForward && ev.FiveTuple.DestinationPort == 443
+		}) != 0 {
+			t.Fatal("the router should not have seen the dropped packets")
+		}
+	})
+
+	t.Run("we trace the router drops", func(t *testing.T) {
+		if count(func(ev *TraceEvent) bool {
+			return ev.Type == TraceEventRouterDrop && ev.Reason == "no_route" && ev.FiveTuple.DestinationIP == "10.0.0.99"
+		}) <= 0 {
+			t.Fatal("missing router drop event")
+		}
+	})
+}
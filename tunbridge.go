@@ -0,0 +1,143 @@
+package netem
+
+//
+// Bridging to a TUN device
+//
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// ErrTUNNotSupported indicates that we cannot open TUN devices on this system.
+var ErrTUNNotSupported = errors.New("netem: TUN devices not supported on this system")
+
+// TUNBridge is a [NIC] bridging the emulated network to a TUN device of the
+// host, such that real applications running on the machine can send traffic
+// through netem's emulated links and DPI for manual testing. The zero value
+// is invalid; please, construct using [NewTUNBridge].
+//
+// The typical usage is to create and configure the TUN device using the
+// operating system tools, for example:
+//
+//	ip tuntap add dev netem0 mode tun
+//	ip addr add 10.0.0.99/32 dev netem0
+//	ip link set netem0 up
+//	ip route add 10.0.0.0/24 dev netem0
+//
+// and then to attach the [TUNBridge] to a topology using the address
+// configured for the device, for example:
+//
+//	bridge := netem.Must1(netem.NewTUNBridge(logger, "netem0"))
+//	netem.Must0(topology.AddSubnet("10.0.0.99/32", bridge, &netem.LinkConfig{}))
+//
+// Because the [Link] created by [StarTopology.AddSubnet] takes ownership of
+// the [TUNBridge], closing the topology also closes the bridge.
+type TUNBridge struct {
+	// closeOnce provides "once" semantics for Close.
+	closeOnce sync.Once
+
+	// file is the open TUN device.
+	file *os.File
+
+	// logger is the logger to use.
+	logger Logger
+
+	// nic queues the packets read from the TUN device.
+	nic *middleboxNIC
+
+	// wg allows waiting for the background reader.
+	wg *sync.WaitGroup
+}
+
+// NewTUNBridge opens the TUN device with the given name and returns
+// a new [TUNBridge]. The TUN device should already exist and be
+// configured, because we do not modify the host configuration. This
+// function returns [ErrTUNNotSupported] on systems other than Linux.
+func NewTUNBridge(logger Logger, deviceName string) (*TUNBridge, error) {
+	file, err := tunOpen(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	tb := &TUNBridge{
+		closeOnce: sync.Once{},
+		file:      file,
+		logger:    logger,
+		nic:       nil, // set below
+		wg:        &sync.WaitGroup{},
+	}
+	tb.nic = newMiddleboxNIC(logger, tb.writeFrame)
+	tb.wg.Add(1)
+	go tb.readLoop()
+	logger.Debugf("netem: bridge %s <-> %s", tb.nic.InterfaceName(), deviceName)
+	return tb, nil
+}
+
+var _ NIC = &TUNBridge{}
+
+// readLoop reads packets from the TUN device and queues them.
+func (tb *TUNBridge) readLoop() {
+	defer tb.wg.Done()
+	buffer := make([]byte, 1<<16)
+	for {
+		count, err := tb.file.Read(buffer)
+		if err != nil {
+			return
+		}
+		if err := tb.nic.enqueue(NewFrame(append([]byte{}, buffer[:count]...))); err != nil {
+			if errors.Is(err, ErrStackClosed) {
+				return
+			}
+			tb.logger.Warnf("netem: TUNBridge: %s", err.Error())
+		}
+	}
+}
+
+// writeFrame writes a frame to the TUN device and releases it.
+func (tb *TUNBridge) writeFrame(frame *Frame) error {
+	_, err := tb.file.Write(frame.Payload)
+	defer frame.Release() // the kernel has copied the payload
+	return err
+}
+
+// FrameAvailable implements NIC
+func (tb *TUNBridge) FrameAvailable() <-chan any {
+	return tb.nic.FrameAvailable()
+}
+
+// ReadFrameNonblocking implements NIC
+func (tb *TUNBridge) ReadFrameNonblocking() (*Frame, error) {
+	return tb.nic.ReadFrameNonblocking()
+}
+
+// StackClosed implements NIC
+func (tb *TUNBridge) StackClosed() <-chan any {
+	return tb.nic.StackClosed()
+}
+
+// Close implements NIC. This method closes the TUN device and
+// waits for the background reader to terminate.
+func (tb *TUNBridge) Close() error {
+	tb.closeOnce.Do(func() {
+		tb.nic.Close()
+		tb.file.Close()
+		tb.wg.Wait()
+	})
+	return nil
+}
+
+// IPAddress implements NIC
+func (tb *TUNBridge) IPAddress() string {
+	return tb.nic.IPAddress()
+}
+
+// InterfaceName implements NIC
+func (tb *TUNBridge) InterfaceName() string {
+	return tb.nic.InterfaceName()
+}
+
+// WriteFrame implements NIC
+func (tb *TUNBridge) WriteFrame(frame *Frame) error {
+	return tb.nic.WriteFrame(frame)
+}
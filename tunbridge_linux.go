@@ -0,0 +1,20 @@
+//go:build linux
+
+package netem
+
+import (
+	"os"
+
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+)
+
+// tunOpen opens the TUN device with the given name.
+func tunOpen(deviceName string) (*os.File, error) {
+	fd, err := tun.Open(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	// note: tun.Open returns a nonblocking file descriptor, so the
+	// returned [os.File] uses the runtime poller and Close interrupts Read
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package netem
+
+import "os"
+
+// tunOpen opens the TUN device with the given name.
+func tunOpen(deviceName string) (*os.File, error) {
+	return nil, ErrTUNNotSupported
+}
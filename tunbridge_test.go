@@ -0,0 +1,25 @@
+package netem
+
+import (
+	"testing"
+)
+
+func TestTUNBridge(t *testing.T) {
+	bridge, err := NewTUNBridge(&NullLogger{}, "netemtest0")
+	if err != nil {
+		t.Skip("cannot open TUN device", err)
+	}
+
+	t.Run("we can attach the bridge to a topology", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		if err := topology.AddSubnet("10.0.0.99/32", bridge, &LinkConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		topology.Close() // should also close the bridge
+		select {
+		case <-bridge.StackClosed():
+		default:
+			t.Fatal("expected the bridge to be closed")
+		}
+	})
+}
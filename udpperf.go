@@ -0,0 +1,363 @@
+package netem
+
+//
+// UDP throughput and jitter measurement
+//
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// udpPerfHeaderSize is the size of the header of each UDPPerf packet, which
+// consists of the sequence number and of the send time in nanoseconds.
+const udpPerfHeaderSize = 16
+
+// TrafficPattern is the pattern used by [RunUDPPerfClient] to send packets.
+type TrafficPattern string
+
+const (
+	// TrafficPatternCBR sends packets at a constant bitrate, which is
+	// the default when the pattern is empty.
+	TrafficPatternCBR = TrafficPattern("cbr")
+
+	// TrafficPatternPoisson sends packets such that the interval between
+	// them is exponentially distributed, i.e., the packets arrivals are a
+	// Poisson process whose average bitrate is the configured rate.
+	TrafficPatternPoisson = TrafficPattern("poisson")
+
+	// TrafficPatternOnOff alternates bursts where we send packets at the
+	// configured rate and silent periods where we do not send anything.
+	TrafficPatternOnOff = TrafficPattern("onoff")
+)
+
+// ErrUnknownTrafficPattern indicates that we do not know a [TrafficPattern].
+var ErrUnknownTrafficPattern = errors.New("netem: unknown traffic pattern")
+
+// UDPPerfConfig configures [RunUDPPerfClient]. The zero value is invalid; please,
+// init all the fields marked as MANDATORY.
+type UDPPerfConfig struct {
+	// Rate is the MANDATORY sending rate in bit/s. When using [TrafficPatternOnOff],
+	// this is the rate during the bursts rather than the average rate.
+	Rate int64
+
+	// PacketSize is the OPTIONAL UDP payload size (default: 1200 bytes),
+	// which must be at least 16 bytes to fit the packet header.
+	PacketSize int
+
+	// Duration is the OPTIONAL duration of the measurement (default: 10 s).
+	Duration time.Duration
+
+	// Pattern is the OPTIONAL traffic pattern (default: [TrafficPatternCBR]).
+	Pattern TrafficPattern
+
+	// OnDuration is the OPTIONAL duration of each burst when
+	// using [TrafficPatternOnOff] (default: 500 ms).
+	OnDuration time.Duration
+
+	// OffDuration is the OPTIONAL duration of each silent period
+	// when using [TrafficPatternOnOff] (default: 500 ms).
+	OffDuration time.Duration
+}
+
+// packetSize returns the configured packet size or the default.
+func (c *UDPPerfConfig) packetSize() int {
+	if c.PacketSize > 0 {
+		return c.PacketSize
+	}
+	return 1200
+}
+
+// duration returns the configured duration or the default.
+func (c *UDPPerfConfig) duration() time.Duration {
+	if c.Duration > 0 {
+		return c.Duration
+	}
+	return 10 * time.Second
+}
+
+// onOffDurations returns the configured burst and silence durations or the defaults.
+func (c *UDPPerfConfig) onOffDurations() (on, off time.Duration) {
+	on, off = 500*time.Millisecond, 500*time.Millisecond
+	if c.OnDuration > 0 {
+		on = c.OnDuration
+	}
+	if c.OffDuration > 0 {
+		off = c.OffDuration
+	}
+	return
+}
+
+// scheduler returns a function returning the time offset, since the beginning
+// of the measurement, at which we should send the next packet.
+func (c *UDPPerfConfig) scheduler(interval time.Duration) (func() time.Duration, error) {
+	var count int64
+	switch c.Pattern {
+	case "", TrafficPatternCBR:
+		return func() time.Duration {
+			offset := time.Duration(count) * interval
+			count++
+			return offset
+		}, nil
+
+	case TrafficPatternPoisson:
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		var offset time.Duration
+		return func() time.Duration {
+			current := offset
+			offset += time.Duration(rng.ExpFloat64() * float64(interval))
+			return current
+		}, nil
+
+	case TrafficPatternOnOff:
+		on, off := c.onOffDurations()
+		perBurst := int64(on / interval)
+		if perBurst <= 0 {
+			perBurst = 1
+		}
+		return func() time.Duration {
+			burst, index := count/perBurst, count%perBurst
+			count++
+			return time.Duration(burst)*(on+off) + time.Duration(index)*interval
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTrafficPattern, string(c.Pattern))
+	}
+}
+
+// RunUDPPerfClient sends UDP packets to the given server endpoint (e.g.,
+// 10.0.0.1:5201) at the configured rate and using the configured pattern until
+// the configured duration elapses or the context is done. This function returns
+// the number of packets sent, which you can compare with the [UDPPerfReport] of
+// the [UDPPerfServer] to account for the packets lost at the end of the measurement.
+//
+// Like iperf, this tool sends regardless of losses, which makes it suitable to
+// evaluate queue drops, jitter, and reordering. You can also use it to generate
+// background load while running other measurements by running it in a background
+// goroutine with a long duration and canceling the context when done.
+func RunUDPPerfClient(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	serverAddr string,
+	config *UDPPerfConfig,
+) (int64, error) {
+	packetSize := config.packetSize()
+	if config.Rate <= 0 || packetSize < udpPerfHeaderSize {
+		return 0, syscall.EINVAL
+	}
+
+	// compute the average interval between packets required to achieve the rate
+	interval := time.Duration(float64(packetSize*8) / float64(config.Rate) * float64(time.Second))
+	next, err := config.scheduler(interval)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := stack.DialContext(ctx, "udp", serverAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	buffer := make([]byte, packetSize)
+	t0 := time.Now()
+	deadline := t0.Add(config.duration())
+	var sent int64
+	for {
+		// wait until we're due to send the next packet, which allows
+		// us to send bursts when the timer fires late
+		due := t0.Add(next())
+		if !due.Before(deadline) {
+			return sent, nil
+		}
+		if delta := time.Until(due); delta > 0 {
+			timer := time.NewTimer(delta)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return sent, nil
+			case <-timer.C:
+			}
+		}
+
+		binary.BigEndian.PutUint64(buffer[0:8], uint64(sent))
+		binary.BigEndian.PutUint64(buffer[8:16], uint64(time.Now().UnixNano()))
+		if _, err := conn.Write(buffer); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+}
+
+// UDPPerfReport contains the statistics collected by a [UDPPerfServer].
+type UDPPerfReport struct {
+	// BytesReceived is the number of UDP payload bytes received.
+	BytesReceived int64
+
+	// PacketsReceived is the number of packets received, excluding duplicates.
+	PacketsReceived int64
+
+	// PacketsExpected is the number of packets we expected, which we compute
+	// using the highest sequence number, thus excluding the packets lost at the
+	// end of the measurement (see [RunUDPPerfClient]).
+	PacketsExpected int64
+
+	// PacketsLost is the number of expected packets we did not receive.
+	PacketsLost int64
+
+	// PacketsDuplicate is the number of duplicate packets received.
+	PacketsDuplicate int64
+
+	// PacketsReordered is the number of packets received after a packet
+	// with a higher sequence number.
+	PacketsReordered int64
+
+	// Jitter is the interarrival jitter computed as in RFC 3550.
+	Jitter time.Duration
+
+	// FirstPacket is when we received the first packet.
+	FirstPacket time.Time
+
+	// LastPacket is when we received the last packet.
+	LastPacket time.Time
+}
+
+// LossRate returns the fraction of expected packets that we did not receive.
+func (r *UDPPerfReport) LossRate() float64 {
+	if r.PacketsExpected <= 0 {
+		return 0
+	}
+	return float64(r.PacketsLost) / float64(r.PacketsExpected)
+}
+
+// ThroughputMbps returns the receive throughput expressed in Mbit/s.
+func (r *UDPPerfReport) ThroughputMbps() float64 {
+	elapsed := r.LastPacket.Sub(r.FirstPacket).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return (float64(r.BytesReceived*8) / elapsed) / (1000 * 1000)
+}
+
+// UDPPerfServer receives the packets sent by [RunUDPPerfClient] and collects
+// statistics. The zero value is invalid, please construct using [NewUDPPerfServer].
+type UDPPerfServer struct {
+	highestSeq int64
+	lastDelay  time.Duration
+	mu         sync.Mutex
+	once       sync.Once
+	pconn      UDPLikeConn
+	report     UDPPerfReport
+	seen       map[uint64]bool
+}
+
+// NewUDPPerfServer creates a new [UDPPerfServer] listening on the given
+// IPv4 address and UDP port. Remember to call [UDPPerfServer.Close] when done.
+func NewUDPPerfServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	port int,
+) (*UDPPerfServer, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	udpAddr := &net.UDPAddr{
+		IP:   parsedIP,
+		Port: port,
+		Zone: "",
+	}
+	pconn, err := stack.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	us := &UDPPerfServer{
+		pconn:      pconn,
+		seen:       map[uint64]bool{},
+		highestSeq: -1,
+	}
+	go us.reader(logger)
+	return us, nil
+}
+
+// reader receives packets until the server is closed.
+func (us *UDPPerfServer) reader(logger Logger) {
+	buffer := make([]byte, 1<<16)
+	for {
+		count, _, err := us.pconn.ReadFrom(buffer)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warnf("netem: UDPPerfServer: %s", err.Error())
+			}
+			return
+		}
+		if count < udpPerfHeaderSize {
+			continue
+		}
+		us.update(buffer[:count], time.Now())
+	}
+}
+
+// update updates the statistics using the given packet.
+func (us *UDPPerfServer) update(packet []byte, now time.Time) {
+	seq := binary.BigEndian.Uint64(packet[0:8])
+	sendTime := time.Unix(0, int64(binary.BigEndian.Uint64(packet[8:16])))
+
+	defer us.mu.Unlock()
+	us.mu.Lock()
+
+	if us.seen[seq] {
+		us.report.PacketsDuplicate++
+		return
+	}
+	us.seen[seq] = true
+	if int64(seq) < us.highestSeq {
+		us.report.PacketsReordered++
+	} else {
+		us.highestSeq = int64(seq)
+	}
+
+	// compute the interarrival jitter as documented in RFC 3550 Sect. 6.4.1
+	delay := now.Sub(sendTime)
+	if us.report.PacketsReceived > 0 {
+		delta := delay - us.lastDelay
+		if delta < 0 {
+			delta = -delta
+		}
+		us.report.Jitter += (delta - us.report.Jitter) / 16
+	} else {
+		us.report.FirstPacket = now
+	}
+	us.lastDelay = delay
+
+	us.report.LastPacket = now
+	us.report.PacketsReceived++
+	us.report.BytesReceived += int64(len(packet))
+}
+
+// Report returns a snapshot of the statistics collected so far.
+func (us *UDPPerfServer) Report() *UDPPerfReport {
+	defer us.mu.Unlock()
+	us.mu.Lock()
+	report := us.report
+	report.PacketsExpected = us.highestSeq + 1
+	report.PacketsLost = report.PacketsExpected - report.PacketsReceived
+	return &report
+}
+
+// Close closes the server.
+func (us *UDPPerfServer) Close() error {
+	us.once.Do(func() {
+		us.pconn.Close()
+	})
+	return nil
+}
@@ -0,0 +1,203 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUDPPerf(t *testing.T) {
+	t.Run("we measure the throughput and the losses", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{
+			LeftToRightDelay: 10 * time.Millisecond,
+			LeftToRightPLR:   0.1,
+			RightToLeftDelay: 10 * time.Millisecond,
+		})
+		defer topology.Close()
+
+		server := Must1(NewUDPPerfServer(&NullLogger{}, topology.Server, "10.0.0.1", 5201))
+		defer server.Close()
+
+		config := &UDPPerfConfig{
+			Rate:       4 * 1000 * 1000,
+			PacketSize: 1000,
+			Duration:   time.Second,
+		}
+		sent, err := RunUDPPerfClient(context.Background(), topology.Client, "10.0.0.1:5201", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the rate implies sending 500 packets per second
+		if sent < 450 || sent > 500 {
+			t.Fatal("unexpected number of packets sent", sent)
+		}
+
+		// wait for the packets in flight to arrive
+		time.Sleep(250 * time.Millisecond)
+
+		report := server.Report()
+		t.Logf("%+v", report)
+		if report.PacketsExpected > sent || report.PacketsExpected < sent-10 {
+			t.Fatal("unexpected number of expected packets", report.PacketsExpected)
+		}
+		if report.PacketsReceived+report.PacketsLost != report.PacketsExpected {
+			t.Fatal("the received and lost packets do not sum up")
+		}
+		if rate := report.LossRate(); rate < 0.03 || rate > 0.2 {
+			t.Fatal("unexpected loss rate", rate)
+		}
+		// note that the link adds jitter when using PLR, so we may see reordering
+		if report.PacketsDuplicate != 0 {
+			t.Fatal("unexpected duplicate packets")
+		}
+		if report.BytesReceived != report.PacketsReceived*1000 {
+			t.Fatal("unexpected bytes received", report.BytesReceived)
+		}
+		if speed := report.ThroughputMbps(); speed < 3 || speed > 4.5 {
+			t.Fatal("unexpected throughput", speed)
+		}
+	})
+
+	t.Run("we reject an invalid configuration", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		configs := []*UDPPerfConfig{{}, {Rate: 1000, PacketSize: 8}}
+		for _, config := range configs {
+			_, err := RunUDPPerfClient(context.Background(), topology.Client, "10.0.0.1:5201", config)
+			if !errors.Is(err, syscall.EINVAL) {
+				t.Fatal("unexpected error", err)
+			}
+		}
+	})
+
+	t.Run("we stop sending when the context is done", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		server := Must1(NewUDPPerfServer(&NullLogger{}, topology.Server, "10.0.0.1", 5201))
+		defer server.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		config := &UDPPerfConfig{Rate: 1000 * 1000, Duration: time.Hour}
+		start := time.Now()
+		if _, err := RunUDPPerfClient(ctx, topology.Client, "10.0.0.1:5201", config); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatal("took too much time", elapsed)
+		}
+	})
+}
+
+func TestUDPPerfServerUpdate(t *testing.T) {
+	us := &UDPPerfServer{seen: map[uint64]bool{}, highestSeq: -1}
+	t0 := time.Now()
+	packet := func(seq uint64, sendTime time.Time) []byte {
+		buffer := make([]byte, 100)
+		buffer[7] = byte(seq)
+		ns := uint64(sendTime.UnixNano())
+		for idx := 0; idx < 8; idx++ {
+			buffer[15-idx] = byte(ns >> (8 * idx))
+		}
+		return buffer
+	}
+
+	// packets 0, 2, 1, 1, 4 with a variable delay
+	us.update(packet(0, t0), t0.Add(10*time.Millisecond))
+	us.update(packet(2, t0.Add(20*time.Millisecond)), t0.Add(46*time.Millisecond))
+	us.update(packet(1, t0.Add(10*time.Millisecond)), t0.Add(50*time.Millisecond))
+	us.update(packet(1, t0.Add(10*time.Millisecond)), t0.Add(51*time.Millisecond))
+	us.update(packet(4, t0.Add(40*time.Millisecond)), t0.Add(50*time.Millisecond))
+
+	report := us.Report()
+	if report.PacketsReceived != 4 || report.PacketsExpected != 5 || report.PacketsLost != 1 {
+		t.Fatalf("unexpected counters %+v", report)
+	}
+	if report.PacketsDuplicate != 1 || report.PacketsReordered != 1 {
+		t.Fatalf("unexpected counters %+v", report)
+	}
+	if report.Jitter <= 0 {
+		t.Fatal("expected positive jitter")
+	}
+}
+
+func TestUDPPerfTrafficPatterns(t *testing.T) {
+	t.Run("the scheduler implements each pattern", func(t *testing.T) {
+		interval := 10 * time.Millisecond
+
+		cbr := Must1((&UDPPerfConfig{}).scheduler(interval))
+		for idx := 0; idx < 3; idx++ {
+			if offset := cbr(); offset != time.Duration(idx)*interval {
+				t.Fatal("unexpected CBR offset", offset)
+			}
+		}
+
+		config := &UDPPerfConfig{
+			Pattern:     TrafficPatternOnOff,
+			OnDuration:  20 * time.Millisecond,
+			OffDuration: 100 * time.Millisecond,
+		}
+		onoff := Must1(config.scheduler(interval))
+		expect := []time.Duration{0, 10 * time.Millisecond, 120 * time.Millisecond, 130 * time.Millisecond, 240 * time.Millisecond}
+		for _, value := range expect {
+			if offset := onoff(); offset != value {
+				t.Fatal("unexpected on/off offset", offset, value)
+			}
+		}
+
+		poisson := Must1((&UDPPerfConfig{Pattern: TrafficPatternPoisson}).scheduler(interval))
+		var previous time.Duration
+		for idx := 0; idx < 10000; idx++ {
+			offset := poisson()
+			if offset < previous {
+				t.Fatal("the offsets should not decrease")
+			}
+			previous = offset
+		}
+		// the average interval should be close to the configured interval
+		if average := previous / 9999; average < 9*time.Millisecond || average > 11*time.Millisecond {
+			t.Fatal("unexpected average Poisson interval", average)
+		}
+	})
+
+	t.Run("we reject an unknown pattern", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		config := &UDPPerfConfig{Rate: 1000, Pattern: "zigzag"}
+		_, err := RunUDPPerfClient(context.Background(), topology.Client, "10.0.0.1:5201", config)
+		if !errors.Is(err, ErrUnknownTrafficPattern) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("on/off traffic halves the average rate", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		server := Must1(NewUDPPerfServer(&NullLogger{}, topology.Server, "10.0.0.1", 5201))
+		defer server.Close()
+
+		config := &UDPPerfConfig{
+			Rate:        4 * 1000 * 1000,
+			PacketSize:  1000,
+			Duration:    time.Second,
+			Pattern:     TrafficPatternOnOff,
+			OnDuration:  250 * time.Millisecond,
+			OffDuration: 250 * time.Millisecond,
+		}
+		sent, err := RunUDPPerfClient(context.Background(), topology.Client, "10.0.0.1:5201", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the rate implies sending 500 packets per second while on
+		if sent < 225 || sent > 250 {
+			t.Fatal("unexpected number of packets sent", sent)
+		}
+	})
+}
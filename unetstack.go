@@ -8,12 +8,17 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"net"
 	"net/netip"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 )
 
@@ -31,6 +36,16 @@ import (
 //
 // - perform getaddrinfo like DNS lookups using [UNetStack.GetaddrinfoLookupANY];
 //
+// Additionally, you can create raw ICMPv4 sockets using [UNetStack.ListenICMP],
+// which is useful to implement ping and traceroute like measurements. Every
+// [UNetStack] answers ICMP echo requests and [Ping] measures the RTT.
+//
+// The conns returned by [UNetStack.DialContext] and by the listeners created
+// using [UNetStack.ListenTCP] implement [StatsConn], which allows to obtain
+// per-connection statistics without post-processing packet captures. These
+// conns and the ones returned by [UNetStack.ListenUDP] also implement
+// [SocketOptions], which allows to set the TTL, TOS, TCP keepalives, and TCP segmentation.
+//
 // Use [UNetStack.NIC] to obtain a [NIC] to read and write the [Frames]
 // produced by using the network stack as the [UnderlyingNetwork].
 type UNetStack struct {
@@ -40,6 +55,15 @@ type UNetStack struct {
 	// ns is the GVisor network stack.
 	ns *gvisorStack
 
+	// gaiErrorMapping is the getaddrinfo error mapping.
+	gaiErrorMapping atomic.Pointer[GetaddrinfoErrorMapping]
+
+	// keyLogWriter is the OPTIONAL TLS key log writer.
+	keyLogWriter atomic.Pointer[tlsKeyLogWriter]
+
+	// rootCAs is the OPTIONAL pool overriding the CA's pool.
+	rootCAs atomic.Pointer[x509.CertPool]
+
 	// resoAddr is the resolver IPv4 address.
 	resoAddr netip.Addr
 }
@@ -60,48 +84,103 @@ var (
 // - MTU is the MTU to use (you MUST use at least 1252 bytes if you
 // want to use github.com/lucas-clemente/quic-go);
 //
-// - stackAddress is the IPv4 address to assign to the stack;
+// - stackAddress is the IPv4 or IPv6 address to assign to the stack;
 //
 // - cfg contains TLS MITM configuration;
 //
-// - resolverAddress is the IPv4 address of the resolver.
+// - resolverAddress is the IPv4 or IPv6 address of the resolver.
+//
+// See also [NewDualStackUNetStack] and [NewUNetStackWithOptions].
 func NewUNetStack(
 	logger Logger,
 	MTU uint32,
 	stackAddress string,
 	ca *CA,
 	resolverAddress string,
+) (*UNetStack, error) {
+	return NewUNetStackWithOptions(logger, MTU, stackAddress, ca, resolverAddress, &UNetStackOptions{})
+}
+
+// NewUNetStackWithOptions is like [NewUNetStack] but also allows
+// to configure the transport-level features of the stack.
+func NewUNetStackWithOptions(
+	logger Logger,
+	MTU uint32,
+	stackAddress string,
+	ca *CA,
+	resolverAddress string,
+	options *UNetStackOptions,
 ) (*UNetStack, error) {
 	// parse the stack address
 	stackAddr, err := netip.ParseAddr(stackAddress)
 	if err != nil {
 		return nil, err
 	}
-	if !stackAddr.Is4() {
+	return newUNetStack(logger, MTU, []netip.Addr{stackAddr.Unmap()}, ca, resolverAddress, options)
+}
+
+// NewDualStackUNetStack is like [NewUNetStack] but creates a dual-stack
+// [UNetStack] with the given IPv4 and IPv6 addresses. The IPv4 address is
+// the primary address returned by [UNetStack.IPAddress]. Use this function
+// along with [StarTopology.AddDualStackHost] to test Happy Eyeballs.
+func NewDualStackUNetStack(
+	logger Logger,
+	MTU uint32,
+	ipv4Address string,
+	ipv6Address string,
+	ca *CA,
+	resolverAddress string,
+) (*UNetStack, error) {
+	// parse the stack addresses
+	addr4, err := netip.ParseAddr(ipv4Address)
+	if err != nil {
+		return nil, err
+	}
+	if !addr4.Unmap().Is4() {
+		return nil, syscall.EAFNOSUPPORT
+	}
+	addr6, err := netip.ParseAddr(ipv6Address)
+	if err != nil {
+		return nil, err
+	}
+	if !addr6.Is6() || addr6.Is4In6() {
 		return nil, syscall.EAFNOSUPPORT
 	}
+	return newUNetStack(logger, MTU, []netip.Addr{addr4.Unmap(), addr6}, ca, resolverAddress, &UNetStackOptions{})
+}
 
+// newUNetStack is the common implementation of [NewUNetStack] and [NewDualStackUNetStack].
+func newUNetStack(
+	logger Logger,
+	MTU uint32,
+	stackAddrs []netip.Addr,
+	ca *CA,
+	resolverAddress string,
+	options *UNetStackOptions,
+) (*UNetStack, error) {
 	// parse the resolver address
 	resolverAddr, err := netip.ParseAddr(resolverAddress)
 	if err != nil {
 		return nil, err
 	}
-	if !resolverAddr.Is4() {
-		return nil, syscall.EAFNOSUPPORT
-	}
 
 	// create userspace network stack
-	ns, err := newGVisorStack(logger, stackAddr, MTU)
+	ns, err := newGVisorStack(logger, stackAddrs, MTU)
 	if err != nil {
 		return nil, err
 	}
+	if err := options.apply(ns); err != nil {
+		ns.Close()
+		return nil, err
+	}
 
 	// fill and return the network stack
 	stack := &UNetStack{
 		ca:       ca,
 		ns:       ns,
-		resoAddr: resolverAddr,
+		resoAddr: resolverAddr.Unmap(),
 	}
+	stack.gaiErrorMapping.Store(&GetaddrinfoErrorMapping{})
 	return stack, nil
 }
 
@@ -110,14 +189,46 @@ func (gs *UNetStack) CACert() *x509.Certificate {
 	return gs.ca.CACert()
 }
 
-// DefaultCertPool implements CertificationAuthority.
+// DefaultCertPool implements CertificationAuthority. This method returns the pool
+// configured using [UNetStack.SetRootCAs], if any, and otherwise the CA's pool.
 func (gs *UNetStack) DefaultCertPool() *x509.CertPool {
+	if pool := gs.rootCAs.Load(); pool != nil {
+		return pool
+	}
 	return gs.ca.DefaultCertPool()
 }
 
+// SetRootCAs overrides the root CAs that [UNetStack.DefaultCertPool] returns and
+// clients using this stack (e.g., [Net.DialTLSContext], [DNSRoundTripTLS]) use to
+// verify servers, which by default only include the shared MITM CA. Use this method
+// to represent hosts with distinct trust stores: for example, a host trusting a
+// private CA (see [CA.AddStaticCertificate]) or a host trusting no CA at all (i.e.,
+// an empty pool), for which all the servers are untrusted. Passing nil restores
+// the default. It is safe to call this method concurrently with dialing.
+func (gs *UNetStack) SetRootCAs(pool *x509.CertPool) {
+	gs.rootCAs.Store(pool)
+}
+
+// CA returns the [*CA] used by this stack.
+func (gs *UNetStack) CA() *CA {
+	return gs.ca
+}
+
+// CACertPEM is like [CA.CACertPEM].
+func (gs *UNetStack) CACertPEM() []byte {
+	return gs.ca.CACertPEM()
+}
+
+// CAKeyPEM is like [CA.CAKeyPEM].
+func (gs *UNetStack) CAKeyPEM() ([]byte, error) {
+	return gs.ca.CAKeyPEM()
+}
+
 // MustNewServerTLSConfig implements CertificationAuthority.
 func (gs *UNetStack) MustNewServerTLSConfig(commonName string, extraNames ...string) *tls.Config {
-	return gs.ca.MustNewServerTLSConfig(commonName, extraNames...)
+	config := gs.ca.MustNewServerTLSConfig(commonName, extraNames...)
+	config.KeyLogWriter = gs.TLSKeyLogWriter()
+	return config
 }
 
 // MustNewTLSCertificate implements implements CertificationAuthority.
@@ -156,6 +267,12 @@ func (gs *UNetStack) IPAddress() string {
 	return gs.ns.IPAddress()
 }
 
+// IPAddresses returns all the IP addresses of the stack. The first
+// address is the primary address returned by [UNetStack.IPAddress].
+func (gs *UNetStack) IPAddresses() []string {
+	return gs.ns.IPAddresses()
+}
+
 // InterfaceName implements NIC
 func (gs *UNetStack) InterfaceName() string {
 	return gs.ns.InterfaceName()
@@ -171,11 +288,19 @@ func (gs *UNetStack) Close() error {
 	return gs.ns.Close()
 }
 
+// OpenSockets returns the sorted descriptions (e.g., "tcp 10.0.0.2:54321->10.0.0.1:443")
+// of the connections, listeners, and packet conns created using this stack that
+// have not been closed yet, which is useful to detect leaks.
+func (gs *UNetStack) OpenSockets() []string {
+	return gs.ns.openSockets()
+}
+
 // DialContext implements UnderlyingNetwork.
 func (gs *UNetStack) DialContext(
 	ctx context.Context, network string, address string) (net.Conn, error) {
 	var (
 		conn net.Conn
+		ep   tcpip.Endpoint
 		err  error
 	)
 
@@ -185,13 +310,19 @@ func (gs *UNetStack) DialContext(
 		return nil, err
 	}
 
+	// make sure the address family is compatible with the network
+	addrport = netip.AddrPortFrom(addrport.Addr().Unmap(), addrport.Port())
+	if !unetNetworkAllowsAddr(network, addrport.Addr()) {
+		return nil, syscall.EAFNOSUPPORT
+	}
+
 	// determine what "dial" actualls means in this context (sorry)
 	switch network {
-	case "tcp":
-		conn, err = gs.ns.DialContextTCPAddrPort(ctx, addrport)
+	case "tcp", "tcp4", "tcp6":
+		conn, ep, err = gs.ns.DialContextTCPAddrPort(ctx, addrport)
 
-	case "udp":
-		conn, err = gs.ns.DialUDPAddrPort(netip.AddrPort{}, addrport)
+	case "udp", "udp4", "udp6":
+		conn, ep, err = gs.ns.DialUDPAddrPort(netip.AddrPort{}, addrport)
 
 	default:
 		return nil, syscall.EPROTOTYPE
@@ -199,31 +330,102 @@ func (gs *UNetStack) DialContext(
 
 	// make sure we return an error on failure
 	if err != nil {
-		return nil, mapUNetError(err)
+		return nil, MapUNetError(err)
 	}
 
-	// wrap returned connection to correctly map errors
-	return &unetConnWrapper{conn}, nil
+	// wrap returned connection to correctly map errors and collect stats
+	return newUNetConnWrapper(gs.ns, conn, ep), nil
+}
+
+// unetNetworkAllowsAddr returns whether the given network (e.g., "tcp4")
+// allows using the given address. Networks without a "4" or "6" suffix
+// allow using both IPv4 and IPv6 addresses.
+func unetNetworkAllowsAddr(network string, addr netip.Addr) bool {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return addr.Is4()
+	case strings.HasSuffix(network, "6"):
+		return addr.Is6()
+	default:
+		return true
+	}
 }
 
 // GetaddrinfoLookupANY implements UnderlyingNetwork.
+//
+// Like getaddrinfo with AI_ADDRCONFIG, we only query for the address families
+// for which the stack has addresses. So, we send an A query for IPv4 stacks, an
+// AAAA query for IPv6 stacks, and both for dual-stack stacks, in which case we
+// return the IPv6 addresses first, as recommended by RFC 6724.
 func (gs *UNetStack) GetaddrinfoLookupANY(ctx context.Context, domain string) ([]string, string, error) {
 	// shortcircuit IP addresses
 	if net.ParseIP(domain) != nil {
 		return []string{domain}, "", nil
 	}
 
-	// create the query message
-	query := NewDNSRequestA(domain)
+	var (
+		addrs   []string
+		cname   string
+		lastErr error
+	)
+	for _, query := range gs.newGetaddrinfoQueries(domain) {
+		qaddrs, qcname, err := gs.getaddrinfoRoundTrip(ctx, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs = append(addrs, qaddrs...)
+		if cname == "" {
+			cname = qcname
+		}
+	}
+	if len(addrs) <= 0 {
+		return nil, "", lastErr
+	}
+	return addrs, cname, nil
+}
+
+// newGetaddrinfoQueries returns the queries to send for the given domain.
+func (gs *UNetStack) newGetaddrinfoQueries(domain string) (queries []*dns.Msg) {
+	var has4, has6 bool
+	for _, addr := range gs.ns.ipAddresses {
+		has4 = has4 || addr.Is4()
+		has6 = has6 || addr.Is6()
+	}
+	if has6 {
+		queries = append(queries, NewDNSRequestAAAA(domain))
+	}
+	if has4 {
+		queries = append(queries, NewDNSRequestA(domain))
+	}
+	return
+}
 
+// getaddrinfoRoundTrip sends a query to the resolver and parses the response.
+func (gs *UNetStack) getaddrinfoRoundTrip(ctx context.Context, query *dns.Msg) ([]string, string, error) {
 	// perform the DNS round trip
+	mapping := gs.gaiErrorMapping.Load()
 	resp, err := DNSRoundTrip(ctx, gs, gs.resoAddr.String(), query)
 	if err != nil {
-		return nil, "", err
+		return nil, "", mapping.mapRoundTripError(err)
 	}
 
 	// parse the results into a getaddrinfo result
-	return DNSParseResponse(query, resp)
+	addrs, cname, err := DNSParseResponse(query, resp)
+	if err != nil {
+		return nil, "", mapping.mapResponseError(resp, err)
+	}
+	return addrs, cname, nil
+}
+
+// SetGetaddrinfoErrorMapping configures how [UNetStack.GetaddrinfoLookupANY]
+// maps DNS failures to errors. Passing nil restores the default mapping. It is
+// safe to call this method while other goroutines are performing lookups.
+func (gs *UNetStack) SetGetaddrinfoErrorMapping(mapping *GetaddrinfoErrorMapping) {
+	if mapping == nil {
+		mapping = &GetaddrinfoErrorMapping{}
+	}
+	gs.gaiErrorMapping.Store(mapping)
 }
 
 // GetaddrinfoResolverNetwork implements UnderlyingNetwork
@@ -242,114 +444,77 @@ func (gs *UNetStack) ListenUDP(network string, addr *net.UDPAddr) (UDPLikeConn,
 	if !good {
 		return nil, syscall.EADDRNOTAVAIL
 	}
-	addrport := netip.AddrPortFrom(ipaddr, uint16(addr.Port))
+	addrport := netip.AddrPortFrom(ipaddr.Unmap(), uint16(addr.Port))
 
-	pconn, err := gs.ns.DialUDPAddrPort(addrport, netip.AddrPort{})
+	pconn, ep, err := gs.ns.DialUDPAddrPort(addrport, netip.AddrPort{})
 	if err != nil {
-		return nil, mapUNetError(err)
+		return nil, MapUNetError(err)
 	}
 
-	return &unetPacketConnWrapper{pconn}, nil
+	return &unetPacketConnWrapper{
+		c:                 pconn,
+		unetSocketOptions: &unetSocketOptions{ep: ep, tcp: false},
+		untrack:           gs.ns.trackSocket(fmt.Sprintf("udp %s", pconn.LocalAddr())),
+	}, nil
 }
 
 // ListenTCP implements UnderlyingNetwork
 func (gs *UNetStack) ListenTCP(network string, addr *net.TCPAddr) (net.Listener, error) {
-	if network != "tcp" {
-		return nil, syscall.EPROTOTYPE
-	}
-
-	// convert addr to [netip.AddrPort]
-	ipaddr, good := netip.AddrFromSlice(addr.IP)
-	if !good {
-		return nil, syscall.EADDRNOTAVAIL
-	}
-	addrport := netip.AddrPortFrom(ipaddr, uint16(addr.Port))
-
-	listener, err := gs.ns.ListenTCPAddrPort(addrport)
-	if err != nil {
-		return nil, mapUNetError(err)
-	}
-
-	return &unetListenerWrapper{listener}, nil
-}
-
-// unetSuffixToError maps a gvisor error suffix to an stdlib error.
-type unetSuffixToError struct {
-	// suffix is the unet err.Error() suffix.
-	suffix string
-
-	// err is generally a syscall error but it could
-	// also be any other stdlib error.
-	err error
-}
-
-// allUNetSyscallErrors defines [unetSuffixToError] rules for all the
-// errors emitted by unet that matter to measuring censorship.
-//
-// See https://github.com/google/gvisor/blob/master/pkg/tcpip/errors.go
-//
-// See https://github.com/google/gvisor/blob/master/pkg/syserr/netstack.go
-var allUNetSyscallErrors = []*unetSuffixToError{{
-	suffix: "endpoint is closed for receive",
-	err:    net.ErrClosed,
-}, {
-	suffix: "endpoint is closed for send",
-	err:    net.ErrClosed,
-}, {
-	suffix: "connection aborted",
-	err:    syscall.ECONNABORTED,
-}, {
-	suffix: "connection was refused",
-	err:    syscall.ECONNREFUSED,
-}, {
-	suffix: "connection reset by peer",
-	err:    syscall.ECONNRESET,
-}, {
-	suffix: "network is unreachable",
-	err:    syscall.ENETUNREACH,
-}, {
-	suffix: "no route to host",
-	err:    syscall.EHOSTUNREACH,
-}, {
-	suffix: "host is down",
-	err:    syscall.EHOSTDOWN,
-}, {
-	suffix: "machine is not on the network",
-	err:    syscall.ENETDOWN,
-}, {
-	suffix: "operation timed out",
-	err:    syscall.ETIMEDOUT,
-}, {
-	suffix: "endpoint is in invalid state",
-	err:    syscall.EINVAL,
-}}
-
-// mapUNetError maps a unet error to an stdlib error.
-func mapUNetError(err error) error {
-	if err != nil {
-		estring := err.Error()
-		for _, entry := range allUNetSyscallErrors {
-			if strings.HasSuffix(estring, entry.suffix) {
-				return entry.err
-			}
-		}
-	}
-	return err
+	return gs.ListenTCPWithBacklog(network, addr, DefaultListenBacklog)
 }
 
 // unetConnWrapper wraps a [net.Conn] to remap unet errors
-// so that we can emulate stdlib errors.
+// so that we can emulate stdlib errors, to collect stats,
+// and to allow setting socket options.
 type unetConnWrapper struct {
-	c net.Conn
+	*unetSocketOptions
+	c       net.Conn
+	stats   *connStatsCollector
+	untrack func()
+	writeMu sync.Mutex
+	written atomic.Int64
 }
 
-var _ net.Conn = &unetConnWrapper{}
+var (
+	_ StatsConn     = &unetConnWrapper{}
+	_ SocketOptions = &unetConnWrapper{}
+)
+
+// newUNetConnWrapper creates a new [unetConnWrapper] for the given
+// conn and the corresponding TCP or UDP endpoint owned by ns.
+func newUNetConnWrapper(ns *gvisorStack, conn net.Conn, ep tcpip.Endpoint) *unetConnWrapper {
+	_, isTCP := conn.(*gonet.TCPConn)
+	stats := newConnStatsCollector(nil)
+	network := "udp"
+	if isTCP {
+		stats = newConnStatsCollector(ep)
+		stats.inFlight, stats.untrack = ns.trackTCPInFlight(ep)
+		network = "tcp"
+	}
+	gcw := &unetConnWrapper{
+		unetSocketOptions: &unetSocketOptions{ep: ep, tcp: isTCP},
+		c:                 conn,
+		stats:             stats,
+		untrack:           ns.trackSocket(fmt.Sprintf("%s %s->%s", network, conn.LocalAddr(), conn.RemoteAddr())),
+	}
+	if isTCP {
+		gcw.segmentation.Store(ns.tcpSegmentation.Load())
+	}
+	return gcw
+}
 
 // Close implements net.Conn
 func (gcw *unetConnWrapper) Close() error {
+	gcw.stats.onClose()
+	gcw.untrack()
 	return gcw.c.Close()
 }
 
+// ConnStats implements StatsConn
+func (gcw *unetConnWrapper) ConnStats() *ConnStats {
+	return gcw.stats.snapshot()
+}
+
 // LocalAddr implements net.Conn
 func (gcw *unetConnWrapper) LocalAddr() net.Addr {
 	return gcw.c.LocalAddr()
@@ -358,7 +523,8 @@ func (gcw *unetConnWrapper) LocalAddr() net.Addr {
 // Read implements net.Conn
 func (gcw *unetConnWrapper) Read(b []byte) (n int, err error) {
 	count, err := gcw.c.Read(b)
-	return count, mapUNetError(err)
+	gcw.stats.onRead(count)
+	return count, MapUNetError(err)
 }
 
 // RemoteAddr implements net.Conn
@@ -383,24 +549,53 @@ func (gcw *unetConnWrapper) SetWriteDeadline(t time.Time) error {
 
 // Write implements net.Conn
 func (gcw *unetConnWrapper) Write(b []byte) (n int, err error) {
-	count, err := gcw.c.Write(b)
-	return count, mapUNetError(err)
+	var count int
+	if config := gcw.segmentation.Load(); config != nil {
+		count, err = gcw.writeSegmented(config, b)
+	} else {
+		count, err = gcw.c.Write(b)
+		gcw.written.Add(int64(count))
+	}
+	gcw.stats.onWrite(count)
+	return count, MapUNetError(err)
+}
+
+// writeSegmented writes each chunk produced by the given [TCPSegmentation]
+// separately. We serialize segmented writes such that we split the stream
+// of written bytes at the correct offsets even with concurrent writers.
+func (gcw *unetConnWrapper) writeSegmented(config *TCPSegmentation, b []byte) (int, error) {
+	defer gcw.writeMu.Unlock()
+	gcw.writeMu.Lock()
+	var total int
+	for _, chunk := range config.split(gcw.written.Load(), b) {
+		count, err := gcw.c.Write(chunk)
+		total += count
+		gcw.written.Add(int64(count))
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
 }
 
 // unetPacketConnWrapper wraps a [model.UDPLikeConn] such that we can use
 // this connection with lucas-clemente/quic-go and remaps unet errors to
 // emulate actual stdlib errors.
 type unetPacketConnWrapper struct {
-	c *gonet.UDPConn
+	*unetSocketOptions
+	c       *gonet.UDPConn
+	untrack func()
 }
 
 var (
 	_ UDPLikeConn     = &unetPacketConnWrapper{}
 	_ syscall.RawConn = &unetPacketConnWrapper{}
+	_ SocketOptions   = &unetPacketConnWrapper{}
 )
 
 // Close implements model.UDPLikeConn
 func (gpcw *unetPacketConnWrapper) Close() error {
+	gpcw.untrack()
 	return gpcw.c.Close()
 }
 
@@ -412,7 +607,7 @@ func (gpcw *unetPacketConnWrapper) LocalAddr() net.Addr {
 // ReadFrom implements model.UDPLikeConn
 func (gpcw *unetPacketConnWrapper) ReadFrom(p []byte) (int, net.Addr, error) {
 	count, addr, err := gpcw.c.ReadFrom(p)
-	return count, addr, mapUNetError(err)
+	return count, addr, MapUNetError(err)
 }
 
 // SetDeadline implements model.UDPLikeConn
@@ -433,7 +628,7 @@ func (gpcw *unetPacketConnWrapper) SetWriteDeadline(t time.Time) error {
 // WriteTo implements model.UDPLikeConn
 func (gpcw *unetPacketConnWrapper) WriteTo(p []byte, addr net.Addr) (int, error) {
 	count, err := gpcw.c.WriteTo(p, addr)
-	return count, mapUNetError(err)
+	return count, MapUNetError(err)
 }
 
 // Implementation note: the following function calls are all stubs and they
@@ -467,18 +662,20 @@ func (gpcw *unetPacketConnWrapper) Write(f func(fd uintptr) (done bool)) error {
 // unetListenerWrapper wraps a [net.Listener] and maps unet
 // errors to the corresponding stdlib errors.
 type unetListenerWrapper struct {
-	l *gonet.TCPListener
+	l       *gvisorTCPListener
+	ns      *gvisorStack
+	untrack func()
 }
 
-var _ net.Listener = &unetListenerWrapper{}
+var _ StatsListener = &unetListenerWrapper{}
 
 // Accept implements net.Listener
 func (glw *unetListenerWrapper) Accept() (net.Conn, error) {
-	conn, err := glw.l.Accept()
+	conn, ep, err := glw.l.Accept()
 	if err != nil {
-		return nil, mapUNetError(err)
+		return nil, MapUNetError(err)
 	}
-	return &unetConnWrapper{conn}, nil
+	return newUNetConnWrapper(glw.ns, conn, ep), nil
 }
 
 // Addr implements net.Listener
@@ -488,5 +685,17 @@ func (glw *unetListenerWrapper) Addr() net.Addr {
 
 // Close implements net.Listener
 func (glw *unetListenerWrapper) Close() error {
+	glw.untrack()
 	return glw.l.Close()
 }
+
+// ListenQueueStats implements StatsListener
+func (glw *unetListenerWrapper) ListenQueueStats() *ListenQueueStats {
+	synDrops, ackDrops := glw.l.ListenOverflows()
+	return &ListenQueueStats{
+		Backlog:  glw.l.Backlog(),
+		Pending:  glw.l.PendingConnections(),
+		SynDrops: synDrops,
+		AckDrops: ackDrops,
+	}
+}
@@ -0,0 +1,174 @@
+package netem
+
+//
+// UNetStack: transport feature toggles
+//
+
+import (
+	"encoding/binary"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// UNetStackOptions contains the OPTIONAL transport-level features of a [UNetStack],
+// which allow to vary the TCP behavior per experiment. The zero value is valid and
+// corresponds to the default behavior. Use [NewUNetStackWithOptions] or
+// [StarTopology.AddHostWithOptions] to create a stack with options.
+//
+// Note that [UNetStack.SetTCPConfig] overrides EnableSACK and DisableReceiveBufferAutoTuning
+// and that the underlying stack does not implement delayed ACKs (i.e., it always
+// acknowledges segments immediately), hence there is no option for them.
+type UNetStackOptions struct {
+	// DisableRACK OPTIONALLY disables RACK loss detection (RFC 8985), in which case
+	// we only use the classic three duplicate acknowledgments rule.
+	DisableRACK bool
+
+	// DisableReceiveBufferAutoTuning OPTIONALLY disables the receive buffer
+	// auto-tuning, in which case the receive window does not grow beyond
+	// the initial receive buffer size.
+	DisableReceiveBufferAutoTuning bool
+
+	// DisableTCPTimestamps OPTIONALLY prevents negotiating TCP timestamps (RFC 7323)
+	// by removing the option from the SYN segments sent and received by the stack.
+	DisableTCPTimestamps bool
+
+	// EnableNagle OPTIONALLY enables Nagle's algorithm, which the
+	// stack disables by default (i.e., TCP_NODELAY is the default).
+	EnableNagle bool
+
+	// EnableSACK OPTIONALLY enables selective acknowledgments
+	// (the underlying stack disables SACK by default).
+	EnableSACK bool
+
+	// TCPSegmentation OPTIONALLY configures the default segmentation of the
+	// TCP conns created by the stack, which each conn may override using
+	// [SocketOptions] (default: we do not split the written data).
+	TCPSegmentation *TCPSegmentation
+
+	// TrackTCPBytesInFlight OPTIONALLY makes the TCP conns created by the stack
+	// track the bytes in flight (see [ConnStats]), which requires inspecting
+	// every received TCP segment and which we therefore disable by default.
+	TrackTCPBytesInFlight bool
+}
+
+// apply applies the options to the given stack.
+func (options *UNetStackOptions) apply(ns *gvisorStack) error {
+	if options.TCPSegmentation != nil && !options.TCPSegmentation.valid() {
+		return syscall.EINVAL
+	}
+	recovery := tcpip.TCPRecovery(tcpip.TCPRACKLossDetection)
+	if options.DisableRACK {
+		recovery = 0
+	}
+	moderate := tcpip.TCPModerateReceiveBufferOption(!options.DisableReceiveBufferAutoTuning)
+	nagle := tcpip.TCPDelayEnabled(options.EnableNagle)
+	sack := tcpip.TCPSACKEnabled(options.EnableSACK)
+	settings := []tcpip.SettableTransportProtocolOption{
+		&recovery,
+		&moderate,
+		&nagle,
+		&sack,
+	}
+	for _, setting := range settings {
+		if err := ns.SetTCPOption(setting); err != nil {
+			return err
+		}
+	}
+	ns.stripTCPTimestamps.Store(options.DisableTCPTimestamps)
+	ns.tcpSegmentation.Store(options.TCPSegmentation)
+	if options.TrackTCPBytesInFlight {
+		ns.enableTCPBytesInFlight()
+	}
+	return nil
+}
+
+// unetStripTCPTimestamps replaces the timestamps option of the given raw IP packet
+// with NOP options, provided that the packet is a TCP SYN segment, and returns
+// whether it modified the packet. We update the TCP checksum incrementally
+// (see RFC 1624). The packet MUST NOT be shared with other parties.
+func unetStripTCPTimestamps(packet []byte) bool {
+	// find the TCP header
+	if len(packet) < 1 {
+		return false
+	}
+	var offset int
+	switch packet[0] >> 4 {
+	case 4:
+		const protocolTCP = 6
+		if len(packet) < 20 || packet[9] != protocolTCP {
+			return false
+		}
+		offset = int(packet[0]&0x0f) * 4
+		if offset < 20 {
+			return false
+		}
+	case 6:
+		const nextHeaderTCP = 6
+		if len(packet) < 40 || packet[6] != nextHeaderTCP {
+			return false
+		}
+		offset = 40
+	default:
+		return false
+	}
+	if offset+20 > len(packet) {
+		return false
+	}
+	segment := packet[offset:]
+
+	// make sure this is a SYN segment
+	const flagSYN = 0x02
+	if segment[13]&flagSYN == 0 {
+		return false
+	}
+	headerLength := int(segment[12]>>4) * 4
+	if headerLength < 20 || headerLength > len(segment) {
+		return false
+	}
+
+	// walk the options and replace the timestamps option
+	const (
+		optionEnd        = 0
+		optionNOP        = 1
+		optionTimestamps = 8
+	)
+	modified := false
+	for idx := 20; idx < headerLength; {
+		kind := segment[idx]
+		if kind == optionEnd {
+			break
+		}
+		if kind == optionNOP {
+			idx++
+			continue
+		}
+		if idx+1 >= headerLength {
+			break
+		}
+		length := int(segment[idx+1])
+		if length < 2 || idx+length > headerLength {
+			break
+		}
+		if kind == optionTimestamps {
+			checksum := uint32(^binary.BigEndian.Uint16(segment[16:18]))
+			first, last := idx&^1, (idx+length-1)&^1
+			for word := first; word <= last; word += 2 {
+				checksum += uint32(^binary.BigEndian.Uint16(segment[word:]))
+			}
+			for pos := idx; pos < idx+length; pos++ {
+				segment[pos] = optionNOP
+			}
+			for word := first; word <= last; word += 2 {
+				checksum += uint32(binary.BigEndian.Uint16(segment[word:]))
+			}
+			for checksum > 0xffff {
+				checksum = (checksum & 0xffff) + (checksum >> 16)
+			}
+			binary.BigEndian.PutUint16(segment[16:18], ^uint16(checksum))
+			modified = true
+		}
+		idx += length
+	}
+	return modified
+}
@@ -0,0 +1,230 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// tcpObserver is a [PacketObserver] collecting the TCP segments.
+type tcpObserver struct {
+	mu       sync.Mutex
+	segments []*layers.TCP
+}
+
+var _ PacketObserver = &tcpObserver{}
+
+// ObservePacket implements PacketObserver.
+func (so *tcpObserver) ObservePacket(packet []byte) {
+	dp, err := DissectPacket(packet)
+	if err != nil || dp.TCP == nil {
+		return
+	}
+	so.mu.Lock()
+	so.segments = append(so.segments, dp.TCP)
+	so.mu.Unlock()
+}
+
+// tcpHasOption returns whether the given segment contains the given option.
+func tcpHasOption(segment *layers.TCP, kind layers.TCPOptionKind) bool {
+	for _, option := range segment.Options {
+		if option.OptionType == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUNetStackOptions(t *testing.T) {
+	t.Run("we configure the TCP protocol options", func(t *testing.T) {
+		stack := Must1(NewUNetStackWithOptions(&NullLogger{}, 1500, "10.0.0.2", MustNewCA(), "0.0.0.0", &UNetStackOptions{
+			DisableRACK:                    true,
+			DisableReceiveBufferAutoTuning: true,
+			EnableNagle:                    true,
+			EnableSACK:                     true,
+		}))
+		defer stack.Close()
+		var (
+			recovery tcpip.TCPRecovery
+			moderate tcpip.TCPModerateReceiveBufferOption
+			nagle    tcpip.TCPDelayEnabled
+			sack     tcpip.TCPSACKEnabled
+		)
+		_ = stack.ns.stack.TransportProtocolOption(tcp.ProtocolNumber, &recovery)
+		_ = stack.ns.stack.TransportProtocolOption(tcp.ProtocolNumber, &moderate)
+		_ = stack.ns.stack.TransportProtocolOption(tcp.ProtocolNumber, &nagle)
+		_ = stack.ns.stack.TransportProtocolOption(tcp.ProtocolNumber, &sack)
+		if recovery != 0 || bool(moderate) || !bool(nagle) || !bool(sack) {
+			t.Fatal("unexpected options", recovery, moderate, nagle, sack)
+		}
+	})
+
+	t.Run("we segment the data written by new TCP conns", func(t *testing.T) {
+		observer := &tcpObserver{}
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		topology.router.SetPacketObserver(observer)
+		server := Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+		options := &UNetStackOptions{TCPSegmentation: &TCPSegmentation{SegmentSize: 4}}
+		client := Must1(topology.AddHostWithOptions("10.0.0.2", "0.0.0.0", &LinkConfig{}, options))
+
+		listener := Must1(server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+		defer listener.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn := Must1(client.DialContext(ctx, "tcp", "10.0.0.1:80"))
+		defer conn.Close()
+		Must1(conn.Write([]byte("hello, world")))
+		serverConn := Must1(listener.Accept())
+		defer serverConn.Close()
+		Must0(serverConn.SetDeadline(time.Now().Add(5 * time.Second)))
+		Must1(io.ReadFull(serverConn, make([]byte, 12)))
+
+		observer.mu.Lock()
+		defer observer.mu.Unlock()
+		var count int
+		for _, segment := range observer.segments {
+			if len(segment.Payload) > 0 {
+				if len(segment.Payload) != 4 {
+					t.Fatal("unexpected segment size", len(segment.Payload))
+				}
+				count++
+			}
+		}
+		if count != 3 {
+			t.Fatal("expected three segments, got", count)
+		}
+	})
+
+	t.Run("we reject an invalid segmentation", func(t *testing.T) {
+		options := &UNetStackOptions{TCPSegmentation: &TCPSegmentation{Offsets: []int64{-1}}}
+		_, err := NewUNetStackWithOptions(&NullLogger{}, 1500, "10.0.0.2", MustNewCA(), "0.0.0.0", options)
+		if !errors.Is(err, syscall.EINVAL) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("the zero value preserves the defaults", func(t *testing.T) {
+		stack := Must1(NewUNetStack(&NullLogger{}, 1500, "10.0.0.2", MustNewCA(), "0.0.0.0"))
+		defer stack.Close()
+		var (
+			recovery tcpip.TCPRecovery
+			moderate tcpip.TCPModerateReceiveBufferOption
+		)
+		_ = stack.ns.stack.TransportProtocolOption(tcp.ProtocolNumber, &recovery)
+		_ = stack.ns.stack.TransportProtocolOption(tcp.ProtocolNumber, &moderate)
+		if recovery != tcpip.TCPRACKLossDetection || !bool(moderate) {
+			t.Fatal("unexpected options", recovery, moderate)
+		}
+	})
+
+	for _, clientDisables := range []bool{true, false} {
+		name := map[bool]string{true: "client", false: "server"}[clientDisables]
+		t.Run("the "+name+" can disable timestamps", func(t *testing.T) {
+			observer := &tcpObserver{}
+			topology := MustNewStarTopology(&NullLogger{})
+			defer topology.Close()
+			topology.router.SetPacketObserver(observer)
+			linkConfig := &LinkConfig{LeftToRightDelay: time.Millisecond}
+			serverOptions := &UNetStackOptions{DisableTCPTimestamps: !clientDisables}
+			server := Must1(topology.AddHostWithOptions("10.0.0.1", "0.0.0.0", linkConfig, serverOptions))
+			clientOptions := &UNetStackOptions{DisableTCPTimestamps: clientDisables, EnableSACK: true}
+			client := Must1(topology.AddHostWithOptions("10.0.0.2", "0.0.0.0", linkConfig, clientOptions))
+
+			listener := Must1(server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}))
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_, _ = conn.Write([]byte("hello, world"))
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn := Must1(client.DialContext(ctx, "tcp", "10.0.0.1:80"))
+			defer conn.Close()
+			data := Must1(io.ReadAll(conn))
+			if string(data) != "hello, world" {
+				t.Fatal("unexpected data", string(data))
+			}
+
+			// when the server disables timestamps, it removes the option from the
+			// incoming SYN, hence only the SYN emitted by the client contains it
+			observer.mu.Lock()
+			defer observer.mu.Unlock()
+			if len(observer.segments) < 3 || !observer.segments[0].SYN || observer.segments[0].ACK {
+				t.Fatal("expected the client SYN followed by other segments")
+			}
+			syn := observer.segments[0]
+			if tcpHasOption(syn, layers.TCPOptionKindTimestamps) != !clientDisables {
+				t.Fatal("unexpected SYN options", syn.Options)
+			}
+			if !tcpHasOption(syn, layers.TCPOptionKindSACKPermitted) {
+				t.Fatal("expected the SACK permitted option", syn.Options)
+			}
+			for _, segment := range observer.segments[1:] {
+				if tcpHasOption(segment, layers.TCPOptionKindTimestamps) {
+					t.Fatal("expected no timestamps option", segment.Options)
+				}
+			}
+		})
+	}
+
+	t.Run("unetStripTCPTimestamps", func(t *testing.T) {
+		serialize := func(syn bool) []byte {
+			ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+				SrcIP: net.IPv4(10, 0, 0, 2), DstIP: net.IPv4(10, 0, 0, 1)}
+			segment := &layers.TCP{SrcPort: 54321, DstPort: 80, SYN: syn, ACK: !syn, Window: 65535, Options: []layers.TCPOption{{
+				OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4},
+			}, {
+				OptionType: layers.TCPOptionKindNop, OptionLength: 1,
+			}, {
+				OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10,
+				OptionData: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			}, {
+				OptionType: layers.TCPOptionKindNop, OptionLength: 1,
+			}}}
+			Must0(segment.SetNetworkLayerForChecksum(ip))
+			buffer := gopacket.NewSerializeBuffer()
+			options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+			Must0(gopacket.SerializeLayers(buffer, options, ip, segment))
+			return buffer.Bytes()
+		}
+
+		packet := serialize(true)
+		if !unetStripTCPTimestamps(packet) {
+			t.Fatal("expected to modify the SYN segment")
+		}
+		dp := Must1(DissectPacket(packet))
+		if tcpHasOption(dp.TCP, layers.TCPOptionKindTimestamps) || !tcpHasOption(dp.TCP, layers.TCPOptionKindMSS) {
+			t.Fatal("unexpected options", dp.TCP.Options)
+		}
+		checksum := dp.TCP.Checksum
+		reserialized := Must1(dp.Serialize())
+		if expect := Must1(DissectPacket(reserialized)).TCP.Checksum; checksum != expect {
+			t.Fatalf("expected checksum %#x, got %#x", expect, checksum)
+		}
+
+		if unetStripTCPTimestamps(serialize(false)) {
+			t.Fatal("expected not to modify a non-SYN segment")
+		}
+		for _, invalid := range [][]byte{nil, {0x45}, {0x41, 0, 0, 0, 0, 0, 0, 0, 0, 6}, make([]byte, 60)} {
+			if unetStripTCPTimestamps(invalid) {
+				t.Fatal("expected not to modify an invalid packet")
+			}
+		}
+	})
+}
@@ -0,0 +1,575 @@
+package netem
+
+//
+// OONI Web Connectivity test helper emulation
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// WebConnectivityTHRequest is the request sent by the probe to the Web
+// Connectivity test helper (TH), which is compatible with the OONI one.
+type WebConnectivityTHRequest struct {
+	// HTTPRequest is the URL to measure.
+	HTTPRequest string `json:"http_request"`
+
+	// HTTPRequestHeaders contains the headers used by the probe.
+	HTTPRequestHeaders map[string][]string `json:"http_request_headers"`
+
+	// TCPConnect contains the endpoints discovered by the probe.
+	TCPConnect []string `json:"tcp_connect"`
+
+	// XQUICEnabled indicates whether the probe wants the TH to use QUIC.
+	XQUICEnabled bool `json:"x_quic_enabled"`
+}
+
+// WebConnectivityTHTCPConnectResult is the result of a TCP connect.
+type WebConnectivityTHTCPConnectResult struct {
+	Status  bool    `json:"status"`
+	Failure *string `json:"failure"`
+}
+
+// WebConnectivityTHTLSHandshakeResult is the result of a TLS or QUIC handshake.
+type WebConnectivityTHTLSHandshakeResult struct {
+	ServerName string  `json:"server_name"`
+	Status     bool    `json:"status"`
+	Failure    *string `json:"failure"`
+}
+
+// WebConnectivityTHHTTPRequestResult is the result of an HTTP request.
+type WebConnectivityTHHTTPRequestResult struct {
+	BodyLength           int64             `json:"body_length"`
+	DiscoveredH3Endpoint string            `json:"discovered_h3_endpoint"`
+	Failure              *string           `json:"failure"`
+	Title                string            `json:"title"`
+	Headers              map[string]string `json:"headers"`
+	StatusCode           int64             `json:"status_code"`
+}
+
+// WebConnectivityTHDNSResult is the result of the DNS lookup.
+type WebConnectivityTHDNSResult struct {
+	Failure *string  `json:"failure"`
+	Addrs   []string `json:"addrs"`
+}
+
+// WebConnectivityTHIPInfo contains information about an IP address.
+type WebConnectivityTHIPInfo struct {
+	ASN   int64 `json:"asn"`
+	Flags int64 `json:"flags"`
+}
+
+// These flags are the possible values of [WebConnectivityTHIPInfo] Flags.
+const (
+	WebConnectivityTHIPInfoFlagResolvedByProbe = 1 << iota
+	WebConnectivityTHIPInfoFlagResolvedByTH
+	WebConnectivityTHIPInfoFlagIsBogon
+	WebConnectivityTHIPInfoFlagValidForDomain
+)
+
+// WebConnectivityTHResponse is the response returned by the TH.
+type WebConnectivityTHResponse struct {
+	TCPConnect    map[string]WebConnectivityTHTCPConnectResult   `json:"tcp_connect"`
+	TLSHandshake  map[string]WebConnectivityTHTLSHandshakeResult `json:"tls_handshake"`
+	QUICHandshake map[string]WebConnectivityTHTLSHandshakeResult `json:"quic_handshake"`
+	HTTPRequest   WebConnectivityTHHTTPRequestResult             `json:"http_request"`
+	HTTP3Request  *WebConnectivityTHHTTPRequestResult            `json:"http3_request"`
+	DNS           WebConnectivityTHDNSResult                     `json:"dns"`
+	IPInfo        map[string]*WebConnectivityTHIPInfo            `json:"ip_info"`
+}
+
+// WebConnectivityTHConfig contains the [WebConnectivityTH] configuration. With
+// the zero value, the TH listens on ports 80 and 443 using a 10 s timeout.
+type WebConnectivityTHConfig struct {
+	// HTTPPort is the OPTIONAL TCP port for HTTP (default: 80).
+	HTTPPort int
+
+	// HTTPSPort is the OPTIONAL TCP port for HTTPS (default: 443).
+	HTTPSPort int
+
+	// ServerNames contains the OPTIONAL names for which the TH presents a
+	// certificate in addition to its IP address (e.g., "0.th.ooni.org").
+	ServerNames []string
+
+	// Timeout is the OPTIONAL timeout of each network operation performed
+	// by the TH, including the HTTP request (default: 10 s).
+	Timeout time.Duration
+}
+
+// timeout returns the configured timeout or the default.
+func (c *WebConnectivityTHConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 10 * time.Second
+}
+
+// WebConnectivityTH emulates the OONI Web Connectivity test helper, which
+// allows running complete web_connectivity measurements inside a topology.
+// The TH performs its measurements using the stack on which it runs, so it
+// sees the network as seen by the host running it (typically an uncensored
+// host). The zero value is invalid, please construct using [NewWebConnectivityTH].
+type WebConnectivityTH struct {
+	once    sync.Once
+	servers []*http.Server
+}
+
+// NewWebConnectivityTH creates a new [WebConnectivityTH] listening on the given
+// IP address for both HTTP and HTTPS. Remember to call [WebConnectivityTH.Close]
+// when done. See [NewWebConnectivityTHHandler] for the API we implement.
+func NewWebConnectivityTH(
+	logger Logger,
+	stack HTTPUnderlyingNetwork,
+	ipAddress string,
+	config *WebConnectivityTHConfig,
+) (*WebConnectivityTH, error) {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP == nil {
+		return nil, ErrNotIPAddress
+	}
+	httpPort := config.HTTPPort
+	if httpPort <= 0 {
+		httpPort = 80
+	}
+	httpsPort := config.HTTPSPort
+	if httpsPort <= 0 {
+		httpsPort = 443
+	}
+
+	ns := &Net{Stack: stack}
+	httpListener, err := ns.ListenTCP("tcp", &net.TCPAddr{IP: parsedIP, Port: httpPort})
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := stack.MustNewServerTLSConfig(ipAddress, config.ServerNames...)
+	httpsListener, err := ns.ListenTLS("tcp", &net.TCPAddr{IP: parsedIP, Port: httpsPort}, tlsConfig)
+	if err != nil {
+		httpListener.Close()
+		return nil, err
+	}
+
+	th := &WebConnectivityTH{}
+	handler := NewWebConnectivityTHHandler(stack, config)
+	for _, listener := range []net.Listener{httpListener, httpsListener} {
+		server := &http.Server{Handler: handler}
+		th.servers = append(th.servers, server)
+		go func(listener net.Listener) {
+			err := server.Serve(listener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				logger.Warnf("netem: WebConnectivityTH: %s", err.Error())
+			}
+		}(listener)
+	}
+	return th, nil
+}
+
+// Close closes the TH.
+func (th *WebConnectivityTH) Close() error {
+	th.once.Do(func() {
+		for _, server := range th.servers {
+			server.Close()
+		}
+	})
+	return nil
+}
+
+// NewWebConnectivityTHHandler returns the [http.Handler] implementing the Web
+// Connectivity TH API, which accepts a POST containing a [WebConnectivityTHRequest]
+// and returns a [WebConnectivityTHResponse]. For the given URL, the handler:
+//
+// - resolves the domain using the stack's getaddrinfo;
+//
+// - connects to the endpoints discovered by the probe and by the TH and, for
+// https URLs, performs TLS handshakes using the URL's domain as the SNI;
+//
+// - fetches the URL following redirects and using the probe's headers;
+//
+// - when the probe enables QUIC and the server advertises HTTP/3 using
+// Alt-Svc, performs QUIC handshakes and fetches the URL using HTTP/3.
+//
+// Like the OONI TH, we serve the API at the "/" path.
+func NewWebConnectivityTHHandler(stack HTTPUnderlyingNetwork, config *WebConnectivityTHConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req WebConnectivityTHRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		URL, err := url.Parse(req.HTTPRequest)
+		if err != nil || (URL.Scheme != "http" && URL.Scheme != "https") || URL.Hostname() == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := webConnectivityTHMeasure(r.Context(), stack, config.timeout(), URL, &req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// webConnectivityTHMeasure performs the TH measurement.
+func webConnectivityTHMeasure(
+	ctx context.Context,
+	stack HTTPUnderlyingNetwork,
+	timeout time.Duration,
+	URL *url.URL,
+	req *WebConnectivityTHRequest,
+) *WebConnectivityTHResponse {
+	resp := &WebConnectivityTHResponse{
+		TCPConnect:    map[string]WebConnectivityTHTCPConnectResult{},
+		TLSHandshake:  map[string]WebConnectivityTHTLSHandshakeResult{},
+		QUICHandshake: map[string]WebConnectivityTHTLSHandshakeResult{},
+		HTTPRequest:   WebConnectivityTHHTTPRequestResult{Headers: map[string]string{}},
+		HTTP3Request:  nil,
+		DNS:           WebConnectivityTHDNSResult{Addrs: []string{}},
+		IPInfo:        map[string]*WebConnectivityTHIPInfo{},
+	}
+	hostname := URL.Hostname()
+	port := URL.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[URL.Scheme]
+	}
+
+	// resolve the domain name and fetch the URL in parallel
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if net.ParseIP(hostname) != nil {
+			resp.DNS.Addrs = []string{hostname}
+			return
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		addrs, _, err := stack.GetaddrinfoLookupANY(lookupCtx, hostname)
+		if err != nil {
+			resp.DNS.Failure = webConnectivityTHMapDNSFailure(err)
+			return
+		}
+		resp.DNS.Addrs = addrs
+	}()
+	go func() {
+		defer wg.Done()
+		client := NewHTTPClientWithOptions(stack, &HTTPClientOptions{Timeout: timeout})
+		resp.HTTPRequest = webConnectivityTHHTTPRequest(ctx, client, URL, req.HTTPRequestHeaders)
+	}()
+	wg.Wait()
+
+	// build the IP info and the endpoints to measure
+	for _, endpoint := range req.TCPConnect {
+		if addr, _, err := net.SplitHostPort(endpoint); err == nil {
+			webConnectivityTHIPInfo(resp.IPInfo, addr).Flags |= WebConnectivityTHIPInfoFlagResolvedByProbe
+		}
+	}
+	endpoints := append([]string{}, req.TCPConnect...)
+	for _, addr := range resp.DNS.Addrs {
+		webConnectivityTHIPInfo(resp.IPInfo, addr).Flags |= WebConnectivityTHIPInfoFlagResolvedByTH
+		endpoints = append(endpoints, net.JoinHostPort(addr, port))
+	}
+
+	// measure each endpoint in parallel
+	mu := &sync.Mutex{}
+	for _, endpoint := range endpoints {
+		mu.Lock()
+		_, found := resp.TCPConnect[endpoint]
+		resp.TCPConnect[endpoint] = WebConnectivityTHTCPConnectResult{}
+		mu.Unlock()
+		if found {
+			continue
+		}
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			tcp, tls := webConnectivityTHMeasureEndpoint(ctx, stack, timeout, URL, endpoint)
+			defer mu.Unlock()
+			mu.Lock()
+			resp.TCPConnect[endpoint] = tcp
+			if tls != nil {
+				resp.TLSHandshake[endpoint] = *tls
+			}
+		}(endpoint)
+	}
+
+	// use QUIC when the probe asks us to and the server supports HTTP/3
+	if req.XQUICEnabled && resp.HTTPRequest.DiscoveredH3Endpoint != "" {
+		for _, addr := range resp.DNS.Addrs {
+			wg.Add(1)
+			go func(endpoint string) {
+				defer wg.Done()
+				result := webConnectivityTHQUICHandshake(ctx, stack, timeout, hostname, endpoint)
+				defer mu.Unlock()
+				mu.Lock()
+				resp.QUICHandshake[endpoint] = result
+			}(net.JoinHostPort(addr, "443"))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			txp := NewHTTP3Transport(stack)
+			defer txp.Close()
+			result := webConnectivityTHHTTPRequest(ctx, &http.Client{
+				Transport: txp,
+				Timeout:   timeout,
+			}, URL, req.HTTPRequestHeaders)
+			resp.HTTP3Request = &result
+		}()
+	}
+	wg.Wait()
+
+	// finish building the IP info
+	for endpoint, result := range resp.TLSHandshake {
+		addr, _, _ := net.SplitHostPort(endpoint)
+		if info, found := resp.IPInfo[addr]; found && result.Status {
+			info.Flags |= WebConnectivityTHIPInfoFlagValidForDomain
+		}
+	}
+	return resp
+}
+
+// webConnectivityTHIPInfo returns the IP info for the given address, creating
+// it as needed and setting the bogon flag when needed.
+func webConnectivityTHIPInfo(ipInfo map[string]*WebConnectivityTHIPInfo, addr string) *WebConnectivityTHIPInfo {
+	info, found := ipInfo[addr]
+	if !found {
+		info = &WebConnectivityTHIPInfo{}
+		if webConnectivityTHIsBogon(addr) {
+			info.Flags |= WebConnectivityTHIPInfoFlagIsBogon
+		}
+		ipInfo[addr] = info
+	}
+	return info
+}
+
+// webConnectivityTHBogons contains the bogon prefixes.
+var webConnectivityTHBogons = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// webConnectivityTHIsBogon returns whether the given address is a bogon.
+func webConnectivityTHIsBogon(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range webConnectivityTHBogons {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// webConnectivityTHMeasureEndpoint connects to the given endpoint and, for
+// https URLs, performs a TLS handshake using the URL's domain.
+func webConnectivityTHMeasureEndpoint(
+	ctx context.Context,
+	stack HTTPUnderlyingNetwork,
+	timeout time.Duration,
+	URL *url.URL,
+	endpoint string,
+) (WebConnectivityTHTCPConnectResult, *WebConnectivityTHTLSHandshakeResult) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := stack.DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		return WebConnectivityTHTCPConnectResult{Failure: webConnectivityTHMapFailure(err)}, nil
+	}
+	defer conn.Close()
+	if URL.Scheme != "https" {
+		return WebConnectivityTHTCPConnectResult{Status: true}, nil
+	}
+	result := &WebConnectivityTHTLSHandshakeResult{ServerName: URL.Hostname()}
+	tc := tls.Client(conn, &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+		RootCAs:    stack.DefaultCertPool(),
+		ServerName: URL.Hostname(),
+	})
+	if err := tc.HandshakeContext(ctx); err != nil {
+		result.Failure = webConnectivityTHMapFailure(err)
+	} else {
+		result.Status = true
+	}
+	return WebConnectivityTHTCPConnectResult{Status: true}, result
+}
+
+// webConnectivityTHQUICHandshake performs a QUIC handshake with the endpoint.
+func webConnectivityTHQUICHandshake(
+	ctx context.Context,
+	stack HTTPUnderlyingNetwork,
+	timeout time.Duration,
+	hostname string,
+	endpoint string,
+) WebConnectivityTHTLSHandshakeResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	result := WebConnectivityTHTLSHandshakeResult{ServerName: hostname}
+	conn, err := quicDial(ctx, stack, endpoint, &tls.Config{
+		NextProtos: []string{"h3"},
+		RootCAs:    stack.DefaultCertPool(),
+		ServerName: hostname,
+	}, nil)
+	if err != nil {
+		result.Failure = webConnectivityTHMapFailure(err)
+		return result
+	}
+	conn.CloseWithError(0, "")
+	result.Status = true
+	return result
+}
+
+// webConnectivityTHTitle matches the title of a web page.
+var webConnectivityTHTitle = regexp.MustCompile(`(?i)<title>([^<]{1,512})</title>`)
+
+// webConnectivityTHHeaders contains the probe headers we forward.
+var webConnectivityTHHeaders = []string{"Accept", "Accept-Language", "User-Agent"}
+
+// webConnectivityTHHTTPRequest fetches the given URL using the given client.
+func webConnectivityTHHTTPRequest(
+	ctx context.Context,
+	client *http.Client,
+	URL *url.URL,
+	headers map[string][]string,
+) WebConnectivityTHHTTPRequestResult {
+	result := WebConnectivityTHHTTPRequestResult{Headers: map[string]string{}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, URL.String(), nil)
+	if err != nil {
+		result.Failure = webConnectivityTHMapFailure(err)
+		return result
+	}
+	for _, key := range webConnectivityTHHeaders {
+		for _, value := range http.Header(headers).Values(key) {
+			req.Header.Add(key, value)
+		}
+	}
+	if client.Jar == nil {
+		// note: cookiejar.New never returns an error
+		client.Jar = Must1(cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List}))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Failure = webConnectivityTHMapFailure(err)
+		return result
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<24))
+	if err != nil {
+		result.Failure = webConnectivityTHMapFailure(err)
+	}
+	result.BodyLength = int64(len(body))
+	result.StatusCode = int64(resp.StatusCode)
+	for key := range resp.Header {
+		result.Headers[key] = resp.Header.Get(key)
+	}
+	if match := webConnectivityTHTitle.FindSubmatch(body); len(match) > 1 {
+		result.Title = string(match[1])
+	}
+	if resp.Request.URL.Scheme == "https" && webConnectivityTHAdvertisesH3(resp.Header) {
+		host := resp.Request.URL.Hostname()
+		result.DiscoveredH3Endpoint = net.JoinHostPort(host, "443")
+	}
+	return result
+}
+
+// webConnectivityTHAltSvcH3 matches an Alt-Svc advertising HTTP/3 on port 443.
+var webConnectivityTHAltSvcH3 = regexp.MustCompile(`(^|[ ,])h3="[^"]*:443"`)
+
+// webConnectivityTHAdvertisesH3 returns whether the Alt-Svc header
+// advertises HTTP/3 on the default port.
+func webConnectivityTHAdvertisesH3(header http.Header) bool {
+	for _, value := range header.Values("Alt-Svc") {
+		if webConnectivityTHAltSvcH3.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// webConnectivityTHMapDNSFailure maps a DNS error to the strings
+// used by the OONI TH, which differ from the ones used by probes.
+func webConnectivityTHMapDNSFailure(err error) *string {
+	var failure string
+	switch {
+	case errors.Is(err, ErrDNSNoSuchHost):
+		failure = "dns_name_error"
+	case errors.Is(err, ErrDNSNoAnswer):
+		return nil // the OONI TH returns no addresses and no failure
+	default:
+		failure = "dns_server_failure"
+	}
+	return &failure
+}
+
+// webConnectivityTHMapFailure maps an error to an OONI failure string.
+func webConnectivityTHMapFailure(err error) *string {
+	var (
+		hostnameErr  x509.HostnameError
+		authorityErr x509.UnknownAuthorityError
+		certErr      x509.CertificateInvalidError
+		netErr       net.Error
+	)
+	var failure string
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		failure = "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		failure = "connection_reset"
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		failure = "host_unreachable"
+	case errors.Is(err, syscall.ENETUNREACH):
+		failure = "network_unreachable"
+	case errors.Is(err, ErrDNSNoSuchHost):
+		failure = "dns_nxdomain_error"
+	case errors.Is(err, ErrDNSNoAnswer):
+		failure = "dns_no_answer"
+	case errors.Is(err, ErrDNSServerMisbehaving):
+		failure = "dns_server_misbehaving"
+	case errors.As(err, &hostnameErr):
+		failure = "ssl_invalid_hostname"
+	case errors.As(err, &authorityErr):
+		failure = "ssl_unknown_authority"
+	case errors.As(err, &certErr):
+		failure = "ssl_invalid_certificate"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		failure = "eof_error"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		failure = "generic_timeout_error"
+	default:
+		failure = "unknown_failure: " + err.Error()
+	}
+	return &failure
+}
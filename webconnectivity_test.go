@@ -0,0 +1,119 @@
+package netem
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWebConnectivityTH(t *testing.T) {
+	// create the following star topology:
+	//
+	//	- 10.0.0.1 runs the DNS server and the web server
+	//	- 10.0.0.2 is the probe
+	//	- 10.0.0.3 is the TH
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+	server := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", &LinkConfig{}))
+	probe := Must1(topology.AddHost("10.0.0.2", "10.0.0.1", &LinkConfig{}))
+	thHost := Must1(topology.AddHost("10.0.0.3", "10.0.0.1", &LinkConfig{}))
+
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("www.example.com", "", "10.0.0.1"))
+	Must0(dnsConfig.AddRecord("0.th.ooni.org", "", "10.0.0.3"))
+	dnsServer := Must1(NewDNSServer(&NullLogger{}, server, "10.0.0.1", dnsConfig))
+	defer dnsServer.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head><title>Example Domain</title></head></html>"))
+	})
+	tlsConfig := server.MustNewServerTLSConfig("www.example.com")
+	listener := Must1((&Net{Stack: server}).ListenTLS(
+		"tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, tlsConfig))
+	webServer := &http.Server{Handler: handler}
+	defer webServer.Close()
+	go webServer.Serve(listener)
+
+	th := Must1(NewWebConnectivityTH(&NullLogger{}, thHost, "10.0.0.3", &WebConnectivityTHConfig{
+		ServerNames: []string{"0.th.ooni.org"},
+		Timeout:     time.Second,
+	}))
+	defer th.Close()
+
+	// query sends the given request to the TH like a probe would do.
+	query := func(t *testing.T, req *WebConnectivityTHRequest) *WebConnectivityTHResponse {
+		client := NewHTTPClient(probe)
+		resp, err := client.Post("https://0.th.ooni.org/", "application/json", bytes.NewReader(Must1(json.Marshal(req))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("unexpected status code", resp.StatusCode)
+		}
+		var thResp WebConnectivityTHResponse
+		Must0(json.NewDecoder(resp.Body).Decode(&thResp))
+		return &thResp
+	}
+
+	t.Run("for a working website", func(t *testing.T) {
+		resp := query(t, &WebConnectivityTHRequest{
+			HTTPRequest:        "https://www.example.com/",
+			HTTPRequestHeaders: map[string][]string{"User-Agent": {"miniooni/0.1.0"}},
+			TCPConnect:         []string{"10.0.0.1:443", "10.0.0.4:443"},
+		})
+		if resp.DNS.Failure != nil || len(resp.DNS.Addrs) != 1 || resp.DNS.Addrs[0] != "10.0.0.1" {
+			t.Fatal("unexpected DNS result", resp.DNS)
+		}
+		if result := resp.TCPConnect["10.0.0.1:443"]; !result.Status {
+			t.Fatal("unexpected TCP connect result", result)
+		}
+		if result := resp.TCPConnect["10.0.0.4:443"]; result.Status || result.Failure == nil ||
+			*result.Failure != "generic_timeout_error" {
+			t.Fatal("unexpected TCP connect result", result)
+		}
+		if result := resp.TLSHandshake["10.0.0.1:443"]; !result.Status || result.ServerName != "www.example.com" {
+			t.Fatal("unexpected TLS handshake result", result)
+		}
+		if resp.HTTPRequest.Failure != nil || resp.HTTPRequest.StatusCode != 200 ||
+			resp.HTTPRequest.Title != "Example Domain" || resp.HTTPRequest.Headers["Content-Type"] != "text/html" {
+			t.Fatal("unexpected HTTP result", resp.HTTPRequest)
+		}
+		expectFlags := int64(WebConnectivityTHIPInfoFlagResolvedByProbe | WebConnectivityTHIPInfoFlagResolvedByTH |
+			WebConnectivityTHIPInfoFlagIsBogon | WebConnectivityTHIPInfoFlagValidForDomain)
+		if info := resp.IPInfo["10.0.0.1"]; info == nil || info.Flags != expectFlags {
+			t.Fatal("unexpected IP info", info)
+		}
+	})
+
+	t.Run("for a nonexistent domain", func(t *testing.T) {
+		resp := query(t, &WebConnectivityTHRequest{
+			HTTPRequest: "https://nxdomain.example.com/",
+		})
+		if resp.DNS.Failure == nil || *resp.DNS.Failure != "dns_name_error" {
+			t.Fatal("unexpected DNS result", resp.DNS)
+		}
+		if resp.HTTPRequest.Failure == nil || *resp.HTTPRequest.Failure != "dns_nxdomain_error" {
+			t.Fatal("unexpected HTTP result", resp.HTTPRequest)
+		}
+		if len(resp.TCPConnect) != 0 {
+			t.Fatal("unexpected TCP connect results", resp.TCPConnect)
+		}
+	})
+
+	t.Run("we reject invalid requests", func(t *testing.T) {
+		client := NewHTTPClient(probe)
+		resp, err := client.Get("https://0.th.ooni.org/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatal("unexpected status code", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package netem
+
+//
+// WebSocket helpers
+//
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// webSocketMessage is a raw WebSocket message along with its payload
+// type (i.e., [websocket.TextFrame] or [websocket.BinaryFrame]).
+type webSocketMessage struct {
+	data        []byte
+	payloadType byte
+}
+
+// webSocketRawCodec is a [websocket.Codec] that sends and receives
+// [*webSocketMessage] preserving the message payload type.
+var webSocketRawCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		msg := v.(*webSocketMessage)
+		return msg.data, msg.payloadType, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		msg := v.(*webSocketMessage)
+		msg.data, msg.payloadType = data, payloadType
+		return nil
+	},
+}
+
+// NewWebSocketHandler returns an [http.Handler] that upgrades requests to
+// WebSocket and calls the given handler with the resulting conn. When you
+// specify subprotocols, the handler rejects clients that do not request any
+// of them and otherwise selects the first one requested by the client. The
+// handler does not check the Origin header, which simplifies testing.
+func NewWebSocketHandler(handler func(conn *websocket.Conn), protocols ...string) http.Handler {
+	return websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			if len(protocols) <= 0 {
+				config.Protocol = nil
+				return nil
+			}
+			for _, requested := range config.Protocol {
+				for _, supported := range protocols {
+					if requested == supported {
+						config.Protocol = []string{requested}
+						return nil
+					}
+				}
+			}
+			return websocket.ErrBadWebSocketProtocol
+		},
+		Handler: handler,
+	}
+}
+
+// NewWebSocketEchoHandler is like [NewWebSocketHandler] but echoes back each
+// message preserving its type until the client closes the connection.
+func NewWebSocketEchoHandler(protocols ...string) http.Handler {
+	return NewWebSocketHandler(func(conn *websocket.Conn) {
+		defer conn.Close()
+		for {
+			var msg webSocketMessage
+			if err := webSocketRawCodec.Receive(conn, &msg); err != nil {
+				return
+			}
+			if err := webSocketRawCodec.Send(conn, &msg); err != nil {
+				return
+			}
+		}
+	}, protocols...)
+}
+
+// DialWebSocket establishes a WebSocket connection with the given ws:// or
+// wss:// URL using the given [UnderlyingNetwork] and requesting the given
+// subprotocols. For wss:// URLs, we use TLS with the http/1.1 ALPN. The ctx
+// bounds the connect and handshake time but not the conn lifetime.
+func DialWebSocket(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	URL string,
+	protocols ...string,
+) (*websocket.Conn, error) {
+	conn, _, err := dialWebSocket(ctx, stack, URL, protocols...)
+	return conn, err
+}
+
+// dialWebSocket is like [DialWebSocket] but also returns the underlying conn.
+func dialWebSocket(
+	ctx context.Context,
+	stack UnderlyingNetwork,
+	URL string,
+	protocols ...string,
+) (*websocket.Conn, net.Conn, error) {
+	config, err := websocket.NewConfig(URL, URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Protocol = protocols
+
+	// determine whether to use TLS and the port
+	ns := &Net{Stack: stack, ALPN: []string{"http/1.1"}}
+	dialers := map[string]func(context.Context, string, string) (net.Conn, error){
+		"ws":  ns.DialContext,
+		"wss": ns.DialTLSContext,
+	}
+	defaultPorts := map[string]string{"ws": "80", "wss": "443"}
+	dialer, found := dialers[config.Location.Scheme]
+	if !found {
+		return nil, nil, fmt.Errorf("netem: websocket: unsupported URL scheme: %s", config.Location.Scheme)
+	}
+	address := config.Location.Host
+	if config.Location.Port() == "" {
+		address = net.JoinHostPort(config.Location.Hostname(), defaultPorts[config.Location.Scheme])
+	}
+
+	netConn, err := dialer(ctx, "tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// honour the context during the handshake
+	if deadline, okay := ctx.Deadline(); okay {
+		_ = netConn.SetDeadline(deadline)
+	}
+	conn, err := websocket.NewClient(config, netConn)
+	if err != nil {
+		netConn.Close()
+		return nil, nil, err
+	}
+	_ = netConn.SetDeadline(time.Time{})
+	return conn, netConn, nil
+}
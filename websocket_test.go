@@ -0,0 +1,83 @@
+package netem
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{
+		LeftToRightDelay: 10 * time.Millisecond,
+		RightToLeftDelay: 10 * time.Millisecond,
+	})
+	defer topology.Close()
+
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("ws.local", "", "10.0.0.1"))
+	dnsServer := Must1(NewDNSServer(&NullLogger{}, topology.Server, "10.0.0.1", dnsConfig))
+	defer dnsServer.Close()
+
+	// serve the echo handler using both HTTP and HTTPS
+	ns := &Net{Stack: topology.Server}
+	handler := NewWebSocketEchoHandler("echo.v1", "echo.v2")
+	httpListener := Must1(ns.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}))
+	tlsConfig := topology.Server.MustNewServerTLSConfig("ws.local")
+	httpsListener := Must1(ns.ListenTLS("tcp", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, tlsConfig))
+	for _, listener := range []net.Listener{httpListener, httpsListener} {
+		server := &http.Server{Handler: handler}
+		defer server.Close()
+		go server.Serve(listener)
+	}
+
+	for _, URL := range []string{"ws://ws.local/", "wss://ws.local/"} {
+		t.Run("we can echo messages using "+URL, func(t *testing.T) {
+			conn, err := DialWebSocket(context.Background(), topology.Client, URL, "echo.v2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if protocol := conn.Config().Protocol; len(protocol) != 1 || protocol[0] != "echo.v2" {
+				t.Fatal("unexpected protocol", protocol)
+			}
+
+			t0 := time.Now()
+			Must0(websocket.Message.Send(conn, "hello"))
+			var text string
+			Must0(websocket.Message.Receive(conn, &text))
+			if text != "hello" {
+				t.Fatal("unexpected text", text)
+			}
+			if elapsed := time.Since(t0); elapsed < 20*time.Millisecond {
+				t.Fatal("the echo should take at least one RTT", elapsed)
+			}
+
+			var msg webSocketMessage
+			Must0(webSocketRawCodec.Send(conn, &webSocketMessage{data: []byte{0, 1, 2}, payloadType: websocket.BinaryFrame}))
+			Must0(webSocketRawCodec.Receive(conn, &msg))
+			if msg.payloadType != websocket.BinaryFrame || string(msg.data) != "\x00\x01\x02" {
+				t.Fatalf("unexpected message %+v", msg)
+			}
+		})
+	}
+
+	t.Run("the handler rejects unknown subprotocols", func(t *testing.T) {
+		conn, err := DialWebSocket(context.Background(), topology.Client, "ws://ws.local/", "chat")
+		if err == nil {
+			conn.Close()
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("we reject unsupported URL schemes", func(t *testing.T) {
+		conn, err := DialWebSocket(context.Background(), topology.Client, "http://ws.local/")
+		if err == nil {
+			conn.Close()
+			t.Fatal("expected an error")
+		}
+	})
+}